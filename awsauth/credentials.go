@@ -0,0 +1,159 @@
+package awsauth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const imdsBase = "http://169.254.169.254/latest"
+
+// Credentials are AWS credentials; SessionToken is set for temporary credentials
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// LookupCredentials returns AWS credentials from the environment
+// (AWS_ACCESS_KEY_ID et al.), the shared credentials file, or the EC2 instance
+// metadata service, in that order. Callers should look credentials up anew
+// for each use; instance role credentials rotate.
+func LookupCredentials() (Credentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return Credentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	creds, found, err := sharedFileCredentials()
+	if err != nil {
+		return Credentials{}, err
+	} else if found {
+		return creds, nil
+	}
+
+	creds, err = instanceCredentials()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("No AWS credentials found in environment or shared credentials file and instance metadata unavailable. Error: %v", err)
+	}
+	return creds, nil
+}
+
+func sharedFileCredentials() (Credentials, bool, error) {
+	credsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credsFile == "" {
+		credsFile = path.Join(os.Getenv("HOME"), ".aws", "credentials")
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(credsFile)
+	if os.IsNotExist(err) {
+		return Credentials{}, false, nil
+	} else if err != nil {
+		return Credentials{}, false, err
+	}
+	defer f.Close()
+
+	var creds Credentials
+	var inProfile bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if !inProfile || len(kv) != 2 {
+			continue
+		}
+
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(kv[1])
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(kv[1])
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(kv[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, false, err
+	}
+
+	return creds, creds.AccessKeyID != "" && creds.SecretAccessKey != "", nil
+}
+
+func instanceCredentials() (Credentials, error) {
+	imdsClient := &http.Client{Timeout: 2 * time.Second}
+
+	// IMDSv2 session token; IMDSv1 is used if the service doesn't issue one
+	var sessionToken string
+	if req, err := http.NewRequest(http.MethodPut, imdsBase+"/api/token", nil); err == nil {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+		if resp, err := imdsClient.Do(req); err == nil {
+			if b, err := ioutil.ReadAll(resp.Body); err == nil && resp.StatusCode == http.StatusOK {
+				sessionToken = string(b)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	get := func(url string) ([]byte, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if sessionToken != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", sessionToken)
+		}
+
+		resp, err := imdsClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Instance metadata service responded with status %v", resp.StatusCode)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	roles, err := get(imdsBase + "/meta-data/iam/security-credentials/")
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	role := strings.TrimSpace(strings.Split(string(roles), "\n")[0])
+	if role == "" {
+		return Credentials{}, fmt.Errorf("No instance role available")
+	}
+
+	content, err := get(imdsBase + "/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var roleCreds struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+	}
+	if err := json.Unmarshal(content, &roleCreds); err != nil {
+		return Credentials{}, err
+	}
+
+	return Credentials{AccessKeyID: roleCreds.AccessKeyID, SecretAccessKey: roleCreds.SecretAccessKey, SessionToken: roleCreds.Token}, nil
+}
@@ -0,0 +1,408 @@
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestFile is the name of the manifest in a bundle, written after the
+// files it lists
+const ManifestFile = "manifest.json"
+
+// Manifest lists the files of the Pkg in a bundle by their paths in it
+type Manifest struct {
+	PkgDir     string `json:"pkgDir"`
+	PkgFile    string `json:"pkgFile"`
+	PkgSigFile string `json:"pkgSigFile"`
+	Files      []File `json:"files"`
+}
+
+// File is a file in a bundle, with its size and SHA-256 hash
+type File struct {
+	Path      string `json:"path"`
+	Bytes     int64  `json:"bytes"`
+	Sha256sum string `json:"sha256sum"`
+}
+
+// Format returns the archive format of the named bundle file, "tar" or
+// "zip", by its extension
+func Format(file string) (string, error) {
+	switch strings.ToLower(path.Ext(file)) {
+	case ".tar":
+		return "tar", nil
+	case ".zip":
+		return "zip", nil
+	}
+	return "", fmt.Errorf("Expected a file name ending in '.tar' or '.zip', got '%s'", file)
+}
+
+// archiveWriter adds files to a tar or zip archive
+type archiveWriter interface {
+	add(name string, size int64, content io.Reader) error
+	Close() error
+}
+
+type tarWriter struct {
+	w *tar.Writer
+}
+
+func (t *tarWriter) add(name string, size int64, content io.Reader) error {
+	if err := t.w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.w, content)
+	return err
+}
+
+func (t *tarWriter) Close() error {
+	return t.w.Close()
+}
+
+type zipWriter struct {
+	w *zip.Writer
+}
+
+func (z *zipWriter) add(name string, size int64, content io.Reader) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Store}
+	header.SetModTime(time.Now())
+	header.SetMode(0644)
+
+	// parts are compressed already
+	w, err := z.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+func (z *zipWriter) Close() error {
+	return z.w.Close()
+}
+
+// Write writes the Pkg's metadata and signature files and the files in its
+// directory (parts that are symbolic links are followed) to a single tar or
+// zip file, as its extension says, for moving the Pkg where it can't be
+// downloaded, e.g. into air-gapped sites. The files are followed by a
+// manifest of their sizes and hashes. The bundle file is replaced only once
+// it's complete.
+func Write(file string, pkgDir string, pkgFile string, pkgSigFile string) (*Manifest, error) {
+	format, err := Format(file)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	dirName := path.Base(path.Clean(pkgDir))
+	sources := map[string]string{}
+	for _, entry := range entries {
+		source := path.Join(pkgDir, entry.Name())
+		if info, err := os.Stat(source); err != nil {
+			return nil, err
+		} else if info.Mode().IsRegular() {
+			sources[path.Join(dirName, entry.Name())] = source
+		}
+	}
+
+	manifest := &Manifest{PkgDir: dirName, PkgFile: path.Base(pkgFile), PkgSigFile: path.Base(pkgSigFile)}
+	names := sortedNames(sources)
+	sources[manifest.PkgFile] = pkgFile
+	sources[manifest.PkgSigFile] = pkgSigFile
+
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var archive archiveWriter
+	if format == "zip" {
+		archive = &zipWriter{zip.NewWriter(tmp)}
+	} else {
+		archive = &tarWriter{tar.NewWriter(tmp)}
+	}
+
+	// the manifest can only be written once the files are hashed, so it's last
+	for _, name := range append([]string{manifest.PkgFile, manifest.PkgSigFile}, names...) {
+		written, err := addFile(archive, name, sources[name])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to add %v to bundle. Error: %v", sources[name], err)
+		}
+		manifest.Files = append(manifest.Files, written)
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := archive.add(ManifestFile, int64(len(content)), strings.NewReader(string(content))); err != nil {
+		return nil, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return nil, err
+	}
+	return manifest, os.Rename(tmp.Name(), file)
+}
+
+// addFile adds the source file to the archive under the given name,
+// hashing it as it's written
+func addFile(archive archiveWriter, name string, source string) (File, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return File{}, err
+	}
+
+	hash := sha256.New()
+	if err := archive.add(name, info.Size(), io.TeeReader(f, hash)); err != nil {
+		return File{}, err
+	}
+	return File{Path: name, Bytes: info.Size(), Sha256sum: fmt.Sprintf("%x", hash.Sum(nil))}, nil
+}
+
+// Extract extracts the Pkg in the bundle file into outputDir and returns
+// the paths of its directory, metadata file, and signature file there. The
+// files are extracted to a temporary directory in outputDir first and moved
+// into place only once they're all there and match the bundle's manifest, so
+// a damaged or incomplete bundle leaves nothing behind. It fails if
+// outputDir already has files of the same names. The Pkg's signature isn't
+// verified.
+func Extract(file string, outputDir string) (string, string, string, error) {
+	format, err := Format(file)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	tmpDir, err := ioutil.TempDir(outputDir, "build-hznpkg-unbundle-")
+	if err != nil {
+		return "", "", "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	extracted := map[string]File{}
+	var manifestContent []byte
+	extract := func(name string, content io.Reader) error {
+		if name == ManifestFile {
+			read, err := ioutil.ReadAll(io.LimitReader(content, 64<<20))
+			manifestContent = read
+			return err
+		}
+
+		if err := checkName(name); err != nil {
+			return err
+		} else if _, exists := extracted[name]; exists {
+			return fmt.Errorf("Bundle has %v more than once", name)
+		}
+
+		written, err := extractFile(path.Join(tmpDir, name), content)
+		if err != nil {
+			return fmt.Errorf("Unable to extract %v. Error: %v", name, err)
+		}
+		written.Path = name
+		extracted[name] = written
+		return nil
+	}
+
+	if format == "zip" {
+		err = walkZip(file, extract)
+	} else {
+		err = walkTar(file, extract)
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if manifestContent == nil {
+		return "", "", "", fmt.Errorf("Bundle has no %v, it may be truncated", ManifestFile)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return "", "", "", fmt.Errorf("Unable to read bundle's %v. Error: %v", ManifestFile, err)
+	}
+	if err := verify(manifest, extracted); err != nil {
+		return "", "", "", err
+	}
+
+	// the metadata is moved last so nothing sees it before the files it refers to
+	moves := []string{manifest.PkgDir, manifest.PkgSigFile, manifest.PkgFile}
+	for _, name := range moves {
+		if _, err := os.Lstat(path.Join(outputDir, name)); err == nil {
+			return "", "", "", fmt.Errorf("%v already exists in %v", name, outputDir)
+		}
+	}
+	for _, name := range moves {
+		if err := os.Rename(path.Join(tmpDir, name), path.Join(outputDir, name)); err != nil {
+			return "", "", "", err
+		}
+	}
+
+	return path.Join(outputDir, manifest.PkgDir), path.Join(outputDir, manifest.PkgFile), path.Join(outputDir, manifest.PkgSigFile), nil
+}
+
+// checkName returns an error unless name is a relative path within the
+// bundle that's either a file or a file in a directory
+func checkName(name string) error {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "../") || name == ".." || strings.Count(name, "/") > 1 {
+		return fmt.Errorf("Unexpected file name %v in bundle", name)
+	}
+	return nil
+}
+
+// extractFile writes the content to the file, creating its directory, and
+// returns its size and hash
+func extractFile(file string, content io.Reader) (File, error) {
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return File{}, err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), content)
+	if err != nil {
+		return File{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return File{}, err
+	}
+	return File{Bytes: n, Sha256sum: fmt.Sprintf("%x", hash.Sum(nil))}, nil
+}
+
+// verify returns an error unless the extracted files are exactly those of
+// the manifest, with the same sizes and hashes, and the manifest names a
+// Pkg directory, metadata file, and signature file among them
+func verify(manifest Manifest, extracted map[string]File) error {
+	if checkName(manifest.PkgDir) != nil || strings.Contains(manifest.PkgDir, "/") {
+		return fmt.Errorf("Unexpected Pkg directory %v in bundle's %v", manifest.PkgDir, ManifestFile)
+	}
+
+	listed := map[string]bool{}
+	for _, f := range manifest.Files {
+		listed[f.Path] = true
+
+		got, exists := extracted[f.Path]
+		if !exists {
+			return fmt.Errorf("Bundle is missing %v listed in its %v", f.Path, ManifestFile)
+		} else if got.Bytes != f.Bytes || got.Sha256sum != f.Sha256sum {
+			return fmt.Errorf("Bundle's %v doesn't match its %v, expected %v bytes with SHA-256 hash %v but got %v bytes with hash %v", f.Path, ManifestFile, f.Bytes, f.Sha256sum, got.Bytes, got.Sha256sum)
+		}
+
+		if strings.Contains(f.Path, "/") && path.Dir(f.Path) != manifest.PkgDir {
+			return fmt.Errorf("Unexpected file %v outside the Pkg directory in bundle", f.Path)
+		}
+	}
+
+	for name := range extracted {
+		if !listed[name] {
+			return fmt.Errorf("Bundle has %v not listed in its %v", name, ManifestFile)
+		}
+	}
+
+	for _, name := range []string{manifest.PkgFile, manifest.PkgSigFile} {
+		if !listed[name] || strings.Contains(name, "/") {
+			return fmt.Errorf("Bundle's %v doesn't list the Pkg metadata and signature files", ManifestFile)
+		}
+	}
+	return nil
+}
+
+// walkTar calls f with the name and content of each regular file in the tar file
+func walkTar(file string, f func(string, io.Reader) error) error {
+	archive, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	r := tar.NewReader(archive)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to read bundle, it may be truncated. Error: %v", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if err := f(header.Name, r); err != nil {
+				return err
+			}
+		case tar.TypeDir:
+		default:
+			return fmt.Errorf("Unexpected entry %v in bundle that isn't a file", header.Name)
+		}
+	}
+}
+
+// walkZip calls f with the name and content of each file in the zip file
+func walkZip(file string, f func(string, io.Reader) error) error {
+	archive, err := zip.OpenReader(file)
+	if err != nil {
+		return fmt.Errorf("Unable to read bundle, it may be truncated. Error: %v", err)
+	}
+	defer archive.Close()
+
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		} else if !entry.Mode().IsRegular() {
+			return fmt.Errorf("Unexpected entry %v in bundle that isn't a file", entry.Name)
+		}
+
+		content, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = f(entry.Name, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedNames(m map[string]string) []string {
+	names := []string{}
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
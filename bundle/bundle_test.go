@@ -0,0 +1,116 @@
+// +build unit
+
+package bundle
+
+import (
+	"archive/tar"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writePkg writes a Pkg with two parts, one a symbolic link, to dir
+func writePkg(t *testing.T, dir string) (string, string, string) {
+	pkgDir := path.Join(dir, "gt-stack")
+	assert.Nil(t, os.Mkdir(pkgDir, 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(pkgDir, "abc.tgz"), []byte("part abc"), 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "def.tgz"), []byte("part def"), 0644))
+	assert.Nil(t, os.Symlink("../def.tgz", path.Join(pkgDir, "def.tgz")))
+
+	pkgFile := path.Join(dir, "gt-stack.json")
+	assert.Nil(t, ioutil.WriteFile(pkgFile, []byte(`{"id":"pkg"}`), 0644))
+	assert.Nil(t, ioutil.WriteFile(pkgFile+".sig", []byte("signature"), 0644))
+	return pkgDir, pkgFile, pkgFile + ".sig"
+}
+
+func Test_Bundle_Suite(suite *testing.T) {
+
+	for _, ext := range []string{".tar", ".zip"} {
+		suite.Run("Extract restores the Pkg written by Write as "+ext, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bundle-")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			pkgDir, pkgFile, pkgSigFile := writePkg(t, dir)
+			file := path.Join(dir, "gt-stack"+ext)
+			manifest, err := Write(file, pkgDir, pkgFile, pkgSigFile)
+			assert.Nil(t, err)
+			assert.Equal(t, 4, len(manifest.Files))
+			assert.Equal(t, "gt-stack/def.tgz", manifest.Files[3].Path)
+
+			out := path.Join(dir, "out")
+			assert.Nil(t, os.Mkdir(out, 0755))
+			extractedDir, extractedFile, extractedSigFile, err := Extract(file, out)
+			assert.Nil(t, err)
+			assert.Equal(t, path.Join(out, "gt-stack"), extractedDir)
+			assert.Equal(t, path.Join(out, "gt-stack.json.sig"), extractedSigFile)
+
+			content, err := ioutil.ReadFile(extractedFile)
+			assert.Nil(t, err)
+			assert.Equal(t, `{"id":"pkg"}`, string(content))
+
+			// the linked part is extracted as a file
+			content, err = ioutil.ReadFile(path.Join(extractedDir, "def.tgz"))
+			assert.Nil(t, err)
+			assert.Equal(t, "part def", string(content))
+
+			_, _, _, err = Extract(file, out)
+			assert.NotNil(t, err)
+
+			// nothing is left behind
+			entries, err := ioutil.ReadDir(out)
+			assert.Nil(t, err)
+			assert.Equal(t, 3, len(entries))
+		})
+	}
+
+	suite.Run("Extract rejects bundles that don't match their manifest", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "bundle-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		bundleOf := func(name string, files map[string]string) string {
+			file := path.Join(dir, name)
+			f, err := os.Create(file)
+			assert.Nil(t, err)
+			defer f.Close()
+
+			w := tar.NewWriter(f)
+			for _, name := range []string{"gt-stack.json", "gt-stack.json.sig", "../escape", "gt-stack/abc.tgz", ManifestFile} {
+				if content, exists := files[name]; exists {
+					w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+					w.Write([]byte(content))
+				}
+			}
+			assert.Nil(t, w.Close())
+			return file
+		}
+
+		manifest := `{"pkgDir":"gt-stack","pkgFile":"gt-stack.json","pkgSigFile":"gt-stack.json.sig","files":[` +
+			`{"path":"gt-stack.json","bytes":12,"sha256sum":"3a2e84dbbc7e1c8a7bb6c8df43a5d7a65d4dfc8ac84ac9d6a4d91fc6fcd1df51"}]}`
+		files := map[string]string{"gt-stack.json": `{"id":"pkg"}`, ManifestFile: manifest}
+
+		_, _, _, err = Extract(bundleOf("mismatch.tar", files), dir)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "doesn't match"), err.Error())
+
+		delete(files, ManifestFile)
+		_, _, _, err = Extract(bundleOf("truncated.tar", files), dir)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "truncated"), err.Error())
+
+		files["../escape"] = "x"
+		_, _, _, err = Extract(bundleOf("escape.tar", files), dir)
+		assert.NotNil(t, err)
+
+		_, err = Format("gt-stack.tgz")
+		assert.NotNil(t, err)
+
+		entries, err := ioutil.ReadDir(dir)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(entries))
+	})
+}
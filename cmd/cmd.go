@@ -0,0 +1,2698 @@
+// Package cmd is the horizon-pkg-build command line tool, which other tools
+// may run as one of their own commands
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/bundle"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/config"
+	"github.com/open-horizon/horizon-pkg-build/create"
+	"github.com/open-horizon/horizon-pkg-build/dockerauth"
+	"github.com/open-horizon/horizon-pkg-build/dockerssh"
+	"github.com/open-horizon/horizon-pkg-build/metrics"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"github.com/open-horizon/horizon-pkg-build/registry"
+	"github.com/open-horizon/horizon-pkg-build/service"
+	"github.com/open-horizon/horizon-pkg-build/upload"
+	"github.com/urfave/cli"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// minDockerAPIVersion is the oldest Docker API version providing the
+	// operations this tool needs (e.g. image repository digests)
+	minDockerAPIVersion = "1.21"
+
+	// minDockerVersion is the Docker release providing minDockerAPIVersion
+	minDockerVersion = "1.9"
+
+	// maxDockerAPIVersion is the newest Docker API version this tool is known to work with
+	maxDockerAPIVersion = "1.40"
+)
+
+// CheckType is a quasi-enum for FS object checking
+type CheckType int
+
+const (
+	// WRITEDIR describes a writable fs directory
+	WRITEDIR CheckType = iota
+
+	// EXISTINGFILE describes a readable file type
+	EXISTINGFILE
+
+	// EXISTINGDIR describes a readable fs directory
+	EXISTINGDIR
+)
+
+func checkAccess(ty CheckType, target string) error {
+	outputCheck, err := os.Stat(target)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to stat %v", target), 2)
+	}
+
+	mode := outputCheck.Mode()
+
+	switch ty {
+	case WRITEDIR, EXISTINGDIR:
+		if !mode.IsDir() {
+			return cli.NewExitError(fmt.Sprintf("Directory path (%v) is unusable", target), 2)
+		}
+	case EXISTINGFILE:
+		if !mode.IsRegular() {
+			return cli.NewExitError(fmt.Sprintf("File (%v) is unusable", target), 2)
+		}
+	default:
+		return fmt.Errorf("Unknown CheckType: %T", ty)
+	}
+
+	return nil
+}
+
+func dockerConnect(reporter *cmdtools.SynchronizedReporter, ctx *cli.Context) (*docker.Client, error) {
+	dockerEndpoint := ctx.String("dockerendpoint")
+	if dockerEndpoint == "" {
+		return nil, cli.NewExitError("Required option 'dockerendpoint' not provided. Use the '--help' option for more information.", 2)
+	}
+
+	reporter.Log.Subsystem(cmdtools.SubsystemDocker).Debugf("Connecting to Docker daemon at: %v", dockerEndpoint)
+	clientEndpoint := dockerEndpoint
+	var sshDialer *dockerssh.Dialer
+	if strings.HasPrefix(dockerEndpoint, "ssh://") {
+		var err error
+		sshDialer, err = dockerssh.NewDialer(dockerEndpoint)
+		if err != nil {
+			return nil, cli.NewExitError(fmt.Sprintf("Docker client could not be set up. Error: %v", err), cmdtools.ExitDocker)
+		}
+		clientEndpoint = dockerssh.TunnelEndpoint
+	}
+
+	newClient := func(apiVersion string) (*docker.Client, error) {
+		var dockerClient *docker.Client
+		var err error
+		if apiVersion == "" {
+			dockerClient, err = docker.NewClient(clientEndpoint)
+		} else {
+			dockerClient, err = docker.NewVersionedClient(clientEndpoint, apiVersion)
+		}
+
+		if err != nil {
+			reporter.Log.Subsystem(cmdtools.SubsystemDocker).Errorf("Docker client setup error: %v", err)
+			return nil, cli.NewExitError("Docker client could not be set up.", cmdtools.ExitDocker)
+		}
+
+		if sshDialer != nil {
+			dockerClient.Dialer = sshDialer
+		}
+		return dockerClient, nil
+	}
+
+	// an unversioned client talks to the daemon in its own API version
+	dockerClient, err := newClient("")
+	if err != nil {
+		return nil, err
+	}
+
+	err = dockerClient.Ping()
+	if err != nil {
+		reporter.Log.Subsystem(cmdtools.SubsystemDocker).Errorf("Endpoint connection error: %v", err)
+		return nil, cli.NewExitError(fmt.Sprintf("Docker endpoint %v Unreachable.", dockerEndpoint), cmdtools.ExitDocker)
+	}
+
+	apiVersion, err := negotiateAPIVersion(reporter, dockerClient)
+	if err != nil {
+		return nil, cli.NewExitError(fmt.Sprintf("Unable to use Docker endpoint %v. Error: %v", dockerEndpoint, err), cmdtools.ExitDocker)
+	}
+
+	dockerClient, err = newClient(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// the negotiated version is known to be supported
+	dockerClient.SkipServerVersionCheck = true
+
+	return dockerClient, nil
+}
+
+// negotiateAPIVersion returns the Docker API version to use with the daemon:
+// the older of the daemon's and the newest this tool knows, or an error if the
+// daemon is too old to support the operations this tool performs
+func negotiateAPIVersion(reporter *cmdtools.SynchronizedReporter, dockerClient *docker.Client) (string, error) {
+	env, err := dockerClient.Version()
+	if err != nil {
+		return "", fmt.Errorf("Unable to query Docker daemon version. Error: %v", err)
+	}
+
+	serverVersion, err := docker.NewAPIVersion(env.Get("ApiVersion"))
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse Docker daemon API version '%v'. Error: %v", env.Get("ApiVersion"), err)
+	}
+
+	minVersion, _ := docker.NewAPIVersion(minDockerAPIVersion)
+	maxVersion, _ := docker.NewAPIVersion(maxDockerAPIVersion)
+
+	if serverVersion.LessThan(minVersion) {
+		return "", fmt.Errorf("Docker daemon version %v supports API version %v but this tool requires API version %v (Docker %v) or newer. Upgrade Docker on the daemon host", env.Get("Version"), serverVersion, minDockerAPIVersion, minDockerVersion)
+	}
+
+	negotiated := serverVersion
+	if maxVersion.LessThan(serverVersion) {
+		negotiated = maxVersion
+
+		// a daemon may have dropped support for older API versions
+		if serverMin, err := docker.NewAPIVersion(env.Get("MinAPIVersion")); err == nil && negotiated.LessThan(serverMin) {
+			reporter.Log.Subsystem(cmdtools.SubsystemDocker).Warnf("Docker daemon version %v no longer supports API version %v; using its minimum API version %v", env.Get("Version"), maxDockerAPIVersion, serverMin)
+			negotiated = serverMin
+		}
+	}
+
+	reporter.Log.Subsystem(cmdtools.SubsystemDocker).Infof("Using Docker API version %v with Docker daemon version %v", negotiated, env.Get("Version"))
+	return negotiated.String(), nil
+}
+
+// registryMirrors parses registry mirror URLs like "https://mirror.example.com"
+// into their hosts and returns those to be contacted over plain HTTP separately
+func registryMirrors(specs []string) ([]string, []string, error) {
+	mirrors := []string{}
+	insecure := []string{}
+
+	for _, spec := range specs {
+		u, err := url.Parse(spec)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return nil, nil, fmt.Errorf("Expected a URL like 'https://mirror.example.com', got %v", spec)
+		}
+
+		mirrors = append(mirrors, u.Host)
+		if u.Scheme == "http" {
+			insecure = append(insecure, u.Host)
+		}
+	}
+
+	return mirrors, insecure, nil
+}
+
+// normalizeImage returns the given image name in the short form the Docker
+// daemon uses, with its implied tag (e.g. "alpine:latest" for
+// "docker.io/library/alpine"); image IDs are returned as-is
+func normalizeImage(image string) (string, error) {
+	if create.IsImageID(image) {
+		return image, nil
+	}
+
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return "", err
+	}
+	return ref.String(), nil
+}
+
+// imagePlatforms returns the platform to use for each of the given images
+// from platform options of the form 'os/arch[/variant]' (the default for all
+// images) or 'image=os/arch[/variant]'.
+func imagePlatforms(images []string, specs []string) (map[string]string, error) {
+	var defaultPlatform string
+	perImage := map[string]string{}
+
+	for _, spec := range specs {
+		var image, platform string
+		if spl := strings.SplitN(spec, "=", 2); len(spl) == 2 {
+			image, platform = spl[0], spl[1]
+		} else {
+			platform = spec
+		}
+
+		if _, err := registry.ParsePlatform(platform); err != nil {
+			return nil, err
+		}
+
+		if normalized, err := normalizeImage(image); image != "" && err == nil {
+			image = normalized
+		}
+
+		if image == "" {
+			defaultPlatform = platform
+		} else {
+			perImage[image] = platform
+		}
+	}
+
+	platforms := map[string]string{}
+	for _, image := range images {
+		if platform, exists := perImage[image]; exists {
+			platforms[image] = platform
+			delete(perImage, image)
+		} else if defaultPlatform != "" {
+			platforms[image] = defaultPlatform
+		}
+	}
+
+	for image := range perImage {
+		return nil, fmt.Errorf("Platform given for image %v which isn't among the images to package", image)
+	}
+
+	return platforms, nil
+}
+
+// imageURLBase splits a 'dockerimage' value of the form 'image@urlbase' into
+// the image and the part URL base (or template) overriding 'parturlbase' for
+// it. Values without one, including images pinned by digest, are returned
+// unchanged with an empty URL base.
+func imageURLBase(spec string) (string, string, error) {
+	sep := strings.LastIndex(spec, "@")
+	if sep < 0 || !strings.Contains(spec[sep+1:], "://") {
+		return spec, "", nil
+	}
+
+	image, urlBase := spec[:sep], spec[sep+1:]
+	if _, err := url.Parse(urlBase); err != nil {
+		return "", "", err
+	} else if err := create.CheckPartURLTemplate(urlBase); err != nil {
+		return "", "", err
+	}
+
+	return image, urlBase, nil
+}
+
+// ociLayouts parses 'path=name:tag' specs into a map of image name to OCI image layout directory
+func ociLayouts(specs []string) (map[string]string, []string, error) {
+	layouts := map[string]string{}
+	images := []string{}
+
+	for _, spec := range specs {
+		spl := strings.SplitN(spec, "=", 2)
+		if len(spl) != 2 || spl[0] == "" || spl[1] == "" {
+			return nil, nil, fmt.Errorf("Expected format 'path=name:tag', got %v", spec)
+		}
+
+		if err := checkAccess(EXISTINGDIR, spl[0]); err != nil {
+			return nil, nil, err
+		}
+
+		image, err := normalizeImage(spl[1])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if _, exists := layouts[image]; exists {
+			return nil, nil, fmt.Errorf("Image %v given more than once", image)
+		}
+
+		layouts[image] = spl[0]
+		images = append(images, image)
+	}
+
+	return layouts, images, nil
+}
+
+// logInterruption warns once the context is done that work in progress is
+// stopping, until stop is called once Run returns
+func logInterruption(ctx context.Context, log *cmdtools.Logger) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Warnf("Interrupted, stopping and removing temporary files")
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// startProfiling starts the CPU profile and the pprof HTTP listener the
+// global options ask for, and returns a function that stops the CPU profile
+// and the listener and writes the memory profile, to be called before
+// returning from Run
+func startProfiling(reporter *cmdtools.SynchronizedReporter, ctx *cli.Context) (func(), error) {
+	var cpuFile *os.File
+	if cpuProfile := sharedString(ctx, "profile-cpu"); cpuProfile != "" {
+		var err error
+		if cpuFile, err = os.Create(cpuProfile); err != nil {
+			return nil, fmt.Errorf("Unable to create CPU profile. Error: %v", err)
+		}
+
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("Unable to start CPU profile. Error: %v", err)
+		}
+	}
+
+	var listener net.Listener
+	if addr := sharedString(ctx, "pprof-addr"); addr != "" {
+		var err error
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			// a CPU profile left running would keep later calls of Run in this process from starting one
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+				cpuFile.Close()
+			}
+			return nil, fmt.Errorf("Unable to listen for pprof requests. Error: %v", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", httppprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+		go http.Serve(listener, mux)
+
+		reporter.Log.Infof("Serving pprof profiles at: http://%v/debug/pprof/", listener.Addr())
+	}
+
+	memProfile := sharedString(ctx, "profile-mem")
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+				cpuFile.Close()
+			}
+
+			// closing the listener stops the server, freeing its address for later calls of Run
+			if listener != nil {
+				listener.Close()
+			}
+
+			if memProfile != "" {
+				if err := writeMemProfile(memProfile); err != nil {
+					reporter.Log.Warnf("Unable to write memory profile. Error: %v", err)
+				}
+			}
+		})
+	}, nil
+}
+
+// writeMemProfile writes a heap profile of the memory in use to the given file
+func writeMemProfile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// up-to-date statistics
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
+
+// createResult is the result of 'create' printed with '--output json'
+type createResult struct {
+	PkgID      string           `json:"pkgId"`
+	PkgName    string           `json:"pkgName"`
+	PkgDir     string           `json:"pkgDir"`
+	PkgFile    string           `json:"pkgFile"`
+	PkgSigFile string           `json:"pkgSigFile"`
+	Bundle     string           `json:"bundle,omitempty"`
+	Parts      []create.PkgPart `json:"parts"`
+	Durations  resultDurations  `json:"durations"`
+}
+
+// resultDurations are the times a command's phases took, in seconds
+type resultDurations struct {
+	Build  float64 `json:"build"`
+	Upload float64 `json:"upload,omitempty"`
+	Total  float64 `json:"total"`
+}
+
+// buildSummary is the summary of a build logged at the end of 'create' and written with '--summary-file'
+type buildSummary struct {
+	Images    []create.ImageSummary `json:"images"`
+	Totals    summaryTotals         `json:"totals"`
+	Stages    []create.StageSummary `json:"stages"`
+	Durations resultDurations       `json:"durations"`
+}
+
+// summaryTotals add up the images of a build summary, counting images packaged as one part once where they share it
+type summaryTotals struct {
+	Images           int     `json:"images"`
+	Parts            int     `json:"parts"`
+	PullSeconds      float64 `json:"pullSeconds"`
+	ExportSeconds    float64 `json:"exportSeconds"`
+	SignSeconds      float64 `json:"signSeconds"`
+	PlaceSeconds     float64 `json:"placeSeconds"`
+	Bytes            int64   `json:"bytes,omitempty"`
+	CompressedBytes  int64   `json:"compressedBytes"`
+	CompressionRatio float64 `json:"compressionRatio,omitempty"`
+}
+
+func newBuildSummary(images []create.ImageSummary, stages []create.StageSummary, durations resultDurations) buildSummary {
+	totals := summaryTotals{Images: len(images)}
+	parts := map[string]bool{}
+	unknownSize := false
+	for _, image := range images {
+		totals.PullSeconds += image.PullSeconds
+		if parts[image.Sha256sum] {
+			continue
+		}
+		parts[image.Sha256sum] = true
+
+		totals.ExportSeconds += image.ExportSeconds
+		totals.SignSeconds += image.SignSeconds
+		totals.PlaceSeconds += image.PlaceSeconds
+		totals.Bytes += image.Bytes
+		totals.CompressedBytes += image.CompressedBytes
+		unknownSize = unknownSize || image.Bytes == 0
+	}
+	totals.Parts = len(parts)
+
+	// a ratio over only some of the parts would mislead
+	if unknownSize {
+		totals.Bytes = 0
+	} else if totals.CompressedBytes > 0 {
+		totals.CompressionRatio = float64(totals.Bytes) / float64(totals.CompressedBytes)
+	}
+
+	return buildSummary{Images: images, Totals: totals, Stages: stages, Durations: durations}
+}
+
+// logBuildSummary logs the summary as a table, a line for each image and one for the totals
+func logBuildSummary(log *cmdtools.Logger, summary buildSummary) {
+	if !log.Enabled(cmdtools.LevelInfo) {
+		return
+	}
+
+	size := func(n int64) string {
+		if n == 0 {
+			return "-"
+		}
+		return cmdtools.FormatByteSize(n)
+	}
+	ratio := func(ratio float64) string {
+		if ratio == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.2fx", ratio)
+	}
+	hash := func(sum string) string {
+		if len(sum) > 12 {
+			return sum[:12]
+		}
+		return sum
+	}
+
+	var table bytes.Buffer
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "IMAGE\tPULL\tEXPORT\tSIGN\tPLACE\tSIZE\tCOMPRESSED\tRATIO\tHASH\tURL\n")
+	for _, image := range summary.Images {
+		fmt.Fprintf(w, "%s\t%.1fs\t%.1fs\t%.1fs\t%.1fs\t%s\t%s\t%s\t%s\t%s\n", image.Image, image.PullSeconds, image.ExportSeconds, image.SignSeconds, image.PlaceSeconds, size(image.Bytes), size(image.CompressedBytes), ratio(image.CompressionRatio), hash(image.Sha256sum), image.URL)
+	}
+	totals := summary.Totals
+	fmt.Fprintf(w, "TOTAL (%d images, %d parts)\t%.1fs\t%.1fs\t%.1fs\t%.1fs\t%s\t%s\t%s\t\t\n", totals.Images, totals.Parts, totals.PullSeconds, totals.ExportSeconds, totals.SignSeconds, totals.PlaceSeconds, size(totals.Bytes), size(totals.CompressedBytes), ratio(totals.CompressionRatio))
+	w.Flush()
+
+	log.Infof("Build summary:")
+	for _, line := range strings.Split(strings.TrimRight(table.String(), "\n"), "\n") {
+		log.Infof("  %s", strings.TrimRight(line, " "))
+	}
+
+	if len(summary.Stages) > 0 {
+		stages := make([]string, len(summary.Stages))
+		for i, stage := range summary.Stages {
+			stages[i] = fmt.Sprintf("%v %.1fs", stage.Stage, stage.Seconds)
+		}
+		log.Infof("Stages took (first image in to last out): %s", strings.Join(stages, ", "))
+	}
+
+	durations := summary.Durations
+	if durations.Upload > 0 {
+		log.Infof("Build took %.1fs, upload %.1fs, %.1fs in all", durations.Build, durations.Upload, durations.Total)
+	} else {
+		log.Infof("Build took %.1fs, %.1fs in all", durations.Build, durations.Total)
+	}
+}
+
+func createAction(reporter *cmdtools.SynchronizedReporter, prompter *cmdtools.Prompter, interrupt context.Context, measured *runMetrics, ctx *cli.Context) error {
+	started := time.Now()
+
+	output := ctx.String("output")
+	if output != "text" && output != "json" {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'output'. Expected 'text' or 'json', got '%v'", output), 2)
+	}
+
+	outputDir := ctx.String("outputdir")
+	if outputDir == "" {
+		return cli.NewExitError("Required option 'outputDir' not provided. Use the '--help' option for more information.", 2)
+	}
+
+	if err := checkAccess(WRITEDIR, outputDir); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error using given output directory: %v", err), 2)
+	}
+
+	tmpDir := ctx.String("tmpdir")
+	if tmpDir != "" {
+		if err := checkAccess(WRITEDIR, tmpDir); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error using given temporary directory: %v", err), 2)
+		}
+	}
+
+	bundleFile := ctx.String("bundle")
+	if bundleFile != "" {
+		if _, err := bundle.Format(bundleFile); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'bundle'. Error: %v", err), 2)
+		} else if err := checkAccess(WRITEDIR, path.Dir(bundleFile)); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'bundle'. Error: %v", err), 2)
+		}
+	}
+
+	pkgName := ctx.String("pkg-name")
+	if pkgName != "" {
+		if err := create.CheckPkgName(pkgName); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'pkg-name'. Error: %v", err), 2)
+		}
+
+		// a stable name is reused by each build, so don't build only to find an earlier one's output in the way
+		if err := create.CheckPkgOutput(outputDir, pkgName); err != nil && !ctx.Bool("force") {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'pkg-name'. Error: %v. Use '--force' to overwrite it", err), 2)
+		}
+	}
+
+	privateKeySource, err := requiredString(prompter, ctx, "privatekey", "PEM-encoded private key file to sign the Pkg with", "")
+	if err != nil {
+		return err
+	} else if privateKeySource == "" {
+		return cli.NewExitError("Required option 'privatekey' not provided. Use the '--help' option for more information.", 2)
+	}
+
+	if cmdtools.IsSecretFile(privateKeySource) {
+		if err := checkAccess(EXISTINGFILE, privateKeySource); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error accessing privateKey: %v", err), 2)
+		}
+	}
+
+	privateKey, err := cmdtools.ReadSecret(privateKeySource)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error accessing privateKey: %v", err), 2)
+	}
+	reporter.Log.Subsystem(cmdtools.SubsystemSign).Debugf("Read private key from: %v", privateKeySource)
+
+	layouts, layoutImages, err := ociLayouts(ctx.StringSlice("oci-layout"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'oci-layout'. Error: %v", err), 2)
+	}
+
+	stdinUsed := ""
+	if privateKeySource == "-" {
+		stdinUsed = "privatekey"
+	}
+	filters, err := imageFilters(ctx)
+	if err != nil {
+		return err
+	}
+
+	specs, err := imageSpecs(ctx, stdinUsed)
+	if err != nil {
+		return err
+	} else if len(specs) == 0 && len(layoutImages) == 0 && len(filters) == 0 {
+		if specs, err = requiredImages(prompter); err != nil {
+			return err
+		}
+	}
+
+	images := []string{}
+	urlBases := map[string]string{}
+	for _, spec := range specs {
+		image, urlBase, err := imageURLBase(spec)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'dockerimage'. Error: %v", err), 2)
+		}
+
+		normalized, err := normalizeImage(image)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'dockerimage'. Error: %v", err), 2)
+		}
+		images = append(images, normalized)
+
+		if urlBase != "" {
+			urlBases[normalized] = urlBase
+		}
+	}
+
+	if len(images) == 0 && len(layoutImages) == 0 && len(filters) == 0 {
+		return cli.NewExitError("Required option(s) 'dockerimage', 'image-filter', or 'oci-layout' not provided. Use the '--help' option for more information", 2)
+	}
+
+	// images read from OCI layouts or another backend don't need the Docker daemon
+	backend := ctx.String("backend")
+	daemon := backend == "" || backend == create.BackendDocker
+	if !daemon && len(filters) > 0 {
+		return cli.NewExitError(fmt.Sprintf("Option 'image-filter' matches local Docker images and can't be used with 'backend' %v", backend), 2)
+	} else if !daemon {
+		for _, image := range images {
+			if create.IsImageID(image) {
+				return cli.NewExitError(fmt.Sprintf("Image %v is referenced by local image ID, which only the Docker daemon knows, and 'backend' is %v. Reference it by tag or digest instead.", image, backend), 2)
+			}
+		}
+	}
+
+	var dockerClient *docker.Client
+	if daemon && (len(images) > 0 || len(filters) > 0) {
+		dockerClient, err = dockerConnect(reporter, ctx)
+		if err != nil {
+			return err // already a cli error
+		}
+	}
+
+	if len(filters) > 0 {
+		if images, err = filteredImages(reporter, dockerClient, filters, images); err != nil {
+			return err
+		}
+	}
+
+	strict := ctx.Bool("strict")
+	if ctx.Bool("forbid-floating-tags") || strict {
+		for _, image := range images {
+			if create.IsFloatingReference(image) {
+				return cli.NewExitError(fmt.Sprintf("Image %v is referenced by tag and option 'forbid-floating-tags' or 'strict' is set. Reference it by digest (e.g. 'repo@sha256:...') or image ID instead.", image), 2)
+			}
+		}
+	}
+	if strict {
+		for _, image := range images {
+			if create.IsImageID(image) {
+				return cli.NewExitError(fmt.Sprintf("Image %v is referenced by local image ID, which has no registry digest to verify it by, and option 'strict' is set. Reference it by digest (e.g. 'repo@sha256:...') instead.", image), 2)
+			}
+		}
+	}
+
+	author, err := requiredString(prompter, ctx, "author", "Email address of the author of the Pkg", defaultAuthor())
+	if err != nil {
+		return err
+	} else if author == "" {
+		return cli.NewExitError("Required option 'author' not provided. Use the '--help' option for more information.", 2)
+	}
+
+	info := create.PkgInfo{Description: ctx.String("description"), Version: ctx.String("pkg-version")}
+	if info.Version != "" {
+		if err := create.CheckPkgVersion(info.Version); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'pkg-version'. Error: %v", err), 2)
+		}
+	}
+
+	info.Labels, err = create.ParseLabels(ctx.StringSlice("label"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'label'. Error: %v", err), 2)
+	}
+
+	uploadParallelism, bwlimit, err := uploadLimits(ctx)
+	if err != nil {
+		return err
+	}
+
+	var uploader upload.Uploader
+	if destination := ctx.String("upload"); destination != "" {
+		credentials, err := uploadCredentials(prompter, ctx)
+		if err != nil {
+			return err
+		}
+		destination, err = uploadDestination(reporter, ctx, destination)
+		if err != nil {
+			return err
+		}
+		uploader, err = upload.New(destination, credentials, bwlimit)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'upload'. Error: %v", err), 2)
+		}
+		if err := checkStrictVerification(ctx); err != nil {
+			return err
+		}
+	}
+
+	var publisher *upload.Publisher
+	if destination := ctx.String("publish"); destination != "" {
+		publisher, err = upload.NewPublisher(destination, bwlimit)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'publish'. Error: %v", err), 2)
+		}
+	}
+
+	presigner, urlMap, err := presignOptions(reporter, ctx, uploader)
+	if err != nil {
+		return err
+	}
+
+	// parts put with a content-addressed uploader have URLs known only once they're put, so they're uploaded as they're created
+	var partDestination create.PartDestination
+	parturlbase := ctx.String("parturlbase")
+	if uploader != nil && upload.ContentAddressed(uploader) {
+		partDestination = uploader
+		if ctx.IsSet("parturlbase") {
+			reporter.Log.Subsystem(cmdtools.SubsystemUpload).Warnf("Option 'parturlbase' is ignored with the given 'upload' destination, parts are recorded by their content's URL")
+		}
+	} else if presigner != nil && urlMap == "" {
+		partDestination = presigner
+		if ctx.IsSet("parturlbase") {
+			reporter.Log.Subsystem(cmdtools.SubsystemUpload).Warnf("Option 'parturlbase' is ignored with 'presign-expiry', parts are recorded by their pre-signed URLs")
+		}
+	} else if uploader != nil && !ctx.IsSet("parturlbase") {
+		parturlbase = upload.BaseURL(uploader)
+		if parturlbase == "" {
+			return cli.NewExitError("Option 'parturlbase' is required with the given 'upload' destination since the URL its content is served from isn't known.", 2)
+		}
+		reporter.Log.Infof("Option 'parturlbase' not set, using the upload destination's URL: %v", parturlbase)
+	}
+
+	if parturlbase == "" {
+		return cli.NewExitError("Required option 'parturlbase' not provided. Use the '--help' option for more information.", 2)
+	} else if _, err := url.Parse(parturlbase); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'parturlbase'. Error: %v", err), 2)
+	} else if err := create.CheckPartURLTemplate(parturlbase); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'parturlbase'. Error: %v", err), 2)
+	}
+
+	if partDestination != nil && len(urlBases) > 0 {
+		reporter.Log.Warnf("Part URL bases given with 'dockerimage' are ignored, parts are recorded by their URLs at the 'upload' destination")
+	}
+
+	// other parts are uploaded as soon as they're built, while the rest of the images are still exported
+	var receipt *upload.Receipt
+	var handoff *upload.Handoff
+	var partHandoff create.PartHandoff
+	if uploader != nil {
+		receipt, err = uploadReceipt(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !upload.ContentAddressed(uploader) && !ctx.Bool("upload-after-build") {
+			handoff = upload.NewHandoff(uploader, reporter.ErrWriter, uploadParallelism, receipt)
+			partHandoff = handoff
+		}
+	}
+
+	var authConfigurations *docker.AuthConfigurations
+	readauthconfig := ctx.Bool("readauthconfig")
+	if !readauthconfig {
+		reporter.Log.Infof("Option 'readauthconfig' not set, proceeding without credentials from Docker configuration files.")
+	} else {
+		var err error
+		authConfigurations, err = dockerauth.NewAuthConfigurations(dockerauth.Registries(images), reporter.Log)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to read authentication information from Docker configuration files or credential helpers. Set DOCKER_CONFIG envvar to a configuration file path or put a proper Docker configuration file in one its common locations. Error: %v", err), 2)
+		}
+	}
+
+	registryAuths, err := dockerauth.ParseRegistryAuths(ctx.StringSlice("registry-auth"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'registry-auth'. Error: %v", err), 2)
+	}
+
+	mirrors, insecureMirrors, err := registryMirrors(ctx.StringSlice("registry-mirror"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'registry-mirror'. Error: %v", err), 2)
+	}
+
+	insecureRegistries := append(ctx.StringSlice("insecure-registry"), insecureMirrors...)
+	for _, host := range insecureRegistries {
+		if host == "" || strings.ContainsAny(host, "/@") {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'insecure-registry'. Expected format 'host:port', got %v", host), 2)
+		}
+
+		reporter.Log.Subsystem(cmdtools.SubsystemDocker).Warnf("INSECURE: Registry %v will be contacted without TLS certificate verification or over plain HTTP; images and credentials exchanged with it may be intercepted or tampered with. The Docker daemon must also list it among its insecure registries to pull from it.", host)
+	}
+
+	var ecrAuthenticator *dockerauth.ECRAuthenticator
+	if ctx.Bool("ecr-auth") {
+		ecrAuthenticator = dockerauth.NewECRAuthenticator()
+	}
+
+	authResolver := dockerauth.NewResolver(registryAuths, ecrAuthenticator, authConfigurations)
+	authResolver.SetLogger(reporter.Log.Subsystem(cmdtools.SubsystemDocker))
+
+	platforms, err := imagePlatforms(append(images, layoutImages...), ctx.StringSlice("platform"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'platform'. Error: %v", err), 2)
+	}
+
+	resolvedImages, err := create.ResolveImageIDs(dockerClient, images, ctx.Bool("allow-dangling-images"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+
+	// image IDs are packaged under their full ID
+	for i, image := range images {
+		if platform, exists := platforms[image]; exists && image != resolvedImages[i] {
+			delete(platforms, image)
+			platforms[resolvedImages[i]] = platform
+		}
+		if urlBase, exists := urlBases[image]; exists && image != resolvedImages[i] {
+			delete(urlBases, image)
+			urlBases[resolvedImages[i]] = urlBase
+		}
+	}
+	images = append(resolvedImages, layoutImages...)
+
+	skippull := ctx.Bool("skippull")
+	if skippull {
+		reporter.Log.Subsystem(cmdtools.SubsystemDocker).Infof("Option 'skippull' set, this tool will now skip performing a Docker pull from target registry")
+	}
+
+	registryClient := registry.NewClient(authResolver, insecureRegistries, mirrors)
+
+	tmpBaseDir := tmpDir
+	if tmpBaseDir == "" {
+		tmpBaseDir = outputDir
+	}
+	exporter, err := create.NewExporter(backend, registryClient, skippull, tmpBaseDir)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'backend'. Error: %v", err), 2)
+	}
+	defer exporter.Close()
+	reporter.Log.Subsystem(cmdtools.SubsystemDocker).Infof("Reading Docker images from: %v", exporter)
+
+	// a nil *docker.Client would be an ImageSource that isn't nil
+	var client create.ImageSource
+	if dockerClient != nil {
+		client = dockerClient
+	}
+
+	policy := create.ImagePolicy{AllowedRegistries: ctx.StringSlice("allowed-registry"), RequireCredentials: ctx.Bool("strict")}
+	if maxImageSize := ctx.String("max-image-size"); maxImageSize != "" {
+		policy.MaxSize, err = cmdtools.ParseByteSize(maxImageSize)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'max-image-size'. Error: %v", err), 2)
+		}
+	}
+
+	cacheDir := ctx.String("cache-dir")
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to create part cache directory. Error: %v", err), 2)
+		}
+
+		if err := checkAccess(WRITEDIR, cacheDir); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error using given part cache directory: %v", err), 2)
+		}
+	}
+
+	maxRetries := ctx.Int("max-retries")
+	if maxRetries < 0 {
+		return cli.NewExitError("Option 'max-retries' must not be negative.", 2)
+	}
+
+	pullParallelism := ctx.Int("pull-parallelism")
+	exportParallelism := ctx.Int("export-parallelism")
+	signParallelism := ctx.Int("sign-parallelism")
+	placeParallelism := ctx.Int("place-parallelism")
+	maxParallel := ctx.Int("max-parallel")
+	if pullParallelism < 0 || exportParallelism < 0 || signParallelism < 0 || placeParallelism < 0 || maxParallel < 0 {
+		return cli.NewExitError("Options 'pull-parallelism', 'export-parallelism', 'sign-parallelism', 'place-parallelism', and 'max-parallel' must not be negative.", 2)
+	}
+
+	pullTimeout := ctx.Duration("pull-timeout")
+	exportTimeout := ctx.Duration("export-timeout")
+	timeout := ctx.Duration("timeout")
+	if pullTimeout < 0 || exportTimeout < 0 || timeout < 0 {
+		return cli.NewExitError("Options 'pull-timeout', 'export-timeout', and 'timeout' must not be negative.", 2)
+	}
+
+	daemonCalls := ctx.Int("docker-max-calls")
+	daemonCallInterval := ctx.Duration("docker-call-interval")
+	if daemonCalls < 0 || daemonCallInterval < 0 {
+		return cli.NewExitError("Options 'docker-max-calls' and 'docker-call-interval' must not be negative.", 2)
+	}
+
+	ioBufferSize := int64(create.DefaultIOBufferSize)
+	if size := ctx.String("io-buffer-size"); size != "" {
+		ioBufferSize, err = cmdtools.ParseByteSize(size)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'io-buffer-size'. Error: %v", err), 2)
+		}
+	}
+	if ioBufferSize < create.MinIOBufferSize || ioBufferSize > create.MaxIOBufferSize {
+		return cli.NewExitError(fmt.Sprintf("Option 'io-buffer-size' must be between %v and %v.", cmdtools.FormatByteSize(create.MinIOBufferSize), cmdtools.FormatByteSize(create.MaxIOBufferSize)), 2)
+	}
+	reporter.Log.Debugf("Using I/O buffer size: %v", cmdtools.FormatByteSize(ioBufferSize))
+
+	compression := ctx.String("compression")
+	if err := create.ValidCompression(compression); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'compression'. Error: %v", err), 2)
+	}
+
+	compressor, err := create.NewCompressor(ctx.String("compressor"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'compressor'. Error: %v", err), 2)
+	}
+
+	partLink := ctx.String("link-duplicate-parts")
+	if err := create.ValidPartLink(partLink); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'link-duplicate-parts'. Error: %v", err), 2)
+	}
+
+	reporter.DelegateErrorConsumer(func(e cmdtools.DelegateError) {
+		reporter.Log.Errorf("Error creating new Pkg: %v", e.Error())
+	})
+
+	// do the work; any breaking errors will cause DelegateErrorConsumer call its function handler
+	buildStarted := time.Now()
+	imageSummaries := create.NewBuildSummary()
+	// the whole command's budget started with it
+	var buildCtx context.Context = interrupt
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		buildCtx, cancel = context.WithDeadline(interrupt, started.Add(timeout))
+		defer cancel()
+	}
+
+	builder, err := create.NewBuilder(reporter, create.Options{
+		Client:             client,
+		Exporter:           exporter,
+		Manifests:          registryClient,
+		RetryPolicy:        cmdtools.NewRetryPolicy(maxRetries),
+		SkipPullIfExists:   skippull,
+		AuthResolver:       authResolver,
+		Mirrors:            mirrors,
+		Policy:             policy,
+		CacheDir:           cacheDir,
+		PullParallelism:    pullParallelism,
+		ExportParallelism:  exportParallelism,
+		MaxParallel:        maxParallel,
+		SignParallelism:    signParallelism,
+		PlaceParallelism:   placeParallelism,
+		PullTimeout:        pullTimeout,
+		ExportTimeout:      exportTimeout,
+		DaemonCalls:        daemonCalls,
+		DaemonCallInterval: daemonCallInterval,
+		IOBufferSize:       int(ioBufferSize),
+		Compression:        compression,
+		Compressor:         compressor,
+		CheckSpace:         ctx.BoolT("disk-space-check"),
+		Resume:             ctx.Bool("resume"),
+		KeepTmpOnError:     ctx.Bool("keep-tempfiles-on-error"),
+		Platforms:          platforms,
+		OCILayouts:         layouts,
+		OutputDir:          outputDir,
+		TmpDir:             tmpDir,
+		Author:             author,
+		Info:               info,
+		PrivateKey:         privateKey,
+		URLBase:            parturlbase,
+		URLBases:           urlBases,
+		PartDestination:    partDestination,
+		PartHandoff:        partHandoff,
+		Summary:            imageSummaries,
+		PkgName:            pkgName,
+		Force:              ctx.Bool("force"),
+	})
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to set up Pkg builder. Error: %v", err), 2)
+	}
+
+	built, buildErr := builder.Build(buildCtx, images)
+	if interrupt.Err() != nil {
+		return cli.NewExitError("Interrupted, Pkg not created", cmdtools.ExitInterrupted)
+	} else if buildCtx.Err() != nil {
+		return cli.NewExitError(fmt.Sprintf("Timed out after %v, Pkg not created", timeout), cmdtools.ExitTimeout)
+	}
+
+	var delegateError error
+	var permDir, pkgFile, pkgSigFile string
+	var e *create.BuildError
+	if errors.As(buildErr, &e) {
+		delegateError = cli.NewExitError("Failed to create Pkg", e.Code)
+	} else if buildErr != nil {
+		delegateError = cli.NewExitError(fmt.Sprintf("Failed to create Pkg. Error: %v", buildErr), 3)
+	} else {
+		permDir, pkgFile, pkgSigFile = built.PkgDir, built.PkgFile, built.PkgSigFile
+	}
+	durations := resultDurations{Build: time.Since(buildStarted).Seconds()}
+
+	if delegateError == nil {
+		reporter.Log.Infof("Pkg content preparation finished. Temporary files removed and pkg content written to %v", permDir)
+
+		// a failure here leaves the Pkg whole, just larger on disk
+		if linked, saved, err := create.LinkDuplicateParts(permDir, partLink); err != nil {
+			reporter.Log.Warnf("Unable to link parts identical to those of other Pkgs in %v. Error: %v", outputDir, err)
+		} else if linked > 0 {
+			reporter.Log.Infof("Linked %v parts identical to those of other Pkgs in %v, saving %v", linked, outputDir, cmdtools.FormatByteSize(saved))
+		}
+
+		if err := create.WriteChecksums(permDir, pkgFile, pkgSigFile, ctx.Bool("checksum-sidecars")); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to write Pkg checksums. Error: %v", err), 3)
+		}
+		reporter.Log.Infof("Wrote SHA-256 checksums of pkg files to: %v", path.Join(permDir, cmdtools.ChecksumsFile))
+
+		if bundleFile != "" {
+			manifest, err := bundle.Write(bundleFile, permDir, pkgFile, pkgSigFile)
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("Failed to write Pkg bundle. Error: %v", err), 3)
+			}
+			reporter.Log.Infof("Wrote bundle of %v pkg files to: %v", len(manifest.Files), bundleFile)
+		}
+
+		if uploader != nil {
+			// an upload isn't cancelled by the timeout once started, only if interrupted, but a build that used up its time isn't uploaded
+			if timeout > 0 && time.Since(started) > timeout {
+				return cli.NewExitError(fmt.Sprintf("Timed out after %v, Pkg created in %v but not uploaded", timeout, permDir), cmdtools.ExitTimeout)
+			}
+
+			uploadStarted := time.Now()
+			if err := uploadPkg(ctx, reporter, interrupt, measured, uploader, handoff, receipt, permDir, pkgFile, pkgSigFile, uploadParallelism); err != nil {
+				return err
+			}
+
+			if err := verifyUpload(ctx, reporter, interrupt, uploader, presigner, nil, permDir, pkgFile, pkgSigFile); err != nil {
+				return err
+			}
+			durations.Upload = time.Since(uploadStarted).Seconds()
+		}
+
+		if urlMap != "" {
+			if err := upload.WriteURLMap(presigner, urlMap, permDir, pkgFile, pkgSigFile); err != nil {
+				return cli.NewExitError(fmt.Sprintf("Failed to write pre-signed URL map. Error: %v", err), 3)
+			}
+			reporter.Log.Infof("Wrote pre-signed URLs to: %v", urlMap)
+		}
+
+		durations.Total = time.Since(started).Seconds()
+		summary := newBuildSummary(imageSummaries.Images(), imageSummaries.Stages(), durations)
+		measured.summary = &summary
+		logBuildSummary(reporter.Log, summary)
+		if summaryFile := ctx.String("summary-file"); summaryFile != "" {
+			content, err := json.MarshalIndent(summary, "", "  ")
+			if err == nil {
+				err = ioutil.WriteFile(summaryFile, append(content, '\n'), 0644)
+			}
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("Failed to write build summary. Error: %v", err), 3)
+			}
+			reporter.Log.Infof("Wrote build summary to: %v", summaryFile)
+		}
+
+		if output == "json" {
+			parts, err := create.ReadPkgParts(pkgFile, permDir)
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("Failed to read parts of Pkg metadata. Error: %v", err), 3)
+			}
+
+			result, err := json.Marshal(createResult{PkgID: built.PkgID, PkgName: built.PkgName, PkgDir: permDir, PkgFile: pkgFile, PkgSigFile: pkgSigFile, Bundle: bundleFile, Parts: parts, Durations: durations})
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("Failed to serialize result. Error: %v", err), 3)
+			}
+			fmt.Fprintf(reporter.OutWriter, "%s\n", result)
+		} else {
+			fmt.Fprintf(reporter.OutWriter, "%v %v %v\n", permDir, pkgFile, pkgSigFile)
+		}
+	}
+
+	// a failed build leaves nothing of its own in the output directory, but Pkgs built before are published anyway if asked
+	if publisher != nil && (delegateError == nil || !ctx.BoolT("publish-only-on-success")) {
+		if err := publisher.Publish(interrupt, outputDir, reporter.ErrWriter); interrupt.Err() != nil {
+			return cli.NewExitError("Interrupted, output directory not published", cmdtools.ExitInterrupted)
+		} else if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to publish output directory. Error: %v", err), cmdtools.ExitPublish)
+		}
+	}
+	return delegateError
+}
+
+func uploadAction(reporter *cmdtools.SynchronizedReporter, prompter *cmdtools.Prompter, interrupt context.Context, measured *runMetrics, ctx *cli.Context) error {
+	pkgFile, err := requiredString(prompter, ctx, "pkg", "Pkg metadata file to upload", defaultPkgFile())
+	if err != nil {
+		return err
+	} else if pkgFile == "" {
+		return cli.NewExitError("Required option 'pkg' not provided. Use the '--help' option for more information.", 2)
+	}
+
+	// the Pkg's parts are in the directory named for the Pkg ID next to its metadata file
+	pkgDir := strings.TrimSuffix(pkgFile, ".json")
+	pkgSigFile := pkgFile + ".sig"
+
+	if err := checkAccess(EXISTINGFILE, pkgFile); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error accessing Pkg metadata file: %v", err), 2)
+	} else if err := checkAccess(EXISTINGFILE, pkgSigFile); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error accessing Pkg signature file: %v", err), 2)
+	} else if err := checkAccess(EXISTINGDIR, pkgDir); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error accessing Pkg parts directory: %v", err), 2)
+	}
+
+	target, err := uploadTargetOptions(reporter, prompter, ctx)
+	if err != nil {
+		return err
+	}
+
+	return uploadToTarget(ctx, reporter, interrupt, measured, target, false, pkgDir, pkgFile, pkgSigFile)
+}
+
+func mirrorAction(reporter *cmdtools.SynchronizedReporter, prompter *cmdtools.Prompter, interrupt context.Context, measured *runMetrics, ctx *cli.Context) error {
+	pkgURL, err := requiredString(prompter, ctx, "pkgurl", "URL of the Pkg metadata file to mirror (e.g. 'https://host/path/<pkg ID>.json')", "")
+	if err != nil {
+		return err
+	} else if pkgURL == "" {
+		return cli.NewExitError("Required option 'pkgurl' not provided. Use the '--help' option for more information.", 2)
+	}
+
+	target, err := uploadTargetOptions(reporter, prompter, ctx)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "hznpkg-mirror-")
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to create temporary directory. Error: %v", err), 3)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgDir, pkgFile, pkgSigFile, err := upload.FetchPkg(interrupt, reporter.ErrWriter, pkgURL, dir)
+	if interrupt.Err() != nil {
+		return cli.NewExitError("Interrupted, Pkg not mirrored", cmdtools.ExitInterrupted)
+	} else if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to fetch Pkg. Error: %v", err), cmdtools.ExitPublish)
+	}
+
+	return uploadToTarget(ctx, reporter, interrupt, measured, target, true, pkgDir, pkgFile, pkgSigFile)
+}
+
+// uploadTarget is where and how the 'upload' and 'mirror' commands upload a Pkg
+type uploadTarget struct {
+	uploader    upload.Uploader
+	parallelism int
+	presigner   *upload.Presigner
+	urlMap      string
+	receipt     *upload.Receipt
+}
+
+// uploadTargetOptions returns the upload target given with the options the
+// 'upload' and 'mirror' commands share
+func uploadTargetOptions(reporter *cmdtools.SynchronizedReporter, prompter *cmdtools.Prompter, ctx *cli.Context) (uploadTarget, error) {
+	destination, err := requiredString(prompter, ctx, "upload", "Destination to upload the Pkg to (e.g. 's3://bucket/prefix')", "")
+	if err != nil {
+		return uploadTarget{}, err
+	} else if destination == "" {
+		return uploadTarget{}, cli.NewExitError("Required option 'upload' not provided. Use the '--help' option for more information.", 2)
+	}
+
+	uploadParallelism, bwlimit, err := uploadLimits(ctx)
+	if err != nil {
+		return uploadTarget{}, err
+	}
+
+	credentials, err := uploadCredentials(prompter, ctx)
+	if err != nil {
+		return uploadTarget{}, err
+	}
+
+	destination, err = uploadDestination(reporter, ctx, destination)
+	if err != nil {
+		return uploadTarget{}, err
+	}
+
+	uploader, err := upload.New(destination, credentials, bwlimit)
+	if err != nil {
+		return uploadTarget{}, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'upload'. Error: %v", err), 2)
+	}
+	if err := checkStrictVerification(ctx); err != nil {
+		return uploadTarget{}, err
+	}
+
+	// the metadata is signed already, so pre-signed URLs can only go in a map
+	presigner, urlMap, err := presignOptions(reporter, ctx, uploader)
+	if err != nil {
+		return uploadTarget{}, err
+	} else if presigner != nil && urlMap == "" {
+		return uploadTarget{}, cli.NewExitError("Option 'presign-expiry' requires option 'presign-url-map' when uploading a Pkg created earlier.", 2)
+	}
+
+	receipt, err := uploadReceipt(ctx)
+	if err != nil {
+		return uploadTarget{}, err
+	}
+
+	return uploadTarget{uploader: uploader, parallelism: uploadParallelism, presigner: presigner, urlMap: urlMap, receipt: receipt}, nil
+}
+
+// uploadToTarget uploads and verifies the Pkg, writes the map of pre-signed
+// URLs if one was asked for, and prints the URL of the uploaded metadata.
+// A mirrored Pkg is verified at the target's URLs, not those its metadata
+// records, which are the original's.
+func uploadToTarget(ctx *cli.Context, reporter *cmdtools.SynchronizedReporter, interrupt context.Context, measured *runMetrics, target uploadTarget, mirrored bool, pkgDir string, pkgFile string, pkgSigFile string) error {
+	if err := uploadPkg(ctx, reporter, interrupt, measured, target.uploader, nil, target.receipt, pkgDir, pkgFile, pkgSigFile, target.parallelism); err != nil {
+		return err
+	}
+
+	var fileURL func(string) string
+	if mirrored {
+		fileURL = target.uploader.URL
+	}
+	if err := verifyUpload(ctx, reporter, interrupt, target.uploader, target.presigner, fileURL, pkgDir, pkgFile, pkgSigFile); err != nil {
+		return err
+	}
+
+	if target.urlMap != "" {
+		if err := upload.WriteURLMap(target.presigner, target.urlMap, pkgDir, pkgFile, pkgSigFile); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to write pre-signed URL map. Error: %v", err), 3)
+		}
+		reporter.Log.Infof("Wrote pre-signed URLs to: %v", target.urlMap)
+	}
+
+	fmt.Fprintf(reporter.OutWriter, "%v\n", target.uploader.URL(path.Base(pkgFile)))
+	return nil
+}
+
+// uploadReceipt returns the receipt loaded from the 'upload-receipt' file, if given
+func uploadReceipt(ctx *cli.Context) (*upload.Receipt, error) {
+	receiptFile := ctx.String("upload-receipt")
+	if receiptFile == "" {
+		return nil, nil
+	}
+
+	receipt, err := upload.LoadReceipt(receiptFile)
+	if err != nil {
+		return nil, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'upload-receipt'. Error: %v", err), 2)
+	}
+	return receipt, nil
+}
+
+// uploadPkg uploads the Pkg, or the rest of it if its parts were handed off
+// as they were built, skipping files the receipt from the 'upload-receipt'
+// file, if given, records as uploaded unchanged, and records the files
+// uploaded in it. The receipt is written even if the upload fails or is
+// interrupted so a later run can continue.
+func uploadPkg(ctx *cli.Context, reporter *cmdtools.SynchronizedReporter, interrupt context.Context, measured *runMetrics, uploader upload.Uploader, handoff *upload.Handoff, receipt *upload.Receipt, pkgDir string, pkgFile string, pkgSigFile string, parallelism int) error {
+	receiptFile := ctx.String("upload-receipt")
+
+	var uploaded int64
+	var uploadErr error
+	if handoff != nil {
+		uploaded, uploadErr = handoff.Pkg(interrupt, pkgDir, pkgFile, pkgSigFile)
+	} else {
+		uploaded, uploadErr = upload.Pkg(interrupt, uploader, reporter.ErrWriter, pkgDir, pkgFile, pkgSigFile, parallelism, receipt)
+	}
+	measured.uploaded += uploaded
+
+	if receipt != nil {
+		if err := receipt.Save(receiptFile); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to write upload receipt. Error: %v", err), 3)
+		}
+		reporter.Log.Infof("Wrote upload receipt to: %v", receiptFile)
+	}
+
+	if interrupt.Err() != nil {
+		return cli.NewExitError("Interrupted, Pkg not uploaded", cmdtools.ExitInterrupted)
+	} else if uploadErr != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to upload Pkg. Error: %v", uploadErr), cmdtools.ExitPublish)
+	}
+	return nil
+}
+
+func unbundleAction(reporter *cmdtools.SynchronizedReporter, ctx *cli.Context) error {
+	bundleFile := ctx.String("bundle")
+	if bundleFile == "" {
+		return cli.NewExitError("Required option 'bundle' not provided. Use the '--help' option for more information.", 2)
+	} else if _, err := bundle.Format(bundleFile); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'bundle'. Error: %v", err), 2)
+	} else if err := checkAccess(EXISTINGFILE, bundleFile); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'bundle'. Error: %v", err), 2)
+	}
+
+	outputDir := ctx.String("outputdir")
+	if err := checkAccess(WRITEDIR, outputDir); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error using given output directory: %v", err), 2)
+	}
+
+	pkgDir, pkgFile, pkgSigFile, err := bundle.Extract(bundleFile, outputDir)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to extract Pkg bundle. Error: %v", err), 3)
+	}
+	reporter.Log.Infof("Extracted and verified Pkg bundle %v to: %v", bundleFile, pkgDir)
+
+	fmt.Fprintf(reporter.OutWriter, "%v %v %v\n", pkgDir, pkgFile, pkgSigFile)
+	return nil
+}
+
+func estimateAction(reporter *cmdtools.SynchronizedReporter, prompter *cmdtools.Prompter, interrupt context.Context, ctx *cli.Context) error {
+	filters, err := imageFilters(ctx)
+	if err != nil {
+		return err
+	}
+
+	specs, err := imageSpecs(ctx, "")
+	if err != nil {
+		return err
+	} else if len(specs) == 0 && len(filters) == 0 {
+		if specs, err = requiredImages(prompter); err != nil {
+			return err
+		}
+	}
+
+	images := []string{}
+	for _, image := range specs {
+		normalized, err := normalizeImage(image)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'dockerimage'. Error: %v", err), 2)
+		}
+		images = append(images, normalized)
+	}
+
+	if len(images) == 0 && len(filters) == 0 {
+		return cli.NewExitError("Required option(s) 'dockerimage' or 'image-filter' not provided. Use the '--help' option for more information.", 2)
+	}
+
+	sampleSize, err := cmdtools.ParseByteSize(ctx.String("sample-size"))
+	if err != nil || sampleSize <= 0 {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'sample-size', expected a positive size like '64MiB'. Error: %v", err), 2)
+	}
+
+	exportParallelism := ctx.Int("export-parallelism")
+	if exportParallelism < 0 {
+		return cli.NewExitError("Option 'export-parallelism' must not be negative.", 2)
+	}
+
+	compressor, err := create.NewCompressor(ctx.String("compressor"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'compressor'. Error: %v", err), 2)
+	}
+
+	dockerClient, err := dockerConnect(reporter, ctx)
+	if err != nil {
+		return err // already a cli error
+	}
+
+	if len(filters) > 0 {
+		if images, err = filteredImages(reporter, dockerClient, filters, images); err != nil {
+			return err
+		}
+	}
+
+	// sampled one at a time so the throughput measured is an export's own
+	estimates := []create.PartEstimate{}
+	var uncompressed, pkgSize int64
+	for _, image := range images {
+		reporter.Log.Subsystem(cmdtools.SubsystemCompress).Infof("Sampling up to %v of the export of Docker image: %v", cmdtools.FormatByteSize(sampleSize), image)
+
+		estimate, err := create.EstimatePart(interrupt, dockerClient, compressor, image, sampleSize)
+		if interrupt.Err() != nil {
+			return cli.NewExitError("Interrupted, estimate not finished", cmdtools.ExitInterrupted)
+		} else if err != nil {
+			code := 3
+			if _, ok := err.(create.ImageError); ok {
+				code = 2
+			}
+			return cli.NewExitError(fmt.Sprintf("Unable to estimate the part of Docker image %v. Error: %v", image, err), code)
+		}
+
+		reporter.Log.Subsystem(cmdtools.SubsystemCompress).Infof("Docker image %v of %v: part of about %v, exported in about %v", image, cmdtools.FormatByteSize(estimate.Size), cmdtools.FormatByteSize(estimate.PartSize), estimate.ExportTime.Round(time.Second))
+		fmt.Fprintf(reporter.OutWriter, "%v %v %v %.0f\n", image, estimate.Size, estimate.PartSize, estimate.ExportTime.Seconds())
+
+		estimates = append(estimates, estimate)
+		uncompressed += estimate.Size
+		pkgSize += estimate.PartSize
+	}
+
+	buildTime := create.EstimateBuildTime(estimates, exportParallelism)
+	reporter.Log.Subsystem(cmdtools.SubsystemCompress).Infof("Estimated Pkg size: %v (from %v of images); estimated export time: %v", cmdtools.FormatByteSize(pkgSize), cmdtools.FormatByteSize(uncompressed), buildTime.Round(time.Second))
+	fmt.Fprintf(reporter.OutWriter, "total %v %v %.0f\n", uncompressed, pkgSize, buildTime.Seconds())
+	return nil
+}
+
+// serviceConfig returns the configuration of a build service from the
+// options of a 'serve-*' command, whose options of jobs are named with the
+// given prefix (e.g. 'api-signing-key')
+func serviceConfig(reporter *cmdtools.SynchronizedReporter, ctx *cli.Context, prefix string) (service.Config, error) {
+	outputDir := ctx.String("outputdir")
+	if outputDir == "" {
+		return service.Config{}, cli.NewExitError("Required option 'outputDir' not provided. Use the '--help' option for more information.", 2)
+	} else if err := checkAccess(WRITEDIR, outputDir); err != nil {
+		return service.Config{}, cli.NewExitError(fmt.Sprintf("Error using given output directory: %v", err), 2)
+	}
+
+	tmpDir := ctx.String("tmpdir")
+	if tmpDir != "" {
+		if err := checkAccess(WRITEDIR, tmpDir); err != nil {
+			return service.Config{}, cli.NewExitError(fmt.Sprintf("Error using given temporary directory: %v", err), 2)
+		}
+	}
+
+	keyFlag := prefix + "-signing-key"
+	keys := map[string][]byte{}
+	for _, spec := range ctx.StringSlice(keyFlag) {
+		spl := strings.SplitN(spec, "=", 2)
+		if len(spl) != 2 || spl[0] == "" || spl[1] == "" || spl[1] == "-" {
+			return service.Config{}, cli.NewExitError(fmt.Sprintf("Unable to use provided value for '%v'. Expected format 'name=key', got %v", keyFlag, spec), 2)
+		}
+
+		key, err := cmdtools.ReadSecret(spl[1])
+		if err != nil {
+			return service.Config{}, cli.NewExitError(fmt.Sprintf("Unable to use provided value for '%v'. Error accessing key %v: %v", keyFlag, spl[0], err), 2)
+		}
+		keys[spl[0]] = key
+	}
+	if len(keys) == 0 {
+		return service.Config{}, cli.NewExitError(fmt.Sprintf("Required option '%v' not provided. Use the '--help' option for more information.", keyFlag), 2)
+	}
+
+	destinationFlag := prefix + "-destination"
+	destinations := ctx.StringSlice(destinationFlag)
+	for _, destination := range destinations {
+		if _, err := upload.BackendOf(destination); err != nil {
+			return service.Config{}, cli.NewExitError(fmt.Sprintf("Unable to use provided value for '%v'. Error: %v", destinationFlag, err), 2)
+		}
+	}
+
+	jobsFlag := prefix + "-jobs"
+	jobs := ctx.Int(jobsFlag)
+	if jobs < 1 {
+		return service.Config{}, cli.NewExitError(fmt.Sprintf("Option '%v' must be at least 1.", jobsFlag), 2)
+	}
+
+	if parturlbase := ctx.String("parturlbase"); parturlbase != "" {
+		if err := create.CheckPartURLTemplate(parturlbase); err != nil {
+			return service.Config{}, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'parturlbase'. Error: %v", err), 2)
+		}
+	}
+
+	uploadParallelism, bwlimit, err := uploadLimits(ctx)
+	if err != nil {
+		return service.Config{}, err
+	}
+	credentials := upload.Credentials{SSHIdentity: ctx.String("upload-identity"), Username: ctx.String("upload-user"), Password: ctx.String("upload-password")}
+
+	var authConfigurations *docker.AuthConfigurations
+	if ctx.Bool("readauthconfig") {
+		// the registries of the images jobs will ask for aren't known, so credential helpers aren't consulted
+		authConfigurations, err = dockerauth.NewAuthConfigurations(nil, reporter.Log)
+		if err != nil {
+			return service.Config{}, cli.NewExitError(fmt.Sprintf("Unable to read authentication information from Docker configuration files. Error: %v", err), 2)
+		}
+	}
+
+	registryAuths, err := dockerauth.ParseRegistryAuths(ctx.StringSlice("registry-auth"))
+	if err != nil {
+		return service.Config{}, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'registry-auth'. Error: %v", err), 2)
+	}
+
+	authResolver := dockerauth.NewResolver(registryAuths, nil, authConfigurations)
+	authResolver.SetLogger(reporter.Log.Subsystem(cmdtools.SubsystemDocker))
+
+	policy := create.ImagePolicy{AllowedRegistries: ctx.StringSlice("allowed-registry")}
+	if maxImageSize := ctx.String("max-image-size"); maxImageSize != "" {
+		policy.MaxSize, err = cmdtools.ParseByteSize(maxImageSize)
+		if err != nil {
+			return service.Config{}, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'max-image-size'. Error: %v", err), 2)
+		}
+	}
+
+	maxRetries := ctx.Int("max-retries")
+	if maxRetries < 0 {
+		return service.Config{}, cli.NewExitError("Option 'max-retries' must not be negative.", 2)
+	}
+
+	compression := ctx.String("compression")
+	if err := create.ValidCompression(compression); err != nil {
+		return service.Config{}, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'compression'. Error: %v", err), 2)
+	}
+
+	compressor, err := create.NewCompressor(ctx.String("compressor"))
+	if err != nil {
+		return service.Config{}, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'compressor'. Error: %v", err), 2)
+	}
+
+	dockerClient, err := dockerConnect(reporter, ctx)
+	if err != nil {
+		return service.Config{}, err // already a cli error
+	}
+
+	return service.Config{
+		Reporter: reporter,
+		Options: create.Options{
+			Client:       dockerClient,
+			Manifests:    registry.NewClient(authResolver, nil, nil),
+			RetryPolicy:  cmdtools.NewRetryPolicy(maxRetries),
+			AuthResolver: authResolver,
+			Policy:       policy,
+			Compression:  compression,
+			Compressor:   compressor,
+			CheckSpace:   true,
+			OutputDir:    outputDir,
+			TmpDir:       tmpDir,
+			Author:       ctx.String("author"),
+			URLBase:      ctx.String("parturlbase"),
+		},
+		Keys:              keys,
+		Destinations:      destinations,
+		Credentials:       credentials,
+		BandwidthLimit:    bwlimit,
+		UploadParallelism: uploadParallelism,
+		Verify:            ctx.BoolT("verify-upload"),
+		Parallel:          jobs,
+	}, nil
+}
+
+// serveAPIAction serves the REST API of a build service (see service.Handler)
+// until interrupted, building the Pkgs of the jobs submitted with the
+// options given, and then stops the jobs being built
+func serveAPIAction(reporter *cmdtools.SynchronizedReporter, interrupt context.Context, ctx *cli.Context) error {
+	var token string
+	if spec := ctx.String("api-token"); spec != "" {
+		secret, err := cmdtools.ReadSecret(spec)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'api-token'. Error: %v", err), 2)
+		}
+		token = strings.TrimSpace(string(secret))
+	} else {
+		reporter.Log.Warnf("Option 'api-token' not set, requests to the API aren't authenticated")
+	}
+
+	tlsCert, tlsKey := ctx.String("api-tls-cert"), ctx.String("api-tls-key")
+	if (tlsCert == "") != (tlsKey == "") {
+		return cli.NewExitError("Options 'api-tls-cert' and 'api-tls-key' must be given together.", 2)
+	}
+	for _, file := range []string{tlsCert, tlsKey} {
+		if file != "" {
+			if err := checkAccess(EXISTINGFILE, file); err != nil {
+				return cli.NewExitError(fmt.Sprintf("Error accessing TLS certificate or key: %v", err), 2)
+			}
+		}
+	}
+
+	queueSize, retain := ctx.Int("api-queue-size"), ctx.Int("api-retain-jobs")
+	if queueSize < 1 || retain < 1 {
+		return cli.NewExitError("Options 'api-queue-size' and 'api-retain-jobs' must be at least 1.", 2)
+	}
+
+	config, err := serviceConfig(reporter, ctx, "api")
+	if err != nil {
+		return err
+	}
+	config.QueueSize, config.Retain, config.Workspaces = queueSize, retain, ctx.Bool("api-job-workspaces")
+
+	reporter.DelegateErrorConsumer(func(e cmdtools.DelegateError) {
+		reporter.Log.Errorf("Error creating new Pkg: %v", e.Error())
+	})
+
+	s, err := service.New(config)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to set up build service. Error: %v", err), 2)
+	}
+
+	listener, err := net.Listen("tcp", ctx.String("api-addr"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'api-addr'. Error: %v", err), 2)
+	}
+
+	// gRPC calls are served alongside, over HTTP/2, which needs TLS
+	server := &http.Server{Handler: service.Handler(s, token)}
+	served := make(chan error, 1)
+	if tlsCert != "" {
+		go func() {
+			served <- server.ServeTLS(listener, tlsCert, tlsKey)
+		}()
+		reporter.Log.Infof("Serving the build API on: https://%v/v1/jobs, and its gRPC BuildService", listener.Addr())
+	} else {
+		go func() {
+			served <- server.Serve(listener)
+		}()
+		reporter.Log.Infof("Serving the build API on: http://%v/v1/jobs; set 'api-tls-cert' and 'api-tls-key' to serve its gRPC BuildService too", listener.Addr())
+	}
+
+	// jobs are built until interrupted, when those being built are cancelled
+	running, stop := context.WithCancel(interrupt)
+	stopped := make(chan struct{})
+	go func() {
+		s.Run(running)
+		close(stopped)
+	}()
+
+	select {
+	case err = <-served:
+	case <-interrupt.Done():
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(shutdown)
+	stop()
+	<-stopped
+
+	if err != nil && err != http.ErrServerClosed {
+		return cli.NewExitError(fmt.Sprintf("Failed to serve the build API. Error: %v", err), 3)
+	}
+
+	// failed jobs are the clients' business, not the service's
+	return cli.NewExitError("", 0)
+}
+
+// serveSpoolAction builds the Pkgs of the job requests written to a spool
+// directory (see service.Spool) until interrupted, with the options given,
+// and then stops the jobs being built, leaving their requests to be built
+// again
+func serveSpoolAction(reporter *cmdtools.SynchronizedReporter, interrupt context.Context, ctx *cli.Context) error {
+	dir := ctx.String("spool-dir")
+	if dir == "" {
+		return cli.NewExitError("Required option 'spool-dir' not provided. Use the '--help' option for more information.", 2)
+	} else if err := checkAccess(WRITEDIR, dir); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error using given spool directory: %v", err), 2)
+	}
+
+	interval := ctx.Duration("spool-interval")
+	if interval <= 0 {
+		return cli.NewExitError("Option 'spool-interval' must be positive.", 2)
+	}
+
+	config, err := serviceConfig(reporter, ctx, "spool")
+	if err != nil {
+		return err
+	}
+
+	// requests are claimed only as they can be built soon, so other hosts watching the directory can take the rest
+	config.QueueSize = config.Parallel
+
+	reporter.DelegateErrorConsumer(func(e cmdtools.DelegateError) {
+		reporter.Log.Errorf("Error creating new Pkg: %v", e.Error())
+	})
+
+	s, err := service.New(config)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to set up build service. Error: %v", err), 2)
+	}
+
+	spool, err := service.NewSpool(s, dir, interval)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'spool-dir'. Error: %v", err), 2)
+	}
+	reporter.Log.Infof("Building the Pkgs of the job requests written to: %v", dir)
+
+	// job requests published to NATS are written to the spool directory like any others
+	var subscriber *service.NATSSubscriber
+	if server := ctx.String("spool-nats"); server != "" {
+		if ctx.String("spool-nats-subject") == "" {
+			return cli.NewExitError("Option 'spool-nats' requires 'spool-nats-subject'.", 2)
+		}
+
+		subscriber, err = service.NewNATSSubscriber(server, ctx.String("spool-nats-subject"), ctx.String("spool-nats-queue"), dir, reporter.Log)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'spool-nats'. Error: %v", err), 2)
+		}
+	}
+
+	// jobs are built until interrupted, when those being built are cancelled and their requests put back
+	var workers sync.WaitGroup
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		s.Run(interrupt)
+	}()
+	go func() {
+		defer workers.Done()
+		spool.Run(interrupt)
+	}()
+	if subscriber != nil {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			subscriber.Run(interrupt)
+		}()
+	}
+	workers.Wait()
+
+	// failed jobs are recorded in their receipts, not the service's exit status
+	return cli.NewExitError("", 0)
+}
+
+// requiredString returns the value of a required option, asking for it with
+// the question, suggesting def, if it wasn't given and stdin is a terminal.
+// The value is "" if it wasn't given and couldn't be asked for.
+func requiredString(prompter *cmdtools.Prompter, ctx *cli.Context, name string, question string, def string) (string, error) {
+	if value := ctx.String(name); value != "" {
+		return value, nil
+	}
+
+	value, err := prompter.Ask(question, def)
+	if err != nil {
+		return "", cli.NewExitError(fmt.Sprintf("Unable to use provided value for '%v'. Error: %v", name, err), 2)
+	}
+	return value, nil
+}
+
+// imageSpecs returns the images given with option 'dockerimage', where '-'
+// stands for those listed on stdin, followed by those listed in the files
+// given with 'images-from-file'. stdinUsed names the option already reading
+// stdin, if any.
+func imageSpecs(ctx *cli.Context, stdinUsed string) ([]string, error) {
+	specs := []string{}
+	for _, spec := range ctx.StringSlice("dockerimage") {
+		if spec != "-" {
+			specs = append(specs, spec)
+			continue
+		}
+
+		if stdinUsed != "" {
+			return nil, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'dockerimage'. Error: stdin is already read for '%v'", stdinUsed), 2)
+		}
+		stdinUsed = "dockerimage"
+
+		listed, err := readImageList(os.Stdin)
+		if err != nil {
+			return nil, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'dockerimage'. Error: Unable to read images from stdin: %v", err), 2)
+		}
+		specs = append(specs, listed...)
+	}
+
+	for _, file := range ctx.StringSlice("images-from-file") {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'images-from-file'. Error: %v", err), 2)
+		}
+
+		listed, err := readImageList(f)
+		f.Close()
+		if err != nil {
+			return nil, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'images-from-file'. Error: Unable to read %v: %v", file, err), 2)
+		}
+		specs = append(specs, listed...)
+	}
+	return specs, nil
+}
+
+// imageFilters returns the patterns given with option 'image-filter'
+func imageFilters(ctx *cli.Context) ([]string, error) {
+	filters := ctx.StringSlice("image-filter")
+	for _, filter := range filters {
+		if err := create.CheckImageFilter(filter); err != nil {
+			return nil, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'image-filter'. Error: %v", err), 2)
+		}
+	}
+	return filters, nil
+}
+
+// filteredImages returns the images with the local images matching the filters added
+func filteredImages(reporter *cmdtools.SynchronizedReporter, client *docker.Client, filters []string, images []string) ([]string, error) {
+	matched, err := create.MatchingImages(client, filters)
+	if err != nil {
+		return nil, cli.NewExitError(fmt.Sprintf("Unable to list Docker images to match 'image-filter'. Error: %v", err), cmdtools.ExitDocker)
+	} else if len(matched) == 0 {
+		return nil, cli.NewExitError(fmt.Sprintf("No local Docker images match 'image-filter' %v", strings.Join(filters, ", ")), 2)
+	}
+	reporter.Log.Infof("Docker images matching 'image-filter': %v", strings.Join(matched, ", "))
+
+	given := map[string]bool{}
+	for _, image := range images {
+		given[image] = true
+	}
+	for _, image := range matched {
+		if !given[image] {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// readImageList reads images listed one per line, skipping blank lines and comments starting with '#'
+func readImageList(r io.Reader) ([]string, error) {
+	images := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			images = append(images, line)
+		}
+	}
+	return images, scanner.Err()
+}
+
+// requiredImages asks for the images to package when option 'dockerimage' wasn't given
+func requiredImages(prompter *cmdtools.Prompter) ([]string, error) {
+	answer, err := prompter.Ask("Docker images to package, separated by spaces (e.g. 'summit.hovitos.engineering/x86/gt-db:0.1.0')", "")
+	if err != nil {
+		return nil, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'dockerimage'. Error: %v", err), 2)
+	}
+	return strings.Fields(answer), nil
+}
+
+// defaultAuthor suggests the user at this host as the author of a Pkg
+func defaultAuthor() string {
+	name := os.Getenv("USER")
+	host, err := os.Hostname()
+	if name == "" || err != nil {
+		return ""
+	}
+	return name + "@" + host
+}
+
+// defaultPkgFile suggests the Pkg metadata file in the current directory to upload, if there's only one
+func defaultPkgFile() string {
+	matches, err := filepath.Glob("*.json")
+	if err != nil {
+		return ""
+	}
+
+	pkgFiles := []string{}
+	for _, match := range matches {
+		if checkAccess(EXISTINGFILE, match+".sig") == nil {
+			pkgFiles = append(pkgFiles, match)
+		}
+	}
+	if len(pkgFiles) != 1 {
+		return ""
+	}
+	return "./" + pkgFiles[0]
+}
+
+// uploadCredentials returns the credentials to authenticate to the upload
+// destination with, asking for the password if only the user was given
+func uploadCredentials(prompter *cmdtools.Prompter, ctx *cli.Context) (upload.Credentials, error) {
+	credentials := upload.Credentials{SSHIdentity: ctx.String("upload-identity"), Username: ctx.String("upload-user"), Password: ctx.String("upload-password")}
+	if credentials.Username != "" && credentials.Password == "" {
+		password, err := prompter.AskSecret(fmt.Sprintf("Password (or secret key) of upload user %v", credentials.Username))
+		if err != nil {
+			return credentials, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'upload-password'. Error: %v", err), 2)
+		}
+		credentials.Password = password
+	}
+	return credentials, nil
+}
+
+// uploadDestination returns the upload destination URL with the options of
+// its backend given by the 'upload-<backend>-<option>' options set. Options
+// of other backends are ignored with a warning.
+func uploadDestination(reporter *cmdtools.SynchronizedReporter, ctx *cli.Context, destination string) (string, error) {
+	destinationBackend, err := upload.BackendOf(destination)
+	if err != nil {
+		return "", cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'upload'. Error: %v", err), 2)
+	}
+
+	options := map[string]string{}
+	for _, backend := range upload.Backends() {
+		for _, option := range backend.Options {
+			name := upload.OptionFlag(backend, option)
+			if value := ctx.String(name); value != "" && backend.Name == destinationBackend.Name {
+				options[option.Name] = value
+			} else if value != "" {
+				reporter.Log.Subsystem(cmdtools.SubsystemUpload).Warnf("Option '%v' is ignored, the 'upload' destination's backend is %v", name, destinationBackend.Name)
+			}
+		}
+	}
+
+	destination, err = upload.WithOptions(destination, options)
+	if err != nil {
+		return "", cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'upload'. Error: %v", err), 2)
+	}
+	return destination, nil
+}
+
+// uploadLimits returns the number of parts to upload at once and the upload bandwidth limit in bytes per second (0 for none)
+func uploadLimits(ctx *cli.Context) (int, int64, error) {
+	parallelism := ctx.Int("upload-parallelism")
+	if parallelism < 1 {
+		return 0, 0, cli.NewExitError("Option 'upload-parallelism' must be at least 1.", 2)
+	}
+
+	var bwlimit int64
+	if limit := ctx.String("upload-bwlimit"); limit != "" {
+		var err error
+		bwlimit, err = cmdtools.ParseByteSize(limit)
+		if err != nil || bwlimit <= 0 {
+			return 0, 0, cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'upload-bwlimit', expected a positive size per second like '2MiB'. Error: %v", err), 2)
+		}
+	}
+
+	return parallelism, bwlimit, nil
+}
+
+// verifyUpload checks that the uploaded Pkg's files can be downloaded unless
+// the 'verify-upload' option is unset; pre-signed URLs are checked if any,
+// and else those fileURL returns, if given (see upload.Verify)
+func verifyUpload(ctx *cli.Context, reporter *cmdtools.SynchronizedReporter, interrupt context.Context, uploader upload.Uploader, presigner *upload.Presigner, fileURL func(string) string, pkgDir string, pkgFile string, pkgSigFile string) error {
+	if !ctx.BoolT("verify-upload") {
+		return nil
+	}
+
+	if presigner != nil {
+		fileURL = presigner.URL
+	}
+
+	if err := upload.Verify(interrupt, uploader, reporter.ErrWriter, pkgDir, pkgFile, pkgSigFile, fileURL, ctx.Bool("verify-spot-check"), ctx.Bool("strict")); interrupt.Err() != nil {
+		return cli.NewExitError("Interrupted, uploaded Pkg not verified", cmdtools.ExitInterrupted)
+	} else if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to verify uploaded Pkg. Error: %v", err), cmdtools.ExitPublish)
+	}
+	return nil
+}
+
+// checkStrictVerification returns an error if the 'strict' option is set but
+// verifying the upload is turned off
+func checkStrictVerification(ctx *cli.Context) error {
+	if ctx.Bool("strict") && !ctx.BoolT("verify-upload") {
+		return cli.NewExitError("Option 'verify-upload' can't be turned off when option 'strict' is set, which requires the upload to be verified", 2)
+	}
+	return nil
+}
+
+// presignOptions returns a Presigner for the given uploader if the
+// 'presign-expiry' option is set, and the file to write a map of pre-signed
+// URLs to instead of recording them in the Pkg metadata, if any
+func presignOptions(reporter *cmdtools.SynchronizedReporter, ctx *cli.Context, uploader upload.Uploader) (*upload.Presigner, string, error) {
+	expiry := ctx.Duration("presign-expiry")
+	urlMap := ctx.String("presign-url-map")
+
+	if expiry == 0 {
+		if urlMap != "" {
+			return nil, "", cli.NewExitError("Option 'presign-url-map' requires option 'presign-expiry'.", 2)
+		}
+		return nil, "", nil
+	}
+
+	if uploader == nil {
+		return nil, "", cli.NewExitError("Option 'presign-expiry' requires option 'upload'.", 2)
+	}
+
+	presigner, err := upload.NewPresigner(uploader, expiry)
+	if err != nil {
+		return nil, "", cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'presign-expiry'. Error: %v", err), 2)
+	}
+
+	if presigner.Temporary() {
+		reporter.Log.Subsystem(cmdtools.SubsystemUpload).Warnf("Pre-signing URLs with temporary credentials, they stop working when the credentials expire even if that's sooner than 'presign-expiry'")
+	}
+
+	return presigner, urlMap, nil
+}
+
+// loadConfig loads the configuration file given with the global 'config'
+// option or else the first found in config.DefaultPaths, returning nil if
+// there's none
+func loadConfig(ctx *cli.Context) (*config.File, error) {
+	file := ctx.GlobalString("config")
+	if file == "" {
+		if file = config.Find(); file == "" {
+			return nil, nil
+		}
+	}
+	return config.Load(file)
+}
+
+// configProblems returns what's wrong with the given configuration file for
+// the app: options or command sections the app doesn't have and values the
+// options don't accept
+func configProblems(app *cli.App, file *config.File) []string {
+	problems := []string{}
+	check := func(section string, flags []cli.Flag, values map[string][]string) {
+		set := flag.NewFlagSet(section, flag.ContinueOnError)
+		set.SetOutput(ioutil.Discard)
+		for _, f := range flags {
+			f.Apply(set)
+		}
+
+		for _, name := range sortedKeys(values) {
+			if set.Lookup(name) == nil {
+				problems = append(problems, fmt.Sprintf("%s has no option '%s'", section, name))
+				continue
+			}
+
+			for _, value := range values[name] {
+				if err := set.Set(name, value); err != nil {
+					problems = append(problems, fmt.Sprintf("%s option '%s' can't be '%s'. Error: %v", section, name, value, err))
+				}
+			}
+		}
+	}
+
+	check("Global", app.Flags, file.Global)
+	for _, name := range sortedKeys(file.Commands) {
+		if command := app.Command(name); command == nil || command.Name != name {
+			problems = append(problems, fmt.Sprintf("There's no command '%s'", name))
+		} else {
+			check(fmt.Sprintf("Command '%s'", name), command.Flags, file.Commands[name])
+		}
+	}
+	return problems
+}
+
+// applyConfig sets the options among flags that the given configuration
+// values are given for, unless they're given on the command line or by
+// envvar, which take precedence
+func applyConfig(ctx *cli.Context, flags []cli.Flag, values map[string][]string) error {
+	for _, f := range flags {
+		names := strings.Split(f.GetName(), ",")
+		given := false
+		for i := range names {
+			names[i] = strings.TrimSpace(names[i])
+			given = given || ctx.IsSet(names[i])
+		}
+		for _, envVar := range strings.Split(flagEnvVar(f), ",") {
+			if _, set := os.LookupEnv(strings.TrimSpace(envVar)); envVar != "" && set {
+				given = true
+			}
+		}
+		if given {
+			continue
+		}
+
+		for _, name := range names {
+			for _, value := range values[name] {
+				if err := ctx.Set(names[0], value); err != nil {
+					return fmt.Errorf("Option '%s' can't be '%s'. Error: %v", name, value, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// flagEnvVar returns the envvars, separated by commas, the given flag is read from, if any
+func flagEnvVar(f cli.Flag) string {
+	switch f := f.(type) {
+	case cli.StringFlag:
+		return f.EnvVar
+	case cli.StringSliceFlag:
+		return f.EnvVar
+	case cli.BoolFlag:
+		return f.EnvVar
+	case cli.BoolTFlag:
+		return f.EnvVar
+	case cli.IntFlag:
+		return f.EnvVar
+	case cli.DurationFlag:
+		return f.EnvVar
+	}
+	return ""
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string][]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]map[string][]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func configValidateAction(app *cli.App, reporter *cmdtools.SynchronizedReporter, ctx *cli.Context) error {
+	file, err := loadConfig(ctx)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to read configuration file. Error: %v", err), 2)
+	} else if file == nil {
+		return cli.NewExitError(fmt.Sprintf("No configuration file given with 'config' or found in: %v", strings.Join(config.DefaultPaths(), ", ")), 2)
+	}
+
+	problems := configProblems(app, file)
+	for _, problem := range problems {
+		reporter.Log.Errorf("%v: %v", file.Path, problem)
+	}
+	if len(problems) > 0 {
+		return cli.NewExitError(fmt.Sprintf("Configuration file %v is invalid", file.Path), 2)
+	}
+
+	reporter.Log.Infof("Configuration file %v is valid", file.Path)
+	fmt.Fprintf(reporter.OutWriter, "%v\n", file.Path)
+	return nil
+}
+
+// completeCommand returns the shell completion of a command, which prints
+// the candidates for the word being completed: after one of imageFlags, the
+// names and tags of the Docker daemon's local images; after another option
+// taking a value, nothing, so the shell completes file paths (see
+// autocomplete/bash_autocomplete); otherwise the command's options
+func completeCommand(args []string, imageFlags ...string) cli.BashCompleteFunc {
+	return func(ctx *cli.Context) {
+		// the option before the word being completed is unparsed if it's missing its value
+		if len(args) > 0 && args[len(args)-1] == "--generate-bash-completion" {
+			args = args[:len(args)-1]
+		}
+
+		var previous cli.Flag
+		if len(args) > 1 && strings.HasPrefix(args[len(args)-1], "-") {
+			name := strings.TrimLeft(args[len(args)-1], "-")
+			for _, f := range ctx.Command.Flags {
+				for _, flagName := range strings.Split(f.GetName(), ",") {
+					if strings.TrimSpace(flagName) == name {
+						previous = f
+					}
+				}
+			}
+		}
+
+		switch previous.(type) {
+		case nil, cli.BoolFlag, cli.BoolTFlag:
+		default:
+			name := strings.TrimSpace(strings.Split(previous.GetName(), ",")[0])
+			for _, imageFlag := range imageFlags {
+				if name == imageFlag {
+					for _, tag := range localImageTags(ctx.String("dockerendpoint")) {
+						fmt.Fprintln(ctx.App.Writer, tag)
+					}
+				}
+			}
+			return
+		}
+
+		for _, f := range ctx.Command.Flags {
+			fmt.Fprintf(ctx.App.Writer, "--%s\n", strings.TrimSpace(strings.Split(f.GetName(), ",")[0]))
+		}
+	}
+}
+
+// localImageTags returns the names and tags of the images of the Docker
+// daemon at the endpoint, or none if it can't be reached soon enough to
+// complete them
+func localImageTags(endpoint string) []string {
+	// tunnels over ssh may ask for passwords, which would garble the command line
+	if endpoint == "" || strings.HasPrefix(endpoint, "ssh://") {
+		return nil
+	}
+
+	client, err := docker.NewClient(endpoint)
+	if err != nil {
+		return nil
+	}
+	client.SetTimeout(2 * time.Second)
+
+	images, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil
+	}
+
+	tags := []string{}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			if tag != "<none>:<none>" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Run runs the command line tool with the given arguments, the first of
+// which names it as os.Args does, writing results to stdout and messages to
+// stderr, and returns the exit status. It reads from stdin when asked to.
+// Since the command line library's exit handling is global, Run mustn't be
+// called by more than one goroutine at once.
+func Run(args []string, stdout io.Writer, stderr io.Writer) int {
+	return RunContext(context.Background(), args, stdout, stderr)
+}
+
+// RunContext is Run stopped by the context: once it's done, work in progress
+// stops and cleans up, and the command exits with cmdtools.ExitInterrupted,
+// e.g. for main to cancel it on SIGINT or SIGTERM
+func RunContext(interrupt context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	app := cli.NewApp()
+	app.EnableBashCompletion = true
+
+	app.Name = "horizon-pkg-build"
+	app.Version = cmdtools.Version
+	app.Usage = "Create, validate, and upload Horizon Pkg metadata and parts"
+	app.Writer = stdout
+	app.ErrWriter = stderr
+
+	app.Flags = GlobalFlags()
+
+	// set up reporter; its output is flushed before the CLI exits, even with an error
+	reporter := cmdtools.NewSynchronizedReporterTo(512, stdout, stderr)
+
+	// missing required options are asked for if stdin is a terminal
+	prompter := cmdtools.NewPrompter(reporter)
+
+	// builds stop cleanly once the context is done; their work is tagged with the build ID, if given, through it
+	defer logInterruption(interrupt, reporter.Log)()
+
+	// profiles are written out before exiting, once started with the global options
+	stopProfiling := func() {}
+
+	// the log file, if any, is closed after the last message
+	closeLogFile := func() {}
+
+	// metrics, if wanted, are pushed for the command run once the CLI exits; failures are counted as they're reported
+	started := time.Now()
+	var metricsPush, metricsJob string
+	measured := &runMetrics{failures: map[string]int{}}
+	reporter.Bus.Subscribe(measured.observe)
+
+	// the error report, if wanted, describes the error the CLI exits with and those reported by workers
+	var errorReport string
+	var failure error
+	fail := func(err error) error {
+		if err != nil {
+			failure = err
+		}
+		return err
+	}
+
+	setup := func(ctx *cli.Context) error {
+		errorReport = sharedString(ctx, "error-report")
+
+		metricsPush, metricsJob = sharedString(ctx, "metrics-push"), sharedString(ctx, "metrics-job")
+		if metricsPush != "" {
+			if err := metrics.CheckEndpoint(metricsPush); err != nil {
+				return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'metrics-push'. Error: %v", err), 2)
+			}
+		}
+
+		level, subsystemLevels, err := cmdtools.ParseLogLevels(sharedString(ctx, "log-level"))
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'log-level'. Error: %v", err), 2)
+		} else if sharedBool(ctx, "debug") {
+			level = cmdtools.LevelDebug
+		}
+		reporter.Log.SetLevel(level, subsystemLevels)
+		if err := reporter.Log.SetFormat(sharedString(ctx, "log-format")); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'log-format'. Error: %v", err), 2)
+		}
+		if sharedBool(ctx, "quiet") {
+			reporter.Quiet()
+		}
+		if sharedBool(ctx, "ci") {
+			reporter.CI()
+		}
+		if sharedBool(ctx, "no-color") {
+			reporter.Log.SetColor(false)
+		}
+		if buildID := sharedString(ctx, "build-id"); buildID != "" {
+			interrupt = cmdtools.WithBuildID(interrupt, buildID)
+		}
+		switch progress := sharedString(ctx, "progress"); progress {
+		case "text":
+		case "json":
+			w, err := progressWriter(reporter, sharedInt(ctx, "progress-fd"))
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'progress-fd'. Error: %v", err), 2)
+			}
+			reporter.StreamEventsTo(w)
+		default:
+			return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'progress'. Error: Expected one of 'text' or 'json', got '%s'", progress), 2)
+		}
+		if logFile := sharedString(ctx, "log-file"); logFile != "" {
+			var maxSize int64
+			if size := sharedString(ctx, "log-file-max-size"); size != "" {
+				if maxSize, err = cmdtools.ParseByteSize(size); err != nil {
+					return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'log-file-max-size'. Error: %v", err), 2)
+				}
+			}
+
+			file, err := cmdtools.OpenLogFile(logFile, maxSize, sharedInt(ctx, "log-file-keep"))
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("Unable to use provided value for 'log-file'. Error: %v", err), 2)
+			}
+			reporter.TeeTo(file)
+			closeLogFile = func() { file.Close() }
+		}
+
+		stop, err := startProfiling(reporter, ctx)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 2)
+		}
+
+		stopProfiling = stop
+		return nil
+	}
+
+	var configFile *config.File
+	app.Before = func(ctx *cli.Context) error {
+		// 'config validate' reports what's wrong with the file rather than failing to load it
+		if ctx.Args().First() != "config" {
+			var err error
+			if configFile, err = loadConfig(ctx); err != nil {
+				return fail(cli.NewExitError(fmt.Sprintf("Unable to read configuration file. Error: %v", err), 2))
+			} else if configFile != nil {
+				if problems := configProblems(app, configFile); len(problems) > 0 {
+					return fail(cli.NewExitError(fmt.Sprintf("Configuration file %v is invalid: %v. Use 'config validate' for more information.", configFile.Path, problems[0]), 2))
+				}
+				if err := applyConfig(ctx, app.Flags, configFile.Global); err != nil {
+					return fail(cli.NewExitError(fmt.Sprintf("Unable to use configuration file %v. Error: %v", configFile.Path, err), 2))
+				}
+			}
+		}
+
+		// a command's options are parsed once it's found; without one, set up now
+		if command := app.Command(ctx.Args().First()); command != nil && command.Before != nil {
+			return nil
+		}
+		return fail(setup(ctx))
+	}
+
+	app.Action = func(ctx *cli.Context) error {
+		reporter.Log.Debugf("Debug output enabled")
+		return nil
+	}
+
+	// commands failing with a cli.ExitCoder have their error written and the status recorded rather than exiting
+	exited := -1
+	defer func(osExiter func(int), errWriter io.Writer) {
+		cli.OsExiter = osExiter
+		cli.ErrWriter = errWriter
+	}(cli.OsExiter, cli.ErrWriter)
+	cli.OsExiter = func(code int) {
+		exited = code
+	}
+	cli.ErrWriter = reporter.ErrWriter
+
+	app.Commands = []cli.Command{
+		cli.Command{
+			Name:         "create",
+			Aliases:      []string{"c"},
+			Usage:        "Create a new Horizon Pkg from Docker image files",
+			Flags:        CreateFlags(),
+			BashComplete: completeCommand(args, "dockerimage"),
+			// curry the action with an anonymous function so we can get a reporter passed
+			Action: func(ctx *cli.Context) error {
+				defer reporter.Flush()
+				return createAction(reporter, prompter, interrupt, measured, ctx)
+			},
+		},
+		cli.Command{
+			Name:         "upload",
+			Aliases:      []string{"u"},
+			Usage:        "Upload a Horizon Pkg created earlier",
+			Flags:        UploadFlags(),
+			BashComplete: completeCommand(args),
+			Action: func(ctx *cli.Context) error {
+				defer reporter.Flush()
+				return uploadAction(reporter, prompter, interrupt, measured, ctx)
+			},
+		},
+		cli.Command{
+			Name:         "mirror",
+			Usage:        "Copy a Horizon Pkg published at a URL to another upload destination, checking its parts against its metadata",
+			Flags:        MirrorFlags(),
+			BashComplete: completeCommand(args),
+			Action: func(ctx *cli.Context) error {
+				defer reporter.Flush()
+				return mirrorAction(reporter, prompter, interrupt, measured, ctx)
+			},
+		},
+		cli.Command{
+			Name:         "unbundle",
+			Usage:        "Extract a Pkg from a bundle written by 'create' with '--bundle', verifying its files against the bundle's manifest",
+			Flags:        UnbundleFlags(),
+			BashComplete: completeCommand(args),
+			Action: func(ctx *cli.Context) error {
+				defer reporter.Flush()
+				return unbundleAction(reporter, ctx)
+			},
+		},
+		cli.Command{
+			Name:         "estimate",
+			Aliases:      []string{"e"},
+			Usage:        "Estimate the size of the Pkg and the time to build it from local Docker images by exporting and compressing a sample of each",
+			Flags:        EstimateFlags(),
+			BashComplete: completeCommand(args, "dockerimage"),
+			Action: func(ctx *cli.Context) error {
+				defer reporter.Flush()
+				return estimateAction(reporter, prompter, interrupt, ctx)
+			},
+		},
+		cli.Command{
+			Name:  "serve-api",
+			Usage: "Serve a REST API for submitting jobs that build Pkgs of Docker images, following their progress, and fetching the Pkgs they built",
+			Flags: ServeAPIFlags(),
+			Action: func(ctx *cli.Context) error {
+				defer reporter.Flush()
+				return serveAPIAction(reporter, interrupt, ctx)
+			},
+		},
+		cli.Command{
+			Name:  "serve-spool",
+			Usage: "Build the Pkgs of job requests written to a spool directory or published to a NATS subject, writing a receipt of each job beside its request",
+			Flags: ServeSpoolFlags(),
+			Action: func(ctx *cli.Context) error {
+				defer reporter.Flush()
+				return serveSpoolAction(reporter, interrupt, ctx)
+			},
+		},
+		cli.Command{
+			Name:  "config",
+			Usage: "Work with the configuration file of option values (see the global 'config' option)",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "validate",
+					Usage: "Check that every option in the configuration file exists and accepts its value, print any problems, and print the file's path if there are none",
+					Action: func(ctx *cli.Context) error {
+						defer reporter.Flush()
+						return configValidateAction(app, reporter, ctx)
+					},
+				},
+			},
+		},
+	}
+
+	// each command's options in the configuration file apply unless given on the command line or by envvar
+	for i := range app.Commands {
+		name := app.Commands[i].Name
+		app.Commands[i].Flags = append(app.Commands[i].Flags, SharedFlags()...)
+		flags := app.Commands[i].Flags
+		app.Commands[i].Before = func(ctx *cli.Context) error {
+			measured.command = name
+			if configFile != nil {
+				if err := applyConfig(ctx, flags, configFile.Commands[name]); err != nil {
+					return fail(cli.NewExitError(fmt.Sprintf("Unable to use configuration file %v. Error: %v", configFile.Path, err), 2))
+				}
+			}
+			return fail(setup(ctx))
+		}
+		if action, ok := app.Commands[i].Action.(func(*cli.Context) error); ok {
+			app.Commands[i].Action = func(ctx *cli.Context) error {
+				return fail(action(ctx))
+			}
+		}
+	}
+
+	// errors that aren't cli.ExitCoders, like unparseable flags, are invocation errors, and errors
+	// reported by workers otherwise unheeded still fail
+	code := 0
+	if err := app.Run(args); exited >= 0 {
+		code = exited
+	} else if err != nil {
+		reporter.Log.Errorf("%v", err)
+		failure = err
+		code = 3
+	} else {
+		code = reporter.DelegateExitCode()
+	}
+
+	stopProfiling()
+	reporter.Close()
+	writeErrorReport(reporter.Log, errorReport, code, failure, reporter.DelegateErrors())
+	emitExit(reporter, code)
+	pushMetrics(reporter.Log, metricsPush, metricsJob, measured, code, time.Since(started))
+
+	if exited < 0 {
+		reporter.Log.Infof("Exiting.")
+	}
+	closeLogFile()
+	return code
+}
+
+// errorReportEntry describes a failure in an error report
+type errorReportEntry struct {
+	Code      int    `json:"code"`
+	Class     string `json:"class"`
+	Kind      string `json:"kind"`
+	Stage     string `json:"stage,omitempty"`
+	Image     string `json:"image,omitempty"`
+	Part      string `json:"part,omitempty"`
+	Build     string `json:"build,omitempty"`
+	UserError bool   `json:"userError"`
+	Message   string `json:"message"`
+}
+
+// writeErrorReport writes a JSON report of the exit status code, the error
+// the CLI failed with, if any, and the errors reported by workers to file,
+// if given. The class of a nonzero status is included so it needn't be
+// looked up.
+func writeErrorReport(log *cmdtools.Logger, file string, code int, failure error, delegateErrors []cmdtools.DelegateError) {
+	if file == "" {
+		return
+	}
+
+	report := struct {
+		ExitCode int                `json:"exitCode"`
+		Class    string             `json:"class,omitempty"`
+		Message  string             `json:"message,omitempty"`
+		Errors   []errorReportEntry `json:"errors"`
+	}{
+		ExitCode: code,
+		Errors:   []errorReportEntry{},
+	}
+	if code != 0 {
+		report.Class = cmdtools.ExitClass(code)
+	}
+	if failure != nil {
+		report.Message = strings.TrimRight(failure.Error(), "\n")
+	}
+	for _, e := range delegateErrors {
+		report.Errors = append(report.Errors, errorReportEntry{
+			Code:      e.Code,
+			Class:     cmdtools.ExitClass(e.Code),
+			Kind:      cmdtools.KindOf(e).Error(),
+			Stage:     e.Stage,
+			Image:     e.Image,
+			Part:      e.Part,
+			Build:     e.Build,
+			UserError: e.UserError,
+			Message:   strings.TrimRight(e.Error(), "\n"),
+		})
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(file, append(content, '\n'), 0644)
+	}
+	if err != nil {
+		log.Errorf("Unable to write error report %v. Error: %v", file, err)
+	}
+}
+
+// progressWriter returns the writer for JSON progress events written to the file descriptor fd
+func progressWriter(reporter *cmdtools.SynchronizedReporter, fd int) (io.Writer, error) {
+	switch {
+	case fd == 1:
+		return reporter.OutWriter, nil
+	case fd == 2:
+		return reporter.ErrWriter, nil
+	case fd < 1:
+		return nil, fmt.Errorf("Expected 1, 2, or a descriptor opened for writing, got %v", fd)
+	}
+
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("progress-fd-%d", fd))
+	if _, err := file.Stat(); err != nil {
+		return nil, fmt.Errorf("File descriptor %v isn't open. Error: %v", fd, err)
+	}
+	return file, nil
+}
+
+// emitExit emits the exit event of the event stream, with the status code and its class
+func emitExit(reporter *cmdtools.SynchronizedReporter, code int) {
+	ok := code == 0
+	event := cmdtools.Event{Event: cmdtools.EventExit, Code: code, OK: &ok}
+	if !ok {
+		event.Class = cmdtools.ExitClass(code)
+	}
+	reporter.Emit(event)
+}
+
+// runMetrics are the measurements of a run pushed with '--metrics-push'
+type runMetrics struct {
+	command  string
+	summary  *buildSummary // of a Pkg created
+	uploaded int64
+
+	lock     sync.Mutex
+	failures map[string]int // reported by workers, by class
+}
+
+// observe counts the failures published on the reporter's bus
+func (m *runMetrics) observe(e cmdtools.Event) {
+	if e.Event != cmdtools.EventError {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.failures[e.Class]++
+}
+
+// samples returns the metrics of a run that exited with the given status
+// code: the failures are counted by class for every class, so a push replaces
+// the counts of an earlier run
+func (m *runMetrics) samples(code int, took time.Duration) []metrics.Sample {
+	samples := []metrics.Sample{
+		{Name: "run_duration_seconds", Help: "Seconds the run took", Value: took.Seconds()},
+		{Name: "run_exit_code", Help: "Exit status code of the run, 0 if it succeeded", Value: float64(code)},
+		{Name: "run_timestamp_seconds", Help: "Unix time the run ended", Value: float64(time.Now().Unix())},
+	}
+
+	m.lock.Lock()
+	failures := map[string]int{}
+	for class, count := range m.failures {
+		failures[class] = count
+	}
+	m.lock.Unlock()
+	if code != 0 && len(failures) == 0 {
+		failures[cmdtools.ExitClass(code)]++
+	}
+	for _, class := range cmdtools.ExitClasses() {
+		samples = append(samples, metrics.Sample{Name: "failures", Help: "Failures of the run by class", Labels: map[string]string{"class": class}, Value: float64(failures[class])})
+	}
+
+	if m.summary != nil {
+		for _, stage := range m.summary.Stages {
+			samples = append(samples, metrics.Sample{Name: "stage_duration_seconds", Help: "Seconds each stage of the build took, from the first image entering it to the last leaving it", Labels: map[string]string{"stage": stage.Stage}, Value: stage.Seconds})
+		}
+		totals := m.summary.Totals
+		samples = append(samples,
+			metrics.Sample{Name: "images", Help: "Docker images packaged", Value: float64(totals.Images)},
+			metrics.Sample{Name: "parts", Help: "Parts written", Value: float64(totals.Parts)},
+			metrics.Sample{Name: "exported_bytes", Help: "Bytes of the images exported, uncompressed, or 0 if unknown", Value: float64(totals.Bytes)},
+			metrics.Sample{Name: "compressed_bytes", Help: "Bytes of the parts written", Value: float64(totals.CompressedBytes)},
+		)
+	}
+	if m.command == "create" || m.command == "upload" {
+		samples = append(samples, metrics.Sample{Name: "uploaded_bytes", Help: "Bytes uploaded, not counting files skipped as already uploaded", Value: float64(m.uploaded)})
+	}
+
+	return samples
+}
+
+// pushMetrics pushes the metrics of a command's run to endpoint, if given,
+// logging a failure rather than failing the run
+func pushMetrics(log *cmdtools.Logger, endpoint string, job string, measured *runMetrics, code int, took time.Duration) {
+	// checking the configuration isn't a run worth tracking
+	if endpoint == "" || measured.command == "" || measured.command == "config" {
+		return
+	}
+
+	grouping := map[string]string{"command": measured.command}
+	if host, err := os.Hostname(); err == nil {
+		grouping["instance"] = host
+	}
+
+	if err := metrics.Push(endpoint, job, grouping, measured.samples(code, took)); err != nil {
+		log.Warnf("Unable to push metrics to %v. Error: %v", endpoint, err)
+		return
+	}
+	log.Debugf("Pushed metrics to %v", endpoint)
+}
+
+// sharedString returns the value of one of the global options that may also
+// be given after the command, where it takes precedence
+func sharedString(ctx *cli.Context, name string) string {
+	if ctx.IsSet(name) {
+		return ctx.String(name)
+	}
+	return ctx.GlobalString(name)
+}
+
+// sharedInt is sharedString for integer options
+func sharedInt(ctx *cli.Context, name string) int {
+	if ctx.IsSet(name) {
+		return ctx.Int(name)
+	}
+	return ctx.GlobalInt(name)
+}
+
+// sharedBool is sharedString for boolean options
+func sharedBool(ctx *cli.Context, name string) bool {
+	return ctx.Bool(name) || ctx.GlobalBool(name)
+}
+
+// a BoolFlag is false by default, BoolT is true by default
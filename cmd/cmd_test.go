@@ -0,0 +1,120 @@
+// +build unit
+
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"testing"
+)
+
+func Test_NegotiateAPIVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		version    map[string]string
+		negotiated string
+		err        string
+	}{
+		{name: "daemon older than the minimum", version: map[string]string{"Version": "1.8.3", "ApiVersion": "1.20"}, err: "requires API version 1.21 (Docker 1.9) or newer"},
+		{name: "daemon at the minimum", version: map[string]string{"Version": "1.9.1", "ApiVersion": "1.21"}, negotiated: "1.21"},
+		{name: "daemon in range", version: map[string]string{"Version": "17.06.0-ce", "ApiVersion": "1.30", "MinAPIVersion": "1.12"}, negotiated: "1.30"},
+		{name: "daemon at the maximum", version: map[string]string{"Version": "19.03.0", "ApiVersion": "1.40", "MinAPIVersion": "1.12"}, negotiated: "1.40"},
+		{name: "daemon newer than the maximum", version: map[string]string{"Version": "24.0.0", "ApiVersion": "1.43", "MinAPIVersion": "1.12"}, negotiated: "1.40"},
+		{name: "daemon that dropped the maximum", version: map[string]string{"Version": "99.0.0", "ApiVersion": "1.50", "MinAPIVersion": "1.44"}, negotiated: "1.44"},
+		{name: "daemon with an unparseable version", version: map[string]string{"Version": "dev", "ApiVersion": "latest"}, err: "Unable to parse Docker daemon API version"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/version") {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(tc.version)
+			}))
+			defer server.Close()
+
+			dockerClient, err := docker.NewClient(server.URL)
+			assert.Nil(t, err)
+
+			negotiated, err := negotiateAPIVersion(cmdtools.NewSynchronizedReporterTo(512, ioutil.Discard, ioutil.Discard), dockerClient)
+			if tc.err != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.negotiated, negotiated)
+			}
+		})
+	}
+
+	t.Run("daemon that doesn't answer", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		dockerClient, err := docker.NewClient(server.URL)
+		assert.Nil(t, err)
+
+		_, err = negotiateAPIVersion(cmdtools.NewSynchronizedReporterTo(512, ioutil.Discard, ioutil.Discard), dockerClient)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "Unable to query Docker daemon version")
+	})
+}
+
+// profilingContext returns a context with the given profiling options set
+func profilingContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("profile-cpu", "", "")
+	set.String("profile-mem", "", "")
+	set.String("pprof-addr", "", "")
+	assert.Nil(t, set.Parse(args))
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func Test_StartProfiling_Suite(suite *testing.T) {
+	reporter := cmdtools.NewSynchronizedReporterTo(512, ioutil.Discard, ioutil.Discard)
+
+	suite.Run("stopping profiling frees the pprof address", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		addr := listener.Addr().String()
+		listener.Close()
+
+		for i := 0; i < 2; i++ {
+			stop, err := startProfiling(reporter, profilingContext(t, "--pprof-addr", addr))
+			assert.Nil(t, err)
+			stop()
+		}
+	})
+
+	suite.Run("a pprof address in use doesn't leave the CPU profile running", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "profile-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer listener.Close()
+
+		_, err = startProfiling(reporter, profilingContext(t, "--profile-cpu", filepath.Join(dir, "cpu.prof"), "--pprof-addr", listener.Addr().String()))
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "Unable to listen for pprof requests")
+
+		assert.Nil(t, pprof.StartCPUProfile(ioutil.Discard))
+		pprof.StopCPUProfile()
+	})
+}
@@ -0,0 +1,33 @@
+// +build unit
+
+package cmd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+	"strings"
+	"testing"
+)
+
+func Test_Flags(t *testing.T) {
+	// commands' options are given along with the shared ones, so no name may be used twice
+	for command, flags := range map[string][]cli.Flag{
+		"global":      GlobalFlags(),
+		"create":      append(CreateFlags(), SharedFlags()...),
+		"upload":      append(UploadFlags(), SharedFlags()...),
+		"mirror":      append(MirrorFlags(), SharedFlags()...),
+		"unbundle":    append(UnbundleFlags(), SharedFlags()...),
+		"estimate":    append(EstimateFlags(), SharedFlags()...),
+		"serve-api":   append(ServeAPIFlags(), SharedFlags()...),
+		"serve-spool": append(ServeSpoolFlags(), SharedFlags()...),
+	} {
+		names := map[string]bool{}
+		for _, f := range flags {
+			for _, name := range strings.Split(f.GetName(), ",") {
+				name = strings.TrimSpace(name)
+				assert.False(t, names[name], "%s option %s given twice", command, name)
+				names[name] = true
+			}
+		}
+	}
+}
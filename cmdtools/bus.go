@@ -0,0 +1,77 @@
+package cmdtools
+
+import (
+	"sync"
+	"time"
+)
+
+// Subscriber handles the events published on a Bus
+type Subscriber func(e Event)
+
+// Bus carries the events of a run from the workers publishing them to the
+// subscribers rendering or acting on them: a SynchronizedReporter's console
+// output, event stream, and log file, the accounting of failures that
+// decides the exit status, and e.g. the metrics of the run. Each event is
+// handed to every subscriber, in the order they subscribed, before Publish
+// returns. Subscribers may publish events of their own, and events published
+// by one goroutine reach each subscriber in the order published, but events
+// published concurrently may reach different subscribers in different
+// orders. It's safe for concurrent use.
+type Bus struct {
+	lock        sync.RWMutex
+	subscribers []*subscription
+	now         func() time.Time
+}
+
+// subscription is a subscriber, held by pointer so it can be told apart when unsubscribed
+type subscription struct {
+	fn Subscriber
+}
+
+// NewBus returns a Bus without subscribers
+func NewBus() *Bus {
+	return &Bus{now: time.Now}
+}
+
+// Subscribe hands every event published from now on to fn, until the
+// returned function is called
+func (b *Bus) Subscribe(fn Subscriber) func() {
+	sub := &subscription{fn: fn}
+
+	b.lock.Lock()
+	b.subscribers = append(b.subscribers, sub)
+	b.lock.Unlock()
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		for i, s := range b.subscribers {
+			if s == sub {
+				b.subscribers = append(b.subscribers[:i:i], b.subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Publish stamps the event with the current time, unless it has one, and
+// hands it to each subscriber in turn
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	if e.Time == "" {
+		e.Time = b.now().UTC().Format(logTimeFormat)
+	}
+
+	// not held while handing the event out, so subscribers can publish
+	b.lock.RLock()
+	subscribers := b.subscribers
+	b.lock.RUnlock()
+
+	for _, s := range subscribers {
+		s.fn(e)
+	}
+}
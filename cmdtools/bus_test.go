@@ -0,0 +1,77 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func Test_Bus_Suite(suite *testing.T) {
+
+	suite.Run("events reach subscribers in the order they subscribed until they unsubscribe", func(t *testing.T) {
+		bus := NewBus()
+		got := []string{}
+		first := bus.Subscribe(func(e Event) { got = append(got, "first "+e.Event) })
+		bus.Subscribe(func(e Event) { got = append(got, "second "+e.Event) })
+
+		bus.Publish(Event{Event: EventStageStarted})
+		first()
+		bus.Publish(Event{Event: EventExit})
+
+		assert.Equal(t, []string{"first stage_started", "second stage_started", "second exit"}, got)
+	})
+
+	suite.Run("subscribers can publish, and events are stamped once", func(t *testing.T) {
+		bus := NewBus()
+		times := []string{}
+		bus.Subscribe(func(e Event) {
+			times = append(times, e.Time)
+			if e.Event == EventError {
+				bus.Publish(Event{Event: EventExit})
+			}
+		})
+
+		bus.Publish(Event{Event: EventError})
+		bus.Publish(Event{Event: EventExit, Time: "then"})
+		assert.Equal(t, 3, len(times))
+		assert.NotEqual(t, "", times[0])
+		assert.Equal(t, "then", times[2])
+
+		// a nil bus drops events
+		var none *Bus
+		none.Publish(Event{Event: EventExit})
+	})
+
+	suite.Run("a reporter publishes output with the level and subsystem of log messages", func(t *testing.T) {
+		reporter := newSynchronizedReporter(16, ioutil.Discard, ioutil.Discard)
+		stopClock(reporter.Log)
+		output := []Event{}
+		failures := 0
+		reporter.Bus.Subscribe(func(e Event) {
+			switch e.Event {
+			case EventOutput:
+				output = append(output, e)
+			case EventError:
+				failures++
+			}
+		})
+		reporter.DelegateErrorConsumer(func(e DelegateError) {})
+
+		reporter.Log.Subsystem(SubsystemUpload).Warnf("slow")
+		reporter.OutWriter.Write([]byte("result\n"))
+		reporter.DelegateFailure(ExitPull, "pull", "a:1", false, "not found")
+		reporter.Close()
+
+		assert.Equal(t, 2, len(output))
+		assert.Equal(t, StreamStderr, output[0].Stream)
+		assert.Equal(t, "warn", output[0].Level)
+		assert.Equal(t, SubsystemUpload, output[0].Subsystem)
+		assert.Equal(t, "2017-10-02T15:04:05.000000Z [WARN] upload: slow\n", output[0].Message)
+		assert.Equal(t, Event{Event: EventOutput, Time: output[1].Time, Stream: StreamStdout, Message: "result\n"}, output[1])
+
+		assert.Equal(t, 1, failures)
+		assert.Equal(t, 1, reporter.DelegateErrorCount())
+	})
+}
@@ -0,0 +1,47 @@
+package cmdtools
+
+import (
+	"strings"
+)
+
+// ParseAuthChallenge parses a WWW-Authenticate header value like
+// 'Bearer realm="https://auth.docker.io/token",service="registry.docker.io"'
+// into a lowercased scheme and its parameters.
+func ParseAuthChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+
+	spl := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	scheme := strings.ToLower(spl[0])
+	if len(spl) == 1 {
+		return scheme, params
+	}
+
+	rest := spl[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return scheme, params
+}
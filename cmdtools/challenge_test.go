@@ -0,0 +1,18 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_ParseAuthChallenge(t *testing.T) {
+	scheme, params := ParseAuthChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`)
+	assert.Equal(t, "bearer", scheme)
+	assert.Equal(t, map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/alpine:pull"}, params)
+
+	scheme, params = ParseAuthChallenge(`Basic realm=registry`)
+	assert.Equal(t, "basic", scheme)
+	assert.Equal(t, "registry", params["realm"])
+}
@@ -0,0 +1,20 @@
+package cmdtools
+
+import (
+	"path"
+	"strings"
+)
+
+const (
+	// ChecksumsFile is the name of the file in a Pkg's directory listing the
+	// SHA-256 hashes of the Pkg's files in the format 'sha256sum -c' reads
+	ChecksumsFile = "SHA256SUMS"
+
+	// ChecksumSidecarExt is the extension of the files listing the SHA-256 hash of the file they're named for
+	ChecksumSidecarExt = ".sha256"
+)
+
+// IsChecksumFile returns true if the named file is a checksums file or a checksum sidecar rather than Pkg content
+func IsChecksumFile(name string) bool {
+	return path.Base(name) == ChecksumsFile || strings.HasSuffix(name, ChecksumSidecarExt)
+}
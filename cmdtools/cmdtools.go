@@ -1,11 +1,15 @@
 package cmdtools
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
-	"time"
 )
 
 const (
@@ -18,6 +22,9 @@ const (
 	// OutputDebugPrefix is a prefix for debug output on stderr
 	OutputDebugPrefix = "[DEBUG]"
 
+	// OutputWarnPrefix is a prefix for warning output on stderr
+	OutputWarnPrefix = "[WARN]"
+
 	// OutputErrorPrefix is a prefix for error output on stderr
 	OutputErrorPrefix = "[ERROR]"
 )
@@ -25,7 +32,13 @@ const (
 // DelegateError is a subtype of error indicating an error that occured in a worker or other async process
 type DelegateError struct {
 	UserError bool
-	Breaking  bool // indicates that the error isn't transient and stopped processing
+	Breaking  bool   // indicates that the error isn't transient and stopped processing
+	Code      int    // the exit status for the class of failure, one of the Exit* constants
+	Stage     string // the stage of processing an image that failed (e.g. "pull"), if any
+	Image     string // the image whose processing failed, if any
+	Part      string // the hash of the part whose processing failed, if any
+	Build     string // the ID of the build that failed, if it has one
+	Err       error  // the Failure, whose kind the exit status is for (see KindOf)
 	msg       string
 }
 
@@ -33,77 +46,475 @@ func (e DelegateError) Error() string {
 	return e.msg
 }
 
+// Unwrap returns the Failure, so errors.Is matches the error with its kind and cause
+func (e DelegateError) Unwrap() error {
+	return e.Err
+}
+
 // SynchronizedReporter is used to write messages to what would be stdout and
-// stderr from multiple concurrent workers. It synchronizes access to Reader
-// and Writer instances with locking and is therefore suitable only for
-// accepting messages at moderate volume.
+// stderr from multiple concurrent workers, and to account for the failures
+// they report. Everything workers report is published as an Event on the
+// reporter's Bus, and rendered or acted on by its subscribers: complete
+// lines written to ErrWriter and OutWriter, including Log's messages, are
+// published as output, which is queued on a buffered channel and written out
+// by a single goroutine, so lines written whole aren't interleaved or
+// reordered; the rest of a line is held until it's completed or the reporter
+// is flushed. Flush waits for everything queued to be written, and Close
+// also stops the goroutine; writes after Close go straight to the
+// destination. If stderr is a terminal, the Progress of operations written to
+// the reporter is shown on live status lines below the output, and Log's
+// level prefixes are colored unless the NO_COLOR envvar is set. Output may
+// also be copied to a log file with TeeTo, and events written as JSON lines
+// with StreamEventsTo; other programs can subscribe to the Bus themselves.
 type SynchronizedReporter struct {
-	ErrWriter          *io.PipeWriter
-	OutWriter          *io.PipeWriter
-	DelegateErrorCount int
-	bufferLen          int
-	pipeWatchSleep     time.Duration
-	errChannel         chan DelegateError // a way for delegates to report errors from go routines
+	ErrWriter io.Writer
+	OutWriter io.Writer
+	Log       *Logger
+	Bus       *Bus
+	failures  *failures
+	events    chan reportEvent
+	done      chan struct{}
+	lock      sync.RWMutex // held to queue events, and exclusively to close the channel
+	closed    bool
+	writers   []*lineWriter
+
+	// set by CI; read by a Prompter
+	ci bool
+
+	// the live status lines, if shown, and the Progresses on them
+	live        bool
+	outDest     io.Writer
+	errDest     io.Writer
+	statusLock  sync.Mutex
+	progresses  []*Progress
+	stopStatus  chan struct{}
+	stopOnce    sync.Once
+	statusLines []string // drawn by the writing goroutine only
 }
 
-// NewSynchronizedReporter instantiates a SynchronizedReporter with given
-// buffer length and sleep duration for each pipe watch go routine.
-func NewSynchronizedReporter(bufferLen int, pipeWatchSleep time.Duration) *SynchronizedReporter {
+// reportEvent is content to write to a destination; if flushed is set, a
+// request to close flushed once everything queued before it is written; or
+// if redraw is set, new live status lines
+type reportEvent struct {
+	dest    io.Writer
+	content []byte
+	flushed chan struct{}
+	redraw  bool
+	status  []string
+}
 
-	stderrPipeReader, stderrPipeWriter := io.Pipe()
-	stdoutPipeReader, stdoutPipeWriter := io.Pipe()
+// NewSynchronizedReporter instantiates a SynchronizedReporter writing to
+// stdout and stderr that queues up to the given number of events before
+// writers wait for them to be written.
+func NewSynchronizedReporter(bufferLen int) *SynchronizedReporter {
+	return newSynchronizedReporter(bufferLen, os.Stdout, os.Stderr)
+}
 
+// NewSynchronizedReporterTo is NewSynchronizedReporter writing to the given
+// outputs instead of stdout and stderr, e.g. those of a tool running this one
+func NewSynchronizedReporterTo(bufferLen int, out io.Writer, err io.Writer) *SynchronizedReporter {
+	return newSynchronizedReporter(bufferLen, out, err)
+}
+
+func newSynchronizedReporter(bufferLen int, out io.Writer, err io.Writer) *SynchronizedReporter {
 	reporter := &SynchronizedReporter{
-		ErrWriter:      stderrPipeWriter,
-		OutWriter:      stdoutPipeWriter,
-		bufferLen:      bufferLen,
-		pipeWatchSleep: pipeWatchSleep,
-		errChannel:     make(chan DelegateError),
+		Bus:        NewBus(),
+		events:     make(chan reportEvent, bufferLen),
+		done:       make(chan struct{}),
+		live:       isTerminal(err),
+		outDest:    out,
+		errDest:    err,
+		stopStatus: make(chan struct{}),
 	}
 
-	go reporter.startPipeWatch(stdoutPipeReader, os.Stdout, &sync.Mutex{})
-	go reporter.startPipeWatch(stderrPipeReader, os.Stderr, &sync.Mutex{})
+	errWriter := &lineWriter{reporter: reporter, stream: StreamStderr}
+	outWriter := &lineWriter{reporter: reporter, stream: StreamStdout}
+	reporter.ErrWriter = errWriter
+	reporter.OutWriter = outWriter
+	reporter.Log = NewLogger(errWriter)
+	reporter.Log.SetColor(reporter.live && os.Getenv("NO_COLOR") == "")
+	reporter.writers = []*lineWriter{errWriter, outWriter}
+
+	reporter.failures = &failures{log: reporter.Log}
+	reporter.Bus.Subscribe(reporter.render)
+	reporter.Bus.Subscribe(reporter.failures.observe)
+
+	go reporter.write()
+	if reporter.live {
+		go reporter.refreshStatus()
+	}
 
 	return reporter
 }
 
-// DelegateErrorConsumer takes a functionn for handling errors from delegates transmitted using a Reporter's ErrChannel
-func (s *SynchronizedReporter) DelegateErrorConsumer(fn func(e DelegateError)) {
+// render queues the output published on the Bus to be written to the console
+func (s *SynchronizedReporter) render(e Event) {
+	if e.Event != EventOutput {
+		return
+	}
+
+	dest := s.errDest
+	if e.Stream == StreamStdout {
+		dest = s.outDest
+	}
+	s.queue(reportEvent{dest: dest, content: []byte(e.Message)})
+}
+
+// write writes out queued events in order until the channel is closed
+func (s *SynchronizedReporter) write() {
+	defer close(s.done)
+
+	for e := range s.events {
+		if e.flushed != nil {
+			close(e.flushed)
+			continue
+		}
 
-	go func() {
-		for {
-			// blocking read
-			e := <-s.errChannel
-			s.DelegateErrorCount++
-			fn(e)
+		// the status lines stay below the output
+		s.clearStatus()
+		if e.redraw {
+			s.statusLines = e.status
+		} else {
+			s.writeOut(e)
 		}
-	}()
+		s.drawStatus()
+	}
+}
+
+// writeOut writes an event's content to its destination
+func (s *SynchronizedReporter) writeOut(e reportEvent) {
+	if _, err := e.dest.Write(e.content); err != nil {
+		fmt.Fprintf(os.Stderr, "%s Error writing output. Error: %v\n", OutputErrorPrefix, err)
+	}
+}
+
+// queue queues an event, or writes its content at once if the reporter is closed
+func (s *SynchronizedReporter) queue(e reportEvent) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		if e.flushed != nil {
+			close(e.flushed)
+		} else if e.dest != nil {
+			s.writeOut(e)
+		}
+		return
+	}
+
+	s.events <- e
+}
+
+// Flush writes out held partial lines and waits until everything written to the reporter before is written out
+func (s *SynchronizedReporter) Flush() {
+	for _, w := range s.writers {
+		w.flush()
+	}
+
+	flushed := make(chan struct{})
+	s.queue(reportEvent{flushed: flushed})
+	<-flushed
+}
+
+// Close flushes the reporter and stops its goroutine
+func (s *SynchronizedReporter) Close() {
+	s.Flush()
+
+	// clears the status lines
+	if s.live {
+		s.stopOnce.Do(func() { close(s.stopStatus) })
+		s.queue(reportEvent{redraw: true})
+	}
+
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.lock.Unlock()
+
+	<-s.done
+}
+
+// Quiet stops informational output: Log's debug and informational messages
+// are dropped, including the periodic progress lines of operations, whatever
+// its level, and live status lines aren't shown. Warnings, errors, and
+// OutWriter's output are still written. It's meant to be called once Log's
+// level is set and before anything is written to the reporter.
+func (s *SynchronizedReporter) Quiet() {
+	s.Log.raiseLevel(LevelWarn)
+
+	if s.live {
+		s.live = false
+		s.stopOnce.Do(func() { close(s.stopStatus) })
+	}
+}
+
+// CI makes the output suit CI logs rather than a terminal: live status
+// lines aren't shown, nor colors, so the Progress of operations is written as periodic
+// lines, and a Prompter asks nothing. Each write to ErrWriter or OutWriter is
+// queued whole, as complete lines, with a newline added if it lacks one,
+// rather than held until a line is completed by a later write, which may be
+// another worker's; and it's written out before the write returns. It's meant
+// to be called before anything is written to the reporter.
+func (s *SynchronizedReporter) CI() {
+	s.ci = true
+	s.Log.SetColor(false)
+
+	if s.live {
+		s.live = false
+		s.stopOnce.Do(func() { close(s.stopStatus) })
+	}
+
+	for _, w := range s.writers {
+		w.eager = true
+	}
+}
+
+// colorCodes matches the ANSI SGR codes level prefixes are colored with
+var colorCodes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// tee copies the output published on a Bus to a writer, without color codes
+type tee struct {
+	lock    sync.Mutex
+	w       io.Writer
+	errDest io.Writer
+	failed  bool
+}
+
+func (t *tee) write(e Event) {
+	if e.Event != EventOutput {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// reported once rather than with every line
+	if t.failed {
+		return
+	}
+	if _, err := io.WriteString(t.w, colorCodes.ReplaceAllString(e.Message, "")); err != nil {
+		t.failed = true
+		fmt.Fprintf(t.errDest, "%s Error writing log file, no longer writing to it. Error: %v\n", OutputErrorPrefix, err)
+	}
+}
+
+// TeeTo copies everything written to ErrWriter and OutWriter, without color
+// codes, to w as well, e.g. a LogFile, so it's kept beyond the scrollback of
+// a terminal. Live status lines aren't copied. It's meant to be called before
+// anything is written to the reporter.
+func (s *SynchronizedReporter) TeeTo(w io.Writer) {
+	s.Bus.Subscribe((&tee{w: w, errDest: s.errDest}).write)
+}
+
+// DelegateErrorConsumer takes a function for handling errors from delegates
+// reported with DelegateErr. Without one, errors are written to ErrWriter.
+func (s *SynchronizedReporter) DelegateErrorConsumer(fn func(e DelegateError)) {
+	s.failures.lock.Lock()
+	defer s.failures.lock.Unlock()
+
+	s.failures.consumer = fn
 }
 
-// DelegateErr enqueues an error in the ErrChannel
+// DelegateErr counts an error and hands it to the consumer; once it returns,
+// the consumer has handled the error. Its exit status is ExitUserError for
+// user errors and ExitError otherwise.
 func (s *SynchronizedReporter) DelegateErr(userError bool, breaking bool, msg string) {
+	code := ExitError
+	if userError {
+		code = ExitUserError
+	}
 
-	s.errChannel <- DelegateError{
+	s.delegate(DelegateError{
 		UserError: userError,
 		Breaking:  breaking,
+		Code:      code,
+		Err:       &Failure{Kind: kindFor(code), Msg: strings.TrimRight(msg, "\n")},
 		msg:       msg,
+	})
+}
+
+// DelegateFailure is DelegateErr for a breaking error of a class of failure
+// with an exit status of its own, one of the Exit* constants, in the given
+// stage of processing an image; stage and image may be empty
+func (s *SynchronizedReporter) DelegateFailure(code int, stage string, image string, userError bool, msg string) {
+	s.delegate(DelegateError{
+		UserError: userError,
+		Breaking:  true,
+		Code:      code,
+		Stage:     stage,
+		Image:     image,
+		Err:       &Failure{Kind: kindFor(code), Stage: stage, Image: image, Msg: strings.TrimRight(msg, "\n")},
+		msg:       msg,
+	})
+}
+
+// Fail is DelegateFailure for a breaking error that's a typed failure: its
+// exit status and whether it's a user error follow from its kind (see
+// KindOf), and its stage, image, and part from the Failure it is or wraps.
+// Its event is tagged with the build ID the context carries, if any.
+func (s *SynchronizedReporter) Fail(ctx context.Context, err error) {
+	e := delegateErrorOf(err)
+	e.Build = BuildID(ctx)
+	s.delegate(e)
+}
+
+// delegateErrorOf returns the breaking DelegateError for a typed failure
+func delegateErrorOf(err error) DelegateError {
+	e := DelegateError{
+		UserError: IsUserError(err),
+		Breaking:  true,
+		Code:      ExitCodeOf(err),
+		Err:       err,
+		msg:       err.Error() + "\n",
+	}
+
+	var failure *Failure
+	if errors.As(err, &failure) {
+		e.Stage, e.Image, e.Part = failure.Stage, failure.Image, failure.Part
 	}
+	return e
+}
+
+// delegate publishes an error event for the error, which is accounted for before it returns
+func (s *SynchronizedReporter) delegate(e DelegateError) {
+	s.Bus.Publish(Event{Event: EventError, Build: e.Build, Stage: e.Stage, Image: e.Image, Part: e.Part, Code: e.Code, Class: ExitClass(e.Code), Message: e.msg, Err: e})
 }
 
-func (s *SynchronizedReporter) startPipeWatch(pipeReader *io.PipeReader, destWriter *os.File, lock *sync.Mutex) {
-	defer pipeReader.Close()
-	buf := make([]byte, s.bufferLen)
+// DelegateErrorCount returns the number of errors reported with
+// DelegateErr, DelegateFailure, and Fail
+func (s *SynchronizedReporter) DelegateErrorCount() int {
+	s.failures.lock.Lock()
+	defer s.failures.lock.Unlock()
 
-	for {
-		lock.Lock()
-		readN, err := pipeReader.Read(buf)
-		if err != nil && err != io.EOF {
-			fmt.Fprintf(destWriter, fmt.Sprintf("Error reading from pipereader. Error: %v\n", err), OutputErrorPrefix)
-		}
+	return len(s.failures.errors)
+}
+
+// DelegateExitCode returns the exit status the errors reported with
+// DelegateErr, DelegateFailure, and Fail call for: 0 if there were none,
+// ExitUserError if they were all user errors, and otherwise the status of
+// the first that wasn't
+func (s *SynchronizedReporter) DelegateExitCode() int {
+	s.failures.lock.Lock()
+	defer s.failures.lock.Unlock()
+
+	return s.failures.exitCode
+}
+
+// DelegateErrors returns the errors reported with DelegateErr, DelegateFailure, and Fail, in the order reported
+func (s *SynchronizedReporter) DelegateErrors() []DelegateError {
+	s.failures.lock.Lock()
+	defer s.failures.lock.Unlock()
+
+	return append([]DelegateError{}, s.failures.errors...)
+}
+
+// failures accounts for the error events published on a reporter's Bus: it
+// keeps their errors, decides the exit status they call for, and hands each
+// to the consumer, or logs it if there's none
+type failures struct {
+	lock     sync.Mutex
+	log      *Logger
+	consumer func(e DelegateError)
+	errors   []DelegateError
+	exitCode int
+}
+
+func (f *failures) observe(event Event) {
+	if event.Event != EventError || event.Err == nil {
+		return
+	}
+
+	e, ok := event.Err.(DelegateError)
+	if !ok {
+		e = delegateErrorOf(event.Err)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.errors = append(f.errors, e)
+	if f.exitCode == 0 || f.exitCode == ExitUserError {
+		f.exitCode = e.Code
+	}
+
+	if f.consumer != nil {
+		f.consumer(e)
+	} else {
+		f.log.Errorf("%v", e.Error())
+	}
+}
+
+// lineWriter publishes the complete lines written to it as output on a
+// reporter's Bus, or if eager, each write as complete lines, waiting for
+// them to be written. Lines are published while holding its lock, so
+// subscribers mustn't write to a lineWriter when handling output.
+type lineWriter struct {
+	reporter *SynchronizedReporter
+	stream   string
+	lock     sync.Mutex
+	partial  []byte
+	eager    bool
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.write(p, Event{})
+	return len(p), nil
+}
+
+// write publishes the complete lines of p, with the level, subsystem, and
+// build of the log message p is, given in message, if it is one and completes
+// no earlier partial line
+func (w *lineWriter) write(p []byte, message Event) {
+	if w.eager {
+		w.writeEager(p, message)
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.partial) > 0 {
+		message = Event{}
+	}
+	w.partial = append(w.partial, p...)
+
+	// published while locked so the lines of each writer stay in order
+	if i := bytes.LastIndexByte(w.partial, '\n'); i >= 0 {
+		lines := w.partial[:i+1]
+		w.partial = append([]byte{}, w.partial[i+1:]...)
+		w.publish(lines, message)
+	}
+}
+
+func (w *lineWriter) writeEager(p []byte, message Event) {
+	if len(p) == 0 {
+		return
+	}
+
+	lines := append([]byte{}, p...)
+	if lines[len(lines)-1] != '\n' {
+		lines = append(lines, '\n')
+	}
+
+	written := make(chan struct{})
+	w.publish(lines, message)
+	w.reporter.queue(reportEvent{flushed: written})
+	<-written
+}
+
+func (w *lineWriter) publish(lines []byte, message Event) {
+	w.reporter.Bus.Publish(Event{Event: EventOutput, Stream: w.stream, Level: message.Level, Subsystem: message.Subsystem, Build: message.Build, Message: string(lines)})
+}
 
-		destWriter.Write(buf[0:readN])
-		lock.Unlock()
+// flush publishes the held partial line, if any
+func (w *lineWriter) flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
-		time.Sleep(s.pipeWatchSleep)
+	if len(w.partial) > 0 {
+		w.publish(w.partial, Event{})
+		w.partial = nil
 	}
 }
@@ -0,0 +1,327 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func Test_SynchronizedReporter_Suite(suite *testing.T) {
+
+	suite.Run("lines written concurrently aren't interleaved or lost", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(4, out, out)
+
+		var group sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			group.Add(1)
+			go func(w int) {
+				defer group.Done()
+				for i := 0; i < 100; i++ {
+					fmt.Fprintf(reporter.ErrWriter, "%s worker %v line %v\n", OutputInfoPrefix, w, i)
+				}
+			}(w)
+		}
+		group.Wait()
+		reporter.Close()
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		assert.Equal(t, 800, len(lines))
+
+		next := map[string]int{}
+		for _, line := range lines {
+			var w, i int
+			_, err := fmt.Sscanf(line, OutputInfoPrefix+" worker %d line %d", &w, &i)
+			assert.Nil(t, err, line)
+
+			// each worker's lines stay in order
+			key := fmt.Sprint(w)
+			assert.Equal(t, next[key], i)
+			next[key] = i + 1
+		}
+	})
+
+	suite.Run("Flush writes partial lines and keeps order across outputs", func(t *testing.T) {
+		out := &syncBuffer{}
+		err := &syncBuffer{}
+		both := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, io.MultiWriter(out, both), io.MultiWriter(err, both))
+
+		fmt.Fprintf(reporter.ErrWriter, "first\n")
+		fmt.Fprintf(reporter.OutWriter, "second\n")
+		fmt.Fprintf(reporter.ErrWriter, "third, unfinished")
+
+		reporter.Flush()
+		assert.Equal(t, "first\nthird, unfinished", err.String())
+		assert.Equal(t, "second\n", out.String())
+		assert.Equal(t, "first\nsecond\nthird, unfinished", both.String())
+
+		// written straight through once closed
+		reporter.Close()
+		fmt.Fprintf(reporter.OutWriter, "after\n")
+		assert.Equal(t, "second\nafter\n", out.String())
+		reporter.Close()
+	})
+
+	suite.Run("CI writes each write as complete lines before it returns", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		defer reporter.Close()
+		reporter.CI()
+
+		// written at once, without waiting for Flush, and never completed by another write
+		fmt.Fprintf(reporter.ErrWriter, "worker 1: half")
+		assert.Equal(t, "worker 1: half\n", out.String())
+		fmt.Fprintf(reporter.ErrWriter, "worker 2: whole\n")
+		assert.Equal(t, "worker 1: half\nworker 2: whole\n", out.String())
+
+		assert.False(t, newPrompter(reporter, strings.NewReader(""), true, nil).Interactive())
+	})
+
+	suite.Run("Quiet drops informational lines only", func(t *testing.T) {
+		out := &syncBuffer{}
+		err := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, err)
+		now := stopClock(reporter.Log)
+		reporter.Log.SetLevel(LevelDebug, map[string]Level{SubsystemUpload: LevelDebug})
+		reporter.Quiet()
+
+		reporter.Log.Infof("chatter")
+		reporter.Log.Subsystem(SubsystemUpload).Debugf("details")
+		reporter.Log.Warnf("problem")
+		fmt.Fprintf(reporter.OutWriter, "result\n")
+
+		progress := NewProgress(reporter.ErrWriter, "Pulling", "downloaded", 100, 0)
+		progress.Write(make([]byte, 10))
+		progress.Finish()
+
+		reporter.Close()
+		assert.Equal(t, now+" "+OutputWarnPrefix+" problem\n", err.String())
+		assert.Equal(t, "result\n", out.String())
+	})
+
+	suite.Run("TeeTo copies both outputs without colors, even once closed", func(t *testing.T) {
+		out := &syncBuffer{}
+		err := &syncBuffer{}
+		tee := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, err)
+		now := stopClock(reporter.Log)
+		reporter.Log.SetColor(true)
+		reporter.TeeTo(tee)
+
+		reporter.Log.Infof("building")
+		fmt.Fprintf(reporter.OutWriter, "result\n")
+		reporter.Close()
+		reporter.Log.Infof("Exiting.")
+
+		assert.Equal(t, now+" \x1b[36m"+OutputInfoPrefix+"\x1b[0m building\n"+now+" \x1b[36m"+OutputInfoPrefix+"\x1b[0m Exiting.\n", err.String())
+		assert.Equal(t, "result\n", out.String())
+		assert.Equal(t, now+" "+OutputInfoPrefix+" building\nresult\n"+now+" "+OutputInfoPrefix+" Exiting.\n", tee.String())
+	})
+
+	suite.Run("StreamEventsTo writes stage, progress, and error events as JSON lines", func(t *testing.T) {
+		out := &syncBuffer{}
+		events := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		reporter.StreamEventsTo(events)
+		stopClock(reporter.Log)
+		reporter.Bus.now = reporter.Log.settings.now
+
+		reporter.StageStarted(WithBuildID(context.Background(), "1a2b"), "pull", "a:1")
+		progress := NewProgress(reporter.ErrWriter, "Pulling Docker image a:1", "downloaded", 100, time.Hour)
+		progress.Write(make([]byte, 10))
+		progress.Write(make([]byte, 30))
+		progress.Finish()
+		reporter.StageFinished(context.Background(), "pull", "a:1", 1500*time.Millisecond, true)
+		reporter.DelegateFailure(ExitPull, "pull", "b:1", false, "not found")
+		reporter.Close()
+
+		now := `{"time":"2017-10-02T15:04:05.000000Z",`
+		assert.Equal(t, now+`"event":"stage_started","build":"1a2b","stage":"pull","image":"a:1"}
+`+now+`"event":"progress","operation":"Pulling Docker image a:1","bytes":10,"total":100}
+`+now+`"event":"progress","operation":"Pulling Docker image a:1","bytes":40,"total":100}
+`+now+`"event":"stage_finished","stage":"pull","image":"a:1","seconds":1.5,"ok":true}
+`+now+`"event":"error","stage":"pull","image":"b:1","code":5,"class":"pull","message":"not found"}
+`, events.String())
+
+		// without a stream, nothing is emitted
+		unstreamed := newSynchronizedReporter(16, out, out)
+		unstreamed.StageStarted(context.Background(), "pull", "a:1")
+		unstreamed.Close()
+		assert.NotContains(t, out.String(), "stage_started")
+	})
+
+	suite.Run("DelegateErr returns once the consumer has handled the error", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		now := stopClock(reporter.Log)
+		defer reporter.Close()
+
+		assert.Equal(t, 0, reporter.DelegateExitCode())
+
+		reporter.DelegateErr(true, true, "unconsumed\n")
+		reporter.Flush()
+		assert.Equal(t, now+" "+OutputErrorPrefix+" unconsumed\n", out.String())
+		assert.Equal(t, 2, reporter.DelegateExitCode())
+
+		var handled []DelegateError
+		reporter.DelegateErrorConsumer(func(e DelegateError) {
+			handled = append(handled, e)
+		})
+
+		reporter.DelegateErr(false, true, "failed")
+		assert.Equal(t, 1, len(handled))
+		assert.Equal(t, "failed", handled[0].Error())
+		assert.False(t, handled[0].UserError)
+		assert.Equal(t, 2, reporter.DelegateErrorCount())
+		assert.Equal(t, 3, reporter.DelegateExitCode())
+
+		// a later user error doesn't lessen the status
+		reporter.DelegateErr(true, true, "user")
+		assert.Equal(t, 3, reporter.DelegateExitCode())
+	})
+
+	suite.Run("DelegateFailure exits with the status of the first failure that isn't a user error", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		defer reporter.Close()
+		reporter.DelegateErrorConsumer(func(e DelegateError) {})
+
+		reporter.DelegateFailure(ExitUserError, "pull", "x:1", true, "refused by policy")
+		assert.Equal(t, ExitUserError, reporter.DelegateExitCode())
+
+		reporter.DelegateFailure(ExitPull, "pull", "y:1", false, "not found")
+		reporter.DelegateFailure(ExitSign, "sign", "z:1", false, "no key")
+		assert.Equal(t, ExitPull, reporter.DelegateExitCode())
+
+		errs := reporter.DelegateErrors()
+		assert.Equal(t, 3, len(errs))
+		assert.Equal(t, "y:1", errs[1].Image)
+		assert.Equal(t, "pull", errs[1].Stage)
+		assert.Equal(t, ExitSign, errs[2].Code)
+		assert.True(t, errs[2].Breaking)
+		assert.True(t, errors.Is(errs[2], ErrSigning))
+	})
+
+	suite.Run("Fail reports a typed failure with the exit status of its kind", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		defer reporter.Close()
+		reporter.DelegateErrorConsumer(func(e DelegateError) {})
+
+		cause := errors.New("manifest unknown")
+		reporter.Fail(context.Background(), &Failure{Kind: ErrImageNotFound, Stage: "pull", Image: "x:1", Msg: "Error writing docker image x:1", Err: cause})
+		assert.Equal(t, ExitPull, reporter.DelegateExitCode())
+
+		reporter.Fail(WithBuildID(context.Background(), "1a2b"), fmt.Errorf("Unable to sign: %w", &Failure{Kind: ErrSigning, Stage: "sign", Image: "y:1", Part: "abc", Msg: "Error hashing docker image y:1"}))
+		assert.Equal(t, ExitPull, reporter.DelegateExitCode())
+
+		errs := reporter.DelegateErrors()
+		assert.Equal(t, 2, len(errs))
+		assert.Equal(t, "Error writing docker image x:1. Error: manifest unknown\n", errs[0].Error())
+		assert.True(t, errs[0].UserError)
+		assert.Equal(t, "x:1", errs[0].Image)
+		assert.True(t, errors.Is(errs[0], ErrImageNotFound))
+		assert.True(t, errors.Is(errs[0], cause))
+		assert.False(t, errors.Is(errs[0], ErrSigning))
+
+		assert.False(t, errs[1].UserError)
+		assert.Equal(t, "sign", errs[1].Stage)
+		assert.Equal(t, "abc", errs[1].Part)
+		assert.Equal(t, "", errs[0].Build)
+		assert.Equal(t, "1a2b", errs[1].Build)
+	})
+}
+
+func Test_KindOf(t *testing.T) {
+	assert.Equal(t, ErrAuthFailed, KindOf(&Failure{Kind: ErrAuthFailed}))
+	assert.Equal(t, ErrPolicy, KindOf(&Failure{Kind: ErrPull, Err: &Failure{Kind: ErrPolicy}}))
+	assert.Equal(t, ErrFailed, KindOf(errors.New("disk full")))
+
+	assert.Equal(t, ExitPull, ExitCodeOf(&Failure{Kind: ErrAuthFailed}))
+	assert.Equal(t, ExitPublish, ExitCodeOf(&Failure{Kind: ErrPublish}))
+	assert.Equal(t, ExitError, ExitCodeOf(errors.New("disk full")))
+
+	assert.True(t, IsUserError(&Failure{Kind: ErrImageNotFound}))
+	assert.False(t, IsUserError(&Failure{Kind: ErrExport}))
+
+	assert.Equal(t, ErrUsage, kindFor(ExitUserError))
+	assert.Equal(t, ErrPull, kindFor(ExitPull))
+	assert.Equal(t, ErrFailed, kindFor(42))
+}
+
+func Test_ExitClass(t *testing.T) {
+	assert.Equal(t, "usage", ExitClass(ExitUserError))
+	assert.Equal(t, "pull", ExitClass(ExitPull))
+	assert.Equal(t, "publish", ExitClass(ExitPublish))
+	assert.Equal(t, "timeout", ExitClass(ExitTimeout))
+	assert.Equal(t, "interrupted", ExitClass(130))
+	assert.Equal(t, "error", ExitClass(42))
+}
+
+func Test_Progress_Suite(suite *testing.T) {
+
+	suite.Run("Progress writes periodic lines when not on a terminal", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		now := stopClock(reporter.Log)
+
+		progress := NewProgress(reporter.ErrWriter, "Uploading part.tgz", "uploaded", 4096, 0)
+		io.WriteString(progress, strings.Repeat("x", 1024))
+		progress.Update(2048, 4096, "2 of 4 chunks")
+		progress.Finish()
+
+		reporter.Close()
+		assert.Equal(t, now+" "+OutputInfoPrefix+" Uploading part.tgz: 1.0 KiB of 4.0 KiB uploaded (25%)\n"+
+			now+" "+OutputInfoPrefix+" Uploading part.tgz: 2 of 4 chunks, 2.0 KiB of 4.0 KiB uploaded (50%)\n", out.String())
+
+		unknown := NewProgress(ioutil.Discard, "Exporting", "exported", 0, time.Hour)
+		unknown.Write(make([]byte, 3<<20))
+		assert.Equal(t, "Exporting: 3.0 MiB exported", unknown.String())
+	})
+
+	suite.Run("Progress is shown on status lines below the output on a terminal", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		reporter.live = true
+
+		progress := NewProgress(reporter.ErrWriter, "Pulling Docker image x", "downloaded", 2048, time.Hour)
+		progress.Update(1024, 2048, "")
+		reporter.queue(reportEvent{redraw: true, status: reporter.renderStatus()})
+
+		fmt.Fprintf(reporter.ErrWriter, "%s Pulled Docker image y\n", OutputInfoPrefix)
+		progress.Finish()
+		reporter.Close()
+
+		status := "Pulling Docker image x: 1.0 KiB of 2.0 KiB downloaded (50%)"
+		assert.Equal(t, status+"\r\033[J"+OutputInfoPrefix+" Pulled Docker image y\n"+status+"\r\033[J", out.String())
+	})
+}
@@ -0,0 +1,36 @@
+package cmdtools
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// buildIDKey is the key of the build ID among a context's values
+type buildIDKey struct{}
+
+// NewBuildID returns a random ID for a build, 16 hex digits, to tell its log
+// messages and events apart from those of other builds
+func NewBuildID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// WithBuildID returns a context carrying the given build ID, which the log
+// messages and events of work done with it are tagged with (see
+// Logger.WithContext)
+func WithBuildID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, buildIDKey{}, id)
+}
+
+// BuildID returns the build ID the context carries, or "" if it has none
+func BuildID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(buildIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,23 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_BuildID(t *testing.T) {
+	id := NewBuildID()
+	assert.Equal(t, 16, len(id))
+	assert.NotEqual(t, id, NewBuildID())
+
+	assert.Equal(t, "", BuildID(context.Background()))
+	ctx := WithBuildID(context.Background(), id)
+	assert.Equal(t, id, BuildID(ctx))
+
+	child, cancel := context.WithCancel(ctx)
+	defer cancel()
+	assert.Equal(t, id, BuildID(child))
+}
@@ -0,0 +1,140 @@
+package cmdtools
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of failure. Errors reported by workers are, or wrap, a Failure of
+// one of these kinds, so programs can tell them apart with errors.Is (e.g.
+// errors.Is(err, cmdtools.ErrImageNotFound)) rather than by their messages.
+// Each kind has an exit status (see ExitCodeOf).
+var (
+	// ErrUsage is for invalid options or input, e.g. existing output that isn't to be replaced
+	ErrUsage = errors.New("invalid usage")
+
+	// ErrPolicy is for an image refused by policy
+	ErrPolicy = errors.New("refused by policy")
+
+	// ErrImageNotFound is for an image that doesn't exist locally or in its registry
+	ErrImageNotFound = errors.New("image not found")
+
+	// ErrAuthFailed is for a registry that denied access to an image
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrDocker is for a Docker daemon that can't be reached or used
+	ErrDocker = errors.New("Docker daemon failed")
+
+	// ErrPull is for an image that couldn't be pulled for another reason
+	ErrPull = errors.New("pull failed")
+
+	// ErrExport is for an image that couldn't be exported, compressed, or written to disk
+	ErrExport = errors.New("export failed")
+
+	// ErrSigning is for a part or metadata that couldn't be signed, including an unreadable private key
+	ErrSigning = errors.New("signing failed")
+
+	// ErrPublish is for a part or Pkg that couldn't be uploaded, verified once uploaded, or published
+	ErrPublish = errors.New("publish failed")
+
+	// ErrTimeout is for a build stopped for taking longer than it was allowed
+	ErrTimeout = errors.New("timed out")
+
+	// ErrFailed is for failures of no other kind
+	ErrFailed = errors.New("failed")
+)
+
+// the exit status of each kind of failure, and whether it's the user's rather than the tools'
+var kindExits = []struct {
+	kind      error
+	code      int
+	userError bool
+}{
+	{ErrUsage, ExitUserError, true},
+	{ErrPolicy, ExitUserError, true},
+	{ErrImageNotFound, ExitPull, true},
+	{ErrAuthFailed, ExitPull, true},
+	{ErrDocker, ExitDocker, false},
+	{ErrPull, ExitPull, false},
+	{ErrExport, ExitExport, false},
+	{ErrSigning, ExitSign, false},
+	{ErrPublish, ExitPublish, false},
+	{ErrTimeout, ExitTimeout, false},
+	{ErrFailed, ExitError, false},
+}
+
+// Failure is a failure of a kind, one of the Err* kinds, in a stage of
+// processing an image or part, with the error that caused it. errors.Is
+// matches a Failure with its kind as well as with its cause's chain.
+type Failure struct {
+	Kind  error
+	Stage string // the stage of processing that failed (e.g. "pull"), if any
+	Image string // the image whose processing failed, if any
+	Part  string // the hash of the part whose processing failed, if any
+	Msg   string // what failed, e.g. "Error writing docker image x"; empty if the cause says
+	Err   error  // the cause, if any
+}
+
+func (f *Failure) Error() string {
+	if f.Err == nil {
+		return f.Msg
+	} else if f.Msg == "" {
+		return f.Err.Error()
+	}
+	return fmt.Sprintf("%s. Error: %v", f.Msg, f.Err)
+}
+
+// Unwrap returns the cause of the failure
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+// Is tells if target is the failure's kind
+func (f *Failure) Is(target error) bool {
+	return target == f.Kind
+}
+
+// KindOf returns the kind of failure err is or wraps, the first of the Err*
+// kinds errors.Is matches it with, or ErrFailed if none does
+func KindOf(err error) error {
+	for _, k := range kindExits {
+		if errors.Is(err, k.kind) {
+			return k.kind
+		}
+	}
+	return ErrFailed
+}
+
+// ExitCodeOf returns the exit status for the kind of failure err is (see KindOf)
+func ExitCodeOf(err error) int {
+	kind := KindOf(err)
+	for _, k := range kindExits {
+		if k.kind == kind {
+			return k.code
+		}
+	}
+	return ExitError
+}
+
+// IsUserError tells if err is a kind of failure caused by the options or
+// input given, e.g. an image that doesn't exist, rather than by the tools
+func IsUserError(err error) bool {
+	kind := KindOf(err)
+	for _, k := range kindExits {
+		if k.kind == kind {
+			return k.userError
+		}
+	}
+	return false
+}
+
+// kindFor returns the kind of failure whose exit status is code: ErrUsage for
+// ExitUserError, and otherwise the kind that isn't a user error
+func kindFor(code int) error {
+	for _, k := range kindExits {
+		if k.code == code && k.userError == (code == ExitUserError) {
+			return k.kind
+		}
+	}
+	return ErrFailed
+}
@@ -0,0 +1,120 @@
+package cmdtools
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// The kinds of events published on a reporter's Bus
+const (
+	// EventStageStarted is for an image entering a stage of the build: "pull", "write", "sign", or "place"
+	EventStageStarted = "stage_started"
+
+	// EventStageFinished is for an image leaving a stage, with the seconds it
+	// took and whether it succeeded
+	EventStageFinished = "stage_finished"
+
+	// EventProgress is for the bytes a long operation has processed of its total, if known
+	EventProgress = "progress"
+
+	// EventError is for a failure reported by a worker, with its exit status and class
+	EventError = "error"
+
+	// EventExit is for the end of the run, with its exit status
+	EventExit = "exit"
+
+	// EventOutput is for complete lines written to ErrWriter or OutWriter, or
+	// a log message, with its level and subsystem. It's rendered on the
+	// console and copied to the log file, but isn't written to event streams.
+	EventOutput = "output"
+)
+
+// The streams of EventOutput events
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// eventInterval is the minimum time between progress events for a single operation
+const eventInterval = time.Second
+
+// Event is an event of a run, published on a reporter's Bus and written as a
+// JSON object on a line of its own to an event stream (see
+// SynchronizedReporter.StreamEventsTo) for programs following the run.
+// Fields that don't apply to the kind of event are omitted.
+type Event struct {
+	Time      string  `json:"time"`
+	Event     string  `json:"event"`
+	Build     string  `json:"build,omitempty"`
+	Stage     string  `json:"stage,omitempty"`
+	Image     string  `json:"image,omitempty"`
+	Part      string  `json:"part,omitempty"`
+	Operation string  `json:"operation,omitempty"`
+	Bytes     int64   `json:"bytes,omitempty"`
+	Total     int64   `json:"total,omitempty"`
+	Seconds   float64 `json:"seconds,omitempty"`
+	OK        *bool   `json:"ok,omitempty"`
+	Code      int     `json:"code,omitempty"`
+	Class     string  `json:"class,omitempty"`
+	Stream    string  `json:"stream,omitempty"`
+	Level     string  `json:"level,omitempty"`
+	Subsystem string  `json:"subsystem,omitempty"`
+	Message   string  `json:"message,omitempty"`
+
+	// Err is the DelegateError of an EventError, for the reporter's
+	// accounting of failures; it isn't written to event streams
+	Err error `json:"-"`
+}
+
+// eventStream writes events other than output to out, each whole
+type eventStream struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+// StreamEventsTo writes the events of the run to w as JSON lines: stages
+// started and finished by images, progress of long operations, failures
+// reported with DelegateFailure, DelegateErr, or Fail, and the exit. If w is
+// ErrWriter or OutWriter, events are written in order with the other output.
+// It's meant to be called before anything is written to the reporter.
+func (s *SynchronizedReporter) StreamEventsTo(w io.Writer) {
+	s.Bus.Subscribe((&eventStream{out: w}).emit)
+}
+
+// Emit publishes an event on the reporter's Bus, with the current time
+func (s *SynchronizedReporter) Emit(e Event) {
+	if s == nil {
+		return
+	}
+	s.Bus.Publish(e)
+}
+
+// StageStarted emits an EventStageStarted event, tagged with the build ID the context carries, if any
+func (s *SynchronizedReporter) StageStarted(ctx context.Context, stage string, image string) {
+	s.Emit(Event{Event: EventStageStarted, Build: BuildID(ctx), Stage: stage, Image: image})
+}
+
+// StageFinished emits an EventStageFinished event, tagged with the build ID the context carries, if any
+func (s *SynchronizedReporter) StageFinished(ctx context.Context, stage string, image string, took time.Duration, ok bool) {
+	s.Emit(Event{Event: EventStageFinished, Build: BuildID(ctx), Stage: stage, Image: image, Seconds: took.Seconds(), OK: &ok})
+}
+
+func (e *eventStream) emit(event Event) {
+	// writing the line to a reporter's writer publishes its output
+	if event.Event == EventOutput {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	// written whole so a SynchronizedReporter's writer queues the line at once
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.out.Write(append(line, '\n'))
+}
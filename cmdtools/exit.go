@@ -0,0 +1,67 @@
+package cmdtools
+
+// Exit statuses for the classes of failure, so scripts can tell, say, a
+// Docker daemon that's down or a registry that's unreachable from an option
+// that's wrong
+const (
+	// ExitUserError is for invalid options or input, e.g. a missing file or an image refused by policy
+	ExitUserError = 2
+
+	// ExitError is for invocation errors, like unknown options, and failures of no other class
+	ExitError = 3
+
+	// ExitDocker is for a Docker daemon that can't be reached or used
+	ExitDocker = 4
+
+	// ExitPull is for images that can't be pulled, including registry authentication failures
+	ExitPull = 5
+
+	// ExitExport is for images that can't be exported, compressed, or written to disk
+	ExitExport = 6
+
+	// ExitSign is for parts or metadata that can't be signed, including an unreadable private key
+	ExitSign = 7
+
+	// ExitPublish is for Pkgs that can't be uploaded, verified once uploaded, or published
+	ExitPublish = 8
+
+	// ExitTimeout is for builds stopped for taking longer than they were allowed
+	ExitTimeout = 9
+)
+
+// ExitInterrupted is for commands interrupted, e.g. by SIGINT; those stopped
+// by another signal exit with 128 plus its number, as shells report it
+const ExitInterrupted = 130
+
+var exitClasses = map[int]string{
+	ExitUserError: "usage",
+	ExitError:     "error",
+	ExitDocker:    "docker",
+	ExitPull:      "pull",
+	ExitExport:    "export",
+	ExitSign:      "sign",
+	ExitPublish:   "publish",
+	ExitTimeout:   "timeout",
+}
+
+// ExitClasses returns the names of the classes of failure ExitClass returns,
+// in the order of their statuses, then "interrupted"
+func ExitClasses() []string {
+	classes := []string{}
+	for code := ExitUserError; code <= ExitTimeout; code++ {
+		classes = append(classes, exitClasses[code])
+	}
+	return append(classes, "interrupted")
+}
+
+// ExitClass names the class of failure an exit status is for, e.g. "pull",
+// or returns "interrupted" for the statuses of signals and "error" for any
+// other
+func ExitClass(code int) string {
+	if class, ok := exitClasses[code]; ok {
+		return class
+	} else if code > 128 {
+		return "interrupted"
+	}
+	return exitClasses[ExitError]
+}
@@ -0,0 +1,310 @@
+package cmdtools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message
+type Level int
+
+// The levels of log messages, from the most to the least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{LevelDebug: "debug", LevelInfo: "info", LevelWarn: "warn", LevelError: "error"}
+
+var levelPrefixes = map[Level]string{LevelDebug: OutputDebugPrefix, LevelInfo: OutputInfoPrefix, LevelWarn: OutputWarnPrefix, LevelError: OutputErrorPrefix}
+
+// levelColors are the ANSI SGR codes level prefixes are colored with on a
+// terminal: gray, cyan, yellow, and bold red
+var levelColors = map[Level]string{LevelDebug: "90", LevelInfo: "36", LevelWarn: "33", LevelError: "1;31"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// The formats log messages can be written in
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// The subsystems with loggers of their own, whose levels can be set separately
+const (
+	SubsystemDocker   = "docker"
+	SubsystemCompress = "compress"
+	SubsystemSign     = "sign"
+	SubsystemUpload   = "upload"
+)
+
+var subsystems = []string{SubsystemDocker, SubsystemCompress, SubsystemSign, SubsystemUpload}
+
+// logTimeFormat is the RFC 3339 format of the timestamps of log messages,
+// always in UTC and to the microsecond, so they can be correlated with the
+// logs of registries and CDNs
+const logTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// Logger writes leveled log messages, each as a single line: in the text
+// format the timestamp, level prefix, subsystem, and message, e.g.
+//
+//	2017-10-02T15:04:05.000000Z [INFO] docker: Pulled Docker image x: 3 layers, 1.0 GiB
+//
+// or in the JSON format an object with the fields "time", "level", "build"
+// and "subsystem" (if any), and "msg". Messages of a logger for a build (see
+// WithContext) have its ID after the level prefix in the text format, e.g.
+// "[INFO] build=1a2b3c4d5e6f7a8b docker: ...". If color is on, level prefixes
+// in the text format are colored by level. Messages below the level set for
+// the logger's subsystem are dropped. A logger and the loggers for its
+// subsystems and builds share their settings.
+type Logger struct {
+	out       io.Writer
+	subsystem string
+	build     string
+	settings  *logSettings
+}
+
+type logSettings struct {
+	lock   sync.RWMutex
+	level  Level
+	levels map[string]Level // overrides level for subsystems
+	format string
+	color  bool
+	now    func() time.Time
+}
+
+// NewLogger returns a logger writing text messages at LevelInfo and above to out
+func NewLogger(out io.Writer) *Logger {
+	return &Logger{
+		out:      out,
+		settings: &logSettings{level: LevelInfo, levels: map[string]Level{}, format: LogFormatText, now: time.Now},
+	}
+}
+
+// LoggerFor returns the logger of the SynchronizedReporter whose writer out
+// is, so messages follow its settings, or else a new logger writing to out
+func LoggerFor(out io.Writer) *Logger {
+	if w, ok := out.(*lineWriter); ok {
+		if log := w.reporter.Log; log.out == out {
+			return log
+		}
+		return &Logger{out: out, settings: w.reporter.Log.settings}
+	}
+	return NewLogger(out)
+}
+
+// Subsystem returns a logger for messages of the named subsystem, one of the Subsystem* constants
+func (l *Logger) Subsystem(name string) *Logger {
+	return &Logger{out: l.out, subsystem: name, build: l.build, settings: l.settings}
+}
+
+// WithContext returns a logger tagging messages with the build ID the
+// context carries (see WithBuildID), or l itself if it carries none
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	build := BuildID(ctx)
+	if build == "" || build == l.build {
+		return l
+	}
+	return &Logger{out: l.out, subsystem: l.subsystem, build: build, settings: l.settings}
+}
+
+// SetLevel sets the level of messages written, and the levels of the given subsystems if they differ
+func (l *Logger) SetLevel(level Level, subsystemLevels map[string]Level) {
+	l.settings.lock.Lock()
+	defer l.settings.lock.Unlock()
+
+	l.settings.level = level
+	l.settings.levels = map[string]Level{}
+	for subsystem, level := range subsystemLevels {
+		l.settings.levels[subsystem] = level
+	}
+}
+
+// SetFormat sets the format messages are written in, one of the LogFormat* constants
+func (l *Logger) SetFormat(format string) error {
+	if err := ValidLogFormat(format); err != nil {
+		return err
+	}
+
+	l.settings.lock.Lock()
+	defer l.settings.lock.Unlock()
+
+	l.settings.format = format
+	return nil
+}
+
+// SetColor turns coloring level prefixes with ANSI escape codes on or off; it's off by default
+func (l *Logger) SetColor(color bool) {
+	l.settings.lock.Lock()
+	defer l.settings.lock.Unlock()
+
+	l.settings.color = color
+}
+
+// raiseLevel makes sure no messages below the given level are written, whatever the subsystem
+func (l *Logger) raiseLevel(min Level) {
+	l.settings.lock.Lock()
+	defer l.settings.lock.Unlock()
+
+	if l.settings.level < min {
+		l.settings.level = min
+	}
+	for subsystem, level := range l.settings.levels {
+		if level < min {
+			l.settings.levels[subsystem] = min
+		}
+	}
+}
+
+// Enabled tells if messages of the given level are written, e.g. to skip
+// preparing a costly debug message
+func (l *Logger) Enabled(level Level) bool {
+	l.settings.lock.RLock()
+	defer l.settings.lock.RUnlock()
+
+	min, ok := l.settings.levels[l.subsystem]
+	if !ok {
+		min = l.settings.level
+	}
+	return level >= min
+}
+
+// Debugf writes a debug message, formatted as by fmt.Sprintf
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof writes an informational message, formatted as by fmt.Sprintf
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warnf writes a warning, formatted as by fmt.Sprintf
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Errorf writes an error message, formatted as by fmt.Sprintf
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	l.settings.lock.RLock()
+	now := l.settings.now().UTC().Format(logTimeFormat)
+	jsonFormat := l.settings.format == LogFormatJSON
+	color := l.settings.color
+	l.settings.lock.RUnlock()
+
+	prefix := levelPrefixes[level]
+	if color {
+		prefix = "\x1b[" + levelColors[level] + "m" + prefix + "\x1b[0m"
+	}
+
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+
+	var line []byte
+	if jsonFormat {
+		line, _ = json.Marshal(struct {
+			Time      string `json:"time"`
+			Level     string `json:"level"`
+			Build     string `json:"build,omitempty"`
+			Subsystem string `json:"subsystem,omitempty"`
+			Msg       string `json:"msg"`
+		}{now, level.String(), l.build, l.subsystem, msg})
+	} else {
+		if l.build != "" {
+			prefix += " build=" + l.build
+		}
+		if l.subsystem != "" {
+			line = []byte(fmt.Sprintf("%s %s %s: %s", now, prefix, l.subsystem, msg))
+		} else {
+			line = []byte(fmt.Sprintf("%s %s %s", now, prefix, msg))
+		}
+	}
+
+	// written whole so a SynchronizedReporter publishes the line at once, as a log message
+	if w, ok := l.out.(*lineWriter); ok {
+		w.write(append(line, '\n'), Event{Level: level.String(), Subsystem: l.subsystem, Build: l.build})
+		return
+	}
+	l.out.Write(append(line, '\n'))
+}
+
+// ValidLogFormat returns an error if format isn't one of the LogFormat* constants
+func ValidLogFormat(format string) error {
+	switch format {
+	case LogFormatText, LogFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("Expected one of '%s' or '%s', got '%s'", LogFormatText, LogFormatJSON, format)
+}
+
+// ParseLogLevels parses a log level, optionally followed by levels for
+// subsystems, e.g. "warn,upload=debug", into the level and the subsystems'
+// levels
+func ParseLogLevels(spec string) (Level, map[string]Level, error) {
+	level := LevelInfo
+	subsystemLevels := map[string]Level{}
+
+	for i, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if i == 0 && !strings.Contains(part, "=") {
+			parsed, err := parseLevel(part)
+			if err != nil {
+				return level, nil, err
+			}
+			level = parsed
+			continue
+		}
+
+		pieces := strings.SplitN(part, "=", 2)
+		if len(pieces) != 2 {
+			return level, nil, fmt.Errorf("Expected 'subsystem=level', got '%s'", part)
+		}
+
+		subsystem := strings.TrimSpace(pieces[0])
+		if !knownSubsystem(subsystem) {
+			return level, nil, fmt.Errorf("Unknown subsystem '%s', expected one of '%s'", subsystem, strings.Join(subsystems, "', '"))
+		}
+		parsed, err := parseLevel(strings.TrimSpace(pieces[1]))
+		if err != nil {
+			return level, nil, err
+		}
+		subsystemLevels[subsystem] = parsed
+	}
+	return level, subsystemLevels, nil
+}
+
+func parseLevel(name string) (Level, error) {
+	names := []string{}
+	for level := LevelDebug; level <= LevelError; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+		names = append(names, level.String())
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level '%s', expected one of '%s'", name, strings.Join(names, "', '"))
+}
+
+func knownSubsystem(name string) bool {
+	for _, subsystem := range subsystems {
+		if name == subsystem {
+			return true
+		}
+	}
+	return false
+}
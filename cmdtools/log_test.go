@@ -0,0 +1,143 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// stopClock makes the logger timestamp messages with a fixed time and returns the timestamp
+func stopClock(log *Logger) string {
+	log.settings.now = func() time.Time {
+		return time.Date(2017, 10, 2, 17, 4, 5, 0, time.FixedZone("CEST", 2*60*60))
+	}
+	return "2017-10-02T15:04:05.000000Z"
+}
+
+func Test_Logger_Suite(suite *testing.T) {
+
+	suite.Run("Logger writes text lines at its levels", func(t *testing.T) {
+		var out bytes.Buffer
+		log := NewLogger(&out)
+		now := stopClock(log)
+
+		log.Debugf("hidden")
+		log.Infof("Wrote %v\n", "pkg.json")
+		log.Subsystem(SubsystemUpload).Warnf("slow")
+		assert.Equal(t, now+" [INFO] Wrote pkg.json\n"+now+" [WARN] upload: slow\n", out.String())
+
+		out.Reset()
+		log.SetLevel(LevelError, map[string]Level{SubsystemDocker: LevelDebug})
+		log.Warnf("hidden")
+		log.Subsystem(SubsystemUpload).Warnf("hidden")
+		log.Subsystem(SubsystemDocker).Debugf("pulling")
+		log.Errorf("failed")
+		assert.Equal(t, now+" [DEBUG] docker: pulling\n"+now+" [ERROR] failed\n", out.String())
+		assert.True(t, log.Subsystem(SubsystemDocker).Enabled(LevelDebug))
+		assert.False(t, log.Enabled(LevelWarn))
+	})
+
+	suite.Run("Logger colors level prefixes if asked", func(t *testing.T) {
+		var out bytes.Buffer
+		log := NewLogger(&out)
+		now := stopClock(log)
+
+		log.SetColor(true)
+		log.Errorf("failed")
+		log.Subsystem(SubsystemDocker).Warnf("slow")
+		assert.Equal(t, now+" \x1b[1;31m[ERROR]\x1b[0m failed\n"+now+" \x1b[33m[WARN]\x1b[0m docker: slow\n", out.String())
+
+		// never in JSON
+		out.Reset()
+		log.SetFormat(LogFormatJSON)
+		log.Errorf("failed")
+		assert.NotContains(t, out.String(), "\x1b")
+
+		// nor on a reporter in CI mode
+		reporter := newSynchronizedReporter(16, &syncBuffer{}, &syncBuffer{})
+		defer reporter.Close()
+		reporter.Log.SetColor(true)
+		reporter.CI()
+		assert.False(t, reporter.Log.settings.color)
+	})
+
+	suite.Run("Logger writes JSON lines", func(t *testing.T) {
+		var out bytes.Buffer
+		log := NewLogger(&out)
+		now := stopClock(log)
+		assert.Nil(t, log.SetFormat(LogFormatJSON))
+		assert.NotNil(t, log.SetFormat("xml"))
+
+		log.Subsystem(SubsystemSign).Infof("Signed \"%v\"", "pkg.json")
+		log.Warnf("careful")
+
+		lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+		assert.Equal(t, 2, len(lines))
+
+		var message map[string]string
+		assert.Nil(t, json.Unmarshal(lines[0], &message))
+		assert.Equal(t, map[string]string{"time": now, "level": "info", "subsystem": "sign", "msg": `Signed "pkg.json"`}, message)
+
+		message = nil
+		assert.Nil(t, json.Unmarshal(lines[1], &message))
+		assert.Equal(t, map[string]string{"time": now, "level": "warn", "msg": "careful"}, message)
+	})
+
+	suite.Run("Logger tags messages with the build ID of a context", func(t *testing.T) {
+		var out bytes.Buffer
+		log := NewLogger(&out)
+		now := stopClock(log)
+		ctx := WithBuildID(context.Background(), "1a2b")
+
+		assert.Equal(t, log, log.WithContext(context.Background()))
+		log.WithContext(ctx).Infof("building")
+		log.WithContext(ctx).Subsystem(SubsystemDocker).Infof("pulled")
+		log.Subsystem(SubsystemDocker).WithContext(ctx).Warnf("slow")
+		assert.Equal(t, now+" [INFO] build=1a2b building\n"+now+" [INFO] build=1a2b docker: pulled\n"+now+" [WARN] build=1a2b docker: slow\n", out.String())
+
+		out.Reset()
+		log.SetFormat(LogFormatJSON)
+		log.WithContext(ctx).Subsystem(SubsystemSign).Infof("signed")
+		var message map[string]string
+		assert.Nil(t, json.Unmarshal(out.Bytes(), &message))
+		assert.Equal(t, map[string]string{"time": now, "level": "info", "build": "1a2b", "subsystem": "sign", "msg": "signed"}, message)
+	})
+
+	suite.Run("LoggerFor shares a reporter's settings", func(t *testing.T) {
+		out := &syncBuffer{}
+		err := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, err)
+		now := stopClock(reporter.Log)
+		reporter.Log.SetLevel(LevelWarn, nil)
+
+		assert.Equal(t, reporter.Log, LoggerFor(reporter.ErrWriter))
+		LoggerFor(reporter.ErrWriter).Infof("hidden")
+		LoggerFor(reporter.OutWriter).Warnf("on stdout")
+
+		reporter.Close()
+		assert.Equal(t, "", err.String())
+		assert.Equal(t, now+" [WARN] on stdout\n", out.String())
+	})
+
+	suite.Run("ParseLogLevels", func(t *testing.T) {
+		level, subsystemLevels, err := ParseLogLevels("WARN, upload=debug,docker=error")
+		assert.Nil(t, err)
+		assert.Equal(t, LevelWarn, level)
+		assert.Equal(t, map[string]Level{SubsystemUpload: LevelDebug, SubsystemDocker: LevelError}, subsystemLevels)
+
+		level, subsystemLevels, err = ParseLogLevels("sign=debug")
+		assert.Nil(t, err)
+		assert.Equal(t, LevelInfo, level)
+		assert.Equal(t, map[string]Level{SubsystemSign: LevelDebug}, subsystemLevels)
+
+		for _, spec := range []string{"", "verbose", "info,debug", "info,network=debug", "info,upload=loud"} {
+			_, _, err := ParseLogLevels(spec)
+			assert.NotNil(t, err, spec)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package cmdtools
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// LogFile is a file output is appended to that, if it has a maximum size, is
+// rotated before a write would take it past that size: the file is renamed
+// with the suffix ".1", an earlier ".1" to ".2", and so on, keeping the given
+// number of rotated files and removing older ones. A write larger than the
+// maximum size is still written whole, to a fresh file. It's safe for
+// concurrent use.
+type LogFile struct {
+	lock     sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+}
+
+// OpenLogFile opens the log file at path for appending, creating it if need
+// be. With a maxBytes of 0 it's never rotated.
+func OpenLogFile(path string, maxBytes int64, keep int) (*LogFile, error) {
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("Expected a maximum size of at least 0, got %v", maxBytes)
+	} else if keep < 0 {
+		return nil, fmt.Errorf("Expected to keep at least 0 rotated files, got %v", keep)
+	}
+
+	f := &LogFile{path: path, maxBytes: maxBytes, keep: keep}
+	if err := f.open(os.O_APPEND); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past the maximum size
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file; later writes fail
+func (f *LogFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// open opens the file with the given flag besides those to create and write it
+func (f *LogFile) open(flag int) error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate moves the file and the rotated files kept before it along a suffix
+// and starts a new, empty file
+func (f *LogFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	if f.keep == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		if err := os.Remove(fmt.Sprintf("%s.%d", f.path, f.keep)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for i := f.keep - 1; i > 0; i-- {
+			if err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return f.open(os.O_TRUNC)
+}
@@ -0,0 +1,70 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_LogFile_Suite(suite *testing.T) {
+
+	suite.Run("LogFile appends and rotates past the maximum size, keeping the newest files", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cmdtools-logfile-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		file := path.Join(dir, "build.log")
+		assert.Nil(t, ioutil.WriteFile(file, []byte("earlier\n"), 0644))
+
+		log, err := OpenLogFile(file, 16, 2)
+		assert.Nil(t, err)
+		for _, line := range []string{"one\n", "two two\n", "three\n", "four four\n", "a line longer than the maximum\n"} {
+			_, err := log.Write([]byte(line))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, log.Close())
+
+		for name, expected := range map[string]string{
+			"build.log":   "a line longer than the maximum\n",
+			"build.log.1": "four four\n",
+			"build.log.2": "two two\nthree\n",
+		} {
+			content, err := ioutil.ReadFile(path.Join(dir, name))
+			assert.Nil(t, err, name)
+			assert.Equal(t, expected, string(content), name)
+		}
+
+		// the first rotated file, with the earlier content and "one", was removed
+		_, err = os.Stat(path.Join(dir, "build.log.3"))
+		assert.True(t, os.IsNotExist(err))
+
+		_, err = log.Write([]byte("closed\n"))
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("LogFile without a maximum size is never rotated", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cmdtools-logfile-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		file := path.Join(dir, "build.log")
+		log, err := OpenLogFile(file, 0, 2)
+		assert.Nil(t, err)
+		log.Write([]byte("one\n"))
+		log.Write([]byte("two\n"))
+		log.Close()
+
+		content, err := ioutil.ReadFile(file)
+		assert.Nil(t, err)
+		assert.Equal(t, "one\ntwo\n", string(content))
+		_, err = os.Stat(file + ".1")
+		assert.True(t, os.IsNotExist(err))
+
+		_, err = OpenLogFile(file, -1, 2)
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,163 @@
+package cmdtools
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ProgressInterval is the minimum time between progress lines for a single operation
+const ProgressInterval = 10 * time.Second
+
+// Progress tracks the bytes a long operation (e.g. a pull or an upload) has
+// processed of its total and reports them with the throughput and estimated
+// time remaining. Written to a SynchronizedReporter's writer on a terminal,
+// it's shown on the reporter's live status line; otherwise a progress line is
+// written to out at most once per interval. Writes to a Progress count the
+// bytes written. Written to a reporter's writer, progress events are
+// published on its Bus at most once a second, and once finished.
+type Progress struct {
+	out      io.Writer
+	reporter *SynchronizedReporter
+	events   *SynchronizedReporter
+	label    string
+	noun     string
+	interval time.Duration
+
+	lock       sync.Mutex
+	done       int64
+	total      int64
+	detail     string
+	started    time.Time
+	lastReport time.Time
+	lastEvent  time.Time
+}
+
+// NewProgress starts tracking an operation described by label, e.g. "Pulling
+// Docker image x", whose bytes are described by noun, e.g. "downloaded". A
+// total of 0 means the total isn't known.
+func NewProgress(out io.Writer, label string, noun string, total int64, interval time.Duration) *Progress {
+	now := time.Now()
+	p := &Progress{
+		out:        out,
+		label:      label,
+		noun:       noun,
+		interval:   interval,
+		total:      total,
+		started:    now,
+		lastReport: now,
+	}
+
+	if w, ok := out.(*lineWriter); ok {
+		if w.reporter.live {
+			p.reporter = w.reporter
+			p.reporter.track(p)
+		}
+		p.events = w.reporter
+	}
+
+	return p
+}
+
+func (p *Progress) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	p.done += int64(len(b))
+	p.lock.Unlock()
+
+	p.maybeReport()
+	return len(b), nil
+}
+
+// Update sets the bytes done and the total, and a detail shown before them, e.g. "3 of 5 layers complete"
+func (p *Progress) Update(done int64, total int64, detail string) {
+	p.lock.Lock()
+	p.done = done
+	p.total = total
+	p.detail = detail
+	p.lock.Unlock()
+
+	p.maybeReport()
+}
+
+// Finish stops showing the progress
+func (p *Progress) Finish() {
+	if p.reporter != nil {
+		p.reporter.untrack(p)
+	}
+	p.emit()
+}
+
+func (p *Progress) maybeReport() {
+	if p.events != nil {
+		p.lock.Lock()
+		due := time.Since(p.lastEvent) >= eventInterval
+		if due {
+			p.lastEvent = time.Now()
+		}
+		p.lock.Unlock()
+
+		if due {
+			p.emit()
+		}
+	}
+
+	if p.reporter != nil {
+		return
+	}
+
+	p.lock.Lock()
+	if time.Since(p.lastReport) < p.interval {
+		p.lock.Unlock()
+		return
+	}
+	p.lastReport = time.Now()
+	p.lock.Unlock()
+
+	LoggerFor(p.out).Infof("%v", p)
+}
+
+// emit publishes a progress event on the reporter's Bus, if any
+func (p *Progress) emit() {
+	if p.events == nil {
+		return
+	}
+
+	p.lock.Lock()
+	event := Event{Event: EventProgress, Operation: p.label, Bytes: p.done, Total: p.total}
+	p.lock.Unlock()
+
+	p.events.Emit(event)
+}
+
+// String describes the progress, e.g. "Pulling Docker image x: 1.0 GiB of
+// 2.0 GiB downloaded (50%), 10.0 MiB/s, ETA 1m42s"
+func (p *Progress) String() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s := p.label + ": "
+	if p.detail != "" {
+		s += p.detail + ", "
+	}
+
+	if p.total > 0 {
+		s += fmt.Sprintf("%v of %v %v (%d%%)", FormatByteSize(p.done), FormatByteSize(p.total), p.noun, p.done*100/p.total)
+	} else {
+		s += fmt.Sprintf("%v %v", FormatByteSize(p.done), p.noun)
+	}
+
+	elapsed := time.Since(p.started)
+	if elapsed < time.Second || p.done == 0 {
+		return s
+	}
+
+	rate := float64(p.done) / elapsed.Seconds()
+	s += fmt.Sprintf(", %v/s", FormatByteSize(int64(rate)))
+
+	if p.total > p.done {
+		eta := time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+		s += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	return s
+}
@@ -0,0 +1,94 @@
+package cmdtools
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"os"
+	"strings"
+)
+
+// Prompter asks for the values of required options that weren't given, on
+// the error output of a SynchronizedReporter, but only if stdin is a
+// terminal; otherwise, e.g. in CI, it asks nothing so commands fail as they
+// would without it
+type Prompter struct {
+	reporter    *SynchronizedReporter
+	in          *bufio.Reader
+	interactive bool
+	readSecret  func() ([]byte, error)
+}
+
+// NewPrompter returns a Prompter reading answers from stdin and writing
+// questions where the reporter writes its messages
+func NewPrompter(reporter *SynchronizedReporter) *Prompter {
+	fd := int(os.Stdin.Fd())
+	return newPrompter(reporter, os.Stdin, terminal.IsTerminal(fd), func() ([]byte, error) {
+		return terminal.ReadPassword(fd)
+	})
+}
+
+func newPrompter(reporter *SynchronizedReporter, in io.Reader, interactive bool, readSecret func() ([]byte, error)) *Prompter {
+	return &Prompter{
+		reporter:    reporter,
+		in:          bufio.NewReader(in),
+		interactive: interactive,
+		readSecret:  readSecret,
+	}
+}
+
+// Interactive tells if the Prompter asks questions at all: not without a
+// terminal, nor once the reporter is in CI mode
+func (p *Prompter) Interactive() bool {
+	return p.interactive && !p.reporter.ci
+}
+
+// Ask asks the question and returns the answer, or def if the answer is
+// empty. If the Prompter isn't interactive it returns "" without asking.
+func (p *Prompter) Ask(question string, def string) (string, error) {
+	if !p.Interactive() {
+		return "", nil
+	}
+
+	if def != "" {
+		p.write(fmt.Sprintf("%s [%s]: ", question, def))
+	} else {
+		p.write(question + ": ")
+	}
+
+	answer, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return "", fmt.Errorf("Unable to read answer. Error: %v", err)
+	}
+
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// AskSecret is Ask for secrets such as passwords: the answer isn't echoed
+// and there's no default
+func (p *Prompter) AskSecret(question string) (string, error) {
+	if !p.Interactive() {
+		return "", nil
+	}
+
+	p.write(question + ": ")
+	answer, err := p.readSecret()
+
+	// the newline typed isn't echoed either
+	p.write("\n")
+	if err != nil {
+		return "", fmt.Errorf("Unable to read answer. Error: %v", err)
+	}
+	return strings.TrimSpace(string(answer)), nil
+}
+
+// write writes the text once the reporter's queued output is written so
+// the question follows it
+func (p *Prompter) write(text string) {
+	p.reporter.Flush()
+	io.WriteString(p.reporter.errDest, text)
+}
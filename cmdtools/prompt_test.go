@@ -0,0 +1,69 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func Test_Prompter_Suite(suite *testing.T) {
+
+	suite.Run("Ask writes questions after queued output and returns answers or defaults", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		defer reporter.Close()
+
+		prompter := newPrompter(reporter, strings.NewReader("me@example.com\n\n"), true, nil)
+		assert.True(t, prompter.Interactive())
+
+		reporter.OutWriter.Write([]byte("queued\n"))
+		answer, err := prompter.Ask("Author", "")
+		assert.Nil(t, err)
+		assert.Equal(t, "me@example.com", answer)
+
+		answer, err = prompter.Ask("Output directory", ".")
+		assert.Nil(t, err)
+		assert.Equal(t, ".", answer)
+		assert.Equal(t, "queued\nAuthor: Output directory [.]: ", out.String())
+
+		_, err = prompter.Ask("More", "")
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("AskSecret doesn't echo the answer", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		defer reporter.Close()
+
+		prompter := newPrompter(reporter, strings.NewReader(""), true, func() ([]byte, error) {
+			return []byte("s3cret"), nil
+		})
+		answer, err := prompter.AskSecret("Password")
+		assert.Nil(t, err)
+		assert.Equal(t, "s3cret", answer)
+		assert.Equal(t, "Password: \n", out.String())
+
+		prompter.readSecret = func() ([]byte, error) { return nil, errors.New("no tty") }
+		_, err = prompter.AskSecret("Password")
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("Nothing is asked without a terminal", func(t *testing.T) {
+		out := &syncBuffer{}
+		reporter := newSynchronizedReporter(16, out, out)
+		defer reporter.Close()
+
+		prompter := newPrompter(reporter, strings.NewReader("ignored\n"), false, nil)
+		answer, err := prompter.Ask("Author", "me")
+		assert.Nil(t, err)
+		assert.Equal(t, "", answer)
+
+		answer, err = prompter.AskSecret("Password")
+		assert.Nil(t, err)
+		assert.Equal(t, "", answer)
+		assert.Equal(t, "", out.String())
+	})
+}
@@ -0,0 +1,111 @@
+package cmdtools
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	jitterLock   sync.Mutex
+	jitterSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// PermanentError wraps an error that retrying the failed operation won't fix
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// RetryPolicy describes how many times and how patiently to retry failed operations
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// NewRetryPolicy returns a RetryPolicy permitting the given number of
+// retries with exponential backoff starting at one second and capped at 30
+// seconds.
+func NewRetryPolicy(maxRetries int) RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: maxRetries,
+		BaseDelay:  time.Second,
+		MaxDelay:   30 * time.Second,
+	}
+}
+
+// Delay returns the time to wait before the given retry (starting at 1): the
+// base delay doubled for each prior retry, capped at the max delay, with
+// random jitter of up to half of it subtracted to spread out retries from
+// concurrent workers.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if delay <= 1 {
+		return delay
+	}
+
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return delay - time.Duration(jitterSource.Int63n(int64(delay/2)))
+}
+
+// Retry calls fn until it succeeds, returns a PermanentError, or the
+// policy's retries are exhausted, returning the last error (unwrapped if
+// permanent). If notify is not nil it is called before each retry with the
+// number of the upcoming retry, the error that prompted it, and the delay
+// before it.
+func (p RetryPolicy) Retry(fn func() error, notify func(retry int, err error, delay time.Duration)) error {
+	return p.RetryContext(context.Background(), fn, notify)
+}
+
+// RetryContext is Retry, but gives up waiting to retry once the context is
+// done, returning the error of the last attempt, or the context's error if
+// there was none
+func (p RetryPolicy) RetryContext(ctx context.Context, fn func() error, notify func(retry int, err error, delay time.Duration)) error {
+	var err error
+
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			delay := p.Delay(retry)
+			if notify != nil {
+				notify(retry, err, delay)
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		if permanent, ok := err.(PermanentError); ok {
+			return permanent.Err
+		}
+
+		if retry >= p.MaxRetries {
+			return err
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_RetryPolicy_Suite(suite *testing.T) {
+	policy := RetryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond}
+
+	suite.Run("Retry succeeds after transient failures", func(t *testing.T) {
+		calls := 0
+		notified := []int{}
+
+		err := policy.Retry(func() error {
+			calls++
+			if calls < 3 {
+				return errors.New("transient")
+			}
+			return nil
+		}, func(retry int, err error, delay time.Duration) {
+			notified = append(notified, retry)
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, 3, calls)
+		assert.Equal(t, []int{1, 2}, notified)
+	})
+
+	suite.Run("Retry gives up after max retries", func(t *testing.T) {
+		calls := 0
+		err := policy.Retry(func() error {
+			calls++
+			return errors.New("transient")
+		}, nil)
+
+		assert.NotNil(t, err)
+		assert.Equal(t, 4, calls)
+	})
+
+	suite.Run("Retry stops on permanent errors and unwraps them", func(t *testing.T) {
+		calls := 0
+		cause := errors.New("not found")
+		err := policy.Retry(func() error {
+			calls++
+			return PermanentError{cause}
+		}, nil)
+
+		assert.Equal(t, cause, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	suite.Run("RetryContext stops waiting to retry once the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		patient := RetryPolicy{MaxRetries: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+		cause := errors.New("transient")
+
+		calls := 0
+		err := patient.RetryContext(ctx, func() error {
+			calls++
+			return cause
+		}, func(retry int, err error, delay time.Duration) {
+			cancel()
+		})
+		assert.Equal(t, cause, err)
+		assert.Equal(t, 1, calls)
+
+		// nothing is attempted once it's done
+		err = patient.RetryContext(ctx, func() error {
+			calls++
+			return nil
+		}, nil)
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	suite.Run("Delay grows exponentially up to the max with jitter", func(t *testing.T) {
+		for retry, max := range map[int]time.Duration{1: time.Millisecond, 2: 2 * time.Millisecond, 3: 4 * time.Millisecond, 10: 4 * time.Millisecond} {
+			delay := policy.Delay(retry)
+			assert.True(t, delay <= max && delay > max/2, retry)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package cmdtools
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadSecret reads secret material, such as a private key, from where spec
+// says, so it needn't be written to disk first:
+//
+//	env:NAME  the environment variable NAME, which is then unset so processes the tool starts don't inherit it
+//	fd:N      the inherited file descriptor N (3 or more), read to its end and closed
+//	-         stdin, read to its end
+//	PATH      the file at PATH
+func ReadSecret(spec string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(spec, "env:"):
+		name := strings.TrimPrefix(spec, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("Environment variable %v is not set", name)
+		}
+		os.Unsetenv(name)
+		return []byte(value), nil
+
+	case strings.HasPrefix(spec, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(spec, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("Expected a file descriptor number after 'fd:', got '%v'", strings.TrimPrefix(spec, "fd:"))
+		} else if fd < 3 {
+			// closing stdin, stdout, or stderr once read would break the tool's own input and output
+			return nil, fmt.Errorf("File descriptor %v is one of stdin, stdout, and stderr; use '-' to read from stdin, or a file descriptor of 3 or more", fd)
+		}
+		f := os.NewFile(uintptr(fd), spec)
+		defer f.Close()
+		return readSecret(f, "file descriptor "+strconv.Itoa(fd))
+
+	case spec == "-":
+		return readSecret(os.Stdin, "stdin")
+	}
+	return ioutil.ReadFile(spec)
+}
+
+func readSecret(r io.Reader, source string) ([]byte, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %v. Error: %v", source, err)
+	} else if len(content) == 0 {
+		return nil, fmt.Errorf("Nothing could be read from %v", source)
+	}
+	return content, nil
+}
+
+// IsSecretFile tells if spec, as given to ReadSecret, is the path of a file
+func IsSecretFile(spec string) bool {
+	return spec != "-" && !strings.HasPrefix(spec, "env:") && !strings.HasPrefix(spec, "fd:")
+}
@@ -0,0 +1,68 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_ReadSecret_Suite(suite *testing.T) {
+
+	suite.Run("ReadSecret reads envvars and unsets them", func(t *testing.T) {
+		t.Setenv("HZNPKG_TEST_SECRET", "key material")
+		content, err := ReadSecret("env:HZNPKG_TEST_SECRET")
+		assert.Nil(t, err)
+		assert.Equal(t, "key material", string(content))
+
+		_, set := os.LookupEnv("HZNPKG_TEST_SECRET")
+		assert.False(t, set)
+
+		_, err = ReadSecret("env:HZNPKG_TEST_SECRET")
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("ReadSecret reads inherited file descriptors", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		assert.Nil(t, err)
+		w.Write([]byte("key material"))
+		w.Close()
+
+		content, err := ReadSecret(fmt.Sprintf("fd:%d", r.Fd()))
+		assert.Nil(t, err)
+		assert.Equal(t, "key material", string(content))
+
+		_, err = ReadSecret("fd:three")
+		assert.NotNil(t, err)
+
+		// the standard streams aren't read as inherited descriptors, nor closed
+		for _, fd := range []string{"fd:0", "fd:1", "fd:2"} {
+			_, err = ReadSecret(fd)
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), "use '-' to read from stdin")
+		}
+		_, err = os.Stderr.Stat()
+		assert.Nil(t, err)
+	})
+
+	suite.Run("ReadSecret reads files", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "secret-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		file := path.Join(dir, "private.key")
+		assert.Nil(t, ioutil.WriteFile(file, []byte("key material"), 0600))
+		content, err := ReadSecret(file)
+		assert.Nil(t, err)
+		assert.Equal(t, "key material", string(content))
+
+		assert.True(t, IsSecretFile(file))
+		assert.False(t, IsSecretFile("-"))
+		assert.False(t, IsSecretFile("env:KEY"))
+		assert.False(t, IsSecretFile("fd:3"))
+	})
+}
@@ -0,0 +1,53 @@
+package cmdtools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteUnits maps size suffixes to their multiples; decimal and binary units are both accepted
+var byteUnits = []struct {
+	suffix   string
+	multiple int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size like "512MiB", "2GB", or "1048576" (bytes) into a number of bytes
+func ParseByteSize(size string) (int64, error) {
+	trimmed := strings.TrimSpace(size)
+
+	multiple := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(trimmed), strings.ToUpper(unit.suffix)) {
+			trimmed = strings.TrimSpace(trimmed[:len(trimmed)-len(unit.suffix)])
+			multiple = unit.multiple
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Unable to parse size '%v', expected a number of bytes optionally followed by a unit like KB, MB, GB, KiB, MiB, or GiB", size)
+	}
+
+	return int64(n * float64(multiple)), nil
+}
+
+// FormatByteSize renders a number of bytes in human-readable binary units, e.g. "1.5 MiB"
+func FormatByteSize(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
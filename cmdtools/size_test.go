@@ -0,0 +1,28 @@
+// +build unit
+
+package cmdtools
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_ParseByteSize(t *testing.T) {
+	for size, expected := range map[string]int64{
+		"1048576": 1048576,
+		"512B":    512,
+		"2KB":     2000,
+		"512MiB":  512 * 1024 * 1024,
+		"1.5 GB":  1500 * 1000 * 1000,
+		"1gib":    1024 * 1024 * 1024,
+	} {
+		n, err := ParseByteSize(size)
+		assert.Nil(t, err, size)
+		assert.Equal(t, expected, n, size)
+	}
+
+	for _, size := range []string{"", "MB", "-1", "12XB"} {
+		_, err := ParseByteSize(size)
+		assert.NotNil(t, err, size)
+	}
+}
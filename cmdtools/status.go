@@ -0,0 +1,115 @@
+package cmdtools
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// statusRefresh is how often the live status lines are redrawn
+const statusRefresh = 500 * time.Millisecond
+
+// isTerminal tells if the writer is a file that's a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth returns the number of columns of the terminal the writer is, or 80 if it isn't known or is implausibly narrow
+func terminalWidth(w io.Writer) int {
+	if f, ok := w.(*os.File); ok {
+		var size struct {
+			rows, cols, xpixels, ypixels uint16
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))); errno == 0 && size.cols >= 20 {
+			return int(size.cols)
+		}
+	}
+	return 80
+}
+
+func (s *SynchronizedReporter) track(p *Progress) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	s.progresses = append(s.progresses, p)
+}
+
+func (s *SynchronizedReporter) untrack(p *Progress) {
+	s.statusLock.Lock()
+	for i, tracked := range s.progresses {
+		if tracked == p {
+			s.progresses = append(s.progresses[:i], s.progresses[i+1:]...)
+			break
+		}
+	}
+	s.statusLock.Unlock()
+
+	s.queue(reportEvent{redraw: true, status: s.renderStatus()})
+}
+
+// refreshStatus periodically queues the status lines to redraw until the reporter is closed
+func (s *SynchronizedReporter) refreshStatus() {
+	ticker := time.NewTicker(statusRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopStatus:
+			return
+		case <-ticker.C:
+			if status := s.renderStatus(); len(status) > 0 {
+				s.queue(reportEvent{redraw: true, status: status})
+			}
+		}
+	}
+}
+
+// renderStatus describes each tracked Progress on a line that fits the terminal
+func (s *SynchronizedReporter) renderStatus() []string {
+	s.statusLock.Lock()
+	progresses := append([]*Progress{}, s.progresses...)
+	s.statusLock.Unlock()
+
+	width := terminalWidth(s.errDest)
+	lines := []string{}
+	for _, p := range progresses {
+		line := []rune(p.String())
+		if len(line) >= width {
+			line = append(line[:width-4], []rune("...")...)
+		}
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+// clearStatus erases the drawn status lines, leaving the cursor where they began
+func (s *SynchronizedReporter) clearStatus() {
+	if len(s.statusLines) == 0 {
+		return
+	}
+
+	if len(s.statusLines) > 1 {
+		fmt.Fprintf(s.errDest, "\r\033[%dA\033[J", len(s.statusLines)-1)
+	} else {
+		fmt.Fprint(s.errDest, "\r\033[J")
+	}
+}
+
+// drawStatus draws the status lines, leaving the cursor at the end of the last one
+func (s *SynchronizedReporter) drawStatus() {
+	if len(s.statusLines) == 0 {
+		return
+	}
+
+	fmt.Fprint(s.errDest, strings.Join(s.statusLines, "\n"))
+}
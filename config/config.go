@@ -0,0 +1,353 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// FileName is the name of the configuration files searched for by Find
+const FileName = "hznpkg.yaml"
+
+// File is a configuration file of option values: global options at its top
+// level and each command's options in a section named for the command, e.g.
+//
+//	debug: true
+//	create:
+//	  author: someone@example.com
+//	  dockerimage:
+//	    - summit.hovitos.engineering/x86/cpu:1.2.2
+//	    - summit.hovitos.engineering/x86/gps:1.0.0
+//
+// Options given more than once on the command line take a YAML sequence,
+// others a scalar. Only this subset of YAML is accepted: block mappings and
+// sequences, flow sequences ("[a, b]"), plain and quoted scalars, and
+// comments. Options are named as on the command line, without dashes.
+type File struct {
+	Path     string
+	Global   map[string][]string
+	Commands map[string]map[string][]string
+}
+
+// DefaultPaths returns the paths searched in order for a configuration file
+// when none is given: the working directory, the user's configuration
+// directory ($XDG_CONFIG_HOME, by default ~/.config), then /etc
+func DefaultPaths() []string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home := os.Getenv("HOME"); home != "" {
+			configHome = path.Join(home, ".config")
+		}
+	}
+
+	paths := []string{FileName}
+	if configHome != "" {
+		paths = append(paths, path.Join(configHome, "horizon-pkg-build", FileName))
+	}
+	return append(paths, path.Join("/etc", "horizon-pkg-build", FileName))
+}
+
+// Find returns the first of DefaultPaths that exists, or an empty string if none does
+func Find() string {
+	for _, p := range DefaultPaths() {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// Load reads and parses the given configuration file
+func Load(file string) (*File, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	config.Path = file
+	return config, nil
+}
+
+// Parse parses the content of a configuration file
+func Parse(content []byte) (*File, error) {
+	p, err := newParser(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	top, err := p.mapping(0)
+	if err != nil {
+		return nil, err
+	} else if p.i < len(p.lines) {
+		return nil, p.errorf(p.lines[p.i], "unexpected indentation")
+	}
+
+	config := &File{Global: map[string][]string{}, Commands: map[string]map[string][]string{}}
+	for key, value := range top {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			section := map[string][]string{}
+			for option, value := range v {
+				values, ok := optionValues(value)
+				if !ok {
+					return nil, fmt.Errorf("Option '%s' of '%s' is nested too deeply", option, key)
+				}
+				section[option] = values
+			}
+			config.Commands[key] = section
+		default:
+			values, _ := optionValues(value)
+			config.Global[key] = values
+		}
+	}
+	return config, nil
+}
+
+// optionValues returns the values of an option given a scalar or sequence, or false if it's a mapping
+func optionValues(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case []string:
+		return v, true
+	case string:
+		return []string{v}, true
+	case nil:
+		return []string{}, true
+	}
+	return nil, false
+}
+
+// line is a line of a configuration file with content
+type line struct {
+	num    int
+	indent int
+	text   string
+}
+
+// parser parses a configuration file's lines into values: nested
+// map[string]interface{}s, []strings, strings, and nils for empty values
+type parser struct {
+	lines []line
+	i     int
+}
+
+func newParser(content string) (*parser, error) {
+	p := &parser{}
+	for i, text := range strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n") {
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", i+1)
+		}
+
+		trimmed = strings.TrimSpace(stripComment(trimmed))
+		if trimmed == "" || (len(p.lines) == 0 && trimmed == "---") {
+			continue
+		}
+		p.lines = append(p.lines, line{num: i + 1, indent: len(text) - len(strings.TrimLeft(text, " ")), text: trimmed})
+	}
+	return p, nil
+}
+
+func (p *parser) errorf(l line, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", l.num, fmt.Sprintf(format, args...))
+}
+
+// mapping parses the block mapping whose keys are at the given indentation
+func (p *parser) mapping(indent int) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for p.i < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent < indent {
+			break
+		} else if l.indent > indent {
+			return nil, p.errorf(l, "unexpected indentation")
+		} else if isSequenceItem(l.text) {
+			return nil, p.errorf(l, "expected 'key: value', got a sequence item")
+		}
+
+		key, rest, err := splitKey(l.text)
+		if err != nil {
+			return nil, p.errorf(l, "%v", err)
+		} else if _, exists := m[key]; exists {
+			return nil, p.errorf(l, "key '%s' is repeated", key)
+		}
+		p.i++
+
+		if rest != "" {
+			if m[key], err = flowValue(rest); err != nil {
+				return nil, p.errorf(l, "%v", err)
+			}
+			continue
+		}
+
+		// a block value, if any, follows on more indented lines; sequences may be indented as much as their key
+		if p.i < len(p.lines) {
+			next := p.lines[p.i]
+			if isSequenceItem(next.text) && next.indent >= indent {
+				if m[key], err = p.sequence(next.indent); err != nil {
+					return nil, err
+				}
+				continue
+			} else if next.indent > indent {
+				if m[key], err = p.mapping(next.indent); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		m[key] = nil
+	}
+	return m, nil
+}
+
+// sequence parses the block sequence of scalars whose items are at the given indentation
+func (p *parser) sequence(indent int) ([]string, error) {
+	items := []string{}
+	for p.i < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent != indent || !isSequenceItem(l.text) {
+			break
+		}
+
+		item, err := scalar(strings.TrimSpace(strings.TrimPrefix(l.text, "-")))
+		if err != nil {
+			return nil, p.errorf(l, "%v", err)
+		}
+		items = append(items, item)
+		p.i++
+	}
+	return items, nil
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitKey splits a 'key: value' line into its key and the rest of the line
+func splitKey(text string) (string, string, error) {
+	start := 0
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+		if start = closingQuote(text); start < 0 {
+			return "", "", fmt.Errorf("unterminated quoted key")
+		}
+	}
+
+	for i := start; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			key, err := scalar(strings.TrimSpace(text[:i]))
+			if err != nil {
+				return "", "", err
+			} else if key == "" {
+				return "", "", fmt.Errorf("empty key")
+			}
+			return key, strings.TrimSpace(text[i+1:]), nil
+		}
+	}
+	return "", "", fmt.Errorf("expected 'key: value', got '%s'", text)
+}
+
+// flowValue parses a value given on the line of its key: a flow sequence or a scalar
+func flowValue(text string) (interface{}, error) {
+	if !strings.HasPrefix(text, "[") {
+		return scalar(text)
+	} else if !strings.HasSuffix(text, "]") {
+		return nil, fmt.Errorf("unterminated sequence '%s'", text)
+	}
+
+	items := []string{}
+	inner := strings.TrimSpace(text[1 : len(text)-1])
+	for inner != "" {
+		end := strings.Index(inner, ",")
+		if strings.HasPrefix(inner, `"`) || strings.HasPrefix(inner, "'") {
+			closing := closingQuote(inner)
+			if closing < 0 {
+				return nil, fmt.Errorf("unterminated quoted string in '%s'", text)
+			}
+			end = strings.Index(inner[closing:], ",")
+			if end >= 0 {
+				end += closing
+			}
+		}
+
+		item := inner
+		if end >= 0 {
+			item, inner = inner[:end], strings.TrimSpace(inner[end+1:])
+		} else {
+			inner = ""
+		}
+
+		value, err := scalar(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, nil
+}
+
+// scalar parses a plain, single-quoted, or double-quoted scalar
+func scalar(text string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+
+	switch text[0] {
+	case '"':
+		if closingQuote(text) != len(text)-1 {
+			return "", fmt.Errorf("malformed quoted string %s", text)
+		}
+		return strconv.Unquote(text)
+	case '\'':
+		if closingQuote(text) != len(text)-1 {
+			return "", fmt.Errorf("malformed quoted string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case '&', '*', '|', '>', '{', '!', '[', '%', '@', '`':
+		return "", fmt.Errorf("unsupported value '%s': anchors, aliases, tags, block scalars, and flow mappings aren't supported", text)
+	}
+	return text, nil
+}
+
+// closingQuote returns the index of the quote closing the string text starts with, or -1
+func closingQuote(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment removes a comment, begun by '#' at the start of the line or
+// after a space, from a line
+func stripComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if quote == '"' && c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.ContainsRune(" [,:-", rune(text[i-1]))):
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return text[:i]
+		}
+	}
+	return text
+}
@@ -0,0 +1,84 @@
+// +build unit
+
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_Config_Suite(suite *testing.T) {
+
+	suite.Run("Parse reads global options and command sections", func(t *testing.T) {
+		config, err := Parse([]byte(`---
+# built nightly
+debug: true
+create:
+  author: "someone@example.com"   # quoted
+  parturlbase: https://cdn.example.com/pkgs
+  dockerimage:
+    - summit.hovitos.engineering/x86/cpu:1.2.2
+    - 'summit.hovitos.engineering/x86/gps:1.0.0'
+  platform: [cpu=linux/arm64, "gps=linux/amd64"]
+upload:
+  upload: s3://bucket/prefix
+  upload-receipt:
+estimate:
+  dockerimage:
+  - summit.hovitos.engineering/x86/cpu:1.2.2
+`))
+		assert.Nil(t, err)
+
+		assert.Equal(t, map[string][]string{"debug": {"true"}}, config.Global)
+		assert.Equal(t, []string{"someone@example.com"}, config.Commands["create"]["author"])
+		assert.Equal(t, []string{"https://cdn.example.com/pkgs"}, config.Commands["create"]["parturlbase"])
+		assert.Equal(t, []string{"summit.hovitos.engineering/x86/cpu:1.2.2", "summit.hovitos.engineering/x86/gps:1.0.0"}, config.Commands["create"]["dockerimage"])
+		assert.Equal(t, []string{"cpu=linux/arm64", "gps=linux/amd64"}, config.Commands["create"]["platform"])
+		assert.Equal(t, []string{"s3://bucket/prefix"}, config.Commands["upload"]["upload"])
+		assert.Equal(t, []string{}, config.Commands["upload"]["upload-receipt"])
+		assert.Equal(t, []string{"summit.hovitos.engineering/x86/cpu:1.2.2"}, config.Commands["estimate"]["dockerimage"])
+	})
+
+	suite.Run("Parse rejects what it doesn't support", func(t *testing.T) {
+		for _, content := range []string{
+			"create:\n\tauthor: me\n",
+			"create:\n  author: me\n   tmpdir: /tmp\n",
+			"debug: true\ndebug: false\n",
+			"create:\n  dockerimage:\n    nested: deeply\n",
+			"- item\n",
+			"author: &anchor me\n",
+			"author: \"unterminated\n",
+			"just text\n",
+		} {
+			_, err := Parse([]byte(content))
+			assert.NotNil(t, err, content)
+		}
+	})
+
+	suite.Run("Load and Find", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "config-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		file := path.Join(dir, "horizon-pkg-build", FileName)
+		assert.Nil(t, os.MkdirAll(path.Dir(file), 0755))
+		assert.Nil(t, ioutil.WriteFile(file, []byte("upload:\n  upload: s3://bucket\n"), 0644))
+
+		config, err := Load(file)
+		assert.Nil(t, err)
+		assert.Equal(t, file, config.Path)
+		assert.Equal(t, []string{"s3://bucket"}, config.Commands["upload"]["upload"])
+
+		t.Setenv("XDG_CONFIG_HOME", dir)
+		assert.Contains(t, DefaultPaths(), file)
+		if _, err := os.Stat(FileName); os.IsNotExist(err) {
+			assert.Equal(t, file, Find())
+		}
+
+		_, err = Load(path.Join(dir, "missing.yaml"))
+		assert.NotNil(t, err)
+	})
+}
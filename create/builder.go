@@ -0,0 +1,312 @@
+package create
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/dockerauth"
+	"time"
+)
+
+// Options configures the Pkgs a Builder builds. Only OutputDir and PrivateKey
+// are required (OutputDir not with a PartStreamer), and Client unless every
+// image is read by an Exporter; the
+// zero value of every other field is a sensible default. Fields are only
+// added to Options, never removed or given another meaning, so programs
+// setting them by name keep building with later releases.
+type Options struct {
+	// Client is the Docker daemon images are pulled, inspected, and exported
+	// with. Images with the same ID are packaged as one part only if it can
+	// export several images at once, and Mirrors are only used if it can tag
+	// images, as a DockerClient can.
+	Client ImageSource
+
+	// Exporter, if set, is the backend images are read from instead of the
+	// Docker daemon (see NewExporter); OCILayouts takes precedence for the
+	// images it specifies
+	Exporter Exporter
+
+	// Manifests resolves the digests of images packaged for a platform other
+	// than the daemon's (see Platforms), e.g. a registry.Client
+	Manifests ManifestResolver
+
+	// RetryPolicy says how failed pulls and exports are retried; the zero value retries none
+	RetryPolicy cmdtools.RetryPolicy
+
+	// SkipPullIfExists skips pulling images the Docker daemon already has
+	SkipPullIfExists bool
+
+	// AuthResolver supplies the registry credentials images are pulled with, if any
+	AuthResolver *dockerauth.Resolver
+
+	// Mirrors are registry mirrors (hosts) Docker Hub images are pulled
+	// through, in order, before falling back to Docker Hub
+	Mirrors []string
+
+	// Policy says which images are refused
+	Policy ImagePolicy
+
+	// CacheDir, if set, keeps parts for reuse by later builds of images whose IDs haven't changed
+	CacheDir string
+
+	// PullParallelism and ExportParallelism bound the images pulled and
+	// exported at once, and MaxParallel the images processed at once in all.
+	// When they're bounded, the largest images (by the sizes the Docker
+	// daemon reports) go first. Zero means no limit.
+	PullParallelism   int
+	ExportParallelism int
+	MaxParallel       int
+
+	// SignParallelism and PlaceParallelism bound the parts signed and placed
+	// (uploaded and added to the Pkg) at once; zero means no limit
+	SignParallelism  int
+	PlaceParallelism int
+
+	// PullTimeout and ExportTimeout, if set, fail an attempt to pull or export an image that takes longer
+	PullTimeout   time.Duration
+	ExportTimeout time.Duration
+
+	// DaemonCalls bounds the calls made to the Docker daemon at once, whatever
+	// the other limits, and DaemonCallInterval is the least time between their
+	// starts; zero means no limit
+	DaemonCalls        int
+	DaemonCallInterval time.Duration
+
+	// IOBufferSize is the size of the buffers parts are written, copied, and
+	// hashed through, between MinIOBufferSize and MaxIOBufferSize; zero means
+	// DefaultIOBufferSize
+	IOBufferSize int
+
+	// Compression is how parts are compressed, one of the Compression* modes;
+	// empty means CompressionAuto
+	Compression string
+
+	// Compressor compresses parts (see NewCompressor); nil means gzip
+	Compressor Compressor
+
+	// CheckSpace fails the build before any export if the filesystems parts are
+	// written to lack the space they're estimated to take
+	CheckSpace bool
+
+	// Resume records finished parts in a journal directory in TmpDir that's
+	// kept if the build fails, and reuses them in the next build of the same
+	// images with Resume set
+	Resume bool
+
+	// KeepTmpOnError keeps the temporary directory, with the partial exports
+	// in it, for inspection if the build fails
+	KeepTmpOnError bool
+
+	// Platforms specifies the platform (e.g. "linux/arm64") to package an
+	// image for; images absent from it are packaged for the platform of
+	// whatever image the Docker daemon pulls or has
+	Platforms map[string]string
+
+	// OCILayouts specifies OCI image layout directories to read images from instead of the Docker daemon
+	OCILayouts map[string]string
+
+	// OutputDir is the directory the Pkg's output directory, metadata file, and
+	// signature file are written to; with a PartStreamer, if it's empty,
+	// nothing is written to disk
+	OutputDir string
+
+	// TmpDir is the directory parts are written to a temporary directory in,
+	// moved into OutputDir once the Pkg is complete (by copying if they're on
+	// different filesystems); empty means OutputDir
+	TmpDir string
+
+	// Author and Info are recorded in the Pkg metadata, and signed with it
+	Author string
+	Info   PkgInfo
+
+	// PrivateKey is the PEM-encoded RSA private key parts and metadata are signed with
+	PrivateKey []byte
+
+	// URLBase is the URL base (or template, see CheckPartURLTemplate) of part
+	// URLs, and URLBases that of the parts of images served elsewhere
+	URLBase  string
+	URLBases map[string]string
+
+	// PartDestination, if set, names the URL recorded as each part's source
+	// instead of one under URLBase; if it's a PartUploader, each part is
+	// uploaded to it as soon as it's written, and if it's a PartStreamer, each
+	// part is streamed to it as it's written instead of to TmpDir (CacheDir
+	// and Resume can't be used with it, and CheckSpace and KeepTmpOnError are
+	// ignored)
+	PartDestination PartDestination
+
+	// PartHandoff, if set, is handed each part written to TmpDir as soon as
+	// it's written, before it's added to the Pkg; a part it fails to take
+	// fails the build
+	PartHandoff PartHandoff
+
+	// Summary, if set, records how each image was built
+	Summary *BuildSummary
+
+	// Events, if set, is called with each Event of a build as it happens, so
+	// programs can follow the build without parsing the reporter's output.
+	// It's called by concurrent workers, which wait for it to return.
+	Events func(Event)
+
+	// PkgName (see CheckPkgName) names the Pkg's output directory, metadata
+	// file, and part URLs; empty means the Pkg ID
+	PkgName string
+
+	// Force replaces earlier output of a Pkg of the same name in OutputDir
+	// once the new Pkg is complete, rather than failing the build
+	Force bool
+}
+
+// Result describes a Pkg a Builder built
+type Result struct {
+	PkgID      string
+	PkgName    string
+	PkgDir     string // the directory holding the parts
+	PkgFile    string // the metadata file
+	PkgSigFile string // the signature of the metadata file
+
+	// Pkg is the metadata, and PkgSignature its signature, as written to
+	// PkgFile and PkgSigFile; PkgDir and those are empty if they weren't
+	// written to disk (see PartStreamer)
+	Pkg          []byte
+	PkgSignature []byte
+}
+
+// BuildError is the error of a build that failed, with the failures reported
+// by the workers building it. Each failure wraps a cmdtools.Failure of its
+// kind of failure, e.g. cmdtools.ErrImageNotFound, with the affected image
+// and part; errors.Is matches a BuildError with the kinds and causes of all
+// its failures, and errors.As with the first's.
+type BuildError struct {
+	Code     int // the exit status for the class of failure, one of the cmdtools.Exit* constants
+	Failures []cmdtools.DelegateError
+}
+
+func (e *BuildError) Error() string {
+	if len(e.Failures) == 0 {
+		return "Failed to create Pkg"
+	}
+	return fmt.Sprintf("Failed to create Pkg: %v", e.Failures[0].Error())
+}
+
+// Unwrap returns the first failure, if any
+func (e *BuildError) Unwrap() error {
+	if len(e.Failures) == 0 {
+		return nil
+	}
+	return e.Failures[0]
+}
+
+// Is tells if any failure is of the kind, or caused by, target
+func (e *BuildError) Is(target error) bool {
+	for _, failure := range e.Failures {
+		if errors.Is(failure, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Builder builds Pkgs of Docker images for Go programs, as the `create`
+// command does without spawning it. A Builder may build any number of Pkgs,
+// one at a time.
+type Builder struct {
+	reporter *cmdtools.SynchronizedReporter
+	options  Options
+}
+
+// NewBuilder returns a Builder of Pkgs configured by options, or an error if
+// they're invalid. Progress, warnings, and failures are written to reporter
+// as they happen.
+func NewBuilder(reporter *cmdtools.SynchronizedReporter, options Options) (*Builder, error) {
+	if reporter == nil {
+		return nil, fmt.Errorf("Expected a reporter")
+	} else if _, isDaemon := options.Exporter.(*dockerExporter); options.Client == nil && (options.Exporter == nil || isDaemon) && len(options.OCILayouts) == 0 {
+		return nil, fmt.Errorf("Expected a Docker client or an Exporter")
+	} else if len(options.PrivateKey) == 0 {
+		return nil, fmt.Errorf("Expected a private key")
+	} else if _, tags := options.Client.(imageTagger); options.Client != nil && !tags && len(options.Mirrors) > 0 {
+		return nil, fmt.Errorf("Expected a Docker client that can tag images to pull images through registry mirrors")
+	}
+
+	if _, streaming := options.PartDestination.(PartStreamer); !streaming && options.OutputDir == "" {
+		return nil, fmt.Errorf("Expected an output directory")
+	} else if streaming && (options.CacheDir != "" || options.Resume) {
+		return nil, fmt.Errorf("Unable to cache parts or resume builds with parts streamed to their destination")
+	}
+
+	if options.IOBufferSize == 0 {
+		options.IOBufferSize = DefaultIOBufferSize
+	} else if options.IOBufferSize < MinIOBufferSize || options.IOBufferSize > MaxIOBufferSize {
+		return nil, fmt.Errorf("Expected an I/O buffer size between %v and %v, got %v", MinIOBufferSize, MaxIOBufferSize, options.IOBufferSize)
+	}
+
+	if options.Compression == "" {
+		options.Compression = CompressionAuto
+	} else if err := ValidCompression(options.Compression); err != nil {
+		return nil, err
+	}
+
+	if options.PkgName != "" {
+		if err := CheckPkgName(options.PkgName); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Builder{reporter: reporter, options: options}, nil
+}
+
+// Build builds a Pkg of the images. Once ctx is done, e.g. cancelled or past
+// its deadline, Docker operations in flight are cancelled, no new ones are
+// started, the temporary directory is removed, and ctx.Err() is returned. If
+// the build fails otherwise, the error is a *BuildError. Either way, an
+// EventBuildFinished event is sent to Options.Events, if set, once it's done.
+// The build's log messages, stage and error events, and failures are tagged
+// with the build ID ctx carries, if any (see cmdtools.WithBuildID), so builds
+// sharing a reporter can be told apart.
+func (b *Builder) Build(ctx context.Context, images []string) (*Result, error) {
+	result, err := b.build(ctx, images)
+	eventHandler(b.options.Events).send(Event{Kind: EventBuildFinished, Result: result, Err: err})
+	return result, err
+}
+
+func (b *Builder) build(ctx context.Context, images []string) (*Result, error) {
+	if len(images) == 0 {
+		return nil, fmt.Errorf("Expected at least one image")
+	}
+
+	failed := len(b.reporter.DelegateErrors())
+	result := buildPkg(ctx, b.reporter, b.options, images)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if result == nil {
+		return nil, newBuildError(buildFailures(b.reporter.DelegateErrors()[failed:], cmdtools.BuildID(ctx)))
+	}
+	return result, nil
+}
+
+// buildFailures returns the failures of the build with the given ID, leaving
+// out those of other builds reporting to the same reporter at once
+func buildFailures(failures []cmdtools.DelegateError, build string) []cmdtools.DelegateError {
+	own := []cmdtools.DelegateError{}
+	for _, failure := range failures {
+		if failure.Build == build {
+			own = append(own, failure)
+		}
+	}
+	return own
+}
+
+// newBuildError returns the error of a build with the given failures, whose
+// code is ExitUserError if they were all user errors and otherwise the code
+// of the first that wasn't, as SynchronizedReporter.DelegateExitCode says
+func newBuildError(failures []cmdtools.DelegateError) *BuildError {
+	code := cmdtools.ExitError
+	for i, failure := range failures {
+		if i == 0 || code == cmdtools.ExitUserError {
+			code = failure.Code
+		}
+	}
+	return &BuildError{Code: code, Failures: failures}
+}
@@ -0,0 +1,274 @@
+package create
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// partCacheManifest is the name of the file recording the parts in a cache directory
+const partCacheManifest = "hznpkg-cache.json"
+
+// cachedPart records a compressed part built from an image
+type cachedPart struct {
+	ImageID  string `json:"imageId"`
+	Platform string `json:"platform,omitempty"`
+	Settings string `json:"settings"`
+	Hash     string `json:"hash"`
+	Bytes    int64  `json:"bytes"`
+
+	// Stored is set if compression was skipped for some or all of the part (see CompressionAuto)
+	Stored bool `json:"stored,omitempty"`
+
+	// Extension is the file extension of the part, that of its Compressor; empty means ".tgz"
+	Extension string `json:"extension,omitempty"`
+}
+
+// matches tells if the part was built from the given image ID and platform with the given settings
+func (p cachedPart) matches(imageID string, platform string, settings string) bool {
+	return p.ImageID == imageID && p.Platform == platform && p.Settings == settings
+}
+
+// partCache keeps the parts built from images in a directory so that
+// later builds can reuse them instead of exporting and compressing an
+// image whose ID hasn't changed. Parts are keyed by image name since the
+// name is recorded in the exported content, and are only reused if they were
+// built with the same settings (see partSettings). A nil partCache caches
+// nothing.
+type partCache struct {
+	dir        string
+	log        *cmdtools.Logger
+	bufferSize int
+	parts      map[string]cachedPart
+	lock       sync.Mutex
+}
+
+// newPartCache opens the cache in the given directory, copying parts in and
+// out of it through buffers of bufferSize bytes; an unreadable cache manifest
+// is ignored. Its messages are tagged with the build ID the context carries.
+func newPartCache(ctx context.Context, dir string, reporter *cmdtools.SynchronizedReporter, bufferSize int) *partCache {
+	cache := &partCache{
+		dir:        dir,
+		log:        reporter.Log.WithContext(ctx).Subsystem(cmdtools.SubsystemCompress),
+		bufferSize: bufferSize,
+		parts:      map[string]cachedPart{},
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, partCacheManifest))
+	if err != nil && !os.IsNotExist(err) {
+		cache.log.Warnf("Unable to read part cache manifest in %v, ignoring cached parts. Error: %v", dir, err)
+	} else if err == nil {
+		if err := json.Unmarshal(content, &cache.parts); err != nil {
+			cache.log.Warnf("Unable to parse part cache manifest in %v, ignoring cached parts. Error: %v", dir, err)
+			cache.parts = map[string]cachedPart{}
+		}
+	}
+
+	return cache
+}
+
+func (c *partCache) partPath(part cachedPart) string {
+	extension := part.Extension
+	if extension == "" {
+		extension = gzipCompressor{}.Extension()
+	}
+	return path.Join(c.dir, fmt.Sprintf("%s%s", part.Hash, extension))
+}
+
+// cachedBytes returns the size of the part cached for the given image if it
+// was built from the same image ID and platform with the same settings
+func (c *partCache) cachedBytes(image string, imageID string, platform string, settings string) (int64, bool) {
+	if c == nil || imageID == "" {
+		return 0, false
+	}
+
+	c.lock.Lock()
+	part, exists := c.parts[image]
+	c.lock.Unlock()
+
+	if !exists || !part.matches(imageID, platform, settings) {
+		return 0, false
+	}
+
+	if _, err := os.Stat(c.partPath(part)); err != nil {
+		return 0, false
+	}
+	return part.Bytes, true
+}
+
+// reuse copies the part cached for the given image into tmpDir if it was
+// built from the same image ID and platform with the same settings, verifying its content against
+// the recorded hash. It returns the same values as writePart and false
+// if there's no usable part.
+func (c *partCache) reuse(image string, imageID string, platform string, settings string, tmpDir string) (hash.Hash, string, string, int64, bool, bool, error) {
+	if c == nil || imageID == "" {
+		return nil, "", "", 0, false, false, nil
+	}
+
+	c.lock.Lock()
+	part, exists := c.parts[image]
+	c.lock.Unlock()
+
+	if !exists || !part.matches(imageID, platform, settings) {
+		return nil, "", "", 0, false, false, nil
+	}
+
+	cached, err := os.Open(c.partPath(part))
+	if os.IsNotExist(err) {
+		return nil, "", "", 0, false, false, nil
+	} else if err != nil {
+		return nil, "", "", 0, false, false, err
+	}
+	defer cached.Close()
+
+	fileName := path.Base(c.partPath(part))
+	permPath := path.Join(tmpDir, fileName)
+
+	dest, err := os.OpenFile(permPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, "", "", 0, false, false, err
+	}
+	defer dest.Close()
+
+	// N.B. It's important that this match the signing tools' expectations, we reuse this hash
+	hashWriter := sha256.New()
+	written, err := io.CopyBuffer(io.MultiWriter(dest, hashWriter), struct{ io.Reader }{cached}, make([]byte, c.bufferSize))
+	if err != nil {
+		return nil, "", "", 0, false, false, err
+	}
+
+	if fmt.Sprintf("%x", hashWriter.Sum(nil)) != part.Hash || written != part.Bytes {
+		c.log.Warnf("Cached part for image %v in %v is corrupt, rebuilding it", image, c.dir)
+		os.Remove(permPath)
+		return nil, "", "", 0, false, false, nil
+	}
+
+	c.log.Infof("Reusing cached part for Docker image %v (image ID %v)", image, imageID)
+	return hashWriter, fileName, permPath, written, part.Stored, true, nil
+}
+
+// store adds the part built from the given image to the cache, replacing
+// any part cached for the image before. Failures are reported but don't
+// fail the build.
+func (c *partCache) store(image string, imageID string, platform string, settings string, partPath string, hashHex string, bytes int64, stored bool) {
+	if c == nil || imageID == "" {
+		return
+	}
+
+	part := cachedPart{ImageID: imageID, Platform: platform, Settings: settings, Hash: hashHex, Bytes: bytes, Stored: stored, Extension: strings.TrimPrefix(path.Base(partPath), hashHex)}
+
+	if err := copyFile(partPath, c.partPath(part), c.bufferSize); err != nil {
+		c.log.Warnf("Unable to cache part for image %v in %v. Error: %v", image, c.dir, err)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	previous, existed := c.parts[image]
+	c.parts[image] = part
+
+	// remove the superseded part unless another image shares it
+	if existed && previous.Hash != part.Hash {
+		shared := false
+		for _, p := range c.parts {
+			shared = shared || p.Hash == previous.Hash
+		}
+		if !shared {
+			os.Remove(c.partPath(previous))
+		}
+	}
+
+	if err := c.save(); err != nil {
+		c.log.Warnf("Unable to write part cache manifest in %v. Error: %v", c.dir, err)
+	}
+}
+
+// save atomically writes the cache manifest; the caller must hold the lock
+func (c *partCache) save() error {
+	serialized, err := json.MarshalIndent(c.parts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(c.dir, partCacheManifest)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(serialized); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path.Join(c.dir, partCacheManifest))
+}
+
+// resumeJournalDir returns the directory in tmpBaseDir where a build of the
+// given images records its finished parts for a later build to resume from.
+// It's named for the images so builds of other images don't share it and,
+// like the temporary build directories, isn't published.
+func resumeJournalDir(tmpBaseDir string, images []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(images, "\n")))
+	return path.Join(tmpBaseDir, fmt.Sprintf("build-hznpkg-resume-%x", sum[:8]))
+}
+
+// copyFile hard-links src to dest, or copies it through a buffer of
+// bufferSize bytes and syncs the copy to disk if they're on different
+// filesystems
+func copyFile(src string, dest string, bufferSize int) error {
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpFile, err := ioutil.TempFile(path.Dir(dest), path.Base(dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	// the files are hidden from io.CopyBuffer so it uses the buffer rather than their own ReadFrom or WriteTo
+	if _, err := io.CopyBuffer(struct{ io.Writer }{tmpFile}, struct{ io.Reader }{in}, make([]byte, bufferSize)); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), dest)
+}
@@ -0,0 +1,139 @@
+package create
+
+import (
+	"context"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io"
+	"time"
+)
+
+// contextClient is a DockerClient whose operations are cancelled with a
+// context: operations started after it's done fail at once and the daemon's
+// streams of operations in flight are closed. Errors of cancelled operations
+// are the context's, marked permanent so they aren't retried. Pulls and
+// exports taking longer than their timeouts, if set, are cancelled too, but
+// fail with errors that are retried.
+type contextClient struct {
+	DockerClient
+	ctx           context.Context
+	pullTimeout   time.Duration
+	exportTimeout time.Duration
+}
+
+func newContextClient(client DockerClient, ctx context.Context, pullTimeout time.Duration, exportTimeout time.Duration) *contextClient {
+	return &contextClient{
+		DockerClient:  client,
+		ctx:           ctx,
+		pullTimeout:   pullTimeout,
+		exportTimeout: exportTimeout,
+	}
+}
+
+// withTimeout returns a context for one operation, done after the timeout if it's set
+func (c *contextClient) withTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(c.ctx)
+	}
+	return context.WithTimeout(c.ctx, timeout)
+}
+
+// checkTimeout returns check's error, or a timeout error if the operation's context ran out of time
+func (c *contextClient) checkTimeout(opCtx context.Context, timeout time.Duration, operation string, err error) error {
+	if c.ctx.Err() == nil && opCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%v timed out after %v", operation, timeout)
+	}
+	return c.check(err)
+}
+
+// check returns the context's error, marked permanent, once it's done, or else the given error
+func (c *contextClient) check(err error) error {
+	if c.ctx.Err() != nil {
+		return cmdtools.PermanentError{Err: c.ctx.Err()}
+	}
+	return err
+}
+
+func (c *contextClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	if err := c.check(nil); err != nil {
+		return err
+	}
+	opCtx, cancel := c.withTimeout(c.pullTimeout)
+	defer cancel()
+
+	opts.Context = opCtx
+	return c.checkTimeout(opCtx, c.pullTimeout, "Pull", c.DockerClient.PullImage(opts, auth))
+}
+
+func (c *contextClient) ExportImage(opts docker.ExportImageOptions) error {
+	if err := c.check(nil); err != nil {
+		return err
+	}
+	opCtx, cancel := c.withTimeout(c.exportTimeout)
+	defer cancel()
+
+	opts.Context = opCtx
+	return c.checkTimeout(opCtx, c.exportTimeout, "Export", c.DockerClient.ExportImage(opts))
+}
+
+func (c *contextClient) ExportImages(opts docker.ExportImagesOptions) error {
+	if err := c.check(nil); err != nil {
+		return err
+	}
+	opCtx, cancel := c.withTimeout(c.exportTimeout)
+	defer cancel()
+
+	opts.Context = opCtx
+	return c.checkTimeout(opCtx, c.exportTimeout, "Export", c.DockerClient.ExportImages(opts))
+}
+
+func (c *contextClient) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	if err := c.check(nil); err != nil {
+		return nil, err
+	}
+	opts.Context = c.ctx
+	images, err := c.DockerClient.ListImages(opts)
+	return images, c.check(err)
+}
+
+func (c *contextClient) InspectImage(name string) (*docker.Image, error) {
+	if err := c.check(nil); err != nil {
+		return nil, err
+	}
+	return c.DockerClient.InspectImage(name)
+}
+
+func (c *contextClient) TagImage(name string, opts docker.TagImageOptions) error {
+	if err := c.check(nil); err != nil {
+		return err
+	}
+	opts.Context = c.ctx
+	return c.check(c.DockerClient.TagImage(name, opts))
+}
+
+// contextWriter fails writes once its context is done, stopping copies into it
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// contextReader fails reads once its context is done, stopping copies from it
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,107 @@
+package create
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// WriteChecksums writes the SHA-256 hashes of a Pkg's parts, metadata, and
+// signature files to the checksums file in pkgDir. Files are listed by their
+// paths relative to the directory containing pkgDir, as they're uploaded, so
+// 'sha256sum -c <pkg id>/SHA256SUMS' checks them from there. If sidecars is
+// set, each file's hash is also written beside it to a file with the
+// '.sha256' extension added that 'sha256sum -c' checks from the file's
+// directory. Checksum files written earlier are replaced.
+func WriteChecksums(pkgDir string, pkgFile string, pkgSigFile string, sidecars bool) error {
+	files, err := ioutil.ReadDir(pkgDir)
+	if err != nil {
+		return err
+	}
+
+	parts := []string{}
+	for _, f := range files {
+		// parts may be symbolic links to identical parts of other Pkgs (see LinkDuplicateParts)
+		if info, err := os.Stat(path.Join(pkgDir, f.Name())); err == nil && info.Mode().IsRegular() && !cmdtools.IsChecksumFile(f.Name()) {
+			parts = append(parts, path.Join(pkgDir, f.Name()))
+		}
+	}
+	sort.Strings(parts)
+
+	baseDir := path.Dir(path.Clean(pkgDir))
+
+	var sums bytes.Buffer
+	for _, file := range append(parts, pkgFile, pkgSigFile) {
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return fmt.Errorf("Unable to hash %v. Error: %v", file, err)
+		}
+
+		name := path.Base(file)
+		if path.Dir(file) == path.Clean(pkgDir) {
+			name = path.Join(path.Base(pkgDir), name)
+		} else if path.Dir(file) != baseDir {
+			// the metadata and signature files are normally beside the Pkg directory
+			name = file
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", sum, name)
+
+		if sidecars {
+			if err := writeFileAtomic(file+cmdtools.ChecksumSidecarExt, []byte(fmt.Sprintf("%s  %s\n", sum, path.Base(file)))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return writeFileAtomic(path.Join(pkgDir, cmdtools.ChecksumsFile), sums.Bytes())
+}
+
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// writeFileAtomic writes the content to a temporary file that's synced to
+// disk, then renamed over the given file, so a crash or a full disk never
+// leaves the file truncated
+func writeFileAtomic(file string, content []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(file))
+}
@@ -0,0 +1,336 @@
+package create
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// The compressors parts may be written with (see NewCompressor)
+const (
+	CompressorGzip  = "gzip"
+	CompressorPgzip = "pgzip"
+	CompressorZstd  = "zstd"
+	CompressorXz    = "xz"
+	CompressorNone  = "none"
+)
+
+// The encodings of parts, recorded in the Pkg metadata as each part's
+// "encoding" unless it's EncodingGzip, which fetchers assume of parts
+// without one. They're named as HTTP content codings are.
+const (
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+	EncodingXz       = "xz"
+	EncodingIdentity = "identity"
+)
+
+// Compressor compresses parts in an encoding fetchers know how to read, so a
+// new format needs only a Compressor. Streams a Compressor writes one after
+// another must read as one stream of their content, as gzip members, zstd
+// frames, and xz streams do, since CompressionAuto may end a stream after its
+// sample and write the rest in a stored one. A Compressor is used by
+// concurrent workers.
+type Compressor interface {
+	// String names the compressor and its settings, e.g. "gzip-9"; parts
+	// cached by builds with another compressor aren't reused
+	String() string
+
+	// Encoding identifies the encoding of the parts, one of the Encoding* constants
+	Encoding() string
+
+	// Extension is the file extension of the parts, e.g. ".tgz"
+	Extension() string
+
+	// NewWriter returns a writer compressing what's written to it into w as
+	// a stream that ends once it's closed, leaving w open. If stored is set,
+	// content is compressed as little as the encoding allows, for content that
+	// barely compresses. Compression that runs apart from the writes, e.g. in a
+	// tool of its own, is stopped once the context is done.
+	NewWriter(ctx context.Context, w io.Writer, stored bool) (io.WriteCloser, error)
+}
+
+// NewCompressor returns the Compressor of the given name, one of:
+//
+//	gzip   gzip at the best compression level
+//	pgzip  gzip at the best compression level, compressing blocks on all CPUs at once
+//	zstd   Zstandard at level 19, with the 'zstd' tool
+//	xz     xz at its default level, with the 'xz' tool
+//	none   no compression: parts are the uncompressed archives
+//
+// pgzip writes each block of a part as a gzip member of its own, so its parts
+// are a little larger than gzip's but read the same.
+func NewCompressor(name string) (Compressor, error) {
+	switch name {
+	case CompressorGzip:
+		return gzipCompressor{}, nil
+	case CompressorPgzip:
+		return parallelGzipCompressor{workers: runtime.NumCPU()}, nil
+	case CompressorZstd:
+		return newCommandCompressor(CompressorZstd, EncodingZstd, ".tar.zst", []string{"-q", "-c", "-19", "-T0"}, []string{"-q", "-c", "-1", "-T0"})
+	case CompressorXz:
+		return newCommandCompressor(CompressorXz, EncodingXz, ".tar.xz", []string{"-q", "-c", "-6", "-T0"}, []string{"-q", "-c", "-0", "-T0"})
+	case CompressorNone:
+		return noCompressor{}, nil
+	}
+	return nil, fmt.Errorf("Expected one of '%s', '%s', '%s', '%s', or '%s', got '%s'", CompressorGzip, CompressorPgzip, CompressorZstd, CompressorXz, CompressorNone, name)
+}
+
+// gzipCompressor writes parts as gzip streams at partCompressionLevel
+type gzipCompressor struct{}
+
+func (gzipCompressor) String() string {
+	return fmt.Sprintf("gzip-%d", partCompressionLevel)
+}
+
+func (gzipCompressor) Encoding() string {
+	return EncodingGzip
+}
+
+func (gzipCompressor) Extension() string {
+	return ".tgz"
+}
+
+func (gzipCompressor) NewWriter(ctx context.Context, w io.Writer, stored bool) (io.WriteCloser, error) {
+	if stored {
+		return gzip.NewWriterLevel(w, gzip.NoCompression)
+	}
+	return gzip.NewWriterLevel(w, partCompressionLevel)
+}
+
+// the size of the blocks parallelGzipCompressor compresses at once
+const parallelGzipBlockSize = 1 << 20
+
+// parallelGzipCompressor writes parts as gzip at partCompressionLevel,
+// compressing blocks on as many workers at once, each as a gzip member
+type parallelGzipCompressor struct {
+	workers int
+}
+
+func (c parallelGzipCompressor) String() string {
+	return fmt.Sprintf("pgzip-%d-%d", partCompressionLevel, parallelGzipBlockSize)
+}
+
+func (parallelGzipCompressor) Encoding() string {
+	return EncodingGzip
+}
+
+func (parallelGzipCompressor) Extension() string {
+	return ".tgz"
+}
+
+func (c parallelGzipCompressor) NewWriter(ctx context.Context, w io.Writer, stored bool) (io.WriteCloser, error) {
+	if stored {
+		return gzip.NewWriterLevel(w, gzip.NoCompression)
+	}
+
+	p := &parallelGzipWriter{
+		w:       w,
+		block:   make([]byte, 0, parallelGzipBlockSize),
+		pending: make(chan chan []byte, c.workers),
+		done:    make(chan error, 1),
+	}
+	go p.drain()
+	return p, nil
+}
+
+// parallelGzipWriter compresses each block written to it as a gzip member on
+// a goroutine of its own, with at most cap(pending) blocks compressed at
+// once, and writes the members out in order
+type parallelGzipWriter struct {
+	w       io.Writer
+	block   []byte
+	pending chan chan []byte
+	done    chan error
+	closed  bool
+}
+
+func (p *parallelGzipWriter) Write(b []byte) (int, error) {
+	if p.closed {
+		return 0, fmt.Errorf("Unable to write to closed compressor")
+	}
+
+	written := 0
+	for len(b) > 0 {
+		n := copy(p.block[len(p.block):cap(p.block)], b)
+		p.block = p.block[:len(p.block)+n]
+		b = b[n:]
+		written += n
+
+		if len(p.block) == cap(p.block) {
+			p.compress()
+		}
+	}
+	return written, nil
+}
+
+// compress hands the block to a goroutine to compress, waiting if too many are in flight
+func (p *parallelGzipWriter) compress() {
+	block := p.block
+	p.block = make([]byte, 0, parallelGzipBlockSize)
+
+	result := make(chan []byte, 1)
+	p.pending <- result
+	go func() {
+		var member bytes.Buffer
+		gzipWriter, _ := gzip.NewWriterLevel(&member, partCompressionLevel)
+		gzipWriter.Write(block)
+		gzipWriter.Close()
+		result <- member.Bytes()
+	}()
+}
+
+// drain writes the compressed blocks out in the order they were written
+func (p *parallelGzipWriter) drain() {
+	var err error
+	for result := range p.pending {
+		member := <-result
+		if err == nil {
+			_, err = p.w.Write(member)
+		}
+	}
+	p.done <- err
+}
+
+// Close compresses what's left and waits until every block is written out
+func (p *parallelGzipWriter) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	if len(p.block) > 0 {
+		p.compress()
+	}
+	close(p.pending)
+	return <-p.done
+}
+
+// commandCompressor writes parts by piping them through a compression tool
+type commandCompressor struct {
+	name         string
+	encoding     string
+	extension    string
+	args         []string
+	storedArgs   []string
+	toolLocation string
+}
+
+// newCommandCompressor returns a compressor running the tool of the given
+// name with args, or storedArgs for stored content, to compress stdin to
+// stdout, failing if the tool isn't installed
+func newCommandCompressor(name string, encoding string, extension string, args []string, storedArgs []string) (Compressor, error) {
+	location, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("The '%s' tool is required to compress parts with %s. Error: %v", name, name, err)
+	}
+	return commandCompressor{name: name, encoding: encoding, extension: extension, args: args, storedArgs: storedArgs, toolLocation: location}, nil
+}
+
+func (c commandCompressor) String() string {
+	return fmt.Sprintf("%s %s", c.name, strings.Join(c.args, " "))
+}
+
+func (c commandCompressor) Encoding() string {
+	return c.encoding
+}
+
+func (c commandCompressor) Extension() string {
+	return c.extension
+}
+
+func (c commandCompressor) NewWriter(ctx context.Context, w io.Writer, stored bool) (io.WriteCloser, error) {
+	args := c.args
+	if stored {
+		args = c.storedArgs
+	}
+
+	cmd := exec.CommandContext(ctx, c.toolLocation, args...)
+	cmd.Stdout = w
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Unable to start '%s' to compress part. Error: %v", c.name, err)
+	}
+	return &commandWriter{name: c.name, cmd: cmd, stdin: stdin, stderr: stderr}, nil
+}
+
+// commandWriter writes what's written to it to a compression tool, which writes its output on
+type commandWriter struct {
+	name   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *bytes.Buffer
+	closed bool
+}
+
+func (c *commandWriter) Write(p []byte) (int, error) {
+	n, err := c.stdin.Write(p)
+	if err != nil {
+		// the tool's exit status says more than the broken pipe
+		if closeErr := c.Close(); closeErr != nil {
+			return n, closeErr
+		}
+	}
+	return n, err
+}
+
+// Close ends the tool's input and waits until it's written all its output
+func (c *commandWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	c.stdin.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("Unable to compress part with '%s'. Error: %v: %s", c.name, err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
+
+// noCompressor writes parts uncompressed
+type noCompressor struct{}
+
+func (noCompressor) String() string {
+	return CompressorNone
+}
+
+func (noCompressor) Encoding() string {
+	return EncodingIdentity
+}
+
+func (noCompressor) Extension() string {
+	return ".tar"
+}
+
+func (noCompressor) NewWriter(ctx context.Context, w io.Writer, stored bool) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+// nopWriteCloser is a writer with a Close that does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressorOf returns the given compressor, or gzip's if it's nil
+func compressorOf(compressor Compressor) Compressor {
+	if compressor == nil {
+		return gzipCompressor{}
+	}
+	return compressor
+}
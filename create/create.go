@@ -1,46 +1,267 @@
 package create
 
 import (
+	"bufio"
 	"compress/gzip"
-	"crypto/rsa"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/dockerauth"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"github.com/open-horizon/horizon-pkg-build/registry"
 	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
-	"github.com/open-horizon/rsapss-tool/sign"
 	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
-// DockerClient is an interface for the parts of fsouza/go-dockerclient that we
-// need; we're abstracting it for testing purposes: we want to avoid generating
-// mock structs
-type DockerClient interface {
-	ExportImage(docker.ExportImageOptions) error
+// the gzip compression level parts are written with by gzip compressors
+const partCompressionLevel = gzip.BestCompression
+
+// How parts are compressed: CompressionAuto compresses the first
+// compressionSampleSize bytes of an image's export and, if that shrinks it by
+// less than minCompressionSavings, stores the rest uncompressed, as images
+// dominated by already-compressed content (model weights, media) gain next
+// to nothing from compression at great CPU cost; CompressionAlways always
+// compresses, and CompressionNever never does. Parts are streams of the
+// Compressor's encoding either way, so they're read the same.
+const (
+	CompressionAuto   = "auto"
+	CompressionAlways = "always"
+	CompressionNever  = "never"
+)
+
+const (
+	compressionSampleSize = 16 << 20
+	minCompressionSavings = 0.05
+)
+
+// ValidCompression returns an error if mode isn't one of the Compression* modes
+func ValidCompression(mode string) error {
+	switch mode {
+	case CompressionAuto, CompressionAlways, CompressionNever:
+		return nil
+	}
+	return fmt.Errorf("Expected one of '%s', '%s', or '%s', got '%s'", CompressionAuto, CompressionAlways, CompressionNever, mode)
+}
+
+// The size of the buffers parts are written, copied, and hashed through, and
+// the bounds of sizes that may be configured instead
+const (
+	DefaultIOBufferSize = 256 << 10
+	MinIOBufferSize     = 4 << 10
+	MaxIOBufferSize     = 64 << 20
+)
+
+// matches Pkg names that are safe as file names and URL path segments
+var pkgNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// CheckPkgName returns an error if name can't name a Pkg: it must start with
+// a letter or digit followed by letters, digits, '.', '_', or '-'
+func CheckPkgName(name string) error {
+	if !pkgNamePattern.MatchString(name) {
+		return fmt.Errorf("Expected a letter or digit followed by letters, digits, '.', '_', or '-', got '%s'", name)
+	}
+	return nil
+}
+
+// CheckPkgOutput returns an error if baseOutputDir already has output of a
+// Pkg named pkgName: its directory, metadata file, or signature file
+func CheckPkgOutput(baseOutputDir string, pkgName string) error {
+	for _, name := range []string{pkgName, pkgName + ".json", pkgName + ".json.sig"} {
+		if _, err := os.Lstat(path.Join(baseOutputDir, name)); err == nil {
+			return fmt.Errorf("%v already exists in %v", name, baseOutputDir)
+		}
+	}
+	return nil
+}
+
+// matches full image IDs and unambiguous-length prefixes, with or without the digest algorithm
+var imageIDPattern = regexp.MustCompile(`^(sha256:)?[0-9a-f]{12,64}$`)
+
+// ImageSource is the least of fsouza/go-dockerclient's docker.Client that
+// images can be listed, pulled, inspected, and exported with. Functions that
+// only read images take it, so other backends or test doubles need implement
+// only these methods.
+type ImageSource interface {
 	ListImages(docker.ListImagesOptions) ([]docker.APIImages, error)
 	PullImage(docker.PullImageOptions, docker.AuthConfiguration) error
+	InspectImage(string) (*docker.Image, error)
+	ExportImage(docker.ExportImageOptions) error
+}
+
+// DockerClient is an ImageSource that can also export several images in one
+// archive and tag images; we're abstracting it for testing purposes: we want
+// to avoid generating mock structs. An ImageSource given to a Builder is used
+// as one, with whichever of these operations it has (see sourceClient).
+type DockerClient interface {
+	ImageSource
+	imagesExporter
+	imageTagger
+}
+
+// imagesExporter is an ImageSource that can export several images in one
+// archive, so images with the same ID are packaged as one part
+type imagesExporter interface {
+	ExportImages(docker.ExportImagesOptions) error
+}
+
+// imageTagger is an ImageSource that can tag images, as pulling Docker Hub
+// images through registry mirrors needs to
+type imageTagger interface {
+	TagImage(string, docker.TagImageOptions) error
+}
+
+// sourceClient is a DockerClient of an ImageSource that may lack its other
+// operations, which fail if it does
+type sourceClient struct {
+	ImageSource
+}
+
+// dockerClientOf returns the ImageSource as a DockerClient, or nil if it's nil
+func dockerClientOf(source ImageSource) DockerClient {
+	if client, ok := source.(DockerClient); ok || source == nil {
+		return client
+	}
+	return &sourceClient{ImageSource: source}
+}
+
+func (c *sourceClient) ExportImages(opts docker.ExportImagesOptions) error {
+	if exporter, ok := c.ImageSource.(imagesExporter); ok {
+		return exporter.ExportImages(opts)
+	}
+	return fmt.Errorf("Unable to export several images at once, the Docker client doesn't support it")
+}
+
+func (c *sourceClient) TagImage(name string, opts docker.TagImageOptions) error {
+	if tagger, ok := c.ImageSource.(imageTagger); ok {
+		return tagger.TagImage(name, opts)
+	}
+	return fmt.Errorf("Unable to tag image %v, the Docker client doesn't support it", name)
+}
+
+// ManifestResolver determines the digest of the manifest of an image for a
+// given platform; it's abstracted for testing purposes like ImageSource
+type ManifestResolver interface {
+	PlatformDigest(image string, platform string) (string, error)
+}
+
+// PartDestination names the URLs parts are recorded with when they aren't
+// under the part URL base (e.g. pre-signed URLs). Names are the Pkg ID and the
+// part's file name joined by "/".
+type PartDestination interface {
+	URL(name string) string
+}
+
+// PartUploader is a PartDestination that parts are uploaded to as they're
+// written, for destinations whose URLs are known only once the content is
+// uploaded (e.g. IPFS content identifiers). upload.Uploader implementations
+// satisfy it.
+type PartUploader interface {
+	PartDestination
+	Put(ctx context.Context, name string, localPath string) error
+}
+
+// PartHandoff is handed each part as soon as it's written, while the parts of
+// other images are still being exported, e.g. to start uploading it, without
+// naming the URL it's recorded with as a PartDestination does. Names are the
+// Pkg ID and the part's file name joined by "/". upload.Handoff satisfies it.
+type PartHandoff interface {
+	Put(ctx context.Context, name string, localPath string) error
+}
+
+// imageMatchesPlatform returns true if the local image has the OS and
+// architecture of the given platform (image metadata doesn't record variants)
+func imageMatchesPlatform(client ImageSource, image string, platformSpec string) (bool, error) {
+	platform, err := registry.ParsePlatform(platformSpec)
+	if err != nil {
+		return false, err
+	}
+
+	inspected, err := client.InspectImage(image)
+	if err != nil {
+		return false, err
+	}
+
+	return inspected.OS == platform.OS && inspected.Architecture == platform.Architecture, nil
+}
+
+// localImageMatchesPlatform returns true if the local image suits the given
+// platform, as imageMatchesPlatform says, and, for a platform naming a variant
+// (e.g. "linux/arm/v7"), if it was pulled by the digest the registry gives the
+// variant, as variants are pulled by fetchImage, since image metadata
+// doesn't record them
+func localImageMatchesPlatform(client ImageSource, manifests ManifestResolver, image string, platformSpec string) (bool, error) {
+	matches, err := imageMatchesPlatform(client, image, platformSpec)
+	if err != nil || !matches {
+		return false, err
+	}
+
+	platform, err := registry.ParsePlatform(platformSpec)
+	if err != nil {
+		return false, err
+	} else if platform.Variant == "" {
+		return true, nil
+	} else if manifests == nil {
+		return false, nil
+	}
+
+	inspected, err := client.InspectImage(image)
+	if err != nil {
+		return false, err
+	}
+
+	// an image pulled by the variant's own digest resolves to itself
+	for _, repoDigest := range inspected.RepoDigests {
+		digest, err := manifests.PlatformDigest(repoDigest, platformSpec)
+		if err == nil && strings.HasSuffix(repoDigest, "@"+digest) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func imageExistsAtTarget(client DockerClient, image string) (bool, error) {
+func imageExistsAtTarget(client ImageSource, image string) (bool, error) {
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return false, err
+	}
+
+	// the daemon records images under the short form of their names
+	image = ref.String()
+
 	opts := docker.ListImagesOptions{
 		All:    true,
 		Filter: image,
 	}
 
+	// the daemon's reference filter doesn't reliably match digests; list the repository and check them ourselves
+	isDigest := ref.IsDigest()
+	if isDigest {
+		opts.Filter = ref.Repository()
+	}
+
 	images, err := client.ListImages(opts)
 	if err != nil {
 		return false, err
 	}
 
 	for _, im := range images {
-		for _, t := range im.RepoTags {
+		refs := im.RepoTags
+		if isDigest {
+			refs = im.RepoDigests
+		}
+
+		for _, t := range refs {
 			if t == image {
 				return true, nil
 			}
@@ -50,281 +271,980 @@ func imageExistsAtTarget(client DockerClient, image string) (bool, error) {
 
 }
 
-func exportImageToFile(client DockerClient, skipPullIfExists bool, authConfigurations *docker.AuthConfigurations, tmpDir string, image string) (string, string, error) {
+// IsImageID returns true if the given image name is a local image ID (or ID
+// prefix of at least 12 characters) like "sha256:2b8fd9751c4c" or "2b8fd9751c4c"
+func IsImageID(image string) bool {
+	return imageIDPattern.MatchString(image)
+}
+
+// ResolveImageIDs returns the given image names with image IDs replaced by
+// the full ID of the local image they identify, e.g. "sha256:2b8f...". This
+// canonical ID is used as the image's name in the Pkg. Dangling images,
+// which have no name to restore when loaded, are refused with an ImageError
+// unless allowDangling is set.
+func ResolveImageIDs(client ImageSource, images []string, allowDangling bool) ([]string, error) {
+	resolved := []string{}
+
+	for _, image := range images {
+		if !IsImageID(image) {
+			resolved = append(resolved, image)
+			continue
+		}
+
+		inspected, err := client.InspectImage(image)
+		if err != nil {
+			return nil, localImageError(image, err)
+		}
+
+		if !allowDangling && isDangling(inspected) {
+			return nil, ImageError{Image: image, Reason: "is dangling (it has no tag), so it would be loaded without a name. Tag it or set option 'allow-dangling-images' to package it by ID anyway"}
+		}
+		resolved = append(resolved, inspected.ID)
+	}
+
+	return resolved, nil
+}
+
+// isDangling returns true if the given image has no tags
+func isDangling(image *docker.Image) bool {
+	for _, tag := range image.RepoTags {
+		if tag != "<none>:<none>" {
+			return false
+		}
+	}
+	return true
+}
+
+// checkLocalImage verifies an image given by ID, which can't be pulled, exists locally and suits the platform
+func checkLocalImage(client ImageSource, manifests ManifestResolver, platform string, image string) error {
+	if _, err := client.InspectImage(image); err != nil {
+		return localImageError(image, err)
+	}
+
+	if platform != "" {
+		matches, err := localImageMatchesPlatform(client, manifests, image, platform)
+		if err != nil {
+			return err
+		} else if !matches {
+			return fmt.Errorf("Local image %v is not for requested platform %v, or wasn't pulled by the digest of its variant", image, platform)
+		}
+	}
 
-	dockerSafeName := strings.Replace(image, "/", "_", -1)
+	return nil
+}
 
-	dockerSafeTmpFileName := fmt.Sprintf("%s.tar", dockerSafeName)
-	tmpFile, err := ioutil.TempFile(tmpDir, dockerSafeTmpFileName)
+// fetchImage pulls the given image if necessary and returns the name to
+// export it by and, if that's not the image's name, the tag the export must
+// record it under (see retagArchive)
+func fetchImage(client DockerClient, manifests ManifestResolver, skipPullIfExists bool, authResolver *dockerauth.Resolver, policy ImagePolicy, platform string, image string) (string, string, error) {
+	ref, err := reference.Parse(image)
 	if err != nil {
 		return "", "", err
 	}
-	defer tmpFile.Close()
+	repo := ref.Repository()
 
 	// fetch image if it doesn't exist locally
 	imageExists, err := imageExistsAtTarget(client, image)
 	if err != nil {
 		return "", "", err
 	}
+	existsLocally := imageExists
 
-	if !imageExists || imageExists && !skipPullIfExists {
-		spl := strings.Split(image, ":")
-
-		if len(spl) != 2 {
-			return "", "", fmt.Errorf("Unable to parse given image name: %v", image)
+	// a local image for another platform doesn't satisfy the request
+	if imageExists && platform != "" {
+		imageExists, err = localImageMatchesPlatform(client, manifests, image, platform)
+		if err != nil {
+			return "", "", err
 		}
+	}
 
-		repo := spl[0]
-		var repoAuth docker.AuthConfiguration
-
-		if authConfigurations != nil {
-			serverAddressSpl := strings.Split(repo, "/")
-			var serverAddress string
-
-			if len(serverAddressSpl) > 1 {
-				serverAddress = serverAddressSpl[0]
+	if imageExists && skipPullIfExists {
+		return image, "", nil
+	}
 
-				for _, ra := range authConfigurations.Configs {
-					if ra.ServerAddress == serverAddress {
-						repoAuth = ra
-					}
-				}
-			} // if we didn't find one, we'll try the pull without
-		}
+	// if we don't find one, we'll try the pull without unless the policy requires one
+	repoAuth, found, err := authResolver.Lookup(dockerauth.ServerAddress(ref))
+	if err != nil {
+		return "", "", err
+	}
+	if err := policy.checkCredentials(image, dockerauth.ServerAddress(ref), found); err != nil {
+		return "", "", err
+	}
 
-		pullOpts := docker.PullImageOptions{
-			Repository: repo,
-			Tag:        spl[1],
-		}
+	// the daemon accepts a digest in place of a tag
+	pullOpts := docker.PullImageOptions{
+		Repository: repo,
+		Tag:        ref.Ref(),
+	}
 
-		if err := client.PullImage(pullOpts, repoAuth); err != nil {
+	// pull the platform's variant by its digest
+	if platform != "" {
+		digest, err := manifests.PlatformDigest(image, platform)
+		if err != nil {
 			return "", "", err
 		}
+		pullOpts.Tag = digest
 	}
 
-	// pulled by now
-	exportOpts := docker.ExportImageOptions{
-		Name:         image,
-		OutputStream: tmpFile,
+	if err := client.PullImage(pullOpts, repoAuth); err != nil {
+		return "", "", pullError(image, existsLocally, err)
 	}
 
-	if err := client.ExportImage(exportOpts); err != nil {
-		return "", "", err
+	if platform == "" {
+		return image, "", nil
 	}
 
-	if err := tmpFile.Sync(); err != nil {
+	// the variant is exported by its own digest, since pulling by digest
+	// doesn't move the tag and the local tag, which others may use, is left
+	// as it is; the export records the tag instead
+	exportName := fmt.Sprintf("%s@%s", repo, pullOpts.Tag)
+	tag := ""
+	if !ref.IsDigest() {
+		tag = ref.String()
+	}
+
+	matches, err := imageMatchesPlatform(client, exportName, platform)
+	if err != nil {
 		return "", "", err
+	} else if !matches {
+		return "", "", fmt.Errorf("Image %v pulled from registry is not for requested platform %v", image, platform)
 	}
 
-	return tmpFile.Name(), dockerSafeTmpFileName, nil
+	return exportName, tag, nil
 }
 
-func compressImageFile(tmpDir string, fileName string, dockerSafeTmpFileName string) (string, string, int64, error) {
+// prepareImage makes the given image available for export with the exporter
+// it's read by, returning its image ID and, if the exporter learns it, its
+// uncompressed size
+func prepareImage(ctx context.Context, platform string, exporter Exporter, image string) (string, int64, error) {
+	imageID, err := exporter.Prepare(ctx, image, platform)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var size int64
+	if sizer, ok := exporter.(imageSizer); ok {
+		size = sizer.Size(image, platform)
+	}
+	return imageID, size, nil
+}
 
-	dockerSafeTmpCompressedFileName := fmt.Sprintf("%s.tgz", dockerSafeTmpFileName[0:len(dockerSafeTmpFileName)-len(filepath.Ext(dockerSafeTmpFileName))])
+// exportPreparedImage writes an image readied by prepareImage, compressed,
+// to a file in tmpDir. The export is streamed into the compressor so the
+// uncompressed image never lands on disk. Several export names of the same
+// image are exported together so the file restores all of them when loaded.
+// Returns the file's path, a Docker-safe name for it with the compressor's
+// extension parts are named with, the SHA-256 hash and size of the
+// compressed content, hashed as it's written, and whether compression was
+// skipped for some or all of it per the compression mode (see
+// CompressionAuto). The compressed content is written through a buffer of
+// bufferSize bytes; progress, if set, is told the uncompressed bytes exported
+// so far as they're written. Exports stop once the context is done.
+func exportPreparedImage(ctx context.Context, policy ImagePolicy, platform string, exporter Exporter, tmpDir string, bufferSize int, compressor Compressor, compression string, progress func(int64), images []string) (string, string, hash.Hash, int64, bool, error) {
+
+	dockerSafeName := strings.Replace(images[0], "/", "_", -1)
+
+	dockerSafeTmpCompressedFileName := fmt.Sprintf("%s%s", dockerSafeName, compressorOf(compressor).Extension())
 	tmpCompressedFile, err := ioutil.TempFile(tmpDir, dockerSafeTmpCompressedFileName)
 	if err != nil {
-		return "", "", 0, err
+		return "", "", nil, 0, false, err
 	}
 	defer tmpCompressedFile.Close()
 
-	// now compress
-	gzipFileWriter, err := gzip.NewWriterLevel(tmpCompressedFile, gzip.BestCompression)
+	out, err := newCompressedFile(ctx, tmpCompressedFile, bufferSize, compressor, compression)
 	if err != nil {
-		return "", "", 0, err
+		return "", "", nil, 0, false, err
 	}
-	defer gzipFileWriter.Close()
+	out.progress = progress
 
-	tmpFile, err := os.Open(fileName)
-	if err != nil {
-		return "", "", 0, err
+	if err := exportTo(ctx, policy, platform, exporter, out, images); err != nil {
+		return "", "", nil, 0, false, err
 	}
-	defer tmpFile.Close()
 
-	unzippedBytes, err := io.Copy(gzipFileWriter, tmpFile)
-	if err != nil {
-		return "", "", 0, err
+	if err := out.Close(); err != nil {
+		return "", "", nil, 0, false, err
 	}
 
-	if err := gzipFileWriter.Flush(); err != nil {
-		return "", "", 0, err
+	if err := tmpCompressedFile.Sync(); err != nil {
+		return "", "", nil, 0, false, err
 	}
 
-	return tmpCompressedFile.Name(), dockerSafeTmpCompressedFileName, unzippedBytes, nil
+	return tmpCompressedFile.Name(), dockerSafeTmpCompressedFileName, out.hash, out.compressed.n, out.stored, nil
 }
 
-// Returns sha256hash, filename, full path to written file, and err.
-// N.B. The hash is calculated on the *compressed* content.
-func writeDockerImage(client DockerClient, skipPullIfExists bool, authConfigurations *docker.AuthConfigurations, tmpDir string, image string) (hash.Hash, string, string, int64, error) {
+// exportTo exports the images, which are all the same image, to out with the
+// exporter they're read by: together, if it can export several names of an
+// image at once, or else just the first
+func exportTo(ctx context.Context, policy ImagePolicy, platform string, exporter Exporter, out io.Writer, images []string) error {
+	// images of known sizes were checked against the policy when they were
+	// prepared, and are exported to out as it is so a failed export can be
+	// retried by rewinding it (see retryingClient)
+	_, sized := exporter.(imageSizer)
+
+	// the archive holds uncompressed layers like a Docker daemon export
+	counter := &countingWriter{w: &contextWriter{ctx: ctx, w: out}}
+	w := io.Writer(counter)
+	if sized {
+		w = out
+	}
 
-	tmpFileName, dockerSafeTmpFileName, err := exportImageToFile(client, skipPullIfExists, authConfigurations, tmpDir, image)
-	if err != nil {
-		return nil, "", "", 0, err
+	var err error
+	if grouped, ok := exporter.(groupExporter); ok {
+		err = grouped.ExportGroup(ctx, images, platform, w)
+	} else {
+		err = exporter.Export(ctx, images[0], platform, w)
+	}
+	if err != nil || sized {
+		return err
 	}
-	defer os.Remove(tmpFileName)
+	return policy.checkSize(images[0], counter.n)
+}
+
+// compressedWriter compresses what's written to it with a Compressor into a
+// writer through a buffer, hashing and counting the compressed content on its
+// way. Content is compressed as the compression mode says; once a
+// CompressionAuto sample shows it isn't worth it, the rest is written as a
+// second, stored stream, which readers of the encoding read on from the first
+// (e.g. a second gzip member).
+type compressedWriter struct {
+	io.WriteCloser
+	ctx        context.Context
+	buffer     *bufio.Writer
+	hash       hash.Hash
+	compressed *countingWriter
+
+	compressor  Compressor
+	compression string
+	sampled     int64
+	decided     bool
+	stored      bool
+
+	// progress, if set, is told the uncompressed bytes written so far after each write
+	progress func(int64)
+	written  int64
+}
 
-	tmpCompressedFileName, dockerSafeTmpCompressedFileName, _, err := compressImageFile(tmpDir, tmpFileName, dockerSafeTmpFileName)
+func newCompressedWriter(ctx context.Context, w io.Writer, bufferSize int, compressor Compressor, compression string) (*compressedWriter, error) {
+	// N.B. It's important that this match the signing tools' expectations, we reuse this hash
+	hashWriter := sha256.New()
+	compressed := &countingWriter{w: io.MultiWriter(w, hashWriter)}
+	buffer := bufio.NewWriterSize(compressed, bufferSize)
+
+	c := &compressedWriter{ctx: ctx, buffer: buffer, hash: hashWriter, compressed: compressed, compressor: compressorOf(compressor), compression: compression}
+	if err := c.start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// start begins compressing from scratch as the compression mode says; there's
+// nothing to decide for parts that aren't compressed at all
+func (c *compressedWriter) start() error {
+	var err error
+	c.WriteCloser, err = c.compressor.NewWriter(c.ctx, c.buffer, c.compression == CompressionNever)
+	c.sampled = 0
+	c.decided = c.compression != CompressionAuto || c.compressor.Encoding() == EncodingIdentity
+	c.stored = c.compression == CompressionNever && c.compressor.Encoding() != EncodingIdentity
+	return err
+}
+
+// Write compresses p, telling the progress function how much has been written
+func (c *compressedWriter) Write(p []byte) (int, error) {
+	n, err := c.write(p)
+	c.written += int64(n)
+	if c.progress != nil {
+		c.progress(c.written)
+	}
+	return n, err
+}
+
+// write compresses p, deciding whether to compress the rest once the sample is written
+func (c *compressedWriter) write(p []byte) (int, error) {
+	if c.decided {
+		return c.WriteCloser.Write(p)
+	}
+
+	remaining := compressionSampleSize - c.sampled
+	if int64(len(p)) < remaining {
+		n, err := c.WriteCloser.Write(p)
+		c.sampled += int64(n)
+		return n, err
+	}
+
+	n, err := c.WriteCloser.Write(p[:remaining])
+	c.sampled += int64(n)
 	if err != nil {
-		return nil, "", "", 0, err
+		return n, err
+	}
+
+	if err := c.decide(); err != nil {
+		return n, err
+	}
+
+	rest, err := c.WriteCloser.Write(p[remaining:])
+	return n + rest, err
+}
+
+// decide switches to storing content uncompressed if the sample barely
+// shrank. Compressors that can be flushed are, to learn how far it shrank;
+// the stream of others is ended and a new one started for the rest.
+func (c *compressedWriter) decide() error {
+	c.decided = true
+
+	flusher, flushes := c.WriteCloser.(interface{ Flush() error })
+	if flushes {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	} else if err := c.WriteCloser.Close(); err != nil {
+		return err
 	}
 
-	tmpCompressedFile, err := os.Open(tmpCompressedFileName)
+	compressed := c.compressed.n + int64(c.buffer.Buffered())
+	if float64(compressed) < float64(c.sampled)*(1-minCompressionSavings) {
+		if flushes {
+			return nil
+		}
+		var err error
+		c.WriteCloser, err = c.compressor.NewWriter(c.ctx, c.buffer, false)
+		return err
+	}
+
+	if flushes {
+		if err := c.WriteCloser.Close(); err != nil {
+			return err
+		}
+	}
+
+	stored, err := c.compressor.NewWriter(c.ctx, c.buffer, true)
 	if err != nil {
-		return nil, "", "", 0, err
+		return err
 	}
+	c.WriteCloser = stored
+	c.stored = true
+	return nil
+}
 
-	// N.B. It's important that this match the signing tools' expectations, we reuse this hash
-	hashWriter := sha256.New()
-	compressedBytes, err := io.Copy(hashWriter, tmpCompressedFile)
+// Close finishes compression and writes out what's buffered; the writer is left open
+func (c *compressedWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return c.buffer.Flush()
+}
+
+// compressedFile is a compressedWriter into a file. Like an *os.File, it can
+// be rewound and truncated, discarding everything written, so a failed export
+// streamed into it can be retried.
+type compressedFile struct {
+	*compressedWriter
+	file *os.File
+}
+
+func newCompressedFile(ctx context.Context, file *os.File, bufferSize int, compressor Compressor, compression string) (*compressedFile, error) {
+	w, err := newCompressedWriter(ctx, file, bufferSize, compressor, compression)
 	if err != nil {
-		return nil, "", "", 0, err
+		return nil, err
+	}
+	return &compressedFile{compressedWriter: w, file: file}, nil
+}
+
+// Seek rewinds the file to its start and restarts compression; other offsets aren't supported
+func (c *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, fmt.Errorf("Unable to seek in compressed file %v except to its start", c.file.Name())
+	}
+
+	// the abandoned stream is ended so compressors with workers or tools stop; what it wrote is discarded
+	c.WriteCloser.Close()
+
+	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
 	}
+	c.hash.Reset()
+	c.compressed.n = 0
+	c.written = 0
+	c.buffer.Reset(c.compressed)
+	return 0, c.start()
+}
+
+// Truncate empties the file; other sizes aren't supported
+func (c *compressedFile) Truncate(size int64) error {
+	if size != 0 {
+		return fmt.Errorf("Unable to truncate compressed file %v except to empty", c.file.Name())
+	}
+	return c.file.Truncate(0)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// preparedImage is an image made available for export by prepareImage
+type preparedImage struct {
+	image    string
+	platform string
+	imageID  string
+
+	// exporter is the Exporter the image is read by
+	exporter Exporter
 
-	tmpCompressedFile.Close()
+	// size is the image's uncompressed size, if known
+	size int64
+
+	// urlBase is the part URL base (or template) of the image if it overrides the Pkg's
+	urlBase string
+}
+
+// groupImages groups prepared images that have the same image ID, platform,
+// and part URL base and are read by a groupExporter, so they can be packaged
+// as one part. Other images and images whose ID isn't known aren't grouped.
+// Order is preserved.
+func groupImages(prepared []preparedImage) [][]preparedImage {
+	groups := [][]preparedImage{}
+	byID := map[string]int{}
+
+	for _, p := range prepared {
+		key := fmt.Sprintf("%s %s %s", p.imageID, p.platform, p.urlBase)
+		if _, grouped := p.exporter.(groupExporter); grouped && p.imageID != "" {
+			if i, exists := byID[key]; exists {
+				groups[i] = append(groups[i], p)
+				continue
+			}
+			byID[key] = len(groups)
+		}
+		groups = append(groups, []preparedImage{p})
+	}
+
+	return groups
+}
+
+// cacheKey returns the key of the part of the given images, which are all the
+// same image, in the part cache. The exported content records all the names,
+// so they're all part of the key.
+func cacheKey(images []preparedImage) string {
+	names := []string{}
+	for _, p := range images {
+		names = append(names, p.image)
+	}
+	return strings.Join(names, ",")
+}
+
+// partSettings describes how the part of an image readied by prepareImage is
+// built: its source, the archive format and compressor it's written with,
+// and the compression mode. A cached part is only reused by builds with the
+// same settings, since they determine its content.
+func partSettings(p preparedImage, compressor Compressor, compression string) string {
+	// parts of Docker daemon images were cached under this name before it was an Exporter
+	source := p.exporter.Backend()
+	if source == BackendDocker {
+		source = "docker-daemon"
+	}
+	return fmt.Sprintf("%s docker-archive %s compression-%s", source, compressorOf(compressor), compression)
+}
+
+// writePart exports and compresses the given images readied by prepareImage,
+// which are all the same image, as the compression mode says, or reuses
+// their part recorded in the journal of an earlier, unfinished build or in
+// the cache, telling progress, if set, the uncompressed bytes exported so
+// far. Returns sha256hash, filename, full path to written file, size,
+// whether compression was skipped for any of it, and err.
+// N.B. The hash is calculated on the *compressed* content.
+func writePart(ctx context.Context, policy ImagePolicy, cache *partCache, journal *partCache, tmpDir string, bufferSize int, compressor Compressor, compression string, progress func(int64), images []preparedImage) (hash.Hash, string, string, int64, bool, error) {
+
+	first := images[0]
+	key := cacheKey(images)
+	settings := partSettings(first, compressor, compression)
+
+	for _, c := range []*partCache{journal, cache} {
+		if hashWriter, fileName, permPath, compressedBytes, stored, reused, err := c.reuse(key, first.imageID, first.platform, settings, tmpDir); err != nil || reused {
+			return hashWriter, fileName, permPath, compressedBytes, stored, err
+		}
+	}
+
+	// the compressed content is hashed as it's written, so the file needn't be read back
+	tmpCompressedFileName, _, hashWriter, compressedBytes, stored, err := exportPreparedImage(ctx, policy, first.platform, first.exporter, tmpDir, bufferSize, compressor, compression, progress, imageNames(images))
+	if err != nil {
+		return nil, "", "", 0, false, err
+	}
 
 	hash := fmt.Sprintf("%x", hashWriter.Sum(nil))
 
-	fileName := fmt.Sprintf("%v%s", hash, filepath.Ext(dockerSafeTmpCompressedFileName))
+	fileName := fmt.Sprintf("%v%s", hash, compressorOf(compressor).Extension())
 	permPath := path.Join(tmpDir, fileName)
 
-	if err := os.Chmod(tmpCompressedFile.Name(), 0644); err != nil {
-		return nil, "", tmpCompressedFile.Name(), 0, err
+	if err := os.Chmod(tmpCompressedFileName, 0644); err != nil {
+		return nil, "", tmpCompressedFileName, 0, false, err
 	}
 
-	if err := os.Rename(tmpCompressedFile.Name(), permPath); err != nil {
-		return nil, "", tmpCompressedFile.Name(), 0, err
+	if err := os.Rename(tmpCompressedFileName, permPath); err != nil {
+		return nil, "", tmpCompressedFileName, 0, false, err
 	}
 
 	// N.B. The temporary files get removed when the tmpdir containing them does in the event of an error
 
-	return hashWriter, fileName, permPath, compressedBytes, err
+	journal.store(key, first.imageID, first.platform, settings, permPath, hash, compressedBytes, stored)
+	cache.store(key, first.imageID, first.platform, settings, permPath, hash, compressedBytes, stored)
+
+	return hashWriter, fileName, permPath, compressedBytes, stored, err
 }
 
-// the worker part of the concurrent image processing operations
-func exportDockerImage(reporter *cmdtools.SynchronizedReporter, group *sync.WaitGroup, client DockerClient, skipPullIfExists bool, authConfigurations *docker.AuthConfigurations, tmpDir string, pkgBuilder *horizonpkg.PkgBuilder, image string, urlBase string, privateKey *rsa.PrivateKey) {
+// the worker part of the concurrent image pulls; the prepared image is written to the given destination
+func pullDockerImage(ctx context.Context, reporter *cmdtools.SynchronizedReporter, group *sync.WaitGroup, phases *buildJournal, summary *BuildSummary, pulls workerPool, dest *preparedImage) {
 	defer group.Done()
+	log := reporter.Log.WithContext(ctx)
 
-	fmt.Fprintf(reporter.ErrWriter, "%s Beginning processing Docker image: %v\n", cmdtools.OutputInfoPrefix, image)
+	image := dest.image
+	log.Infof("Beginning processing Docker image: %v", image)
+	if dest.platform != "" {
+		log.Subsystem(cmdtools.SubsystemDocker).Infof("Using platform %v for Docker image: %v", dest.platform, image)
+	}
+	log.Subsystem(cmdtools.SubsystemDocker).Infof("Reading Docker image %v from: %v", image, dest.exporter)
+
+	started := time.Now()
+	defer func() {
+		summary.spanned(stagePull, started, time.Since(started))
+	}()
+	reporter.StageStarted(ctx, stagePull, image)
+
+	err := pulls.do(func() error {
+		pulling := time.Now()
+		var err error
+		dest.imageID, dest.size, err = prepareImage(ctx, dest.platform, dest.exporter, image)
+		summary.pulled(image, time.Since(pulling))
+		return err
+	})
+
+	// failures of cancelled operations aren't worth reporting
+	if err != nil && ctx.Err() == nil {
+		phases.record(phaseFailed, image, "", 0, err)
+		reporter.Fail(ctx, imageFailure(cmdtools.ErrPull, stagePull, image, "", fmt.Sprintf("Error writing docker image %v", image), err))
+	} else if err == nil {
+		phases.record(phasePulled, image, "", dest.size, nil)
+	}
+	reporter.StageFinished(ctx, stagePull, image, time.Since(started), err == nil)
+	log.Debugf("Stage '%v' of Docker image %v took %v", stagePull, image, time.Since(started).Round(time.Millisecond))
+}
 
-	hashWriter, fileName, _, compressedBytes, err := writeDockerImage(client, skipPullIfExists, authConfigurations, tmpDir, image)
-	if err != nil {
-		// TODO: differentiate b/n errors here: user can specify an image that isn't in the local repo and the client will fail
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error writing docker image %v. Error: %v\n", image, err))
-		return
+// exporterOf returns the Exporter the image is read by as the options say;
+// images read from the Docker daemon are read by the build's daemon Exporter
+func exporterOf(o Options, daemon Exporter, image string) Exporter {
+	if dir, exists := o.OCILayouts[image]; exists {
+		return NewOCILayoutExporter(dir)
+	} else if _, isDaemon := o.Exporter.(*dockerExporter); o.Exporter == nil || isDaemon {
+		return daemon
 	}
+	return o.Exporter
+}
 
-	fmt.Fprintf(reporter.ErrWriter, "%s Wrote Docker image %v as: %v\n", cmdtools.OutputInfoPrefix, image, fileName)
+// buildPkg builds a Pkg of the images as the options say (see Options and
+// Builder.Build), returning the paths of its output directory, metadata file,
+// and signature file. If it fails, the failures are reported to reporter with
+// Fail and empty paths are returned; once the context is done, Docker
+// operations in flight are cancelled, no new ones are started, and empty
+// paths are returned.
+func buildPkg(ctx context.Context, reporter *cmdtools.SynchronizedReporter, o Options, images []string) *Result {
+	log := reporter.Log.WithContext(ctx)
+
+	// parts streamed to their destination never touch the disk
+	streamer, streaming := o.PartDestination.(PartStreamer)
+
+	client := newMirroringClient(newRetryingClient(newThrottledClient(newProgressClient(newTracingClient(newContextClient(dockerClientOf(o.Client), ctx, o.PullTimeout, o.ExportTimeout), ctx, reporter), ctx, reporter, cmdtools.ProgressInterval), ctx, o.DaemonCalls, o.DaemonCallInterval), ctx, o.RetryPolicy, reporter), ctx, o.Mirrors, o.AuthResolver, reporter)
+	fromDaemon := newDockerExporter(client, o.Manifests, o.SkipPullIfExists, o.AuthResolver, o.Policy)
+	var daemon Exporter = fromDaemon
+	if _, exportsGroups := o.Client.(imagesExporter); exportsGroups {
+		daemon = groupingDockerExporter{fromDaemon}
+	}
 
-	// TODO: upload the part here and verify with a HEAD request to it?
-	// for now, just construct a URL for the part and write that in the pkg
-	// upload the part with the appropriate path stuff (note: requires the pkg name so we can put it in the pkg subdir)
+	for _, image := range images {
+		if err := o.Policy.CheckRegistry(image); err != nil {
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrPolicy, Image: image, Err: err})
+			return nil
+		}
+
+		if o.Client == nil && exporterOf(o, daemon, image) == daemon {
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrUsage, Image: image, Msg: fmt.Sprintf("Image %v is read from the Docker daemon, but no Docker client was given", image)})
+			return nil
+		}
+	}
 
-	// N.B. The signature is on the *uncompressed* content
-	signature, err := sign.Sha256HashOfInput(privateKey, hashWriter)
+	// failures reported before the build started aren't its own
+	failed := reporter.DelegateErrorCount()
+
+	pK, err := parsePrivateKey(o.PrivateKey)
 	if err != nil {
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error hashing docker image %v. Error: %v\n", image, err))
-		return
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrSigning, Msg: "Error reading RSA PSS private key", Err: err})
+		return nil
 	}
+	log.Subsystem(cmdtools.SubsystemSign).Debugf("Using %v-bit RSA private key for RSA-PSS signatures", pK.N.BitLen())
 
-	fmt.Fprintf(reporter.ErrWriter, "%s Signed hash for image: %v\n", cmdtools.OutputInfoPrefix, image)
+	pkgBuilder, err := horizonpkg.NewDockerImagePkgBuilder(horizonpkg.FILE, o.Author, images)
+	if err != nil {
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error setting up Pkg builder", Err: err})
+		return nil
+	}
 
-	signatures := []string{signature}
+	pkgName := o.PkgName
+	if pkgName == "" {
+		pkgName = pkgBuilder.ID()
+	}
 
-	// note: this assumes no funny business was done in writeDockerImage
-	source := horizonpkg.PartSource{URL: fmt.Sprintf("%s/%s/%s", strings.TrimRight(urlBase, "/"), pkgBuilder.ID(), fileName)}
+	tmpBaseDir := o.TmpDir
+	if tmpBaseDir == "" {
+		tmpBaseDir = o.OutputDir
+	}
 
-	// we use the shasum as the name for the part
-	sha256sum := fmt.Sprintf("%x", hashWriter.Sum(nil))
-	_, err = pkgBuilder.AddPart(sha256sum, sha256sum, image, signatures, compressedBytes, source)
-	if err != nil {
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error adding Pkg part %v. Error: %v\n", sha256sum, err))
-		return
+	// it's moved into place once the Pkg is built, so it's left behind only by a failed build
+	built := false
+	var tmpDir string
+	if !streaming {
+		tmpDir, err = ioutil.TempDir(tmpBaseDir, fmt.Sprintf("build-hznpkg-%s-", pkgName))
+		if err != nil {
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error setting up Pkg builder", Err: err})
+			return nil
+		}
+
+		defer func() {
+			if !built && o.KeepTmpOnError && ctx.Err() == nil {
+				log.Warnf("Build failed, keeping temporary directory for inspection: %v", tmpDir)
+				return
+			}
+			os.RemoveAll(tmpDir)
+		}()
+
+		log.Infof("Created temporary directory for packaging: %v", tmpDir)
 	}
 
-	fmt.Fprintf(reporter.ErrWriter, "%s Part added to pkg %v for image: %v\n", cmdtools.OutputInfoPrefix, pkgBuilder.ID(), image)
-}
+	var cache *partCache
+	if o.CacheDir != "" {
+		cache = newPartCache(ctx, o.CacheDir, reporter, o.IOBufferSize)
+	}
 
-// NewPkg is an exported function that fulfills the primary use case of this
-// module: create a new package and output all relevant material for upload /
-// service to a Horizon edge node.
-func NewPkg(reporter *cmdtools.SynchronizedReporter, client DockerClient, skipPullIfExists bool, authConfigurations *docker.AuthConfigurations, baseOutputDir string, author string, privateKey string, urlBase string, images []string) (string, string, string) {
+	// the journal outlives a failed build so a rerun can pick up where it stopped
+	var journal *partCache
+	if o.Resume {
+		journalDir := resumeJournalDir(tmpBaseDir, images)
+		if err := os.MkdirAll(journalDir, 0755); err != nil {
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error setting up build journal", Err: err})
+			return nil
+		}
 
-	pK, err := sign.ReadPrivateKey(privateKey)
-	if err != nil {
-		reporter.DelegateErr(true, true, fmt.Sprintf("Error reading RSA PSS private key. Error: %v\n", err))
-		return "", "", ""
+		journal = newPartCache(ctx, journalDir, reporter, o.IOBufferSize)
+		log.Infof("Recording finished parts for resuming the build in: %v", journalDir)
 	}
 
-	pkgBuilder, err := horizonpkg.NewDockerImagePkgBuilder(horizonpkg.FILE, author, images)
-	if err != nil {
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error setting up Pkg builder. Error: %v\n", err))
-		return "", "", ""
+	// a record of how far the build gets, kept if it fails and consulted by a resumed build; there's none without an output directory
+	var phases *buildJournal
+	var previous []journalEntry
+	if o.OutputDir != "" {
+		phases, previous, err = openBuildJournal(buildJournalFile(o.OutputDir, images), o.Resume)
+		if err != nil {
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error setting up build journal", Err: err})
+			return nil
+		}
 	}
+	defer func() {
+		if !built && ctx.Err() != nil {
+			phases.record(phaseFailed, "", "", 0, ctx.Err())
+		} else if !built {
+			phases.record(phaseFailed, "", "", 0, fmt.Errorf("Pkg not created"))
+		}
+		phases.close(built)
+	}()
 
-	tmpDir, err := ioutil.TempDir(baseOutputDir, fmt.Sprintf("build-hznpkg-%s-", pkgBuilder.ID()))
-	if err != nil {
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error setting up Pkg builder. Error: %v\n", err))
-		return "", "", ""
+	if resumed := summarizeJournal(previous); resumed != "" {
+		log.Infof("Resuming the last build of these images; the %v", resumed)
+	}
+	if phases != nil {
+		log.Infof("Journaling build progress in: %v", phases.file.Name())
 	}
-	defer os.RemoveAll(tmpDir)
 
-	fmt.Fprintf(reporter.ErrWriter, "%s Created temporary directory for packaging: %v\n", cmdtools.OutputInfoPrefix, tmpDir)
+	// pulls are bound by the network and exports by the disk, so they're limited separately
+	pulls := newWorkerPool(o.PullParallelism)
+	exports := newWorkerPool(o.ExportParallelism)
+
+	// bounds the images processed at once, whichever the operation, so many images don't swamp the host and the Docker daemon
+	workers := newWorkerPool(o.MaxParallel)
 
 	var waitGroup sync.WaitGroup
+	annotations := newPartAnnotations()
 
-	// concurrently process each part
-	for _, image := range images {
+	// when pulls are bounded, the largest images the daemon already has start first so they don't hold up the build at its end
+	localSizes := map[string]int64{}
+	if o.Client != nil && (o.MaxParallel > 0 || o.PullParallelism > 0) {
+		if localSizes, err = localImageSizes(client); err != nil {
+			log.Subsystem(cmdtools.SubsystemDocker).Warnf("Unable to list local Docker images, pulling images in the order given. Error: %v", err)
+		}
+	}
+	pullOrder := largestFirst(len(images), func(i int) int64 { return sizeOf(localSizes, images[i]) })
+
+	// concurrently pull each image first; images that turn out to be the same are exported once
+	prepared := make([]preparedImage, len(images))
+	for _, i := range pullOrder {
+		image := images[i]
+		prepared[i] = preparedImage{image: image, platform: o.Platforms[image], exporter: exporterOf(o, daemon, image), urlBase: o.URLBases[image]}
+
+		dest := &prepared[i]
 		waitGroup.Add(1)
-		go func(image string) {
-			exportDockerImage(reporter, &waitGroup, client, skipPullIfExists, authConfigurations, tmpDir, pkgBuilder, image, urlBase, pK)
-		}(image)
+		workers.start(func() {
+			pullDockerImage(ctx, reporter, &waitGroup, phases, o.Summary, pulls, dest)
+		})
 	}
 
 	waitGroup.Wait()
-	if reporter.DelegateErrorCount > 0 {
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Warnf("Timed out, discontinuing operations and removing temporary files")
+		return nil
+	} else if ctx.Err() != nil {
+		log.Warnf("Interrupted, discontinuing operations and removing temporary files")
+		return nil
+	} else if reporter.DelegateErrorCount() > failed {
+		// error reporting is done elsewhere, we just need to manage the control flow
+		log.Errorf("All images not pulled successfully, discontinuing operations")
+		return nil
+	}
+
+	groups := groupImages(prepared)
+
+	// fail now rather than run out of space halfway through a long build
+	if o.CheckSpace && !streaming {
+		uncounted, err := checkDiskSpace(cache, tmpDir, o.OutputDir, o.Compressor, o.Compression, groups)
+		if err != nil {
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrUsage, Err: err})
+			return nil
+		}
+		if uncounted > 0 {
+			log.Warnf("Sizes of %v Docker images aren't known; disk space for their parts wasn't checked", uncounted)
+		}
+	}
+
+	// build the parts in a pipeline (see pipeline.go), the largest first in case exports are bounded
+	queued := make(chan *partBuild, len(groups))
+	for _, i := range largestFirst(len(groups), func(i int) int64 { return groups[i][0].size }) {
+		queued <- &partBuild{images: groups[i]}
+	}
+	close(queued)
+
+	signs := newWorkerPool(o.SignParallelism)
+	places := newWorkerPool(o.PlaceParallelism)
+	written := stageQueue(signs)
+	signed := stageQueue(places)
+
+	go runStage(workers, queued, written, timedStage(ctx, reporter, o.Summary, stageWrite, func(part *partBuild) bool {
+		return writeStage(ctx, reporter, eventHandler(o.Events), o.Policy, cache, journal, phases, o.Summary, exports, streamer, pkgName, tmpDir, o.IOBufferSize, o.Compressor, o.Compression, part)
+	}))
+	go runStage(signs, written, signed, timedStage(ctx, reporter, o.Summary, stageSign, func(part *partBuild) bool {
+		return signStage(ctx, reporter, phases, pK, part)
+	}))
+	runStage(places, signed, nil, timedStage(ctx, reporter, o.Summary, stagePlace, func(part *partBuild) bool {
+		return placeStage(ctx, reporter, eventHandler(o.Events), phases, o.Summary, pkgBuilder, pkgName, annotations, o.URLBase, o.PartDestination, o.PartHandoff, part)
+	}))
+
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Warnf("Timed out, discontinuing operations and removing temporary files")
+		return nil
+	} else if ctx.Err() != nil {
+		log.Warnf("Interrupted, discontinuing operations and removing temporary files")
+		return nil
+	} else if reporter.DelegateErrorCount() > failed {
 		// error reporting is done elsewhere, we just need to manage the control flow
-		fmt.Fprintf(reporter.ErrWriter, "%s All parts not processed successfully, discontinuing operations\n", cmdtools.OutputErrorPrefix)
-		return "", "", ""
+		log.Errorf("All parts not processed successfully, discontinuing operations")
+		return nil
 	}
 
 	_, serialized, err := pkgBuilder.Build()
 	if err != nil {
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error building package. Error: %v\n", err))
-		return "", "", ""
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error building package", Err: err})
+		return nil
 	}
 
-	pkgFile := path.Join(baseOutputDir, fmt.Sprintf("%s.json", pkgBuilder.ID()))
-	err = ioutil.WriteFile(pkgFile, serialized, 0644)
+	serialized, err = annotations.apply(serialized)
 	if err != nil {
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error writing Pkg metadata to disk. Error: %v\n", err))
-		return "", "", ""
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error adding resolved digests to Pkg metadata", Err: err})
+		return nil
+	}
+
+	serialized, err = o.Info.apply(serialized)
+	if err != nil {
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error adding description, version, and labels to Pkg metadata", Err: err})
+		return nil
+	}
+
+	// parts are added as they finish, so put them in order for the same Pkg to be serialized the same way every time
+	serialized, err = canonicalPkg(serialized)
+	if err != nil {
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error serializing Pkg metadata", Err: err})
+		return nil
+	}
+
+	pkgID, err := pkgIDOf(serialized)
+	if err != nil {
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error reading ID of Pkg metadata", Err: err})
+		return nil
 	}
-	fmt.Fprintf(reporter.ErrWriter, "%s Wrote pkg metadata file to: %v\n", cmdtools.OutputInfoPrefix, pkgFile)
 
 	// and sign the pkg file content
-	pkgSig, err := sign.Input(privateKey, serialized)
+	pkgSig, err := signInput(pK, serialized)
 	if err != nil {
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error signing Pkg metadata. Error: %v\n", err))
-		return "", "", ""
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrSigning, Msg: "Error signing Pkg metadata", Err: err})
+		return nil
+	}
+	log.Subsystem(cmdtools.SubsystemSign).Debugf("Signed pkg metadata of Pkg %v", pkgID)
+
+	result := &Result{PkgID: pkgID, PkgName: pkgName, Pkg: serialized, PkgSignature: []byte(pkgSig)}
+	if o.OutputDir == "" {
+		// success, with nothing written to disk
+		built = true
+		return result
+	}
+
+	// another build may have written output of the same name meanwhile
+	if err := CheckPkgOutput(o.OutputDir, pkgName); err != nil && !o.Force {
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrUsage, Msg: "Not overwriting existing Pkg output", Err: err})
+		return nil
+	} else if err != nil {
+		log.Warnf("Replacing existing Pkg output: %v", err)
+	}
+
+	pkgFile := path.Join(o.OutputDir, fmt.Sprintf("%s.json", pkgName))
+	if err := writeFileAtomic(pkgFile, serialized); err != nil {
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error writing Pkg metadata to disk", Err: err})
+		return nil
 	}
+	log.Infof("Wrote pkg metadata file to: %v", pkgFile)
 
 	pkgSigFile := fmt.Sprintf("%s.sig", pkgFile)
-	err = ioutil.WriteFile(pkgSigFile, []byte(pkgSig), 0644)
+	if err := writeFileAtomic(pkgSigFile, []byte(pkgSig)); err != nil {
+		// metadata without its signature would only be rejected later
+		os.Remove(pkgFile)
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error writing Pkg metadata signature to disk", Err: err})
+		return nil
+	}
+
+	log.Subsystem(cmdtools.SubsystemSign).Infof("Signed pkg metadata file and wrote signature to file: %v", pkgSigFile)
+	result.PkgFile, result.PkgSigFile = pkgFile, pkgSigFile
 
-	fmt.Fprintf(reporter.ErrWriter, "%s Signed pkg metadata file and wrote signature to file: %v\n", cmdtools.OutputInfoPrefix, pkgSigFile)
+	if streaming {
+		// success; the parts are at their destination
+		built = true
+		return result
+	}
 
 	// all succeeded, change perms then move tmp dir
 	if err := os.Chmod(tmpDir, 0755); err != nil {
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error changing perms on tmpdir. Error: %v\n", err))
-		return "", "", ""
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error changing perms on tmpdir", Err: err})
+		return nil
 	}
 
-	permDir := path.Join(baseOutputDir, string(os.PathSeparator), pkgBuilder.ID())
-	if err := os.Rename(tmpDir, permDir); err != nil {
-		reporter.DelegateErr(false, true, fmt.Sprintf("Error moving Pkg content to permanent dir from tmpdir. Error: %v\n", err))
-		return "", "", ""
+	permDir := path.Join(o.OutputDir, string(os.PathSeparator), pkgName)
+	if o.Force {
+		if err := os.RemoveAll(permDir); err != nil {
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: fmt.Sprintf("Error removing existing Pkg dir %v", permDir), Err: err})
+			return nil
+		}
+	}
+
+	log.Debugf("Moving temporary directory %v to: %v", tmpDir, permDir)
+	if err := moveDir(tmpDir, permDir, o.IOBufferSize); err != nil {
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Msg: "Error moving Pkg content to permanent dir from tmpdir", Err: err})
+		return nil
+	}
+
+	if journal != nil {
+		os.RemoveAll(journal.dir)
 	}
 
 	// success
-	return permDir, pkgFile, pkgSigFile
+	built = true
+	result.PkgDir = permDir
+	return result
+}
+
+// moveDir renames the directory src to dest or, if they're on different
+// filesystems, copies its files through a buffer of bufferSize bytes to a
+// temporary directory beside dest, syncs them to disk and verifies their
+// hashes against the originals, then renames it to dest and removes src
+func moveDir(src string, dest string, bufferSize int) error {
+	err := os.Rename(src, dest)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	staging, err := ioutil.TempDir(path.Dir(dest), fmt.Sprintf(".%s-", path.Base(dest)))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		if err := copyFile(path.Join(src, f.Name()), path.Join(staging, f.Name()), bufferSize); err != nil {
+			return err
+		}
+	}
+
+	// src is about to be removed, so make sure the copies are intact and durable first
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		srcSum, err := fileSHA256(path.Join(src, f.Name()))
+		if err != nil {
+			return err
+		}
+
+		copySum, err := fileSHA256(path.Join(staging, f.Name()))
+		if err != nil {
+			return err
+		}
+
+		if srcSum != copySum {
+			return fmt.Errorf("Copy of %v in %v is corrupt: its SHA-256 hash is %v, expected %v", f.Name(), staging, copySum, srcSum)
+		}
+	}
+
+	if err := syncDir(staging); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(staging, 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(staging, dest); err != nil {
+		return err
+	}
+
+	if err := syncDir(path.Dir(dest)); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+// syncDir flushes the given directory's entries to disk so files renamed into it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
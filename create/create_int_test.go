@@ -3,12 +3,34 @@
 package create
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/dockerauth"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const bogusImageContent = "fffff"
@@ -31,6 +53,17 @@ func (c *MockDockerClient) ExportImage(opts docker.ExportImageOptions) error {
 	return args.Error(0)
 }
 
+func (c *MockDockerClient) ExportImages(opts docker.ExportImagesOptions) error {
+	args := c.Called(opts)
+
+	_, err := io.WriteString(opts.OutputStream, bogusImageContent)
+	if err != nil {
+		return err
+	}
+
+	return args.Error(0)
+}
+
 func (c *MockDockerClient) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
 	args := c.Called(opts)
 	return args.Get(0).([]docker.APIImages), args.Error(1)
@@ -41,6 +74,92 @@ func (c *MockDockerClient) PullImage(opts docker.PullImageOptions, auth docker.A
 	return args.Error(0)
 }
 
+func (c *MockDockerClient) InspectImage(name string) (*docker.Image, error) {
+	args := c.Called(name)
+	return args.Get(0).(*docker.Image), args.Error(1)
+}
+
+func (c *MockDockerClient) TagImage(name string, opts docker.TagImageOptions) error {
+	args := c.Called(name, opts)
+	return args.Error(0)
+}
+
+type MockManifestResolver struct {
+	mock.Mock
+}
+
+func (r *MockManifestResolver) PlatformDigest(image string, platform string) (string, error) {
+	args := r.Called(image, platform)
+	return args.String(0), args.Error(1)
+}
+
+// staticImageSource is an ImageSource of a fixed set of images, implementing only what ImageSource requires
+type staticImageSource []docker.Image
+
+func (s staticImageSource) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	listed := []docker.APIImages{}
+	for _, image := range s {
+		listed = append(listed, docker.APIImages{ID: image.ID, RepoTags: image.RepoTags, Size: image.Size})
+	}
+	return listed, nil
+}
+
+func (s staticImageSource) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	return errors.New("pulls not supported")
+}
+
+func (s staticImageSource) InspectImage(name string) (*docker.Image, error) {
+	for _, image := range s {
+		if strings.HasPrefix(image.ID, name) || strings.HasPrefix(image.ID, "sha256:"+name) {
+			return &image, nil
+		}
+	}
+	return nil, docker.ErrNoSuchImage
+}
+
+func (s staticImageSource) ExportImage(opts docker.ExportImageOptions) error {
+	return errors.New("exports not supported")
+}
+
+// memoryStreamer is a PartStreamer keeping parts in memory, or refusing them if full
+type memoryStreamer struct {
+	lock  sync.Mutex
+	parts map[string][]byte
+	full  bool
+}
+
+func (m *memoryStreamer) URL(name string) string {
+	return "mem://" + name
+}
+
+func (m *memoryStreamer) StreamPart(ctx context.Context, part *PartStream) error {
+	if m.full {
+		return errors.New("no room")
+	}
+
+	content, err := ioutil.ReadAll(part.Content)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.parts[part.Name()] = content
+	return nil
+}
+
+// exportImageToFile prepares and exports an image from the Docker daemon as
+// a build does, gzip-compressed, returning the file's path and Docker-safe name
+func exportImageToFile(client DockerClient, manifests ManifestResolver, skipPullIfExists bool, authResolver *dockerauth.Resolver, policy ImagePolicy, platform string, tmpDir string, image string) (string, string, error) {
+	exporter := newDockerExporter(client, manifests, skipPullIfExists, authResolver, policy)
+	if _, _, err := prepareImage(context.Background(), platform, exporter, image); err != nil {
+		return "", "", err
+	}
+
+	fileName, dockerSafeFileName, _, _, _, err := exportPreparedImage(context.Background(), policy, platform, exporter, tmpDir, DefaultIOBufferSize, gzipCompressor{}, CompressionAlways, nil, []string{image})
+	return fileName, dockerSafeFileName, err
+}
+
 func setup() (string, error) {
 	dir, err := ioutil.TempDir("", "create-newPkg-")
 	if err != nil {
@@ -63,10 +182,11 @@ func Test_Create_NewPkg_Suite(suite *testing.T) {
 
 		// we don't care what gets passed to most of these, just that the auth config is empty
 		m.On("PullImage", mock.AnythingOfType("docker.PullImageOptions"), docker.AuthConfiguration{}).Return(nil)
+		m.On("InspectImage", mock.Anything).Return(&docker.Image{ID: "sha256:2b8f"}, nil)
 		m.On("ExportImage", mock.AnythingOfType("docker.ExportImageOptions")).Return(nil)
 
 		// these creds don't match
-		_, _, err := exportImageToFile(m, true, &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{"someid": docker.AuthConfiguration{Username: "foo", ServerAddress: "somenonmatchingdomain.com"}}}, tmpDir, "domain.com/someimage:0.1.0")
+		_, _, err := exportImageToFile(m, nil, true, dockerauth.NewResolver(nil, nil, &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{"someid": docker.AuthConfiguration{Username: "foo", ServerAddress: "somenonmatchingdomain.com"}}}), ImagePolicy{}, "", tmpDir, "domain.com/someimage:0.1.0")
 		assert.Nil(t, err)
 
 		m.AssertExpectations(t)
@@ -78,10 +198,24 @@ func Test_Create_NewPkg_Suite(suite *testing.T) {
 
 		// we don't care what gets passed to most of these, just that the auth config matches
 		m.On("PullImage", mock.AnythingOfType("docker.PullImageOptions"), docker.AuthConfiguration{Username: "timmy", ServerAddress: "xy.io"}).Return(nil)
+		m.On("InspectImage", mock.Anything).Return(&docker.Image{ID: "sha256:2b8f"}, nil)
 		m.On("ExportImage", mock.AnythingOfType("docker.ExportImageOptions")).Return(nil)
 
 		// these creds don't match
-		_, _, err := exportImageToFile(m, true, &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{"someid": docker.AuthConfiguration{Username: "timmy", ServerAddress: "xy.io"}}}, tmpDir, "xy.io/someimage:0.1.0")
+		_, _, err := exportImageToFile(m, nil, true, dockerauth.NewResolver(nil, nil, &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{"someid": docker.AuthConfiguration{Username: "timmy", ServerAddress: "xy.io"}}}), ImagePolicy{}, "", tmpDir, "xy.io/someimage:0.1.0")
+		assert.Nil(t, err)
+
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("exportImageToFile pulls from registries with ports with the implicit latest tag", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("ListImages", docker.ListImagesOptions{All: true, Filter: "xy.io:5000/ns/someimage:latest"}).Return([]docker.APIImages{}, nil)
+		m.On("PullImage", docker.PullImageOptions{Repository: "xy.io:5000/ns/someimage", Tag: "latest"}, docker.AuthConfiguration{Username: "timmy", ServerAddress: "xy.io:5000"}).Return(nil)
+		m.On("InspectImage", mock.Anything).Return(&docker.Image{ID: "sha256:2b8f"}, nil)
+		m.On("ExportImage", mock.AnythingOfType("docker.ExportImageOptions")).Return(nil)
+
+		_, _, err := exportImageToFile(m, nil, true, dockerauth.NewResolver(nil, nil, &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{"someid": docker.AuthConfiguration{Username: "timmy", ServerAddress: "xy.io:5000"}}}), ImagePolicy{}, "", tmpDir, "xy.io:5000/ns/someimage")
 		assert.Nil(t, err)
 
 		m.AssertExpectations(t)
@@ -90,9 +224,10 @@ func Test_Create_NewPkg_Suite(suite *testing.T) {
 	suite.Run("exportImageToFile skips pull if image exists and we use default skip arg", func(t *testing.T) {
 		m := new(MockDockerClient)
 		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{docker.APIImages{RepoTags: []string{"xy.io/someimage:0.1.0"}}}, nil)
+		m.On("InspectImage", mock.Anything).Return(&docker.Image{ID: "sha256:2b8f"}, nil)
 		m.On("ExportImage", mock.AnythingOfType("docker.ExportImageOptions")).Return(nil)
 
-		_, _, err := exportImageToFile(m, true, &docker.AuthConfigurations{}, tmpDir, "xy.io/someimage:0.1.0")
+		_, _, err := exportImageToFile(m, nil, true, dockerauth.NewResolver(nil, nil, &docker.AuthConfigurations{}), ImagePolicy{}, "", tmpDir, "xy.io/someimage:0.1.0")
 		assert.Nil(t, err)
 
 		// want to make sure the pull didn't occur
@@ -104,32 +239,1535 @@ func Test_Create_NewPkg_Suite(suite *testing.T) {
 		m := new(MockDockerClient)
 		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{docker.APIImages{RepoTags: []string{"xy.io/someimage:0.1.0"}}}, nil)
 		m.On("PullImage", mock.AnythingOfType("docker.PullImageOptions"), mock.AnythingOfType("docker.AuthConfiguration")).Return(nil)
+		m.On("InspectImage", mock.Anything).Return(&docker.Image{ID: "sha256:2b8f"}, nil)
 		m.On("ExportImage", mock.AnythingOfType("docker.ExportImageOptions")).Return(nil)
 
 		// the "false" is important here
-		_, _, err := exportImageToFile(m, false, &docker.AuthConfigurations{}, tmpDir, "xy.io/someimage:0.1.0")
+		_, _, err := exportImageToFile(m, nil, false, dockerauth.NewResolver(nil, nil, &docker.AuthConfigurations{}), ImagePolicy{}, "", tmpDir, "xy.io/someimage:0.1.0")
 		assert.Nil(t, err)
 
 		m.AssertExpectations(t)
 	})
 
-	suite.Run("exportImageToFile", func(t *testing.T) {
-		imageList := []docker.APIImages{docker.APIImages{ID: "1", RepoTags: []string{"foo.goo/someimage:0.2.0"}}}
+	suite.Run("exportImageToFile pulls platform variant by digest and exports it by digest without retagging it", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{}, nil)
+		m.On("PullImage", docker.PullImageOptions{Repository: "xy.io/someimage", Tag: "sha256:abc"}, docker.AuthConfiguration{}).Return(nil)
+		m.On("InspectImage", "xy.io/someimage@sha256:abc").Return(&docker.Image{ID: "sha256:2b8f", OS: "linux", Architecture: "arm64"}, nil)
+		m.On("ExportImage", mock.MatchedBy(func(opts docker.ExportImageOptions) bool { return opts.Name == "xy.io/someimage@sha256:abc" })).Return(nil)
+
+		r := new(MockManifestResolver)
+		r.On("PlatformDigest", "xy.io/someimage:0.1.0", "linux/arm64").Return("sha256:abc", nil)
+
+		_, _, err := exportImageToFile(m, r, true, nil, ImagePolicy{}, "linux/arm64", tmpDir, "xy.io/someimage:0.1.0")
+		assert.Nil(t, err)
 
+		m.AssertExpectations(t)
+		m.AssertNotCalled(t, "TagImage", mock.Anything, mock.Anything)
+		r.AssertExpectations(t)
+	})
+
+	suite.Run("exportImageToFile pulls if local image is for another platform", func(t *testing.T) {
 		m := new(MockDockerClient)
-		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return(imageList, nil)
-		// unfortunately, we can't check the options b/c of the changing file handle
+		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{docker.APIImages{RepoTags: []string{"xy.io/someimage:0.1.0"}}}, nil)
+		m.On("InspectImage", "xy.io/someimage:0.1.0").Return(&docker.Image{OS: "linux", Architecture: "amd64"}, nil).Once()
+		m.On("PullImage", mock.AnythingOfType("docker.PullImageOptions"), docker.AuthConfiguration{}).Return(nil)
+		m.On("InspectImage", "xy.io/someimage@sha256:abc").Return(&docker.Image{OS: "linux", Architecture: "amd64"}, nil).Once()
+
+		r := new(MockManifestResolver)
+		r.On("PlatformDigest", "xy.io/someimage:0.1.0", "linux/arm64").Return("sha256:abc", nil)
+
+		// the registry gave us a single-platform manifest for the wrong architecture
+		_, _, err := exportImageToFile(m, r, true, nil, ImagePolicy{}, "linux/arm64", tmpDir, "xy.io/someimage:0.1.0")
+		assert.NotNil(t, err)
+
+		m.AssertExpectations(t)
+		m.AssertNotCalled(t, "ExportImage", mock.AnythingOfType("docker.ExportImageOptions"))
+	})
+
+	suite.Run("localImageMatchesPlatform matches variants by the digest the image was pulled by", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("InspectImage", "xy.io/someimage:0.1.0").Return(&docker.Image{OS: "linux", Architecture: "arm", RepoDigests: []string{"xy.io/someimage@sha256:abc"}}, nil)
+
+		r := new(MockManifestResolver)
+		r.On("PlatformDigest", "xy.io/someimage@sha256:abc", "linux/arm/v7").Return("sha256:abc", nil)
+		r.On("PlatformDigest", "xy.io/someimage@sha256:abc", "linux/arm/v6").Return("sha256:def", nil)
+
+		matches, err := localImageMatchesPlatform(m, r, "xy.io/someimage:0.1.0", "linux/arm")
+		assert.Nil(t, err)
+		assert.True(t, matches)
+
+		matches, err = localImageMatchesPlatform(m, r, "xy.io/someimage:0.1.0", "linux/arm/v7")
+		assert.Nil(t, err)
+		assert.True(t, matches)
+
+		matches, err = localImageMatchesPlatform(m, r, "xy.io/someimage:0.1.0", "linux/arm/v6")
+		assert.Nil(t, err)
+		assert.False(t, matches)
+
+		// without a registry to ask, a variant can't be told apart
+		matches, err = localImageMatchesPlatform(m, nil, "xy.io/someimage:0.1.0", "linux/arm/v7")
+		assert.Nil(t, err)
+		assert.False(t, matches)
+	})
+
+	suite.Run("retagExport records tags in the export's manifest and repositories file", func(t *testing.T) {
+		archive := func(files map[string]string) *bytes.Buffer {
+			var buf bytes.Buffer
+			w := tar.NewWriter(&buf)
+			for _, name := range []string{"2b8f.json", "l1/layer.tar", "manifest.json", "repositories"} {
+				if content, ok := files[name]; ok {
+					assert.Nil(t, w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+					_, err := w.Write([]byte(content))
+					assert.Nil(t, err)
+				}
+			}
+			assert.Nil(t, w.Close())
+			return &buf
+		}
+		read := func(r io.Reader) map[string]string {
+			files := map[string]string{}
+			in := tar.NewReader(r)
+			for {
+				header, err := in.Next()
+				if err == io.EOF {
+					return files
+				}
+				assert.Nil(t, err)
+				content, err := ioutil.ReadAll(in)
+				assert.Nil(t, err)
+				files[header.Name] = string(content)
+			}
+		}
+
+		tags := map[string][]string{"sha256:2b8f": []string{"xy.io/someimage:0.1.0"}}
+		export := func(files map[string]string) func(io.Writer) error {
+			return func(w io.Writer) error {
+				_, err := io.Copy(w, archive(files))
+				return err
+			}
+		}
+
+		// an image exported by digest is saved without tags
+		var out bytes.Buffer
+		assert.Nil(t, retagExport(&out, tags, export(map[string]string{
+			"2b8f.json":     "{}",
+			"l1/layer.tar":  "layer",
+			"manifest.json": `[{"Config":"2b8f.json","RepoTags":null,"Layers":["l1/layer.tar"]}]`,
+		})))
+		files := read(&out)
+		assert.Equal(t, "layer", files["l1/layer.tar"])
+		assert.JSONEq(t, `[{"Config":"2b8f.json","RepoTags":["xy.io/someimage:0.1.0"],"Layers":["l1/layer.tar"]}]`, files["manifest.json"])
+		assert.JSONEq(t, `{"xy.io/someimage":{"0.1.0":"l1"}}`, files["repositories"])
+
+		// existing tags and repositories are kept
+		out.Reset()
+		assert.Nil(t, retagExport(&out, tags, export(map[string]string{
+			"2b8f.json":     "{}",
+			"manifest.json": `[{"Config":"2b8f.json","RepoTags":["other:1"],"Layers":["l1/layer.tar"]}]`,
+			"repositories":  `{"other":{"1":"l1"}}`,
+		})))
+		files = read(&out)
+		assert.JSONEq(t, `[{"Config":"2b8f.json","RepoTags":["other:1","xy.io/someimage:0.1.0"],"Layers":["l1/layer.tar"]}]`, files["manifest.json"])
+		assert.JSONEq(t, `{"other":{"1":"l1"},"xy.io/someimage":{"0.1.0":"l1"}}`, files["repositories"])
+
+		// export failures are returned, and exports aren't left blocked by a failure to read them
+		assert.EqualError(t, retagExport(&out, tags, func(w io.Writer) error { return errors.New("export failed") }), "export failed")
+		assert.NotNil(t, retagExport(&out, tags, func(w io.Writer) error {
+			_, err := io.WriteString(w, strings.Repeat("not an archive", 1024))
+			return err
+		}))
+	})
+
+	suite.Run("exportImageToFile pulls and exports digest-pinned images by digest", func(t *testing.T) {
+		image := "xy.io/someimage@sha256:0b5f03a8a7c2ccd6e2d2d1ab8a2c1a8a4b0a36b6f3e9cbb3d5f4bd1a0dcf6a2d"
+
+		m := new(MockDockerClient)
+		m.On("ListImages", docker.ListImagesOptions{All: true, Filter: "xy.io/someimage"}).Return([]docker.APIImages{docker.APIImages{RepoTags: []string{"xy.io/someimage:0.1.0"}}}, nil)
+		m.On("PullImage", docker.PullImageOptions{Repository: "xy.io/someimage", Tag: "sha256:0b5f03a8a7c2ccd6e2d2d1ab8a2c1a8a4b0a36b6f3e9cbb3d5f4bd1a0dcf6a2d"}, docker.AuthConfiguration{}).Return(nil)
+		m.On("InspectImage", mock.Anything).Return(&docker.Image{ID: "sha256:2b8f"}, nil)
+		m.On("ExportImage", mock.MatchedBy(func(opts docker.ExportImageOptions) bool { return opts.Name == image })).Return(nil)
+
+		_, _, err := exportImageToFile(m, nil, true, nil, ImagePolicy{}, "", tmpDir, image)
+		assert.Nil(t, err)
+
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("exportImageToFile skips pull if digest-pinned image exists", func(t *testing.T) {
+		image := "xy.io/someimage@sha256:0b5f03a8a7c2ccd6e2d2d1ab8a2c1a8a4b0a36b6f3e9cbb3d5f4bd1a0dcf6a2d"
+
+		m := new(MockDockerClient)
+		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{docker.APIImages{RepoDigests: []string{image}}}, nil)
+		m.On("InspectImage", mock.Anything).Return(&docker.Image{ID: "sha256:2b8f"}, nil)
 		m.On("ExportImage", mock.AnythingOfType("docker.ExportImageOptions")).Return(nil)
 
-		fName, _, err := exportImageToFile(m, true, &docker.AuthConfigurations{}, tmpDir, imageList[0].RepoTags[0])
+		_, _, err := exportImageToFile(m, nil, true, nil, ImagePolicy{}, "", tmpDir, image)
 		assert.Nil(t, err)
-		assert.NotNil(t, fName)
 
-		b, err := ioutil.ReadFile(fName)
+		m.AssertNotCalled(t, "PullImage", mock.AnythingOfType("docker.PullImageOptions"), mock.AnythingOfType("docker.AuthConfiguration"))
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("exportImageToFile exports local image IDs without pulling", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("InspectImage", "sha256:2b8fd9751c4c").Return(&docker.Image{ID: "sha256:2b8fd9751c4c0f5dd266fcae00707e67a2545ef34f9a29354585f93dac906749"}, nil)
+		m.On("ExportImage", mock.MatchedBy(func(opts docker.ExportImageOptions) bool { return opts.Name == "sha256:2b8fd9751c4c" })).Return(nil)
+
+		_, _, err := exportImageToFile(m, nil, false, nil, ImagePolicy{}, "", tmpDir, "sha256:2b8fd9751c4c")
 		assert.Nil(t, err)
 
-		assert.Equal(t, bogusImageContent, string(b))
+		m.AssertNotCalled(t, "PullImage", mock.AnythingOfType("docker.PullImageOptions"), mock.AnythingOfType("docker.AuthConfiguration"))
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("ResolveImageIDs replaces IDs with full IDs", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("InspectImage", "2b8fd9751c4c").Return(&docker.Image{ID: "sha256:2b8fd9751c4c0f5dd266fcae00707e67a2545ef34f9a29354585f93dac906749", RepoTags: []string{"xy.io/someimage:0.1.0"}}, nil)
+		m.On("InspectImage", "3c9ae8640d5d").Return(&docker.Image{ID: "sha256:3c9ae8640d5d0f5dd266fcae00707e67a2545ef34f9a29354585f93dac906749", RepoTags: []string{"<none>:<none>"}}, nil)
+		m.On("InspectImage", "4dab00000000").Return(&docker.Image{}, docker.ErrNoSuchImage)
+
+		resolved, err := ResolveImageIDs(m, []string{"xy.io/someimage:0.1.0", "2b8fd9751c4c"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"xy.io/someimage:0.1.0", "sha256:2b8fd9751c4c0f5dd266fcae00707e67a2545ef34f9a29354585f93dac906749"}, resolved)
+
+		// dangling images must be allowed explicitly
+		_, err = ResolveImageIDs(m, []string{"3c9ae8640d5d"}, false)
+		assert.IsType(t, ImageError{}, err)
+
+		resolved, err = ResolveImageIDs(m, []string{"3c9ae8640d5d"}, true)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"sha256:3c9ae8640d5d0f5dd266fcae00707e67a2545ef34f9a29354585f93dac906749"}, resolved)
+
+		_, err = ResolveImageIDs(m, []string{"4dab00000000"}, true)
+		assert.IsType(t, ImageError{}, err)
+
+		assert.False(t, IsImageID("someimage:0.1.0"))
+		assert.False(t, IsImageID("2b8fd97"))
+	})
+
+	suite.Run("exportImageToFile reports missing images and denied pulls as ImageErrors", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{}, nil)
+		m.On("PullImage", docker.PullImageOptions{Repository: "xy.io/someimage", Tag: "missing"}, docker.AuthConfiguration{}).Return(&docker.Error{Status: 404, Message: "manifest for xy.io/someimage:missing not found"})
+		m.On("PullImage", docker.PullImageOptions{Repository: "xy.io/private", Tag: "0.1.0"}, docker.AuthConfiguration{}).Return(errors.New("unauthorized: authentication required"))
+		m.On("PullImage", docker.PullImageOptions{Repository: "xy.io/someimage", Tag: "0.1.0"}, docker.AuthConfiguration{}).Return(errors.New("connection reset by peer"))
+
+		_, _, err := exportImageToFile(m, nil, true, nil, ImagePolicy{}, "", tmpDir, "xy.io/someimage:missing")
+		assert.IsType(t, ImageError{}, err)
+		assert.Contains(t, err.Error(), "was not found locally and its registry has no such tag or digest")
+		assert.True(t, errors.Is(err, cmdtools.ErrImageNotFound))
+		assert.True(t, cmdtools.IsUserError(err))
 
+		_, _, err = exportImageToFile(m, nil, true, nil, ImagePolicy{}, "", tmpDir, "xy.io/private:0.1.0")
+		assert.IsType(t, ImageError{}, err)
+		assert.Contains(t, err.Error(), "denied access")
+		assert.True(t, errors.Is(err, cmdtools.ErrAuthFailed))
+		assert.Equal(t, cmdtools.ExitPull, cmdtools.ExitCodeOf(err))
+
+		// failures unrelated to the image aren't the user's
+		_, _, err = exportImageToFile(m, nil, true, nil, ImagePolicy{}, "", tmpDir, "xy.io/someimage:0.1.0")
+		assert.False(t, cmdtools.IsUserError(err))
+		m.AssertNotCalled(t, "ExportImage", mock.AnythingOfType("docker.ExportImageOptions"))
+	})
+
+	suite.Run("resolveDigest prefers the repository digest over the image ID", func(t *testing.T) {
+		digest := resolveDigest("xy.io/someimage:latest", &docker.Image{ID: "sha256:2b8f", RepoDigests: []string{"other.io/someimage@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "xy.io/someimage@sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}})
+		assert.Equal(t, "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", digest)
+
+		digest = resolveDigest("xy.io/localimage:latest", &docker.Image{ID: "sha256:2b8f"})
+		assert.Equal(t, "sha256:2b8f", digest)
+
+		assert.True(t, IsFloatingReference("xy.io/someimage:latest"))
+		assert.False(t, IsFloatingReference("xy.io/someimage@sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"))
+		assert.False(t, IsFloatingReference("sha256:2b8fd9751c4c"))
+	})
+
+	suite.Run("partAnnotations adds fields to matching parts", func(t *testing.T) {
+		annotations := newPartAnnotations()
+
+		unchanged, err := annotations.apply([]byte(`{"parts":{}}`))
+		assert.Nil(t, err)
+		assert.Equal(t, `{"parts":{}}`, string(unchanged))
+
+		annotations.set("abc", "resolvedDigest", "sha256:bbbb")
+		annotated, err := annotations.apply([]byte(`{"id":"pkg","parts":[{"id":"abc","bytes":9007199254740993},{"id":"def"}]}`))
+		assert.Nil(t, err)
+		assert.Equal(t, `{"id":"pkg","parts":[{"bytes":9007199254740993,"id":"abc","resolvedDigest":"sha256:bbbb"},{"id":"def"}]}`, string(annotated))
+
+		_, err = annotations.apply([]byte(`{"parts":[{"id":"def"}]}`))
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("PkgInfo adds the description, version, and labels to the Pkg", func(t *testing.T) {
+		unchanged, err := PkgInfo{}.apply([]byte(`{"parts":{}}`))
+		assert.Nil(t, err)
+		assert.Equal(t, `{"parts":{}}`, string(unchanged))
+
+		labels, err := ParseLabels([]string{"tier=edge", "example.com/team=gt", "empty="})
+		assert.Nil(t, err)
+		info := PkgInfo{Description: "GT stack", Version: "1.4.2", Labels: labels}
+		added, err := info.apply([]byte(`{"id":"pkg","parts":[{"id":"abc","bytes":9007199254740993}]}`))
+		assert.Nil(t, err)
+		assert.Equal(t, `{"description":"GT stack","id":"pkg","labels":{"empty":"","example.com/team":"gt","tier":"edge"},"parts":[{"bytes":9007199254740993,"id":"abc"}],"pkgVersion":"1.4.2"}`, string(added))
+
+		_, err = info.apply([]byte(`{"id":"pkg","labels":{},"parts":[]}`))
+		assert.NotNil(t, err)
+
+		for _, specs := range [][]string{{"tier"}, {"=edge"}, {"tier/=edge"}, {"tier=a", "tier=b"}} {
+			_, err := ParseLabels(specs)
+			assert.NotNil(t, err, "%v", specs)
+		}
+
+		assert.Nil(t, CheckPkgVersion("1.4.2"))
+		assert.Nil(t, CheckPkgVersion("2.0.0-rc.1+build.5"))
+		assert.NotNil(t, CheckPkgVersion("v1.4.2"))
+		assert.NotNil(t, CheckPkgVersion("1.4"))
+		assert.NotNil(t, CheckPkgVersion("1.04.2"))
+	})
+
+	suite.Run("canonicalPkg serializes the same Pkg identically whatever its part order", func(t *testing.T) {
+		first, err := canonicalPkg([]byte(`{"parts": [{"id": "def", "sources": [{"url": "https://x.io/a?b=1&c=2"}]}, {"id": "abc", "bytes": 9007199254740993}], "id": "pkg"}`))
+		assert.Nil(t, err)
+		second, err := canonicalPkg([]byte(`{"id":"pkg","parts":[{"bytes":9007199254740993,"id":"abc"},{"sources":[{"url":"https://x.io/a?b=1&c=2"}],"id":"def"}]}`))
+		assert.Nil(t, err)
+
+		assert.Equal(t, `{"id":"pkg","parts":[{"bytes":9007199254740993,"id":"abc"},{"id":"def","sources":[{"url":"https://x.io/a?b=1&c=2"}]}]}`, string(first))
+		assert.Equal(t, string(first), string(second))
+	})
+
+	suite.Run("partURL joins the URL base or expands templates", func(t *testing.T) {
+		fields := partURLFields{pkgid: "5aecb701", pkgname: "5aecb701", hash: "e26e31a0", filename: "e26e31a0.tgz", image: imageRepository("registry.example.com/team/app:1.0"), arch: "arm64"}
+
+		assert.Equal(t, "https://cdn.example.com/hzn/5aecb701/e26e31a0.tgz", partURL("https://cdn.example.com/hzn/", fields))
+		assert.Equal(t, "https://cdn.example.com/5aecb701/arm64/e26e31a0.tgz", partURL("https://cdn.example.com/{pkgid}/{arch}/{hash}.tgz", fields))
+		assert.Equal(t, "https://cdn.example.com/registry.example.com/team/app/e26e31a0.tgz", partURL("https://cdn.example.com/{image}/{filename}", fields))
+
+		named := fields
+		named.pkgname = "gt-stack-1.4.2"
+		assert.Equal(t, "https://cdn.example.com/hzn/gt-stack-1.4.2/e26e31a0.tgz", partURL("https://cdn.example.com/hzn", named))
+		assert.Equal(t, "https://cdn.example.com/gt-stack-1.4.2/5aecb701/e26e31a0.tgz", partURL("https://cdn.example.com/{pkgname}/{pkgid}/{filename}", named))
+		assert.Nil(t, CheckPkgName("gt-stack-1.4.2"))
+		assert.NotNil(t, CheckPkgName("../gt-stack"))
+		assert.NotNil(t, CheckPkgName(".hidden"))
+		assert.NotNil(t, CheckPkgName("gt stack"))
+
+		dir, err := ioutil.TempDir("", "pkg-output-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+		assert.Nil(t, CheckPkgOutput(dir, "gt-stack-1.4.2"))
+		assert.Nil(t, ioutil.WriteFile(path.Join(dir, "gt-stack-1.4.2.json.sig"), []byte("signature"), 0644))
+		assert.NotNil(t, CheckPkgOutput(dir, "gt-stack-1.4.2"))
+
+		assert.Equal(t, "alpine", imageRepository("docker.io/library/alpine:3.7"))
+		assert.Equal(t, "sha256:2b8fd9751c4c", imageRepository("sha256:2b8fd9751c4c"))
+
+		assert.False(t, IsPartURLTemplate("https://cdn.example.com/hzn"))
+		assert.Nil(t, CheckPartURLTemplate("https://cdn.example.com/{pkgid}/{arch}/{hash}.tgz"))
+		assert.NotNil(t, CheckPartURLTemplate("https://cdn.example.com/{version}/{hash}.tgz"))
+		assert.NotNil(t, CheckPartURLTemplate("https://cdn.example.com/{pkgid/{hash}.tgz"))
+
+		m := new(MockDockerClient)
+		m.On("InspectImage", "xy.io/someimage:0.1.0").Return(&docker.Image{OS: "linux", Architecture: "amd64"}, nil)
+
+		e := newDockerExporter(m, nil, true, nil, ImagePolicy{})
+		e.images[dockerImageKey("xy.io/someimage:0.1.0", "")] = dockerImage{exportName: "xy.io/someimage:0.1.0"}
+
+		arch, err := imageArchitecture(context.Background(), preparedImage{image: "xy.io/someimage:0.1.0", exporter: e})
+		assert.Nil(t, err)
+		assert.Equal(t, "amd64", arch)
+
+		arch, err = imageArchitecture(context.Background(), preparedImage{image: "xy.io/someimage:0.1.0", platform: "linux/arm/v7", exporter: e})
+		assert.Nil(t, err)
+		assert.Equal(t, "arm", arch)
+		m.AssertNumberOfCalls(t, "InspectImage", 1)
+	})
+
+	suite.Run("mirroringClient pulls Docker Hub images through mirrors and falls back to Docker Hub", func(t *testing.T) {
+		reporter := cmdtools.NewSynchronizedReporter(512)
+		resolver := dockerauth.NewResolver(nil, nil, &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{"m": docker.AuthConfiguration{Username: "mirroruser", ServerAddress: "mirror2.io"}}})
+
+		m := new(MockDockerClient)
+		m.On("PullImage", docker.PullImageOptions{Repository: "mirror1.io/library/alpine", Tag: "3.6"}, docker.AuthConfiguration{}).Return(errors.New("connection refused"))
+		m.On("PullImage", docker.PullImageOptions{Repository: "mirror2.io/library/alpine", Tag: "3.6"}, docker.AuthConfiguration{Username: "mirroruser", ServerAddress: "mirror2.io"}).Return(nil)
+		m.On("TagImage", "mirror2.io/library/alpine:3.6", docker.TagImageOptions{Repo: "alpine", Tag: "3.6", Force: true}).Return(nil)
+
+		// digest pulls are exported by the mirror's name
+		m.On("PullImage", docker.PullImageOptions{Repository: "mirror1.io/library/alpine", Tag: "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"}, docker.AuthConfiguration{}).Return(nil)
+		m.On("ExportImage", docker.ExportImageOptions{Name: "mirror1.io/library/alpine@sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"}).Return(nil)
+		m.On("InspectImage", "mirror1.io/library/alpine@sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc").Return(&docker.Image{RepoDigests: []string{"mirror1.io/library/alpine@sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"}}, nil)
+
+		// other registries aren't mirrored; neither are Docker Hub images the mirrors lack
+		m.On("PullImage", docker.PullImageOptions{Repository: "xy.io/someimage", Tag: "0.1.0"}, docker.AuthConfiguration{}).Return(nil)
+		m.On("PullImage", docker.PullImageOptions{Repository: "mirror1.io/someuser/someimage", Tag: "0.1.0"}, docker.AuthConfiguration{}).Return(errors.New("not found"))
+		m.On("PullImage", docker.PullImageOptions{Repository: "mirror2.io/someuser/someimage", Tag: "0.1.0"}, docker.AuthConfiguration{Username: "mirroruser", ServerAddress: "mirror2.io"}).Return(errors.New("not found"))
+		m.On("PullImage", docker.PullImageOptions{Repository: "someuser/someimage", Tag: "0.1.0"}, docker.AuthConfiguration{Username: "hub"}).Return(nil)
+
+		c := newMirroringClient(m, context.Background(), []string{"mirror1.io", "mirror2.io"}, resolver, reporter)
+
+		assert.Nil(t, c.PullImage(docker.PullImageOptions{Repository: "alpine", Tag: "3.6"}, docker.AuthConfiguration{}))
+
+		assert.Nil(t, c.PullImage(docker.PullImageOptions{Repository: "alpine", Tag: "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"}, docker.AuthConfiguration{}))
+		assert.Nil(t, c.ExportImage(docker.ExportImageOptions{Name: "alpine@sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"}))
+		inspected, err := c.InspectImage("alpine@sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc")
+		assert.Nil(t, err)
+		assert.Contains(t, inspected.RepoDigests, "alpine@sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc")
+
+		assert.Nil(t, c.PullImage(docker.PullImageOptions{Repository: "xy.io/someimage", Tag: "0.1.0"}, docker.AuthConfiguration{}))
+		assert.Nil(t, c.PullImage(docker.PullImageOptions{Repository: "someuser/someimage", Tag: "0.1.0"}, docker.AuthConfiguration{Username: "hub"}))
+
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("ImagePolicy refuses oversized images before export and images from other registries", func(t *testing.T) {
+		policy := ImagePolicy{MaxSize: 1024, AllowedRegistries: []string{"xy.io", "docker.io"}}
+
+		m := new(MockDockerClient)
+		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{docker.APIImages{RepoTags: []string{"xy.io/someimage:0.1.0"}}}, nil)
+		m.On("InspectImage", "xy.io/someimage:0.1.0").Return(&docker.Image{Size: 2048}, nil)
+
+		_, _, err := exportImageToFile(m, nil, true, nil, policy, "", tmpDir, "xy.io/someimage:0.1.0")
+		assert.IsType(t, PolicyError{}, err)
+		m.AssertNotCalled(t, "ExportImage", mock.AnythingOfType("docker.ExportImageOptions"))
+
+		assert.Nil(t, policy.CheckRegistry("xy.io/someimage:0.1.0"))
+		assert.Nil(t, policy.CheckRegistry("alpine"))
+		assert.IsType(t, PolicyError{}, policy.CheckRegistry("xy.io:5000/someimage:0.1.0"))
+		assert.IsType(t, PolicyError{}, policy.CheckRegistry("sha256:2b8fd9751c4c"))
+		assert.Nil(t, ImagePolicy{}.CheckRegistry("sha256:2b8fd9751c4c"))
+	})
+
+	suite.Run("ImagePolicy requiring credentials refuses anonymous pulls but not local images", func(t *testing.T) {
+		policy := ImagePolicy{RequireCredentials: true}
+
+		m := new(MockDockerClient)
+		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{docker.APIImages{RepoTags: []string{"xy.io/someimage:0.1.0"}}}, nil)
+
+		_, _, err := fetchImage(m, nil, false, nil, policy, "", "xy.io/otherimage:0.1.0")
+		assert.IsType(t, PolicyError{}, err)
+		assert.Contains(t, err.Error(), "no credentials are configured for registry xy.io")
+		m.AssertNotCalled(t, "PullImage", mock.Anything, mock.Anything)
+
+		exportName, tag, err := fetchImage(m, nil, true, nil, policy, "", "xy.io/someimage:0.1.0")
+		assert.Nil(t, err)
+		assert.Equal(t, "xy.io/someimage:0.1.0", exportName)
+		assert.Equal(t, "", tag)
+	})
+
+	suite.Run("writePart reuses cached parts of unchanged images", func(t *testing.T) {
+		reporter := cmdtools.NewSynchronizedReporter(512)
+
+		cacheDir, err := ioutil.TempDir(tmpDir, "cache")
+		assert.Nil(t, err)
+
+		image := "foo.goo/someimage:0.2.0"
+		m := new(MockDockerClient)
+		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{docker.APIImages{RepoTags: []string{image}}}, nil)
+		m.On("InspectImage", image).Return(&docker.Image{ID: "sha256:2b8f"}, nil).Once()
+		m.On("InspectImage", image).Return(&docker.Image{ID: "sha256:2b8f"}, nil).Once()
+		m.On("InspectImage", image).Return(&docker.Image{ID: "sha256:3c9a"}, nil).Once()
+		m.On("ExportImage", mock.AnythingOfType("docker.ExportImageOptions")).Return(nil)
+
+		write := func() (string, string) {
+			buildDir, err := ioutil.TempDir(tmpDir, "build")
+			assert.Nil(t, err)
+
+			e := newDockerExporter(m, nil, true, nil, ImagePolicy{})
+			imageID, _, err := prepareImage(context.Background(), "", e, image)
+			assert.Nil(t, err)
+
+			prepared := []preparedImage{preparedImage{image: image, imageID: imageID, exporter: e}}
+			hashWriter, fileName, _, _, _, err := writePart(context.Background(), ImagePolicy{}, newPartCache(context.Background(), cacheDir, reporter, DefaultIOBufferSize), nil, buildDir, DefaultIOBufferSize, gzipCompressor{}, CompressionAuto, nil, prepared)
+			assert.Nil(t, err)
+			return fmt.Sprintf("%x", hashWriter.Sum(nil)), fileName
+		}
+
+		hash, fileName := write()
+		assert.Equal(t, hash+".tgz", fileName)
+		m.AssertNumberOfCalls(t, "ExportImage", 1)
+
+		reusedHash, reusedFileName := write()
+		assert.Equal(t, hash, reusedHash)
+		assert.Equal(t, fileName, reusedFileName)
+		m.AssertNumberOfCalls(t, "ExportImage", 1)
+
+		// a changed image ID means a new export
+		write()
+		m.AssertNumberOfCalls(t, "ExportImage", 2)
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("writePart resumes from the parts recorded in the journal of an unfinished build", func(t *testing.T) {
+		reporter := cmdtools.NewSynchronizedReporter(512)
+
+		image := "foo.goo/someimage:0.2.0"
+		journalDir := resumeJournalDir(tmpDir, []string{image})
+		assert.Equal(t, journalDir, resumeJournalDir(tmpDir, []string{image}))
+		assert.NotEqual(t, journalDir, resumeJournalDir(tmpDir, []string{image, "foo.goo/otherimage:0.1.0"}))
+		assert.True(t, strings.HasPrefix(path.Base(journalDir), "build-hznpkg-resume-"))
+		assert.Nil(t, os.MkdirAll(journalDir, 0755))
+
+		m := new(MockDockerClient)
+		m.On("ExportImage", mock.AnythingOfType("docker.ExportImageOptions")).Return(nil)
+
+		e := newDockerExporter(m, nil, true, nil, ImagePolicy{})
+		e.images[dockerImageKey(image, "")] = dockerImage{exportName: image, imageID: "sha256:2b8f"}
+
+		prepared := []preparedImage{preparedImage{image: image, imageID: "sha256:2b8f", exporter: e}}
+		write := func() string {
+			buildDir, err := ioutil.TempDir(tmpDir, "build")
+			assert.Nil(t, err)
+			defer os.RemoveAll(buildDir)
+
+			hashWriter, _, _, _, _, err := writePart(context.Background(), ImagePolicy{}, nil, newPartCache(context.Background(), journalDir, reporter, DefaultIOBufferSize), buildDir, DefaultIOBufferSize, gzipCompressor{}, CompressionAuto, nil, prepared)
+			assert.Nil(t, err)
+			return fmt.Sprintf("%x", hashWriter.Sum(nil))
+		}
+
+		// the build directory is gone, but the journal kept the part
+		hash := write()
+		m.AssertNumberOfCalls(t, "ExportImage", 1)
+
+		assert.Equal(t, hash, write())
+		m.AssertNumberOfCalls(t, "ExportImage", 1)
+	})
+
+	suite.Run("checkDiskSpace fails if parts wouldn't fit and counts cached parts by their size", func(t *testing.T) {
+		available, err := availableSpace(tmpDir)
+		assert.Nil(t, err)
+
+		groups := [][]preparedImage{
+			[]preparedImage{preparedImage{image: "xy.io/someimage:0.1.0", imageID: "sha256:2b8f", size: 1 << 20, exporter: newDockerExporter(nil, nil, true, nil, ImagePolicy{})}},
+			[]preparedImage{preparedImage{image: "xy.io/layoutimage:0.1.0", exporter: NewOCILayoutExporter("/some/layout")}},
+		}
+
+		uncounted, err := checkDiskSpace(nil, tmpDir, tmpDir, gzipCompressor{}, CompressionAuto, groups)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, uncounted)
+
+		groups[0][0].size = available + 1
+		_, err = checkDiskSpace(nil, tmpDir, tmpDir, gzipCompressor{}, CompressionAuto, groups)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "Insufficient disk space")
+
+		// a reusable cached part takes only its own size
+		cacheDir, err := ioutil.TempDir(tmpDir, "cache")
+		assert.Nil(t, err)
+		cache := newPartCache(context.Background(), cacheDir, cmdtools.NewSynchronizedReporter(512), DefaultIOBufferSize)
+		cache.parts["xy.io/someimage:0.1.0"] = cachedPart{ImageID: "sha256:2b8f", Settings: partSettings(groups[0][0], gzipCompressor{}, CompressionAuto), Hash: "abc", Bytes: 5}
+		assert.Nil(t, ioutil.WriteFile(cache.partPath(cache.parts["xy.io/someimage:0.1.0"]), []byte("fffff"), 0644))
+
+		// parts built with other settings aren't reused
+		cached, exists := cache.cachedBytes("xy.io/someimage:0.1.0", "sha256:2b8f", "", partSettings(groups[0][0], gzipCompressor{}, CompressionAuto))
+		assert.True(t, exists)
+		assert.Equal(t, int64(5), cached)
+		_, exists = cache.cachedBytes("xy.io/someimage:0.1.0", "sha256:2b8f", "", "docker-daemon docker-archive gzip-1")
+		assert.False(t, exists)
+
+		_, err = checkDiskSpace(cache, tmpDir, tmpDir, gzipCompressor{}, CompressionAuto, groups)
+		assert.Nil(t, err)
+	})
+
+	suite.Run("moveDir renames directories or copies them across filesystems", func(t *testing.T) {
+		for _, base := range []string{tmpDir, "/dev/shm"} {
+			if _, err := os.Stat(base); err != nil {
+				continue
+			}
+
+			src, err := ioutil.TempDir(base, "move-src")
+			assert.Nil(t, err)
+			defer os.RemoveAll(src)
+			assert.Nil(t, ioutil.WriteFile(path.Join(src, "part.tgz"), []byte("fffff"), 0644))
+
+			dest := path.Join(tmpDir, path.Base(src)+"-moved")
+			assert.Nil(t, moveDir(src, dest, DefaultIOBufferSize))
+
+			content, err := ioutil.ReadFile(path.Join(dest, "part.tgz"))
+			assert.Nil(t, err)
+			assert.Equal(t, "fffff", string(content))
+
+			_, err = os.Stat(src)
+			assert.True(t, os.IsNotExist(err))
+
+			// the staging directory of a copy is gone once it's renamed into place
+			staged, err := filepath.Glob(path.Join(tmpDir, "."+path.Base(dest)+"-*"))
+			assert.Nil(t, err)
+			assert.Equal(t, 0, len(staged))
+		}
+	})
+
+	suite.Run("groupImages groups daemon images with the same ID and platform and exports them together", func(t *testing.T) {
+		m := new(MockDockerClient)
+		d := newDockerExporter(m, nil, true, nil, ImagePolicy{})
+		for _, image := range []string{"xy.io/someimage:latest", "xy.io/someimage:0.1.0"} {
+			d.images[dockerImageKey(image, "")] = dockerImage{exportName: image, imageID: "sha256:2b8f"}
+		}
+		e := groupingDockerExporter{d}
+
+		prepared := []preparedImage{
+			preparedImage{image: "xy.io/someimage:latest", imageID: "sha256:2b8f", exporter: e},
+			preparedImage{image: "xy.io/otherimage:0.1.0", imageID: "sha256:3c9a", exporter: e},
+			preparedImage{image: "xy.io/someimage:0.1.0", imageID: "sha256:2b8f", exporter: e},
+			preparedImage{image: "xy.io/someimage:arm", imageID: "sha256:2b8f", platform: "linux/arm64", exporter: e},
+			preparedImage{image: "xy.io/layoutimage:0.1.0", exporter: NewOCILayoutExporter("/some/layout"), imageID: "sha256:2b8f"},
+			preparedImage{image: "xy.io/someimage:restricted", imageID: "sha256:2b8f", urlBase: "https://restricted.example.com/pkgs", exporter: e},
+		}
+
+		groups := groupImages(prepared)
+		assert.Equal(t, 5, len(groups))
+		assert.Equal(t, []preparedImage{prepared[0], prepared[2]}, groups[0])
+		assert.Equal(t, []preparedImage{prepared[1]}, groups[1])
+
+		m.On("ExportImages", mock.MatchedBy(func(opts docker.ExportImagesOptions) bool {
+			return strings.Join(opts.Names, ",") == "xy.io/someimage:latest,xy.io/someimage:0.1.0"
+		})).Return(nil).Once()
+
+		_, fileName, _, _, _, err := writePart(context.Background(), ImagePolicy{}, nil, nil, tmpDir, DefaultIOBufferSize, gzipCompressor{}, CompressionAuto, nil, groups[0])
+		assert.Nil(t, err)
+		assert.NotEqual(t, "", fileName)
 		m.AssertExpectations(t)
 	})
+
+	suite.Run("dockerExporter resolves tags as it pulls them rather than when asked", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("InspectImage", "xy.io/someimage:latest").Return(&docker.Image{ID: "sha256:2b8f", RepoDigests: []string{"xy.io/someimage@sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}}, nil)
+		m.On("InspectImage", "sha256:2b8fd9751c4c").Return(&docker.Image{ID: "sha256:2b8fd9751c4c"}, nil)
+		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return([]docker.APIImages{docker.APIImages{RepoTags: []string{"xy.io/someimage:latest"}}}, nil)
+		e := newDockerExporter(m, nil, true, nil, ImagePolicy{})
+
+		_, err := e.Prepare(context.Background(), "xy.io/someimage:latest", "")
+		assert.Nil(t, err)
+
+		// the tag may be moved after the pull, so the daemon isn't asked again
+		calls := len(m.Calls)
+		digest, err := e.Digest("xy.io/someimage:latest", "")
+		assert.Nil(t, err)
+		assert.Equal(t, "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", digest)
+		assert.Equal(t, calls, len(m.Calls))
+
+		_, err = e.Prepare(context.Background(), "sha256:2b8fd9751c4c", "")
+		assert.Nil(t, err)
+		digest, err = e.Digest("sha256:2b8fd9751c4c", "")
+		assert.Nil(t, err)
+		assert.Equal(t, "", digest)
+
+		_, err = e.Digest("xy.io/otherimage:latest", "")
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("placeStage records the digest each tag of a part resolved to", func(t *testing.T) {
+		e := newDockerExporter(nil, nil, true, nil, ImagePolicy{})
+		e.images[dockerImageKey("xy.io/someimage:latest", "")] = dockerImage{imageID: "sha256:2b8f", digest: "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}
+		e.images[dockerImageKey("xy.io/otherimage:0.1.0", "")] = dockerImage{imageID: "sha256:2b8f", digest: "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"}
+		e.images[dockerImageKey("xy.io/someimage@sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "")] = dockerImage{imageID: "sha256:2b8f"}
+		e.images[dockerImageKey("xy.io/single:1.0", "")] = dockerImage{imageID: "sha256:3c9a", digest: "sha256:3c9a"}
+
+		images := []string{"xy.io/someimage:latest", "xy.io/otherimage:0.1.0", "xy.io/someimage@sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "xy.io/single:1.0"}
+		pkgBuilder, err := horizonpkg.NewDockerImagePkgBuilder(horizonpkg.FILE, "author", images)
+		assert.Nil(t, err)
+
+		reporter := cmdtools.NewSynchronizedReporterTo(512, ioutil.Discard, ioutil.Discard)
+		annotations := newPartAnnotations()
+		grouped := &partBuild{images: []preparedImage{{image: images[0], exporter: e}, {image: images[1], exporter: e}, {image: images[2], exporter: e}}, sha256sum: "abc", fileName: "abc.tar.gz"}
+		assert.True(t, placeStage(context.Background(), reporter, nil, nil, nil, pkgBuilder, "pkg", annotations, "https://example.com", nil, nil, grouped))
+
+		single := &partBuild{images: []preparedImage{{image: images[3], exporter: e}}, sha256sum: "def", fileName: "def.tar.gz"}
+		assert.True(t, placeStage(context.Background(), reporter, nil, nil, nil, pkgBuilder, "pkg", annotations, "https://example.com", nil, nil, single))
+
+		assert.Equal(t, map[string]string{
+			"xy.io/someimage:latest": "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+			"xy.io/otherimage:0.1.0": "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+		}, annotations.fields["abc"]["resolvedDigests"])
+		assert.Nil(t, annotations.fields["abc"]["resolvedDigest"])
+		assert.Equal(t, "xy.io/single:1.0", annotations.fields["def"]["requestedReference"])
+		assert.Equal(t, "sha256:3c9a", annotations.fields["def"]["resolvedDigest"])
+
+		// a name that can't be resolved fails the part, whichever of its names it is
+		failing := &partBuild{images: []preparedImage{{image: "xy.io/single:1.0", exporter: e}, {image: "xy.io/gone:1.0", exporter: e}}, sha256sum: "ghi", fileName: "ghi.tar.gz"}
+		assert.False(t, placeStage(context.Background(), reporter, nil, nil, nil, pkgBuilder, "pkg", annotations, "https://example.com", nil, nil, failing))
+	})
+
+	suite.Run("MatchingImages lists local images matching glob patterns", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("ListImages", docker.ListImagesOptions{}).Return([]docker.APIImages{
+			docker.APIImages{ID: "sha256:2b8f", RepoTags: []string{"summit.hovitos.engineering/x86/cpu:1.4.1", "summit.hovitos.engineering/x86/cpu:latest"}},
+			docker.APIImages{ID: "sha256:3c9a", RepoTags: []string{"summit.hovitos.engineering/x86/gps:1.4.0", "summit.hovitos.engineering/x86/sub/gps:1.4.0"}},
+			docker.APIImages{ID: "sha256:4d0b", RepoTags: []string{"summit.hovitos.engineering/x86/cpu:1.3.9", "<none>:<none>"}},
+		}, nil)
+
+		matched, err := MatchingImages(m, []string{"summit.hovitos.engineering/x86/*:1.4.*", "*:latest"})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"summit.hovitos.engineering/x86/cpu:1.4.1", "summit.hovitos.engineering/x86/gps:1.4.0"}, matched)
+
+		assert.NotNil(t, CheckImageFilter("x86/[cpu"))
+		assert.Nil(t, CheckImageFilter("x86/cpu:1.4.?"))
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("Functions reading images take any ImageSource", func(t *testing.T) {
+		source := staticImageSource{
+			{ID: "sha256:2b8fd9751c4c0f5dd266fcae00707e67a2545ef34f9a29354585f93dac906749", RepoTags: []string{"x86/cpu:1.4.1"}, Size: 3000},
+			{ID: "sha256:3c9ae0b5c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8", RepoTags: []string{"<none>:<none>"}},
+		}
+
+		matched, err := MatchingImages(source, []string{"x86/*"})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"x86/cpu:1.4.1"}, matched)
+
+		resolved, err := ResolveImageIDs(source, []string{"2b8fd9751c4c", "x86/cpu:1.4.1"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{source[0].ID, "x86/cpu:1.4.1"}, resolved)
+
+		_, err = ResolveImageIDs(source, []string{"3c9ae0b5c1d2"}, false)
+		assert.NotNil(t, err)
+
+		sizes, err := localImageSizes(source)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(3000), sizes["x86/cpu:1.4.1"])
+	})
+
+	suite.Run("largestFirst orders images by the sizes the daemon reports", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("ListImages", docker.ListImagesOptions{}).Return([]docker.APIImages{
+			docker.APIImages{ID: "sha256:2b8f", RepoTags: []string{"xy.io/someimage:latest"}, Size: 100, VirtualSize: 300},
+			docker.APIImages{ID: "sha256:3c9a", RepoTags: []string{"otherimage:0.1.0"}, Size: 200},
+		}, nil)
+
+		sizes, err := localImageSizes(m)
+		assert.Nil(t, err)
+
+		images := []string{"xy.io/missing:0.1.0", "docker.io/library/otherimage:0.1.0", "sha256:2b8f", "xy.io/unknown:latest"}
+		assert.Equal(t, int64(200), sizeOf(sizes, images[1]))
+		assert.Equal(t, []int{2, 1, 0, 3}, largestFirst(len(images), func(i int) int64 { return sizeOf(sizes, images[i]) }))
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("runStage passes parts on and holds up earlier stages when it falls behind", func(t *testing.T) {
+		queued := make(chan *partBuild, 4)
+		for _, name := range []string{"a", "b", "c", "d"} {
+			queued <- &partBuild{fileName: name}
+		}
+		close(queued)
+
+		places := newWorkerPool(1)
+		written := stageQueue(places)
+		assert.Equal(t, 1, cap(written))
+
+		var lock sync.Mutex
+		writes := 0
+		release := make(chan struct{})
+		go runStage(newWorkerPool(4), queued, written, func(part *partBuild) bool {
+			lock.Lock()
+			writes++
+			lock.Unlock()
+			return part.fileName != "c"
+		})
+
+		placed := []string{}
+		done := make(chan struct{})
+		go func() {
+			runStage(places, written, nil, func(part *partBuild) bool {
+				<-release
+				placed = append(placed, part.fileName)
+				return true
+			})
+			close(done)
+		}()
+
+		// every part is written, but with one placing and one queued, the rest wait to be handed on
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		assert.Equal(t, 4, writes)
+		lock.Unlock()
+		assert.Equal(t, 1, len(written))
+
+		close(release)
+		<-done
+		sort.Strings(placed)
+		assert.Equal(t, []string{"a", "b", "d"}, placed)
+	})
+
+	suite.Run("retryingClient retries failed exports with a clean destination and gives up on permanent errors", func(t *testing.T) {
+		reporter := cmdtools.NewSynchronizedReporter(512)
+		policy := cmdtools.RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+		dest, err := ioutil.TempFile(tmpDir, "retry")
+		assert.Nil(t, err)
+		defer dest.Close()
+
+		opts := docker.ExportImageOptions{Name: "foo.goo/someimage:0.2.0", OutputStream: dest}
+
+		m := new(MockDockerClient)
+		m.On("ExportImage", opts).Return(errors.New("unexpected EOF")).Once()
+		m.On("ExportImage", opts).Return(nil).Once()
+		m.On("PullImage", mock.AnythingOfType("docker.PullImageOptions"), docker.AuthConfiguration{}).Return(&docker.Error{Status: 404, Message: "not found"}).Once()
+
+		client := newRetryingClient(m, context.Background(), policy, reporter)
+		assert.Nil(t, client.ExportImage(opts))
+
+		// content from the failed attempt was discarded
+		b, err := ioutil.ReadFile(dest.Name())
+		assert.Nil(t, err)
+		assert.Equal(t, bogusImageContent, string(b))
+
+		// an export streamed into a compressed file is retried from a clean file too
+		compressed, err := ioutil.TempFile(tmpDir, "retry-compressed")
+		assert.Nil(t, err)
+		defer compressed.Close()
+
+		gzipOut, err := newCompressedFile(context.Background(), compressed, MinIOBufferSize, gzipCompressor{}, CompressionAuto)
+		assert.Nil(t, err)
+
+		gzipOpts := docker.ExportImageOptions{Name: "foo.goo/someimage:0.2.0", OutputStream: gzipOut}
+		m.On("ExportImage", gzipOpts).Return(errors.New("unexpected EOF")).Once()
+		m.On("ExportImage", gzipOpts).Return(nil).Once()
+		assert.Nil(t, client.ExportImage(gzipOpts))
+		assert.Nil(t, gzipOut.Close())
+
+		// the hash covers only the content of the successful attempt
+		content, err := ioutil.ReadFile(compressed.Name())
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content)), fmt.Sprintf("%x", gzipOut.hash.Sum(nil)))
+		assert.Equal(t, int64(len(content)), gzipOut.compressed.n)
+
+		_, err = compressed.Seek(0, io.SeekStart)
+		assert.Nil(t, err)
+		gz, err := gzip.NewReader(compressed)
+		assert.Nil(t, err)
+		b, err = ioutil.ReadAll(gz)
+		assert.Nil(t, err)
+		assert.Equal(t, bogusImageContent, string(b))
+
+		assert.NotNil(t, client.PullImage(docker.PullImageOptions{Repository: "xy.io/someimage", Tag: "missing"}, docker.AuthConfiguration{}))
+		m.AssertNumberOfCalls(t, "PullImage", 1)
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("tracingClient logs Docker API calls as debug messages", func(t *testing.T) {
+		var out bytes.Buffer
+		log := cmdtools.NewLogger(&out)
+
+		m := new(MockDockerClient)
+		m.On("PullImage", mock.AnythingOfType("docker.PullImageOptions"), mock.AnythingOfType("docker.AuthConfiguration")).Return(nil)
+		m.On("InspectImage", "xy.io/someimage:missing").Return((*docker.Image)(nil), docker.ErrNoSuchImage)
+
+		client := &tracingClient{DockerClient: m, log: log.Subsystem(cmdtools.SubsystemDocker)}
+		assert.Nil(t, client.PullImage(docker.PullImageOptions{Repository: "xy.io/someimage", Tag: "sha256:abc"}, docker.AuthConfiguration{Username: "timmy", Password: "s3cret"}))
+		assert.Equal(t, "", out.String())
+
+		log.SetLevel(cmdtools.LevelDebug, nil)
+		assert.Nil(t, client.PullImage(docker.PullImageOptions{Repository: "xy.io/someimage", Tag: "0.1.0"}, docker.AuthConfiguration{Username: "timmy", Password: "s3cret"}))
+		_, err := client.InspectImage("xy.io/someimage:missing")
+		assert.Equal(t, docker.ErrNoSuchImage, err)
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		assert.Equal(t, 2, len(lines))
+		assert.Contains(t, lines[0], "[DEBUG] docker: Docker API call PullImage(xy.io/someimage:0.1.0) as user timmy took ")
+		assert.Contains(t, lines[1], "[DEBUG] docker: Docker API call InspectImage(xy.io/someimage:missing) failed after ")
+		assert.NotContains(t, out.String(), "s3cret")
+	})
+
+	suite.Run("compressedFile stores content that compresses poorly", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "create-compression-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(tmpDir)
+
+		random := make([]byte, compressionSampleSize+(1<<20))
+		rand.New(rand.NewSource(1)).Read(random)
+		zeros := make([]byte, len(random))
+
+		for _, c := range []struct {
+			compression string
+			content     []byte
+			stored      bool
+		}{
+			{CompressionAuto, random, true},
+			{CompressionAuto, zeros, false},
+			{CompressionAlways, random, false},
+			{CompressionNever, zeros, true},
+		} {
+			file, err := ioutil.TempFile(tmpDir, "part")
+			assert.Nil(t, err)
+			defer file.Close()
+
+			out, err := newCompressedFile(context.Background(), file, DefaultIOBufferSize, gzipCompressor{}, c.compression)
+			assert.Nil(t, err)
+			_, err = out.Write(c.content)
+			assert.Nil(t, err)
+			assert.Nil(t, out.Close())
+			assert.Equal(t, c.stored, out.stored, c.compression)
+
+			// stored or not, the part reads back whole
+			_, err = file.Seek(0, io.SeekStart)
+			assert.Nil(t, err)
+			gz, err := gzip.NewReader(file)
+			assert.Nil(t, err)
+			b, err := ioutil.ReadAll(gz)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(c.content, b), c.compression)
+		}
+	})
+
+	suite.Run("Compressors write parts that read back whole in their encoding", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "create-compressors-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(tmpDir)
+
+		random := make([]byte, compressionSampleSize+(3<<20)+17)
+		rand.New(rand.NewSource(2)).Read(random)
+		zeros := make([]byte, len(random))
+
+		_, err = NewCompressor("lz4")
+		assert.NotNil(t, err)
+
+		for _, name := range []string{CompressorGzip, CompressorPgzip, CompressorZstd, CompressorXz, CompressorNone} {
+			compressor, err := NewCompressor(name)
+			if name == CompressorZstd || name == CompressorXz {
+				if _, lookErr := exec.LookPath(name); lookErr != nil {
+					assert.NotNil(t, err, name)
+					continue
+				}
+			}
+			assert.Nil(t, err, name)
+
+			for _, c := range []struct {
+				content []byte
+				stored  bool
+			}{
+				{random, name != CompressorNone},
+				{zeros, false},
+			} {
+				content := c.content
+				file, err := ioutil.TempFile(tmpDir, "part")
+				assert.Nil(t, err)
+				defer file.Close()
+
+				out, err := newCompressedFile(context.Background(), file, DefaultIOBufferSize, compressor, CompressionAuto)
+				assert.Nil(t, err)
+				_, err = out.Write(content)
+				assert.Nil(t, err)
+				assert.Nil(t, out.Close())
+				assert.Equal(t, c.stored, out.stored, name)
+
+				_, err = file.Seek(0, io.SeekStart)
+				assert.Nil(t, err)
+
+				var b []byte
+				switch compressor.Encoding() {
+				case EncodingGzip:
+					gz, err := gzip.NewReader(file)
+					assert.Nil(t, err)
+					b, err = ioutil.ReadAll(gz)
+					assert.Nil(t, err)
+				case EncodingIdentity:
+					b, err = ioutil.ReadAll(file)
+					assert.Nil(t, err)
+				default:
+					b, err = exec.Command(name, "-d", "-c", file.Name()).Output()
+					assert.Nil(t, err, name)
+				}
+				assert.True(t, bytes.Equal(content, b), name)
+			}
+		}
+	})
+
+	suite.Run("streamPart streams parts to a PartStreamer and fails if it refuses them", func(t *testing.T) {
+		image := "foo.goo/someimage:0.2.0"
+		client := new(MockDockerClient)
+		client.On("ExportImage", mock.Anything).Return(nil)
+		e := newDockerExporter(client, nil, true, nil, ImagePolicy{})
+		e.images[dockerImageKey(image, "")] = dockerImage{exportName: image}
+		prepared := []preparedImage{preparedImage{image: image, exporter: e}}
+
+		streamer := &memoryStreamer{parts: map[string][]byte{}}
+		hash, filename, size, _, err := streamPart(context.Background(), ImagePolicy{}, streamer, "pkg", DefaultIOBufferSize, nil, CompressionAlways, nil, prepared)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("%x.tgz", hash.Sum(nil)), filename)
+
+		// the part is streamed under the name it's recorded with, and reads back whole
+		content, ok := streamer.parts["pkg/"+filename]
+		assert.True(t, ok)
+		assert.Equal(t, int64(len(content)), size)
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content)), fmt.Sprintf("%x", hash.Sum(nil)))
+		gz, err := gzip.NewReader(bytes.NewReader(content))
+		assert.Nil(t, err)
+		b, err := ioutil.ReadAll(gz)
+		assert.Nil(t, err)
+		assert.Equal(t, bogusImageContent, string(b))
+
+		// the export of a part the streamer refuses doesn't wait for it
+		streamer.full = true
+		_, _, _, _, err = streamPart(context.Background(), ImagePolicy{}, streamer, "pkg", DefaultIOBufferSize, nil, CompressionAlways, nil, prepared)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "no room")
+	})
+
+	suite.Run("pullProgress summarizes layer progress and records stream errors", func(t *testing.T) {
+		var out bytes.Buffer
+		progress := newPullProgress(&out, "xy.io/someimage:0.1.0", 0)
+
+		stream := `{"status":"Pulling from someimage","id":"0.1.0"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"aaa"}
+{"status":"Already exists","progressDetail":{},"id":"bbb"}
+{"status":"Downloading","progressDetail":{"current":1024,"total":4096},"id":"aaa"}
+{"status":"Downlo`
+		_, err := io.WriteString(progress, stream)
+		assert.Nil(t, err)
+		assert.Contains(t, out.String(), "1 of 2 layers complete, 1.0 KiB of 4.0 KiB downloaded")
+
+		_, err = io.WriteString(progress, `ading","progressDetail":{"current":4096,"total":4096},"id":"aaa"}
+{"status":"Pull complete","progressDetail":{},"id":"aaa"}
+{"errorDetail":{"message":"unauthorized"},"error":"unauthorized"}
+`)
+		assert.Nil(t, err)
+		assert.Contains(t, out.String(), "2 of 2 layers complete, 4.0 KiB of 4.0 KiB downloaded")
+		assert.Equal(t, "unauthorized", progress.err.Error())
+	})
+
+	suite.Run("WriteChecksums lists the Pkg's files for sha256sum and writes sidecars", func(t *testing.T) {
+		outDir, err := ioutil.TempDir("", "create-checksums-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(outDir)
+
+		pkgDir := path.Join(outDir, "pkgid")
+		assert.Nil(t, os.Mkdir(pkgDir, 0755))
+		assert.Nil(t, ioutil.WriteFile(path.Join(pkgDir, "part.tar.gz"), []byte("part"), 0644))
+		assert.Nil(t, ioutil.WriteFile(path.Join(outDir, "pkgid.json"), []byte("{}"), 0644))
+		assert.Nil(t, ioutil.WriteFile(path.Join(outDir, "pkgid.json.sig"), []byte("sig"), 0644))
+
+		assert.Nil(t, WriteChecksums(pkgDir, path.Join(outDir, "pkgid.json"), path.Join(outDir, "pkgid.json.sig"), true))
+
+		sums, err := ioutil.ReadFile(path.Join(pkgDir, "SHA256SUMS"))
+		assert.Nil(t, err)
+		assert.Equal(t, "37a680133bd09342f934afb8dd2c7d9e1b624da5f35e3a38adb103e37c055ed1  pkgid/part.tar.gz\n"+
+			"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a  pkgid.json\n"+
+			"a543997d84f12798350c09bdef2cdb171bf41ed3e4a5f808af2feb0c56263009  pkgid.json.sig\n", string(sums))
+
+		sidecar, err := ioutil.ReadFile(path.Join(outDir, "pkgid.json.sha256"))
+		assert.Nil(t, err)
+		assert.Equal(t, "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a  pkgid.json\n", string(sidecar))
+
+		// rewriting doesn't list the checksum files themselves
+		assert.Nil(t, WriteChecksums(pkgDir, path.Join(outDir, "pkgid.json"), path.Join(outDir, "pkgid.json.sig"), true))
+		rewritten, err := ioutil.ReadFile(path.Join(pkgDir, "SHA256SUMS"))
+		assert.Nil(t, err)
+		assert.Equal(t, string(sums), string(rewritten))
+	})
+
+	suite.Run("buildJournal records phases and tells a resumed build how far the last got", func(t *testing.T) {
+		outDir, err := ioutil.TempDir("", "create-journal-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(outDir)
+
+		file := buildJournalFile(outDir, []string{"xy.io/someimage:0.1.0", "xy.io/otherimage:0.1.0"})
+		assert.True(t, strings.HasPrefix(path.Base(file), "build-hznpkg-"))
+
+		phases, previous, err := openBuildJournal(file, true)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(previous))
+		phases.record(phasePulled, "xy.io/someimage:0.1.0", "", 1024, nil)
+		phases.record(phasePulled, "xy.io/otherimage:0.1.0", "", 2048, nil)
+		phases.record(phaseWritten, "xy.io/someimage:0.1.0", "e26e31a0", 512, nil)
+		phases.record(phaseFailed, "xy.io/otherimage:0.1.0", "", 0, errors.New("unexpected EOF\n"))
+		phases.record(phaseFailed, "", "", 0, errors.New("Pkg not created"))
+		phases.close(false)
+
+		// a line cut short by a crash is ignored
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+		assert.Nil(t, err)
+		f.WriteString(`{"time":"2026-`)
+		f.Close()
+
+		phases, previous, err = openBuildJournal(file, true)
+		assert.Nil(t, err)
+		assert.Equal(t, 6, len(previous))
+		assert.Equal(t, "e26e31a0", previous[3].Part)
+		assert.Contains(t, summarizeJournal(previous), "pulled 2 images, wrote 1 parts, signed 0, and placed 0; it failed on image xy.io/otherimage:0.1.0: unexpected EOF")
+
+		// entries appended after the cut short line are still read
+		phases.record(phasePulled, "xy.io/someimage:0.1.0", "", 1024, nil)
+		entries, err := readBuildJournal(file)
+		assert.Nil(t, err)
+		assert.Equal(t, 8, len(entries))
+		assert.Contains(t, summarizeJournal(entries), "pulled 1 images")
+		phases.close(true)
+
+		_, err = os.Stat(file)
+		assert.True(t, os.IsNotExist(err))
+
+		// without resume, earlier builds' entries are dropped
+		phases, _, err = openBuildJournal(file, false)
+		assert.Nil(t, err)
+		phases.close(false)
+		entries, err = readBuildJournal(file)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, "", summarizeJournal(nil))
+	})
+
+	suite.Run("writeFileAtomic replaces files whole and leaves no temporary files", func(t *testing.T) {
+		outDir, err := ioutil.TempDir("", "create-atomic-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(outDir)
+
+		file := path.Join(outDir, "pkgid.json")
+		assert.Nil(t, writeFileAtomic(file, []byte(`{"id":"old"}`)))
+		assert.Nil(t, writeFileAtomic(file, []byte(`{"id":"new"}`)))
+
+		content, err := ioutil.ReadFile(file)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"id":"new"}`, string(content))
+
+		info, err := os.Stat(file)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+		files, err := ioutil.ReadDir(outDir)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(files))
+
+		// a file in a missing directory fails rather than being written elsewhere
+		assert.NotNil(t, writeFileAtomic(path.Join(outDir, "missing", "pkgid.json.sig"), []byte("sig")))
+	})
+
+	suite.Run("parsePrivateKey reads PEM keys", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.New(rand.NewSource(1)), 1024)
+		assert.Nil(t, err)
+
+		pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		parsed, err := parsePrivateKey(pkcs1)
+		assert.Nil(t, err)
+		assert.Equal(t, key.N, parsed.N)
+
+		_, err = parsePrivateKey([]byte("not a key"))
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("NewBuilder fills in defaults and refuses incomplete options", func(t *testing.T) {
+		reporter := cmdtools.NewSynchronizedReporterTo(512, ioutil.Discard, ioutil.Discard)
+		options := Options{Client: new(MockDockerClient), OutputDir: "/tmp", PrivateKey: []byte("key")}
+
+		builder, err := NewBuilder(reporter, options)
+		assert.Nil(t, err)
+		assert.Equal(t, DefaultIOBufferSize, builder.options.IOBufferSize)
+		assert.Equal(t, CompressionAuto, builder.options.Compression)
+
+		// with parts streamed to their destination, nothing need be written to disk
+		streaming := options
+		streaming.OutputDir, streaming.PartDestination = "", &memoryStreamer{}
+		_, err = NewBuilder(reporter, streaming)
+		assert.Nil(t, err)
+
+		for _, invalid := range []func(o *Options){
+			func(o *Options) { o.Client = nil },
+			func(o *Options) { o.OutputDir = "" },
+			func(o *Options) { o.PrivateKey = nil },
+			func(o *Options) { o.IOBufferSize = 1 },
+			func(o *Options) { o.Compression = "sometimes" },
+			func(o *Options) { o.PkgName = "../pkg" },
+			func(o *Options) { o.PartDestination, o.CacheDir = &memoryStreamer{}, "/tmp/cache" },
+			func(o *Options) {
+				o.Client, o.Mirrors = struct{ ImageSource }{new(MockDockerClient)}, []string{"mirror1.io"}
+			},
+		} {
+			o := options
+			invalid(&o)
+			_, err := NewBuilder(reporter, o)
+			assert.NotNil(t, err)
+		}
+	})
+
+	suite.Run("dockerClientOf fails the operations an ImageSource doesn't have", func(t *testing.T) {
+		m := new(MockDockerClient)
+		assert.Equal(t, DockerClient(m), dockerClientOf(m))
+		assert.Nil(t, dockerClientOf(nil))
+
+		client := dockerClientOf(struct{ ImageSource }{m})
+		assert.NotNil(t, client.ExportImages(docker.ExportImagesOptions{Names: []string{"xy.io/someimage:0.1.0", "xy.io/someimage:latest"}}))
+		assert.NotNil(t, client.TagImage("xy.io/someimage:0.1.0", docker.TagImageOptions{Repo: "xy.io/someimage", Tag: "latest"}))
+		m.AssertNotCalled(t, "ExportImages", mock.Anything)
+		m.AssertNotCalled(t, "TagImage", mock.Anything, mock.Anything)
+	})
+
+	suite.Run("Builder.Build returns the failures of the build as a BuildError", func(t *testing.T) {
+		reporter := cmdtools.NewSynchronizedReporterTo(512, ioutil.Discard, ioutil.Discard)
+		reporter.DelegateErr(true, false, "an earlier failure\n")
+
+		events := []Event{}
+		builder, err := NewBuilder(reporter, Options{Client: new(MockDockerClient), OutputDir: "/tmp", PrivateKey: []byte("not a key"), Events: func(e Event) { events = append(events, e) }})
+		assert.Nil(t, err)
+
+		result, err := builder.Build(context.Background(), []string{"alpine:3.6"})
+		assert.Nil(t, result)
+		buildErr, ok := err.(*BuildError)
+		assert.True(t, ok)
+		assert.Equal(t, cmdtools.ExitSign, buildErr.Code)
+		assert.Equal(t, 1, len(buildErr.Failures))
+		assert.Contains(t, buildErr.Error(), "Error reading RSA PSS private key")
+		assert.True(t, errors.Is(err, cmdtools.ErrSigning))
+		assert.False(t, errors.Is(err, cmdtools.ErrPull))
+
+		// the build's end is sent to Options.Events with its error
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, EventBuildFinished, events[0].Kind)
+		assert.Nil(t, events[0].Result)
+		assert.Equal(t, err, events[0].Err)
+
+		assert.Equal(t, cmdtools.ExitUserError, newBuildError([]cmdtools.DelegateError{{Code: cmdtools.ExitUserError}, {Code: cmdtools.ExitUserError}}).Code)
+		assert.Equal(t, cmdtools.ExitPull, newBuildError([]cmdtools.DelegateError{{Code: cmdtools.ExitUserError}, {Code: cmdtools.ExitPull}, {Code: cmdtools.ExitSign}}).Code)
+	})
+
+	suite.Run("eventHandler sends a part's export progress at most once per interval", func(t *testing.T) {
+		assert.Nil(t, eventHandler(nil).exported([]string{"a:1"}, 3000))
+
+		events := []Event{}
+		progress := eventHandler(func(e Event) { events = append(events, e) }).exported([]string{"a:1"}, 3000)
+		progress(1000)
+		progress(2000)
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, Event{Kind: EventPartExported, Time: events[0].Time, Images: []string{"a:1"}, Bytes: 1000, Total: 3000}, events[0])
+	})
+
+	suite.Run("BuildSummary records each image of a part", func(t *testing.T) {
+		summary := NewBuildSummary()
+		part := &partBuild{images: []preparedImage{{image: "b:1", size: 3000}, {image: "a:1", size: 3000}}, sha256sum: "abc", bytes: 1000}
+
+		summary.pulled("a:1", 2*time.Second)
+		summary.written(part, 500*time.Millisecond)
+		summary.placed(part, "https://example.com/pkg/abc.tgz")
+
+		images := summary.Images()
+		assert.Equal(t, 2, len(images))
+		assert.Equal(t, ImageSummary{Image: "a:1", PullSeconds: 2, ExportSeconds: 0.5, Bytes: 3000, CompressedBytes: 1000, CompressionRatio: 3, Sha256sum: "abc", URL: "https://example.com/pkg/abc.tgz"}, images[0])
+		assert.Equal(t, "b:1", images[1].Image)
+		assert.Equal(t, float64(0), images[1].PullSeconds)
+
+		// nothing is collected without a summary
+		var none *BuildSummary
+		none.written(part, time.Second)
+		assert.Nil(t, none.Images())
+		assert.Nil(t, none.Stages())
+	})
+
+	suite.Run("BuildSummary spans each stage from the first image in to the last out", func(t *testing.T) {
+		summary := NewBuildSummary()
+		first := &partBuild{images: []preparedImage{{image: "a:1"}}}
+		second := &partBuild{images: []preparedImage{{image: "b:1"}}}
+
+		started := time.Now()
+		summary.staged(stageWrite, first, started, 2*time.Second)
+		summary.staged(stageWrite, second, started.Add(time.Second), 3*time.Second)
+		summary.staged(stageSign, first, started.Add(2*time.Second), 250*time.Millisecond)
+		summary.staged(stagePlace, first, started.Add(3*time.Second), 500*time.Millisecond)
+		summary.spanned(stagePull, started.Add(-time.Second), time.Second)
+
+		assert.Equal(t, []StageSummary{{Stage: stagePull, Seconds: 1}, {Stage: stageWrite, Seconds: 4}, {Stage: stageSign, Seconds: 0.25}, {Stage: stagePlace, Seconds: 0.5}}, summary.Stages())
+
+		images := summary.Images()
+		assert.Equal(t, 2, len(images))
+		assert.Equal(t, 0.25, images[0].SignSeconds)
+		assert.Equal(t, 0.5, images[0].PlaceSeconds)
+		assert.Equal(t, float64(0), images[1].SignSeconds)
+	})
+
+	suite.Run("ReadPkgParts", func(t *testing.T) {
+		outDir, err := ioutil.TempDir("", "create-parts-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(outDir)
+
+		pkgDir := path.Join(outDir, "pkgid")
+		assert.Nil(t, os.Mkdir(pkgDir, 0755))
+		assert.Nil(t, ioutil.WriteFile(path.Join(pkgDir, "bbbb.tgz"), []byte("part"), 0644))
+		assert.Nil(t, ioutil.WriteFile(path.Join(pkgDir, "bbbb.tgz.sha256"), []byte("sum"), 0644))
+
+		pkgFile := path.Join(outDir, "pkgid.json")
+		assert.Nil(t, ioutil.WriteFile(pkgFile, []byte(`{"id":"pkgid","parts":[{"id":"bbbb","sha256sum":"bbbb","bytes":4,"sources":[{"url":"https://cdn.example.com/pkgid/bbbb.tgz"}]},{"id":"aaaa","sha256sum":"aaaa","bytes":5000000000,"sources":[]}]}`), 0644))
+
+		parts, err := ReadPkgParts(pkgFile, pkgDir)
+		assert.Nil(t, err)
+		assert.Equal(t, []PkgPart{
+			{ID: "aaaa", Sha256sum: "aaaa", Bytes: 5000000000, URLs: []string{}},
+			{ID: "bbbb", Sha256sum: "bbbb", Bytes: 4, File: path.Join(pkgDir, "bbbb.tgz"), URLs: []string{"https://cdn.example.com/pkgid/bbbb.tgz"}},
+		}, parts)
+	})
+
+	suite.Run("LinkDuplicateParts links parts identical to those of other Pkgs", func(t *testing.T) {
+		outDir, err := ioutil.TempDir("", "create-dedupe-")
+		assert.Nil(t, err)
+		defer os.RemoveAll(outDir)
+
+		content := []byte("identical part")
+		name := fmt.Sprintf("%x.tgz", sha256.Sum256(content))
+		for _, pkg := range []string{"pkga", "pkgb", "pkgc"} {
+			assert.Nil(t, os.Mkdir(path.Join(outDir, pkg), 0755))
+			assert.Nil(t, ioutil.WriteFile(path.Join(outDir, pkg, name), content, 0644))
+			assert.Nil(t, ioutil.WriteFile(path.Join(outDir, pkg+".json"), []byte("{}"), 0644))
+		}
+
+		// a directory without Pkg metadata isn't a Pkg
+		assert.Nil(t, os.Mkdir(path.Join(outDir, "build-hznpkg-1"), 0755))
+		assert.Nil(t, ioutil.WriteFile(path.Join(outDir, "build-hznpkg-1", name), content, 0644))
+
+		linked, saved, err := LinkDuplicateParts(path.Join(outDir, "pkgb"), PartLinkHardlink)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, linked)
+		assert.EqualValues(t, len(content), saved)
+
+		a, _ := os.Stat(path.Join(outDir, "pkga", name))
+		b, _ := os.Stat(path.Join(outDir, "pkgb", name))
+		assert.True(t, os.SameFile(a, b))
+
+		// already linked
+		linked, _, err = LinkDuplicateParts(path.Join(outDir, "pkgb"), PartLinkHardlink)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, linked)
+
+		linked, _, err = LinkDuplicateParts(path.Join(outDir, "pkgc"), PartLinkSymlink)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, linked)
+
+		target, err := os.Readlink(path.Join(outDir, "pkgc", name))
+		assert.Nil(t, err)
+		assert.Equal(t, path.Join("..", "pkga", name), target)
+
+		linkedContent, err := ioutil.ReadFile(path.Join(outDir, "pkgc", name))
+		assert.Nil(t, err)
+		assert.Equal(t, content, linkedContent)
+
+		// a part whose content doesn't match its name isn't linked to
+		corrupt := []byte("corrupt part")
+		corruptName := fmt.Sprintf("%x.tgz", sha256.Sum256([]byte("other part")))
+		assert.Nil(t, ioutil.WriteFile(path.Join(outDir, "pkga", corruptName), corrupt, 0644))
+		assert.Nil(t, ioutil.WriteFile(path.Join(outDir, "pkgb", corruptName), corrupt, 0644))
+
+		linked, _, err = LinkDuplicateParts(path.Join(outDir, "pkgb"), PartLinkHardlink)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, linked)
+
+		assert.NotNil(t, ValidPartLink("copy"))
+	})
+
+	suite.Run("exportImageToFile", func(t *testing.T) {
+		imageList := []docker.APIImages{docker.APIImages{ID: "1", RepoTags: []string{"foo.goo/someimage:0.2.0"}}}
+
+		m := new(MockDockerClient)
+		m.On("ListImages", mock.AnythingOfType("docker.ListImagesOptions")).Return(imageList, nil)
+		// unfortunately, we can't check the options b/c of the changing file handle
+		m.On("InspectImage", mock.Anything).Return(&docker.Image{ID: "sha256:2b8f"}, nil)
+		m.On("ExportImage", mock.AnythingOfType("docker.ExportImageOptions")).Return(nil)
+
+		fName, _, err := exportImageToFile(m, nil, true, dockerauth.NewResolver(nil, nil, &docker.AuthConfigurations{}), ImagePolicy{}, "", tmpDir, imageList[0].RepoTags[0])
+		assert.Nil(t, err)
+		assert.NotNil(t, fName)
+
+		// the export is streamed into the compressed file; there's no uncompressed copy
+		f, err := os.Open(fName)
+		assert.Nil(t, err)
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		assert.Nil(t, err)
+		b, err := ioutil.ReadAll(gz)
+		assert.Nil(t, err)
+
+		assert.Equal(t, bogusImageContent, string(b))
+
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("contextClient", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		m := new(MockDockerClient)
+		m.On("PullImage", mock.MatchedBy(func(opts docker.PullImageOptions) bool { return opts.Context != nil }), docker.AuthConfiguration{}).Return(nil)
+
+		client := newContextClient(m, ctx, 0, 0)
+		assert.Nil(t, client.PullImage(docker.PullImageOptions{Repository: "foo.goo/someimage"}, docker.AuthConfiguration{}))
+
+		var out bytes.Buffer
+		w := &contextWriter{ctx: ctx, w: &out}
+		_, err := w.Write([]byte("abc"))
+		assert.Nil(t, err)
+
+		// once cancelled, operations fail permanently without reaching the daemon
+		cancel()
+		err = client.PullImage(docker.PullImageOptions{Repository: "foo.goo/someimage"}, docker.AuthConfiguration{})
+		assert.IsType(t, cmdtools.PermanentError{}, err)
+		_, err = client.InspectImage("foo.goo/someimage")
+		assert.NotNil(t, err)
+
+		_, err = w.Write([]byte("def"))
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, "abc", out.String())
+
+		m.AssertNumberOfCalls(t, "PullImage", 1)
+		m.AssertExpectations(t)
+	})
+
+	suite.Run("contextClient timeout", func(t *testing.T) {
+		client := newContextClient(&stallingDockerClient{}, context.Background(), 10*time.Millisecond, 0)
+
+		// a timed out pull isn't permanent, so it's retried
+		err := client.PullImage(docker.PullImageOptions{Repository: "foo.goo/someimage"}, docker.AuthConfiguration{})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "timed out after 10ms")
+		_, permanent := err.(cmdtools.PermanentError)
+		assert.False(t, permanent)
+	})
+
+	suite.Run("throttledClient limits concurrent and frequent daemon calls", func(t *testing.T) {
+		counter := &countingDockerClient{}
+		client := newThrottledClient(counter, context.Background(), 2, 5*time.Millisecond)
+
+		started := time.Now()
+		var group sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				_, err := client.InspectImage("foo.goo/someimage")
+				assert.Nil(t, err)
+			}()
+		}
+		group.Wait()
+
+		assert.Equal(t, 2, counter.maxRunning)
+		assert.True(t, time.Since(started) >= 60*time.Millisecond)
+
+		// waiting for a turn stops once the context is done
+		ctx, cancel := context.WithCancel(context.Background())
+		blocked := newThrottledClient(&stallingDockerClient{}, ctx, 1, 0)
+		go blocked.PullImage(docker.PullImageOptions{Repository: "foo.goo/someimage", Context: ctx}, docker.AuthConfiguration{})
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+
+		_, err := blocked.InspectImage("foo.goo/someimage")
+		_, permanent := err.(cmdtools.PermanentError)
+		assert.True(t, permanent)
+	})
+
+	suite.Run("EstimatePart extrapolates a sample of the export", func(t *testing.T) {
+		m := new(MockDockerClient)
+		m.On("InspectImage", "foo.goo/someimage:0.2.0").Return(&docker.Image{Size: 50, VirtualSize: 100}, nil)
+		m.On("ExportImage", mock.Anything).Return(nil)
+
+		estimate, err := EstimatePart(context.Background(), m, nil, "foo.goo/someimage:0.2.0", 1<<20)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 100, estimate.Size)
+		assert.EqualValues(t, len(bogusImageContent), estimate.Sampled)
+		assert.True(t, estimate.PartSize > 0)
+
+		// only the sample is compressed
+		estimate, err = EstimatePart(context.Background(), m, nil, "foo.goo/someimage:0.2.0", 2)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, estimate.Sampled)
+
+		missing := new(MockDockerClient)
+		missing.On("InspectImage", "foo.goo/missing:1.0").Return((*docker.Image)(nil), docker.ErrNoSuchImage)
+		_, err = EstimatePart(context.Background(), missing, nil, "foo.goo/missing:1.0", 1<<20)
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("EstimateBuildTime", func(t *testing.T) {
+		estimates := []PartEstimate{{ExportTime: 4 * time.Second}, {ExportTime: 2 * time.Second}, {ExportTime: 2 * time.Second}}
+
+		assert.Equal(t, 8*time.Second, EstimateBuildTime(estimates, 1))
+		assert.Equal(t, 4*time.Second, EstimateBuildTime(estimates, 2))
+		assert.Equal(t, 4*time.Second, EstimateBuildTime(estimates, 0))
+		assert.Equal(t, time.Duration(0), EstimateBuildTime(nil, 2))
+	})
+
+	suite.Run("NewExporter refuses unknown backends and misplaced locations", func(t *testing.T) {
+		exporter, err := NewExporter("docker", nil, false, tmpDir)
+		assert.Nil(t, err)
+		assert.Equal(t, BackendDocker, exporter.Backend())
+		assert.Nil(t, exporter.Close())
+
+		for _, backend := range []string{"podman", "docker:/var/run", "registry:x.io", "tarball", "tarball:" + path.Join(tmpDir, "missing")} {
+			_, err := NewExporter(backend, nil, false, tmpDir)
+			assert.NotNil(t, err, backend)
+		}
+
+		exporter, err = NewExporter("tarball:"+tmpDir, nil, false, tmpDir)
+		assert.Nil(t, err)
+		assert.Equal(t, BackendTarball, exporter.Backend())
+		assert.Nil(t, exporter.Close())
+	})
+
+	suite.Run("fetchingExporter fetches each image once and removes its fetches on Close", func(t *testing.T) {
+		var lock sync.Mutex
+		fetches := map[string]int{}
+		exporter := newFetchingExporter(BackendRegistry, "registries", tmpDir, true, func(ctx context.Context, image string, platform string, dir string) error {
+			lock.Lock()
+			defer lock.Unlock()
+			fetches[image+" "+platform]++
+			if image == "xy.io/broken:0.1.0" {
+				return errors.New("unreachable")
+			}
+			return nil
+		})
+
+		var waitGroup sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				_, _, err := exporter.layout(context.Background(), "xy.io/someimage:0.1.0", "linux/arm64")
+				assert.Nil(t, err)
+			}()
+		}
+		waitGroup.Wait()
+		assert.Equal(t, 1, fetches["xy.io/someimage:0.1.0 linux/arm64"])
+
+		// images for no platform are fetched for the host's
+		_, platform, err := exporter.layout(context.Background(), "xy.io/someimage:0.1.0", "")
+		assert.Nil(t, err)
+		assert.Equal(t, hostPlatform(), platform)
+
+		// failed fetches are tried again
+		for i := 0; i < 2; i++ {
+			_, _, err := exporter.layout(context.Background(), "xy.io/broken:0.1.0", "linux/arm64")
+			assert.NotNil(t, err)
+		}
+		assert.Equal(t, 2, fetches["xy.io/broken:0.1.0 linux/arm64"])
+
+		fetchDir := exporter.tmpDir
+		assert.Nil(t, exporter.Close())
+		_, err = os.Stat(fetchDir)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+// countingDockerClient inspects images slowly, recording how many inspections run at once
+type countingDockerClient struct {
+	MockDockerClient
+	lock       sync.Mutex
+	running    int
+	maxRunning int
+}
+
+func (c *countingDockerClient) InspectImage(name string) (*docker.Image, error) {
+	c.lock.Lock()
+	c.running++
+	if c.running > c.maxRunning {
+		c.maxRunning = c.running
+	}
+	c.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	c.lock.Lock()
+	c.running--
+	c.lock.Unlock()
+	return &docker.Image{}, nil
+}
+
+// stallingDockerClient pulls until the pull is cancelled, like a stalled registry connection
+type stallingDockerClient struct {
+	MockDockerClient
+}
+
+func (c *stallingDockerClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	<-opts.Context.Done()
+	return opts.Context.Err()
 }
@@ -0,0 +1,217 @@
+package create
+
+import (
+	"context"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/dockerauth"
+	"github.com/open-horizon/horizon-pkg-build/registry"
+	"io"
+	"sync"
+)
+
+// groupExporter is an Exporter that can export several names of the same
+// image in one archive, which restores all of them when loaded; images it
+// reads that have the same image ID are packaged as one part (see groupImages)
+type groupExporter interface {
+	ExportGroup(ctx context.Context, images []string, platform string, w io.Writer) error
+}
+
+// imageSizer is an Exporter that learns the uncompressed sizes of images as
+// it prepares them, and checks them against the ImagePolicy then rather than
+// as they're exported
+type imageSizer interface {
+	Size(image string, platform string) int64
+}
+
+// digestResolver is an Exporter of images whose tags may be moved after the
+// build, which resolves a prepared image's tag to what it referred to
+type digestResolver interface {
+	Digest(image string, platform string) (string, error)
+}
+
+// dockerExporter reads images from the Docker daemon, pulling them first
+// unless skipPullIfExists is set and the daemon has them. The one NewExporter
+// returns has no client; a build reads images through one of its own (see
+// exporterOf).
+type dockerExporter struct {
+	client           DockerClient
+	manifests        ManifestResolver
+	skipPullIfExists bool
+	authResolver     *dockerauth.Resolver
+	policy           ImagePolicy
+
+	lock   sync.Mutex
+	images map[string]dockerImage
+}
+
+// dockerImage is an image the Docker daemon has been readied to export
+type dockerImage struct {
+	// exportName is the name the image is exported by
+	exportName string
+
+	// tag is the name the image is recorded under in its export if it's
+	// exported by another name, e.g. a platform's variant pulled by digest
+	tag string
+
+	imageID string
+
+	// digest is what the image's tag resolved to as it was pulled (see
+	// resolveDigest), or empty if it isn't named by a tag
+	digest string
+
+	// size is the image's uncompressed size
+	size int64
+}
+
+func newDockerExporter(client DockerClient, manifests ManifestResolver, skipPullIfExists bool, authResolver *dockerauth.Resolver, policy ImagePolicy) *dockerExporter {
+	return &dockerExporter{client: client, manifests: manifests, skipPullIfExists: skipPullIfExists, authResolver: authResolver, policy: policy, images: map[string]dockerImage{}}
+}
+
+func (e *dockerExporter) Backend() string {
+	return BackendDocker
+}
+
+func (e *dockerExporter) String() string {
+	return "the Docker daemon"
+}
+
+// Prepare pulls the image if necessary, refusing it if it's larger than the
+// policy allows before time is spent on its export
+func (e *dockerExporter) Prepare(ctx context.Context, image string, platform string) (string, error) {
+	if e.client == nil {
+		return "", fmt.Errorf("Image %v is read from the Docker daemon, but no Docker client was given", image)
+	}
+
+	prepared := dockerImage{exportName: image}
+	if IsImageID(image) {
+		if err := checkLocalImage(e.client, e.manifests, platform, image); err != nil {
+			return "", err
+		}
+	} else {
+		var err error
+		prepared.exportName, prepared.tag, err = fetchImage(e.client, e.manifests, e.skipPullIfExists, e.authResolver, e.policy, platform, image)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	inspected, err := e.client.InspectImage(prepared.exportName)
+	if err != nil {
+		return "", err
+	}
+
+	if err := e.policy.checkSize(image, inspected.Size); err != nil {
+		return "", err
+	}
+
+	// a tag may be moved by the time the part is placed, so it's resolved along with the image ID
+	if IsFloatingReference(image) {
+		prepared.digest = resolveDigest(image, inspected)
+	}
+
+	// the virtual size includes layers shared with other images, all of which are exported
+	prepared.imageID, prepared.size = inspected.ID, inspected.VirtualSize
+	if prepared.size < inspected.Size {
+		prepared.size = inspected.Size
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.images[dockerImageKey(image, platform)] = prepared
+	return prepared.imageID, nil
+}
+
+func (e *dockerExporter) Export(ctx context.Context, image string, platform string, w io.Writer) error {
+	return e.export([]string{image}, platform, w)
+}
+
+// export exports the prepared images by their export names, recording the
+// tags of those exported by another name (see retagArchive). Exports are
+// cancelled by the client (see contextClient).
+func (e *dockerExporter) export(images []string, platform string, w io.Writer) error {
+	exportNames := []string{}
+	tags := map[string][]string{}
+	for _, image := range images {
+		prepared, err := e.prepared(image, platform)
+		if err != nil {
+			return err
+		}
+
+		exportNames = append(exportNames, prepared.exportName)
+		if prepared.tag != "" {
+			tags[prepared.imageID] = append(tags[prepared.imageID], prepared.tag)
+		}
+	}
+
+	if len(tags) > 0 {
+		return retagExport(w, tags, func(out io.Writer) error {
+			return exportFromDaemon(e.client, out, exportNames)
+		})
+	}
+	return exportFromDaemon(e.client, w, exportNames)
+}
+
+func (e *dockerExporter) Platform(ctx context.Context, image string, platform string) (registry.Platform, error) {
+	prepared, err := e.prepared(image, platform)
+	if err != nil {
+		return registry.Platform{}, err
+	}
+
+	inspected, err := e.client.InspectImage(prepared.exportName)
+	if err != nil {
+		return registry.Platform{}, err
+	}
+	return registry.Platform{OS: inspected.OS, Architecture: inspected.Architecture}, nil
+}
+
+func (e *dockerExporter) Size(image string, platform string) int64 {
+	prepared, _ := e.prepared(image, platform)
+	return prepared.size
+}
+
+// Digest returns what the tag of the prepared image resolved to as it was
+// pulled; images named by digest or image ID resolve to nothing
+func (e *dockerExporter) Digest(image string, platform string) (string, error) {
+	prepared, err := e.prepared(image, platform)
+	return prepared.digest, err
+}
+
+// Close leaves the images pulled in the Docker daemon
+func (e *dockerExporter) Close() error {
+	return nil
+}
+
+// prepared returns how the image was readied to export for the platform
+func (e *dockerExporter) prepared(image string, platform string) (dockerImage, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	prepared, exists := e.images[dockerImageKey(image, platform)]
+	if !exists {
+		return dockerImage{}, fmt.Errorf("Image %v wasn't prepared for export from the Docker daemon", image)
+	}
+	return prepared, nil
+}
+
+func dockerImageKey(image string, platform string) string {
+	return image + " " + platform
+}
+
+// groupingDockerExporter is a dockerExporter whose client can export several
+// images in one archive
+type groupingDockerExporter struct {
+	*dockerExporter
+}
+
+func (e groupingDockerExporter) ExportGroup(ctx context.Context, images []string, platform string, w io.Writer) error {
+	return e.export(images, platform, w)
+}
+
+// exportFromDaemon exports the images of the given names from the Docker daemon to out
+func exportFromDaemon(client DockerClient, out io.Writer, exportNames []string) error {
+	if len(exportNames) > 1 {
+		return client.ExportImages(docker.ExportImagesOptions{Names: exportNames, OutputStream: out})
+	}
+	return client.ExportImage(docker.ExportImageOptions{Name: exportNames[0], OutputStream: out})
+}
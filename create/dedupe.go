@@ -0,0 +1,148 @@
+package create
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// The ways LinkDuplicateParts can refer to a part identical to one of another Pkg
+const (
+	PartLinkNone     = "none"
+	PartLinkHardlink = "hardlink"
+	PartLinkSymlink  = "symlink"
+)
+
+// ValidPartLink returns an error if mode isn't one of the PartLink* modes
+func ValidPartLink(mode string) error {
+	switch mode {
+	case PartLinkNone, PartLinkHardlink, PartLinkSymlink:
+		return nil
+	}
+	return fmt.Errorf("Expected one of '%s', '%s', or '%s', got '%s'", PartLinkHardlink, PartLinkSymlink, PartLinkNone, mode)
+}
+
+// LinkDuplicateParts replaces each part in pkgDir, as written by a Builder, that
+// is byte-identical to a part of another Pkg in the same output directory
+// with a hard link or, if mode is PartLinkSymlink, a relative symbolic link
+// to that part, so stacks sharing images store each part once. Parts are
+// named for the hash of their content; a part of another Pkg is only linked
+// to once its content is verified to match its name. Pkgs are recognized by
+// their metadata files, so temporary build directories and caches in the
+// output directory are ignored. Returns the number of parts linked and the
+// bytes that saves.
+func LinkDuplicateParts(pkgDir string, mode string) (int, int64, error) {
+	if mode == PartLinkNone {
+		return 0, 0, nil
+	}
+
+	outputDir := path.Dir(path.Clean(pkgDir))
+	others, err := otherPkgDirs(outputDir, path.Base(path.Clean(pkgDir)))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	parts, err := ioutil.ReadDir(pkgDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var linked int
+	var saved int64
+	for _, part := range parts {
+		if !part.Mode().IsRegular() || !isPartFile(part.Name()) {
+			continue
+		}
+
+		partPath := path.Join(pkgDir, part.Name())
+		for _, other := range others {
+			original := path.Join(outputDir, other, part.Name())
+
+			// only link to a real file: a symbolic link could be to a Pkg that's removed
+			info, err := os.Lstat(original)
+			if err != nil || !info.Mode().IsRegular() || info.Size() != part.Size() {
+				continue
+			} else if os.SameFile(info, part) {
+				break
+			}
+
+			if sum, err := fileSHA256(original); err != nil || sum != partHash(part.Name()) {
+				continue
+			}
+
+			target := original
+			if mode == PartLinkSymlink {
+				target = path.Join("..", other, part.Name())
+			}
+
+			if err := replaceWithLink(target, partPath, mode); err != nil {
+				return linked, saved, err
+			}
+
+			linked++
+			saved += part.Size()
+			break
+		}
+	}
+
+	if linked > 0 {
+		return linked, saved, syncDir(pkgDir)
+	}
+	return 0, 0, nil
+}
+
+// otherPkgDirs returns the names of the directories of the Pkgs in outputDir other than the named one
+func otherPkgDirs(outputDir string, except string) ([]string, error) {
+	entries, err := ioutil.ReadDir(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == except {
+			continue
+		}
+
+		if _, err := os.Stat(path.Join(outputDir, fmt.Sprintf("%s.json", entry.Name()))); err == nil {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	return dirs, nil
+}
+
+// isPartFile returns true if the named file of a Pkg directory is a part,
+// named for the SHA-256 hash of its content, rather than a checksums file
+func isPartFile(name string) bool {
+	hash := partHash(name)
+	return len(hash) == 64 && strings.Trim(hash, "0123456789abcdef") == ""
+}
+
+// partHash returns the hash a part file is named for
+func partHash(name string) string {
+	return strings.SplitN(name, ".", 2)[0]
+}
+
+// replaceWithLink atomically replaces file with a link of the given mode to target
+func replaceWithLink(target string, file string, mode string) error {
+	tmpFile := fmt.Sprintf("%s.link-tmp", file)
+	os.Remove(tmpFile)
+
+	var err error
+	if mode == PartLinkSymlink {
+		err = os.Symlink(target, tmpFile)
+	} else {
+		err = os.Link(target, tmpFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFile, file); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
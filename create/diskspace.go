@@ -0,0 +1,117 @@
+package create
+
+import (
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// filesystemSpace is the disk space needed on a filesystem, known by a directory on it
+type filesystemSpace struct {
+	dir  string
+	need int64
+}
+
+// checkDiskSpace estimates the disk space writing the parts of the given
+// image groups takes in tmpDir, and in outputDir and the cache's directory if
+// parts must be copied there, and returns an error if a filesystem doesn't have it
+// available. Parts reused from the cache need their cached size. Parts
+// exported from images are assumed to be as large as the uncompressed
+// images since compression may not shrink them; images whose size isn't
+// known (e.g. from OCI layouts) aren't counted. Returns the number of images
+// not counted.
+func checkDiskSpace(cache *partCache, tmpDir string, outputDir string, compressor Compressor, compression string, groups [][]preparedImage) (int, error) {
+	tmpDev, err := device(tmpDir)
+	if err != nil {
+		return 0, err
+	}
+
+	spaces := map[uint64]*filesystemSpace{tmpDev: &filesystemSpace{dir: tmpDir}}
+
+	// the finished Pkg directory is copied to an output directory on another filesystem
+	outputDev, err := device(outputDir)
+	if err != nil {
+		return 0, err
+	}
+	if outputDev != tmpDev {
+		spaces[outputDev] = &filesystemSpace{dir: outputDir}
+	}
+
+	var cacheDev uint64
+	if cache != nil {
+		if cacheDev, err = device(cache.dir); err != nil {
+			return 0, err
+		}
+		if _, exists := spaces[cacheDev]; !exists {
+			spaces[cacheDev] = &filesystemSpace{dir: cache.dir}
+		}
+	}
+
+	// need adds the size of a part to the filesystems it's written to
+	need := func(size int64, cached bool) {
+		spaces[tmpDev].need += size
+		if outputDev != tmpDev {
+			spaces[outputDev].need += size
+		}
+
+		// parts are hard-linked into a cache on the same filesystem, copied to one elsewhere
+		if !cached && cache != nil && cacheDev != tmpDev {
+			spaces[cacheDev].need += size
+		}
+	}
+
+	uncounted := 0
+	for _, images := range groups {
+		first := images[0]
+
+		if cached, exists := cache.cachedBytes(cacheKey(images), first.imageID, first.platform, partSettings(first, compressor, compression)); exists {
+			need(cached, true)
+		} else if first.size == 0 {
+			uncounted++
+		} else {
+			need(first.size, false)
+		}
+	}
+
+	short := []string{}
+	for _, space := range spaces {
+		available, err := availableSpace(space.dir)
+		if err != nil {
+			return 0, err
+		}
+
+		if space.need > available {
+			short = append(short, fmt.Sprintf("%v needed in %v but only %v available", cmdtools.FormatByteSize(space.need), space.dir, cmdtools.FormatByteSize(available)))
+		}
+	}
+
+	if len(short) != 0 {
+		return uncounted, fmt.Errorf("Insufficient disk space to write the Pkg's parts: %v", strings.Join(short, "; "))
+	}
+	return uncounted, nil
+}
+
+// device returns the ID of the device of the filesystem the given file is on
+func device(file string) (uint64, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("Unable to determine the filesystem of %v", file)
+	}
+	return uint64(stat.Dev), nil
+}
+
+// availableSpace returns the disk space available to unprivileged users on the filesystem the given directory is on
+func availableSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("Unable to determine the disk space available in %v. Error: %v", dir, err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
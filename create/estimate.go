@@ -0,0 +1,135 @@
+package create
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// PartEstimate is the estimated size of the part of an image and the time
+// exporting it takes, extrapolated from a sample of its export
+type PartEstimate struct {
+	Image string
+
+	// Size is the image's uncompressed size
+	Size int64
+
+	// Sampled is the number of bytes of the export sampled, at most Size
+	Sampled int64
+
+	// PartSize is the estimated size of the compressed part
+	PartSize int64
+
+	// ExportTime is the estimated time exporting and compressing the image takes
+	ExportTime time.Duration
+}
+
+// errSampled stops an export once enough of it has been sampled
+var errSampled = errors.New("sampled enough of the export")
+
+// sampler compresses what's written to it like a part until it's seen its limit
+type sampler struct {
+	compressor io.WriteCloser
+	limit      int64
+	n          int64
+}
+
+func (s *sampler) Write(p []byte) (int, error) {
+	if s.n >= s.limit {
+		return 0, errSampled
+	}
+	if remaining := s.limit - s.n; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := s.compressor.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// EstimatePart estimates the part of the given local image by exporting and
+// compressing at most the first sampleBytes of it with the compressor (nil
+// for gzip), as a part is written, and extrapolating the compression ratio
+// and throughput to the whole image.
+// Layers exported later may compress differently, so it's only a guide. The
+// export is abandoned once sampled or once the context is done.
+func EstimatePart(ctx context.Context, client ImageSource, compressor Compressor, image string, sampleBytes int64) (PartEstimate, error) {
+	estimate := PartEstimate{Image: image}
+
+	inspected, err := client.InspectImage(image)
+	if err != nil {
+		return estimate, localImageError(image, err)
+	}
+
+	// the virtual size includes layers shared with other images, all of which are exported
+	estimate.Size = inspected.VirtualSize
+	if estimate.Size < inspected.Size {
+		estimate.Size = inspected.Size
+	}
+
+	compressed := &countingWriter{w: ioutil.Discard}
+	compressorWriter, err := compressorOf(compressor).NewWriter(ctx, compressed, false)
+	if err != nil {
+		return estimate, err
+	}
+	sample := &sampler{compressor: compressorWriter, limit: sampleBytes}
+
+	exportCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	started := time.Now()
+	err = client.ExportImage(docker.ExportImageOptions{Name: image, OutputStream: sample, Context: exportCtx})
+	if ctx.Err() != nil {
+		return estimate, ctx.Err()
+	} else if err != nil && sample.n < sample.limit {
+		return estimate, err
+	}
+
+	if err := compressorWriter.Close(); err != nil {
+		return estimate, err
+	}
+	elapsed := time.Since(started)
+
+	estimate.Sampled = sample.n
+	if sample.n == 0 {
+		return estimate, fmt.Errorf("Export of image %v was empty", image)
+	}
+
+	// an export is a little larger than the image for the archive's headers and manifest
+	total := estimate.Size
+	if total < sample.n {
+		total = sample.n
+	}
+
+	estimate.PartSize = int64(float64(total) * float64(compressed.n) / float64(sample.n))
+	estimate.ExportTime = time.Duration(float64(elapsed) * float64(total) / float64(sample.n))
+	return estimate, nil
+}
+
+// EstimateBuildTime estimates the time exporting parts with the given
+// estimates takes when at most parallelism are exported at once (0 for no
+// limit), assuming exports running at once don't slow each other down
+func EstimateBuildTime(estimates []PartEstimate, parallelism int) time.Duration {
+	if parallelism <= 0 || parallelism > len(estimates) {
+		parallelism = len(estimates)
+	}
+
+	var total, longest time.Duration
+	for _, e := range estimates {
+		total += e.ExportTime
+		if e.ExportTime > longest {
+			longest = e.ExportTime
+		}
+	}
+
+	if parallelism == 0 {
+		return 0
+	} else if perWorker := total / time.Duration(parallelism); perWorker > longest {
+		return perWorker
+	}
+	return longest
+}
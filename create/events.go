@@ -0,0 +1,86 @@
+package create
+
+import (
+	"sync"
+	"time"
+)
+
+// The kinds of Events a build sends to Options.Events
+const (
+	// EventPartStarted is for a part starting to be written: exported, compressed, and hashed
+	EventPartStarted = "part_started"
+
+	// EventPartExported is for the uncompressed bytes of a part's images
+	// exported so far, of their size if known; sent at most once per
+	// partEventInterval for each part
+	EventPartExported = "part_exported"
+
+	// EventPartCompleted is for a part added to the Pkg, with its hash, size, and URL
+	EventPartCompleted = "part_completed"
+
+	// EventBuildFinished is for the end of a build, with its Result or error
+	EventBuildFinished = "build_finished"
+)
+
+// partEventInterval is the minimum time between EventPartExported events for a single part
+const partEventInterval = time.Second
+
+// Event is something that happened in a build, sent to Options.Events so a
+// program building Pkgs can follow the build, e.g. to show its own progress.
+// Fields that don't apply to the kind of event are left zero.
+type Event struct {
+	Kind string
+	Time time.Time
+
+	// Images are those of the part, which are all the same image
+	Images []string
+
+	// Bytes is the uncompressed bytes exported (EventPartExported) or the
+	// size of the finished part (EventPartCompleted), and Total the images'
+	// uncompressed size, if known
+	Bytes int64
+	Total int64
+
+	// Sha256sum and URL are the finished part's hash and URL (EventPartCompleted)
+	Sha256sum string
+	URL       string
+
+	// Result and Err are the built Pkg, or why the build failed (EventBuildFinished)
+	Result *Result
+	Err    error
+}
+
+// eventHandler sends events to a build's Options.Events, if set
+type eventHandler func(Event)
+
+func (h eventHandler) send(event Event) {
+	if h == nil {
+		return
+	}
+	event.Time = time.Now()
+	h(event)
+}
+
+// exported returns a function sending EventPartExported events for the part
+// of the given images as it's told the bytes exported so far, or nil if
+// there's no handler
+func (h eventHandler) exported(images []string, total int64) func(int64) {
+	if h == nil {
+		return nil
+	}
+
+	var lock sync.Mutex
+	var last time.Time
+	return func(bytes int64) {
+		lock.Lock()
+		due := time.Since(last) >= partEventInterval
+		if due {
+			last = time.Now()
+		}
+		lock.Unlock()
+
+		if due {
+			h.send(Event{Kind: EventPartExported, Images: images, Bytes: bytes, Total: total})
+		}
+	}
+}
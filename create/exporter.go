@@ -0,0 +1,465 @@
+package create
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/ocilayout"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"github.com/open-horizon/horizon-pkg-build/registry"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The backends images are read from. The Docker daemon is used unless a
+// Builder is given an Exporter of another.
+const (
+	BackendDocker     = "docker"
+	BackendOCILayout  = "oci-layout"
+	BackendRegistry   = "registry"
+	BackendContainerd = "containerd"
+	BackendTarball    = "tarball"
+)
+
+// Exporter is a backend images are read from, e.g. the Docker daemon. The
+// packaging pipeline treats every Exporter alike, so a new source of images
+// needs only an Exporter. An Exporter is used by concurrent workers.
+type Exporter interface {
+	// Backend names the kind of backend, e.g. BackendRegistry; parts of
+	// cached images are only reused by builds reading them from the same kind
+	Backend() string
+
+	// String describes where images are read from, e.g. "OCI layout /tmp/app"
+	String() string
+
+	// Prepare makes the image available to export for the platform (e.g.
+	// "linux/arm64"), if given, e.g. by fetching it, and returns its image
+	// ID: the digest of its configuration
+	Prepare(ctx context.Context, image string, platform string) (string, error)
+
+	// Export writes the prepared image to w in the tarball format 'docker
+	// save' produces, tagged with its name unless it's named by digest
+	Export(ctx context.Context, image string, platform string, w io.Writer) error
+
+	// Platform returns the platform recorded in the prepared image's configuration
+	Platform(ctx context.Context, image string, platform string) (registry.Platform, error)
+
+	// Close removes whatever the Exporter fetched
+	Close() error
+}
+
+// NewExporter returns the Exporter of images of the given backend. The backend is one of:
+//
+//	docker                  The Docker daemon, through the Builder's Docker client (see Options.Client)
+//	registry                Images' registries, without a daemon, through the given registry.Client
+//	containerd[:namespace]  containerd's image store, with its 'ctr' tool; images it doesn't have are pulled
+//	                        unless skipPullIfExists is set
+//	tarball:dir             Image archives ('docker save' tarballs or OCI image layouts) in dir
+//
+// Images read from a registry, containerd, or tarballs are first stored as OCI
+// image layouts in a temporary directory in tmpBaseDir, removed by Close.
+// Images for no given platform are read for that of the host, as the Docker
+// daemon would pull them.
+func NewExporter(backend string, client *registry.Client, skipPullIfExists bool, tmpBaseDir string) (Exporter, error) {
+	kind, location := backend, ""
+	if spl := strings.SplitN(backend, ":", 2); len(spl) == 2 {
+		kind, location = spl[0], spl[1]
+	}
+
+	switch kind {
+	case BackendDocker:
+		if location != "" {
+			return nil, fmt.Errorf("Backend '%s' takes no location, got '%s'", kind, backend)
+		}
+		return &dockerExporter{}, nil
+	case BackendRegistry:
+		if location != "" {
+			return nil, fmt.Errorf("Backend '%s' takes no location, got '%s'", kind, backend)
+		}
+		return newFetchingExporter(BackendRegistry, "registries", tmpBaseDir, false, registryFetcher(client)), nil
+	case BackendContainerd:
+		if _, err := exec.LookPath("ctr"); err != nil {
+			return nil, fmt.Errorf("containerd's 'ctr' tool is required to read images from containerd. Error: %v", err)
+		}
+		description := "containerd"
+		if location != "" {
+			description = fmt.Sprintf("containerd namespace %s", location)
+		}
+		return newFetchingExporter(BackendContainerd, description, tmpBaseDir, true, containerdFetcher(location, skipPullIfExists)), nil
+	case BackendTarball:
+		if location == "" {
+			return nil, fmt.Errorf("Backend '%s' needs the directory of the archives, e.g. 'tarball:/srv/images'", kind)
+		} else if info, err := os.Stat(location); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("Expected a directory of image archives, got %v", location)
+		}
+		return newFetchingExporter(BackendTarball, fmt.Sprintf("image archives in %s", location), tmpBaseDir, false, tarballFetcher(&tarballIndex{dir: location})), nil
+	default:
+		return nil, fmt.Errorf("Unsupported backend '%s', expected 'docker', 'registry', 'containerd[:namespace]', or 'tarball:dir'", backend)
+	}
+}
+
+// hostPlatform is the platform images for no given platform are read for
+func hostPlatform() string {
+	return "linux/" + runtime.GOARCH
+}
+
+// ociLayoutExporter reads images from an OCI image layout
+type ociLayoutExporter struct {
+	dir string
+}
+
+// NewOCILayoutExporter returns an Exporter of images from the OCI image layout at dir (see ocilayout.Export)
+func NewOCILayoutExporter(dir string) Exporter {
+	return &ociLayoutExporter{dir: dir}
+}
+
+func (e *ociLayoutExporter) Backend() string {
+	return BackendOCILayout
+}
+
+func (e *ociLayoutExporter) String() string {
+	return fmt.Sprintf("OCI layout %s", e.dir)
+}
+
+func (e *ociLayoutExporter) Prepare(ctx context.Context, image string, platform string) (string, error) {
+	return ocilayout.ImageID(e.dir, image, platform)
+}
+
+func (e *ociLayoutExporter) Export(ctx context.Context, image string, platform string, w io.Writer) error {
+	return ocilayout.Export(e.dir, image, platform, w)
+}
+
+func (e *ociLayoutExporter) Platform(ctx context.Context, image string, platform string) (registry.Platform, error) {
+	return ocilayout.Platform(e.dir, image, platform)
+}
+
+func (e *ociLayoutExporter) Close() error {
+	return nil
+}
+
+// layoutFetcher stores an image for a platform, if given, in the empty
+// directory dir as an OCI image layout
+type layoutFetcher func(ctx context.Context, image string, platform string, dir string) error
+
+// fetchingExporter reads images from OCI image layouts it fetches them into
+// with a layoutFetcher, once for each image and platform
+type fetchingExporter struct {
+	backend     string
+	description string
+	tmpBaseDir  string
+	fetch       layoutFetcher
+
+	// selectPlatform is set if fetched layouts hold images for several
+	// platforms, so one must be selected for images for no given platform
+	selectPlatform bool
+
+	lock    sync.Mutex
+	tmpDir  string
+	layouts map[string]*fetchedLayout
+	fetched int
+}
+
+// fetchedLayout is a layout being fetched or fetched; done is closed once it's fetched or failed
+type fetchedLayout struct {
+	done chan struct{}
+	dir  string
+	err  error
+}
+
+func newFetchingExporter(backend string, description string, tmpBaseDir string, selectPlatform bool, fetch layoutFetcher) *fetchingExporter {
+	return &fetchingExporter{backend: backend, description: description, tmpBaseDir: tmpBaseDir, selectPlatform: selectPlatform, fetch: fetch, layouts: map[string]*fetchedLayout{}}
+}
+
+func (e *fetchingExporter) Backend() string {
+	return e.backend
+}
+
+func (e *fetchingExporter) String() string {
+	return e.description
+}
+
+// layout returns the directory of the layout the image is fetched into and
+// the platform to read it for, fetching it unless it has been already. Failed
+// fetches are tried again by the next call.
+func (e *fetchingExporter) layout(ctx context.Context, image string, platform string) (string, string, error) {
+	if platform == "" && e.selectPlatform {
+		platform = hostPlatform()
+	}
+	key := image + " " + platform
+
+	e.lock.Lock()
+	fetching, exists := e.layouts[key]
+	if !exists {
+		if e.tmpDir == "" {
+			tmpDir, err := ioutil.TempDir(e.tmpBaseDir, fmt.Sprintf("hznpkg-%s-", e.backend))
+			if err != nil {
+				e.lock.Unlock()
+				return "", "", err
+			}
+			e.tmpDir = tmpDir
+		}
+
+		e.fetched++
+		fetching = &fetchedLayout{done: make(chan struct{}), dir: path.Join(e.tmpDir, strconv.Itoa(e.fetched))}
+		e.layouts[key] = fetching
+	}
+	e.lock.Unlock()
+
+	if !exists {
+		fetching.err = os.Mkdir(fetching.dir, 0755)
+		if fetching.err == nil {
+			fetching.err = e.fetch(ctx, image, platform, fetching.dir)
+		}
+
+		if fetching.err != nil {
+			os.RemoveAll(fetching.dir)
+			e.lock.Lock()
+			delete(e.layouts, key)
+			e.lock.Unlock()
+		}
+		close(fetching.done)
+	}
+
+	<-fetching.done
+	return fetching.dir, platform, fetching.err
+}
+
+func (e *fetchingExporter) Prepare(ctx context.Context, image string, platform string) (string, error) {
+	dir, platform, err := e.layout(ctx, image, platform)
+	if err != nil {
+		return "", err
+	}
+	return ocilayout.ImageID(dir, image, platform)
+}
+
+func (e *fetchingExporter) Export(ctx context.Context, image string, platform string, w io.Writer) error {
+	dir, platform, err := e.layout(ctx, image, platform)
+	if err != nil {
+		return err
+	}
+	return ocilayout.Export(dir, image, platform, w)
+}
+
+func (e *fetchingExporter) Platform(ctx context.Context, image string, platform string) (registry.Platform, error) {
+	dir, platform, err := e.layout(ctx, image, platform)
+	if err != nil {
+		return registry.Platform{}, err
+	}
+	return ocilayout.Platform(dir, image, platform)
+}
+
+func (e *fetchingExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.tmpDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(e.tmpDir)
+	e.tmpDir = ""
+	e.layouts = map[string]*fetchedLayout{}
+	return err
+}
+
+// registryFetcher fetches images' manifests and blobs from their registries
+func registryFetcher(client *registry.Client) layoutFetcher {
+	return func(ctx context.Context, image string, platform string, dir string) error {
+		// single-platform images are fetched whatever the platform; the layout is read for the given platform, if any
+		selected := platform
+		if selected == "" {
+			selected = hostPlatform()
+		}
+
+		content, mediaType, digest, err := client.Manifest(ctx, image, selected)
+		if err != nil {
+			return err
+		}
+
+		type blob struct {
+			Digest string `json:"digest"`
+		}
+		var m struct {
+			Config blob   `json:"config"`
+			Layers []blob `json:"layers"`
+		}
+		if err := json.Unmarshal(content, &m); err != nil {
+			return fmt.Errorf("Unable to parse manifest of %v. Error: %v", image, err)
+		}
+
+		for _, b := range append([]blob{m.Config}, m.Layers...) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			body, _, err := client.Blob(ctx, image, b.Digest)
+			if err != nil {
+				return err
+			}
+			_, err = ocilayout.WriteBlob(dir, b.Digest, body)
+			body.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := ocilayout.WriteBlob(dir, digest, bytes.NewReader(content)); err != nil {
+			return err
+		}
+		return ocilayout.WriteIndex(dir, image, mediaType, digest, int64(len(content)))
+	}
+}
+
+// containerdFetcher exports images from containerd's image store with its
+// 'ctr' tool, pulling them first unless skipPullIfExists is set and
+// containerd has them
+func containerdFetcher(namespace string, skipPullIfExists bool) layoutFetcher {
+	return func(ctx context.Context, image string, platform string, dir string) error {
+		ref, err := reference.Parse(image)
+		if err != nil {
+			return err
+		}
+
+		// containerd records images by their full names
+		name := ref.Canonical()
+		global := []string{}
+		if namespace != "" {
+			global = append(global, "--namespace", namespace)
+		}
+
+		exists := false
+		if skipPullIfExists {
+			listed, err := runCtr(ctx, append(global, "images", "list", "--quiet", "name=="+name)...)
+			if err != nil {
+				return err
+			}
+			exists = strings.TrimSpace(string(listed)) != ""
+		}
+
+		if !exists {
+			if _, err := runCtr(ctx, append(global, "images", "pull", "--platform", platform, name)...); err != nil {
+				return err
+			}
+		}
+
+		archive := dir + ".tar"
+		defer os.Remove(archive)
+		if _, err := runCtr(ctx, append(global, "images", "export", "--platform", platform, archive, name)...); err != nil {
+			return err
+		}
+
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return ocilayout.Unpack(f, dir)
+	}
+}
+
+// runCtr runs containerd's 'ctr' tool with the given arguments, returning its output
+func runCtr(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "ctr", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, fmt.Errorf("ctr %v failed: %v. Output: %s", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return output, nil
+}
+
+// tarballIndex finds the archives in a directory holding images, reading the
+// names of their images the first time one is looked for
+type tarballIndex struct {
+	dir string
+
+	once     sync.Once
+	archives map[string][]string
+	err      error
+}
+
+// archive returns the path of the archive holding the image
+func (t *tarballIndex) archive(image string) (string, error) {
+	t.once.Do(func() {
+		t.archives, t.err = indexArchives(t.dir)
+	})
+	if t.err != nil {
+		return "", t.err
+	}
+
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return "", err
+	}
+
+	switch archives := t.archives[ref.String()]; len(archives) {
+	case 0:
+		return "", fmt.Errorf("Image %v is in none of the archives in %v", image, t.dir)
+	case 1:
+		return archives[0], nil
+	default:
+		return "", fmt.Errorf("Image %v is in several archives in %v: %v", image, t.dir, strings.Join(archives, ", "))
+	}
+}
+
+// indexArchives maps the names of the images in the archives ('.tar' files) in dir to the archives
+func indexArchives(dir string) (map[string][]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tar"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	archives := map[string][]string{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		names, err := ocilayout.Names(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read image archive %v. Error: %v", file, err)
+		}
+
+		for _, name := range names {
+			archives[name] = append(archives[name], file)
+		}
+	}
+	return archives, nil
+}
+
+// tarballFetcher unpacks the archive holding an image
+func tarballFetcher(index *tarballIndex) layoutFetcher {
+	return func(ctx context.Context, image string, platform string, dir string) error {
+		archive, err := index.archive(image)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return ocilayout.Unpack(&contextReader{ctx: ctx, r: f}, dir)
+	}
+}
@@ -0,0 +1,54 @@
+package create
+
+import (
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"path"
+	"sort"
+)
+
+// CheckImageFilter returns an error if pattern isn't a valid image filter:
+// a glob pattern, as of path.Match, of image names and tags as the Docker
+// daemon lists them (e.g. 'summit.hovitos.engineering/x86/*:1.4.*')
+func CheckImageFilter(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Malformed pattern '%v'. Error: %v", pattern, err)
+	}
+	return nil
+}
+
+// MatchingImages returns the names and tags of the local images of the Docker
+// daemon matching any of the image filter patterns (see CheckImageFilter),
+// sorted. A '*' doesn't match a '/', so a pattern of one repository's tags
+// doesn't match those of repositories below it.
+func MatchingImages(client ImageSource, patterns []string) ([]string, error) {
+	images, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	matched := map[string]bool{}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			// untagged images are listed with a placeholder
+			if tag == "<none>:<none>" {
+				continue
+			}
+
+			for _, pattern := range patterns {
+				if ok, err := path.Match(pattern, tag); err != nil {
+					return nil, err
+				} else if ok {
+					matched[tag] = true
+				}
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range matched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,98 @@
+package create
+
+import (
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"net/http"
+	"strings"
+)
+
+// ImageError reports an image that can't be packaged as given, e.g. one that
+// doesn't exist locally and couldn't be pulled. Its Kind is
+// cmdtools.ErrImageNotFound, cmdtools.ErrAuthFailed, or, if not set,
+// cmdtools.ErrUsage; errors.Is matches it with its kind.
+type ImageError struct {
+	Image  string
+	Reason string
+	Kind   error
+	Err    error
+}
+
+func (e ImageError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("Image %v %v", e.Image, e.Reason)
+	}
+	return fmt.Sprintf("Image %v %v. Error: %v", e.Image, e.Reason, e.Err)
+}
+
+// Unwrap returns the error that showed the image can't be packaged, if any
+func (e ImageError) Unwrap() error {
+	return e.Err
+}
+
+// Is tells if target is the error's kind of failure
+func (e ImageError) Is(target error) bool {
+	if e.Kind == nil {
+		return target == cmdtools.ErrUsage
+	}
+	return target == e.Kind
+}
+
+// imageFailure returns the failure of a stage of processing an image, and of
+// its part if known, caused by err: of the kind of failure err is, if any,
+// e.g. cmdtools.ErrImageNotFound for an ImageError of a missing image or
+// cmdtools.ErrPolicy for a PolicyError, and otherwise of the given kind the
+// stage's failures are
+func imageFailure(kind error, stage string, image string, part string, msg string, err error) *cmdtools.Failure {
+	if cause := cmdtools.KindOf(err); cause != cmdtools.ErrFailed {
+		kind = cause
+	}
+	return &cmdtools.Failure{Kind: kind, Stage: stage, Image: image, Part: part, Msg: msg, Err: err}
+}
+
+// pullError returns an ImageError naming the reason a pull of the given
+// image failed if the daemon's error shows the image doesn't exist or access
+// to it was denied; other errors are returned as-is
+func pullError(image string, existsLocally bool, err error) error {
+	reason, kind := pullFailureReason(err)
+	if reason == "" {
+		return err
+	}
+
+	if existsLocally {
+		return ImageError{Image: image, Reason: "exists locally but " + reason, Kind: kind, Err: err}
+	}
+	return ImageError{Image: image, Reason: "was not found locally and " + reason, Kind: kind, Err: err}
+}
+
+// pullFailureReason describes why a pull failed, with the kind of failure
+// it is, if the daemon's error shows the image doesn't exist or access to it
+// was denied, or returns ""
+func pullFailureReason(err error) (string, error) {
+	var status int
+	if dockerErr, ok := err.(*docker.Error); ok {
+		status = dockerErr.Status
+	}
+	msg := strings.ToLower(err.Error())
+
+	// registries deny access to repositories that don't exist rather than reveal which exist
+	switch {
+	case strings.Contains(msg, "repository does not exist"):
+		return "its repository doesn't exist or requires credentials", cmdtools.ErrImageNotFound
+	case status == http.StatusNotFound || strings.Contains(msg, "not found") || strings.Contains(msg, "manifest unknown"):
+		return "its registry has no such tag or digest", cmdtools.ErrImageNotFound
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || strings.Contains(msg, "unauthorized") || strings.Contains(msg, "denied"):
+		return "its registry denied access to it; check the credentials given for the registry", cmdtools.ErrAuthFailed
+	default:
+		return "", nil
+	}
+}
+
+// localImageError returns an ImageError if the given error from inspecting a local image shows it doesn't exist
+func localImageError(image string, err error) error {
+	if err == docker.ErrNoSuchImage {
+		return ImageError{Image: image, Reason: "was not found among local images", Kind: cmdtools.ErrImageNotFound, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,182 @@
+package create
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the phases a build and its parts go through, as recorded in the build journal
+const (
+	phaseStarted = "build-started"
+	phasePulled  = "pulled"
+	phaseWritten = "written" // exported, compressed, and hashed, which are streamed at once, or reused
+	phaseSigned  = "signed"
+	phasePlaced  = "placed" // uploaded, if parts are uploaded as they're built, and added to the Pkg
+	phaseFailed  = "failed"
+)
+
+// journalEntry is a line of the build journal
+type journalEntry struct {
+	Time  time.Time `json:"time"`
+	Phase string    `json:"phase"`
+	Image string    `json:"image,omitempty"`
+	Part  string    `json:"part,omitempty"`
+	Bytes int64     `json:"bytes,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// buildJournal is an append-only record, one JSON object per line, of the
+// phases each image and part of a build has been through, synced to disk as
+// it's written so it survives a crash. It tells a resumed build, and whoever
+// investigates a failed one, how far the build got. A nil *buildJournal
+// records nothing.
+type buildJournal struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// buildJournalFile returns the file in outputDir that journals builds of the
+// given images. It's named for the images like resumeJournalDir and, like
+// the temporary build directories, isn't published.
+func buildJournalFile(outputDir string, images []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(images, "\n")))
+	return path.Join(outputDir, fmt.Sprintf("build-hznpkg-%x.journal", sum[:8]))
+}
+
+// openBuildJournal starts journaling a build in the given file. If resume is
+// set, the entries of earlier builds in it are kept and returned; otherwise
+// it's started afresh.
+func openBuildJournal(file string, resume bool) (*buildJournal, []journalEntry, error) {
+	var previous []journalEntry
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+
+		var err error
+		if previous, err = readBuildJournal(file); err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+
+	f, err := os.OpenFile(file, flags, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// end a line cut short by a crash so the entries appended after it can be read
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if r, err := os.Open(file); err == nil {
+			r.ReadAt(last, info.Size()-1)
+			r.Close()
+		}
+		if last[0] != '\n' {
+			f.Write([]byte("\n"))
+		}
+	}
+
+	j := &buildJournal{file: f}
+	if err := j.record(phaseStarted, "", "", 0, nil); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return j, previous, nil
+}
+
+// readBuildJournal returns the entries in the given journal file, skipping
+// lines cut short by a crash
+func readBuildJournal(file string) ([]journalEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []journalEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// record appends an entry for the given phase of an image and its part, if known
+func (j *buildJournal) record(phase string, image string, part string, bytes int64, failure error) error {
+	if j == nil {
+		return nil
+	}
+
+	entry := journalEntry{Time: time.Now().UTC(), Phase: phase, Image: image, Part: part, Bytes: bytes}
+	if failure != nil {
+		entry.Error = strings.TrimSpace(failure.Error())
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// close stops journaling, removing the journal if remove is set
+func (j *buildJournal) close(remove bool) {
+	if j == nil {
+		return
+	}
+
+	j.file.Close()
+	if remove {
+		os.Remove(j.file.Name())
+	}
+}
+
+// summarizeJournal describes how far the last build recorded in the given
+// entries got and why it failed, or returns "" if there's none
+func summarizeJournal(entries []journalEntry) string {
+	last := -1
+	for i, entry := range entries {
+		if entry.Phase == phaseStarted {
+			last = i
+		}
+	}
+	if last < 0 {
+		return ""
+	}
+
+	counts := map[string]int{}
+	var failure journalEntry
+	for _, entry := range entries[last+1:] {
+		counts[entry.Phase]++
+		// the first failure is the likeliest cause of the rest
+		if entry.Phase == phaseFailed && failure.Phase == "" {
+			failure = entry
+		}
+	}
+
+	summary := fmt.Sprintf("build started %v pulled %v images, wrote %v parts, signed %v, and placed %v", entries[last].Time.Format(time.RFC3339), counts[phasePulled], counts[phaseWritten], counts[phaseSigned], counts[phasePlaced])
+	if failure.Phase != "" && failure.Image != "" {
+		return fmt.Sprintf("%v; it failed on image %v: %v", summary, failure.Image, failure.Error)
+	} else if failure.Phase != "" {
+		return fmt.Sprintf("%v; it failed: %v", summary, failure.Error)
+	}
+	return summary + "; it stopped without recording a failure"
+}
@@ -0,0 +1,43 @@
+package create
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/open-horizon/rsapss-tool/sign"
+)
+
+// parsePrivateKey parses a PEM-encoded RSA private key, in PKCS #1 or
+// unencrypted PKCS #8 form, as read by the key's source rather than from a
+// file so the key needn't be on disk
+func parsePrivateKey(content []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("No PEM-encoded key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %v block. Error: %v", block.Type, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Expected an RSA private key, got %T", parsed)
+	}
+	return key, nil
+}
+
+// signInput returns the RSA-PSS signature of the SHA-256 hash of input, as
+// sign.Input does with a key file
+func signInput(privateKey *rsa.PrivateKey, input []byte) (string, error) {
+	hash := sha256.New()
+	hash.Write(input)
+	return sign.Sha256HashOfInput(privateKey, hash)
+}
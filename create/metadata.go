@@ -0,0 +1,323 @@
+package create
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IsFloatingReference returns true if the given image name refers to an image
+// by tag (e.g. "repo:latest"), which may be moved to another image at any
+// time, rather than by digest or local image ID
+func IsFloatingReference(image string) bool {
+	if IsImageID(image) {
+		return false
+	}
+
+	ref, err := reference.Parse(image)
+	return err == nil && !ref.IsDigest()
+}
+
+// resolveDigest returns the immutable identity of the local image inspected
+// by the given tag: the registry digest it was pulled by or, for an image
+// that was never pushed, its image ID
+func resolveDigest(image string, inspected *docker.Image) string {
+	if ref, err := reference.Parse(image); err == nil {
+		for _, repoDigest := range inspected.RepoDigests {
+			pulled, err := reference.Parse(repoDigest)
+			if err == nil && pulled.Domain == ref.Domain && pulled.Path == ref.Path {
+				return pulled.Digest
+			}
+		}
+	}
+
+	return inspected.ID
+}
+
+// partAnnotations collects fields that horizonpkg's PkgBuilder doesn't know
+// about, keyed by part ID, so they can be added to the serialized Pkg
+type partAnnotations struct {
+	lock   sync.Mutex
+	fields map[string]map[string]interface{}
+}
+
+func newPartAnnotations() *partAnnotations {
+	return &partAnnotations{fields: map[string]map[string]interface{}{}}
+}
+
+func (a *partAnnotations) set(partID string, key string, value interface{}) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, exists := a.fields[partID]; !exists {
+		a.fields[partID] = map[string]interface{}{}
+	}
+	a.fields[partID][key] = value
+}
+
+// apply adds the collected fields to the matching parts in the given serialized Pkg
+func (a *partAnnotations) apply(serialized []byte) ([]byte, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.fields) == 0 {
+		return serialized, nil
+	}
+
+	// numbers are kept as-is so part sizes aren't mangled by float conversion
+	var pkg map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(serialized))
+	decoder.UseNumber()
+	if err := decoder.Decode(&pkg); err != nil {
+		return nil, err
+	}
+
+	var parts []interface{}
+	switch p := pkg["parts"].(type) {
+	case []interface{}:
+		parts = p
+	case map[string]interface{}:
+		for _, part := range p {
+			parts = append(parts, part)
+		}
+	default:
+		return nil, fmt.Errorf("Unexpected parts content in Pkg metadata")
+	}
+
+	annotated := 0
+	for _, p := range parts {
+		part, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if fields, exists := a.fields[partID(part)]; exists {
+			for key, value := range fields {
+				part[key] = value
+			}
+			annotated++
+		}
+	}
+
+	if annotated != len(a.fields) {
+		return nil, fmt.Errorf("Unable to find all annotated parts in Pkg metadata")
+	}
+
+	return json.Marshal(pkg)
+}
+
+// PkgInfo is descriptive metadata of a Pkg that horizonpkg's PkgBuilder
+// doesn't know about, added to the serialized Pkg before it's signed so
+// tooling can select Pkgs by it. Empty fields are left out.
+type PkgInfo struct {
+	Description string
+	Version     string
+	Labels      map[string]string
+}
+
+// matches semantic versions, e.g. "1.4.2" or "2.0.0-rc.1+build.5", see https://semver.org
+var pkgVersionPattern = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-(0|[1-9][0-9]*|[0-9]*[A-Za-z-][0-9A-Za-z-]*)(\.(0|[1-9][0-9]*|[0-9]*[A-Za-z-][0-9A-Za-z-]*))*)?(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// matches label keys, optionally with a prefix, e.g. "tier" or "example.com/team"
+var labelKeyPattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?/)?[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?$`)
+
+// CheckPkgVersion returns an error if version isn't a semantic version, e.g. '1.4.2'
+func CheckPkgVersion(version string) error {
+	if !pkgVersionPattern.MatchString(version) {
+		return fmt.Errorf("Expected a semantic version (e.g. '1.4.2' or '2.0.0-rc.1'), got '%s'", version)
+	}
+	return nil
+}
+
+// ParseLabels returns the labels given as 'key=value' specs. Keys are
+// letters, digits, '.', '_', and '-', optionally prefixed with a domain and
+// '/', and may be given once only; values may be empty.
+func ParseLabels(specs []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected 'key=value', got '%s'", spec)
+		}
+
+		key, value := parts[0], parts[1]
+		if !labelKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("Malformed label key '%s' in '%s'", key, spec)
+		} else if _, exists := labels[key]; exists {
+			return nil, fmt.Errorf("Label '%s' given more than once", key)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// apply adds the info to the given serialized Pkg as the fields
+// "description", "pkgVersion", and "labels"
+func (info PkgInfo) apply(serialized []byte) ([]byte, error) {
+	fields := map[string]interface{}{}
+	if info.Description != "" {
+		fields["description"] = info.Description
+	}
+	if info.Version != "" {
+		fields["pkgVersion"] = info.Version
+	}
+	if len(info.Labels) > 0 {
+		fields["labels"] = info.Labels
+	}
+
+	if len(fields) == 0 {
+		return serialized, nil
+	}
+
+	var pkg map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(serialized))
+	decoder.UseNumber()
+	if err := decoder.Decode(&pkg); err != nil {
+		return nil, err
+	}
+
+	for key, value := range fields {
+		if _, exists := pkg[key]; exists {
+			return nil, fmt.Errorf("Pkg metadata already has a '%s' field", key)
+		}
+		pkg[key] = value
+	}
+
+	return json.Marshal(pkg)
+}
+
+// canonicalPkg reserializes the given serialized Pkg canonically, so the
+// same Pkg content is always serialized (and signed) byte for byte the same
+// whatever order its parts were added in: parts are sorted by ID, object
+// keys are sorted, there's no insignificant whitespace, and characters
+// aren't HTML-escaped
+func canonicalPkg(serialized []byte) ([]byte, error) {
+	var pkg map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(serialized))
+	decoder.UseNumber()
+	if err := decoder.Decode(&pkg); err != nil {
+		return nil, err
+	}
+
+	// parts serialized as an object are sorted by their keys when encoded
+	if parts, ok := pkg["parts"].([]interface{}); ok {
+		sort.SliceStable(parts, func(i, j int) bool {
+			return partID(parts[i]) < partID(parts[j])
+		})
+	}
+
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(pkg); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), nil
+}
+
+// partID returns the ID of a decoded part, or "" if it has none
+func partID(part interface{}) string {
+	if p, ok := part.(map[string]interface{}); ok {
+		id, _ := p["id"].(string)
+		return id
+	}
+	return ""
+}
+
+// ReadPkgID returns the ID recorded in the given Pkg metadata file, which
+// names the file unless the Pkg was given another name
+func ReadPkgID(pkgFile string) (string, error) {
+	content, err := ioutil.ReadFile(pkgFile)
+	if err != nil {
+		return "", err
+	}
+	return pkgIDOf(content)
+}
+
+// pkgIDOf returns the ID recorded in the given Pkg metadata
+func pkgIDOf(content []byte) (string, error) {
+	var pkg struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(content, &pkg); err != nil {
+		return "", err
+	}
+	return pkg.ID, nil
+}
+
+// PkgPart describes a part recorded in a Pkg's metadata and the file holding it
+type PkgPart struct {
+	ID        string   `json:"id"`
+	Sha256sum string   `json:"sha256sum"`
+	Bytes     int64    `json:"bytes"`
+	File      string   `json:"file,omitempty"`
+	URLs      []string `json:"urls"`
+}
+
+// ReadPkgParts returns the parts recorded in the given Pkg metadata file,
+// sorted by ID, with the paths of their files in pkgDir if they're there
+func ReadPkgParts(pkgFile string, pkgDir string) ([]PkgPart, error) {
+	content, err := ioutil.ReadFile(pkgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkg struct {
+		Parts json.RawMessage `json:"parts"`
+	}
+	if err := json.Unmarshal(content, &pkg); err != nil {
+		return nil, err
+	}
+
+	type recordedPart struct {
+		ID        string `json:"id"`
+		Sha256sum string `json:"sha256sum"`
+		Bytes     int64  `json:"bytes"`
+		Sources   []struct {
+			URL string `json:"url"`
+		} `json:"sources"`
+	}
+
+	// parts may be serialized as an array or an object keyed by ID
+	var recorded []recordedPart
+	if err := json.Unmarshal(pkg.Parts, &recorded); err != nil {
+		byID := map[string]recordedPart{}
+		if json.Unmarshal(pkg.Parts, &byID) != nil {
+			return nil, fmt.Errorf("Unexpected parts content in Pkg metadata")
+		}
+		for _, part := range byID {
+			recorded = append(recorded, part)
+		}
+	}
+
+	// part files are named for their hash with the compressed file extension
+	files := map[string]string{}
+	if entries, err := ioutil.ReadDir(pkgDir); err == nil {
+		for _, entry := range entries {
+			if !cmdtools.IsChecksumFile(entry.Name()) {
+				files[partHash(entry.Name())] = path.Join(pkgDir, entry.Name())
+			}
+		}
+	}
+
+	parts := []PkgPart{}
+	for _, r := range recorded {
+		part := PkgPart{ID: r.ID, Sha256sum: r.Sha256sum, Bytes: r.Bytes, File: files[r.Sha256sum], URLs: []string{}}
+		for _, source := range r.Sources {
+			part.URLs = append(part.URLs, source.URL)
+		}
+		parts = append(parts, part)
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].ID < parts[j].ID })
+	return parts, nil
+}
@@ -0,0 +1,122 @@
+package create
+
+import (
+	"context"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/dockerauth"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"strings"
+	"sync"
+)
+
+// mirroringClient is a DockerClient that, like the Docker daemon, pulls
+// Docker Hub images through the given registry mirrors (hosts), trying each
+// in order before falling back to Docker Hub. Images pulled from a mirror
+// are made to appear as if pulled from Docker Hub: tags are applied to the
+// Docker Hub name and digest references are translated to the mirror's name.
+type mirroringClient struct {
+	DockerClient
+	mirrors      []string
+	authResolver *dockerauth.Resolver
+	log          *cmdtools.Logger
+
+	// digest references pulled from a mirror mapped to the mirror's name for them
+	pulled map[string]string
+	lock   sync.Mutex
+}
+
+func newMirroringClient(client DockerClient, ctx context.Context, mirrors []string, authResolver *dockerauth.Resolver, reporter *cmdtools.SynchronizedReporter) *mirroringClient {
+	return &mirroringClient{
+		DockerClient: client,
+		mirrors:      mirrors,
+		authResolver: authResolver,
+		log:          reporter.Log.WithContext(ctx).Subsystem(cmdtools.SubsystemDocker),
+		pulled:       map[string]string{},
+	}
+}
+
+// localName returns the name the daemon knows the given image by
+func (c *mirroringClient) localName(name string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if mirrorName, exists := c.pulled[name]; exists {
+		return mirrorName
+	}
+	return name
+}
+
+func (c *mirroringClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	ref, err := reference.Parse(opts.Repository)
+	if err != nil || ref.Domain != reference.DefaultDomain || len(c.mirrors) == 0 {
+		return c.DockerClient.PullImage(opts, auth)
+	}
+
+	isDigest := strings.Contains(opts.Tag, ":")
+
+	for _, mirror := range c.mirrors {
+		mirrorRepo := mirror + "/" + ref.Path
+
+		mirrorAuth, _, err := c.authResolver.Lookup(mirror)
+		if err == nil {
+			mirrorOpts := opts
+			mirrorOpts.Repository = mirrorRepo
+			err = c.DockerClient.PullImage(mirrorOpts, mirrorAuth)
+		}
+
+		if err == nil && isDigest {
+			c.lock.Lock()
+			c.pulled[fmt.Sprintf("%s@%s", opts.Repository, opts.Tag)] = fmt.Sprintf("%s@%s", mirrorRepo, opts.Tag)
+			c.lock.Unlock()
+			return nil
+		} else if err == nil {
+			tagOpts := docker.TagImageOptions{Repo: opts.Repository, Tag: opts.Tag, Force: true}
+			return c.DockerClient.TagImage(fmt.Sprintf("%s:%s", mirrorRepo, opts.Tag), tagOpts)
+		}
+
+		c.log.Warnf("Unable to pull image %v:%v from registry mirror %v. Error: %v", opts.Repository, opts.Tag, mirror, err)
+	}
+
+	c.log.Warnf("Pulling image %v:%v from Docker Hub since no registry mirror provided it", opts.Repository, opts.Tag)
+	return c.DockerClient.PullImage(opts, auth)
+}
+
+func (c *mirroringClient) ExportImage(opts docker.ExportImageOptions) error {
+	opts.Name = c.localName(opts.Name)
+	return c.DockerClient.ExportImage(opts)
+}
+
+func (c *mirroringClient) ExportImages(opts docker.ExportImagesOptions) error {
+	names := []string{}
+	for _, name := range opts.Names {
+		names = append(names, c.localName(name))
+	}
+	opts.Names = names
+	return c.DockerClient.ExportImages(opts)
+}
+
+func (c *mirroringClient) TagImage(name string, opts docker.TagImageOptions) error {
+	return c.DockerClient.TagImage(c.localName(name), opts)
+}
+
+// InspectImage adds the Docker Hub equivalents of mirror repository digests to the returned RepoDigests
+func (c *mirroringClient) InspectImage(name string) (*docker.Image, error) {
+	inspected, err := c.DockerClient.InspectImage(c.localName(name))
+	if err != nil || inspected == nil {
+		return inspected, err
+	}
+
+	for _, repoDigest := range inspected.RepoDigests {
+		for _, mirror := range c.mirrors {
+			if strings.HasPrefix(repoDigest, mirror+"/") {
+				if hubRef, err := reference.Parse(strings.TrimPrefix(repoDigest, mirror+"/")); err == nil {
+					inspected.RepoDigests = append(inspected.RepoDigests, hubRef.String())
+				}
+			}
+		}
+	}
+
+	return inspected, nil
+}
@@ -0,0 +1,116 @@
+package create
+
+import (
+	"context"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"github.com/open-horizon/horizon-pkg-build/registry"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// partURLPlaceholder matches the placeholders of part URL templates, e.g. "{pkgid}"
+var partURLPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// partURLFields are the values of the placeholders of a part URL template
+type partURLFields struct {
+	// pkgid is the Pkg ID
+	pkgid string
+
+	// pkgname is the name of the Pkg's output directory, its ID unless another name was given
+	pkgname string
+
+	// hash is the part's SHA-256 hash, its ID in the Pkg metadata
+	hash string
+
+	// filename is the part's file name in the Pkg's parts directory, its hash and extension
+	filename string
+
+	// image is the repository of the image packaged in the part in the form the Docker daemon tags it, e.g. "alpine" or "registry.example.com/team/app"
+	image string
+
+	// arch is the architecture of the image packaged in the part, e.g. "arm64"
+	arch string
+}
+
+// IsPartURLTemplate returns true if the given part URL base is a template
+// with placeholders rather than a prefix of the parts' URLs
+func IsPartURLTemplate(urlBase string) bool {
+	return strings.ContainsAny(urlBase, "{}")
+}
+
+// CheckPartURLTemplate returns an error if the given part URL template has
+// unknown placeholders or unmatched braces. The placeholders are {pkgid},
+// {pkgname}, {hash}, {filename}, {image}, and {arch}.
+func CheckPartURLTemplate(template string) error {
+	for _, placeholder := range partURLPlaceholder.FindAllString(template, -1) {
+		switch placeholder {
+		case "{pkgid}", "{pkgname}", "{hash}", "{filename}", "{image}", "{arch}":
+		default:
+			return fmt.Errorf("Unknown placeholder %v in part URL template %v, expected {pkgid}, {pkgname}, {hash}, {filename}, {image}, or {arch}", placeholder, template)
+		}
+	}
+
+	if IsPartURLTemplate(partURLPlaceholder.ReplaceAllString(template, "")) {
+		return fmt.Errorf("Unmatched brace in part URL template %v", template)
+	}
+
+	return nil
+}
+
+// partURL returns the URL of a part: the template with its placeholders
+// replaced if urlBase is a template, otherwise urlBase followed by the Pkg
+// name and file name
+func partURL(urlBase string, fields partURLFields) string {
+	if !IsPartURLTemplate(urlBase) {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimRight(urlBase, "/"), fields.pkgname, fields.filename)
+	}
+
+	// image repositories keep their slashes, other values are single path segments
+	imagePath := []string{}
+	for _, segment := range strings.Split(fields.image, "/") {
+		imagePath = append(imagePath, url.PathEscape(segment))
+	}
+
+	return strings.NewReplacer(
+		"{pkgid}", url.PathEscape(fields.pkgid),
+		"{pkgname}", url.PathEscape(fields.pkgname),
+		"{hash}", url.PathEscape(fields.hash),
+		"{filename}", url.PathEscape(fields.filename),
+		"{image}", strings.Join(imagePath, "/"),
+		"{arch}", url.PathEscape(fields.arch),
+	).Replace(urlBase)
+}
+
+// imageRepository returns the repository of the image in the short form the
+// Docker daemon uses, or the image as given if it's an image ID
+func imageRepository(image string) string {
+	if IsImageID(image) {
+		return image
+	}
+
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return image
+	}
+	return ref.Repository()
+}
+
+// imageArchitecture returns the architecture of the prepared image: that of
+// the requested platform if any, else that recorded in the image
+func imageArchitecture(ctx context.Context, p preparedImage) (string, error) {
+	if p.platform != "" {
+		platform, err := registry.ParsePlatform(p.platform)
+		if err != nil {
+			return "", err
+		}
+		return platform.Architecture, nil
+	}
+
+	platform, err := p.exporter.Platform(ctx, p.image, "")
+	if err != nil {
+		return "", err
+	}
+	return platform.Architecture, nil
+}
@@ -0,0 +1,295 @@
+package create
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"github.com/open-horizon/rsapss-tool/sign"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parts are built in a pipeline of stages once the images are pulled: each
+// part is written (exported, compressed, and hashed, all streamed at once so
+// the uncompressed image never touches the disk, and with a PartStreamer,
+// neither does the part), then signed, then placed (uploaded if there's a
+// PartUploader, handed off if there's a PartHandoff, and added to the Pkg),
+// so parts are uploaded while others are still exported. Each stage has its
+// own workerPool, so the disk-, CPU-, and network-bound stages can be tuned
+// separately, and hands parts to the next through a channel no larger than
+// the next stage's pool: a stage that falls behind holds up those before it
+// instead of letting finished parts pile up.
+
+// the stages of building a part, as named in timings and failures
+const (
+	stagePull  = "pull"
+	stageWrite = "write"
+	stageSign  = "sign"
+	stagePlace = "place"
+)
+
+// partBuild is a part making its way through the pipeline
+type partBuild struct {
+	// images are all the same image, packaged as one part
+	images []preparedImage
+
+	hash      hash.Hash
+	sha256sum string
+	fileName  string
+	partPath  string // empty if the part was streamed (see PartStreamer)
+	bytes     int64
+	stored    bool
+	signature string
+
+	// encoding is that of the Compressor the part was written with, one of the Encoding* constants
+	encoding string
+}
+
+// stageQueue returns a channel to hand parts to a stage with the given pool through
+func stageQueue(pool workerPool) chan *partBuild {
+	return make(chan *partBuild, cap(pool))
+}
+
+// runStage runs f on each part received from in, on as many at once as the
+// pool allows, and sends those f succeeds with to out, if given. It returns
+// once in is closed and every part is through the stage, closing out.
+// Waiting for a worker holds up receiving from in.
+func runStage(pool workerPool, in <-chan *partBuild, out chan<- *partBuild, f func(*partBuild) bool) {
+	var group sync.WaitGroup
+	for part := range in {
+		part := part
+		group.Add(1)
+		pool.start(func() {
+			defer group.Done()
+			if f(part) && out != nil {
+				out <- part
+			}
+		})
+	}
+
+	group.Wait()
+	if out != nil {
+		close(out)
+	}
+}
+
+// timedStage returns f, logging how long it takes with each part as a debug
+// message, recording it in the summary, and emitting events for each image of
+// the part entering and leaving the stage
+func timedStage(ctx context.Context, reporter *cmdtools.SynchronizedReporter, summary *BuildSummary, stage string, f func(*partBuild) bool) func(*partBuild) bool {
+	log := reporter.Log.WithContext(ctx)
+	return func(part *partBuild) bool {
+		started := time.Now()
+		for _, image := range part.images {
+			reporter.StageStarted(ctx, stage, image.image)
+		}
+		ok := f(part)
+		took := time.Since(started)
+		summary.staged(stage, part, started, took)
+		for _, image := range part.images {
+			reporter.StageFinished(ctx, stage, image.image, took, ok)
+		}
+		log.Debugf("Stage '%v' of Docker image %v took %v", stage, part.images[0].image, took.Round(time.Millisecond))
+		return ok
+	}
+}
+
+// writeStage exports, compresses, and hashes a part, or reuses it from the
+// journal or cache; the part is streamed to the streamer, if there is one,
+// instead of written to tmpDir
+func writeStage(ctx context.Context, reporter *cmdtools.SynchronizedReporter, events eventHandler, policy ImagePolicy, cache *partCache, journal *partCache, phases *buildJournal, summary *BuildSummary, exports workerPool, streamer PartStreamer, pkgName string, tmpDir string, bufferSize int, compressor Compressor, compression string, part *partBuild) bool {
+	log := reporter.Log.WithContext(ctx)
+	if ctx.Err() != nil {
+		return false
+	}
+
+	image := part.images[0].image
+	if len(part.images) > 1 {
+		log.Warnf("Docker images %v are the same image (image ID %v), packaging them as one part", strings.Join(imageNames(part.images), ", "), part.images[0].imageID)
+	}
+
+	log.Subsystem(cmdtools.SubsystemCompress).Debugf("Writing part for Docker image %v with compressor %v, compression '%v', and I/O buffer size %v", image, compressorOf(compressor), compression, cmdtools.FormatByteSize(int64(bufferSize)))
+	var took time.Duration
+	names := imageNames(part.images)
+	err := exports.do(func() error {
+		writing := time.Now()
+		events.send(Event{Kind: EventPartStarted, Images: names, Total: part.images[0].size})
+		var err error
+		if streamer != nil {
+			part.hash, part.fileName, part.bytes, part.stored, err = streamPart(ctx, policy, streamer, pkgName, bufferSize, compressor, compression, events.exported(names, part.images[0].size), part.images)
+		} else {
+			part.hash, part.fileName, part.partPath, part.bytes, part.stored, err = writePart(ctx, policy, cache, journal, tmpDir, bufferSize, compressor, compression, events.exported(names, part.images[0].size), part.images)
+		}
+		took = time.Since(writing)
+		return err
+	})
+	if ctx.Err() != nil {
+		// cancelled; failures of cancelled operations aren't worth reporting
+		return false
+	} else if err != nil {
+		phases.record(phaseFailed, image, "", 0, err)
+		reporter.Fail(ctx, imageFailure(cmdtools.ErrExport, stageWrite, image, "", fmt.Sprintf("Error writing docker image %v", image), err))
+		return false
+	}
+
+	part.sha256sum = fmt.Sprintf("%x", part.hash.Sum(nil))
+	part.encoding = compressorOf(compressor).Encoding()
+	phases.record(phaseWritten, image, part.sha256sum, part.bytes, nil)
+	summary.written(part, took)
+	if part.stored {
+		log.Subsystem(cmdtools.SubsystemCompress).Infof("Docker image %v compresses poorly, stored its part mostly uncompressed", image)
+	}
+	if streamer != nil {
+		log.Subsystem(cmdtools.SubsystemCompress).Infof("Streamed Docker image %v as: %v", image, part.fileName)
+		log.Subsystem(cmdtools.SubsystemCompress).Debugf("Part of Docker image %v is %v compressed, streamed to: %v", image, cmdtools.FormatByteSize(part.bytes), streamer.URL(fmt.Sprintf("%s/%s", pkgName, part.fileName)))
+		return true
+	}
+	log.Subsystem(cmdtools.SubsystemCompress).Infof("Wrote Docker image %v as: %v", image, part.fileName)
+	log.Subsystem(cmdtools.SubsystemCompress).Debugf("Part of Docker image %v is %v compressed, at: %v", image, cmdtools.FormatByteSize(part.bytes), part.partPath)
+	return true
+}
+
+// signStage signs the hash of a written part
+func signStage(ctx context.Context, reporter *cmdtools.SynchronizedReporter, phases *buildJournal, privateKey *rsa.PrivateKey, part *partBuild) bool {
+	log := reporter.Log.WithContext(ctx)
+	if ctx.Err() != nil {
+		return false
+	}
+
+	image := part.images[0].image
+
+	// N.B. The signature is on the *uncompressed* content
+	signature, err := sign.Sha256HashOfInput(privateKey, part.hash)
+	if err != nil {
+		phases.record(phaseFailed, image, part.sha256sum, 0, err)
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrSigning, Stage: stageSign, Image: image, Part: part.sha256sum, Msg: fmt.Sprintf("Error hashing docker image %v", image), Err: err})
+		return false
+	}
+	part.signature = signature
+	phases.record(phaseSigned, image, part.sha256sum, 0, nil)
+
+	log.Subsystem(cmdtools.SubsystemSign).Infof("Signed hash for image: %v", image)
+	log.Subsystem(cmdtools.SubsystemSign).Debugf("Signed hash of part %v of Docker image %v with a %v-bit RSA-PSS key", part.sha256sum, image, privateKey.N.BitLen())
+	return true
+}
+
+// placeStage uploads a signed part if there's a PartUploader, hands it off if
+// there's a PartHandoff, and adds it to the Pkg, whose parts are named under
+// pkgName
+func placeStage(ctx context.Context, reporter *cmdtools.SynchronizedReporter, events eventHandler, phases *buildJournal, summary *BuildSummary, pkgBuilder *horizonpkg.PkgBuilder, pkgName string, annotations *partAnnotations, urlBase string, partDestination PartDestination, handoff PartHandoff, part *partBuild) bool {
+	log := reporter.Log.WithContext(ctx)
+	if ctx.Err() != nil {
+		return false
+	}
+
+	image := part.images[0].image
+
+	// a tag may be moved after the build, so record which image each of the part's names referred to
+	resolvedDigests := map[string]string{}
+	for _, p := range part.images {
+		resolver, ok := p.exporter.(digestResolver)
+		if !ok {
+			continue
+		}
+
+		resolvedDigest, err := resolver.Digest(p.image, p.platform)
+		if err != nil {
+			phases.record(phaseFailed, image, part.sha256sum, 0, err)
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Stage: stagePlace, Image: p.image, Part: part.sha256sum, Msg: fmt.Sprintf("Error resolving digest of docker image %v", p.image), Err: err})
+			return false
+		} else if resolvedDigest != "" {
+			log.Subsystem(cmdtools.SubsystemDocker).Infof("Resolved Docker image %v to: %v", p.image, resolvedDigest)
+			resolvedDigests[p.image] = resolvedDigest
+		}
+	}
+
+	// without a PartDestination, just construct a URL for the part and write that in the pkg; uploads are verified once the whole Pkg is uploaded
+	// note: this assumes no funny business was done in writePart
+	partName := fmt.Sprintf("%s/%s", pkgName, part.fileName)
+	if part.images[0].urlBase != "" {
+		urlBase = part.images[0].urlBase
+	}
+
+	fields := partURLFields{pkgid: pkgBuilder.ID(), pkgname: pkgName, hash: part.sha256sum, filename: part.fileName, image: imageRepository(image)}
+	if partDestination == nil && strings.Contains(urlBase, "{arch}") {
+		var err error
+		fields.arch, err = imageArchitecture(ctx, part.images[0])
+		if err != nil {
+			phases.record(phaseFailed, image, part.sha256sum, 0, err)
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Stage: stagePlace, Image: image, Part: part.sha256sum, Msg: fmt.Sprintf("Error determining architecture of docker image %v", image), Err: err})
+			return false
+		}
+	}
+	source := horizonpkg.PartSource{URL: partURL(urlBase, fields)}
+
+	// streamed parts are at their destination already
+	if partUploader, ok := partDestination.(PartUploader); ok && part.partPath != "" {
+		if err := partUploader.Put(ctx, partName, part.partPath); err != nil {
+			phases.record(phaseFailed, image, part.sha256sum, 0, err)
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrPublish, Stage: stagePlace, Image: image, Part: part.sha256sum, Msg: fmt.Sprintf("Error uploading part for docker image %v", image), Err: err})
+			return false
+		}
+
+		log.Subsystem(cmdtools.SubsystemUpload).Infof("Uploaded part for image %v to: %v", image, partUploader.URL(partName))
+	}
+
+	if handoff != nil && part.partPath != "" {
+		if err := handoff.Put(ctx, partName, part.partPath); err != nil {
+			phases.record(phaseFailed, image, part.sha256sum, 0, err)
+			reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrPublish, Stage: stagePlace, Image: image, Part: part.sha256sum, Msg: fmt.Sprintf("Error handing off part for docker image %v", image), Err: err})
+			return false
+		}
+
+		log.Subsystem(cmdtools.SubsystemUpload).Debugf("Handed off part for image %v as: %v", image, partName)
+	}
+
+	if partDestination != nil {
+		source.URL = partDestination.URL(partName)
+	}
+
+	// we use the shasum as the name for the part
+	if _, err := pkgBuilder.AddPart(part.sha256sum, part.sha256sum, image, []string{part.signature}, part.bytes, source); err != nil {
+		phases.record(phaseFailed, image, part.sha256sum, 0, err)
+		reporter.Fail(ctx, &cmdtools.Failure{Kind: cmdtools.ErrFailed, Stage: stagePlace, Image: image, Part: part.sha256sum, Msg: fmt.Sprintf("Error adding Pkg part %v", part.sha256sum), Err: err})
+		return false
+	}
+
+	// the names of a part with several record their digests by name, beside the names themselves
+	if len(part.images) > 1 {
+		annotations.set(part.sha256sum, "images", imageNames(part.images))
+		if len(resolvedDigests) > 0 {
+			annotations.set(part.sha256sum, "resolvedDigests", resolvedDigests)
+		}
+	} else if resolvedDigest, exists := resolvedDigests[image]; exists {
+		annotations.set(part.sha256sum, "requestedReference", image)
+		annotations.set(part.sha256sum, "resolvedDigest", resolvedDigest)
+	}
+
+	if part.stored {
+		annotations.set(part.sha256sum, "compression", "stored")
+	}
+
+	// fetchers assume gzip of parts without an encoding, as all parts were before others were supported
+	if part.encoding != EncodingGzip {
+		annotations.set(part.sha256sum, "encoding", part.encoding)
+	}
+
+	phases.record(phasePlaced, image, part.sha256sum, part.bytes, nil)
+	summary.placed(part, source.URL)
+	events.send(Event{Kind: EventPartCompleted, Images: imageNames(part.images), Bytes: part.bytes, Total: part.images[0].size, Sha256sum: part.sha256sum, URL: source.URL})
+	log.Infof("Part added to pkg %v for image: %v", pkgBuilder.ID(), image)
+	return true
+}
+
+// imageNames returns the names of the given images
+func imageNames(images []preparedImage) []string {
+	names := []string{}
+	for _, p := range images {
+		names = append(names, p.image)
+	}
+	return names
+}
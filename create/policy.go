@@ -0,0 +1,80 @@
+package create
+
+import (
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+)
+
+// ImagePolicy restricts the images that may be packaged. The zero value permits any image.
+type ImagePolicy struct {
+	// MaxSize is the largest uncompressed image size in bytes permitted, or 0 for no limit
+	MaxSize int64
+
+	// AllowedRegistries lists the registries (e.g. "docker.io" or
+	// "registry.example.com:5000") images may come from; if empty, any
+	// registry is permitted
+	AllowedRegistries []string
+
+	// RequireCredentials refuses images that would be pulled from a registry
+	// no credentials are configured for, rather than pulling them anonymously
+	RequireCredentials bool
+}
+
+// PolicyError reports an image refused by an ImagePolicy
+type PolicyError struct {
+	Image  string
+	Reason string
+}
+
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("Image %v refused by policy: %v", e.Image, e.Reason)
+}
+
+// Is tells if target is cmdtools.ErrPolicy, the kind of failure a PolicyError is
+func (e PolicyError) Is(target error) bool {
+	return target == cmdtools.ErrPolicy
+}
+
+// CheckRegistry returns a PolicyError if the given image doesn't come from an
+// allowed registry. Local image IDs can't be attributed to a registry so
+// they're refused if any registries are listed.
+func (p ImagePolicy) CheckRegistry(image string) error {
+	if len(p.AllowedRegistries) == 0 {
+		return nil
+	}
+
+	if IsImageID(image) {
+		return PolicyError{Image: image, Reason: "local image IDs can't be attributed to an allowed registry"}
+	}
+
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return err
+	}
+
+	for _, allowed := range p.AllowedRegistries {
+		if allowed == ref.Domain || (ref.Domain == reference.DefaultDomain && allowed == "index.docker.io") {
+			return nil
+		}
+	}
+
+	return PolicyError{Image: image, Reason: fmt.Sprintf("registry %v is not among the allowed registries %v", ref.Domain, p.AllowedRegistries)}
+}
+
+// checkCredentials returns a PolicyError if credentials are required and
+// none were found for the registry the given image is pulled from
+func (p ImagePolicy) checkCredentials(image string, serverAddress string, found bool) error {
+	if p.RequireCredentials && !found {
+		return PolicyError{Image: image, Reason: fmt.Sprintf("no credentials are configured for registry %v", serverAddress)}
+	}
+	return nil
+}
+
+// checkSize returns a PolicyError if the given uncompressed image size exceeds the maximum
+func (p ImagePolicy) checkSize(image string, size int64) error {
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return PolicyError{Image: image, Reason: fmt.Sprintf("its uncompressed size %v exceeds the maximum of %v", cmdtools.FormatByteSize(size), cmdtools.FormatByteSize(p.MaxSize))}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package create
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pullMessage is a message in the Docker daemon's JSON pull progress stream
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	Error          string `json:"error"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+type layerProgress struct {
+	downloaded int64
+	total      int64
+	complete   bool
+}
+
+// pullProgress consumes a Docker pull's JSON progress stream and reports
+// layer download progress to out (see cmdtools.Progress). It records errors
+// reported in the stream, which the client doesn't surface when passing the
+// raw stream through.
+type pullProgress struct {
+	progress *cmdtools.Progress
+	partial  []byte
+	layers   map[string]*layerProgress
+	err      error
+}
+
+func newPullProgress(out io.Writer, image string, interval time.Duration) *pullProgress {
+	return &pullProgress{
+		progress: cmdtools.NewProgress(out, fmt.Sprintf("Pulling Docker image %v", image), "downloaded", 0, interval),
+		layers:   map[string]*layerProgress{},
+	}
+}
+
+func (p *pullProgress) Write(b []byte) (int, error) {
+	p.partial = append(p.partial, b...)
+
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := bytes.TrimSpace(p.partial[:i])
+		p.partial = p.partial[i+1:]
+
+		if len(line) > 0 {
+			p.handle(line)
+		}
+	}
+
+	if complete, layers, downloaded, total := p.summary(); layers > 0 {
+		p.progress.Update(downloaded, total, fmt.Sprintf("%v of %v layers complete", complete, layers))
+	}
+
+	return len(b), nil
+}
+
+func (p *pullProgress) handle(line []byte) {
+	var msg pullMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		// not worth failing a pull over
+		return
+	}
+
+	if msg.Error != "" {
+		p.err = errors.New(msg.Error)
+		return
+	}
+
+	// messages without an ID (e.g. "Digest: ...") or about the image itself ("Pulling from ...") don't describe layers
+	if msg.ID == "" || strings.HasPrefix(msg.Status, "Pulling from") {
+		return
+	}
+
+	layer, exists := p.layers[msg.ID]
+	if !exists {
+		layer = &layerProgress{}
+		p.layers[msg.ID] = layer
+	}
+
+	switch msg.Status {
+	case "Downloading":
+		layer.downloaded = msg.ProgressDetail.Current
+		layer.total = msg.ProgressDetail.Total
+	case "Download complete", "Verifying Checksum":
+		layer.downloaded = layer.total
+	case "Pull complete", "Already exists":
+		layer.downloaded = layer.total
+		layer.complete = true
+	}
+}
+
+func (p *pullProgress) summary() (int, int, int64, int64) {
+	var complete int
+	var downloaded, total int64
+
+	for _, layer := range p.layers {
+		if layer.complete {
+			complete++
+		}
+		downloaded += layer.downloaded
+		total += layer.total
+	}
+
+	return complete, len(p.layers), downloaded, total
+}
+
+// progressClient is a DockerClient that reports the progress of pulls and
+// exports. The progress of an export is the uncompressed bytes streamed out
+// of the daemon, of the image's size if it was inspected through the client.
+type progressClient struct {
+	DockerClient
+	reporter *cmdtools.SynchronizedReporter
+	log      *cmdtools.Logger
+	interval time.Duration
+
+	lock  sync.Mutex
+	sizes map[string]int64
+}
+
+func newProgressClient(client DockerClient, ctx context.Context, reporter *cmdtools.SynchronizedReporter, interval time.Duration) *progressClient {
+	return &progressClient{
+		DockerClient: client,
+		reporter:     reporter,
+		log:          reporter.Log.WithContext(ctx).Subsystem(cmdtools.SubsystemDocker),
+		interval:     interval,
+		sizes:        map[string]int64{},
+	}
+}
+
+func (c *progressClient) InspectImage(name string) (*docker.Image, error) {
+	image, err := c.DockerClient.InspectImage(name)
+	if err == nil && image != nil {
+		size := image.VirtualSize
+		if size < image.Size {
+			size = image.Size
+		}
+
+		c.lock.Lock()
+		c.sizes[name] = size
+		c.lock.Unlock()
+	}
+	return image, err
+}
+
+// exportProgress starts reporting the progress of an export of the named image
+func (c *progressClient) exportProgress(name string) *cmdtools.Progress {
+	c.lock.Lock()
+	size := c.sizes[name]
+	c.lock.Unlock()
+
+	return cmdtools.NewProgress(c.reporter.ErrWriter, fmt.Sprintf("Exporting and compressing Docker image %v", name), "exported", size, c.interval)
+}
+
+func (c *progressClient) ExportImage(opts docker.ExportImageOptions) error {
+	progress := c.exportProgress(opts.Name)
+	defer progress.Finish()
+
+	opts.OutputStream = io.MultiWriter(opts.OutputStream, progress)
+	return c.DockerClient.ExportImage(opts)
+}
+
+func (c *progressClient) ExportImages(opts docker.ExportImagesOptions) error {
+	progress := c.exportProgress(opts.Names[0])
+	defer progress.Finish()
+
+	opts.OutputStream = io.MultiWriter(opts.OutputStream, progress)
+	return c.DockerClient.ExportImages(opts)
+}
+
+func (c *progressClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	image := fmt.Sprintf("%v:%v", opts.Repository, opts.Tag)
+
+	progress := newPullProgress(c.reporter.ErrWriter, image, c.interval)
+	defer progress.progress.Finish()
+
+	opts.OutputStream = progress
+	opts.RawJSONStream = true
+
+	if err := c.DockerClient.PullImage(opts, auth); err != nil {
+		return err
+	}
+
+	if progress.err != nil {
+		return progress.err
+	}
+
+	_, layers, _, total := progress.summary()
+	c.log.Infof("Pulled Docker image %v: %v layers, %v", image, layers, cmdtools.FormatByteSize(total))
+	return nil
+}
@@ -0,0 +1,187 @@
+package create
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// retagExport writes what export writes to out, a Docker image archive, with
+// the given tags recorded for the images of the given IDs (see retagArchive)
+func retagExport(out io.Writer, tags map[string][]string, export func(io.Writer) error) error {
+	archive, pipe := io.Pipe()
+
+	retagged := make(chan error, 1)
+	go func() {
+		err := retagArchive(archive, out, tags)
+
+		// the export fails rather than blocking if the archive can't be read
+		archive.CloseWithError(err)
+		retagged <- err
+	}()
+
+	err := export(pipe)
+	pipe.CloseWithError(err)
+	if retagErr := <-retagged; err == nil {
+		err = retagErr
+	}
+	return err
+}
+
+// retagArchive copies a Docker image archive from r to w, adding the given
+// tags to the RepoTags of the images of the given IDs in its manifest.json,
+// and to its repositories file, which older Docker versions load images by.
+// Images exported by digest (e.g. a platform's variant) are recorded without
+// tags, and pointing the local tag at them instead would move it for every
+// other user of the Docker daemon.
+func retagArchive(r io.Reader, w io.Writer, tags map[string][]string) error {
+	in := tar.NewReader(r)
+	out := tar.NewWriter(w)
+
+	var repositories map[string]map[string]string
+	for {
+		header, err := in.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var content []byte
+		switch header.Name {
+		case "manifest.json":
+			if content, repositories, err = retagManifest(in, tags); err != nil {
+				return err
+			}
+		case "repositories":
+			if content, err = mergeRepositories(in, repositories); err != nil {
+				return err
+			}
+			repositories = nil
+		default:
+			if err := out.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, in); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header.Size = int64(len(content))
+		if err := out.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := out.Write(content); err != nil {
+			return err
+		}
+	}
+
+	// archives of images without tags have no repositories file to merge them into
+	if len(repositories) > 0 {
+		content, err := json.Marshal(repositories)
+		if err != nil {
+			return err
+		}
+		if err := out.WriteHeader(&tar.Header{Name: "repositories", Mode: 0644, Size: int64(len(content))}); err != nil {
+			return err
+		}
+		if _, err := out.Write(content); err != nil {
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// the padding after the archive's end
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// retagManifest returns the manifest.json read from r with the given tags
+// added to the RepoTags of the images of the given IDs, whose Config names
+// their ID, and the repositories file entries of those tags, by repository
+// and tag, naming the ID of each image's top layer
+func retagManifest(r io.Reader, tags map[string][]string) ([]byte, map[string]map[string]string, error) {
+	var manifest []map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, nil, err
+	}
+
+	repositories := map[string]map[string]string{}
+	for _, entry := range manifest {
+		var config string
+		var repoTags, layers []string
+		json.Unmarshal(entry["Config"], &config)
+		json.Unmarshal(entry["RepoTags"], &repoTags)
+		json.Unmarshal(entry["Layers"], &layers)
+
+		for id, names := range tags {
+			hex := strings.TrimPrefix(id, "sha256:")
+			if hex == "" || !strings.Contains(config, hex) {
+				continue
+			}
+
+			for _, name := range names {
+				if !containsString(repoTags, name) {
+					repoTags = append(repoTags, name)
+				}
+
+				// layers are recorded as '<layer ID>/layer.tar'
+				if i := strings.LastIndex(name, ":"); i > 0 && len(layers) > 0 {
+					repo, tag := name[:i], name[i+1:]
+					if repositories[repo] == nil {
+						repositories[repo] = map[string]string{}
+					}
+					repositories[repo][tag] = strings.Split(layers[len(layers)-1], "/")[0]
+				}
+			}
+		}
+
+		encoded, err := json.Marshal(repoTags)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry["RepoTags"] = encoded
+	}
+
+	content, err := json.Marshal(manifest)
+	return content, repositories, err
+}
+
+// mergeRepositories returns the repositories file read from r with the given
+// entries added to it
+func mergeRepositories(r io.Reader, entries map[string]map[string]string) ([]byte, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil || len(entries) == 0 {
+		return content, err
+	}
+
+	repositories := map[string]map[string]string{}
+	if err := json.NewDecoder(bytes.NewReader(content)).Decode(&repositories); err != nil {
+		return nil, err
+	}
+	for repo, tags := range entries {
+		if repositories[repo] == nil {
+			repositories[repo] = map[string]string{}
+		}
+		for tag, layer := range tags {
+			repositories[repo][tag] = layer
+		}
+	}
+	return json.Marshal(repositories)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
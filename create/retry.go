@@ -0,0 +1,105 @@
+package create
+
+import (
+	"context"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// rewindable is satisfied by export destinations like *os.File that can be reset for another attempt
+type rewindable interface {
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// retryingClient is a DockerClient that retries failed pulls and exports
+// according to a RetryPolicy, reporting each failed attempt, until the
+// context is done
+type retryingClient struct {
+	DockerClient
+	ctx    context.Context
+	policy cmdtools.RetryPolicy
+	log    *cmdtools.Logger
+}
+
+func newRetryingClient(client DockerClient, ctx context.Context, policy cmdtools.RetryPolicy, reporter *cmdtools.SynchronizedReporter) *retryingClient {
+	return &retryingClient{
+		DockerClient: client,
+		ctx:          ctx,
+		policy:       policy,
+		log:          reporter.Log.WithContext(ctx).Subsystem(cmdtools.SubsystemDocker),
+	}
+}
+
+// classify marks errors the daemon reports for bad requests (e.g. a missing image or tag) as permanent
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if reason, _ := pullFailureReason(err); err == docker.ErrNoSuchImage || reason != "" {
+		return cmdtools.PermanentError{Err: err}
+	}
+
+	if dockerErr, ok := err.(*docker.Error); ok {
+		if dockerErr.Status >= 400 && dockerErr.Status < 500 && dockerErr.Status != http.StatusRequestTimeout && dockerErr.Status != http.StatusTooManyRequests {
+			return cmdtools.PermanentError{Err: err}
+		}
+	}
+
+	return err
+}
+
+func (c *retryingClient) notify(operation string) func(int, error, time.Duration) {
+	return func(retry int, err error, delay time.Duration) {
+		c.log.Warnf("Attempt %v of %v to %v failed. Retrying in %v. Error: %v", retry, c.policy.MaxRetries+1, operation, delay.Round(time.Millisecond), err)
+	}
+}
+
+func (c *retryingClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	return c.policy.RetryContext(c.ctx, func() error {
+		return classify(c.DockerClient.PullImage(opts, auth))
+	}, c.notify(fmt.Sprintf("pull image %v:%v", opts.Repository, opts.Tag)))
+}
+
+func (c *retryingClient) ExportImage(opts docker.ExportImageOptions) error {
+	return c.retryExport(opts.OutputStream, fmt.Sprintf("export image %v", opts.Name), func() error {
+		return c.DockerClient.ExportImage(opts)
+	})
+}
+
+func (c *retryingClient) ExportImages(opts docker.ExportImagesOptions) error {
+	return c.retryExport(opts.OutputStream, fmt.Sprintf("export images %v", strings.Join(opts.Names, ", ")), func() error {
+		return c.DockerClient.ExportImages(opts)
+	})
+}
+
+// retryExport retries an export, discarding the content of failed attempts from its destination
+func (c *retryingClient) retryExport(out io.Writer, operation string, export func() error) error {
+	dest, canRewind := out.(rewindable)
+
+	first := true
+	return c.policy.RetryContext(c.ctx, func() error {
+		if !first {
+			if _, err := dest.Seek(0, io.SeekStart); err != nil {
+				return cmdtools.PermanentError{Err: err}
+			}
+			if err := dest.Truncate(0); err != nil {
+				return cmdtools.PermanentError{Err: err}
+			}
+		}
+		first = false
+
+		err := classify(export())
+		if err != nil && !canRewind {
+			// a partial export can't be discarded
+			return cmdtools.PermanentError{Err: err}
+		}
+		return err
+	}, c.notify(operation))
+}
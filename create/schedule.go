@@ -0,0 +1,61 @@
+package create
+
+import (
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"sort"
+)
+
+// localImageSizes returns the uncompressed sizes of the images the Docker
+// daemon has, keyed by every tag, digest reference, and ID they're known by
+func localImageSizes(client ImageSource) (map[string]int64, error) {
+	images, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	for _, im := range images {
+		// the virtual size includes layers shared with other images, all of which are exported
+		size := im.VirtualSize
+		if size < im.Size {
+			size = im.Size
+		}
+
+		sizes[im.ID] = size
+		for _, name := range append(im.RepoTags, im.RepoDigests...) {
+			sizes[name] = size
+		}
+	}
+	return sizes, nil
+}
+
+// sizeOf looks up the size of the named image in sizes from localImageSizes,
+// returning 0 if it isn't known
+func sizeOf(sizes map[string]int64, image string) int64 {
+	if size, exists := sizes[image]; exists {
+		return size
+	}
+
+	// the daemon records images under the short form of their names
+	if ref, err := reference.Parse(image); err == nil {
+		return sizes[ref.String()]
+	}
+	return 0
+}
+
+// largestFirst returns the indices 0 to n-1 ordered by the sizes size gives
+// them, largest first, so that when work is bounded by a workerPool the
+// longest operations start first rather than last. Indices of equal size,
+// including those whose size isn't known (0), keep their order.
+func largestFirst(n int, size func(i int) int64) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return size(order[a]) > size(order[b])
+	})
+	return order
+}
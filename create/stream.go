@@ -0,0 +1,132 @@
+package create
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// PartStreamer is a PartDestination that parts are streamed to as they're
+// written, instead of being written to a temporary directory first, so a
+// build needs no local disk for its parts (e.g. a service piping them
+// straight to object storage). Without an OutputDir, a build with a
+// PartStreamer writes nothing to disk at all: the Pkg metadata and its
+// signature are only returned in the Result. A part's name, and so its URL,
+// is known only once its content is read to its end, so a streamer whose
+// objects are named when they're created stores each under a name of its own
+// choosing and renames it then.
+type PartStreamer interface {
+	PartDestination
+
+	// StreamPart reads the part's content until io.EOF and keeps it, e.g.
+	// uploads it, returning once it's kept; it's called by concurrent
+	// workers. A read fails if the export does, and StreamPart should then
+	// fail with that error.
+	StreamPart(ctx context.Context, part *PartStream) error
+}
+
+// PartStream is a part streamed to a PartStreamer as its images are
+// exported and compressed
+type PartStream struct {
+	// Images are those of the part, which are all the same image
+	Images []string
+
+	// Content is the compressed content of the part
+	Content io.Reader
+
+	// Encoding is the encoding of the content, one of the Encoding* constants,
+	// and Extension the file extension of the part, e.g. ".tgz"
+	Encoding  string
+	Extension string
+
+	pkgName   string
+	lock      sync.Mutex
+	sha256sum string
+	bytes     int64
+}
+
+// Sha256sum returns the hex SHA-256 hash of the content once it's been read
+// to its end, or "" before
+func (p *PartStream) Sha256sum() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.sha256sum
+}
+
+// Bytes returns the size of the content once it's been read to its end
+func (p *PartStream) Bytes() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.bytes
+}
+
+// Name returns the name the part is recorded under once its content has been
+// read to its end, the Pkg's name and the part's file name joined by "/" as
+// PartDestination.URL is given, or "" before
+func (p *PartStream) Name() string {
+	sum := p.Sha256sum()
+	if sum == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s%s", p.pkgName, sum, p.Extension)
+}
+
+// finish records the hash and size of the content, before its end is read
+func (p *PartStream) finish(sha256sum string, bytes int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sha256sum, p.bytes = sha256sum, bytes
+}
+
+// errStreamAbandoned is the error an export into a part stream fails with if
+// the PartStreamer returns without reading the content to its end
+var errStreamAbandoned = errors.New("Part stream closed before its end was read")
+
+// streamPart exports and compresses the given images readied by
+// prepareImage, which are all the same image, as the compression mode says,
+// streaming the part to the streamer as it's written and telling progress,
+// if set, the uncompressed bytes exported so far. Returns sha256hash,
+// filename, size, whether compression was skipped for any of it, and err. A
+// failed export can't be retried, since what it streamed can't be taken back.
+// N.B. The hash is calculated on the *compressed* content.
+func streamPart(ctx context.Context, policy ImagePolicy, streamer PartStreamer, pkgName string, bufferSize int, compressor Compressor, compression string, progress func(int64), images []preparedImage) (hash.Hash, string, int64, bool, error) {
+	first := images[0]
+
+	content, pipe := io.Pipe()
+	out, err := newCompressedWriter(ctx, pipe, bufferSize, compressor, compression)
+	if err != nil {
+		return nil, "", 0, false, err
+	}
+	out.progress = progress
+
+	stream := &PartStream{Images: imageNames(images), Content: content, Encoding: out.compressor.Encoding(), Extension: out.compressor.Extension(), pkgName: pkgName}
+
+	exported := make(chan error, 1)
+	go func() {
+		err := exportTo(ctx, policy, first.platform, first.exporter, out, imageNames(images))
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			// known to the streamer once it reads the end of the content
+			stream.finish(fmt.Sprintf("%x", out.hash.Sum(nil)), out.compressed.n)
+		}
+		pipe.CloseWithError(err)
+		exported <- err
+	}()
+
+	streamErr := streamer.StreamPart(ctx, stream)
+
+	// an export the streamer stopped reading mustn't wait for it forever
+	content.CloseWithError(errStreamAbandoned)
+	if err := <-exported; err != nil && (streamErr == nil || !errors.Is(err, errStreamAbandoned)) {
+		return nil, "", 0, false, err
+	} else if streamErr != nil {
+		return nil, "", 0, false, fmt.Errorf("Unable to stream part. Error: %v", streamErr)
+	}
+
+	return out.hash, fmt.Sprintf("%s%s", stream.Sha256sum(), stream.Extension), out.compressed.n, out.stored, nil
+}
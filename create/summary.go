@@ -0,0 +1,180 @@
+package create
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ImageSummary describes how the part of an image was built
+type ImageSummary struct {
+	Image string `json:"image"`
+
+	// PullSeconds and ExportSeconds are the times the pull (or inspection, if
+	// the pull was skipped) and the export, compression, and hashing of the
+	// part took, not counting waits for a worker
+	PullSeconds   float64 `json:"pullSeconds"`
+	ExportSeconds float64 `json:"exportSeconds"`
+
+	// SignSeconds and PlaceSeconds are the times signing the part and
+	// uploading it (if it's uploaded as it's built) and adding it to the Pkg took
+	SignSeconds  float64 `json:"signSeconds"`
+	PlaceSeconds float64 `json:"placeSeconds"`
+
+	// Bytes is the image's uncompressed size, if the Docker daemon reported it
+	Bytes           int64 `json:"bytes,omitempty"`
+	CompressedBytes int64 `json:"compressedBytes"`
+
+	// CompressionRatio is Bytes over CompressedBytes, if both are known
+	CompressionRatio float64 `json:"compressionRatio,omitempty"`
+
+	Sha256sum string `json:"sha256sum"`
+	URL       string `json:"url"`
+}
+
+// StageSummary describes how long a stage of the build took in all: the
+// wall-clock time from when the first image entered it to when the last left
+// it, which includes waits for workers and overlaps the other stages
+type StageSummary struct {
+	Stage   string  `json:"stage"`
+	Seconds float64 `json:"seconds"`
+}
+
+// BuildSummary collects an ImageSummary for each image as a Pkg is built, and
+// how long each stage took. Times are measured with the monotonic clock, so
+// changes to the wall clock during the build don't skew them. It's safe for
+// concurrent use; a nil BuildSummary collects nothing.
+type BuildSummary struct {
+	lock   sync.Mutex
+	images map[string]*ImageSummary
+	stages map[string]*stageSpan
+}
+
+// stageSpan is when a stage was first entered and last left
+type stageSpan struct {
+	started  time.Time
+	finished time.Time
+}
+
+// NewBuildSummary returns an empty BuildSummary
+func NewBuildSummary() *BuildSummary {
+	return &BuildSummary{images: map[string]*ImageSummary{}, stages: map[string]*stageSpan{}}
+}
+
+// Stages returns the summaries of the stages the build entered, in the order
+// images go through them: "pull", "write", "sign", and "place"
+func (s *BuildSummary) Stages() []StageSummary {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	summaries := []StageSummary{}
+	for _, stage := range []string{stagePull, stageWrite, stageSign, stagePlace} {
+		if span, exists := s.stages[stage]; exists {
+			summaries = append(summaries, StageSummary{Stage: stage, Seconds: span.finished.Sub(span.started).Seconds()})
+		}
+	}
+	return summaries
+}
+
+// spanned records that an image was in the stage from started for took
+func (s *BuildSummary) spanned(stage string, started time.Time, took time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	finished := started.Add(took)
+	span, exists := s.stages[stage]
+	if !exists {
+		s.stages[stage] = &stageSpan{started: started, finished: finished}
+		return
+	}
+
+	if started.Before(span.started) {
+		span.started = started
+	}
+	if finished.After(span.finished) {
+		span.finished = finished
+	}
+}
+
+// Images returns the summaries of the images, sorted by image
+func (s *BuildSummary) Images() []ImageSummary {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	summaries := []ImageSummary{}
+	for _, summary := range s.images {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Image < summaries[j].Image })
+	return summaries
+}
+
+// update calls f with the summary of each of the images, while locked
+func (s *BuildSummary) update(images []string, f func(*ImageSummary)) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, image := range images {
+		summary, exists := s.images[image]
+		if !exists {
+			summary = &ImageSummary{Image: image}
+			s.images[image] = summary
+		}
+		f(summary)
+	}
+}
+
+func (s *BuildSummary) pulled(image string, took time.Duration) {
+	s.update([]string{image}, func(summary *ImageSummary) {
+		summary.PullSeconds = took.Seconds()
+	})
+}
+
+// written records the part of the images, which are all the same image, as
+// written, with the uncompressed size of the first if known
+func (s *BuildSummary) written(part *partBuild, took time.Duration) {
+	s.update(imageNames(part.images), func(summary *ImageSummary) {
+		summary.ExportSeconds = took.Seconds()
+		summary.Bytes = part.images[0].size
+		summary.CompressedBytes = part.bytes
+		summary.Sha256sum = part.sha256sum
+		if summary.Bytes > 0 && summary.CompressedBytes > 0 {
+			summary.CompressionRatio = float64(summary.Bytes) / float64(summary.CompressedBytes)
+		}
+	})
+}
+
+func (s *BuildSummary) placed(part *partBuild, url string) {
+	s.update(imageNames(part.images), func(summary *ImageSummary) {
+		summary.URL = url
+	})
+}
+
+// staged records the time the part spent in the stage
+func (s *BuildSummary) staged(stage string, part *partBuild, started time.Time, took time.Duration) {
+	s.spanned(stage, started, took)
+	s.update(imageNames(part.images), func(summary *ImageSummary) {
+		switch stage {
+		case stageSign:
+			summary.SignSeconds = took.Seconds()
+		case stagePlace:
+			summary.PlaceSeconds = took.Seconds()
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package create
+
+import (
+	"context"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"sync"
+	"time"
+)
+
+// throttledClient is a DockerClient that's polite to a Docker daemon shared
+// with others: no more than maxCalls of its operations run at once, and
+// operations start at least interval apart. Zero values don't limit. Waiting
+// stops, failing the operation with the context's error marked permanent,
+// once the context is done.
+type throttledClient struct {
+	DockerClient
+	ctx      context.Context
+	calls    workerPool
+	interval time.Duration
+
+	lock sync.Mutex
+	next time.Time
+}
+
+func newThrottledClient(client DockerClient, ctx context.Context, maxCalls int, interval time.Duration) *throttledClient {
+	return &throttledClient{
+		DockerClient: client,
+		ctx:          ctx,
+		calls:        newWorkerPool(maxCalls),
+		interval:     interval,
+	}
+}
+
+// acquire waits for a turn to call the daemon; the returned func must be called once the call is done
+func (c *throttledClient) acquire() (func(), error) {
+	if c.calls != nil {
+		select {
+		case c.calls <- struct{}{}:
+		case <-c.ctx.Done():
+			return nil, cmdtools.PermanentError{Err: c.ctx.Err()}
+		}
+	}
+	release := func() {
+		if c.calls != nil {
+			<-c.calls
+		}
+	}
+
+	if c.interval > 0 {
+		// reserve the next start time so concurrent callers are spaced out too
+		c.lock.Lock()
+		now := time.Now()
+		start := c.next
+		if start.Before(now) {
+			start = now
+		}
+		c.next = start.Add(c.interval)
+		c.lock.Unlock()
+
+		timer := time.NewTimer(start.Sub(now))
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			release()
+			return nil, cmdtools.PermanentError{Err: c.ctx.Err()}
+		}
+	}
+
+	return release, nil
+}
+
+func (c *throttledClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	release, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return c.DockerClient.PullImage(opts, auth)
+}
+
+func (c *throttledClient) ExportImage(opts docker.ExportImageOptions) error {
+	release, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return c.DockerClient.ExportImage(opts)
+}
+
+func (c *throttledClient) ExportImages(opts docker.ExportImagesOptions) error {
+	release, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return c.DockerClient.ExportImages(opts)
+}
+
+func (c *throttledClient) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	release, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.DockerClient.ListImages(opts)
+}
+
+func (c *throttledClient) InspectImage(name string) (*docker.Image, error) {
+	release, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.DockerClient.InspectImage(name)
+}
+
+func (c *throttledClient) TagImage(name string, opts docker.TagImageOptions) error {
+	release, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return c.DockerClient.TagImage(name, opts)
+}
@@ -0,0 +1,87 @@
+package create
+
+import (
+	"context"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"strings"
+	"time"
+)
+
+// tracingClient is a DockerClient that logs each call to the Docker daemon,
+// its duration, and its error, if any, as a debug message of the docker
+// subsystem. Credentials are described by their user and registry only.
+type tracingClient struct {
+	DockerClient
+	log *cmdtools.Logger
+}
+
+func newTracingClient(client DockerClient, ctx context.Context, reporter *cmdtools.SynchronizedReporter) *tracingClient {
+	return &tracingClient{
+		DockerClient: client,
+		log:          reporter.Log.WithContext(ctx).Subsystem(cmdtools.SubsystemDocker),
+	}
+}
+
+// trace logs a finished call described by call, e.g. "InspectImage(x)"
+func (c *tracingClient) trace(call string, started time.Time, err error) {
+	elapsed := time.Since(started).Round(time.Millisecond)
+	if err != nil {
+		c.log.Debugf("Docker API call %v failed after %v. Error: %v", call, elapsed, err)
+	} else {
+		c.log.Debugf("Docker API call %v took %v", call, elapsed)
+	}
+}
+
+func (c *tracingClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	credentials := "without credentials"
+	if auth.Username != "" {
+		credentials = "as user " + auth.Username
+	}
+
+	// the daemon accepts a digest in place of a tag
+	separator := ":"
+	if strings.Contains(opts.Tag, ":") {
+		separator = "@"
+	}
+
+	started := time.Now()
+	err := c.DockerClient.PullImage(opts, auth)
+	c.trace("PullImage("+opts.Repository+separator+opts.Tag+") "+credentials, started, err)
+	return err
+}
+
+func (c *tracingClient) ExportImage(opts docker.ExportImageOptions) error {
+	started := time.Now()
+	err := c.DockerClient.ExportImage(opts)
+	c.trace("ExportImage("+opts.Name+")", started, err)
+	return err
+}
+
+func (c *tracingClient) ExportImages(opts docker.ExportImagesOptions) error {
+	started := time.Now()
+	err := c.DockerClient.ExportImages(opts)
+	c.trace("ExportImages("+strings.Join(opts.Names, ", ")+")", started, err)
+	return err
+}
+
+func (c *tracingClient) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	started := time.Now()
+	images, err := c.DockerClient.ListImages(opts)
+	c.trace("ListImages()", started, err)
+	return images, err
+}
+
+func (c *tracingClient) InspectImage(name string) (*docker.Image, error) {
+	started := time.Now()
+	image, err := c.DockerClient.InspectImage(name)
+	c.trace("InspectImage("+name+")", started, err)
+	return image, err
+}
+
+func (c *tracingClient) TagImage(name string, opts docker.TagImageOptions) error {
+	started := time.Now()
+	err := c.DockerClient.TagImage(name, opts)
+	c.trace("TagImage("+name+" as "+opts.Repo+":"+opts.Tag+")", started, err)
+	return err
+}
@@ -0,0 +1,37 @@
+package create
+
+// workerPool limits how many operations of one kind run at once. A nil
+// workerPool doesn't limit them.
+type workerPool chan struct{}
+
+// newWorkerPool returns a pool of the given number of workers, or nil if size isn't positive
+func newWorkerPool(size int) workerPool {
+	if size <= 0 {
+		return nil
+	}
+	return make(workerPool, size)
+}
+
+// do runs f once a worker is free
+func (p workerPool) do(f func() error) error {
+	if p != nil {
+		p <- struct{}{}
+		defer func() { <-p }()
+	}
+	return f()
+}
+
+// start waits for a free worker, then runs f in a new goroutine, so no more
+// goroutines than workers are ever started
+func (p workerPool) start(f func()) {
+	if p != nil {
+		p <- struct{}{}
+	}
+
+	go func() {
+		if p != nil {
+			defer func() { <-p }()
+		}
+		f()
+	}()
+}
@@ -0,0 +1,102 @@
+// +build unit
+
+package create
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_WorkerPool_Suite(suite *testing.T) {
+
+	suite.Run("do runs no more operations at once than there are workers", func(t *testing.T) {
+		pool := newWorkerPool(2)
+		entered := make(chan int)
+		release := make(chan struct{})
+		done := make(chan error)
+
+		for i := 0; i < 3; i++ {
+			go func(i int) {
+				done <- pool.do(func() error {
+					entered <- i
+					<-release
+					return nil
+				})
+			}(i)
+		}
+
+		<-entered
+		<-entered
+
+		// both workers are busy, so the third operation waits
+		assert.Equal(t, cap(pool), len(pool))
+		select {
+		case i := <-entered:
+			t.Errorf("operation %v ran while both workers were busy", i)
+		default:
+		}
+
+		release <- struct{}{}
+		<-entered
+		assert.Nil(t, <-done)
+
+		close(release)
+		assert.Nil(t, <-done)
+		assert.Nil(t, <-done)
+		assert.Equal(t, 0, len(pool))
+	})
+
+	suite.Run("start waits for a free worker before starting a goroutine", func(t *testing.T) {
+		pool := newWorkerPool(2)
+		release := make(chan struct{})
+		finished := make(chan struct{})
+
+		for i := 0; i < 2; i++ {
+			pool.start(func() {
+				<-release
+				finished <- struct{}{}
+			})
+		}
+
+		started := make(chan struct{})
+		go func() {
+			pool.start(func() { finished <- struct{}{} })
+			close(started)
+		}()
+
+		select {
+		case <-started:
+			t.Errorf("goroutine started while both workers were busy")
+		default:
+		}
+
+		release <- struct{}{}
+		<-finished
+		<-started
+		<-finished
+
+		close(release)
+		<-finished
+	})
+
+	suite.Run("a nil pool doesn't limit operations", func(t *testing.T) {
+		assert.Nil(t, newWorkerPool(0))
+
+		var pool workerPool
+		assert.NotNil(t, pool.do(func() error { return errors.New("unlimited") }))
+
+		release := make(chan struct{})
+		entered := make(chan struct{})
+		for i := 0; i < 3; i++ {
+			pool.start(func() {
+				entered <- struct{}{}
+				<-release
+			})
+		}
+		for i := 0; i < 3; i++ {
+			<-entered
+		}
+		close(release)
+	})
+}
@@ -0,0 +1,362 @@
+package dockerauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+const (
+	// helperPrefix is prepended to a configured helper name to produce the name of the helper executable
+	helperPrefix = "docker-credential-"
+
+	// helperNotFoundMessage is written by credential helpers when they have no credentials for a server
+	helperNotFoundMessage = "credentials not found in native keychain"
+
+	// helperTokenUsername is the username credential helpers return with identity tokens
+	helperTokenUsername = "<token>"
+
+	// IndexServer is the server address Docker clients record Docker Hub credentials under
+	IndexServer = "https://index.docker.io/v1/"
+)
+
+// configFile describes the parts of a modern Docker client configuration file we need
+type configFile struct {
+	Auths       map[string]configAuth `json:"auths"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+	CredsStore  string                `json:"credsStore"`
+}
+
+type configAuth struct {
+	Auth  string `json:"auth"`
+	Email string `json:"email"`
+}
+
+// helperCredentials is the output of a credential helper's "get" command
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// ServerAddress returns the address credentials for the registry of the
+// given reference are recorded under: its domain or, for Docker Hub, IndexServer.
+func ServerAddress(ref reference.Reference) string {
+	if ref.Domain == reference.DefaultDomain {
+		return IndexServer
+	}
+	return ref.Domain
+}
+
+// Registry returns the registry server address of the given image name (see
+// ServerAddress), or an empty string if the name can't be parsed.
+func Registry(image string) string {
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return ""
+	}
+	return ServerAddress(ref)
+}
+
+// normalizeServerAddress reduces a server address, which may be written as a
+// URL (e.g. "https://xy.io/v1/"), to its host, with Docker Hub's aliases
+// reduced to its domain, so differently-written addresses can be compared.
+func normalizeServerAddress(serverAddress string) string {
+	host := serverAddress
+	for _, scheme := range []string{"https://", "http://"} {
+		host = strings.TrimPrefix(host, scheme)
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return reference.DefaultDomain
+	}
+	return host
+}
+
+// Registries returns the unique registry server addresses named by the given images.
+func Registries(images []string) []string {
+	seen := map[string]bool{}
+	registries := []string{}
+
+	for _, image := range images {
+		registry := Registry(image)
+		if registry == "" || seen[registry] {
+			continue
+		}
+
+		seen[registry] = true
+		registries = append(registries, registry)
+	}
+
+	return registries
+}
+
+func configPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return path.Join(dir, "config.json")
+	}
+
+	return path.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// NewAuthConfigurations reads the Docker client configuration file and
+// returns the credentials it describes. Static credentials from the file's
+// "auths" section are always included; for each of the given registries,
+// credentials obtained from a configured credential helper (a registry-specific
+// "credHelpers" entry or the default "credsStore") take precedence. The
+// default store is consulted for every registry, so one that's missing or
+// fails (e.g. a desktop keychain on a build server) is skipped with a warning
+// to log, if given; a failing registry-specific helper is an error.
+func NewAuthConfigurations(registries []string, log *cmdtools.Logger) (*docker.AuthConfigurations, error) {
+	cfgPath := configPath()
+
+	content, err := ioutil.ReadFile(cfgPath)
+	if os.IsNotExist(err) {
+		// legacy configuration files (e.g. $HOME/.dockercfg) can't specify credential helpers
+		return docker.NewAuthConfigurationsFromDockerCfg()
+	} else if err != nil {
+		return nil, err
+	}
+
+	var cfg configFile
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("Unable to parse Docker configuration file %v. Error: %v", cfgPath, err)
+	}
+
+	authConfigurations, err := staticAuthConfigurations(cfg.Auths)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read credentials from Docker configuration file %v. Error: %v", cfgPath, err)
+	}
+
+	for _, registry := range registries {
+		helper, specific := cfg.CredHelpers[registry]
+		if !specific {
+			helper = cfg.CredsStore
+		}
+
+		if helper == "" {
+			continue
+		}
+
+		auth, found, err := helperGet(helper, registry)
+		if err != nil && !specific {
+			if log != nil {
+				log.Warnf("%v; proceeding without credentials from the default credential store for %v", err, registry)
+			}
+		} else if err != nil {
+			return nil, err
+		} else if found {
+			// static entries recorded under another form of the address would otherwise compete in lookups
+			for server, static := range authConfigurations.Configs {
+				if normalizeServerAddress(static.ServerAddress) == normalizeServerAddress(registry) {
+					delete(authConfigurations.Configs, server)
+				}
+			}
+			authConfigurations.Configs[registry] = auth
+		}
+	}
+
+	return authConfigurations, nil
+}
+
+// staticAuthConfigurations converts the given "auths" section entries to
+// AuthConfigurations. Entries without credentials (written by 'docker login'
+// when a credential helper stores the secret) are omitted.
+func staticAuthConfigurations(auths map[string]configAuth) (*docker.AuthConfigurations, error) {
+	withCreds := map[string]configAuth{}
+	for server, auth := range auths {
+		if auth.Auth != "" {
+			withCreds[server] = auth
+		}
+	}
+
+	if len(withCreds) == 0 {
+		return &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{}}, nil
+	}
+
+	serialized, err := json.Marshal(map[string]interface{}{"auths": withCreds})
+	if err != nil {
+		return nil, err
+	}
+
+	return docker.NewAuthConfigurations(bytes.NewReader(serialized))
+}
+
+// helperGet executes the named credential helper to fetch credentials for
+// the given server. The returned bool is false if the helper has no
+// credentials for the server.
+func helperGet(helper string, serverAddress string) (docker.AuthConfiguration, bool, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(helperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// helpers report errors on stdout
+		msg := strings.TrimSpace(stdout.String())
+		if strings.Contains(msg, helperNotFoundMessage) {
+			return docker.AuthConfiguration{}, false, nil
+		}
+
+		return docker.AuthConfiguration{}, false, fmt.Errorf("Credential helper %v%v failed to get credentials for %v. Error: %v %v %v", helperPrefix, helper, serverAddress, err, msg, strings.TrimSpace(stderr.String()))
+	}
+
+	var creds helperCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return docker.AuthConfiguration{}, false, fmt.Errorf("Unable to parse output of credential helper %v%v. Error: %v", helperPrefix, helper, err)
+	}
+
+	// an identity token is exchanged for registry tokens rather than sent as a password
+	if creds.Username == helperTokenUsername {
+		return docker.AuthConfiguration{IdentityToken: creds.Secret, ServerAddress: serverAddress}, true, nil
+	}
+
+	return docker.AuthConfiguration{
+		Username:      creds.Username,
+		Password:      creds.Secret,
+		ServerAddress: serverAddress,
+	}, true, nil
+}
+
+// ParseRegistryAuth parses a registry credential specification of the form
+// "registry=user:password" or "registry=token". Environment variable
+// references in the user, password, or token (e.g.
+// "registry=ci:$REGISTRY_PASSWORD") are expanded once it's split, so expanded
+// values may contain ':'. A token is sent as the password with an empty
+// username, which registries that accept bare access tokens allow.
+func ParseRegistryAuth(spec string) (docker.AuthConfiguration, error) {
+	spl := strings.SplitN(spec, "=", 2)
+	if len(spl) != 2 || spl[0] == "" || spl[1] == "" {
+		return docker.AuthConfiguration{}, fmt.Errorf("Unable to parse registry credentials '%v', expected format 'registry=user:password' or 'registry=token'", spec)
+	}
+
+	auth := docker.AuthConfiguration{ServerAddress: spl[0]}
+
+	if userPass := strings.SplitN(spl[1], ":", 2); len(userPass) == 2 {
+		auth.Username = os.ExpandEnv(userPass[0])
+		auth.Password = os.ExpandEnv(userPass[1])
+	} else {
+		auth.Password = os.ExpandEnv(spl[1])
+	}
+
+	if auth.Password == "" {
+		return docker.AuthConfiguration{}, fmt.Errorf("Registry credentials for %v have an empty password or token", auth.ServerAddress)
+	}
+
+	return auth, nil
+}
+
+// ParseRegistryAuths parses the given registry credential specifications (see
+// ParseRegistryAuth) and returns them as AuthConfigurations keyed by registry.
+func ParseRegistryAuths(specs []string) (*docker.AuthConfigurations, error) {
+	authConfigurations := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{}}
+
+	for _, spec := range specs {
+		auth, err := ParseRegistryAuth(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		authConfigurations.Configs[auth.ServerAddress] = auth
+	}
+
+	return authConfigurations, nil
+}
+
+// Resolver determines the credentials to use for pulls from a registry. In
+// order of precedence it consults explicitly-provided credentials, an
+// ECRAuthenticator for ECR registries, and credentials read from Docker
+// configuration files, which are also used for an ECR registry if no token
+// can be obtained for it. A nil Resolver provides no credentials.
+type Resolver struct {
+	explicit   *docker.AuthConfigurations
+	configured *docker.AuthConfigurations
+	ecr        *ECRAuthenticator
+	log        *cmdtools.Logger
+}
+
+// NewResolver returns a Resolver consulting the given sources; any may be nil.
+func NewResolver(explicit *docker.AuthConfigurations, ecr *ECRAuthenticator, configured *docker.AuthConfigurations) *Resolver {
+	return &Resolver{
+		explicit:   explicit,
+		configured: configured,
+		ecr:        ecr,
+	}
+}
+
+// SetLogger makes the Resolver log which source's credentials, if any, each
+// lookup matched as debug messages
+func (r *Resolver) SetLogger(log *cmdtools.Logger) {
+	r.log = log
+}
+
+func (r *Resolver) debugf(format string, args ...interface{}) {
+	if r.log != nil {
+		r.log.Debugf(format, args...)
+	}
+}
+
+func matchServerAddress(authConfigurations *docker.AuthConfigurations, serverAddress string) (docker.AuthConfiguration, bool) {
+	if authConfigurations == nil {
+		return docker.AuthConfiguration{}, false
+	}
+
+	normalized := normalizeServerAddress(serverAddress)
+	for _, ra := range authConfigurations.Configs {
+		if normalizeServerAddress(ra.ServerAddress) == normalized {
+			return ra, true
+		}
+	}
+	return docker.AuthConfiguration{}, false
+}
+
+// Lookup returns credentials for the given registry server address. The
+// returned bool is false if no source has credentials for it, in which case
+// a pull should be attempted without.
+func (r *Resolver) Lookup(serverAddress string) (docker.AuthConfiguration, bool, error) {
+	if r == nil || serverAddress == "" {
+		return docker.AuthConfiguration{}, false, nil
+	}
+
+	if auth, found := matchServerAddress(r.explicit, serverAddress); found {
+		r.debugf("Using credentials of user %v given with 'registry-auth' for registry %v", auth.Username, serverAddress)
+		return auth, true, nil
+	}
+
+	var ecrErr error
+	if r.ecr != nil && IsECRRegistry(serverAddress) {
+		auth, err := r.ecr.Auth(serverAddress)
+		if err == nil {
+			r.debugf("Using an ECR authorization token for registry %v", serverAddress)
+			return auth, true, nil
+		}
+
+		// e.g. a host without AWS credentials whose Docker client logs in to ECR itself
+		ecrErr = err
+		if r.log != nil {
+			r.log.Warnf("%v; falling back to credentials from Docker configuration files", err)
+		}
+	}
+
+	auth, found := matchServerAddress(r.configured, serverAddress)
+	if found {
+		r.debugf("Using credentials of user %v from Docker configuration entry %v for registry %v", auth.Username, auth.ServerAddress, serverAddress)
+	} else if ecrErr != nil {
+		return docker.AuthConfiguration{}, false, ecrErr
+	} else {
+		r.debugf("No credentials match registry %v, proceeding without", serverAddress)
+	}
+	return auth, found, nil
+}
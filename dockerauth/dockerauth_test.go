@@ -0,0 +1,229 @@
+// +build unit
+
+package dockerauth
+
+import (
+	"bytes"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// a fake credential helper that knows about two servers, and has an identity token for another
+const fakeHelper = `#!/bin/sh
+read server
+if [ "$server" = "xy.io" ]; then
+  echo '{"ServerURL":"xy.io","Username":"timmy","Secret":"s3cret"}'
+elif [ "$server" = "docker.io" ]; then
+  echo '{"ServerURL":"docker.io","Username":"helper","Secret":"fromstore"}'
+elif [ "$server" = "token.io" ]; then
+  echo '{"ServerURL":"token.io","Username":"<token>","Secret":"refresh"}'
+else
+  echo 'credentials not found in native keychain'
+  exit 1
+fi
+`
+
+func setupHelper(t *testing.T, config string) string {
+	dir, err := ioutil.TempDir("", "dockerauth-")
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "docker-credential-fake"), []byte(fakeHelper), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "config.json"), []byte(config), 0644))
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("DOCKER_CONFIG", dir)
+	return dir
+}
+
+func Test_Registry(t *testing.T) {
+	assert.Equal(t, "xy.io", Registry("xy.io/someimage:0.1.0"))
+	assert.Equal(t, "xy.io:5000", Registry("xy.io:5000/ns/someimage:0.1.0"))
+	assert.Equal(t, "localhost:5000", Registry("localhost:5000/someimage"))
+	assert.Equal(t, IndexServer, Registry("someuser/someimage:0.1.0"))
+	assert.Equal(t, IndexServer, Registry("someimage"))
+	assert.Equal(t, "", Registry("Bad Image"))
+	assert.Equal(t, []string{"xy.io", "foo.goo:5000", IndexServer}, Registries([]string{"xy.io/a:1", "foo.goo:5000/b:2", "xy.io/c:3", "d:4"}))
+}
+
+func Test_Resolver_NormalizesServerAddresses(t *testing.T) {
+	configured := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+		IndexServer:     docker.AuthConfiguration{Username: "hub", ServerAddress: IndexServer},
+		"https://xy.io": docker.AuthConfiguration{Username: "timmy", ServerAddress: "https://xy.io"},
+	}}
+	resolver := NewResolver(nil, nil, configured)
+
+	auth, found, err := resolver.Lookup(Registry("someuser/someimage:0.1.0"))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "hub", auth.Username)
+
+	auth, found, err = resolver.Lookup(Registry("xy.io/someimage:0.1.0"))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "timmy", auth.Username)
+
+	_, found, err = resolver.Lookup(Registry("xy.io:5000/someimage:0.1.0"))
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func Test_NewAuthConfigurations_Suite(suite *testing.T) {
+
+	suite.Run("NewAuthConfigurations uses registry-specific credHelpers entry", func(t *testing.T) {
+		dir := setupHelper(t, `{"auths": {"xy.io": {}}, "credHelpers": {"xy.io": "fake"}}`)
+		defer os.RemoveAll(dir)
+
+		auths, err := NewAuthConfigurations([]string{"xy.io"}, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "timmy", auths.Configs["xy.io"].Username)
+		assert.Equal(t, "s3cret", auths.Configs["xy.io"].Password)
+		assert.Equal(t, "xy.io", auths.Configs["xy.io"].ServerAddress)
+	})
+
+	suite.Run("NewAuthConfigurations falls back to credsStore and tolerates missing credentials", func(t *testing.T) {
+		dir := setupHelper(t, `{"credsStore": "fake"}`)
+		defer os.RemoveAll(dir)
+
+		auths, err := NewAuthConfigurations([]string{"xy.io", "domain.com"}, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "timmy", auths.Configs["xy.io"].Username)
+
+		_, exists := auths.Configs["domain.com"]
+		assert.False(t, exists)
+	})
+
+	suite.Run("NewAuthConfigurations prefers helper credentials over static entries for the same registry", func(t *testing.T) {
+		dir := setupHelper(t, `{"auths": {"https://index.docker.io/v1/": {"auth": "c3RhdGljOnN0YXRpYw=="}}, "credsStore": "fake"}`)
+		defer os.RemoveAll(dir)
+
+		auths, err := NewAuthConfigurations([]string{"docker.io"}, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(auths.Configs))
+
+		auth, found, err := NewResolver(nil, nil, auths).Lookup(IndexServer)
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "helper", auth.Username)
+		assert.Equal(t, "fromstore", auth.Password)
+	})
+
+	suite.Run("NewAuthConfigurations reports helper failures", func(t *testing.T) {
+		dir := setupHelper(t, `{"credHelpers": {"xy.io": "nonexistent"}}`)
+		defer os.RemoveAll(dir)
+
+		_, err := NewAuthConfigurations([]string{"xy.io"}, nil)
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("NewAuthConfigurations warns of a missing credsStore and proceeds without it", func(t *testing.T) {
+		dir := setupHelper(t, `{"credHelpers": {"xy.io": "fake"}, "credsStore": "nonexistent"}`)
+		defer os.RemoveAll(dir)
+
+		var out bytes.Buffer
+		auths, err := NewAuthConfigurations([]string{"xy.io", "domain.com"}, cmdtools.NewLogger(&out))
+		assert.Nil(t, err)
+		assert.Equal(t, "timmy", auths.Configs["xy.io"].Username)
+		assert.Contains(t, out.String(), "docker-credential-nonexistent")
+
+		_, exists := auths.Configs["domain.com"]
+		assert.False(t, exists)
+	})
+
+	suite.Run("NewAuthConfigurations records identity tokens", func(t *testing.T) {
+		dir := setupHelper(t, `{"credHelpers": {"token.io": "fake"}}`)
+		defer os.RemoveAll(dir)
+
+		auths, err := NewAuthConfigurations([]string{"token.io"}, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "refresh", auths.Configs["token.io"].IdentityToken)
+		assert.Equal(t, "", auths.Configs["token.io"].Username)
+		assert.Equal(t, "", auths.Configs["token.io"].Password)
+	})
+}
+
+func Test_ParseRegistryAuth_Suite(suite *testing.T) {
+
+	suite.Run("ParseRegistryAuth parses user and password and expands envvars", func(t *testing.T) {
+		t.Setenv("DOCKERAUTH_TEST_PASS", "p:ss")
+
+		auth, err := ParseRegistryAuth("registry.example.com:5000=ci:$DOCKERAUTH_TEST_PASS")
+		assert.Nil(t, err)
+		assert.Equal(t, "registry.example.com:5000", auth.ServerAddress)
+		assert.Equal(t, "ci", auth.Username)
+		assert.Equal(t, "p:ss", auth.Password)
+	})
+
+	suite.Run("ParseRegistryAuth parses a bare token", func(t *testing.T) {
+		auth, err := ParseRegistryAuth("xy.io=abcdef")
+		assert.Nil(t, err)
+		assert.Equal(t, "", auth.Username)
+		assert.Equal(t, "abcdef", auth.Password)
+	})
+
+	suite.Run("ParseRegistryAuth splits tokens and users before expanding envvars", func(t *testing.T) {
+		t.Setenv("DOCKERAUTH_TEST_TOKEN", "ab:cd")
+		t.Setenv("DOCKERAUTH_TEST_USER", "ci:bot")
+
+		auth, err := ParseRegistryAuth("xy.io=$DOCKERAUTH_TEST_TOKEN")
+		assert.Nil(t, err)
+		assert.Equal(t, "", auth.Username)
+		assert.Equal(t, "ab:cd", auth.Password)
+
+		auth, err = ParseRegistryAuth("xy.io=${DOCKERAUTH_TEST_USER}:pass")
+		assert.Nil(t, err)
+		assert.Equal(t, "ci:bot", auth.Username)
+		assert.Equal(t, "pass", auth.Password)
+	})
+
+	suite.Run("ParseRegistryAuth rejects malformed specs", func(t *testing.T) {
+		for _, spec := range []string{"xy.io", "=user:pass", "xy.io=", "xy.io=user:", "xy.io=$DOCKERAUTH_TEST_UNSET"} {
+			_, err := ParseRegistryAuth(spec)
+			assert.NotNil(t, err, spec)
+		}
+	})
+
+	suite.Run("Resolver prefers explicit credentials over configured ones", func(t *testing.T) {
+		configured := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+			"https://xy.io": docker.AuthConfiguration{Username: "old", ServerAddress: "xy.io"},
+			"other.com":     docker.AuthConfiguration{Username: "other", ServerAddress: "other.com"},
+		}}
+
+		explicit, err := ParseRegistryAuths([]string{"xy.io=new:pass"})
+		assert.Nil(t, err)
+
+		resolver := NewResolver(explicit, nil, configured)
+
+		var out bytes.Buffer
+		log := cmdtools.NewLogger(&out)
+		log.SetLevel(cmdtools.LevelDebug, nil)
+		resolver.SetLogger(log)
+
+		auth, found, err := resolver.Lookup("xy.io")
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "new", auth.Username)
+
+		auth, found, err = resolver.Lookup("other.com")
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "other", auth.Username)
+
+		_, found, err = resolver.Lookup("unknown.com")
+		assert.Nil(t, err)
+		assert.False(t, found)
+
+		assert.Contains(t, out.String(), "Using credentials of user new given with 'registry-auth' for registry xy.io\n")
+		assert.Contains(t, out.String(), "Using credentials of user other from Docker configuration entry other.com for registry other.com\n")
+		assert.Contains(t, out.String(), "No credentials match registry unknown.com, proceeding without\n")
+
+		var nilResolver *Resolver
+		_, found, err = nilResolver.Lookup("xy.io")
+		assert.Nil(t, err)
+		assert.False(t, found)
+	})
+}
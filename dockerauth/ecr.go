@@ -0,0 +1,150 @@
+package dockerauth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/awsauth"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ecrTokenRefreshMargin is the remaining validity below which a cached ECR token is replaced
+	ecrTokenRefreshMargin = 15 * time.Minute
+
+	ecrTarget = "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken"
+)
+
+// matches e.g. 123456789012.dkr.ecr.us-east-1.amazonaws.com; groups are account, region, and optional China partition suffix
+var ecrRegistryPattern = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// IsECRRegistry returns true if the given registry server address is an Amazon ECR registry.
+func IsECRRegistry(serverAddress string) bool {
+	return ecrRegistryPattern.MatchString(serverAddress)
+}
+
+type ecrToken struct {
+	auth      docker.AuthConfiguration
+	expiresAt time.Time
+}
+
+// ECRAuthenticator obtains ECR authorization tokens with AWS credentials from
+// the environment (AWS_ACCESS_KEY_ID et al.), the shared credentials file, or
+// the EC2 instance metadata service. Tokens are cached and replaced when they
+// near expiry so builds that outlive a token keep working. It is safe for
+// concurrent use.
+type ECRAuthenticator struct {
+	httpClient *http.Client
+	lock       sync.Mutex
+	tokens     map[string]ecrToken
+}
+
+// NewECRAuthenticator returns an ECRAuthenticator with an empty token cache.
+func NewECRAuthenticator() *ECRAuthenticator {
+	return &ECRAuthenticator{
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		tokens:     map[string]ecrToken{},
+	}
+}
+
+// Auth returns credentials for the given ECR registry server address,
+// fetching a new token if there is no cached one with sufficient validity.
+func (e *ECRAuthenticator) Auth(serverAddress string) (docker.AuthConfiguration, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if token, exists := e.tokens[serverAddress]; exists && time.Now().Add(ecrTokenRefreshMargin).Before(token.expiresAt) {
+		return token.auth, nil
+	}
+
+	token, err := e.fetchToken(serverAddress)
+	if err != nil {
+		return docker.AuthConfiguration{}, fmt.Errorf("Unable to obtain ECR authorization token for %v. Error: %v", serverAddress, err)
+	}
+
+	e.tokens[serverAddress] = token
+	return token.auth, nil
+}
+
+func (e *ECRAuthenticator) fetchToken(serverAddress string) (ecrToken, error) {
+	match := ecrRegistryPattern.FindStringSubmatch(serverAddress)
+	if match == nil {
+		return ecrToken{}, fmt.Errorf("Not an ECR registry: %v", serverAddress)
+	}
+	account, region, partitionSuffix := match[1], match[2], match[3]
+
+	// looked up anew each time; instance role credentials rotate
+	creds, err := awsauth.LookupCredentials()
+	if err != nil {
+		return ecrToken{}, err
+	}
+
+	body, err := json.Marshal(map[string][]string{"registryIds": []string{account}})
+	if err != nil {
+		return ecrToken{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://api.ecr.%s.amazonaws.com%s/", region, partitionSuffix), bytes.NewReader(body))
+	if err != nil {
+		return ecrToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", ecrTarget)
+	awsauth.SignV4(req, awsauth.PayloadHash(body), creds, region, "ecr", time.Now())
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return ecrToken{}, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ecrToken{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return ecrToken{}, fmt.Errorf("ECR API responded with status %v: %s", resp.StatusCode, respBody)
+	}
+
+	var tokenResp struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"`
+		} `json:"authorizationData"`
+	}
+	if err := json.Unmarshal(respBody, &tokenResp); err != nil {
+		return ecrToken{}, err
+	}
+
+	if len(tokenResp.AuthorizationData) == 0 {
+		return ecrToken{}, fmt.Errorf("ECR API response contained no authorization data")
+	}
+
+	data := tokenResp.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+	if err != nil {
+		return ecrToken{}, err
+	}
+
+	userPass := strings.SplitN(string(decoded), ":", 2)
+	if len(userPass) != 2 {
+		return ecrToken{}, fmt.Errorf("Unable to parse ECR authorization token")
+	}
+
+	return ecrToken{
+		auth: docker.AuthConfiguration{
+			Username:      userPass[0],
+			Password:      userPass[1],
+			ServerAddress: serverAddress,
+		},
+		expiresAt: time.Unix(int64(data.ExpiresAt), 0),
+	}, nil
+}
@@ -0,0 +1,55 @@
+// +build unit
+
+package dockerauth
+
+import (
+	"bytes"
+	"errors"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func Test_IsECRRegistry(t *testing.T) {
+	assert.True(t, IsECRRegistry("123456789012.dkr.ecr.us-east-1.amazonaws.com"))
+	assert.True(t, IsECRRegistry("123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn"))
+	assert.False(t, IsECRRegistry("123456789012.dkr.ecr.us-east-1.amazonaws.com.evil.io"))
+	assert.False(t, IsECRRegistry("xy.io"))
+}
+
+// failingTransport fails every request, as when the ECR API can't be reached
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("unreachable")
+}
+
+func Test_Resolver_FallsBackWithoutECRToken(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	ecr := NewECRAuthenticator()
+	ecr.httpClient = &http.Client{Transport: failingTransport{}}
+
+	registry := "123456789012.dkr.ecr.us-east-1.amazonaws.com"
+	configured := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+		registry: docker.AuthConfiguration{Username: "AWS", Password: "from-docker-login", ServerAddress: registry},
+	}}
+
+	var logged bytes.Buffer
+	resolver := NewResolver(nil, ecr, configured)
+	resolver.SetLogger(cmdtools.NewLogger(&logged))
+
+	auth, found, err := resolver.Lookup(registry)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "from-docker-login", auth.Password)
+	assert.Contains(t, logged.String(), "Unable to obtain ECR authorization token")
+
+	// without configured credentials, the reason there's no token is the error
+	_, found, err = NewResolver(nil, ecr, nil).Lookup(registry)
+	assert.False(t, found)
+	assert.NotNil(t, err)
+}
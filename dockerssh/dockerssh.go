@@ -0,0 +1,128 @@
+package dockerssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TunnelEndpoint is the Docker endpoint to configure a client with when
+// using a Dialer; requests go through the tunnel and the socket path isn't
+// used locally
+const TunnelEndpoint = "unix:///var/run/docker.sock"
+
+// Dialer connects to a remote Docker daemon by running 'docker system
+// dial-stdio' on the remote host over ssh, like the docker CLI does for
+// ssh:// hosts. Each connection is a separate ssh process. The remote
+// host needs Docker 18.09 or newer.
+type Dialer struct {
+	sshArgs []string
+}
+
+// NewDialer returns a Dialer for an endpoint of the form ssh://[user@]host[:port].
+func NewDialer(endpoint string) (*Dialer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("Unable to use endpoint %v, expected format 'ssh://[user@]host[:port]'", endpoint)
+	}
+
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("Unable to use endpoint %v, paths are not supported in ssh endpoints", endpoint)
+	}
+
+	if _, err := exec.LookPath("ssh"); err != nil {
+		return nil, fmt.Errorf("An ssh client is required for ssh endpoints. Error: %v", err)
+	}
+
+	args := []string{"-o", "ConnectTimeout=30"}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+
+	return &Dialer{sshArgs: args}, nil
+}
+
+// Dial starts an ssh process connected to the remote daemon; network and address are ignored.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	cmd := exec.Command("ssh", d.sshArgs...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}
+	cmd.Stderr = &conn.stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Unable to start ssh. Error: %v", err)
+	}
+
+	return conn, nil
+}
+
+// commandConn is a net.Conn over the stdin and stdout of a process
+type commandConn struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	stdout    io.ReadCloser
+	stderr    bytes.Buffer
+	closeOnce sync.Once
+}
+
+func (c *commandConn) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	if err == io.EOF {
+		// wait for the process so its stderr is complete; its complaints are more useful than EOF
+		c.Close()
+		if c.stderr.Len() > 0 {
+			return n, fmt.Errorf("ssh connection closed: %v", strings.TrimSpace(c.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+func (c *commandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		if c.cmd.Process != nil {
+			c.cmd.Process.Kill()
+		}
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "ssh" }
+func (commandAddr) String() string  { return "ssh" }
+
+func (c *commandConn) LocalAddr() net.Addr                { return commandAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr               { return commandAddr{} }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
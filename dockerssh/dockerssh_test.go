@@ -0,0 +1,52 @@
+// +build unit
+
+package dockerssh
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// a fake ssh that prints its arguments and then echoes its input
+const fakeSSH = `#!/bin/sh
+echo "$@"
+exec cat
+`
+
+func Test_Dialer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerssh-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "ssh"), []byte(fakeSSH), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	_, err = NewDialer("ssh://")
+	assert.NotNil(t, err)
+
+	_, err = NewDialer("ssh://builder/var/run/docker.sock")
+	assert.NotNil(t, err)
+
+	dialer, err := NewDialer("ssh://timmy@build.example.com:2222")
+	assert.Nil(t, err)
+
+	conn, err := dialer.Dial("unix", "/var/run/docker.sock")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	args, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "-o ConnectTimeout=30 -l timmy -p 2222 -- build.example.com docker system dial-stdio\n", args)
+
+	_, err = conn.Write([]byte("GET /_ping HTTP/1.1\n"))
+	assert.Nil(t, err)
+
+	echoed, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "GET /_ping HTTP/1.1\n", echoed)
+}
@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix is prepended to the names of the metrics pushed
+const Prefix = "hznpkg_"
+
+// pushTimeout bounds a push, so an unreachable endpoint doesn't hold up the end of a run
+const pushTimeout = 10 * time.Second
+
+// Sample is the value of a metric, a gauge, with any labels telling it from
+// other samples of the same metric
+type Sample struct {
+	Name   string
+	Help   string
+	Labels map[string]string
+	Value  float64
+}
+
+// labelName matches the names of labels Prometheus accepts
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// CheckEndpoint returns an error if endpoint isn't one Push can push to
+func CheckEndpoint(endpoint string) error {
+	_, err := parseEndpoint(endpoint)
+	return err
+}
+
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "statsd":
+	default:
+		return nil, fmt.Errorf("Expected a Pushgateway URL ('http://' or 'https://') or a statsd address ('statsd://host:port'), got '%s'", endpoint)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Expected a host in '%s'", endpoint)
+	}
+	return u, nil
+}
+
+// Push pushes the samples to endpoint, named with Prefix. The endpoint's
+// scheme selects the protocol:
+//
+//	http(s)://host:port[/path]  A Prometheus Pushgateway; the samples replace
+//	                            those of the group job=<job> (and the
+//	                            grouping labels given)
+//	statsd://host:port          A statsd daemon, as gauges over UDP named
+//	                            <job>.<name>[.<label value>...]
+func Push(endpoint string, job string, grouping map[string]string, samples []Sample) error {
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		for name := range sample.Labels {
+			if !labelName.MatchString(name) {
+				return fmt.Errorf("Invalid label name '%s' of metric %v", name, sample.Name)
+			}
+		}
+	}
+
+	if u.Scheme == "statsd" {
+		return pushStatsd(u.Host, job, samples)
+	}
+	return pushGateway(u, job, grouping, samples)
+}
+
+// pushGateway PUTs the samples to a Pushgateway in the Prometheus text format
+func pushGateway(u *url.URL, job string, grouping map[string]string, samples []Sample) error {
+	groupPath := "/metrics/job/" + url.PathEscape(job)
+	for _, name := range sortedKeys(grouping) {
+		if !labelName.MatchString(name) {
+			return fmt.Errorf("Invalid grouping label name '%s'", name)
+		}
+		groupPath += "/" + name + "/" + url.PathEscape(grouping[name])
+	}
+	target := *u
+	target.Path = strings.TrimSuffix(u.Path, "/") + groupPath
+
+	req, err := http.NewRequest(http.MethodPut, target.String(), bytes.NewReader(Format(samples)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := (&http.Client{Timeout: pushTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Pushgateway %v responded %v: %s", u.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// pushStatsd sends each sample as a gauge in its own UDP datagram, so none is
+// larger than a statsd daemon reads
+func pushStatsd(addr string, job string, samples []Sample) error {
+	conn, err := net.DialTimeout("udp", addr, pushTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(pushTimeout))
+	for _, sample := range samples {
+		name := []string{statsdName(job), statsdName(Prefix + sample.Name)}
+		for _, label := range sortedKeys(sample.Labels) {
+			name = append(name, statsdName(sample.Labels[label]))
+		}
+
+		if _, err := fmt.Fprintf(conn, "%s:%s|g", strings.Join(name, "."), formatValue(sample.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Format writes the samples in the Prometheus text exposition format, those
+// of each metric together under its help and type
+func Format(samples []Sample) []byte {
+	var out bytes.Buffer
+	written := map[string]bool{}
+	for i, sample := range samples {
+		if written[sample.Name] {
+			continue
+		}
+		written[sample.Name] = true
+
+		name := Prefix + sample.Name
+		fmt.Fprintf(&out, "# HELP %s %s\n", name, strings.Replace(sample.Help, "\n", " ", -1))
+		fmt.Fprintf(&out, "# TYPE %s gauge\n", name)
+		for _, s := range samples[i:] {
+			if s.Name == sample.Name {
+				fmt.Fprintf(&out, "%s%s %s\n", name, formatLabels(s.Labels), formatValue(s.Value))
+			}
+		}
+	}
+	return out.Bytes()
+}
+
+// labelValueEscaper escapes label values as the text format requires
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := []string{}
+	for _, name := range sortedKeys(labels) {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// statsdUnsafe matches the characters replaced in the components of statsd
+// metric names, among them those statsd and Graphite treat specially
+var statsdUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+func statsdName(name string) string {
+	return statsdUnsafe.ReplaceAllString(name, "_")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
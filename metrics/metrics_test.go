@@ -0,0 +1,89 @@
+// +build unit
+
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var samples = []Sample{
+	{Name: "run_duration_seconds", Help: "Seconds the run took", Value: 94.5},
+	{Name: "failures", Help: "Failures by class", Labels: map[string]string{"class": "pull"}, Value: 2},
+	{Name: "failures", Help: "Failures by class", Labels: map[string]string{"class": `say "hi"`}, Value: 0},
+}
+
+func Test_Format(t *testing.T) {
+	assert.Equal(t, `# HELP hznpkg_run_duration_seconds Seconds the run took
+# TYPE hznpkg_run_duration_seconds gauge
+hznpkg_run_duration_seconds 94.5
+# HELP hznpkg_failures Failures by class
+# TYPE hznpkg_failures gauge
+hznpkg_failures{class="pull"} 2
+hznpkg_failures{class="say \"hi\""} 0
+`, string(Format(samples)))
+}
+
+func Test_Push_Suite(suite *testing.T) {
+
+	suite.Run("Push PUTs to the Pushgateway group of the job", func(t *testing.T) {
+		var method, path, body string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			content, _ := ioutil.ReadAll(r.Body)
+			method, path, body = r.Method, r.URL.Path, string(content)
+		}))
+		defer server.Close()
+
+		assert.Nil(t, Push(server.URL+"/gateway/", "pkg-build", map[string]string{"instance": "ci-1", "command": "create"}, samples))
+		assert.Equal(t, http.MethodPut, method)
+		assert.Equal(t, "/gateway/metrics/job/pkg-build/command/create/instance/ci-1", path)
+		assert.Equal(t, string(Format(samples)), body)
+	})
+
+	suite.Run("Push fails if the Pushgateway refuses the metrics", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "text format parsing error", http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		err := Push(server.URL, "pkg-build", nil, samples)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "text format parsing error")
+	})
+
+	suite.Run("Push sends gauges to statsd", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer conn.Close()
+
+		assert.Nil(t, Push("statsd://"+conn.LocalAddr().String(), "pkg.build", nil, samples))
+
+		received := []string{}
+		buf := make([]byte, 512)
+		for range samples {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			assert.Nil(t, err)
+			received = append(received, string(buf[:n]))
+		}
+		sort.Strings(received)
+		assert.Equal(t, []string{"pkg_build.hznpkg_failures.pull:2|g", "pkg_build.hznpkg_failures.say__hi_:0|g", "pkg_build.hznpkg_run_duration_seconds:94.5|g"}, received)
+	})
+
+	suite.Run("CheckEndpoint accepts Pushgateway URLs and statsd addresses only", func(t *testing.T) {
+		assert.Nil(t, CheckEndpoint("http://pushgateway:9091"))
+		assert.Nil(t, CheckEndpoint("statsd://localhost:8125"))
+		for _, endpoint := range []string{"", "pushgateway:9091", "udp://localhost:8125", "http://"} {
+			err := CheckEndpoint(endpoint)
+			assert.NotNil(t, err, endpoint)
+			assert.False(t, strings.Contains(err.Error(), "%!"), endpoint)
+		}
+	})
+}
@@ -0,0 +1,402 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"github.com/open-horizon/horizon-pkg-build/registry"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// refNameAnnotation names the tag (or full reference) of a manifest in an OCI layout index
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+
+	// imageNameAnnotation is written by containerd and buildkit with the full image reference
+	imageNameAnnotation = "io.containerd.image.name"
+)
+
+type descriptor struct {
+	MediaType   string             `json:"mediaType"`
+	Digest      string             `json:"digest"`
+	Size        int64              `json:"size"`
+	Annotations map[string]string  `json:"annotations"`
+	Platform    *registry.Platform `json:"platform"`
+}
+
+type index struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	Config descriptor   `json:"config"`
+	Layers []descriptor `json:"layers"`
+}
+
+// archiveManifest is an entry in the manifest.json of a 'docker save' tarball
+type archiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == registry.MediaTypeOCIIndex || mediaType == registry.MediaTypeManifestList
+}
+
+// Export writes the image named by the given "name:tag" (or "name@digest")
+// from the OCI image layout at dir to w in the tarball format produced by
+// 'docker save', tagged with the name, so it can be loaded with 'docker
+// load'; images named by digest are written untagged, as 'docker save' writes
+// them. If the layout holds several images, the one annotated with the tag
+// (or full name), or with the digest, is used; if that is a multi-platform
+// index, the platform (e.g. "linux/arm64") selects among its manifests. All
+// blobs are verified against their digests. Layers are written uncompressed,
+// as 'docker save' writes them.
+func Export(dir string, name string, platform string, w io.Writer) error {
+	ref, m, config, err := resolve(dir, name, platform)
+	if err != nil {
+		return err
+	}
+
+	tags := []string{}
+	if !ref.IsDigest() {
+		tags = append(tags, ref.String())
+	}
+	return writeArchive(dir, tags, m, config, w)
+}
+
+// ImageID returns the ID the Docker daemon would give the image Export
+// writes for the same arguments: the digest of its configuration
+func ImageID(dir string, name string, platform string) (string, error) {
+	_, m, _, err := resolve(dir, name, platform)
+	if err != nil {
+		return "", err
+	}
+	return m.Config.Digest, nil
+}
+
+// Platform returns the platform recorded in the configuration of the image
+// Export writes for the same arguments
+func Platform(dir string, name string, platform string) (registry.Platform, error) {
+	var configPlatform registry.Platform
+
+	_, _, config, err := resolve(dir, name, platform)
+	if err != nil {
+		return configPlatform, err
+	}
+
+	err = json.Unmarshal(config, &configPlatform)
+	return configPlatform, err
+}
+
+// resolve finds the manifest of the named image in the layout and reads its configuration
+func resolve(dir string, name string, platform string) (reference.Reference, manifest, []byte, error) {
+	var m manifest
+
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return ref, m, nil, err
+	}
+
+	var wantPlatform *registry.Platform
+	if platform != "" {
+		p, err := registry.ParsePlatform(platform)
+		if err != nil {
+			return ref, m, nil, err
+		}
+		wantPlatform = &p
+	}
+
+	var root index
+	if err := readJSON(path.Join(dir, "index.json"), &root); err != nil {
+		return ref, m, nil, fmt.Errorf("Unable to read OCI layout index in %v. Error: %v", dir, err)
+	}
+
+	names := func(d descriptor) bool {
+		if namesImage(d.Annotations[imageNameAnnotation], ref) {
+			return true
+		} else if ref.IsDigest() {
+			return d.Digest == ref.Digest
+		}
+
+		refName := d.Annotations[refNameAnnotation]
+		return refName == ref.Tag || refName == name
+	}
+
+	desc, err := selectManifest(root.Manifests, names, wantPlatform)
+	if err != nil {
+		return ref, m, nil, fmt.Errorf("Unable to find image %v in OCI layout %v. Error: %v", name, dir, err)
+	}
+
+	// the only image of a layout is used whatever it's named, unless it's named otherwise
+	if refName := desc.Annotations[refNameAnnotation]; len(root.Manifests) == 1 && refName != "" && !names(desc) {
+		return ref, m, nil, fmt.Errorf("Unable to find image %v in OCI layout %v, whose only image is named %v", name, dir, refName)
+	}
+
+	// descend through nested indexes
+	for isIndex(desc.MediaType) {
+		var nested index
+		if err := readBlobJSON(dir, desc, &nested); err != nil {
+			return ref, m, nil, err
+		}
+
+		desc, err = selectManifest(nested.Manifests, nil, wantPlatform)
+		if err != nil {
+			return ref, m, nil, fmt.Errorf("Unable to select platform of image %v in OCI layout %v. Error: %v", name, dir, err)
+		}
+	}
+
+	if err := readBlobJSON(dir, desc, &m); err != nil {
+		return ref, m, nil, err
+	}
+
+	config, err := readBlob(dir, m.Config)
+	if err != nil {
+		return ref, m, nil, err
+	}
+
+	if wantPlatform != nil {
+		var configPlatform registry.Platform
+		if err := json.Unmarshal(config, &configPlatform); err != nil {
+			return ref, m, nil, err
+		}
+
+		if !wantPlatform.Matches(configPlatform) {
+			return ref, m, nil, fmt.Errorf("Image %v in OCI layout %v is for platform %v, not requested platform %v", name, dir, configPlatform, wantPlatform)
+		}
+	}
+
+	return ref, m, config, nil
+}
+
+// namesImage returns true if the given image name (e.g. of an annotation) is
+// another form of ref, e.g. "docker.io/library/alpine:3.6" of "alpine:3.6"
+func namesImage(name string, ref reference.Reference) bool {
+	if name == "" {
+		return false
+	}
+
+	named, err := reference.Parse(name)
+	return err == nil && named.String() == ref.String()
+}
+
+// selectManifest picks the one descriptor satisfying the filter (if any) and platform (if any)
+func selectManifest(descs []descriptor, filter func(descriptor) bool, platform *registry.Platform) (descriptor, error) {
+	candidates := descs
+
+	if len(candidates) > 1 && filter != nil {
+		filtered := []descriptor{}
+		for _, d := range candidates {
+			if filter(d) {
+				filtered = append(filtered, d)
+			}
+		}
+		candidates = filtered
+	}
+
+	if len(candidates) > 1 && platform != nil {
+		filtered := []descriptor{}
+		for _, d := range candidates {
+			if d.Platform != nil && platform.Matches(*d.Platform) {
+				filtered = append(filtered, d)
+			}
+		}
+		candidates = filtered
+	}
+
+	switch len(candidates) {
+	case 0:
+		return descriptor{}, fmt.Errorf("No matching manifest")
+	case 1:
+		return candidates[0], nil
+	default:
+		return descriptor{}, fmt.Errorf("%v manifests match; specify a tag annotated in the layout or a platform", len(candidates))
+	}
+}
+
+func blobPath(dir string, desc descriptor) (string, error) {
+	spl := strings.SplitN(desc.Digest, ":", 2)
+	if len(spl) != 2 || spl[0] != "sha256" || strings.ContainsAny(spl[1], "/.") {
+		return "", fmt.Errorf("Unsupported blob digest: %v", desc.Digest)
+	}
+	return path.Join(dir, "blobs", spl[0], spl[1]), nil
+}
+
+func readJSON(file string, v interface{}) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func readBlob(dir string, desc descriptor) ([]byte, error) {
+	p, err := blobPath(dir, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content)); digest != desc.Digest {
+		return nil, fmt.Errorf("Blob %v has unexpected digest %v", desc.Digest, digest)
+	}
+	return content, nil
+}
+
+func readBlobJSON(dir string, desc descriptor, v interface{}) error {
+	content, err := readBlob(dir, desc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func writeArchive(dir string, repoTags []string, m manifest, config []byte, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	modTime := time.Unix(0, 0)
+
+	writeFile := func(fileName string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: fileName, Mode: 0644, Size: int64(len(content)), ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	configHex := strings.TrimPrefix(m.Config.Digest, "sha256:")
+	entry := archiveManifest{Config: configHex + ".json", RepoTags: repoTags, Layers: []string{}}
+
+	if err := writeFile(entry.Config, config); err != nil {
+		return err
+	}
+
+	for _, layer := range m.Layers {
+		if strings.HasSuffix(layer.MediaType, "+zstd") {
+			return fmt.Errorf("Layer %v is zstd-compressed, which isn't supported", layer.Digest)
+		}
+
+		layerName := path.Join(strings.TrimPrefix(layer.Digest, "sha256:"), "layer.tar")
+		if err := copyLayer(tw, dir, layer, layerName, modTime); err != nil {
+			return err
+		}
+		entry.Layers = append(entry.Layers, layerName)
+	}
+
+	serialized, err := json.Marshal([]archiveManifest{entry})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile("manifest.json", serialized); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// copyLayer writes the uncompressed content of the given layer to the archive
+// as 'docker save' does, verifying the digest of the layer blob as it's read
+func copyLayer(tw *tar.Writer, dir string, layer descriptor, layerName string, modTime time.Time) error {
+	p, err := blobPath(dir, layer)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashWriter := sha256.New()
+	blob := io.TeeReader(f, hashWriter)
+
+	// tar headers precede content, so the uncompressed size must be known before writing it
+	var content io.Reader
+	var size int64
+	switch {
+	case strings.HasSuffix(layer.MediaType, "gzip"):
+		spooled, err := spoolLayer(blob, layer)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+
+		info, err := spooled.Stat()
+		if err != nil {
+			return err
+		}
+		content, size = spooled, info.Size()
+	case strings.HasSuffix(layer.MediaType, ".tar"):
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		content, size = blob, info.Size()
+	default:
+		return fmt.Errorf("Layer %v has unsupported media type %v", layer.Digest, layer.MediaType)
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: path.Dir(layerName) + "/", Mode: 0755, ModTime: modTime, Typeflag: tar.TypeDir}); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: layerName, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(tw, content, size); err != nil {
+		return fmt.Errorf("Unable to copy layer %v. Error: %v", layer.Digest, err)
+	}
+
+	// hash whatever the decompressor didn't consume
+	if _, err := io.Copy(ioutil.Discard, blob); err != nil {
+		return err
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", hashWriter.Sum(nil)); digest != layer.Digest {
+		return fmt.Errorf("Layer blob %v has unexpected digest %v", layer.Digest, digest)
+	}
+	return nil
+}
+
+// spoolLayer decompresses the given gzipped layer blob to a temporary file,
+// which it returns open at its start. The caller removes it.
+func spoolLayer(blob io.Reader, layer descriptor) (*os.File, error) {
+	gz, err := gzip.NewReader(blob)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress layer %v. Error: %v", layer.Digest, err)
+	}
+
+	spooled, err := ioutil.TempFile("", "hznpkg-layer-")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(spooled, gz); err != nil {
+		spooled.Close()
+		os.Remove(spooled.Name())
+		return nil, fmt.Errorf("Unable to decompress layer %v. Error: %v", layer.Digest, err)
+	}
+
+	if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		os.Remove(spooled.Name())
+		return nil, err
+	}
+	return spooled, nil
+}
@@ -0,0 +1,186 @@
+// +build unit
+
+package ocilayout
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/registry"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeBlob stores content in the layout and returns its descriptor
+func writeBlob(t *testing.T, dir string, mediaType string, content []byte) descriptor {
+	hex := fmt.Sprintf("%x", sha256.Sum256(content))
+	assert.Nil(t, os.MkdirAll(path.Join(dir, "blobs", "sha256"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "blobs", "sha256", hex), content, 0644))
+	return descriptor{MediaType: mediaType, Digest: "sha256:" + hex, Size: int64(len(content))}
+}
+
+func writeJSONBlob(t *testing.T, dir string, mediaType string, v interface{}) descriptor {
+	content, err := json.Marshal(v)
+	assert.Nil(t, err)
+	return writeBlob(t, dir, mediaType, content)
+}
+
+// writeImage stores a single-layer image for the given architecture and returns its manifest descriptor
+func writeImage(t *testing.T, dir string, arch string) (descriptor, descriptor) {
+	config := writeJSONBlob(t, dir, "application/vnd.oci.image.config.v1+json", map[string]string{"os": "linux", "architecture": arch})
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write([]byte("layer-" + arch))
+	assert.Nil(t, err)
+	assert.Nil(t, gz.Close())
+
+	layer := writeBlob(t, dir, "application/vnd.oci.image.layer.v1.tar+gzip", compressed.Bytes())
+	m := writeJSONBlob(t, dir, registry.MediaTypeOCIManifest, map[string]interface{}{"schemaVersion": 2, "config": config, "layers": []descriptor{layer}})
+	return m, layer
+}
+
+// readArchive returns the files in a tarball
+func readArchive(t *testing.T, content []byte) map[string][]byte {
+	files := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(content))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			files[hdr.Name], err = ioutil.ReadAll(tr)
+			assert.Nil(t, err)
+		}
+	}
+	return files
+}
+
+func Test_Export(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocilayout-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	amd64, amd64Layer := writeImage(t, dir, "amd64")
+	amd64.Annotations = map[string]string{refNameAnnotation: "0.1.0"}
+	arm64, _ := writeImage(t, dir, "arm64")
+	arm64.Annotations = map[string]string{refNameAnnotation: "0.2.0"}
+	assert.Nil(t, writeIndex(dir, []descriptor{amd64, arm64}))
+
+	t.Run("selects the tagged image", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.Nil(t, Export(dir, "x.io/gt-db:0.1.0", "", &buf))
+
+		files := readArchive(t, buf.Bytes())
+
+		var entries []archiveManifest
+		assert.Nil(t, json.Unmarshal(files["manifest.json"], &entries))
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, []string{"x.io/gt-db:0.1.0"}, entries[0].RepoTags)
+		assert.Equal(t, 1, len(entries[0].Layers))
+		assert.Equal(t, []byte("layer-amd64"), files[entries[0].Layers[0]])
+		assert.Equal(t, path.Join(amd64Layer.Digest[len("sha256:"):], "layer.tar"), entries[0].Layers[0])
+		assert.Contains(t, string(files[entries[0].Config]), "amd64")
+
+		id, err := ImageID(dir, "x.io/gt-db:0.1.0", "")
+		assert.Nil(t, err)
+		assert.Equal(t, "sha256:"+strings.TrimSuffix(entries[0].Config, ".json"), id)
+
+		platform, err := Platform(dir, "x.io/gt-db:0.2.0", "")
+		assert.Nil(t, err)
+		assert.Equal(t, registry.Platform{OS: "linux", Architecture: "arm64"}, platform)
+	})
+
+	t.Run("unknown tag", func(t *testing.T) {
+		assert.NotNil(t, Export(dir, "x.io/gt-db:0.3.0", "", ioutil.Discard))
+	})
+
+	t.Run("platform mismatch", func(t *testing.T) {
+		assert.NotNil(t, Export(dir, "x.io/gt-db:0.1.0", "linux/arm64", ioutil.Discard))
+	})
+
+	t.Run("bad name", func(t *testing.T) {
+		assert.NotNil(t, Export(dir, "x.io/gt-db:bad/tag", "", ioutil.Discard))
+	})
+
+	t.Run("corrupt layer", func(t *testing.T) {
+		assert.Nil(t, ioutil.WriteFile(path.Join(dir, "blobs", "sha256", amd64Layer.Digest[len("sha256:"):]), []byte("layer-amd6X"), 0644))
+		assert.NotNil(t, Export(dir, "x.io/gt-db:0.1.0", "", ioutil.Discard))
+	})
+
+	t.Run("layer that decompresses but doesn't match its digest", func(t *testing.T) {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		_, err := gz.Write([]byte("layer-amd6X"))
+		assert.Nil(t, err)
+		assert.Nil(t, gz.Close())
+
+		assert.Nil(t, ioutil.WriteFile(path.Join(dir, "blobs", "sha256", amd64Layer.Digest[len("sha256:"):]), compressed.Bytes(), 0644))
+		err = Export(dir, "x.io/gt-db:0.1.0", "", ioutil.Discard)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "unexpected digest")
+	})
+}
+
+func Test_Export_Index(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocilayout-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	amd64, _ := writeImage(t, dir, "amd64")
+	amd64.Platform = &registry.Platform{OS: "linux", Architecture: "amd64"}
+	arm64, _ := writeImage(t, dir, "arm64")
+	arm64.Platform = &registry.Platform{OS: "linux", Architecture: "arm64"}
+
+	idx := writeJSONBlob(t, dir, registry.MediaTypeOCIIndex, index{Manifests: []descriptor{amd64, arm64}})
+	assert.Nil(t, writeIndex(dir, []descriptor{idx}))
+
+	t.Run("selects the platform", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.Nil(t, Export(dir, "x.io/gt-db:0.1.0", "linux/arm64", &buf))
+
+		files := readArchive(t, buf.Bytes())
+		var entries []archiveManifest
+		assert.Nil(t, json.Unmarshal(files["manifest.json"], &entries))
+		assert.Equal(t, []byte("layer-arm64"), files[entries[0].Layers[0]])
+	})
+
+	t.Run("ambiguous without platform", func(t *testing.T) {
+		assert.NotNil(t, Export(dir, "x.io/gt-db:0.1.0", "", ioutil.Discard))
+	})
+}
+
+func Test_Export_Single(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocilayout-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	amd64, _ := writeImage(t, dir, "amd64")
+	assert.Nil(t, writeIndex(dir, []descriptor{amd64}))
+
+	t.Run("unnamed image is used by any name", func(t *testing.T) {
+		assert.Nil(t, Export(dir, "x.io/gt-db:0.1.0", "", ioutil.Discard))
+	})
+
+	amd64.Annotations = map[string]string{refNameAnnotation: "0.1.0"}
+	assert.Nil(t, writeIndex(dir, []descriptor{amd64}))
+
+	t.Run("named image", func(t *testing.T) {
+		assert.Nil(t, Export(dir, "x.io/gt-db:0.1.0", "", ioutil.Discard))
+	})
+
+	t.Run("image named otherwise", func(t *testing.T) {
+		err := Export(dir, "x.io/gt-db:0.2.0", "", ioutil.Discard)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "whose only image is named 0.1.0")
+	})
+}
@@ -0,0 +1,327 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"github.com/open-horizon/horizon-pkg-build/registry"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// mediaTypeConfig is the media type of an OCI image configuration
+	mediaTypeConfig = "application/vnd.oci.image.config.v1+json"
+
+	// mediaTypeLayer is the media type of an uncompressed OCI image layer
+	mediaTypeLayer = "application/vnd.oci.image.layer.v1.tar"
+
+	// layoutVersion is the content of the oci-layout file of a layout
+	layoutVersion = `{"imageLayoutVersion":"1.0.0"}`
+)
+
+// WriteBlob stores the content read from r in the OCI image layout at dir as
+// the blob with the given digest, failing if the content has another digest.
+// The blob is written whole or not at all. Returns the size of the content.
+func WriteBlob(dir string, digest string, r io.Reader) (int64, error) {
+	p, err := blobPath(dir, descriptor{Digest: digest})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(p), ".blob-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hashWriter := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hashWriter), r)
+	if err != nil {
+		return 0, err
+	}
+
+	if actual := fmt.Sprintf("sha256:%x", hashWriter.Sum(nil)); actual != digest {
+		return 0, fmt.Errorf("Blob %v has unexpected digest %v", digest, actual)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return size, os.Rename(tmp.Name(), p)
+}
+
+// WriteIndex writes the index of the OCI image layout at dir, naming the
+// image given by the manifest (or index) with the given media type, digest,
+// and size, whose blob is stored with WriteBlob. The image is annotated with
+// its tag, if any, and its full name, so Export finds it by its name.
+func WriteIndex(dir string, name string, mediaType string, digest string, size int64) error {
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return err
+	}
+
+	annotations := map[string]string{imageNameAnnotation: ref.Canonical()}
+	if !ref.IsDigest() {
+		annotations[refNameAnnotation] = ref.Tag
+	}
+
+	return writeIndex(dir, []descriptor{{MediaType: mediaType, Digest: digest, Size: size, Annotations: annotations}})
+}
+
+func writeIndex(dir string, manifests []descriptor) error {
+	content, err := json.Marshal(struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		Manifests     []descriptor `json:"manifests"`
+	}{2, manifests})
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "index.json"), content, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, "oci-layout"), []byte(layoutVersion), 0644)
+}
+
+// Unpack extracts an image archive read from r into dir as an OCI image
+// layout Export reads images from. The archive may be an OCI image layout
+// (as written by 'docker save' since Docker 25, 'ctr images export',
+// BuildKit, or skopeo) or the tarball format earlier versions of 'docker
+// save' write, which is converted: each of its images is indexed by its
+// tags, with its layers stored uncompressed.
+func Unpack(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// nothing is written outside dir, whatever the archive names
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeFile(target, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			// 'docker save' links layers shared by images; they're copied, staying inside dir
+			linked := path.Clean(path.Join(path.Dir(name), hdr.Linkname))
+			if hdr.Typeflag == tar.TypeLink {
+				linked = path.Clean(hdr.Linkname)
+			}
+			if path.IsAbs(linked) || linked == ".." || strings.HasPrefix(linked, "../") {
+				return fmt.Errorf("Archive entry %v links outside the archive", hdr.Name)
+			}
+
+			source, err := os.Open(filepath.Join(dir, filepath.FromSlash(linked)))
+			if err != nil {
+				return fmt.Errorf("Archive entry %v links to missing entry %v", hdr.Name, linked)
+			}
+			err = writeFile(target, source)
+			source.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, "index.json")); err == nil {
+		return nil
+	}
+
+	if _, err := os.Stat(path.Join(dir, "manifest.json")); err != nil {
+		return fmt.Errorf("Archive is neither an OCI image layout nor a 'docker save' tarball: it has no index.json or manifest.json")
+	}
+	return convertArchive(dir)
+}
+
+// Names returns the names of the images in an image archive Unpack reads,
+// in the short form of reference.Reference.String: the tags recorded by
+// 'docker save' and the full names annotated in an OCI image layout's index.
+// Only the archive's index and manifest are read; other content is skipped.
+func Names(r io.Reader) ([]string, error) {
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if ref, err := reference.Parse(name); err == nil && !seen[ref.String()] {
+			seen[ref.String()] = true
+			names = append(names, ref.String())
+		}
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch path.Clean(strings.TrimPrefix(hdr.Name, "./")) {
+		case "manifest.json":
+			var entries []archiveManifest
+			if err := json.NewDecoder(tr).Decode(&entries); err != nil {
+				return nil, fmt.Errorf("Unable to read 'docker save' manifest. Error: %v", err)
+			}
+			for _, entry := range entries {
+				for _, tag := range entry.RepoTags {
+					add(tag)
+				}
+			}
+		case "index.json":
+			var root index
+			if err := json.NewDecoder(tr).Decode(&root); err != nil {
+				return nil, fmt.Errorf("Unable to read OCI layout index. Error: %v", err)
+			}
+			for _, d := range root.Manifests {
+				if name := d.Annotations[imageNameAnnotation]; name != "" {
+					add(name)
+				}
+
+				// a reference name that's more than a tag is a full name, as skopeo writes
+				if name := d.Annotations[refNameAnnotation]; strings.ContainsAny(name, ":/") {
+					add(name)
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+func writeFile(target string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// convertArchive converts the extracted 'docker save' tarball in dir into an
+// OCI image layout, storing its configurations and layers as blobs
+func convertArchive(dir string) error {
+	var entries []archiveManifest
+	if err := readJSON(path.Join(dir, "manifest.json"), &entries); err != nil {
+		return fmt.Errorf("Unable to read 'docker save' manifest. Error: %v", err)
+	}
+
+	manifests := []descriptor{}
+	stored := map[string]descriptor{}
+	for _, entry := range entries {
+		config, err := storeFile(dir, entry.Config, stored)
+		if err != nil {
+			return err
+		}
+		config.MediaType = mediaTypeConfig
+
+		m := manifest{Config: config, Layers: []descriptor{}}
+		for _, layerName := range entry.Layers {
+			layer, err := storeFile(dir, layerName, stored)
+			if err != nil {
+				return err
+			}
+			layer.MediaType = mediaTypeLayer
+			m.Layers = append(m.Layers, layer)
+		}
+
+		serialized, err := json.Marshal(struct {
+			SchemaVersion int          `json:"schemaVersion"`
+			MediaType     string       `json:"mediaType"`
+			Config        descriptor   `json:"config"`
+			Layers        []descriptor `json:"layers"`
+		}{2, registry.MediaTypeOCIManifest, m.Config, m.Layers})
+		if err != nil {
+			return err
+		}
+
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(serialized))
+		if _, err := WriteBlob(dir, digest, strings.NewReader(string(serialized))); err != nil {
+			return err
+		}
+
+		// an untagged image is found only if it's the archive's one image
+		if len(entry.RepoTags) == 0 {
+			manifests = append(manifests, descriptor{MediaType: registry.MediaTypeOCIManifest, Digest: digest, Size: int64(len(serialized))})
+		}
+		for _, tag := range entry.RepoTags {
+			annotations := map[string]string{refNameAnnotation: tag}
+			if ref, err := reference.Parse(tag); err == nil {
+				annotations[imageNameAnnotation] = ref.Canonical()
+			}
+			manifests = append(manifests, descriptor{MediaType: registry.MediaTypeOCIManifest, Digest: digest, Size: int64(len(serialized)), Annotations: annotations})
+		}
+	}
+
+	return writeIndex(dir, manifests)
+}
+
+// storeFile moves the named file of an extracted archive in dir to the blob
+// of its digest, returning its descriptor. Files already stored, e.g. layers
+// shared by images, are recorded in stored.
+func storeFile(dir string, name string, stored map[string]descriptor) (descriptor, error) {
+	name = path.Clean(name)
+	if desc, exists := stored[name]; exists {
+		return desc, nil
+	}
+
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	f, err := os.Open(file)
+	if err != nil {
+		return descriptor{}, fmt.Errorf("Unable to read %v of 'docker save' tarball. Error: %v", name, err)
+	}
+
+	hashWriter := sha256.New()
+	size, err := io.Copy(hashWriter, f)
+	f.Close()
+	if err != nil {
+		return descriptor{}, err
+	}
+
+	desc := descriptor{Digest: fmt.Sprintf("sha256:%x", hashWriter.Sum(nil)), Size: size}
+	p, err := blobPath(dir, desc)
+	if err != nil {
+		return descriptor{}, err
+	}
+
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return descriptor{}, err
+	} else if err := os.Rename(file, p); err != nil {
+		return descriptor{}, err
+	}
+
+	stored[name] = desc
+	return desc, nil
+}
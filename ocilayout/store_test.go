@@ -0,0 +1,186 @@
+// +build unit
+
+package ocilayout
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of an archive written by writeTar; a linkname makes it a symlink
+type tarEntry struct {
+	name     string
+	content  string
+	linkname string
+}
+
+func writeTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if e.linkname != "" {
+			assert.Nil(t, tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeSymlink, Linkname: e.linkname, Mode: 0777}))
+			continue
+		}
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Size: int64(len(e.content)), Mode: 0644}))
+		_, err := tw.Write([]byte(e.content))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	return buf.Bytes()
+}
+
+// dockerSaveArchive returns a 'docker save' tarball of two images sharing a layer, the second linking to it
+func dockerSaveArchive(t *testing.T) []byte {
+	entries := []archiveManifest{
+		{Config: "aaa.json", RepoTags: []string{"x.io/gt-db:0.1.0", "x.io/gt-db:latest"}, Layers: []string{"l1/layer.tar"}},
+		{Config: "bbb.json", RepoTags: []string{"x.io/gt-web:0.1.0"}, Layers: []string{"l2/layer.tar"}},
+	}
+	manifest, err := json.Marshal(entries)
+	assert.Nil(t, err)
+
+	return writeTar(t, []tarEntry{
+		{name: "aaa.json", content: `{"os":"linux","architecture":"amd64"}`},
+		{name: "bbb.json", content: `{"os":"linux","architecture":"arm64"}`},
+		{name: "l1/layer.tar", content: "shared-layer"},
+		{name: "l2/layer.tar", linkname: "../l1/layer.tar"},
+		{name: "../escaped", content: "outside"},
+		{name: "manifest.json", content: string(manifest)},
+	})
+}
+
+func Test_WriteBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocilayout-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content := "some blob"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+
+	size, err := WriteBlob(dir, digest, strings.NewReader(content))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), size)
+
+	stored, err := ioutil.ReadFile(path.Join(dir, "blobs", "sha256", digest[len("sha256:"):]))
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(stored))
+
+	// content that doesn't match its digest isn't stored
+	other := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other blob")))
+	_, err = WriteBlob(dir, other, strings.NewReader(content))
+	assert.NotNil(t, err)
+	_, err = os.Stat(path.Join(dir, "blobs", "sha256", other[len("sha256:"):]))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_WriteIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocilayout-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, _ := writeImage(t, dir, "amd64")
+
+	t.Run("names the image by tag", func(t *testing.T) {
+		assert.Nil(t, WriteIndex(dir, "x.io/gt-db:0.1.0", m.MediaType, m.Digest, m.Size))
+
+		var buf bytes.Buffer
+		assert.Nil(t, Export(dir, "x.io/gt-db:0.1.0", "", &buf))
+	})
+
+	t.Run("names the image by digest", func(t *testing.T) {
+		image := "x.io/gt-db@" + m.Digest
+		assert.Nil(t, WriteIndex(dir, image, m.MediaType, m.Digest, m.Size))
+
+		var buf bytes.Buffer
+		assert.Nil(t, Export(dir, image, "", &buf))
+
+		var entries []archiveManifest
+		assert.Nil(t, json.Unmarshal(readArchive(t, buf.Bytes())["manifest.json"], &entries))
+		assert.Equal(t, 1, len(entries))
+		assert.Empty(t, entries[0].RepoTags)
+	})
+}
+
+func Test_Unpack(t *testing.T) {
+	parent, err := ioutil.TempDir("", "ocilayout-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(parent)
+
+	t.Run("converts a 'docker save' tarball", func(t *testing.T) {
+		dir := path.Join(parent, "legacy")
+		assert.Nil(t, os.Mkdir(dir, 0755))
+		assert.Nil(t, Unpack(bytes.NewReader(dockerSaveArchive(t)), dir))
+
+		_, err := os.Stat(path.Join(parent, "escaped"))
+		assert.True(t, os.IsNotExist(err))
+
+		for image, arch := range map[string]string{"x.io/gt-db:0.1.0": "amd64", "x.io/gt-db:latest": "amd64", "x.io/gt-web:0.1.0": "arm64"} {
+			var buf bytes.Buffer
+			assert.Nil(t, Export(dir, image, "", &buf), image)
+
+			files := readArchive(t, buf.Bytes())
+			var entries []archiveManifest
+			assert.Nil(t, json.Unmarshal(files["manifest.json"], &entries))
+			assert.Equal(t, []string{image}, entries[0].RepoTags)
+			assert.Equal(t, []byte("shared-layer"), files[entries[0].Layers[0]], image)
+
+			platform, err := Platform(dir, image, "")
+			assert.Nil(t, err)
+			assert.Equal(t, arch, platform.Architecture)
+		}
+
+		id, err := ImageID(dir, "x.io/gt-db:0.1.0", "")
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(`{"os":"linux","architecture":"amd64"}`))), id)
+	})
+
+	t.Run("extracts an OCI image layout", func(t *testing.T) {
+		source := path.Join(parent, "source")
+		assert.Nil(t, os.Mkdir(source, 0755))
+		m, _ := writeImage(t, source, "arm64")
+		assert.Nil(t, WriteIndex(source, "x.io/gt-db:0.2.0", m.MediaType, m.Digest, m.Size))
+
+		entries := []tarEntry{}
+		for _, name := range []string{"oci-layout", "index.json", "blobs/sha256/" + m.Digest[len("sha256:"):]} {
+			content, err := ioutil.ReadFile(path.Join(source, name))
+			assert.Nil(t, err)
+			entries = append(entries, tarEntry{name: name, content: string(content)})
+		}
+
+		archive := writeTar(t, entries)
+		names, err := Names(bytes.NewReader(archive))
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"x.io/gt-db:0.2.0"}, names)
+
+		dir := path.Join(parent, "layout")
+		assert.Nil(t, os.Mkdir(dir, 0755))
+		assert.Nil(t, Unpack(bytes.NewReader(archive), dir))
+
+		// only the manifest was archived, so its blobs are missing
+		assert.NotNil(t, Export(dir, "x.io/gt-db:0.2.0", "", ioutil.Discard))
+	})
+
+	t.Run("refuses other archives", func(t *testing.T) {
+		dir := path.Join(parent, "other")
+		assert.Nil(t, os.Mkdir(dir, 0755))
+		assert.NotNil(t, Unpack(bytes.NewReader(writeTar(t, []tarEntry{{name: "README", content: "hi"}})), dir))
+	})
+}
+
+func Test_Names(t *testing.T) {
+	names, err := Names(bytes.NewReader(dockerSaveArchive(t)))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"x.io/gt-db:0.1.0", "x.io/gt-db:latest", "x.io/gt-web:0.1.0"}, names)
+
+	_, err = Names(strings.NewReader("not a tarball"))
+	assert.NotNil(t, err)
+}
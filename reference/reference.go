@@ -0,0 +1,149 @@
+package reference
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultDomain is the registry domain implied by image names without one
+	DefaultDomain = "docker.io"
+
+	// DefaultTag is the tag implied by image names without a tag or digest
+	DefaultTag = "latest"
+
+	// officialRepoPrefix is the namespace of single-component Docker Hub repositories
+	officialRepoPrefix = "library/"
+
+	// legacyDefaultDomain is an alias of DefaultDomain found in older image names
+	legacyDefaultDomain = "index.docker.io"
+)
+
+var (
+	domainPattern    = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	componentPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagPattern       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestPattern    = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// Reference is a parsed Docker image reference, normalized the way the
+// Docker daemon normalizes the names it's given: "alpine" refers to
+// "docker.io/library/alpine:latest".
+type Reference struct {
+	// Domain is the registry, e.g. "docker.io" or "registry.example.com:5000"
+	Domain string
+
+	// Path is the repository within the registry, e.g. "library/alpine"
+	Path string
+
+	// Tag is the tag, "latest" if neither tag nor digest were given; it's empty if only a digest was given
+	Tag string
+
+	// Digest is the content digest, e.g. "sha256:...", if given
+	Digest string
+}
+
+// Parse parses an image reference like "alpine", "someuser/someimage:0.1.0",
+// "registry.example.com:5000/ns/someimage:0.1.0", or "someimage@sha256:...".
+func Parse(image string) (Reference, error) {
+	var ref Reference
+
+	name := image
+	if spl := strings.SplitN(name, "@", 2); len(spl) == 2 {
+		if !digestPattern.MatchString(spl[1]) {
+			return Reference{}, fmt.Errorf("Unable to parse given image name: %v, invalid digest", image)
+		}
+		name, ref.Digest = spl[0], spl[1]
+	}
+
+	// a colon after the last slash separates the tag; one before it is a registry port
+	if sep := strings.LastIndex(name, ":"); sep > strings.LastIndex(name, "/") {
+		if !tagPattern.MatchString(name[sep+1:]) {
+			return Reference{}, fmt.Errorf("Unable to parse given image name: %v, invalid tag", image)
+		}
+		name, ref.Tag = name[:sep], name[sep+1:]
+	}
+
+	ref.Domain, ref.Path = splitDomain(name)
+
+	if ref.Domain != DefaultDomain && !domainPattern.MatchString(ref.Domain) {
+		return Reference{}, fmt.Errorf("Unable to parse given image name: %v, invalid registry", image)
+	}
+
+	for _, component := range strings.Split(ref.Path, "/") {
+		if !componentPattern.MatchString(component) {
+			return Reference{}, fmt.Errorf("Unable to parse given image name: %v, invalid repository name", image)
+		}
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+
+	return ref, nil
+}
+
+// splitDomain separates the registry domain from the repository path; the
+// first component is a domain only if it looks like a host name
+func splitDomain(name string) (string, string) {
+	domain, path := DefaultDomain, name
+
+	if spl := strings.SplitN(name, "/", 2); len(spl) == 2 && (strings.ContainsAny(spl[0], ".:") || spl[0] == "localhost") {
+		domain, path = spl[0], spl[1]
+	}
+
+	if domain == legacyDefaultDomain {
+		domain = DefaultDomain
+	}
+
+	if domain == DefaultDomain && !strings.Contains(path, "/") {
+		path = officialRepoPrefix + path
+	}
+
+	return domain, path
+}
+
+// Repository returns the repository name in the short form the Docker daemon
+// uses in image tags, e.g. "alpine" rather than "docker.io/library/alpine"
+func (r Reference) Repository() string {
+	if r.Domain != DefaultDomain {
+		return r.Domain + "/" + r.Path
+	}
+
+	if strings.HasPrefix(r.Path, officialRepoPrefix) && strings.Count(r.Path, "/") == 1 {
+		return strings.TrimPrefix(r.Path, officialRepoPrefix)
+	}
+	return r.Path
+}
+
+// IsDigest returns true if the reference pins an image by digest
+func (r Reference) IsDigest() bool {
+	return r.Digest != ""
+}
+
+// Ref returns the digest of the reference or, if it has none, its tag
+func (r Reference) Ref() string {
+	if r.IsDigest() {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// Canonical returns the reference in the fully qualified form containerd and
+// OCI image tools use, e.g. "docker.io/library/alpine:latest"
+func (r Reference) Canonical() string {
+	if r.IsDigest() {
+		return r.Domain + "/" + r.Path + "@" + r.Digest
+	}
+	return r.Domain + "/" + r.Path + ":" + r.Tag
+}
+
+// String returns the reference in the short form the Docker daemon uses,
+// with its digest (if any) or tag, e.g. "alpine:latest"
+func (r Reference) String() string {
+	if r.IsDigest() {
+		return r.Repository() + "@" + r.Digest
+	}
+	return r.Repository() + ":" + r.Tag
+}
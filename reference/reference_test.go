@@ -0,0 +1,60 @@
+// +build unit
+
+package reference
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const testDigest = "sha256:2b8fd9751c4c0f5dd266fcae00707e67a2545ef34f9a29354585f93dac906749"
+
+func Test_Parse(t *testing.T) {
+	for image, expected := range map[string]Reference{
+		"alpine":                                  Reference{Domain: "docker.io", Path: "library/alpine", Tag: "latest"},
+		"alpine:3.6":                              Reference{Domain: "docker.io", Path: "library/alpine", Tag: "3.6"},
+		"someuser/someimage:0.1.0":                Reference{Domain: "docker.io", Path: "someuser/someimage", Tag: "0.1.0"},
+		"docker.io/library/alpine:3.6":            Reference{Domain: "docker.io", Path: "library/alpine", Tag: "3.6"},
+		"index.docker.io/someuser/someimage":      Reference{Domain: "docker.io", Path: "someuser/someimage", Tag: "latest"},
+		"localhost/someimage":                     Reference{Domain: "localhost", Path: "someimage", Tag: "latest"},
+		"registry:5000/ns/someimage:0.1.0":        Reference{Domain: "registry:5000", Path: "ns/someimage", Tag: "0.1.0"},
+		"registry:5000/ns/someimage":              Reference{Domain: "registry:5000", Path: "ns/someimage", Tag: "latest"},
+		"xy.io/someimage@" + testDigest:           Reference{Domain: "xy.io", Path: "someimage", Digest: testDigest},
+		"xy.io:443/someimage:0.1.0@" + testDigest: Reference{Domain: "xy.io:443", Path: "someimage", Tag: "0.1.0", Digest: testDigest},
+	} {
+		ref, err := Parse(image)
+		assert.Nil(t, err, image)
+		assert.Equal(t, expected, ref, image)
+	}
+
+	for _, image := range []string{"", "Alpine", "xy.io/someimage:", "xy.io/someimage:bad/tag", "xy.io/someimage@sha256:short", "-bad.io/someimage", "xy.io//someimage"} {
+		_, err := Parse(image)
+		assert.NotNil(t, err, image)
+	}
+}
+
+func Test_String(t *testing.T) {
+	for image, expected := range map[string]string{
+		"alpine":                                "alpine:latest",
+		"docker.io/library/alpine:3.6":          "alpine:3.6",
+		"docker.io/someuser/someimage:0.1.0":    "someuser/someimage:0.1.0",
+		"registry:5000/ns/someimage":            "registry:5000/ns/someimage:latest",
+		"registry:5000/someimage@" + testDigest: "registry:5000/someimage@" + testDigest,
+	} {
+		ref, err := Parse(image)
+		assert.Nil(t, err, image)
+		assert.Equal(t, expected, ref.String(), image)
+	}
+}
+
+func Test_Canonical(t *testing.T) {
+	for image, expected := range map[string]string{
+		"alpine":                                "docker.io/library/alpine:latest",
+		"someuser/someimage:0.1.0":              "docker.io/someuser/someimage:0.1.0",
+		"registry:5000/someimage@" + testDigest: "registry:5000/someimage@" + testDigest,
+	} {
+		ref, err := Parse(image)
+		assert.Nil(t, err, image)
+		assert.Equal(t, expected, ref.Canonical(), image)
+	}
+}
@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// manifestTypes are the media types of the manifests and manifest lists requested
+var manifestTypes = []string{MediaTypeManifestList, MediaTypeOCIIndex, MediaTypeManifest, MediaTypeOCIManifest}
+
+// Manifest returns the manifest of the given image ("repo:tag" or
+// "repo@digest") for the given platform (see ParsePlatform), with its media
+// type and digest. If the image is a manifest list, the manifest of the
+// matching entry is returned; a single-platform manifest is returned whatever
+// the platform, and the caller is responsible for verifying the image's
+// platform. The content of manifests fetched by digest is verified.
+func (c *Client) Manifest(ctx context.Context, image string, platformSpec string) ([]byte, string, string, error) {
+	platform, err := ParsePlatform(platformSpec)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	body, mediaType, digest, err := c.fetchManifest(ctx, ref, ref.Ref())
+	if err != nil || (mediaType != MediaTypeManifestList && mediaType != MediaTypeOCIIndex) {
+		return body, mediaType, digest, err
+	}
+
+	entry, err := selectEntry(image, body, platform)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return c.fetchManifest(ctx, ref, entry)
+}
+
+// Blob returns a reader of the content of the blob with the given digest in
+// the repository of the given image, and its size. The request is cancelled
+// once the context is done. The content isn't verified; the caller should
+// hash it.
+func (c *Client) Blob(ctx context.Context, image string, digest string) (io.ReadCloser, int64, error) {
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := c.getContext(ctx, ref, "blobs/"+digest, []string{"*/*"}, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("Registry responded with status %v to request for blob %v of %v", resp.StatusCode, digest, image)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// fetchManifest fetches the manifest or manifest list of the referenced
+// repository with the given tag or digest, returning its content, media type,
+// and digest
+func (c *Client) fetchManifest(ctx context.Context, ref reference.Reference, tagOrDigest string) ([]byte, string, string, error) {
+	resp, err := c.getContext(ctx, ref, "manifests/"+tagOrDigest, manifestTypes, false)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("Registry responded with status %v to manifest request for %v of %v", resp.StatusCode, tagOrDigest, ref.Repository())
+	}
+
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	if strings.HasPrefix(tagOrDigest, "sha256:") && digest != tagOrDigest {
+		return nil, "", "", fmt.Errorf("Manifest %v of %v has unexpected digest %v", tagOrDigest, ref.Repository(), digest)
+	}
+	return body, mediaType, digest, nil
+}
+
+// selectEntry returns the digest of the entry of a manifest list for the platform
+func selectEntry(image string, body []byte, platform Platform) (string, error) {
+	var list manifestList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return "", fmt.Errorf("Unable to parse manifest list for %v. Error: %v", image, err)
+	}
+
+	available := []string{}
+	for _, m := range list.Manifests {
+		if platform.Matches(m.Platform) {
+			return m.Digest, nil
+		}
+		available = append(available, m.Platform.String())
+	}
+
+	return "", fmt.Errorf("Image %v has no variant for platform %v. Available platforms: %v", image, platform, strings.Join(available, ", "))
+}
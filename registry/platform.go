@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Platform describes the operating system and CPU architecture an image variant targets
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ParsePlatform parses platform specifications like "linux/arm64" or "linux/arm/v7".
+func ParsePlatform(spec string) (Platform, error) {
+	spl := strings.Split(spec, "/")
+	if len(spl) < 2 || len(spl) > 3 || spl[0] == "" || spl[1] == "" {
+		return Platform{}, fmt.Errorf("Unable to parse platform '%v', expected format 'os/architecture[/variant]'", spec)
+	}
+
+	platform := Platform{OS: spl[0], Architecture: spl[1]}
+	if len(spl) == 3 {
+		platform.Variant = spl[2]
+	}
+	return platform, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// Matches returns true if the given platform satisfies p; a variant is only compared if p specifies one
+func (p Platform) Matches(other Platform) bool {
+	return p.OS == other.OS && p.Architecture == other.Architecture && (p.Variant == "" || p.Variant == other.Variant)
+}
+
+type manifestList struct {
+	Manifests []struct {
+		Digest    string   `json:"digest"`
+		MediaType string   `json:"mediaType"`
+		Platform  Platform `json:"platform"`
+	} `json:"manifests"`
+}
+
+// PlatformDigest returns the digest of the manifest of the given image
+// ("repo:tag" or "repo@digest") for the given platform (see ParsePlatform). If the tag refers
+// to a manifest list the matching entry's digest is returned; if it refers
+// to a single-platform manifest, that manifest's digest is returned and the
+// caller is responsible for verifying the pulled image's platform.
+func (c *Client) PlatformDigest(image string, platformSpec string) (string, error) {
+	platform, err := ParsePlatform(platformSpec)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.get(ref, "manifests/"+ref.Ref(), manifestTypes)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Registry responded with status %v to manifest request for %v", resp.StatusCode, image)
+	}
+
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if mediaType != MediaTypeManifestList && mediaType != MediaTypeOCIIndex {
+		if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+			return digest, nil
+		}
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+	}
+
+	return selectEntry(image, body, platform)
+}
@@ -0,0 +1,306 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/dockerauth"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRegistryHost is the API host of the registry implied by image names without one
+	defaultRegistryHost = "registry-1.docker.io"
+
+	// MediaTypeManifestList is the media type of a Docker multi-platform manifest list
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeManifest is the media type of a Docker single-platform image manifest
+	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// MediaTypeOCIIndex is the media type of an OCI multi-platform image index
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+
+	// MediaTypeOCIManifest is the media type of an OCI single-platform image manifest
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+)
+
+// Client queries Docker Registry HTTP API V2 endpoints. It authenticates
+// with credentials from the given dockerauth.Resolver, obtaining bearer
+// tokens as challenged by the registry.
+type Client struct {
+	httpClient         *http.Client
+	insecureHTTPClient *http.Client
+	authResolver       *dockerauth.Resolver
+	mirrors            []string
+
+	// insecure registry hosts mapped to the URL scheme they were found to
+	// serve, or "" if not yet contacted
+	insecureRegistries map[string]string
+	insecureLock       sync.Mutex
+}
+
+// NewClient returns a Client using credentials from the given Resolver, which
+// may be nil. Like the Docker daemon, the Client contacts the given insecure
+// registries ("host:port") over HTTPS without verifying their certificates
+// or, if that fails, over plain HTTP. Requests for Docker Hub repositories
+// are sent to the given registry mirrors (hosts) in order before Docker Hub.
+func NewClient(authResolver *dockerauth.Resolver, insecureRegistries []string, mirrors []string) *Client {
+	insecure := map[string]string{}
+	for _, host := range insecureRegistries {
+		insecure[host] = ""
+	}
+
+	return &Client{
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+		insecureHTTPClient: &http.Client{
+			Timeout:   60 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, Proxy: http.ProxyFromEnvironment},
+		},
+		authResolver:       authResolver,
+		mirrors:            mirrors,
+		insecureRegistries: insecure,
+	}
+}
+
+// clientFor returns the http.Client to use with the given host
+func (c *Client) clientFor(host string) *http.Client {
+	c.insecureLock.Lock()
+	defer c.insecureLock.Unlock()
+
+	if _, insecure := c.insecureRegistries[host]; insecure {
+		return c.insecureHTTPClient
+	}
+	return c.httpClient
+}
+
+// scheme returns the URL scheme to use with the given registry host, probing
+// an insecure registry for HTTPS support the first time it's contacted
+func (c *Client) scheme(host string) string {
+	c.insecureLock.Lock()
+	defer c.insecureLock.Unlock()
+
+	scheme, insecure := c.insecureRegistries[host]
+	if !insecure {
+		return "https"
+	}
+
+	if scheme == "" {
+		scheme = "https"
+		resp, err := c.insecureHTTPClient.Get(fmt.Sprintf("https://%s/v2/", host))
+		if err != nil {
+			scheme = "http"
+		} else {
+			resp.Body.Close()
+		}
+		c.insecureRegistries[host] = scheme
+	}
+	return scheme
+}
+
+// apiHost returns the host serving the registry API for the given reference
+func apiHost(ref reference.Reference) string {
+	if ref.Domain == reference.DefaultDomain {
+		return defaultRegistryHost
+	}
+	return ref.Domain
+}
+
+// get performs a GET request for the given API path of the referenced
+// repository's registry, answering authentication challenges. Requests for
+// Docker Hub repositories fall back from each mirror to the next, and
+// finally to Docker Hub, if a mirror can't be reached or doesn't succeed.
+func (c *Client) get(ref reference.Reference, apiPath string, accept []string) (*http.Response, error) {
+	return c.getContext(context.Background(), ref, apiPath, accept, false)
+}
+
+// getContext is get with a request that's cancelled once the context is
+// done. If stream is set, the response isn't bound by the client's timeout,
+// so large blobs can be read whole.
+func (c *Client) getContext(ctx context.Context, ref reference.Reference, apiPath string, accept []string, stream bool) (*http.Response, error) {
+	if ref.Domain == reference.DefaultDomain {
+		for _, mirror := range c.mirrors {
+			resp, err := c.getFrom(ctx, mirror, mirror, ref.Path, apiPath, accept, stream)
+			if err == nil && resp.StatusCode == http.StatusOK {
+				return resp, nil
+			} else if err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+
+	return c.getFrom(ctx, apiHost(ref), dockerauth.ServerAddress(ref), ref.Path, apiPath, accept, stream)
+}
+
+// getFrom performs a GET request for the given API path of a repository at a
+// registry host, answering authentication challenges with credentials for
+// the given server address
+func (c *Client) getFrom(ctx context.Context, host string, serverAddress string, repoPath string, apiPath string, accept []string, stream bool) (*http.Response, error) {
+	reqURL := fmt.Sprintf("%s://%s/v2/%s/%s", c.scheme(host), host, repoPath, apiPath)
+	httpClient := c.clientFor(host)
+	if stream {
+		untimed := *httpClient
+		untimed.Timeout = 0
+		httpClient = &untimed
+	}
+
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+		return req.WithContext(ctx), nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	auth, found, err := c.authResolver.Lookup(serverAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, params := cmdtools.ParseAuthChallenge(challenge)
+	switch scheme {
+	case "bearer":
+		var token string
+		if scope := fmt.Sprintf("repository:%s:pull", repoPath); auth.IdentityToken != "" {
+			token, err = c.identityBearerToken(params, scope, auth.IdentityToken)
+		} else {
+			token, err = c.bearerToken(params, scope, auth.Username, auth.Password, found)
+		}
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "basic":
+		if !found {
+			return nil, fmt.Errorf("Registry %v requires credentials and none were provided", host)
+		}
+		req.SetBasicAuth(auth.Username, auth.Password)
+	default:
+		return nil, fmt.Errorf("Unsupported authentication challenge from registry %v: %v", host, challenge)
+	}
+
+	return httpClient.Do(req)
+}
+
+// bearerToken fetches a token from the realm given in a bearer challenge
+func (c *Client) bearerToken(params map[string]string, scope string, username string, password string, useCreds bool) (string, error) {
+	var host string
+	if realm, err := url.Parse(params["realm"]); err == nil {
+		host = realm.Host
+	}
+	return BearerToken(c.clientFor(host), params, scope, username, password, useCreds)
+}
+
+// identityBearerToken fetches a token for the given scope from the realm given
+// in a bearer challenge like bearerToken, exchanging an identity token (an
+// OAuth2 refresh token, as credential helpers return for some registries) for it
+func (c *Client) identityBearerToken(params map[string]string, scope string, identityToken string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("Unable to use registry token realm '%v'", params["realm"])
+	}
+
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {identityToken}, "client_id": {"horizon-pkg-build"}, "scope": {scope}}
+	if service, exists := params["service"]; exists {
+		form.Set("service", service)
+	}
+
+	resp, err := c.clientFor(realm.Host).PostForm(realm.String(), form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return readToken(resp, realm)
+}
+
+// BearerToken fetches a token for the given scope (e.g.
+// "repository:ns/app:pull,push") from the realm given in the parameters of a
+// registry's bearer challenge, authenticating with the given credentials if
+// useCreds is set
+func BearerToken(httpClient *http.Client, params map[string]string, scope string, username string, password string, useCreds bool) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("Unable to use registry token realm '%v'", params["realm"])
+	}
+
+	query := realm.Query()
+	if service, exists := params["service"]; exists {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if useCreds {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return readToken(resp, realm)
+}
+
+// readToken reads the token a registry token service responded with
+func readToken(resp *http.Response, realm *url.URL) (string, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Registry token service %v responded with status %v", realm.Host, resp.StatusCode)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", err
+	}
+
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	return tokenResp.AccessToken, nil
+}
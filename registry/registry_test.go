@@ -0,0 +1,259 @@
+// +build unit
+
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/horizon-pkg-build/dockerauth"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testManifestList = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": [
+    {"digest": "sha256:amd64digest", "platform": {"architecture": "amd64", "os": "linux"}},
+    {"digest": "sha256:armv7digest", "platform": {"architecture": "arm", "os": "linux", "variant": "v7"}},
+    {"digest": "sha256:arm64digest", "platform": {"architecture": "arm64", "os": "linux", "variant": "v8"}}
+  ]
+}`
+
+// setupRegistry starts a registry that demands a bearer token obtained with
+// the credentials timmy:s3cret or the identity token "identity"
+func setupRegistry(t *testing.T) (*httptest.Server, string) {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token" && r.Method == http.MethodPost:
+			r.ParseForm()
+			if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "identity" || r.PostForm.Get("scope") != "repository:someimage:pull" || r.PostForm.Get("service") != "test" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"access_token": "tok"}`)
+
+		case r.URL.Path == "/token":
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "timmy" || pass != "s3cret" || r.URL.Query().Get("scope") != "repository:someimage:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token": "tok"}`)
+
+		case r.Header.Get("Authorization") != "Bearer tok":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+
+		case r.URL.Path == "/v2/someimage/manifests/multi":
+			w.Header().Set("Content-Type", MediaTypeManifestList)
+			fmt.Fprint(w, testManifestList)
+
+		case r.URL.Path == "/v2/someimage/manifests/single":
+			w.Header().Set("Content-Type", MediaTypeManifest)
+			w.Header().Set("Docker-Content-Digest", "sha256:singledigest")
+			fmt.Fprint(w, `{}`)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return server, strings.TrimPrefix(server.URL, "https://")
+}
+
+func Test_PlatformDigest_Suite(suite *testing.T) {
+	server, host := setupRegistry(suite)
+	defer server.Close()
+
+	creds := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+		host: docker.AuthConfiguration{Username: "timmy", Password: "s3cret", ServerAddress: host},
+	}}
+
+	client := NewClient(dockerauth.NewResolver(creds, nil, nil), nil, nil)
+	client.httpClient = server.Client()
+
+	suite.Run("PlatformDigest selects the matching manifest list entry", func(t *testing.T) {
+		digest, err := client.PlatformDigest(host+"/someimage:multi", "linux/arm64")
+		assert.Nil(t, err)
+		assert.Equal(t, "sha256:arm64digest", digest)
+
+		digest, err = client.PlatformDigest(host+"/someimage:multi", "linux/arm/v7")
+		assert.Nil(t, err)
+		assert.Equal(t, "sha256:armv7digest", digest)
+	})
+
+	suite.Run("PlatformDigest reports missing platforms", func(t *testing.T) {
+		_, err := client.PlatformDigest(host+"/someimage:multi", "linux/s390x")
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("PlatformDigest returns the digest of a single-platform manifest", func(t *testing.T) {
+		digest, err := client.PlatformDigest(host+"/someimage:single", "linux/arm64")
+		assert.Nil(t, err)
+		assert.Equal(t, "sha256:singledigest", digest)
+	})
+
+	suite.Run("PlatformDigest exchanges identity tokens for registry tokens", func(t *testing.T) {
+		identity := NewClient(dockerauth.NewResolver(&docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+			host: docker.AuthConfiguration{IdentityToken: "identity", ServerAddress: host},
+		}}, nil, nil), nil, nil)
+		identity.httpClient = server.Client()
+
+		digest, err := identity.PlatformDigest(host+"/someimage:multi", "linux/arm64")
+		assert.Nil(t, err)
+		assert.Equal(t, "sha256:arm64digest", digest)
+	})
+
+	suite.Run("PlatformDigest fails without credentials", func(t *testing.T) {
+		anonymous := NewClient(nil, nil, nil)
+		anonymous.httpClient = server.Client()
+
+		_, err := anonymous.PlatformDigest(host+"/someimage:multi", "linux/arm64")
+		assert.NotNil(t, err)
+	})
+}
+
+func Test_InsecureRegistry(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/someimage/manifests/single" {
+			w.Header().Set("Content-Type", MediaTypeManifest)
+			w.Header().Set("Docker-Content-Digest", "sha256:singledigest")
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer plain.Close()
+	plainHost := strings.TrimPrefix(plain.URL, "http://")
+
+	selfSigned, host := setupRegistry(t)
+	defer selfSigned.Close()
+
+	creds := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+		host: docker.AuthConfiguration{Username: "timmy", Password: "s3cret", ServerAddress: host},
+	}}
+
+	// a secure registry with an untrusted certificate must fail
+	_, err := NewClient(dockerauth.NewResolver(creds, nil, nil), nil, nil).PlatformDigest(host+"/someimage:single", "linux/arm64")
+	assert.NotNil(t, err)
+
+	client := NewClient(dockerauth.NewResolver(creds, nil, nil), []string{plainHost, host}, nil)
+
+	digest, err := client.PlatformDigest(plainHost+"/someimage:single", "linux/arm64")
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:singledigest", digest)
+	assert.Equal(t, "http", client.insecureRegistries[plainHost])
+
+	digest, err = client.PlatformDigest(host+"/someimage:multi", "linux/arm64")
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:arm64digest", digest)
+	assert.Equal(t, "https", client.insecureRegistries[host])
+}
+
+func Test_RegistryMirror(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/library/someimage/manifests/multi" {
+			w.Header().Set("Content-Type", MediaTypeManifestList)
+			fmt.Fprint(w, testManifestList)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer mirror.Close()
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+
+	// the first mirror is unreachable, the second has the repository
+	unreachable := "127.0.0.1:1"
+	client := NewClient(nil, []string{unreachable, mirrorHost}, []string{unreachable, mirrorHost})
+
+	digest, err := client.PlatformDigest("someimage:multi", "linux/arm64")
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:arm64digest", digest)
+}
+
+func Test_apiHost(t *testing.T) {
+	for image, expected := range map[string][]string{
+		"alpine":                   []string{defaultRegistryHost, "library/alpine"},
+		"someuser/someimage":       []string{defaultRegistryHost, "someuser/someimage"},
+		"xy.io/ns/someimage":       []string{"xy.io", "ns/someimage"},
+		"localhost:5000/someimage": []string{"localhost:5000", "someimage"},
+	} {
+		ref, err := reference.Parse(image)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, []string{apiHost(ref), ref.Path}, image)
+	}
+}
+
+func Test_Manifest_Blob(t *testing.T) {
+	manifest := `{"schemaVersion":2,"config":{"digest":"sha256:cfg"},"layers":[]}`
+	manifestDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+	list := fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"digest":"sha256:amd64digest","platform":{"architecture":"amd64","os":"linux"}},{"digest":"%s","platform":{"architecture":"arm64","os":"linux"}}]}`, manifestDigest)
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/someimage/manifests/multi":
+			w.Header().Set("Content-Type", MediaTypeOCIIndex)
+			fmt.Fprint(w, list)
+		case "/v2/someimage/manifests/" + manifestDigest:
+			w.Header().Set("Content-Type", MediaTypeOCIManifest+"; charset=utf-8")
+			fmt.Fprint(w, manifest)
+		case "/v2/someimage/manifests/sha256:amd64digest":
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			fmt.Fprint(w, `{"tampered":true}`)
+		case "/v2/someimage/blobs/sha256:cfg":
+			fmt.Fprint(w, "config content")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer plain.Close()
+	host := strings.TrimPrefix(plain.URL, "http://")
+
+	client := NewClient(nil, []string{host}, nil)
+
+	t.Run("Manifest selects the platform's manifest", func(t *testing.T) {
+		content, mediaType, digest, err := client.Manifest(context.Background(), host+"/someimage:multi", "linux/arm64")
+		assert.Nil(t, err)
+		assert.Equal(t, manifest, string(content))
+		assert.Equal(t, MediaTypeOCIManifest, mediaType)
+		assert.Equal(t, manifestDigest, digest)
+	})
+
+	t.Run("Manifest verifies content fetched by digest", func(t *testing.T) {
+		_, _, _, err := client.Manifest(context.Background(), host+"/someimage:multi", "linux/amd64")
+		assert.NotNil(t, err)
+
+		_, _, _, err = client.Manifest(context.Background(), host+"/someimage:multi", "linux/s390x")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Blob streams the blob", func(t *testing.T) {
+		body, size, err := client.Blob(context.Background(), host+"/someimage:multi", "sha256:cfg")
+		assert.Nil(t, err)
+		defer body.Close()
+
+		content, err := ioutil.ReadAll(body)
+		assert.Nil(t, err)
+		assert.Equal(t, "config content", string(content))
+		assert.Equal(t, int64(len(content)), size)
+
+		_, _, err = client.Blob(context.Background(), host+"/someimage:multi", "sha256:missing")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Manifest stops once the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, _, err := client.Manifest(ctx, host+"/someimage:multi", "linux/arm64")
+		assert.NotNil(t, err)
+	})
+}
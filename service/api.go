@@ -0,0 +1,170 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxRequestBytes is the largest job request body read
+const maxRequestBytes = 1 << 20
+
+// Handler returns an http.Handler serving the REST API of the service,
+// requiring the given bearer token in each request's Authorization header
+// unless it's empty:
+//
+//	POST   /v1/jobs              submits a job, a JobRequest, returning its Job (202)
+//	GET    /v1/jobs              returns every Job kept, the most recently submitted first
+//	GET    /v1/jobs/{id}         returns the Job
+//	DELETE /v1/jobs/{id}         cancels the job, returning its Job
+//	GET    /v1/jobs/{id}/log     returns the job's log messages, as text
+//	GET    /v1/jobs/{id}/pkg     returns the Pkg metadata the job built
+//	GET    /v1/jobs/{id}/pkg.sig returns the signature of the Pkg metadata
+//
+// Errors are returned as JSON objects with an "error" field.
+//
+// gRPC calls, requests of Content-Type 'application/grpc', are served the
+// BuildService of buildservice.proto: SubmitBuild, StreamProgress, and
+// GetResult. gRPC needs HTTP/2, which net/http serves over TLS, and the
+// token is then expected in the 'authorization' metadata.
+func Handler(s *Service, token string) http.Handler {
+	return &api{service: s, token: token}
+}
+
+type api struct {
+	service *Service
+	token   string
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isRPC(r) {
+		a.serveRPC(w, r)
+		return
+	}
+
+	if a.token != "" && !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("Expected a valid bearer token"))
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 2 || segments[0] != "v1" || segments[1] != "jobs" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No such resource: %v", r.URL.Path))
+		return
+	}
+
+	switch {
+	case len(segments) == 2 && r.Method == http.MethodPost:
+		a.submit(w, r)
+	case len(segments) == 2 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, a.service.Jobs())
+	case len(segments) == 3 && r.Method == http.MethodGet:
+		job, err := a.service.Job(segments[2])
+		a.respond(w, http.StatusOK, job, err)
+	case len(segments) == 3 && r.Method == http.MethodDelete:
+		job, err := a.service.Cancel(segments[2])
+		a.respond(w, http.StatusOK, job, err)
+	case len(segments) == 4 && r.Method == http.MethodGet:
+		a.get(w, r, segments[2], segments[3])
+	case len(segments) <= 4:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %v not allowed on %v", r.Method, r.URL.Path))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("No such resource: %v", r.URL.Path))
+	}
+}
+
+// authorized tells if the request carries the token
+func (a *api) authorized(r *http.Request) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) == 1
+}
+
+// submit submits the job request in the request body
+func (a *api) submit(w http.ResponseWriter, r *http.Request) {
+	var request JobRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Unable to decode job request. Error: %v", err))
+		return
+	}
+
+	job, err := a.service.Submit(request)
+	if err == ErrQueueFull {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// get serves the log or a built file of a job
+func (a *api) get(w http.ResponseWriter, r *http.Request, id string, name string) {
+	switch name {
+	case "log":
+		lines, err := a.service.Log(id)
+		if err != nil {
+			a.respond(w, 0, nil, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+
+	case "pkg", "pkg.sig":
+		pkgFile, pkgSigFile, err := a.service.Files(id)
+		if err == ErrJobNotFound {
+			a.respond(w, 0, nil, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+
+		if name == "pkg" {
+			w.Header().Set("Content-Type", "application/json")
+			http.ServeFile(w, r, pkgFile)
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeFile(w, r, pkgSigFile)
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("No such resource: %v", r.URL.Path))
+	}
+}
+
+// respond writes the value with the given status, or the error with the status it calls for
+func (a *api) respond(w http.ResponseWriter, status int, v interface{}, err error) {
+	switch err {
+	case nil:
+		writeJSON(w, status, v)
+	case ErrJobNotFound:
+		writeError(w, http.StatusNotFound, err)
+	case ErrJobFinished:
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,333 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/gogo/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rpcPrefix is the path prefix of the methods of the BuildService of buildservice.proto
+const rpcPrefix = "/horizonpkgbuild.v1.BuildService/"
+
+// maxRPCMessageBytes is the largest request message read, as gRPC's default
+const maxRPCMessageBytes = 4 << 20
+
+// gRPC status codes, see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	rpcOK                 = 0
+	rpcCancelled          = 1
+	rpcUnknown            = 2
+	rpcInvalidArgument    = 3
+	rpcNotFound           = 5
+	rpcResourceExhausted  = 8
+	rpcFailedPrecondition = 9
+	rpcUnimplemented      = 12
+	rpcInternal           = 13
+	rpcUnauthenticated    = 16
+)
+
+// The messages of buildservice.proto, encoded by their protobuf struct tags
+
+// SubmitBuildRequest is a JobRequest as the BuildService takes it
+type SubmitBuildRequest struct {
+	Images      []string `protobuf:"bytes,1,rep,name=images,proto3" json:"images,omitempty"`
+	Key         string   `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Destination string   `protobuf:"bytes,3,opt,name=destination,proto3" json:"destination,omitempty"`
+	PartURLBase string   `protobuf:"bytes,4,opt,name=part_url_base,json=partUrlBase,proto3" json:"part_url_base,omitempty"`
+	PkgName     string   `protobuf:"bytes,5,opt,name=pkg_name,json=pkgName,proto3" json:"pkg_name,omitempty"`
+	Author      string   `protobuf:"bytes,6,opt,name=author,proto3" json:"author,omitempty"`
+	Description string   `protobuf:"bytes,7,opt,name=description,proto3" json:"description,omitempty"`
+	Version     string   `protobuf:"bytes,8,opt,name=version,proto3" json:"version,omitempty"`
+	Labels      []string `protobuf:"bytes,9,rep,name=labels,proto3" json:"labels,omitempty"`
+}
+
+func (m *SubmitBuildRequest) Reset()         { *m = SubmitBuildRequest{} }
+func (m *SubmitBuildRequest) String() string { return proto.CompactTextString(m) }
+func (*SubmitBuildRequest) ProtoMessage()    {}
+
+// BuildRef names a job by its ID
+type BuildRef struct {
+	ID string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (m *BuildRef) Reset()         { *m = BuildRef{} }
+func (m *BuildRef) String() string { return proto.CompactTextString(m) }
+func (*BuildRef) ProtoMessage()    {}
+
+// BuildStatus is a Job's status as the BuildService returns it, with its
+// times in seconds since the Unix epoch, or 0 if they haven't come yet
+type BuildStatus struct {
+	ID             string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	State          string `protobuf:"bytes,2,opt,name=state,proto3" json:"state,omitempty"`
+	PartsStarted   int32  `protobuf:"varint,3,opt,name=parts_started,json=partsStarted,proto3" json:"parts_started,omitempty"`
+	PartsCompleted int32  `protobuf:"varint,4,opt,name=parts_completed,json=partsCompleted,proto3" json:"parts_completed,omitempty"`
+	Exported       int64  `protobuf:"varint,5,opt,name=exported,proto3" json:"exported,omitempty"`
+	Total          int64  `protobuf:"varint,6,opt,name=total,proto3" json:"total,omitempty"`
+	Error          string `protobuf:"bytes,7,opt,name=error,proto3" json:"error,omitempty"`
+	Code           int32  `protobuf:"varint,8,opt,name=code,proto3" json:"code,omitempty"`
+	Submitted      int64  `protobuf:"varint,9,opt,name=submitted,proto3" json:"submitted,omitempty"`
+	Started        int64  `protobuf:"varint,10,opt,name=started,proto3" json:"started,omitempty"`
+	Finished       int64  `protobuf:"varint,11,opt,name=finished,proto3" json:"finished,omitempty"`
+}
+
+func (m *BuildStatus) Reset()         { *m = BuildStatus{} }
+func (m *BuildStatus) String() string { return proto.CompactTextString(m) }
+func (*BuildStatus) ProtoMessage()    {}
+
+// BuildResult is the status of a finished job and, if it succeeded, the
+// Pkg it built, with the content of its metadata and signature files
+type BuildResult struct {
+	Status       *BuildStatus `protobuf:"bytes,1,opt,name=status" json:"status,omitempty"`
+	PkgID        string       `protobuf:"bytes,2,opt,name=pkg_id,json=pkgId,proto3" json:"pkg_id,omitempty"`
+	PkgName      string       `protobuf:"bytes,3,opt,name=pkg_name,json=pkgName,proto3" json:"pkg_name,omitempty"`
+	URL          string       `protobuf:"bytes,4,opt,name=url,proto3" json:"url,omitempty"`
+	Parts        []*BuildPart `protobuf:"bytes,5,rep,name=parts" json:"parts,omitempty"`
+	Pkg          []byte       `protobuf:"bytes,6,opt,name=pkg,proto3" json:"pkg,omitempty"`
+	PkgSignature []byte       `protobuf:"bytes,7,opt,name=pkg_signature,json=pkgSignature,proto3" json:"pkg_signature,omitempty"`
+}
+
+func (m *BuildResult) Reset()         { *m = BuildResult{} }
+func (m *BuildResult) String() string { return proto.CompactTextString(m) }
+func (*BuildResult) ProtoMessage()    {}
+
+// BuildPart is a part recorded in the metadata of a Pkg a job built
+type BuildPart struct {
+	ID        string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Sha256sum string   `protobuf:"bytes,2,opt,name=sha256sum,proto3" json:"sha256sum,omitempty"`
+	Bytes     int64    `protobuf:"varint,3,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	URLs      []string `protobuf:"bytes,4,rep,name=urls,proto3" json:"urls,omitempty"`
+}
+
+func (m *BuildPart) Reset()         { *m = BuildPart{} }
+func (m *BuildPart) String() string { return proto.CompactTextString(m) }
+func (*BuildPart) ProtoMessage()    {}
+
+// rpcError is the error a call fails with, and its status code
+type rpcError struct {
+	code int
+	msg  string
+}
+
+func (e *rpcError) Error() string {
+	return e.msg
+}
+
+func rpcErrorf(code int, format string, args ...interface{}) error {
+	return &rpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// isRPC tells if the request is a gRPC call
+func isRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// serveRPC serves a gRPC call of the BuildService, which must be made over
+// HTTP/2, as net/http serves it over TLS: requests and responses are
+// length-prefixed protobuf messages, and the status of the call is sent in
+// the grpc-status and grpc-message trailers
+func (a *api) serveRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost {
+		writeError(w, http.StatusHTTPVersionNotSupported, fmt.Errorf("Expected gRPC calls over HTTP/2, served over TLS"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	status, msg := rpcOK, ""
+	if err := a.call(w, r); err != nil {
+		status, msg = rpcUnknown, err.Error()
+		if rpcErr, ok := err.(*rpcError); ok {
+			status = rpcErr.code
+		}
+	}
+
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", rpcPercentEncode(msg))
+	}
+}
+
+// call calls the method the request names
+func (a *api) call(w http.ResponseWriter, r *http.Request) error {
+	if a.token != "" && !a.authorized(r) {
+		return rpcErrorf(rpcUnauthenticated, "Expected a valid bearer token")
+	}
+
+	switch method := strings.TrimPrefix(r.URL.Path, rpcPrefix); method {
+	case "SubmitBuild":
+		var request SubmitBuildRequest
+		if err := readRPC(r.Body, &request); err != nil {
+			return err
+		}
+
+		job, err := a.service.Submit(JobRequest{
+			Images:      request.Images,
+			Key:         request.Key,
+			Destination: request.Destination,
+			PartURLBase: request.PartURLBase,
+			PkgName:     request.PkgName,
+			Author:      request.Author,
+			Description: request.Description,
+			Version:     request.Version,
+			Labels:      request.Labels,
+		})
+		if err == ErrQueueFull {
+			return rpcErrorf(rpcResourceExhausted, "%v", err)
+		} else if err != nil {
+			return rpcErrorf(rpcInvalidArgument, "%v", err)
+		}
+		return writeRPC(w, buildStatus(job))
+
+	case "StreamProgress":
+		var ref BuildRef
+		if err := readRPC(r.Body, &ref); err != nil {
+			return err
+		}
+
+		err := a.service.Watch(r.Context(), ref.ID, func(job Job) error {
+			return writeRPC(w, buildStatus(job))
+		})
+		if err == ErrJobNotFound {
+			return rpcErrorf(rpcNotFound, "%v", err)
+		} else if r.Context().Err() != nil {
+			return rpcErrorf(rpcCancelled, "%v", r.Context().Err())
+		}
+		return err
+
+	case "GetResult":
+		var ref BuildRef
+		if err := readRPC(r.Body, &ref); err != nil {
+			return err
+		}
+
+		result, err := a.buildResult(ref.ID)
+		if err != nil {
+			return err
+		}
+		return writeRPC(w, result)
+
+	default:
+		return rpcErrorf(rpcUnimplemented, "Unknown method %v", r.URL.Path)
+	}
+}
+
+// buildResult returns the result of the finished job with the given ID
+func (a *api) buildResult(id string) (*BuildResult, error) {
+	job, err := a.service.Job(id)
+	if err == ErrJobNotFound {
+		return nil, rpcErrorf(rpcNotFound, "%v", err)
+	} else if err != nil {
+		return nil, err
+	} else if job.Finished == nil {
+		return nil, rpcErrorf(rpcFailedPrecondition, "Job %v is not finished, it's %v", id, job.State)
+	}
+
+	result := &BuildResult{Status: buildStatus(job)}
+	if job.State != JobSucceeded {
+		return result, nil
+	}
+
+	result.PkgID, result.PkgName, result.URL = job.Result.PkgID, job.Result.PkgName, job.Result.URL
+	for _, part := range job.Result.Parts {
+		result.Parts = append(result.Parts, &BuildPart{ID: part.ID, Sha256sum: part.Sha256sum, Bytes: part.Bytes, URLs: part.URLs})
+	}
+
+	pkgFile, pkgSigFile, err := a.service.Files(id)
+	if err != nil {
+		return nil, rpcErrorf(rpcNotFound, "%v", err)
+	}
+	if result.Pkg, err = ioutil.ReadFile(pkgFile); err != nil {
+		return nil, rpcErrorf(rpcInternal, "Unable to read Pkg metadata. Error: %v", err)
+	}
+	if result.PkgSignature, err = ioutil.ReadFile(pkgSigFile); err != nil {
+		return nil, rpcErrorf(rpcInternal, "Unable to read Pkg signature. Error: %v", err)
+	}
+	return result, nil
+}
+
+// buildStatus returns the job's status as a BuildStatus message
+func buildStatus(job Job) *BuildStatus {
+	status := &BuildStatus{
+		ID:             job.ID,
+		State:          job.State,
+		PartsStarted:   int32(job.Progress.PartsStarted),
+		PartsCompleted: int32(job.Progress.PartsCompleted),
+		Exported:       job.Progress.Exported,
+		Total:          job.Progress.Total,
+		Error:          job.Error,
+		Code:           int32(job.Code),
+		Submitted:      job.Submitted.Unix(),
+	}
+	if job.Started != nil {
+		status.Started = job.Started.Unix()
+	}
+	if job.Finished != nil {
+		status.Finished = job.Finished.Unix()
+	}
+	return status
+}
+
+// readRPC reads a request message, which mustn't be compressed
+func readRPC(r io.Reader, msg proto.Message) error {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return rpcErrorf(rpcInvalidArgument, "Unable to read request message. Error: %v", err)
+	} else if prefix[0] != 0 {
+		return rpcErrorf(rpcUnimplemented, "Compressed request messages are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxRPCMessageBytes {
+		return rpcErrorf(rpcResourceExhausted, "Request message of %v bytes is larger than %v bytes", size, maxRPCMessageBytes)
+	}
+
+	content := make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return rpcErrorf(rpcInvalidArgument, "Unable to read request message. Error: %v", err)
+	}
+
+	if err := proto.Unmarshal(content, msg); err != nil {
+		return rpcErrorf(rpcInvalidArgument, "Unable to decode request message. Error: %v", err)
+	}
+	return nil
+}
+
+// writeRPC writes a response message, uncompressed, and sends it at once
+func writeRPC(w http.ResponseWriter, msg proto.Message) error {
+	content, err := proto.Marshal(msg)
+	if err != nil {
+		return rpcErrorf(rpcInternal, "Unable to encode response message. Error: %v", err)
+	}
+
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(content)))
+	if _, err := w.Write(append(prefix, content...)); err != nil {
+		return rpcErrorf(rpcUnknown, "Unable to write response message. Error: %v", err)
+	}
+
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// rpcPercentEncode encodes a grpc-message as gRPC requires, escaping '%' and
+// bytes other than printable ASCII
+func rpcPercentEncode(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,720 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/create"
+	"github.com/open-horizon/horizon-pkg-build/reference"
+	"github.com/open-horizon/horizon-pkg-build/upload"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The states of a Job
+const (
+	// JobQueued is for a job waiting for a build slot
+	JobQueued = "queued"
+
+	// JobBuilding is for a job whose Pkg is being built (and its parts uploaded, if they're handed off)
+	JobBuilding = "building"
+
+	// JobUploading is for a job whose built Pkg is being uploaded and verified
+	JobUploading = "uploading"
+
+	// JobSucceeded, JobFailed, and JobCancelled are for finished jobs
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// DefaultQueueSize is the number of jobs that may wait for a build slot unless Config.QueueSize says otherwise
+const DefaultQueueSize = 100
+
+// DefaultRetain is the number of finished jobs kept unless Config.Retain says otherwise
+const DefaultRetain = 100
+
+// jobLogLines is the number of log lines kept for each job, the oldest dropped first
+const jobLogLines = 1000
+
+var (
+	// ErrQueueFull is the error of a job submitted while as many jobs as allowed are waiting
+	ErrQueueFull = errors.New("Too many jobs are queued, try again later")
+
+	// ErrJobNotFound is the error for a job that doesn't exist, or was forgotten
+	ErrJobNotFound = errors.New("No such job")
+
+	// ErrJobFinished is the error of cancelling a job that's finished already
+	ErrJobFinished = errors.New("Job is finished already")
+)
+
+// Config configures a Service
+type Config struct {
+	// Reporter is where the builds' log messages and failures are reported,
+	// tagged with the IDs of their jobs (see cmdtools.WithBuildID)
+	Reporter *cmdtools.SynchronizedReporter
+
+	// Options are those every job's Pkg is built with; a job sets
+	// PrivateKey, Author, Info, PkgName, URLBase, PartDestination,
+	// PartHandoff, and Events of its own, and Author and URLBase are the
+	// defaults of jobs that don't
+	Options create.Options
+
+	// Keys are the PEM-encoded RSA private keys jobs may sign Pkgs with, by
+	// the names jobs refer to them by, so keys are never sent to the service
+	Keys map[string][]byte
+
+	// Destinations are the upload destinations jobs may upload Pkgs to, or
+	// that their destinations must be under (e.g. 's3://bucket/pkgs' allows
+	// 's3://bucket/pkgs/team-a'), with the backend options, as query
+	// parameters, jobs' uploads are made with; without any, jobs can't be
+	// uploaded
+	Destinations []string
+
+	// Credentials and BandwidthLimit are those uploads are made with, and
+	// UploadParallelism the number of parts each job uploads at once
+	Credentials       upload.Credentials
+	BandwidthLimit    int64
+	UploadParallelism int
+
+	// Verify checks that uploaded Pkgs can be downloaded (see upload.Verify)
+	Verify bool
+
+	// Parallel is the number of jobs built at once; zero means one
+	Parallel int
+
+	// QueueSize is the number of jobs that may wait for a build slot, beyond
+	// which jobs are refused; zero means DefaultQueueSize
+	QueueSize int
+
+	// Retain is the number of finished jobs kept for their status and
+	// results, the oldest forgotten first (their Pkgs stay in the output
+	// directory, unless in workspaces); zero means DefaultRetain
+	Retain int
+
+	// Workspaces builds each job in a directory of its own under
+	// Options.OutputDir, and Options.TmpDir if set, named by the job's ID, so
+	// jobs can't clash over Pkg names; a job's workspace is removed once the
+	// job is forgotten
+	Workspaces bool
+}
+
+// JobRequest describes the Pkg a job builds
+type JobRequest struct {
+	// Images are the Docker images to package, as given to 'create'
+	Images []string `json:"images"`
+
+	// Key names the private key, among Config.Keys, the Pkg is signed with
+	Key string `json:"key"`
+
+	// Destination, if set, is where the Pkg is uploaded once it's built, as
+	// given to 'create --upload' but without any backend options
+	Destination string `json:"destination,omitempty"`
+
+	// PartURLBase, PkgName, Author, Description, Version, and Labels are
+	// as given to 'create' with the options of the same names
+	PartURLBase string   `json:"partUrlBase,omitempty"`
+	PkgName     string   `json:"pkgName,omitempty"`
+	Author      string   `json:"author,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Version     string   `json:"version,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+}
+
+// Job is the status of a job building a Pkg
+type Job struct {
+	ID        string     `json:"id"`
+	State     string     `json:"state"`
+	Request   JobRequest `json:"request"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Progress  Progress   `json:"progress"`
+
+	// Result is the Pkg built, once the job succeeded
+	Result *JobResult `json:"result,omitempty"`
+
+	// Error is why the job failed, and Code the exit status 'create' would
+	// have failed with, one of the cmdtools.Exit* constants
+	Error string `json:"error,omitempty"`
+	Code  int    `json:"code,omitempty"`
+}
+
+// Progress is how far a job's build has got
+type Progress struct {
+	// PartsStarted and PartsCompleted count the parts started and added to the Pkg
+	PartsStarted   int `json:"partsStarted"`
+	PartsCompleted int `json:"partsCompleted"`
+
+	// Exported is the uncompressed bytes of the images exported so far, and
+	// Total that of the images of the parts started, where known
+	Exported int64 `json:"exported"`
+	Total    int64 `json:"total"`
+}
+
+// JobResult describes the Pkg a job built
+type JobResult struct {
+	PkgID   string `json:"pkgId"`
+	PkgName string `json:"pkgName"`
+
+	// URL is that of the metadata file at the destination, if it was uploaded
+	URL string `json:"url,omitempty"`
+
+	// Parts are the parts recorded in the metadata
+	Parts []create.PkgPart `json:"parts"`
+}
+
+// job is a Job with what the service needs to run it, guarded by the service's lock
+type job struct {
+	Job
+	cancel     context.CancelFunc
+	exported   map[string]int64
+	log        []string
+	pkgFile    string
+	pkgSigFile string
+}
+
+// Service builds Pkgs as jobs submitted to it, a few at a time, keeping
+// their status and results for a while once they're done: the part of a
+// build service that doesn't depend on how it's reached (see Handler). Jobs
+// are identified by the build IDs their builds are tagged with, so their log
+// messages can be told apart. It's safe for concurrent use.
+type Service struct {
+	config Config
+	queue  chan *job
+
+	lock     sync.Mutex
+	jobs     map[string]*job
+	finished []string      // the IDs of finished jobs, the oldest first
+	changed  chan struct{} // closed, and replaced, when any job changes
+}
+
+// New returns a Service building Pkgs as config says, or an error if it's
+// invalid; jobs are built once it's Run
+func New(config Config) (*Service, error) {
+	if config.Reporter == nil {
+		return nil, fmt.Errorf("Expected a reporter")
+	} else if len(config.Keys) == 0 {
+		return nil, fmt.Errorf("Expected at least one signing key")
+	} else if config.Workspaces && config.Options.OutputDir == "" {
+		return nil, fmt.Errorf("Expected an output directory for the workspaces of jobs")
+	}
+
+	if config.Parallel < 1 {
+		config.Parallel = 1
+	}
+	if config.QueueSize < 1 {
+		config.QueueSize = DefaultQueueSize
+	}
+	if config.Retain < 1 {
+		config.Retain = DefaultRetain
+	}
+
+	s := &Service{config: config, queue: make(chan *job, config.QueueSize), jobs: map[string]*job{}, changed: make(chan struct{})}
+	config.Reporter.Bus.Subscribe(s.observe)
+	return s, nil
+}
+
+// Run builds the jobs submitted, up to Config.Parallel at once, until ctx is
+// done, when the jobs being built are cancelled, and returns once they've
+// stopped
+func (s *Service) Run(ctx context.Context) {
+	var workers sync.WaitGroup
+	for i := 0; i < s.config.Parallel; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case j := <-s.queue:
+					s.run(ctx, j)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	workers.Wait()
+}
+
+// Submit queues a job building the Pkg the request describes and returns
+// its status, or an error if the request is invalid or the queue is full
+func (s *Service) Submit(request JobRequest) (Job, error) {
+	if err := s.check(&request); err != nil {
+		return Job{}, err
+	}
+
+	j := &job{Job: Job{ID: cmdtools.NewBuildID(), State: JobQueued, Request: request, Submitted: time.Now().UTC()}, exported: map[string]int64{}}
+
+	s.lock.Lock()
+	select {
+	case s.queue <- j:
+		s.jobs[j.ID] = j
+	default:
+		s.lock.Unlock()
+		return Job{}, ErrQueueFull
+	}
+	queued := j.Job
+	s.lock.Unlock()
+
+	s.config.Reporter.Log.Infof("Queued job %v to build a Pkg of %v images", queued.ID, len(request.Images))
+	return queued, nil
+}
+
+// check returns an error if the request is invalid, normalizing its images
+func (s *Service) check(request *JobRequest) error {
+	if len(request.Images) == 0 {
+		return fmt.Errorf("Expected at least one image")
+	}
+	request.Images = append([]string{}, request.Images...)
+	for i, image := range request.Images {
+		if create.IsImageID(image) {
+			return fmt.Errorf("Image %v is referenced by local image ID; reference it by tag or digest instead", image)
+		}
+
+		ref, err := reference.Parse(image)
+		if err != nil {
+			return fmt.Errorf("Unable to use image %v. Error: %v", image, err)
+		}
+		request.Images[i] = ref.String()
+	}
+
+	if _, exists := s.config.Keys[request.Key]; !exists {
+		return fmt.Errorf("Unknown signing key '%v'", request.Key)
+	}
+
+	if request.Destination != "" {
+		if _, allowed := allowedDestination(request.Destination, s.config.Destinations); !allowed {
+			return fmt.Errorf("Destination %v is not among those jobs may upload to", request.Destination)
+		}
+	}
+
+	if request.PartURLBase != "" {
+		if err := create.CheckPartURLTemplate(request.PartURLBase); err != nil {
+			return fmt.Errorf("Unable to use part URL base. Error: %v", err)
+		}
+	}
+
+	if request.PkgName != "" {
+		if err := create.CheckPkgName(request.PkgName); err != nil {
+			return fmt.Errorf("Unable to use Pkg name. Error: %v", err)
+		}
+	}
+
+	if request.Version != "" {
+		if err := create.CheckPkgVersion(request.Version); err != nil {
+			return fmt.Errorf("Unable to use Pkg version. Error: %v", err)
+		}
+	}
+
+	if _, err := create.ParseLabels(request.Labels); err != nil {
+		return fmt.Errorf("Unable to use labels. Error: %v", err)
+	}
+	return nil
+}
+
+// allowedDestination returns the upload destination of a job asking for
+// destination, if it's one of those allowed or under one: destination with
+// the backend options of the allowed one. Job destinations can't set options
+// of their own, e.g. another endpoint, or climb out of the allowed ones with
+// '..', so they're compared by scheme, host, and path segments.
+func allowedDestination(destination string, allowed []string) (string, bool) {
+	u, err := url.Parse(destination)
+	if err != nil || u.Scheme == "" || u.Opaque != "" || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return "", false
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return "", false
+		}
+	}
+
+	for _, a := range allowed {
+		au, err := url.Parse(a)
+		if err != nil || au.Scheme != u.Scheme || au.Host != u.Host || userOf(au) != userOf(u) {
+			continue
+		}
+
+		under := path.Clean("/" + au.Path)
+		if p := path.Clean("/" + u.Path); under == "/" || p == under || strings.HasPrefix(p, under+"/") {
+			resolved := *u
+			resolved.RawQuery = au.RawQuery
+			return resolved.String(), true
+		}
+	}
+	return "", false
+}
+
+// userOf returns the user information of the URL, or "" if it has none
+func userOf(u *url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	return u.User.String()
+}
+
+// Job returns the status of the job with the given ID
+func (s *Service) Job(id string) (Job, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	j, exists := s.jobs[id]
+	if !exists {
+		return Job{}, ErrJobNotFound
+	}
+	return j.Job, nil
+}
+
+// Jobs returns the status of every job kept, the most recently submitted first
+func (s *Service) Jobs() []Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	jobs := []Job{}
+	for _, j := range s.jobs {
+		jobs = append(jobs, j.Job)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Submitted.After(jobs[b].Submitted) })
+	return jobs
+}
+
+// Log returns the log messages of the job with the given ID, the last
+// jobLogLines of them
+func (s *Service) Log(id string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	j, exists := s.jobs[id]
+	if !exists {
+		return nil, ErrJobNotFound
+	}
+	return append([]string{}, j.log...), nil
+}
+
+// Files returns the metadata and signature files of the Pkg the job with
+// the given ID built, or an error if it hasn't succeeded
+func (s *Service) Files(id string) (string, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	j, exists := s.jobs[id]
+	if !exists {
+		return "", "", ErrJobNotFound
+	} else if j.State != JobSucceeded {
+		return "", "", fmt.Errorf("Job %v has not succeeded, it's %v", id, j.State)
+	}
+	return j.pkgFile, j.pkgSigFile, nil
+}
+
+// Watch calls fn with the status of the job with the given ID, and again
+// each time its state or progress changes, until the job is finished, fn
+// fails, or ctx is done, and returns the error of either, if any
+func (s *Service) Watch(ctx context.Context, id string, fn func(Job) error) error {
+	var last *Job
+	for {
+		s.lock.Lock()
+		j, exists := s.jobs[id]
+		var job Job
+		if exists {
+			job = j.Job
+		}
+		changed := s.changed
+		s.lock.Unlock()
+
+		if !exists {
+			return ErrJobNotFound
+		}
+
+		if last == nil || job.State != last.State || job.Progress != last.Progress {
+			if err := fn(job); err != nil {
+				return err
+			}
+			last = &job
+		}
+
+		if job.Finished != nil {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Cancel cancels the job with the given ID: a queued job isn't built, and
+// the build or upload of a running job is stopped
+func (s *Service) Cancel(id string) (Job, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	j, exists := s.jobs[id]
+	if !exists {
+		return Job{}, ErrJobNotFound
+	}
+
+	switch j.State {
+	case JobQueued:
+		s.finish(j, JobCancelled, "Cancelled", cmdtools.ExitError)
+	case JobBuilding, JobUploading:
+		// the job is finished as cancelled once it stops
+		j.cancel()
+	default:
+		return j.Job, ErrJobFinished
+	}
+	return j.Job, nil
+}
+
+// observe keeps the log messages of builds tagged with the IDs of jobs
+func (s *Service) observe(e cmdtools.Event) {
+	if e.Event != cmdtools.EventOutput || e.Build == "" {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if j, exists := s.jobs[e.Build]; exists {
+		j.log = append(j.log, strings.TrimRight(e.Message, "\n"))
+		if len(j.log) > jobLogLines {
+			j.log = j.log[len(j.log)-jobLogLines:]
+		}
+	}
+}
+
+// progress updates the job's progress with an event of its build
+func (s *Service) progress(j *job, e create.Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	part := strings.Join(e.Images, ",")
+	switch e.Kind {
+	case create.EventPartStarted:
+		j.Progress.PartsStarted++
+		j.Progress.Total += e.Total
+	case create.EventPartExported:
+		j.Progress.Exported += e.Bytes - j.exported[part]
+		j.exported[part] = e.Bytes
+	case create.EventPartCompleted:
+		j.Progress.PartsCompleted++
+	}
+	s.notify()
+}
+
+// notify wakes those watching jobs; the lock is held
+func (s *Service) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// start marks a queued job as being built, returning false if it was cancelled while queued
+func (s *Service) start(ctx context.Context, j *job) (context.Context, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if j.State != JobQueued {
+		return nil, false
+	}
+
+	started := time.Now().UTC()
+	j.State, j.Started = JobBuilding, &started
+	s.notify()
+
+	ctx, j.cancel = context.WithCancel(cmdtools.WithBuildID(ctx, j.ID))
+	return ctx, true
+}
+
+// setState sets the state of a running job
+func (s *Service) setState(j *job, state string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	j.State = state
+	s.notify()
+}
+
+// finish marks the job finished in the given state, forgetting the oldest
+// finished jobs beyond those retained; the lock is held
+func (s *Service) finish(j *job, state string, message string, code int) {
+	finished := time.Now().UTC()
+	j.State, j.Finished, j.Error, j.Code = state, &finished, message, code
+
+	s.finished = append(s.finished, j.ID)
+	for len(s.finished) > s.config.Retain {
+		delete(s.jobs, s.finished[0])
+		if s.config.Workspaces {
+			go os.RemoveAll(filepath.Join(s.config.Options.OutputDir, s.finished[0]))
+		}
+		s.finished = s.finished[1:]
+	}
+	s.notify()
+}
+
+// run builds and uploads the Pkg of a job, recording how it ended
+func (s *Service) run(ctx context.Context, j *job) {
+	buildCtx, started := s.start(ctx, j)
+	if !started {
+		return
+	}
+	defer j.cancel()
+
+	log := s.config.Reporter.Log.WithContext(buildCtx)
+	log.Infof("Started job %v", j.ID)
+
+	result, files, err := s.build(buildCtx, j)
+
+	// not logged while the lock is held, since the service observes log messages
+	job := s.end(ctx, buildCtx, j, result, files, err)
+	if job.State == JobSucceeded {
+		log.Infof("Job %v succeeded, built Pkg %v", job.ID, job.Result.PkgName)
+	} else {
+		log.Warnf("Job %v %v: %v", job.ID, job.State, job.Error)
+	}
+}
+
+// end records how a job ended and returns its status
+func (s *Service) end(ctx context.Context, buildCtx context.Context, j *job, result *JobResult, files builtPkg, err error) Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var buildErr *create.BuildError
+	switch {
+	case buildCtx.Err() != nil && ctx.Err() != nil:
+		s.finish(j, JobCancelled, "Cancelled, the service is stopping", cmdtools.ExitError)
+	case buildCtx.Err() != nil:
+		s.finish(j, JobCancelled, "Cancelled", cmdtools.ExitError)
+	case errors.As(err, &buildErr):
+		s.finish(j, JobFailed, buildErr.Error(), buildErr.Code)
+	case err != nil:
+		s.finish(j, JobFailed, err.Error(), cmdtools.ExitCodeOf(err))
+	default:
+		j.Result, j.pkgFile, j.pkgSigFile = result, files.pkgFile, files.pkgSigFile
+		s.finish(j, JobSucceeded, "", 0)
+	}
+	return j.Job
+}
+
+// builtPkg is where the metadata and signature files of a job's Pkg are
+type builtPkg struct {
+	pkgFile    string
+	pkgSigFile string
+}
+
+// build builds the Pkg of a job and uploads it to the job's destination, if any
+func (s *Service) build(ctx context.Context, j *job) (*JobResult, builtPkg, error) {
+	request := j.Request
+
+	options := s.config.Options
+	if s.config.Workspaces {
+		options.OutputDir = filepath.Join(options.OutputDir, j.ID)
+		if err := os.MkdirAll(options.OutputDir, 0755); err != nil {
+			return nil, builtPkg{}, fmt.Errorf("Unable to create workspace of job. Error: %v", err)
+		}
+
+		if options.TmpDir != "" {
+			options.TmpDir = filepath.Join(options.TmpDir, j.ID)
+			if err := os.MkdirAll(options.TmpDir, 0755); err != nil {
+				return nil, builtPkg{}, fmt.Errorf("Unable to create temporary workspace of job. Error: %v", err)
+			}
+			defer os.RemoveAll(options.TmpDir)
+		}
+	}
+	options.PrivateKey = s.config.Keys[request.Key]
+	options.PkgName = request.PkgName
+	options.Events = func(e create.Event) { s.progress(j, e) }
+	if request.Author != "" {
+		options.Author = request.Author
+	}
+	if request.PartURLBase != "" {
+		options.URLBase = request.PartURLBase
+	}
+
+	labels, err := create.ParseLabels(request.Labels)
+	if err != nil {
+		return nil, builtPkg{}, &cmdtools.Failure{Kind: cmdtools.ErrUsage, Msg: "Unable to use labels", Err: err}
+	}
+	options.Info = create.PkgInfo{Description: request.Description, Version: request.Version, Labels: labels}
+
+	// parts are uploaded as soon as they're built, or put as they're created if their URLs are known only then
+	var uploader upload.Uploader
+	var handoff *upload.Handoff
+	if destination, _ := allowedDestination(request.Destination, s.config.Destinations); destination != "" {
+		uploader, err = upload.New(destination, s.config.Credentials, s.config.BandwidthLimit)
+		if err != nil {
+			return nil, builtPkg{}, &cmdtools.Failure{Kind: cmdtools.ErrUsage, Msg: "Unable to use destination", Err: err}
+		}
+
+		if upload.ContentAddressed(uploader) {
+			options.PartDestination = uploader
+		} else {
+			if request.PartURLBase == "" {
+				if options.URLBase = upload.BaseURL(uploader); options.URLBase == "" {
+					return nil, builtPkg{}, &cmdtools.Failure{Kind: cmdtools.ErrUsage, Msg: "A part URL base is required with the given destination since the URL its content is served from isn't known"}
+				}
+			}
+
+			handoff = upload.NewHandoff(uploader, s.config.Reporter.ErrWriter, s.config.UploadParallelism, nil)
+			options.PartHandoff = handoff
+		}
+	}
+
+	if options.URLBase == "" {
+		return nil, builtPkg{}, &cmdtools.Failure{Kind: cmdtools.ErrUsage, Msg: "A part URL base is required"}
+	} else if options.Author == "" {
+		return nil, builtPkg{}, &cmdtools.Failure{Kind: cmdtools.ErrUsage, Msg: "An author is required"}
+	}
+
+	builder, err := create.NewBuilder(s.config.Reporter, options)
+	if err != nil {
+		return nil, builtPkg{}, &cmdtools.Failure{Kind: cmdtools.ErrUsage, Msg: "Unable to set up Pkg builder", Err: err}
+	}
+
+	built, err := builder.Build(ctx, request.Images)
+	if err != nil {
+		return nil, builtPkg{}, err
+	}
+
+	parts, err := create.ReadPkgParts(built.PkgFile, built.PkgDir)
+	if err != nil {
+		return nil, builtPkg{}, fmt.Errorf("Unable to read parts of Pkg metadata. Error: %v", err)
+	}
+
+	// the parts' files are the service's own business
+	for i := range parts {
+		parts[i].File = ""
+	}
+	result := &JobResult{PkgID: built.PkgID, PkgName: built.PkgName, Parts: parts}
+	files := builtPkg{pkgFile: built.PkgFile, pkgSigFile: built.PkgSigFile}
+
+	if uploader == nil {
+		return result, files, nil
+	}
+
+	s.setState(j, JobUploading)
+	if handoff != nil {
+		_, err = handoff.Pkg(ctx, built.PkgDir, built.PkgFile, built.PkgSigFile)
+	} else {
+		_, err = upload.Pkg(ctx, uploader, s.config.Reporter.ErrWriter, built.PkgDir, built.PkgFile, built.PkgSigFile, s.config.UploadParallelism, nil)
+	}
+	if err != nil {
+		return nil, builtPkg{}, &cmdtools.Failure{Kind: cmdtools.ErrPublish, Msg: "Failed to upload Pkg", Err: err}
+	}
+
+	if s.config.Verify {
+		if err := upload.Verify(ctx, uploader, s.config.Reporter.ErrWriter, built.PkgDir, built.PkgFile, built.PkgSigFile, nil, false, false); err != nil {
+			return nil, builtPkg{}, &cmdtools.Failure{Kind: cmdtools.ErrPublish, Msg: "Failed to verify uploaded Pkg", Err: err}
+		}
+	}
+
+	result.URL = uploader.URL(path.Base(built.PkgFile))
+	return result, files, nil
+}
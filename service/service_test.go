@@ -0,0 +1,275 @@
+// +build unit
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gogo/protobuf/proto"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestService(t *testing.T, queueSize int) *Service {
+	s, err := New(Config{
+		Reporter:     cmdtools.NewSynchronizedReporterTo(16, ioutil.Discard, ioutil.Discard),
+		Keys:         map[string][]byte{"dev": []byte("not a key")},
+		Destinations: []string{"s3://bucket/pkgs/"},
+		QueueSize:    queueSize,
+		Retain:       1,
+	})
+	assert.Nil(t, err)
+	return s
+}
+
+func Test_Service_Suite(suite *testing.T) {
+
+	suite.Run("New requires a reporter and signing keys", func(t *testing.T) {
+		_, err := New(Config{Keys: map[string][]byte{"dev": nil}})
+		assert.NotNil(t, err)
+
+		_, err = New(Config{Reporter: cmdtools.NewSynchronizedReporterTo(16, ioutil.Discard, ioutil.Discard)})
+		assert.NotNil(t, err)
+
+		_, err = New(Config{Reporter: cmdtools.NewSynchronizedReporterTo(16, ioutil.Discard, ioutil.Discard), Keys: map[string][]byte{"dev": nil}, Workspaces: true})
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("Submit checks and normalizes requests and queues jobs until the queue is full", func(t *testing.T) {
+		s := newTestService(t, 1)
+
+		for _, request := range []JobRequest{
+			{Key: "dev"},
+			{Images: []string{"alpine"}, Key: "prod"},
+			{Images: []string{"alpine"}, Key: "dev", Destination: "s3://bucket/other"},
+			{Images: []string{"alpine"}, Key: "dev", Destination: "s3://bucket/pkgsx"},
+			{Images: []string{"alpine"}, Key: "dev", Destination: "s3://bucket/pkgs/x?endpoint=https://attacker"},
+			{Images: []string{"alpine"}, Key: "dev", Destination: "s3://bucket/pkgs/../other"},
+			{Images: []string{"alpine"}, Key: "dev", Version: "one"},
+			{Images: []string{"alpine"}, Key: "dev", Labels: []string{"tier"}},
+			{Images: []string{"alpine"}, Key: "dev", PkgName: "../up"},
+		} {
+			_, err := s.Submit(request)
+			assert.NotNil(t, err, "%+v", request)
+		}
+
+		images := []string{"docker.io/library/alpine"}
+		job, err := s.Submit(JobRequest{Images: images, Key: "dev", Destination: "s3://bucket/pkgs/team-a", Labels: []string{"tier=edge"}})
+		assert.Nil(t, err)
+		assert.Equal(t, JobQueued, job.State)
+		assert.Equal(t, []string{"alpine:latest"}, job.Request.Images)
+		assert.Equal(t, []string{"docker.io/library/alpine"}, images)
+		assert.Equal(t, 16, len(job.ID))
+
+		_, err = s.Submit(JobRequest{Images: []string{"alpine"}, Key: "dev"})
+		assert.Equal(t, ErrQueueFull, err)
+
+		got, err := s.Job(job.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, job, got)
+		assert.Equal(t, []Job{job}, s.Jobs())
+
+		_, err = s.Job("nope")
+		assert.Equal(t, ErrJobNotFound, err)
+	})
+
+	suite.Run("job destinations are under an allowed one, with its options and none of their own", func(t *testing.T) {
+		allowed := []string{"s3://bucket/pkgs?region=eu-de", "sftp://deploy@host/srv/pkgs/"}
+
+		for destination, expected := range map[string]string{
+			"s3://bucket/pkgs":                   "s3://bucket/pkgs?region=eu-de",
+			"s3://bucket/pkgs/team-a":            "s3://bucket/pkgs/team-a?region=eu-de",
+			"sftp://deploy@host/srv/pkgs/team-a": "sftp://deploy@host/srv/pkgs/team-a",
+			"s3://bucket/pkgsx":                  "",
+			"s3://other/pkgs":                    "",
+			"gs://bucket/pkgs":                   "",
+			"s3://bucket/pkgs/x?endpoint=https://attacker&ca-bundle=/etc/ssl/key.pem": "",
+			"s3://bucket/pkgs?region=us-east-1":                                       "",
+			"s3://bucket/pkgs/x#frag":                                                 "",
+			"sftp://deploy@host/srv/pkgs/../../etc":                                   "",
+			"sftp://deploy@host/srv/pkgs/%2E%2E/x":                                    "",
+			"sftp://deploy@host/srv/pkgs/./x":                                         "",
+			"sftp://root@host/srv/pkgs/team-a":                                        "",
+			"sftp://host/srv/pkgs/team-a":                                             "",
+			"sftp://deploy@other/srv/pkgs":                                            "",
+		} {
+			resolved, ok := allowedDestination(destination, allowed)
+			assert.Equal(t, expected != "", ok, destination)
+			assert.Equal(t, expected, resolved, destination)
+		}
+	})
+
+	suite.Run("Cancel finishes queued jobs, which are then forgotten beyond those retained", func(t *testing.T) {
+		s := newTestService(t, 2)
+		first, _ := s.Submit(JobRequest{Images: []string{"alpine"}, Key: "dev"})
+		second, _ := s.Submit(JobRequest{Images: []string{"busybox"}, Key: "dev"})
+
+		cancelled, err := s.Cancel(first.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, JobCancelled, cancelled.State)
+		assert.NotNil(t, cancelled.Finished)
+
+		_, err = s.Cancel(first.ID)
+		assert.Equal(t, ErrJobFinished, err)
+
+		_, _, err = s.Files(first.ID)
+		assert.NotNil(t, err)
+
+		s.Cancel(second.ID)
+		_, err = s.Job(first.ID)
+		assert.Equal(t, ErrJobNotFound, err)
+		_, err = s.Job(second.ID)
+		assert.Nil(t, err)
+	})
+
+	suite.Run("Watch tells each change of a job until it's finished", func(t *testing.T) {
+		s := newTestService(t, 1)
+		job, _ := s.Submit(JobRequest{Images: []string{"alpine"}, Key: "dev"})
+
+		states := make(chan string, 2)
+		watched := make(chan error, 1)
+		go func() {
+			watched <- s.Watch(context.Background(), job.ID, func(job Job) error {
+				states <- job.State
+				return nil
+			})
+		}()
+
+		assert.Equal(t, JobQueued, <-states)
+		s.Cancel(job.ID)
+		assert.Nil(t, <-watched)
+		assert.Equal(t, JobCancelled, <-states)
+
+		assert.Equal(t, ErrJobNotFound, s.Watch(context.Background(), "nope", func(Job) error { return nil }))
+	})
+
+	suite.Run("the log of a job keeps the messages tagged with its ID", func(t *testing.T) {
+		s := newTestService(t, 1)
+		job, _ := s.Submit(JobRequest{Images: []string{"alpine"}, Key: "dev"})
+
+		s.observe(cmdtools.Event{Event: cmdtools.EventOutput, Build: job.ID, Message: "pulled\n"})
+		s.observe(cmdtools.Event{Event: cmdtools.EventOutput, Build: "other", Message: "not ours\n"})
+
+		log, err := s.Log(job.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"pulled"}, log)
+	})
+
+	suite.Run("the API submits, shows, and cancels jobs with a valid token", func(t *testing.T) {
+		server := httptest.NewServer(Handler(newTestService(t, 1), "secret"))
+		defer server.Close()
+
+		do := func(method string, path string, token string, body string) (*http.Response, map[string]interface{}) {
+			req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+			assert.Nil(t, err)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+			defer resp.Body.Close()
+
+			var decoded map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&decoded)
+			return resp, decoded
+		}
+
+		resp, _ := do("GET", "/v1/jobs", "wrong", "")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp, body := do("POST", "/v1/jobs", "secret", `{"images": ["alpine"], "key": "prod"}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, "Unknown signing key 'prod'", body["error"])
+
+		resp, _ = do("POST", "/v1/jobs", "secret", `{"images": ["alpine"], "key": "dev", "extra": true}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp, body = do("POST", "/v1/jobs", "secret", `{"images": ["alpine"], "key": "dev"}`)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		id := body["id"].(string)
+		assert.Equal(t, "/v1/jobs/"+id, resp.Header.Get("Location"))
+
+		resp, _ = do("POST", "/v1/jobs", "secret", `{"images": ["alpine"], "key": "dev"}`)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+		resp, body = do("GET", "/v1/jobs/"+id, "secret", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, JobQueued, body["state"])
+
+		resp, _ = do("GET", "/v1/jobs/"+id+"/pkg", "secret", "")
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp, body = do("DELETE", "/v1/jobs/"+id, "secret", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, JobCancelled, body["state"])
+
+		resp, _ = do("DELETE", "/v1/jobs/"+id, "secret", "")
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp, _ = do("GET", "/v1/jobs/nope", "secret", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp, _ = do("PUT", "/v1/jobs", "secret", "")
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+
+	suite.Run("gRPC calls over HTTP/2 submit jobs and fail with their status in trailers", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(Handler(newTestService(t, 1), "secret"))
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		defer server.Close()
+
+		call := func(method string, token string, request proto.Message, response proto.Message) (string, string) {
+			content, err := proto.Marshal(request)
+			assert.Nil(t, err)
+			body := append([]byte{0, 0, 0, 0, byte(len(content))}, content...)
+
+			req, err := http.NewRequest("POST", server.URL+rpcPrefix+method, bytes.NewReader(body))
+			assert.Nil(t, err)
+			req.Header.Set("Content-Type", "application/grpc")
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			resp, err := server.Client().Do(req)
+			assert.Nil(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, 2, resp.ProtoMajor)
+
+			if received, _ := ioutil.ReadAll(resp.Body); len(received) > 5 {
+				assert.Nil(t, proto.Unmarshal(received[5:], response))
+			}
+			return resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+		}
+
+		var status BuildStatus
+		code, _ := call("SubmitBuild", "wrong", &SubmitBuildRequest{Images: []string{"alpine"}, Key: "dev"}, &status)
+		assert.Equal(t, "16", code)
+
+		code, msg := call("SubmitBuild", "secret", &SubmitBuildRequest{Images: []string{"alpine"}, Key: "prod"}, &status)
+		assert.Equal(t, "3", code)
+		assert.Equal(t, "Unknown signing key 'prod'", msg)
+
+		code, _ = call("SubmitBuild", "secret", &SubmitBuildRequest{Images: []string{"alpine"}, Key: "dev"}, &status)
+		assert.Equal(t, "0", code)
+		assert.Equal(t, JobQueued, status.State)
+		assert.NotEqual(t, int64(0), status.Submitted)
+
+		var result BuildResult
+		code, _ = call("GetResult", "secret", &BuildRef{ID: status.ID}, &result)
+		assert.Equal(t, "9", code)
+
+		code, _ = call("GetResult", "secret", &BuildRef{ID: "nope"}, &result)
+		assert.Equal(t, "5", code)
+
+		code, _ = call("CancelBuild", "secret", &BuildRef{ID: status.ID}, &result)
+		assert.Equal(t, "12", code)
+
+		assert.Equal(t, "50%25 done%0A", rpcPercentEncode("50% done\n"))
+	})
+}
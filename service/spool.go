@@ -0,0 +1,261 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The subdirectories of a spool directory
+const (
+	// SpoolProcessing holds the requests whose jobs are queued or being built
+	SpoolProcessing = "processing"
+
+	// SpoolDone and SpoolFailed hold the requests whose jobs succeeded, or
+	// failed or were cancelled, each beside its receipt
+	SpoolDone   = "done"
+	SpoolFailed = "failed"
+)
+
+// DefaultSpoolInterval is how often a spool directory is scanned for requests unless told otherwise
+const DefaultSpoolInterval = 2 * time.Second
+
+// SpoolReceipt is written for each request of a spool directory once its
+// job is finished: the job's status, and where the Pkg it built was written
+type SpoolReceipt struct {
+	Job
+	PkgFile    string `json:"pkgFile,omitempty"`
+	PkgSigFile string `json:"pkgSigFile,omitempty"`
+}
+
+// Spool feeds a Service the job requests written to a spool directory, so
+// other tools can have Pkgs built by dropping files in it. Each request is a
+// JobRequest as JSON in a file whose name ends in '.json', which writers
+// should write elsewhere on the same filesystem, or under a name that doesn't
+// (e.g. '.gt-stack.json.tmp'), and rename in once it's complete. Requests are
+// claimed in the order of their names by moving them to the SpoolProcessing
+// subdirectory, as many as the service's queue takes, and once a request's
+// job is finished it's moved to SpoolDone or SpoolFailed and its receipt, a
+// SpoolReceipt, written beside it as '<name>.receipt.json'.
+type Spool struct {
+	service  *Service
+	dir      string
+	interval time.Duration
+	log      *cmdtools.Logger
+	jobs     sync.WaitGroup
+}
+
+// NewSpool returns a Spool feeding the service the requests in dir, scanned
+// every interval, creating its subdirectories. Requests left in
+// SpoolProcessing by a spool that stopped before their jobs finished are
+// moved back to be built again.
+func NewSpool(s *Service, dir string, interval time.Duration) (*Spool, error) {
+	if interval <= 0 {
+		interval = DefaultSpoolInterval
+	}
+
+	for _, sub := range []string{SpoolProcessing, SpoolDone, SpoolFailed} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("Unable to create spool directory. Error: %v", err)
+		}
+	}
+
+	sp := &Spool{service: s, dir: dir, interval: interval, log: s.config.Reporter.Log}
+
+	claimed, err := ioutil.ReadDir(filepath.Join(dir, SpoolProcessing))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read spool directory. Error: %v", err)
+	}
+	for _, entry := range claimed {
+		if isSpoolRequest(entry) {
+			if err := sp.requeue(entry.Name()); err != nil {
+				return nil, err
+			}
+			sp.log.Infof("Requeued spooled request %v, whose job didn't finish", entry.Name())
+		}
+	}
+	return sp, nil
+}
+
+// isSpoolRequest tells if a spool directory's entry is a request
+func isSpoolRequest(entry os.FileInfo) bool {
+	name := entry.Name()
+	return entry.Mode().IsRegular() && strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".receipt.json")
+}
+
+// Run submits the requests in the spool directory to the service until ctx
+// is done, and returns once the jobs of those submitted have stopped. Run it
+// with the service's own Run, with the same context: the requests of jobs
+// cancelled because it's done are moved back to be built again.
+func (sp *Spool) Run(ctx context.Context) {
+	ticker := time.NewTicker(sp.interval)
+	defer ticker.Stop()
+
+	for {
+		sp.scan(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			sp.jobs.Wait()
+			return
+		}
+	}
+}
+
+// scan submits the requests in the spool directory until the service's queue is full
+func (sp *Spool) scan(ctx context.Context) {
+	entries, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		sp.log.Warnf("Unable to read spool directory. Error: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		if isSpoolRequest(entry) && !sp.submit(ctx, entry.Name()) {
+			return
+		}
+	}
+}
+
+// submit claims the request of the given name and submits its job,
+// returning false if the service's queue is full
+func (sp *Spool) submit(ctx context.Context, name string) bool {
+	claimed := filepath.Join(sp.dir, SpoolProcessing, name)
+	if err := os.Rename(filepath.Join(sp.dir, name), claimed); err != nil {
+		// removed since it was listed
+		return true
+	}
+
+	job, err := sp.submitFile(claimed)
+	if err == ErrQueueFull {
+		if err := sp.requeue(name); err != nil {
+			sp.log.Warnf("%v", err)
+		}
+		return false
+	} else if err != nil {
+		now := time.Now().UTC()
+		sp.finish(name, SpoolReceipt{Job: Job{State: JobFailed, Submitted: now, Finished: &now, Error: err.Error(), Code: cmdtools.ExitUserError}})
+		return true
+	}
+
+	sp.log.Infof("Submitted job %v for spooled request %v", job.ID, name)
+	sp.jobs.Add(1)
+	go func() {
+		defer sp.jobs.Done()
+		sp.follow(ctx, name, job.ID)
+	}()
+	return true
+}
+
+// submitFile submits the job request in the file
+func (sp *Spool) submitFile(file string) (Job, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Job{}, fmt.Errorf("Unable to read job request. Error: %v", err)
+	}
+
+	var request JobRequest
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return Job{}, fmt.Errorf("Unable to decode job request. Error: %v", err)
+	}
+	return sp.service.Submit(request)
+}
+
+// follow waits for the job of the request of the given name to finish and
+// writes its receipt, or moves the request back if ctx is done first
+func (sp *Spool) follow(ctx context.Context, name string, id string) {
+	var last Job
+	err := sp.service.Watch(ctx, id, func(job Job) error {
+		last = job
+		return nil
+	})
+
+	// a job cancelled because the service is stopping is built again once it's back
+	if ctx.Err() != nil && (err != nil || last.State == JobCancelled) {
+		if err := sp.requeue(name); err != nil {
+			sp.log.Warnf("%v", err)
+		}
+		return
+	} else if err != nil {
+		sp.log.Warnf("Unable to follow job %v of spooled request %v. Error: %v", id, name, err)
+		return
+	}
+
+	receipt := SpoolReceipt{Job: last}
+	if last.State == JobSucceeded {
+		receipt.PkgFile, receipt.PkgSigFile, _ = sp.service.Files(id)
+	}
+	sp.finish(name, receipt)
+}
+
+// requeue moves the claimed request of the given name back to the spool directory
+func (sp *Spool) requeue(name string) error {
+	if err := os.Rename(filepath.Join(sp.dir, SpoolProcessing, name), filepath.Join(sp.dir, name)); err != nil {
+		return fmt.Errorf("Unable to requeue spooled request %v. Error: %v", name, err)
+	}
+	return nil
+}
+
+// finish writes the receipt of the claimed request of the given name and
+// moves the request beside it
+func (sp *Spool) finish(name string, receipt SpoolReceipt) {
+	sub := SpoolDone
+	if receipt.State != JobSucceeded {
+		sub = SpoolFailed
+	}
+
+	receiptFile := filepath.Join(sp.dir, sub, strings.TrimSuffix(name, ".json")+".receipt.json")
+	if err := writeReceipt(receiptFile, receipt); err != nil {
+		sp.log.Warnf("Unable to write receipt of spooled request %v. Error: %v", name, err)
+	}
+
+	if err := os.Rename(filepath.Join(sp.dir, SpoolProcessing, name), filepath.Join(sp.dir, sub, name)); err != nil {
+		sp.log.Warnf("Unable to move spooled request %v to %v. Error: %v", name, sub, err)
+	}
+
+	if receipt.State == JobSucceeded {
+		sp.log.Infof("Spooled request %v done, built Pkg %v", name, receipt.Result.PkgName)
+	} else {
+		sp.log.Warnf("Spooled request %v %v: %v", name, receipt.State, receipt.Error)
+	}
+}
+
+// writeReceipt writes the receipt to the given file, replacing it atomically
+func writeReceipt(file string, receipt SpoolReceipt) error {
+	content, err := json.MarshalIndent(receipt, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,97 @@
+// +build unit
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Spool_Suite(suite *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-")
+	assert.Nil(suite, err)
+	defer os.RemoveAll(dir)
+
+	request := func(name string, content string) {
+		assert.Nil(suite, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	exists := func(path ...string) bool {
+		_, err := os.Stat(filepath.Join(append([]string{dir}, path...)...))
+		return err == nil
+	}
+	receipt := func(sub string, name string) SpoolReceipt {
+		var r SpoolReceipt
+		content, err := ioutil.ReadFile(filepath.Join(dir, sub, name+".receipt.json"))
+		assert.Nil(suite, err)
+		assert.Nil(suite, json.Unmarshal(content, &r))
+		return r
+	}
+	waitFor := func(t *testing.T, path ...string) {
+		for i := 0; i < 100 && !exists(path...); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.True(t, exists(path...), "%v", path)
+	}
+
+	suite.Run("NewSpool creates the subdirectories and requeues requests whose jobs didn't finish", func(t *testing.T) {
+		assert.Nil(t, os.MkdirAll(filepath.Join(dir, SpoolProcessing), 0755))
+		request(filepath.Join(SpoolProcessing, "left.json"), `{"images": ["alpine"], "key": "dev"}`)
+
+		_, err := NewSpool(newTestService(t, 1), dir, 0)
+		assert.Nil(t, err)
+		assert.True(t, exists(SpoolDone))
+		assert.True(t, exists(SpoolFailed))
+		assert.True(t, exists("left.json"))
+		assert.False(t, exists(SpoolProcessing, "left.json"))
+	})
+
+	suite.Run("requests are claimed until the queue is full, and invalid ones fail with a receipt", func(t *testing.T) {
+		s := newTestService(t, 1)
+		sp, err := NewSpool(s, dir, time.Hour)
+		assert.Nil(t, err)
+
+		request("a-invalid.json", `{"images": ["alpine"], "key": "prod"}`)
+		request(".b-partial.json", `{"images": [`)
+		request("c-notes.txt", `not a request`)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sp.scan(ctx)
+
+		assert.True(t, exists(SpoolFailed, "a-invalid.json"))
+		failed := receipt(SpoolFailed, "a-invalid")
+		assert.Equal(t, JobFailed, failed.State)
+		assert.Equal(t, "Unknown signing key 'prod'", failed.Error)
+		assert.True(t, exists(".b-partial.json"))
+		assert.True(t, exists("c-notes.txt"))
+		assert.True(t, exists(SpoolProcessing, "left.json"))
+
+		// the queue is full
+		request("m-next.json", `{"images": ["busybox"], "key": "dev"}`)
+		sp.scan(ctx)
+		assert.True(t, exists("m-next.json"))
+		assert.False(t, exists(SpoolProcessing, "m-next.json"))
+
+		// a cancelled job fails with a receipt
+		jobs := s.Jobs()
+		assert.Equal(t, 1, len(jobs))
+		s.Cancel(jobs[0].ID)
+		waitFor(t, SpoolFailed, "left.receipt.json")
+		assert.True(t, exists(SpoolFailed, "left.json"))
+		assert.Equal(t, JobCancelled, receipt(SpoolFailed, "left").State)
+		<-s.queue
+
+		// the request of a job not finished once the spool stops is moved back
+		sp.scan(ctx)
+		assert.True(t, exists(SpoolProcessing, "m-next.json"))
+		cancel()
+		sp.jobs.Wait()
+		assert.True(t, exists("m-next.json"))
+		assert.False(t, exists(SpoolProcessing, "m-next.json"))
+	})
+}
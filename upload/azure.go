@@ -0,0 +1,452 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// azureConnectionStringEnvVar names the envvar holding a storage account connection string
+	azureConnectionStringEnvVar = "AZURE_STORAGE_CONNECTION_STRING"
+
+	// azureClientIDEnvVar names the envvar selecting a user-assigned managed identity
+	azureClientIDEnvVar = "AZURE_CLIENT_ID"
+
+	// azureAPIVersion is the Blob service REST API version used; bearer tokens need 2017-11-09 or newer
+	azureAPIVersion = "2019-12-12"
+
+	// azureBlockSize is the size of the blocks larger files are uploaded in
+	azureBlockSize = 8 * 1024 * 1024
+
+	// azureMaxBlocks is the most blocks a block blob may have
+	azureMaxBlocks = 50000
+
+	defaultIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// azureUploader puts files as block blobs in an Azure Blob Storage
+// container. It authenticates with the account key or shared access
+// signature in a connection string or, without one, with a token for the
+// managed identity of the Azure VM it runs on.
+type azureUploader struct {
+	httpClient *http.Client
+	endpoint   string
+	account    string
+	container  string
+	prefix     string
+	blockSize  int64
+	resume     *resumeStore
+
+	// one of these authenticates requests
+	key      []byte
+	sas      url.Values
+	identity *managedIdentity
+}
+
+// newAzureUploader returns an uploader for a destination URL of the form
+// azblob://account/container[/prefix], using the given connection string if
+// it isn't empty
+func newAzureUploader(u *url.URL, connectionString string) (*azureUploader, error) {
+	segments := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || segments[0] == "" {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 'azblob://account/container[/prefix]'", u)
+	}
+
+	uploader := &azureUploader{
+		httpClient: &http.Client{Timeout: 10 * time.Minute},
+		endpoint:   fmt.Sprintf("https://%s.blob.core.windows.net", u.Host),
+		account:    u.Host,
+		container:  segments[0],
+		blockSize:  azureBlockSize,
+		resume:     newResumeStore(),
+	}
+	if len(segments) == 2 && segments[1] != "" {
+		uploader.prefix = strings.TrimRight(segments[1], "/") + "/"
+	}
+
+	if connectionString == "" {
+		uploader.identity = newManagedIdentity(defaultIMDSEndpoint, os.Getenv(azureClientIDEnvVar))
+		return uploader, nil
+	}
+
+	settings := map[string]string{}
+	for _, setting := range strings.Split(connectionString, ";") {
+		if spl := strings.SplitN(setting, "=", 2); len(spl) == 2 {
+			settings[spl[0]] = spl[1]
+		}
+	}
+
+	if name, exists := settings["AccountName"]; exists && name != uploader.account {
+		return nil, fmt.Errorf("Azure storage connection string is for account %v, not destination account %v", name, uploader.account)
+	}
+
+	if endpoint, exists := settings["BlobEndpoint"]; exists {
+		uploader.endpoint = strings.TrimRight(endpoint, "/")
+	} else if suffix, exists := settings["EndpointSuffix"]; exists {
+		protocol := "https"
+		if p, exists := settings["DefaultEndpointsProtocol"]; exists {
+			protocol = p
+		}
+		uploader.endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, uploader.account, suffix)
+	}
+
+	if key, exists := settings["AccountKey"]; exists {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode account key in Azure storage connection string. Error: %v", err)
+		}
+		uploader.key = decoded
+	} else if sas, exists := settings["SharedAccessSignature"]; exists {
+		values, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse shared access signature in Azure storage connection string. Error: %v", err)
+		}
+		uploader.sas = values
+	} else {
+		return nil, fmt.Errorf("Azure storage connection string has neither an AccountKey nor a SharedAccessSignature")
+	}
+
+	return uploader, nil
+}
+
+func (a *azureUploader) blobURL(name string) string {
+	segments := []string{}
+	for _, segment := range strings.Split(a.prefix+name, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return fmt.Sprintf("%s/%s/%s", a.endpoint, a.container, strings.Join(segments, "/"))
+}
+
+func (a *azureUploader) URL(name string) string {
+	return a.blobURL(name)
+}
+
+// Put uploads the file as a single blob if it fits in one block and otherwise block by block
+func (a *azureUploader) Put(ctx context.Context, name string, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	contentType := "application/octet-stream"
+	if path.Ext(name) == ".json" {
+		contentType = "application/json"
+	}
+
+	blobURL := a.blobURL(name)
+
+	if size <= a.blockSize {
+		headers := map[string]string{"Content-Type": contentType, "x-ms-blob-type": "BlockBlob"}
+		return a.put(ctx, blobURL, headers, io.NewSectionReader(f, 0, size), size)
+	}
+
+	if (size+a.blockSize-1)/a.blockSize > azureMaxBlocks {
+		return fmt.Errorf("File %v is too large to upload as a block blob", localPath)
+	}
+
+	return a.putBlocks(ctx, f, size, contentType, blobURL, a.resume.key(blobURL, info))
+}
+
+// putStatus puts the file; the service responds 201 Created to a successful put or block list commit
+func (a *azureUploader) putStatus(ctx context.Context, name string, localPath string) (int, error) {
+	if err := a.Put(ctx, name, localPath); err != nil {
+		return 0, err
+	}
+	return http.StatusCreated, nil
+}
+
+// Head looks the blob up with a Get Blob Properties request
+func (a *azureUploader) Head(ctx context.Context, name string) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, a.blobURL(name), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	if err := a.authorize(req); err != nil {
+		return 0, false, err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, true, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("Azure Blob Storage responded with status %v (%v) to HEAD of %v", resp.StatusCode, resp.Header.Get("x-ms-error-code"), req.URL.Path)
+	}
+}
+
+func (a *azureUploader) Verify(ctx context.Context, name string, localPath string) error {
+	return verifySize(ctx, a, name, localPath)
+}
+
+// azureUploadState is the persisted progress of a block-by-block upload
+type azureUploadState struct {
+	// BlockIDPrefix distinguishes the upload's blocks from those of other uploads to the blob
+	BlockIDPrefix string
+	BlockSize     int64
+
+	// Blocks is the number of blocks uploaded
+	Blocks int64
+}
+
+// putBlocks uploads the file block by block, continuing an earlier upload
+// whose state was saved under the given key, if any, then commits the
+// blocks. Uncommitted blocks expire, so an upload whose blocks can't be
+// committed after resuming is restarted.
+func (a *azureUploader) putBlocks(ctx context.Context, f *os.File, size int64, contentType string, blobURL string, key string) error {
+	var state azureUploadState
+	resumed := a.resume.load(key, &state) && state.BlockIDPrefix != "" && state.BlockSize == a.blockSize
+	if !resumed {
+		prefix := make([]byte, 4)
+		if _, err := rand.Read(prefix); err != nil {
+			return err
+		}
+		state = azureUploadState{BlockIDPrefix: fmt.Sprintf("%x", prefix), BlockSize: a.blockSize}
+	}
+
+	blockCount := (size + a.blockSize - 1) / a.blockSize
+
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+
+	for i := int64(0); i < blockCount; i++ {
+		// block IDs must all have the same length
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s%08d", state.BlockIDPrefix, i)))
+		fmt.Fprintf(&blockList, "<Latest>%s</Latest>", blockID)
+
+		if i < state.Blocks {
+			continue
+		}
+
+		length := a.blockSize
+		if remaining := size - i*a.blockSize; remaining < length {
+			length = remaining
+		}
+
+		blockURL := fmt.Sprintf("%s?comp=block&blockid=%s", blobURL, url.QueryEscape(blockID))
+		if err := a.put(ctx, blockURL, map[string]string{}, io.NewSectionReader(f, i*a.blockSize, length), length); err != nil {
+			return err
+		}
+
+		state.Blocks = i + 1
+		a.resume.save(key, state)
+	}
+
+	blockList.WriteString("</BlockList>")
+
+	headers := map[string]string{"Content-Type": "application/xml", "x-ms-blob-content-type": contentType}
+	if err := a.put(ctx, blobURL+"?comp=blocklist", headers, bytes.NewReader(blockList.Bytes()), int64(blockList.Len())); err != nil {
+		a.resume.remove(key)
+		if resumed {
+			return a.putBlocks(ctx, f, size, contentType, blobURL, key)
+		}
+		return err
+	}
+
+	a.resume.remove(key)
+	return nil
+}
+
+// put sends an authenticated PUT request with the given body, expecting the blob service to create the resource
+func (a *azureUploader) put(ctx context.Context, reqURL string, headers map[string]string, body io.Reader, length int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, reqURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	if err := a.authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Azure Blob Storage responded with status %v (%v) to upload to %v: %s", resp.StatusCode, resp.Header.Get("x-ms-error-code"), req.URL.Path, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func (a *azureUploader) authorize(req *http.Request) error {
+	switch {
+	case a.key != nil:
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", a.account, a.sharedKeySignature(req)))
+	case a.sas != nil:
+		query := req.URL.Query()
+		for key, values := range a.sas {
+			query[key] = values
+		}
+		req.URL.RawQuery = query.Encode()
+	default:
+		token, err := a.identity.token(req.Context())
+		if err != nil {
+			return fmt.Errorf("Unable to obtain managed identity token for Azure Blob Storage. Error: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// sharedKeySignature signs the request as described in "Authorize with Shared Key" of the Azure Storage docs
+func (a *azureUploader) sharedKeySignature(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	msHeaders := []string{}
+	for key := range req.Header {
+		if lower := strings.ToLower(key); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+
+	var canonicalHeaders bytes.Buffer
+	for _, key := range msHeaders {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", key, strings.TrimSpace(req.Header.Get(key)))
+	}
+
+	canonicalResource := fmt.Sprintf("/%s%s", a.account, req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := []string{}
+	for key := range query {
+		params = append(params, key)
+	}
+	sort.Strings(params)
+	for _, key := range params {
+		values := query[key]
+		sort.Strings(values)
+		canonicalResource += fmt.Sprintf("\n%s:%s", strings.ToLower(key), strings.Join(values, ","))
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date; x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalHeaders.String() + canonicalResource
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// managedIdentity obtains Azure Storage tokens from the instance metadata
+// service of an Azure VM, caching each until shortly before it expires
+type managedIdentity struct {
+	endpoint string
+	clientID string
+	lock     sync.Mutex
+	current  string
+	expiry   time.Time
+}
+
+func newManagedIdentity(endpoint string, clientID string) *managedIdentity {
+	return &managedIdentity{endpoint: endpoint, clientID: clientID}
+}
+
+func (m *managedIdentity) token(ctx context.Context) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.current != "" && time.Now().Add(5*time.Minute).Before(m.expiry) {
+		return m.current, nil
+	}
+
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", "https://storage.azure.com/")
+	if m.clientID != "" {
+		query.Set("client_id", m.clientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Instance metadata service responded with status %v: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", err
+	}
+
+	expiresOn, err := strconv.ParseInt(tokenResp.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse token expiry '%v' from instance metadata service", tokenResp.ExpiresOn)
+	}
+
+	m.current, m.expiry = tokenResp.AccessToken, time.Unix(expiresOn, 0)
+	return m.current, nil
+}
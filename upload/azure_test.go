@@ -0,0 +1,228 @@
+// +build unit
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a fake blob service recording the blobs put and the requests authorizing them
+type fakeBlobService struct {
+	lock           sync.Mutex
+	blobs          map[string][]byte
+	blocks         map[string][]byte
+	authorizations []string
+	queries        []url.Values
+
+	// blockPuts counts block uploads; the failBlock'th fails, if set
+	blockPuts int
+	failBlock int
+}
+
+func newFakeBlobService() *fakeBlobService {
+	return &fakeBlobService{blobs: map[string][]byte{}, blocks: map[string][]byte{}}
+}
+
+func (f *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	f.authorizations = append(f.authorizations, r.Header.Get("Authorization"))
+	f.queries = append(f.queries, r.URL.Query())
+
+	switch r.URL.Query().Get("comp") {
+	case "block":
+		f.blockPuts++
+		if f.blockPuts == f.failBlock {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.blocks[r.URL.Query().Get("blockid")] = body
+	case "blocklist":
+		var content []byte
+		for _, id := range strings.Split(string(body), "<Latest>")[1:] {
+			content = append(content, f.blocks[strings.Split(id, "</Latest>")[0]]...)
+		}
+		f.blobs[r.URL.Path] = content
+	default:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[r.URL.Path] = body
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	p := path.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(p, []byte(content), 0644))
+	return p
+}
+
+func Test_Azure_Suite(suite *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-azure-")
+	assert.Nil(suite, err)
+	defer os.RemoveAll(dir)
+
+	suite.Setenv("XDG_CACHE_HOME", path.Join(dir, "cache"))
+
+	suite.Run("newAzureUploader parses destinations and connection strings", func(t *testing.T) {
+		u, _ := url.Parse("azblob://acct/parts/edge/")
+		uploader, err := newAzureUploader(u, "DefaultEndpointsProtocol=https;AccountName=acct;AccountKey=c2VjcmV0;EndpointSuffix=core.chinacloudapi.cn")
+		assert.Nil(t, err)
+		assert.Equal(t, "https://acct.blob.core.chinacloudapi.cn/parts/edge/pkg/a.tgz", uploader.URL("pkg/a.tgz"))
+		assert.Equal(t, []byte("secret"), uploader.key)
+
+		uploader, err = newAzureUploader(u, "")
+		assert.Nil(t, err)
+		assert.Equal(t, "https://acct.blob.core.windows.net/parts/edge", BaseURL(uploader))
+		assert.NotNil(t, uploader.identity)
+
+		_, err = newAzureUploader(u, "AccountName=other;AccountKey=c2VjcmV0")
+		assert.NotNil(t, err)
+
+		_, err = newAzureUploader(u, "AccountName=acct")
+		assert.NotNil(t, err)
+
+		u, _ = url.Parse("azblob://acct")
+		_, err = newAzureUploader(u, "")
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("sharedKeySignature signs the canonicalized request", func(t *testing.T) {
+		a := &azureUploader{account: "acct", key: []byte("secret")}
+
+		req, _ := http.NewRequest(http.MethodPut, "http://127.0.0.1:10000/acct/parts/pkg/a.tgz", bytes.NewReader([]byte("fffff")))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+		req.Header.Set("x-ms-date", "Mon, 02 Jan 2006 15:04:05 GMT")
+		req.Header.Set("x-ms-version", azureAPIVersion)
+		assert.Equal(t, "ckrXEOvt0h05onoPYRTSNzl6Udn9WX0Risq0Qd6kNQY=", a.sharedKeySignature(req))
+
+		req, _ = http.NewRequest(http.MethodPut, "https://acct.blob.core.windows.net/parts/pkg/a.tgz?comp=block&blockid=MDAwMDAwMDA%3D", bytes.NewReader([]byte("fffff")))
+		req.Header.Set("x-ms-date", "Mon, 02 Jan 2006 15:04:05 GMT")
+		req.Header.Set("x-ms-version", azureAPIVersion)
+		assert.Equal(t, "1ppQZpKUSAuNPVNDmcneM1d8fqiDa+alRTsG9x/CN0Q=", a.sharedKeySignature(req))
+	})
+
+	suite.Run("Put uploads large files in blocks and small ones whole", func(t *testing.T) {
+		service := newFakeBlobService()
+		server := httptest.NewServer(service)
+		defer server.Close()
+
+		u, _ := url.Parse("azblob://acct/parts")
+		uploader, err := newAzureUploader(u, "BlobEndpoint="+server.URL+";AccountName=acct;AccountKey=c2VjcmV0")
+		assert.Nil(t, err)
+		uploader.blockSize = 4
+
+		assert.Nil(t, uploader.Put(context.Background(), "pkg/large.tgz", writeFile(t, dir, "large.tgz", "0123456789")))
+		assert.Nil(t, uploader.Put(context.Background(), "pkg.json", writeFile(t, dir, "pkg.json", "{}")))
+
+		assert.Equal(t, "0123456789", string(service.blobs["/parts/pkg/large.tgz"]))
+		assert.Equal(t, "{}", string(service.blobs["/parts/pkg.json"]))
+		assert.Equal(t, 3, len(service.blocks))
+		for _, auth := range service.authorizations {
+			assert.True(t, strings.HasPrefix(auth, "SharedKey acct:"), auth)
+		}
+	})
+
+	suite.Run("Put resumes an interrupted block upload", func(t *testing.T) {
+		service := newFakeBlobService()
+		service.failBlock = 3
+		server := httptest.NewServer(service)
+		defer server.Close()
+
+		u, _ := url.Parse("azblob://acct/parts")
+		uploader, err := newAzureUploader(u, "BlobEndpoint="+server.URL+";AccountName=acct;AccountKey=c2VjcmV0")
+		assert.Nil(t, err)
+		uploader.blockSize = 4
+
+		large := writeFile(t, dir, "resumed.tgz", "0123456789abcdef")
+		assert.NotNil(t, uploader.Put(context.Background(), "pkg/resumed.tgz", large))
+
+		// a new uploader, as in a later run, continues with the failed block
+		uploader, err = newAzureUploader(u, "BlobEndpoint="+server.URL+";AccountName=acct;AccountKey=c2VjcmV0")
+		assert.Nil(t, err)
+		uploader.blockSize = 4
+
+		assert.Nil(t, uploader.Put(context.Background(), "pkg/resumed.tgz", large))
+		assert.Equal(t, "0123456789abcdef", string(service.blobs["/parts/pkg/resumed.tgz"]))
+		assert.Equal(t, 5, service.blockPuts)
+
+		files, _ := ioutil.ReadDir(path.Join(dir, "cache", "horizon-pkg-build", "uploads"))
+		assert.Equal(t, 0, len(files))
+	})
+
+	suite.Run("Put authenticates with a shared access signature or managed identity", func(t *testing.T) {
+		service := newFakeBlobService()
+		server := httptest.NewServer(service)
+		defer server.Close()
+
+		u, _ := url.Parse("azblob://acct/parts")
+		uploader, err := newAzureUploader(u, "BlobEndpoint="+server.URL+";SharedAccessSignature=sv=2019-12-12&sig=abc")
+		assert.Nil(t, err)
+
+		assert.Nil(t, uploader.Put(context.Background(), "a.tgz", writeFile(t, dir, "a.tgz", "fffff")))
+		assert.Equal(t, "abc", service.queries[0].Get("sig"))
+		assert.Equal(t, "", service.authorizations[0])
+
+		tokenRequests := 0
+		imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests++
+			assert.Equal(t, "true", r.Header.Get("Metadata"))
+			assert.Equal(t, "https://storage.azure.com/", r.URL.Query().Get("resource"))
+			assert.Equal(t, "some-client", r.URL.Query().Get("client_id"))
+			w.Write([]byte(`{"access_token":"tok","expires_on":"4102444800"}`))
+		}))
+		defer imds.Close()
+
+		uploader, err = newAzureUploader(u, "")
+		assert.Nil(t, err)
+		uploader.endpoint = server.URL
+		uploader.identity = newManagedIdentity(imds.URL, "some-client")
+
+		assert.Nil(t, uploader.Put(context.Background(), "a.tgz", writeFile(t, dir, "a.tgz", "fffff")))
+		assert.Nil(t, uploader.Put(context.Background(), "b.tgz", writeFile(t, dir, "b.tgz", "fffff")))
+		assert.Equal(t, "Bearer tok", service.authorizations[2])
+		assert.Equal(t, 1, tokenRequests)
+	})
+
+	suite.Run("Pkg uploads parts before the metadata", func(t *testing.T) {
+		service := newFakeBlobService()
+		server := httptest.NewServer(service)
+		defer server.Close()
+
+		u, _ := url.Parse("azblob://acct/parts")
+		uploader, err := newAzureUploader(u, "BlobEndpoint="+server.URL+";AccountName=acct;AccountKey=c2VjcmV0")
+		assert.Nil(t, err)
+
+		pkgDir := path.Join(dir, "5aecb701")
+		assert.Nil(t, os.Mkdir(pkgDir, 0755))
+		writeFile(t, pkgDir, "e26e31a0.tgz", "fffff")
+		pkgFile := writeFile(t, dir, "5aecb701.json", "{}")
+		pkgSigFile := writeFile(t, dir, "5aecb701.json.sig", "sig")
+
+		var out bytes.Buffer
+		uploaded, err := Pkg(context.Background(), uploader, &out, pkgDir, pkgFile, pkgSigFile, 1, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(10), uploaded)
+		assert.Equal(t, "fffff", string(service.blobs["/parts/5aecb701/e26e31a0.tgz"]))
+		assert.Equal(t, "{}", string(service.blobs["/parts/5aecb701.json"]))
+		assert.Equal(t, "sig", string(service.blobs["/parts/5aecb701.json.sig"]))
+		assert.Contains(t, out.String(), server.URL+"/parts/5aecb701.json.sig")
+	})
+}
@@ -0,0 +1,244 @@
+package upload
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend creates Uploaders for the destination URLs of the schemes it's
+// registered for (see Register)
+type Backend struct {
+	// Name names the backend in the options given for it, e.g. "s3" in
+	// 'upload-s3-region' (see OptionFlag)
+	Name string
+
+	// Schemes are the destination URL schemes the backend handles, e.g. "davs" and "dav"
+	Schemes []string
+
+	// Format describes the destination URLs, e.g. "s3://bucket[/prefix]"
+	Format string
+
+	// Options are the backend's settings other than credentials. They're
+	// given as query parameters of the destination URL or set with
+	// WithOptions.
+	Options []Option
+
+	// New returns an Uploader for the destination URL, with the given
+	// credentials or those it reads from the environment
+	New func(u *url.URL, credentials Credentials) (Uploader, error)
+}
+
+// Option is a setting of a Backend
+type Option struct {
+	// Name is the query parameter of the destination URL setting the option, e.g. "region"
+	Name string
+
+	// Usage describes the option's value
+	Usage string
+}
+
+// OptionFlag returns the name of the command line option setting the
+// backend's option, e.g. "upload-s3-region", so the options of every backend
+// are named alike
+func OptionFlag(backend Backend, option Option) string {
+	return fmt.Sprintf("upload-%s-%s", backend.Name, option.Name)
+}
+
+var (
+	backendsLock sync.RWMutex
+
+	// backends holds the registered backends by scheme
+	backends = map[string]Backend{}
+)
+
+// Register adds a backend for destination URLs with the given backend's
+// schemes, replacing any registered for them. Backends are registered before
+// Uploaders are created, e.g. by a program's main function.
+func Register(backend Backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	for _, scheme := range backend.Schemes {
+		backends[scheme] = backend
+	}
+}
+
+// Backends returns the registered backends, ordered by name
+func Backends() []Backend {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	seen := map[string]bool{}
+	registered := []Backend{}
+	for _, backend := range backends {
+		if !seen[backend.Name] {
+			seen[backend.Name] = true
+			registered = append(registered, backend)
+		}
+	}
+
+	sort.Slice(registered, func(i, j int) bool { return registered[i].Name < registered[j].Name })
+	return registered
+}
+
+// BackendOf returns the backend registered for the scheme of the destination URL
+func BackendOf(destination string) (Backend, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return Backend{}, fmt.Errorf("Unable to parse upload destination %v. Error: %v", destination, err)
+	}
+	return backendFor(u)
+}
+
+func backendFor(u *url.URL) (Backend, error) {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	if backend, exists := backends[u.Scheme]; exists {
+		return backend, nil
+	}
+
+	schemes := []string{}
+	for scheme := range backends {
+		schemes = append(schemes, "'"+scheme+"'")
+	}
+	sort.Strings(schemes)
+	return Backend{}, fmt.Errorf("Unsupported upload destination %v, expected a URL with scheme %v", u, strings.Join(schemes, ", "))
+}
+
+// WithOptions returns the destination URL with the given options of its
+// backend set as query parameters, unless the destination sets them already.
+// Options the backend doesn't have are refused.
+func WithOptions(destination string, options map[string]string) (string, error) {
+	if len(options) == 0 {
+		return destination, nil
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse upload destination %v. Error: %v", destination, err)
+	}
+
+	backend, err := backendFor(u)
+	if err != nil {
+		return "", err
+	}
+
+	known := map[string]bool{}
+	for _, option := range backend.Options {
+		known[option.Name] = true
+	}
+
+	query := u.Query()
+	for name, value := range options {
+		if !known[name] {
+			return "", fmt.Errorf("Upload destinations of backend '%s' have no option '%s'", backend.Name, name)
+		} else if _, exists := query[name]; !exists {
+			query.Set(name, value)
+		}
+	}
+
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// the backends built in; more are added with Register
+func init() {
+	for _, backend := range []Backend{
+		{
+			Name:    "s3",
+			Schemes: []string{"s3"},
+			Format:  "s3://bucket[/prefix][?region=name&endpoint=url&path-style=bool&ca-bundle=file]",
+			Options: []Option{
+				{Name: "region", Usage: "AWS region of the bucket, if not that named by the AWS_REGION or AWS_DEFAULT_REGION envvar (default us-east-1)"},
+				{Name: "endpoint", Usage: "URL of an S3-compatible store such as MinIO to upload to instead of AWS, if not that of the AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL envvar"},
+				{Name: "path-style", Usage: "Whether buckets are addressed path-style ('true', the default at custom endpoints) or virtual-hosted-style ('false')"},
+				{Name: "ca-bundle", Usage: "PEM file of certificates to trust in addition to the system's, if not that named by the AWS_CA_BUNDLE envvar"},
+			},
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newS3Uploader(u, credentials.Username, credentials.Password)
+			},
+		},
+		{
+			Name:    "gs",
+			Schemes: []string{"gs"},
+			Format:  "gs://bucket[/prefix]",
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newGCSUploader(u, credentials.Username, credentials.Password)
+			},
+		},
+		{
+			Name:    "azblob",
+			Schemes: []string{"azblob"},
+			Format:  "azblob://account/container[/prefix]",
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newAzureUploader(u, os.Getenv(azureConnectionStringEnvVar))
+			},
+		},
+		{
+			Name:    "sftp",
+			Schemes: []string{"sftp"},
+			Format:  "sftp://[user@]host[:port]/path",
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newSFTPUploader(u, credentials.SSHIdentity)
+			},
+		},
+		{
+			Name:    "webdav",
+			Schemes: []string{"davs", "dav"},
+			Format:  "davs://[user@]host[:port]/path",
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newWebDAVUploader(u, credentials.Username, credentials.Password)
+			},
+		},
+		{
+			Name:    "http",
+			Schemes: []string{"https", "http"},
+			Format:  "https://[user@]host[:port]/path",
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newHTTPUploader(u, credentials.Username, credentials.Password)
+			},
+		},
+		{
+			Name:    "ipfs",
+			Schemes: []string{"ipfs"},
+			Format:  "ipfs://[host[:port]][?pin-service=name]",
+			Options: []Option{
+				{Name: "pin-service", Usage: "Remote pinning service, added to the IPFS daemon with 'ipfs pin remote service add', to also pin the files with"},
+			},
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newIPFSUploader(u, credentials.Username, credentials.Password)
+			},
+		},
+		{
+			Name:    "oci",
+			Schemes: []string{"oci", "oci+http"},
+			Format:  "oci://host[:port]/repository",
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newOCIUploader(u, credentials.Username, credentials.Password)
+			},
+		},
+		{
+			Name:    "artifactory",
+			Schemes: []string{"artifactory", "artifactory+http"},
+			Format:  "artifactory://host[:port]/[context/]repository[/path][;key=value...]",
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newArtifactoryUploader(u, credentials.Username, credentials.Password)
+			},
+		},
+		{
+			Name:    "nexus",
+			Schemes: []string{"nexus", "nexus+http"},
+			Format:  "nexus://host[:port]/[context/]repository/name[/path]",
+			New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+				return newNexusUploader(u, credentials.Username, credentials.Password)
+			},
+		},
+	} {
+		Register(backend)
+	}
+}
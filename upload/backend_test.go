@@ -0,0 +1,177 @@
+// +build unit
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+// a backend keeping the files put in memory
+type memoryUploader struct {
+	files map[string][]byte
+}
+
+func (m *memoryUploader) Put(ctx context.Context, name string, localPath string) error {
+	content, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	m.files[name] = content
+	return nil
+}
+
+func (m *memoryUploader) Head(ctx context.Context, name string) (int64, bool, error) {
+	content, exists := m.files[name]
+	return int64(len(content)), exists, nil
+}
+
+func (m *memoryUploader) Verify(ctx context.Context, name string, localPath string) error {
+	return verifySize(ctx, m, name, localPath)
+}
+
+func (m *memoryUploader) URL(name string) string {
+	return "mem:///" + name
+}
+
+func Test_Register(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-backend-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var created *url.URL
+	Register(Backend{
+		Name:    "memory",
+		Schemes: []string{"mem"},
+		Format:  "mem:///[?quota=size]",
+		Options: []Option{{Name: "quota", Usage: "Most bytes kept"}},
+		New: func(u *url.URL, credentials Credentials) (Uploader, error) {
+			created = u
+			return &memoryUploader{files: map[string][]byte{}}, nil
+		},
+	})
+
+	backend, err := BackendOf("mem:///")
+	assert.Nil(t, err)
+	assert.Equal(t, "memory", backend.Name)
+	assert.Equal(t, "upload-memory-quota", OptionFlag(backend, backend.Options[0]))
+
+	names := []string{}
+	for _, backend := range Backends() {
+		names = append(names, backend.Name)
+	}
+	assert.Equal(t, []string{"artifactory", "azblob", "gs", "http", "ipfs", "memory", "nexus", "oci", "s3", "sftp", "webdav"}, names)
+
+	t.Run("options are set unless the destination sets them", func(t *testing.T) {
+		destination, err := WithOptions("mem:///", map[string]string{"quota": "1MiB"})
+		assert.Nil(t, err)
+		assert.Equal(t, "mem:///?quota=1MiB", destination)
+
+		destination, err = WithOptions("mem:///?quota=2MiB", map[string]string{"quota": "1MiB"})
+		assert.Nil(t, err)
+		assert.Equal(t, "mem:///?quota=2MiB", destination)
+
+		_, err = WithOptions("mem:///", map[string]string{"region": "us-east-2"})
+		assert.NotNil(t, err)
+		_, err = WithOptions("ftp://files.example.com", map[string]string{"quota": "1MiB"})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("New creates uploaders of registered backends", func(t *testing.T) {
+		uploader, err := New("mem:///?quota=1MiB", Credentials{}, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, "1MiB", created.Query().Get("quota"))
+
+		local := path.Join(dir, "a.tgz")
+		assert.Nil(t, ioutil.WriteFile(local, []byte("fffff"), 0644))
+
+		assert.NotNil(t, uploader.Verify(context.Background(), "5aecb701/a.tgz", local))
+		assert.Nil(t, uploader.Put(context.Background(), "5aecb701/a.tgz", local))
+		assert.Nil(t, uploader.Verify(context.Background(), "5aecb701/a.tgz", local))
+
+		size, exists, err := uploader.Head(context.Background(), "5aecb701/a.tgz")
+		assert.Nil(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, int64(5), size)
+
+		assert.Nil(t, ioutil.WriteFile(local, []byte("ffffff"), 0644))
+		err = uploader.Verify(context.Background(), "5aecb701/a.tgz", local)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), fmt.Sprintf("has size 5 at the upload destination, expected %v", 6))
+
+		_, err = New("ftp://files.example.com/hzn", Credentials{}, 0)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "'mem'")
+	})
+}
+
+func Test_Pkg_Context(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-context-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	pkgDir := path.Join(dir, "5aecb701")
+	assert.Nil(t, os.Mkdir(pkgDir, 0755))
+	writeFile(t, pkgDir, "e26e31a0.tgz", "fffff")
+	pkgFile := writeFile(t, dir, "5aecb701.json", "{}")
+	pkgSigFile := writeFile(t, dir, "5aecb701.json.sig", "sig")
+
+	// nothing is uploaded once the context is done
+	uploader := &memoryUploader{files: map[string][]byte{}}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Pkg(cancelled, uploader, ioutil.Discard, pkgDir, pkgFile, pkgSigFile, 2, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(uploader.files))
+
+	// messages are tagged with the build ID the context carries
+	var out bytes.Buffer
+	uploaded, err := Pkg(cmdtools.WithBuildID(context.Background(), "1a2b"), uploader, &out, pkgDir, pkgFile, pkgSigFile, 2, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), uploaded)
+	assert.Contains(t, out.String(), "[INFO] build=1a2b upload: Uploaded ")
+}
+
+func Test_Handoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-handoff-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	pkgDir := path.Join(dir, "5aecb701")
+	assert.Nil(t, os.Mkdir(pkgDir, 0755))
+	writeFile(t, pkgDir, "e26e31a0.tgz", "fffff")
+	writeFile(t, pkgDir, "f0f0f0f0.tgz", "ggg")
+	pkgFile := writeFile(t, dir, "5aecb701.json", "{}")
+	pkgSigFile := writeFile(t, dir, "5aecb701.json.sig", "sig")
+
+	// a part is uploaded as soon as it's handed off, from wherever it was built
+	uploader := &memoryUploader{files: map[string][]byte{}}
+	handoff := NewHandoff(uploader, ioutil.Discard, 2, nil)
+	tmpPart := writeFile(t, dir, "e26e31a0.tgz", "fffff")
+	assert.Nil(t, handoff.Put(context.Background(), "5aecb701/e26e31a0.tgz", tmpPart))
+	assert.Equal(t, "fffff", string(uploader.files["5aecb701/e26e31a0.tgz"]))
+	assert.Equal(t, 1, len(uploader.files))
+
+	// the rest of the Pkg follows, without uploading the part again
+	uploader.files["5aecb701/e26e31a0.tgz"] = []byte("handed off")
+	uploaded, err := handoff.Pkg(context.Background(), pkgDir, pkgFile, pkgSigFile)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), uploaded)
+	assert.Equal(t, "handed off", string(uploader.files["5aecb701/e26e31a0.tgz"]))
+	assert.Equal(t, "ggg", string(uploader.files["5aecb701/f0f0f0f0.tgz"]))
+	assert.Equal(t, "{}", string(uploader.files["5aecb701.json"]))
+	assert.Equal(t, "sig", string(uploader.files["5aecb701.json.sig"]))
+
+	// nothing is handed off once the context is done
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, handoff.Put(cancelled, "5aecb701/f0f0f0f0.tgz", tmpPart))
+}
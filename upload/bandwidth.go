@@ -0,0 +1,134 @@
+package upload
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// throttleChunk bounds the bytes read at once through a bandwidthLimiter so the rate stays smooth
+const throttleChunk = 32 << 10
+
+// bandwidthLimiter limits the combined rate of the uploads sharing it. A nil
+// bandwidthLimiter doesn't limit anything.
+type bandwidthLimiter struct {
+	// bytes per second
+	rate int64
+
+	lock sync.Mutex
+
+	// the time the bytes read so far may all have been sent at the limited rate
+	next time.Time
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes may be sent
+func (l *bandwidthLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.lock.Unlock()
+
+	time.Sleep(delay)
+}
+
+// transport returns an http.RoundTripper limiting the rate request bodies are
+// sent at through the given one (nil for the default transport), or the given
+// one if there's no limit
+func (l *bandwidthLimiter) transport(base http.RoundTripper) http.RoundTripper {
+	if l == nil {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &throttledTransport{base: base, limiter: l}
+}
+
+type throttledReadCloser struct {
+	io.ReadCloser
+	limiter *bandwidthLimiter
+}
+
+func (t *throttledReadCloser) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+
+	n, err := t.ReadCloser.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
+
+type throttledTransport struct {
+	base    http.RoundTripper
+	limiter *bandwidthLimiter
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	// a RoundTripper mustn't modify the request, so the body is replaced on a copy
+	throttled := req.WithContext(req.Context())
+	throttled.Body = &throttledReadCloser{ReadCloser: req.Body, limiter: t.limiter}
+	return t.base.RoundTrip(throttled)
+}
+
+// limitBandwidth has the given uploader send files no faster than the limiter allows
+func limitBandwidth(uploader Uploader, limiter *bandwidthLimiter) {
+	if limiter == nil {
+		return
+	}
+
+	if httpClient := httpClientOf(uploader); httpClient != nil {
+		httpClient.Transport = limiter.transport(httpClient.Transport)
+		return
+	}
+
+	if u, ok := uploader.(*sftpUploader); ok {
+		// sftp limits its own bandwidth, in Kbit/s
+		kbits := limiter.rate * 8 / 1000
+		if kbits < 1 {
+			kbits = 1
+		}
+		u.sftpArgs = append(u.sftpArgs, "-l", strconv.FormatInt(kbits, 10))
+	}
+}
+
+// httpClientOf returns the http.Client an uploader sends files with, or nil if it doesn't send them over HTTP
+func httpClientOf(uploader Uploader) *http.Client {
+	switch u := uploader.(type) {
+	case *objectStoreUploader:
+		return u.httpClient
+	case *azureUploader:
+		return u.httpClient
+	case *webdavUploader:
+		return u.httpClient
+	case *ipfsUploader:
+		return u.httpClient
+	case *ociUploader:
+		return u.httpClient
+	case *repositoryUploader:
+		return u.httpClient
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+// +build unit
+
+package upload
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_bandwidthLimiter(t *testing.T) {
+	assert.Nil(t, newBandwidthLimiter(0))
+	assert.Nil(t, newBandwidthLimiter(0).transport(nil))
+
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received += len(body)
+	}))
+	defer server.Close()
+
+	// 256 KiB at 1 MiB/s takes about a quarter second, whatever the chunking
+	client := &http.Client{Transport: newBandwidthLimiter(1 << 20).transport(nil)}
+
+	start := time.Now()
+	resp, err := client.Post(server.URL, "application/octet-stream", bytes.NewReader(make([]byte, 256<<10)))
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, 256<<10, received)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, time.Since(start).String())
+}
+
+func Test_limitBandwidth(t *testing.T) {
+	uploader := &sftpUploader{sftpArgs: []string{"-b", "-"}}
+	limitBandwidth(uploader, newBandwidthLimiter(2<<20))
+	assert.Equal(t, []string{"-b", "-", "-l", "16777"}, uploader.sftpArgs)
+
+	webdav := &webdavUploader{httpClient: &http.Client{}}
+	limitBandwidth(webdav, nil)
+	assert.Nil(t, webdav.httpClient.Transport)
+	limitBandwidth(webdav, newBandwidthLimiter(2<<20))
+	assert.NotNil(t, webdav.httpClient.Transport)
+}
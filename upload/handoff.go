@@ -0,0 +1,72 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Handoff uploads the parts of a Pkg as a create.Builder hands them off (see
+// create.Options.PartHandoff), while the parts of other images are still
+// being exported, rather than once the whole Pkg is built; its Pkg then
+// uploads only the rest. It's safe for concurrent use.
+type Handoff struct {
+	uploader Uploader
+	out      io.Writer
+	receipt  *Receipt
+	slots    chan struct{}
+
+	lock     sync.Mutex
+	uploaded map[string]bool
+	sent     int64
+}
+
+// NewHandoff returns a Handoff uploading parts with the uploader, up to
+// parallelism of them at once (at least one), reporting progress to out and
+// recording the files uploaded in the receipt, if given, as Pkg does
+func NewHandoff(uploader Uploader, out io.Writer, parallelism int, receipt *Receipt) *Handoff {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	reportProgress(uploader, out)
+	return &Handoff{uploader: uploader, out: out, receipt: receipt, slots: make(chan struct{}, parallelism), uploaded: map[string]bool{}}
+}
+
+// Put uploads the part under the given name, waiting its turn if as many
+// parts as allowed are being uploaded already
+func (h *Handoff) Put(ctx context.Context, name string, localPath string) error {
+	select {
+	case h.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-h.slots }()
+
+	n, err := put(ctx, h.uploader, h.out, name, localPath, h.receipt)
+	if err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.uploaded[name] = true
+	h.sent += n
+	return nil
+}
+
+// Pkg uploads the rest of the Pkg as Pkg does, skipping the parts handed off
+// already, and returns the number of bytes uploaded in all, including those
+// of the parts handed off
+func (h *Handoff) Pkg(ctx context.Context, pkgDir string, pkgFile string, pkgSigFile string) (int64, error) {
+	h.lock.Lock()
+	uploaded := map[string]bool{}
+	for name := range h.uploaded {
+		uploaded[name] = true
+	}
+	sent := h.sent
+	h.lock.Unlock()
+
+	n, err := uploadPkg(ctx, h.uploader, h.out, pkgDir, pkgFile, pkgSigFile, cap(h.slots), h.receipt, uploaded)
+	return sent + n, err
+}
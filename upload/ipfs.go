@@ -0,0 +1,251 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the IPFS daemon's RPC API address when the destination names none
+const ipfsDefaultAPIHost = "127.0.0.1:5001"
+
+// ipfsCheckTimeout bounds checking that the daemon answers before any file is added
+const ipfsCheckTimeout = 10 * time.Second
+
+// ipfsUploader adds files to IPFS with a Kubo (go-ipfs) daemon's RPC API,
+// pinning them on the daemon and, optionally, with a remote pinning service
+// configured in the daemon. Files are known by their content identifiers
+// (CIDs) only once they're added. The daemon is required: files are neither
+// added nor pinned remotely without one, not even with a pinning service's
+// own API.
+type ipfsUploader struct {
+	httpClient *http.Client
+	api        *url.URL
+	pinService string
+	username   string
+	password   string
+
+	lock sync.Mutex
+
+	// CIDs of the files added, by name
+	cids map[string]string
+}
+
+// newIPFSUploader returns an uploader for a destination URL of the form
+// ipfs://[host[:port]][?pin-service=name], where host and port are those of
+// the daemon's RPC API (by default 127.0.0.1:5001) and name is a remote
+// pinning service added to the daemon with 'ipfs pin remote service add'. It
+// fails unless the daemon answers and has the pinning service, if any, so a
+// Pkg isn't built for a destination it can't be uploaded to.
+func newIPFSUploader(u *url.URL, username string, password string) (*ipfsUploader, error) {
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 'ipfs://[host[:port]][?pin-service=name]'", u)
+	}
+
+	host := u.Host
+	if host == "" {
+		host = ipfsDefaultAPIHost
+	}
+
+	if username == "" && u.User != nil {
+		username = u.User.Username()
+	}
+
+	i := &ipfsUploader{
+		httpClient: &http.Client{Timeout: 30 * time.Minute},
+		api:        &url.URL{Scheme: "http", Host: host, Path: "/api/v0/"},
+		pinService: u.Query().Get("pin-service"),
+		username:   username,
+		password:   password,
+		cids:       map[string]string{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ipfsCheckTimeout)
+	defer cancel()
+	if err := i.checkDaemon(ctx); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// checkDaemon checks that the daemon's RPC API answers and, if files are
+// pinned remotely, that the pinning service has been added to it
+func (i *ipfsUploader) checkDaemon(ctx context.Context) error {
+	var version struct {
+		Version string
+	}
+	if err := i.call(ctx, "version", nil, nil, "", &version); err != nil {
+		return fmt.Errorf("Unable to reach the IPFS daemon at %v, which ipfs:// uploads are made with; start a Kubo daemon (e.g. 'ipfs daemon') or give the address of its RPC API. Error: %v", i.api.Host, err)
+	}
+
+	if i.pinService == "" {
+		return nil
+	}
+
+	var services struct {
+		RemoteServices []struct {
+			Service string
+		}
+	}
+	if err := i.call(ctx, "pin/remote/service/ls", nil, nil, "", &services); err != nil {
+		return fmt.Errorf("Unable to list the remote pinning services of the IPFS daemon at %v. Error: %v", i.api.Host, err)
+	}
+	for _, service := range services.RemoteServices {
+		if service.Service == i.pinService {
+			return nil
+		}
+	}
+	return fmt.Errorf("Remote pinning service %v isn't added to the IPFS daemon at %v (version %v); add it with 'ipfs pin remote service add'", i.pinService, i.api.Host, version.Version)
+}
+
+func (i *ipfsUploader) contentAddressed() bool { return true }
+
+// URL returns the ipfs:// URL of the file added under the given name, or ""
+// if none has been
+func (i *ipfsUploader) URL(name string) string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if cid, exists := i.cids[name]; exists {
+		return "ipfs://" + cid
+	}
+	return ""
+}
+
+// Put adds the file to IPFS as a CIDv1 with raw leaves, pinned on the daemon,
+// then pins it with the remote pinning service, if any. A file already added
+// under the name isn't added again: parts are named for their content hash
+// and Pkg metadata for the Pkg ID.
+func (i *ipfsUploader) Put(ctx context.Context, name string, localPath string) error {
+	if i.URL(name) != "" {
+		return nil
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// stream the file in a multipart body rather than reading large parts into memory
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", path.Base(name))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	var added struct {
+		Name string
+		Hash string
+	}
+	query := url.Values{"cid-version": {"1"}, "raw-leaves": {"true"}, "pin": {"true"}, "progress": {"false"}}
+	if err := i.call(ctx, "add", query, body, form.FormDataContentType(), &added); err != nil {
+		body.CloseWithError(err)
+		return err
+	}
+
+	if added.Hash == "" {
+		return fmt.Errorf("IPFS daemon returned no CID for %v", name)
+	}
+
+	if i.pinService != "" {
+		query := url.Values{"arg": {added.Hash}, "service": {i.pinService}, "name": {name}, "background": {"true"}}
+		if err := i.call(ctx, "pin/remote/add", query, nil, "", nil); err != nil {
+			return fmt.Errorf("Unable to pin %v with pinning service %v. Error: %v", added.Hash, i.pinService, err)
+		}
+	}
+
+	i.lock.Lock()
+	i.cids[name] = added.Hash
+	i.lock.Unlock()
+	return nil
+}
+
+// putStatus adds the file; the daemon answers successful calls with 200 OK
+func (i *ipfsUploader) putStatus(ctx context.Context, name string, localPath string) (int, error) {
+	if err := i.Put(ctx, name, localPath); err != nil {
+		return 0, err
+	}
+	return http.StatusOK, nil
+}
+
+// Head looks up the size of the file added under the given name with the
+// daemon. Only files added with this Uploader are known, by their CIDs.
+func (i *ipfsUploader) Head(ctx context.Context, name string) (int64, bool, error) {
+	i.lock.Lock()
+	cid, exists := i.cids[name]
+	i.lock.Unlock()
+	if !exists {
+		return 0, false, nil
+	}
+
+	var stat struct {
+		Size int64
+	}
+	if err := i.call(ctx, "files/stat", url.Values{"arg": {"/ipfs/" + cid}}, nil, "", &stat); err != nil {
+		return 0, false, err
+	}
+	return stat.Size, true, nil
+}
+
+// Verify checks the file's size; its CID already names its content
+func (i *ipfsUploader) Verify(ctx context.Context, name string, localPath string) error {
+	return verifySize(ctx, i, name, localPath)
+}
+
+// call POSTs to the given RPC API command (all of them are POSTs) and decodes
+// the JSON response into result, if given
+func (i *ipfsUploader) call(ctx context.Context, command string, query url.Values, body io.Reader, contentType string, result interface{}) error {
+	u := *i.api
+	u.Path = path.Join(i.api.Path, command)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if i.username != "" {
+		req.SetBasicAuth(i.username, i.password)
+	}
+
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		var apiErr struct{ Message string }
+		if json.Unmarshal(content, &apiErr) == nil && apiErr.Message != "" {
+			return fmt.Errorf("IPFS daemon responded with status %v to %v: %v", resp.StatusCode, command, apiErr.Message)
+		}
+		return fmt.Errorf("IPFS daemon responded with status %v to %v: %s", resp.StatusCode, command, strings.TrimSpace(string(content)))
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
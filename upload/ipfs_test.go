@@ -0,0 +1,129 @@
+// +build unit
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+// a fake IPFS daemon RPC API with fake CIDs made from the content's hash
+type fakeIPFS struct {
+	lock   sync.Mutex
+	files  map[string]string
+	pinned map[string]string
+	adds   int
+}
+
+func (f *fakeIPFS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v0/version":
+		fmt.Fprintf(w, `{"Version":"0.18.1","Commit":"","Repo":"13","System":"amd64/linux","Golang":"go1.19.1"}`)
+	case "/api/v0/pin/remote/service/ls":
+		fmt.Fprintf(w, `{"RemoteServices":[{"Service":"pinner","ApiEndpoint":"https://pinner.example.com/psa"}]}`)
+	case "/api/v0/add":
+		if r.URL.Query().Get("cid-version") != "1" || r.URL.Query().Get("raw-leaves") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content, _ := ioutil.ReadAll(file)
+
+		cid := fmt.Sprintf("bafk%x", sha256.Sum256(content))[:20]
+		f.files[cid] = string(content)
+		f.adds++
+		fmt.Fprintf(w, `{"Name":"%v","Hash":"%v","Size":"%d"}`, header.Filename, cid, len(content))
+	case "/api/v0/pin/remote/add":
+		query := r.URL.Query()
+		if query.Get("service") != "pinner" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"Message":"service not found","Code":0,"Type":"error"}`)
+			return
+		}
+		f.pinned[query.Get("arg")] = query.Get("name")
+		fmt.Fprintf(w, `{"Cid":"%v","Name":"%v","Status":"queued"}`, query.Get("arg"), query.Get("name"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func Test_IPFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-ipfs-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fake := &fakeIPFS{files: map[string]string{}, pinned: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	host := server.URL[len("http://"):]
+
+	_, err = New("ipfs://"+host+"/some/path", Credentials{}, 0)
+	assert.NotNil(t, err)
+
+	uploader, err := New("ipfs://"+host+"?pin-service=pinner", Credentials{}, 0)
+	assert.Nil(t, err)
+	assert.True(t, ContentAddressed(uploader))
+	assert.Equal(t, "", BaseURL(uploader))
+
+	partPath := path.Join(dir, "part.tgz")
+	assert.Nil(t, ioutil.WriteFile(partPath, bytes.Repeat([]byte("layer"), 100000), 0644))
+
+	assert.Equal(t, "", uploader.URL("pkgid/part.tgz"))
+	assert.Nil(t, uploader.Put(context.Background(), "pkgid/part.tgz", partPath))
+
+	partURL := uploader.URL("pkgid/part.tgz")
+	assert.Contains(t, partURL, "ipfs://bafk")
+
+	cid := partURL[len("ipfs://"):]
+	assert.Equal(t, string(bytes.Repeat([]byte("layer"), 100000)), fake.files[cid])
+	assert.Equal(t, "pkgid/part.tgz", fake.pinned[cid])
+
+	// a part already added isn't added again
+	assert.Nil(t, uploader.Put(context.Background(), "pkgid/part.tgz", partPath))
+	assert.Equal(t, 1, fake.adds)
+
+	// the pinning service must be configured in the daemon before anything is added
+	_, err = New("ipfs://"+host+"?pin-service="+url.QueryEscape("other"), Credentials{}, 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "isn't added to the IPFS daemon")
+
+	// as must the daemon be running
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	stopped := listener.Addr().String()
+	listener.Close()
+	_, err = New("ipfs://"+stopped, Credentials{}, 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Unable to reach the IPFS daemon at "+stopped)
+
+	// other backends' URLs don't depend on content
+	uploader, err = New("davs://files.example.com/hzn", Credentials{}, 0)
+	assert.Nil(t, err)
+	assert.False(t, ContentAddressed(uploader))
+}
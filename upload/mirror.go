@@ -0,0 +1,173 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// fetchPart is a part of a Pkg as its metadata records it
+type fetchPart struct {
+	ID        string `json:"id"`
+	Sha256sum string `json:"sha256sum"`
+	Bytes     int64  `json:"bytes"`
+	Sources   []struct {
+		URL string `json:"url"`
+	} `json:"sources"`
+}
+
+// FetchPkg downloads the Pkg whose metadata file is at the given HTTP(S) URL
+// into dir, laid out as a create.Builder writes Pkgs, so it can be uploaded
+// with Pkg, e.g. to mirror it elsewhere: the metadata file and its signature
+// file, at the metadata's URL with '.sig' appended, beside a directory named
+// for the Pkg ID holding the parts. Each part is downloaded from the first of
+// its sources that's an HTTP(S) URL, under the name its URL ends in, and
+// checked against the size and SHA-256 hash the metadata records. The
+// signature isn't checked; edge nodes check it as usual. It returns the paths
+// of the parts' directory, the metadata file, and the signature file. Once
+// ctx is done, the download is abandoned.
+func FetchPkg(ctx context.Context, out io.Writer, pkgURL string, dir string) (string, string, string, error) {
+	u, err := url.Parse(pkgURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || !strings.HasSuffix(u.Path, ".json") {
+		return "", "", "", fmt.Errorf("Unable to fetch Pkg from %v, expected the HTTP(S) URL of its metadata file (e.g. 'https://host/path/<pkg ID>.json')", pkgURL)
+	}
+
+	pkgFile := path.Join(dir, path.Base(u.Path))
+	pkgSigFile := pkgFile + ".sig"
+	pkgDir := strings.TrimSuffix(pkgFile, ".json")
+
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		return "", "", "", err
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Minute}
+	for file, fileURL := range map[string]string{pkgFile: pkgURL, pkgSigFile: sigURL(u)} {
+		if _, err := download(ctx, httpClient, fileURL, file); err != nil {
+			return "", "", "", fmt.Errorf("Unable to fetch %v. Error: %v", fileURL, err)
+		}
+	}
+
+	parts, err := fetchParts(pkgFile)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	for _, part := range parts {
+		partURL := ""
+		for _, source := range part.Sources {
+			if strings.HasPrefix(source.URL, "https://") || strings.HasPrefix(source.URL, "http://") {
+				partURL = source.URL
+				break
+			}
+		}
+
+		// the name the part is uploaded under must match its ID for the metadata to refer to it
+		source, err := url.Parse(partURL)
+		if partURL == "" || err != nil {
+			return "", "", "", fmt.Errorf("Unable to fetch part %v of Pkg %v, it has no HTTP(S) source", part.ID, pkgURL)
+		} else if name := path.Base(source.Path); !strings.HasPrefix(name, part.ID+".") {
+			return "", "", "", fmt.Errorf("Unable to fetch part %v of Pkg %v, its URL %v isn't named for it", part.ID, pkgURL, partURL)
+		}
+
+		file := path.Join(pkgDir, path.Base(source.Path))
+		sum, err := download(ctx, httpClient, partURL, file)
+		if err != nil {
+			return "", "", "", fmt.Errorf("Unable to fetch part %v from %v. Error: %v", part.ID, redactURL(partURL), err)
+		}
+
+		if info, err := os.Stat(file); err != nil {
+			return "", "", "", err
+		} else if info.Size() != part.Bytes || sum != part.Sha256sum {
+			return "", "", "", fmt.Errorf("Part %v fetched from %v doesn't match the Pkg metadata: got %v bytes with hash %v, expected %v bytes with hash %v", part.ID, redactURL(partURL), info.Size(), sum, part.Bytes, part.Sha256sum)
+		}
+
+		cmdtools.LoggerFor(out).WithContext(ctx).Subsystem(cmdtools.SubsystemUpload).Infof("Fetched part %v from %v", part.ID, redactURL(partURL))
+	}
+
+	return pkgDir, pkgFile, pkgSigFile, nil
+}
+
+// sigURL returns the URL of the signature file of the Pkg whose metadata is at the given URL
+func sigURL(u *url.URL) string {
+	sig := *u
+	sig.Path += ".sig"
+	sig.RawPath = ""
+	return sig.String()
+}
+
+// fetchParts reads the parts recorded in the Pkg metadata file, which may be
+// serialized as an array or an object keyed by ID
+func fetchParts(pkgFile string) ([]fetchPart, error) {
+	content, err := ioutil.ReadFile(pkgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkg struct {
+		Parts json.RawMessage `json:"parts"`
+	}
+	if err := json.Unmarshal(content, &pkg); err != nil {
+		return nil, fmt.Errorf("Unable to parse Pkg metadata %v. Error: %v", pkgFile, err)
+	}
+
+	var parts []fetchPart
+	if err := json.Unmarshal(pkg.Parts, &parts); err != nil {
+		byID := map[string]fetchPart{}
+		if json.Unmarshal(pkg.Parts, &byID) != nil {
+			return nil, fmt.Errorf("Unexpected parts content in Pkg metadata %v", pkgFile)
+		}
+		for _, part := range byID {
+			parts = append(parts, part)
+		}
+	}
+
+	for _, part := range parts {
+		if part.ID == "" || strings.ContainsAny(part.ID, "/\\") {
+			return nil, fmt.Errorf("Part without a valid ID in Pkg metadata %v", pkgFile)
+		}
+	}
+	return parts, nil
+}
+
+// download writes the content at the given URL to the file, returning its SHA-256 hash
+func download(ctx context.Context, httpClient *http.Client, fileURL string, file string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Server responded with status %v", resp.StatusCode)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hasher), resp.Body); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
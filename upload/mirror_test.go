@@ -0,0 +1,81 @@
+// +build unit
+
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_FetchPkg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-mirror-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	part := "fffff"
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(part)))
+
+	files := map[string]string{"/parts/5aecb701/" + hash + ".tgz": part, "/hzn/5aecb701.json.sig": "c2ln"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, exists := files[r.URL.Path]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	metadata := func(bytes int, sources ...string) string {
+		return fmt.Sprintf(`{"id":"5aecb701","parts":{"%s":{"id":"%s","sha256sum":"%s","bytes":%d,"sources":[{"url":"%s"},{"url":"%s"}]}}}`, hash, hash, hash, bytes, sources[0], sources[1])
+	}
+
+	// parts are fetched from their first HTTP(S) source
+	files["/hzn/5aecb701.json"] = metadata(5, "ipfs://bafy", server.URL+"/parts/5aecb701/"+hash+".tgz")
+	pkgDir, pkgFile, pkgSigFile, err := FetchPkg(context.Background(), ioutil.Discard, server.URL+"/hzn/5aecb701.json", path.Join(dir, "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, path.Join(dir, "a", "5aecb701"), pkgDir)
+	assert.Equal(t, path.Join(dir, "a", "5aecb701.json"), pkgFile)
+	assert.Equal(t, path.Join(dir, "a", "5aecb701.json.sig"), pkgSigFile)
+
+	content, err := ioutil.ReadFile(path.Join(pkgDir, hash+".tgz"))
+	assert.Nil(t, err)
+	assert.Equal(t, part, string(content))
+	content, err = ioutil.ReadFile(pkgSigFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "c2ln", string(content))
+
+	// the result can be uploaded as a Pkg written by create
+	uploads, err := pkgFiles(pkgDir, pkgFile, pkgSigFile)
+	assert.Nil(t, err)
+	assert.Equal(t, []pkgUploadFile{
+		{name: "5aecb701/" + hash + ".tgz", localPath: path.Join(pkgDir, hash+".tgz")},
+		{name: "5aecb701.json", localPath: pkgFile},
+		{name: "5aecb701.json.sig", localPath: pkgSigFile},
+	}, uploads)
+
+	// parts that don't match the metadata, or have no HTTP(S) source named for them, fail the fetch
+	for _, pkg := range []string{
+		metadata(6, server.URL+"/parts/5aecb701/"+hash+".tgz", "ipfs://bafy"),
+		metadata(5, "ipfs://bafy", "oci://xy.io/hzn"),
+		metadata(5, server.URL+"/blobs/sha256:"+hash, "ipfs://bafy"),
+	} {
+		files["/hzn/5aecb701.json"] = pkg
+		_, _, _, err := FetchPkg(context.Background(), ioutil.Discard, server.URL+"/hzn/5aecb701.json", path.Join(dir, "b"))
+		assert.NotNil(t, err, pkg)
+		os.RemoveAll(path.Join(dir, "b"))
+	}
+
+	_, _, _, err = FetchPkg(context.Background(), ioutil.Discard, "s3://bucket/5aecb701.json", dir)
+	assert.NotNil(t, err)
+	_, _, _, err = FetchPkg(context.Background(), ioutil.Discard, server.URL+"/hzn/5aecb701", dir)
+	assert.NotNil(t, err)
+}
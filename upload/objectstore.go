@@ -0,0 +1,416 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/awsauth"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// files larger than this are uploaded in parts with a multipart upload
+	objectMultipartThreshold = 64 << 20
+
+	// the smallest size of a multipart upload's parts, and the most parts it may have
+	objectMinPartSize = 16 << 20
+	objectMaxParts    = 10000
+
+	gcsEndpoint = "storage.googleapis.com"
+)
+
+// objectStoreUploader puts objects in an Amazon S3 bucket, or a Google Cloud
+// Storage bucket through its S3-compatible XML API, authenticating requests
+// with AWS Signature Version 4. Large files are uploaded with resumable
+// multipart uploads.
+type objectStoreUploader struct {
+	httpClient *http.Client
+
+	// the URL of the bucket, including the prefix objects are put under
+	base *url.URL
+
+	region             string
+	multipartThreshold int64
+	minPartSize        int64
+	resume             *resumeStore
+
+	// static credentials; if nil, AWS credentials are looked up for each request
+	static *awsauth.Credentials
+}
+
+// newS3Uploader returns an uploader for a destination URL of the form
+// s3://bucket[/prefix][?endpoint=url&path-style=bool&ca-bundle=file] in the
+// region named by a region parameter, AWS_REGION, or AWS_DEFAULT_REGION (by
+// default us-east-1).
+// The endpoint of an S3-compatible store such as MinIO may be given instead
+// of AWS's, or by AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL; buckets at custom
+// endpoints are addressed path-style unless path-style=false. The CA bundle,
+// or AWS_CA_BUNDLE, names a PEM file of certificates to trust in addition to
+// the system's. Requests are authenticated with the given access key ID and
+// secret, if any, or else AWS credentials from the environment, shared
+// credentials file, or instance metadata.
+func newS3Uploader(u *url.URL, accessKeyID string, secret string) (*objectStoreUploader, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 's3://bucket[/prefix][?endpoint=url&path-style=bool&ca-bundle=file]'", u)
+	}
+
+	query := u.Query()
+
+	region := query.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := &url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", region)}
+	customEndpoint := firstNonEmpty(query.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+	if customEndpoint != "" {
+		var err error
+		endpoint, err = url.Parse(customEndpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, fmt.Errorf("Unable to use S3 endpoint '%v', expected format 'http[s]://host[:port]'", customEndpoint)
+		}
+	}
+
+	// virtual-hosted-style URLs of buckets with dots in their names don't match S3's certificate
+	pathStyle := customEndpoint != "" || strings.Contains(u.Host, ".")
+	if value := query.Get("path-style"); value != "" {
+		var err error
+		if pathStyle, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("Unable to use path-style value '%v' of upload destination %v, expected true or false", value, u)
+		}
+	}
+
+	base := &url.URL{Scheme: endpoint.Scheme, Host: u.Host + "." + endpoint.Host, Path: path.Join("/", u.Path)}
+	if pathStyle {
+		base = &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: path.Join("/", u.Host, u.Path)}
+	}
+
+	o := newObjectStoreUploader(base, region, accessKeyID, secret)
+
+	if caBundle := firstNonEmpty(query.Get("ca-bundle"), os.Getenv("AWS_CA_BUNDLE")); caBundle != "" {
+		transport, err := caBundleTransport(caBundle)
+		if err != nil {
+			return nil, err
+		}
+		o.httpClient.Transport = transport
+	}
+	return o, nil
+}
+
+// caBundleTransport returns a transport trusting the certificates in the
+// given PEM file in addition to the system's
+func caBundleTransport(caBundle string) (*http.Transport, error) {
+	pem, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA bundle %v: %v", caBundle, err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Unable to use CA bundle %v, it contains no PEM certificates", caBundle)
+	}
+
+	return &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: pool}}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// newGCSUploader returns an uploader for a destination URL of the form
+// gs://bucket[/prefix]. Requests are authenticated with the given HMAC key
+// (access ID and secret) of a service account with access to the bucket.
+func newGCSUploader(u *url.URL, accessID string, secret string) (*objectStoreUploader, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 'gs://bucket[/prefix]'", u)
+	}
+
+	if accessID == "" || secret == "" {
+		return nil, fmt.Errorf("Upload destination %v requires the access ID and secret of a Google Cloud Storage HMAC key", u)
+	}
+
+	base := &url.URL{Scheme: "https", Host: gcsEndpoint, Path: path.Join("/", u.Host, u.Path)}
+	return newObjectStoreUploader(base, "auto", accessID, secret), nil
+}
+
+func newObjectStoreUploader(base *url.URL, region string, accessKeyID string, secret string) *objectStoreUploader {
+	o := &objectStoreUploader{
+		httpClient:         &http.Client{Timeout: 30 * time.Minute},
+		base:               base,
+		region:             region,
+		multipartThreshold: objectMultipartThreshold,
+		minPartSize:        objectMinPartSize,
+		resume:             newResumeStore(),
+	}
+
+	if accessKeyID != "" {
+		o.static = &awsauth.Credentials{AccessKeyID: accessKeyID, SecretAccessKey: secret}
+	}
+	return o
+}
+
+func (o *objectStoreUploader) credentials() (awsauth.Credentials, error) {
+	if o.static != nil {
+		return *o.static, nil
+	}
+	return awsauth.LookupCredentials()
+}
+
+func (o *objectStoreUploader) objectURL(name string) *url.URL {
+	u := *o.base
+	u.Path = path.Join(o.base.Path, name)
+	if name == "" {
+		u.Path = o.base.Path + "/"
+	}
+	return &u
+}
+
+func (o *objectStoreUploader) URL(name string) string {
+	return o.objectURL(name).String()
+}
+
+// Put puts the file as an object in a single request or, if it's large, with
+// a multipart upload. The payload isn't signed so it's read once.
+func (o *objectStoreUploader) Put(ctx context.Context, name string, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() > o.multipartThreshold {
+		return o.putMultipart(ctx, f, info.Size(), o.objectURL(name), o.resume.key(o.URL(name), info))
+	}
+
+	resp, err := o.do(ctx, http.MethodPut, o.objectURL(name), io.NewSectionReader(f, 0, info.Size()), info.Size())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putStatus puts the file; the service answers successful requests with 200 OK
+func (o *objectStoreUploader) putStatus(ctx context.Context, name string, localPath string) (int, error) {
+	if err := o.Put(ctx, name, localPath); err != nil {
+		return 0, err
+	}
+	return http.StatusOK, nil
+}
+
+// Head looks the object up with a HEAD request
+func (o *objectStoreUploader) Head(ctx context.Context, name string) (int64, bool, error) {
+	resp, err := o.do(ctx, http.MethodHead, o.objectURL(name), nil, 0)
+	if storeErr, ok := err.(*objectStoreError); ok && storeErr.status == http.StatusNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, true, nil
+}
+
+// Verify checks the object's size; ETags of multipart uploads aren't content hashes
+func (o *objectStoreUploader) Verify(ctx context.Context, name string, localPath string) error {
+	return verifySize(ctx, o, name, localPath)
+}
+
+// objectUploadState is the persisted progress of a multipart upload
+type objectUploadState struct {
+	UploadID string
+	PartSize int64
+
+	// ETags of the parts uploaded, in order
+	ETags []string
+}
+
+// putMultipart uploads the file in parts, continuing an earlier multipart
+// upload whose state was saved under the given key, if any, then completes
+// the upload. An upload that was aborted or expired since is restarted.
+func (o *objectStoreUploader) putMultipart(ctx context.Context, f *os.File, size int64, objectURL *url.URL, key string) error {
+	var state objectUploadState
+	resumed := o.resume.load(key, &state) && state.UploadID != "" && state.PartSize > 0
+
+	if !resumed {
+		partSize := (size + objectMaxParts - 1) / objectMaxParts
+		if partSize < o.minPartSize {
+			partSize = o.minPartSize
+		}
+
+		var initiated struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := o.doXML(ctx, http.MethodPost, withQuery(objectURL, url.Values{"uploads": {""}}), nil, &initiated); err != nil {
+			return err
+		}
+
+		state = objectUploadState{UploadID: initiated.UploadID, PartSize: partSize}
+		o.resume.save(key, state)
+	}
+
+	partCount := (size + state.PartSize - 1) / state.PartSize
+
+	var completion bytes.Buffer
+	completion.WriteString("<CompleteMultipartUpload>")
+
+	for i := int64(0); i < partCount; i++ {
+		if i >= int64(len(state.ETags)) {
+			length := state.PartSize
+			if remaining := size - i*state.PartSize; remaining < length {
+				length = remaining
+			}
+
+			partURL := withQuery(objectURL, url.Values{"partNumber": {strconv.FormatInt(i+1, 10)}, "uploadId": {state.UploadID}})
+			resp, err := o.do(ctx, http.MethodPut, partURL, io.NewSectionReader(f, i*state.PartSize, length), length)
+			if err != nil {
+				if resumed && isNoSuchUpload(err) {
+					o.resume.remove(key)
+					return o.putMultipart(ctx, f, size, objectURL, key)
+				}
+				return err
+			}
+			resp.Body.Close()
+
+			state.ETags = append(state.ETags, resp.Header.Get("ETag"))
+			o.resume.save(key, state)
+		}
+
+		fmt.Fprintf(&completion, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, html.EscapeString(state.ETags[i]))
+	}
+
+	completion.WriteString("</CompleteMultipartUpload>")
+
+	if err := o.doXML(ctx, http.MethodPost, withQuery(objectURL, url.Values{"uploadId": {state.UploadID}}), completion.Bytes(), nil); err != nil {
+		if resumed && isNoSuchUpload(err) {
+			o.resume.remove(key)
+			return o.putMultipart(ctx, f, size, objectURL, key)
+		}
+		return err
+	}
+
+	o.resume.remove(key)
+	return nil
+}
+
+// objectStoreError is an error response from the object store
+type objectStoreError struct {
+	status int
+	code   string
+	method string
+	url    *url.URL
+	body   string
+}
+
+func (e *objectStoreError) Error() string {
+	u := *e.url
+	u.RawQuery = ""
+	return fmt.Sprintf("Object store responded with status %v to %v of %v: %s", e.status, e.method, u.String(), e.body)
+}
+
+// isNoSuchUpload returns true if the error is the object store's response to
+// a multipart upload that doesn't exist (anymore)
+func isNoSuchUpload(err error) bool {
+	storeErr, ok := err.(*objectStoreError)
+	return ok && storeErr.code == "NoSuchUpload"
+}
+
+func withQuery(u *url.URL, query url.Values) *url.URL {
+	withQuery := *u
+	withQuery.RawQuery = query.Encode()
+	return &withQuery
+}
+
+// do sends a signed request, returning an objectStoreError for responses other than 200 OK
+func (o *objectStoreUploader) do(ctx context.Context, method string, reqURL *url.URL, body io.Reader, length int64) (*http.Response, error) {
+	creds, err := o.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+	req.Header.Set("X-Amz-Content-Sha256", awsauth.UnsignedPayload)
+	awsauth.SignV4(req, awsauth.UnsignedPayload, creds, o.region, "s3", time.Now())
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		var errorResponse struct {
+			Code string
+		}
+		xml.Unmarshal(content, &errorResponse)
+
+		return nil, &objectStoreError{status: resp.StatusCode, code: errorResponse.Code, method: method, url: reqURL, body: strings.TrimSpace(string(content))}
+	}
+
+	return resp, nil
+}
+
+// doXML sends a signed request with the given body and decodes the XML
+// response into result, if given. Some errors are reported in a response
+// with status 200 OK.
+func (o *objectStoreUploader) doXML(ctx context.Context, method string, reqURL *url.URL, body []byte, result interface{}) error {
+	resp, err := o.do(ctx, method, reqURL, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var errorResponse struct {
+		XMLName xml.Name
+		Code    string
+	}
+	if xml.Unmarshal(content, &errorResponse) == nil && errorResponse.XMLName.Local == "Error" {
+		return &objectStoreError{status: resp.StatusCode, code: errorResponse.Code, method: method, url: reqURL, body: strings.TrimSpace(string(content))}
+	}
+
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(content, result)
+}
@@ -0,0 +1,255 @@
+// +build unit
+
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a fake object store that accepts signed PUTs and multipart uploads
+type fakeObjectStore struct {
+	lock    sync.Mutex
+	objects map[string]string
+	uploads map[string]map[string]string
+
+	// partPuts counts part uploads; the failPart'th fails, if set
+	partPuts int
+	failPart int
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: map[string]string{}, uploads: map[string]map[string]string{}}
+}
+
+func (f *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.Header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>AccessDenied</Code></Error>"))
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	if _, exists := f.uploads[uploadID]; uploadID != "" && !exists {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<Error><Code>NoSuchUpload</Code></Error>"))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		uploadID = fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[uploadID] = map[string]string{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == http.MethodPut && uploadID != "":
+		f.partPuts++
+		if f.partPuts == f.failPart {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		etag := fmt.Sprintf(`"etag-%v"`, query.Get("partNumber"))
+		f.uploads[uploadID][etag] = string(body)
+		w.Header().Set("ETag", etag)
+	case r.Method == http.MethodPost && uploadID != "":
+		var completion struct {
+			Parts []struct {
+				ETag string
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &completion)
+
+		content := ""
+		for _, part := range completion.Parts {
+			content += f.uploads[uploadID][part.ETag]
+		}
+		f.objects[r.URL.Path] = content
+		delete(f.uploads, uploadID)
+		w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case r.Method == http.MethodPut:
+		f.objects[r.URL.Path] = string(body)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func Test_ObjectStoreDestinations(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	uploader, err := New("s3://hzn-pkgs/edge", Credentials{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://hzn-pkgs.s3.eu-west-1.amazonaws.com/edge/pkgid/part.tgz", uploader.URL("pkgid/part.tgz"))
+	assert.Equal(t, "https://hzn-pkgs.s3.eu-west-1.amazonaws.com/edge", BaseURL(uploader))
+
+	uploader, err = New("s3://pkgs.example.com", Credentials{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://s3.eu-west-1.amazonaws.com/pkgs.example.com/pkg.json", uploader.URL("pkg.json"))
+
+	_, err = New("gs://hzn-pkgs/edge", Credentials{}, 0)
+	assert.NotNil(t, err)
+
+	uploader, err = New("gs://hzn-pkgs/edge", Credentials{Username: "GOOGKEY", Password: "secret"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://storage.googleapis.com/hzn-pkgs/edge/pkg.json", uploader.URL("pkg.json"))
+}
+
+func Test_ObjectStorePresigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-objectstore-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fake := newFakeObjectStore()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	base, err := url.Parse(server.URL + "/bucket/edge")
+	assert.Nil(t, err)
+	store := newObjectStoreUploader(base, "us-east-1", "AKID", "secret")
+
+	pkgDir := path.Join(dir, "pkgid")
+	assert.Nil(t, os.Mkdir(pkgDir, 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(pkgDir, "part.tgz"), []byte("part"), 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "pkgid.json"), []byte("{}"), 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "pkgid.json.sig"), []byte("sig"), 0644))
+
+	_, err = Pkg(context.Background(), store, ioutil.Discard, pkgDir, path.Join(dir, "pkgid.json"), path.Join(dir, "pkgid.json.sig"), 2, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "part", fake.objects["/bucket/edge/pkgid/part.tgz"])
+	assert.Equal(t, "sig", fake.objects["/bucket/edge/pkgid.json.sig"])
+
+	_, err = NewPresigner(store, 8*24*time.Hour)
+	assert.NotNil(t, err)
+
+	_, err = NewPresigner(&webdavUploader{}, time.Hour)
+	assert.NotNil(t, err)
+
+	presigner, err := NewPresigner(store, 72*time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, presigner.Temporary())
+
+	presigned := presigner.URL("pkgid/part.tgz")
+	assert.True(t, strings.HasPrefix(presigned, server.URL+"/bucket/edge/pkgid/part.tgz?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKID%2F"))
+	assert.Contains(t, presigned, "&X-Amz-Expires=259200&")
+	assert.Contains(t, presigned, "&X-Amz-Signature=")
+
+	mapFile := path.Join(dir, "urls.json")
+	assert.Nil(t, WriteURLMap(presigner, mapFile, pkgDir, path.Join(dir, "pkgid.json"), path.Join(dir, "pkgid.json.sig")))
+
+	content, err := ioutil.ReadFile(mapFile)
+	assert.Nil(t, err)
+
+	var urls map[string]string
+	assert.Nil(t, json.Unmarshal(content, &urls))
+	assert.Equal(t, 3, len(urls))
+	assert.Contains(t, urls["pkgid/part.tgz"], server.URL+"/bucket/edge/pkgid/part.tgz?")
+	assert.Contains(t, urls["pkgid.json"], server.URL+"/bucket/edge/pkgid.json?")
+	assert.Contains(t, urls["pkgid.json.sig"], server.URL+"/bucket/edge/pkgid.json.sig?")
+}
+
+func Test_ObjectStoreMultipart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-objectstore-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Setenv("XDG_CACHE_HOME", path.Join(dir, "cache"))
+
+	fake := newFakeObjectStore()
+	fake.failPart = 3
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	base, err := url.Parse(server.URL + "/bucket")
+	assert.Nil(t, err)
+
+	newStore := func() *objectStoreUploader {
+		store := newObjectStoreUploader(base, "us-east-1", "AKID", "secret")
+		store.multipartThreshold = 8
+		store.minPartSize = 4
+		return store
+	}
+
+	large := path.Join(dir, "large.tgz")
+	assert.Nil(t, ioutil.WriteFile(large, []byte("0123456789abcdef"), 0644))
+
+	err = newStore().Put(context.Background(), "pkgid/large.tgz", large)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "status 500")
+
+	// a later run continues the upload with the failed part
+	assert.Nil(t, newStore().Put(context.Background(), "pkgid/large.tgz", large))
+	assert.Equal(t, "0123456789abcdef", fake.objects["/bucket/pkgid/large.tgz"])
+	assert.Equal(t, 5, fake.partPuts)
+	assert.Equal(t, 0, len(fake.uploads))
+
+	// an upload that no longer exists is restarted
+	fake.failPart = 7
+	assert.NotNil(t, newStore().Put(context.Background(), "pkgid/restarted.tgz", large))
+	fake.uploads = map[string]map[string]string{}
+
+	assert.Nil(t, newStore().Put(context.Background(), "pkgid/restarted.tgz", large))
+	assert.Equal(t, "0123456789abcdef", fake.objects["/bucket/pkgid/restarted.tgz"])
+	assert.Equal(t, 11, fake.partPuts)
+
+	files, _ := ioutil.ReadDir(path.Join(dir, "cache", "horizon-pkg-build", "uploads"))
+	assert.Equal(t, 0, len(files))
+}
+
+func Test_ObjectStoreEndpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-objectstore-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fake := newFakeObjectStore()
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	caBundle := path.Join(dir, "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644))
+
+	uploader, err := New("s3://bucket/edge?endpoint="+url.QueryEscape(server.URL)+"&ca-bundle="+url.QueryEscape(caBundle), Credentials{Username: "AKID", Password: "secret"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, server.URL+"/bucket/edge/pkg.json", uploader.URL("pkg.json"))
+
+	assert.Nil(t, uploader.Put(context.Background(), "pkgid/part.tgz", writeFile(t, dir, "part.tgz", "part")))
+	assert.Equal(t, "part", fake.objects["/bucket/edge/pkgid/part.tgz"])
+
+	// the self-signed certificate isn't trusted without the CA bundle
+	uploader, err = New("s3://bucket/edge?endpoint="+url.QueryEscape(server.URL), Credentials{Username: "AKID", Password: "secret"}, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, uploader.Put(context.Background(), "pkgid/part.tgz", path.Join(dir, "part.tgz")))
+
+	uploader, err = New("s3://bucket?endpoint=https://minio.example.com:9000&path-style=false", Credentials{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://bucket.minio.example.com:9000/pkg.json", uploader.URL("pkg.json"))
+
+	t.Setenv("AWS_ENDPOINT_URL", "http://minio.example.com:9000")
+	uploader, err = New("s3://bucket", Credentials{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://minio.example.com:9000/bucket/pkg.json", uploader.URL("pkg.json"))
+
+	_, err = New("s3://bucket?endpoint=minio.example.com", Credentials{}, 0)
+	assert.NotNil(t, err)
+	_, err = New("s3://bucket?path-style=maybe", Credentials{}, 0)
+	assert.NotNil(t, err)
+	_, err = New("s3://bucket?ca-bundle="+url.QueryEscape(path.Join(dir, "part.tgz")), Credentials{}, 0)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,340 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/open-horizon/horizon-pkg-build/registry"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ociArtifactType is the artifact type of the manifests files are pushed with
+	ociArtifactType = "application/vnd.horizon.pkg.file.v1"
+
+	// ociEmptyMediaType is the media type of the empty configuration of artifact manifests
+	ociEmptyMediaType = "application/vnd.oci.empty.v1+json"
+
+	// ociTitleAnnotation names the file in a layer, as ORAS does
+	ociTitleAnnotation = "org.opencontainers.image.title"
+)
+
+// ociRepositoryPattern matches repository names in the registry API
+var ociRepositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+
+// ociTagInvalid matches the characters of file names not allowed in tags
+var ociTagInvalid = regexp.MustCompile(`[^\w.-]`)
+
+// ociDescriptor describes content in a registry
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an OCI image manifest for an artifact, as ORAS pushes them
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	ArtifactType  string          `json:"artifactType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociUploader pushes files to a repository of an OCI registry as artifacts
+// in the way ORAS does: each file is a blob, referenced as the single layer
+// of a manifest tagged with the file's name. Files are known by their blobs'
+// digests only once they're pushed.
+type ociUploader struct {
+	httpClient *http.Client
+	base       *url.URL
+	repository string
+	username   string
+	password   string
+
+	lock sync.Mutex
+
+	// digests of the files pushed, by name
+	digests map[string]string
+
+	// the Authorization header answering the registry's last challenge, reused for later requests
+	authorization string
+}
+
+// newOCIUploader returns an uploader for a destination URL of the form
+// oci://host[:port]/repository, contacted over HTTPS ('oci+http' for HTTP)
+func newOCIUploader(u *url.URL, username string, password string) (*ociUploader, error) {
+	repository := strings.Trim(u.Path, "/")
+	if u.Host == "" || !ociRepositoryPattern.MatchString(repository) {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 'oci://host[:port]/repository'", u)
+	}
+
+	scheme := "https"
+	if u.Scheme == "oci+http" {
+		scheme = "http"
+	}
+
+	if username == "" && u.User != nil {
+		username = u.User.Username()
+	}
+
+	return &ociUploader{
+		httpClient: &http.Client{Timeout: 30 * time.Minute},
+		base:       &url.URL{Scheme: scheme, Host: u.Host},
+		repository: repository,
+		username:   username,
+		password:   password,
+		digests:    map[string]string{},
+	}, nil
+}
+
+func (o *ociUploader) contentAddressed() bool { return true }
+
+// URL returns the registry API URL of the blob of the file pushed under the
+// given name, or "" if none has been
+func (o *ociUploader) URL(name string) string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if digest, exists := o.digests[name]; exists {
+		return o.apiURL("blobs/" + digest)
+	}
+	return ""
+}
+
+func (o *ociUploader) apiURL(apiPath string) string {
+	return fmt.Sprintf("%s/v2/%s/%s", o.base, o.repository, apiPath)
+}
+
+// Put pushes the file as a blob unless the repository has it already, then
+// pushes a manifest referencing it tagged with the file's base name
+func (o *ociUploader) Put(ctx context.Context, name string, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, sum, err := fileDigest(localPath)
+	if err != nil {
+		return err
+	}
+
+	layer := ociDescriptor{MediaType: "application/octet-stream", Digest: "sha256:" + sum, Size: size, Annotations: map[string]string{ociTitleAnnotation: path.Base(name)}}
+	if path.Ext(name) == ".json" {
+		layer.MediaType = "application/json"
+	}
+
+	if err := o.pushBlob(ctx, layer.Digest, size, func() io.Reader { return io.NewSectionReader(f, 0, size) }); err != nil {
+		return err
+	}
+
+	// artifacts have an empty configuration
+	emptyConfig := []byte("{}")
+	config := ociDescriptor{MediaType: ociEmptyMediaType, Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(emptyConfig)), Size: int64(len(emptyConfig))}
+	if err := o.pushBlob(ctx, config.Digest, config.Size, func() io.Reader { return bytes.NewReader(emptyConfig) }); err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(ociManifest{SchemaVersion: 2, MediaType: registry.MediaTypeOCIManifest, ArtifactType: ociArtifactType, Config: config, Layers: []ociDescriptor{layer}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.do(ctx, http.MethodPut, o.apiURL("manifests/"+ociTag(name)), registry.MediaTypeOCIManifest, func() io.Reader { return bytes.NewReader(manifest) }, int64(len(manifest)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return o.statusError(resp, "manifest of "+name)
+	}
+
+	o.lock.Lock()
+	o.digests[name] = layer.Digest
+	o.lock.Unlock()
+	return nil
+}
+
+// putStatus pushes the file; the registry answers a successful manifest push with 201 Created
+func (o *ociUploader) putStatus(ctx context.Context, name string, localPath string) (int, error) {
+	if err := o.Put(ctx, name, localPath); err != nil {
+		return 0, err
+	}
+	return http.StatusCreated, nil
+}
+
+// Head looks up the blob of the file pushed under the given name. Only files
+// pushed with this Uploader are known, by their blobs' digests.
+func (o *ociUploader) Head(ctx context.Context, name string) (int64, bool, error) {
+	blobURL := o.URL(name)
+	if blobURL == "" {
+		return 0, false, nil
+	}
+
+	resp, err := o.do(ctx, http.MethodHead, blobURL, "", nil, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, true, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, o.statusError(resp, "blob of "+name)
+	}
+}
+
+// Verify checks the blob's size; its digest already names its content
+func (o *ociUploader) Verify(ctx context.Context, name string, localPath string) error {
+	return verifySize(ctx, o, name, localPath)
+}
+
+// pushBlob pushes the content with the given digest in a monolithic upload
+// unless the repository has it already
+func (o *ociUploader) pushBlob(ctx context.Context, digest string, size int64, body func() io.Reader) error {
+	resp, err := o.do(ctx, http.MethodHead, o.apiURL("blobs/"+digest), "", nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = o.do(ctx, http.MethodPost, o.apiURL("blobs/uploads/"), "", nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return o.statusError(resp, "blob "+digest)
+	}
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return fmt.Errorf("Registry %v returned no usable upload location for blob %v", o.base.Host, digest)
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	resp, err = o.do(ctx, http.MethodPut, location.String(), "application/octet-stream", body, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return o.statusError(resp, "blob "+digest)
+	}
+	return nil
+}
+
+// ociTag returns the tag of the manifest of the file put under the given
+// name: its base name, with characters not allowed in tags replaced
+func ociTag(name string) string {
+	tag := ociTagInvalid.ReplaceAllString(path.Base(name), "_")
+	if strings.HasPrefix(tag, ".") || strings.HasPrefix(tag, "-") {
+		tag = "_" + tag
+	}
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+func (o *ociUploader) statusError(resp *http.Response, what string) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("Registry %v responded with status %v to %v of %v: %s", o.base.Host, resp.StatusCode, resp.Request.Method, what, bytes.TrimSpace(body))
+}
+
+// do sends a request with the Authorization header answering the last
+// challenge received if any, and resends it once if the registry challenges
+// it. The body function returns a fresh body for each attempt.
+func (o *ociUploader) do(ctx context.Context, method string, reqURL string, contentType string, body func() io.Reader, length int64) (*http.Response, error) {
+	challenged := false
+
+	for {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = body()
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, reqURL, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = length
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		o.lock.Lock()
+		if o.authorization != "" {
+			req.Header.Set("Authorization", o.authorization)
+		}
+		o.lock.Unlock()
+
+		resp, err := o.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized || challenged {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		authorization, err := o.answer(resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return nil, err
+		}
+
+		o.lock.Lock()
+		o.authorization = authorization
+		o.lock.Unlock()
+
+		challenged = true
+	}
+}
+
+// answer returns the Authorization header answering the registry's challenge
+func (o *ociUploader) answer(challenge string) (string, error) {
+	scheme, params := cmdtools.ParseAuthChallenge(challenge)
+	switch scheme {
+	case "bearer":
+		token, err := registry.BearerToken(o.httpClient, params, fmt.Sprintf("repository:%s:pull,push", o.repository), o.username, o.password, o.username != "")
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	case "basic":
+		if o.username == "" {
+			return "", fmt.Errorf("Registry %v requires credentials and none were provided", o.base.Host)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(o.username+":"+o.password)), nil
+	default:
+		return "", fmt.Errorf("Unsupported authentication challenge from registry %v: %v", o.base.Host, challenge)
+	}
+}
@@ -0,0 +1,129 @@
+// +build unit
+
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a fake OCI registry requiring bearer tokens from its own token service
+type fakeRegistry struct {
+	lock      sync.Mutex
+	realm     string
+	blobs     map[string]string
+	manifests map[string]string
+	tokens    int
+	blobPuts  int
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.URL.Path == "/token" {
+		if username, password, _ := r.BasicAuth(); username != "timmy" || password != "s3cret" || r.URL.Query().Get("scope") != "repository:hzn/parts:pull,push" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.tokens++
+		fmt.Fprintf(w, `{"token":"t0k"}`)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer t0k" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%v",service="fake"`, f.realm))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const prefix = "/v2/hzn/parts/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	apiPath := strings.TrimPrefix(r.URL.Path, prefix)
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodHead && strings.HasPrefix(apiPath, "blobs/"):
+		if _, exists := f.blobs[strings.TrimPrefix(apiPath, "blobs/")]; !exists {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodPost && apiPath == "blobs/uploads/":
+		w.Header().Set("Location", "/v2/hzn/parts/blobs/uploads/some-uuid?state=abc")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && apiPath == "blobs/uploads/some-uuid":
+		if r.URL.Query().Get("state") != "abc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobPuts++
+		f.blobs[r.URL.Query().Get("digest")] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && strings.HasPrefix(apiPath, "manifests/"):
+		f.manifests[strings.TrimPrefix(apiPath, "manifests/")] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func Test_OCI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-oci-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fake := &fakeRegistry{blobs: map[string]string{}, manifests: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.realm = server.URL + "/token"
+
+	host := server.URL[len("http://"):]
+
+	_, err = New("oci://"+host, Credentials{}, 0)
+	assert.NotNil(t, err)
+	_, err = New("oci://"+host+"/Upper/Case", Credentials{}, 0)
+	assert.NotNil(t, err)
+
+	uploader, err := New("oci+http://timmy@"+host+"/hzn/parts/", Credentials{Password: "s3cret"}, 0)
+	assert.Nil(t, err)
+	assert.True(t, ContentAddressed(uploader))
+	assert.Equal(t, "", uploader.URL("5aecb701/e26e31a0.tgz"))
+
+	assert.Nil(t, uploader.Put(context.Background(), "5aecb701/e26e31a0.tgz", writeFile(t, dir, "e26e31a0.tgz", "fffff")))
+	assert.Nil(t, uploader.Put(context.Background(), "5aecb701.json", writeFile(t, dir, "5aecb701.json", "{}")))
+
+	partDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("fffff")))
+	assert.Equal(t, server.URL+"/v2/hzn/parts/blobs/"+partDigest, uploader.URL("5aecb701/e26e31a0.tgz"))
+	assert.Equal(t, "fffff", fake.blobs[partDigest])
+
+	var manifest ociManifest
+	assert.Nil(t, json.Unmarshal([]byte(fake.manifests["e26e31a0.tgz"]), &manifest))
+	assert.Equal(t, ociArtifactType, manifest.ArtifactType)
+	assert.Equal(t, ociEmptyMediaType, manifest.Config.MediaType)
+	assert.Equal(t, "{}", fake.blobs[manifest.Config.Digest])
+	assert.Equal(t, []ociDescriptor{ociDescriptor{MediaType: "application/octet-stream", Digest: partDigest, Size: 5, Annotations: map[string]string{ociTitleAnnotation: "e26e31a0.tgz"}}}, manifest.Layers)
+	assert.Contains(t, fake.manifests["5aecb701.json"], `"mediaType":"application/json"`)
+
+	// the metadata's content is the same as the empty configuration's, which was pushed already
+	assert.Equal(t, 2, fake.blobPuts)
+	assert.Equal(t, 1, fake.tokens)
+
+	uploader, err = New("oci+http://"+host+"/hzn/parts", Credentials{}, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, uploader.Put(context.Background(), "a.tgz", writeFile(t, dir, "a.tgz", "ggggg")))
+
+	assert.Equal(t, "some_file.tgz", ociTag("pkg/some:file.tgz"))
+	assert.Equal(t, "_.hidden", ociTag(".hidden"))
+}
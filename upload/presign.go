@@ -0,0 +1,76 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/awsauth"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Presigner returns pre-signed GET URLs of files put in a private S3 or
+// Google Cloud Storage bucket, so edge nodes can download them without the
+// bucket being public
+type Presigner struct {
+	store  *objectStoreUploader
+	creds  awsauth.Credentials
+	expiry time.Duration
+}
+
+// NewPresigner returns a Presigner for files put with the given Uploader,
+// whose URLs are valid for the given time after they're made (at most 7
+// days)
+func NewPresigner(uploader Uploader, expiry time.Duration) (*Presigner, error) {
+	store, ok := uploader.(*objectStoreUploader)
+	if !ok {
+		return nil, fmt.Errorf("Pre-signed URLs are only supported for 's3' and 'gs' upload destinations")
+	}
+
+	if expiry < time.Second || expiry > awsauth.MaxPresignExpiry {
+		return nil, fmt.Errorf("Pre-signed URL expiry %v is not between 1s and %v", expiry, awsauth.MaxPresignExpiry)
+	}
+
+	creds, err := store.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Presigner{store: store, creds: creds, expiry: expiry}, nil
+}
+
+// Temporary returns true if the URLs are signed with temporary credentials
+// (e.g. an EC2 instance role's), which stop authorizing them when they expire
+func (p *Presigner) Temporary() bool {
+	return p.creds.SessionToken != ""
+}
+
+// URL returns a pre-signed GET URL of the file put under the given name,
+// valid for the Presigner's expiry from now
+func (p *Presigner) URL(name string) string {
+	// the expiry was checked when the Presigner was made, so signing can't fail
+	presigned, _ := awsauth.PresignV4(http.MethodGet, p.store.objectURL(name), p.creds, p.store.region, "s3", time.Now(), p.expiry)
+	return presigned
+}
+
+// WriteURLMap writes a JSON object to mapFile mapping the names of a Pkg's
+// files, as uploaded by Pkg, to pre-signed URLs of them
+func WriteURLMap(p *Presigner, mapFile string, pkgDir string, pkgFile string, pkgSigFile string) error {
+	files, err := pkgFiles(pkgDir, pkgFile, pkgSigFile)
+	if err != nil {
+		return err
+	}
+
+	urls := map[string]string{}
+	for _, f := range files {
+		urls[f.name] = p.URL(f.name)
+	}
+
+	content, err := json.MarshalIndent(urls, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the URLs grant access to the files, so the map is kept private
+	return ioutil.WriteFile(mapFile, append(content, '\n'), 0600)
+}
@@ -0,0 +1,66 @@
+package upload
+
+import (
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io"
+	"net/http"
+	"path"
+	"time"
+)
+
+// minProgressBytes is the smallest request body whose upload progress is reported
+const minProgressBytes = 1 << 20
+
+// progressTransport reports the progress of sending large request bodies
+// through the transport it wraps (see cmdtools.Progress)
+type progressTransport struct {
+	base     http.RoundTripper
+	out      io.Writer
+	interval time.Duration
+}
+
+func (t *progressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.ContentLength < minProgressBytes {
+		return t.base.RoundTrip(req)
+	}
+
+	progress := cmdtools.NewProgress(t.out, "Uploading "+path.Base(req.URL.Path), "uploaded", req.ContentLength, t.interval)
+	defer progress.Finish()
+
+	// a RoundTripper mustn't modify the request, so the body is replaced on a copy
+	tracked := req.WithContext(req.Context())
+	tracked.Body = &progressReadCloser{ReadCloser: req.Body, progress: progress}
+	return t.base.RoundTrip(tracked)
+}
+
+type progressReadCloser struct {
+	io.ReadCloser
+	progress *cmdtools.Progress
+}
+
+func (p *progressReadCloser) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.progress.Write(b[:n])
+	return n, err
+}
+
+// reportProgress has the given uploader report the progress of the files it
+// sends over HTTP to out; reporting to another writer replaces reporting to
+// the last one
+func reportProgress(uploader Uploader, out io.Writer) {
+	httpClient := httpClientOf(uploader)
+	if httpClient == nil {
+		return
+	}
+
+	if t, ok := httpClient.Transport.(*progressTransport); ok {
+		t.out = out
+		return
+	}
+
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	httpClient.Transport = &progressTransport{base: base, out: out, interval: cmdtools.ProgressInterval}
+}
@@ -0,0 +1,49 @@
+// +build unit
+
+package upload
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_reportProgress(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received += len(body)
+	}))
+	defer server.Close()
+
+	webdav := &webdavUploader{httpClient: &http.Client{}}
+	var first bytes.Buffer
+	reportProgress(webdav, &first)
+
+	// reporting elsewhere doesn't wrap the transport again
+	var out bytes.Buffer
+	reportProgress(webdav, &out)
+	transport := webdav.httpClient.Transport.(*progressTransport)
+	assert.Equal(t, &out, transport.out)
+	transport.interval = 0
+
+	resp, err := webdav.httpClient.Post(server.URL+"/pkgid/part.tgz", "application/octet-stream", bytes.NewReader(make([]byte, 2<<20)))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2<<20, received)
+
+	// small files aren't worth reporting
+	resp, err = webdav.httpClient.Post(server.URL+"/pkgid.json", "application/json", bytes.NewReader([]byte("{}")))
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, 0, first.Len())
+	assert.Contains(t, out.String(), "Uploading part.tgz: ")
+	assert.Contains(t, out.String(), "of 2.0 MiB uploaded")
+	assert.NotContains(t, out.String(), "pkgid.json")
+
+	reportProgress(&sftpUploader{}, &out)
+}
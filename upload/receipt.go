@@ -0,0 +1,134 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Receipt records the files uploaded to destinations, for audit and so that
+// uploading again skips files already uploaded unchanged
+type Receipt struct {
+	lock sync.Mutex
+
+	Objects []ReceiptObject `json:"objects"`
+}
+
+// ReceiptObject records a file uploaded
+type ReceiptObject struct {
+	// Name is the slash-separated name the file was put under
+	Name string `json:"name"`
+
+	URL        string    `json:"url"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	UploadedAt time.Time `json:"uploadedAt"`
+
+	// Status is the HTTP status the destination responded to the upload with, 0 for destinations not contacted over HTTP(S)
+	Status int `json:"status,omitempty"`
+}
+
+// LoadReceipt reads the receipt in the given file, or returns an empty
+// receipt if the file doesn't exist
+func LoadReceipt(file string) (*Receipt, error) {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return &Receipt{Objects: []ReceiptObject{}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var receipt Receipt
+	if err := json.Unmarshal(content, &receipt); err != nil {
+		return nil, fmt.Errorf("Unable to parse upload receipt %v. Error: %v", file, err)
+	}
+	if receipt.Objects == nil {
+		receipt.Objects = []ReceiptObject{}
+	}
+	return &receipt, nil
+}
+
+// Save writes the receipt to the given file, replacing it atomically
+func (r *Receipt) Save(file string) error {
+	r.lock.Lock()
+	content, err := json.MarshalIndent(r, "", "  ")
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// uploaded returns true if the receipt records a file with the given URL and content
+func (r *Receipt) uploaded(url string, size int64, sum string) bool {
+	if r == nil || url == "" {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, object := range r.Objects {
+		if object.URL == url && object.Size == size && object.SHA256 == sum {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds the object to the receipt, replacing any earlier record of its URL
+func (r *Receipt) record(object ReceiptObject) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for ix := range r.Objects {
+		if r.Objects[ix].URL == object.URL {
+			r.Objects[ix] = object
+			return
+		}
+	}
+	r.Objects = append(r.Objects, object)
+}
+
+// fileDigest returns the size and hex-encoded SHA-256 hash of the file's content
+func fileDigest(localPath string) (int64, string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
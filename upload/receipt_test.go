@@ -0,0 +1,70 @@
+// +build unit
+
+package upload
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_Receipt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-receipt-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	service := newFakeBlobService()
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	u, _ := url.Parse("azblob://acct/parts")
+	uploader, err := newAzureUploader(u, "BlobEndpoint="+server.URL+";AccountName=acct;AccountKey=c2VjcmV0")
+	assert.Nil(t, err)
+
+	pkgDir := path.Join(dir, "5aecb701")
+	assert.Nil(t, os.Mkdir(pkgDir, 0755))
+	writeFile(t, pkgDir, "e26e31a0.tgz", "fffff")
+	writeFile(t, pkgDir, "f37f42b1.tgz", "ggggg")
+	pkgFile := writeFile(t, dir, "5aecb701.json", "{}")
+	pkgSigFile := writeFile(t, dir, "5aecb701.json.sig", "sig")
+	receiptFile := path.Join(dir, "receipt.json")
+
+	receipt, err := LoadReceipt(receiptFile)
+	assert.Nil(t, err)
+	uploaded, err := Pkg(context.Background(), uploader, ioutil.Discard, pkgDir, pkgFile, pkgSigFile, 2, receipt)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), uploaded)
+	assert.Nil(t, receipt.Save(receiptFile))
+
+	receipt, err = LoadReceipt(receiptFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(receipt.Objects))
+	for _, object := range receipt.Objects {
+		assert.Equal(t, uploader.URL(object.Name), object.URL)
+		assert.Equal(t, http.StatusCreated, object.Status)
+		assert.False(t, object.UploadedAt.IsZero())
+	}
+	assert.Equal(t, "5aecb701.json.sig", receipt.Objects[3].Name)
+	assert.Equal(t, int64(3), receipt.Objects[3].Size)
+	assert.Equal(t, "a543997d84f12798350c09bdef2cdb171bf41ed3e4a5f808af2feb0c56263009", receipt.Objects[3].SHA256)
+
+	// only the changed file is uploaded again
+	writeFile(t, dir, "5aecb701.json", `{"changed":true}`)
+	service.authorizations = nil
+	uploaded, err = Pkg(context.Background(), uploader, ioutil.Discard, pkgDir, pkgFile, pkgSigFile, 2, receipt)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(16), uploaded)
+	assert.Equal(t, 1, len(service.authorizations))
+	assert.Equal(t, `{"changed":true}`, string(service.blobs["/parts/5aecb701.json"]))
+	assert.Equal(t, 4, len(receipt.Objects))
+
+	assert.Nil(t, ioutil.WriteFile(receiptFile, []byte("nope"), 0644))
+	_, err = LoadReceipt(receiptFile)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,196 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// repositoryUploader deploys files to a generic repository of a JFrog
+// Artifactory or Sonatype Nexus (raw format) repository manager with plain
+// PUT requests
+type repositoryUploader struct {
+	httpClient *http.Client
+
+	// product is the repository manager's name, for messages
+	product string
+
+	base     *url.URL
+	username string
+	password string
+
+	// apiKeyHeader is the header a password given without a username is sent in as an API key, if supported
+	apiKeyHeader string
+
+	// properties are Artifactory matrix parameters (";key=value...") set on each file deployed
+	properties string
+}
+
+// newArtifactoryUploader returns an uploader for a destination URL of the
+// form artifactory://host[:port]/[context/]repository[/path][;key=value...],
+// contacted over HTTPS ('artifactory+http' for HTTP). The matrix parameters,
+// if any, are set as properties on the deployed files. Requests are
+// authenticated with the username and password or, given only a password,
+// with it as an API key.
+func newArtifactoryUploader(u *url.URL, username string, password string) (*repositoryUploader, error) {
+	// properties are kept escaped as given
+	repoPath, properties := u.Path, ""
+	if sep := strings.Index(repoPath, ";"); sep >= 0 {
+		repoPath = repoPath[:sep]
+		escaped := u.EscapedPath()
+		properties = escaped[strings.Index(escaped, ";"):]
+	}
+
+	if u.Host == "" || strings.Trim(repoPath, "/") == "" {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 'artifactory://host[:port]/[context/]repository[/path][;key=value...]'", u)
+	}
+
+	for _, property := range strings.Split(properties, ";")[1:] {
+		if spl := strings.SplitN(property, "=", 2); len(spl) != 2 || spl[0] == "" {
+			return nil, fmt.Errorf("Unable to use property '%v' of upload destination %v, expected format 'key=value'", property, u)
+		}
+	}
+
+	r := newRepositoryUploader("Artifactory", u, repoPath, properties, username, password)
+	r.apiKeyHeader = "X-JFrog-Art-Api"
+	return r, nil
+}
+
+// newNexusUploader returns an uploader for a destination URL of the form
+// nexus://host[:port]/[context/]repository/name[/path] naming a raw hosted
+// repository, contacted over HTTPS ('nexus+http' for HTTP). Requests are
+// authenticated with the username and password (or a user token).
+func newNexusUploader(u *url.URL, username string, password string) (*repositoryUploader, error) {
+	if u.Host == "" || !strings.Contains(u.Path, "/repository/") || strings.HasSuffix(strings.TrimRight(u.Path, "/"), "/repository") {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 'nexus://host[:port]/[context/]repository/name[/path]'", u)
+	} else if strings.Contains(u.Path, ";") {
+		return nil, fmt.Errorf("Unable to use upload destination %v, Nexus raw repositories don't support properties", u)
+	}
+
+	return newRepositoryUploader("Nexus", u, u.Path, "", username, password), nil
+}
+
+func newRepositoryUploader(product string, u *url.URL, repoPath string, properties string, username string, password string) *repositoryUploader {
+	scheme := "https"
+	if strings.HasSuffix(u.Scheme, "+http") {
+		scheme = "http"
+	}
+
+	if username == "" && u.User != nil {
+		username = u.User.Username()
+	}
+
+	return &repositoryUploader{
+		httpClient: &http.Client{Timeout: 30 * time.Minute},
+		product:    product,
+		base:       &url.URL{Scheme: scheme, Host: u.Host, Path: strings.TrimRight(repoPath, "/")},
+		username:   username,
+		password:   password,
+		properties: properties,
+	}
+}
+
+func (r *repositoryUploader) URL(name string) string {
+	u := *r.base
+	u.Path = path.Join(r.base.Path, name)
+	if name == "" {
+		u.Path = r.base.Path + "/"
+	}
+	return u.String()
+}
+
+// Put deploys the file, with its checksums for the repository manager to verify
+func (r *repositoryUploader) Put(ctx context.Context, name string, localPath string) error {
+	_, err := r.putStatus(ctx, name, localPath)
+	return err
+}
+
+func (r *repositoryUploader) putStatus(ctx context.Context, name string, localPath string) (int, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sha1Hash, sha256Hash := sha1.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(sha1Hash, sha256Hash), f)
+	if err != nil {
+		return 0, err
+	}
+
+	// matrix parameters follow the path
+	deployURL := r.URL(name) + r.properties
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, deployURL, io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Checksum-Sha1", fmt.Sprintf("%x", sha1Hash.Sum(nil)))
+	req.Header.Set("X-Checksum-Sha256", fmt.Sprintf("%x", sha256Hash.Sum(nil)))
+	r.authorize(req)
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return resp.StatusCode, nil
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("%v responded with status %v to PUT of %v: %s", r.product, resp.StatusCode, r.URL(name), bytes.TrimSpace(body))
+	}
+}
+
+// Head looks the file up with a HEAD request
+func (r *repositoryUploader) Head(ctx context.Context, name string) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, r.URL(name), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	r.authorize(req)
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, true, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("%v responded with status %v to HEAD of %v", r.product, resp.StatusCode, r.URL(name))
+	}
+}
+
+// Verify checks the file's size; the repository manager verified its checksums when it was deployed
+func (r *repositoryUploader) Verify(ctx context.Context, name string, localPath string) error {
+	return verifySize(ctx, r, name, localPath)
+}
+
+// authorize adds the credentials, if any, to the request
+func (r *repositoryUploader) authorize(req *http.Request) {
+	switch {
+	case r.username != "":
+		req.SetBasicAuth(r.username, r.password)
+	case r.password != "" && r.apiKeyHeader != "":
+		req.Header.Set(r.apiKeyHeader, r.password)
+	}
+}
@@ -0,0 +1,99 @@
+// +build unit
+
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a fake repository manager recording the files deployed and the requests deploying them
+type fakeRepositoryManager struct {
+	lock     sync.Mutex
+	files    map[string]string
+	requests []*http.Request
+}
+
+func (f *fakeRepositoryManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	f.requests = append(f.requests, r)
+
+	if r.Method != http.MethodPut || r.Header.Get("X-Checksum-Sha256") != fmt.Sprintf("%x", sha256.Sum256(body)) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	username, password, _ := r.BasicAuth()
+	if r.Header.Get("X-JFrog-Art-Api") != "k3y" && (username != "timmy" || password != "s3cret") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.files[r.URL.EscapedPath()] = string(body)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func Test_Repository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-repository-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fake := &fakeRepositoryManager{files: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	host := server.URL[len("http://"):]
+
+	t.Run("Artifactory deploys with properties and an API key", func(t *testing.T) {
+		uploader, err := New("artifactory+http://"+host+"/artifactory/generic-local/hzn;release=1.2;team=edge%20ops", Credentials{Password: "k3y"}, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, server.URL+"/artifactory/generic-local/hzn", BaseURL(uploader))
+
+		assert.Nil(t, uploader.Put(context.Background(), "5aecb701/e26e31a0.tgz", writeFile(t, dir, "e26e31a0.tgz", "fffff")))
+		assert.Equal(t, "fffff", fake.files["/artifactory/generic-local/hzn/5aecb701/e26e31a0.tgz;release=1.2;team=edge%20ops"])
+		assert.NotEqual(t, "", fake.requests[0].Header.Get("X-Checksum-Sha1"))
+
+		uploader, err = New("artifactory://artifacts.example.com/artifactory/generic-local", Credentials{}, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, "https://artifacts.example.com/artifactory/generic-local/a.tgz", uploader.URL("a.tgz"))
+
+		_, err = New("artifactory://artifacts.example.com/generic-local;release", Credentials{}, 0)
+		assert.NotNil(t, err)
+		_, err = New("artifactory://artifacts.example.com", Credentials{}, 0)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Nexus deploys to raw repositories with a user", func(t *testing.T) {
+		uploader, err := New("nexus+http://timmy@"+host+"/repository/raw-hosted/hzn/", Credentials{Password: "s3cret"}, 0)
+		assert.Nil(t, err)
+
+		assert.Nil(t, uploader.Put(context.Background(), "5aecb701.json", writeFile(t, dir, "5aecb701.json", "{}")))
+		assert.Equal(t, "{}", fake.files["/repository/raw-hosted/hzn/5aecb701.json"])
+		assert.Equal(t, server.URL+"/repository/raw-hosted/hzn/5aecb701.json", uploader.URL("5aecb701.json"))
+
+		uploader, err = New("nexus+http://"+host+"/repository/raw-hosted", Credentials{Password: "k3y"}, 0)
+		assert.Nil(t, err)
+		err = uploader.Put(context.Background(), "a.tgz", writeFile(t, dir, "a.tgz", "ggggg"))
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "Nexus responded with status 401"), err.Error())
+
+		_, err = New("nexus://nexus.example.com/raw-hosted", Credentials{}, 0)
+		assert.NotNil(t, err)
+		_, err = New("nexus://nexus.example.com/repository/", Credentials{}, 0)
+		assert.NotNil(t, err)
+		_, err = New("nexus://nexus.example.com/repository/raw-hosted;release=1.2", Credentials{}, 0)
+		assert.NotNil(t, err)
+	})
+}
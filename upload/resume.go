@@ -0,0 +1,99 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// resumeStateLifetime is how long the state of an unfinished upload is kept;
+// object stores discard uncommitted blocks after about a week
+const resumeStateLifetime = 7 * 24 * time.Hour
+
+// resumeStore persists the progress of uploads of large files in a state
+// directory, so that an upload that failed continues where it stopped the
+// next time the same file is uploaded to the same URL, even by another run of
+// the tool. A nil resumeStore persists nothing.
+type resumeStore struct {
+	dir string
+}
+
+// newResumeStore returns a store in the user's cache directory
+// ($XDG_CACHE_HOME or ~/.cache), or nil if there is none. State of uploads
+// older than resumeStateLifetime is removed.
+func newResumeStore() *resumeStore {
+	cacheDir := os.Getenv("XDG_CACHE_HOME")
+	if cacheDir == "" {
+		if home := os.Getenv("HOME"); home != "" {
+			cacheDir = path.Join(home, ".cache")
+		}
+	}
+	if cacheDir == "" {
+		return nil
+	}
+
+	store := &resumeStore{dir: path.Join(cacheDir, "horizon-pkg-build", "uploads")}
+
+	if files, err := ioutil.ReadDir(store.dir); err == nil {
+		for _, f := range files {
+			if time.Since(f.ModTime()) > resumeStateLifetime {
+				os.Remove(path.Join(store.dir, f.Name()))
+			}
+		}
+	}
+
+	return store
+}
+
+// key identifies an upload of the local file to the given URL; the file's
+// size and modification time stand in for its content
+func (r *resumeStore) key(targetURL string, info os.FileInfo) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%d", targetURL, info.Size(), info.ModTime().UnixNano()))))
+}
+
+// load reads the state saved under the given key into state, returning false if there's none
+func (r *resumeStore) load(key string, state interface{}) bool {
+	if r == nil {
+		return false
+	}
+
+	content, err := ioutil.ReadFile(path.Join(r.dir, key+".json"))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(content, state) == nil
+}
+
+// save writes the state under the given key; failing to persist state only
+// means an interrupted upload can't be resumed, so errors are ignored
+func (r *resumeStore) save(key string, state interface{}) {
+	if r == nil {
+		return
+	}
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return
+	}
+
+	tmpFile := path.Join(r.dir, key+".json.tmp")
+	if err := ioutil.WriteFile(tmpFile, content, 0600); err == nil {
+		os.Rename(tmpFile, path.Join(r.dir, key+".json"))
+	}
+}
+
+// remove discards the state saved under the given key once the upload is finished or can't be resumed
+func (r *resumeStore) remove(key string) {
+	if r == nil {
+		return
+	}
+	os.Remove(path.Join(r.dir, key+".json"))
+}
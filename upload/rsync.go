@@ -0,0 +1,75 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Publisher syncs an output directory of Pkgs to a remote target with
+// rsync. Files on the target that aren't in the output directory are never
+// deleted, so Pkgs published before stay available.
+type Publisher struct {
+	destination string
+	bwlimit     int64
+}
+
+// NewPublisher returns a Publisher for an rsync destination like
+// "[user@]host:path", "rsync://host/module/path", or a local path. If bwlimit
+// is positive, files are sent at no more than that many bytes per second.
+func NewPublisher(destination string, bwlimit int64) (*Publisher, error) {
+	if destination == "" || strings.HasPrefix(destination, "-") {
+		return nil, fmt.Errorf("Unable to use publish destination '%v'", destination)
+	}
+
+	if _, err := exec.LookPath("rsync"); err != nil {
+		return nil, fmt.Errorf("rsync is required to publish Pkgs. Error: %v", err)
+	}
+
+	return &Publisher{destination: destination, bwlimit: bwlimit}, nil
+}
+
+// Publish syncs the output directory to the destination in two passes: the
+// parts first, then the Pkg metadata and signature files, so published
+// metadata never refers to parts that aren't there yet. Temporary
+// directories of builds in progress or failed are skipped. Once ctx is done,
+// rsync is killed.
+func (p *Publisher) Publish(ctx context.Context, outputDir string, out io.Writer) error {
+	source := strings.TrimRight(outputDir, "/") + "/"
+
+	// no --delete: the target may hold Pkgs this output directory doesn't anymore; links between
+	// identical parts of different Pkgs are kept so their content is only sent once
+	args := []string{"--recursive", "--times", "--links", "--hard-links", "--chmod=D755,F644", "--delay-updates", "--exclude=/build-hznpkg-*"}
+	if p.bwlimit > 0 {
+		// rsync's limit is in KiB per second
+		kibs := p.bwlimit / 1024
+		if kibs < 1 {
+			kibs = 1
+		}
+		args = append(args, fmt.Sprintf("--bwlimit=%d", kibs))
+	}
+
+	passes := [][]string{
+		append(append([]string{}, args...), "--exclude=*.json", "--exclude=*.json.sig"),
+		args,
+	}
+
+	for _, pass := range passes {
+		cmd := exec.CommandContext(ctx, "rsync", append(pass, "--", source, p.destination)...)
+
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("rsync failed: %v. Output: %s", err, bytes.TrimSpace(output.Bytes()))
+		}
+	}
+
+	cmdtools.LoggerFor(out).WithContext(ctx).Subsystem(cmdtools.SubsystemUpload).Infof("Published %v to %v", outputDir, p.destination)
+	return nil
+}
@@ -0,0 +1,56 @@
+// +build unit
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// a fake rsync that records its arguments and fails for one destination
+const fakeRsync = `#!/bin/sh
+echo "$@" >> "$RSYNC_LOG"
+for last; do true; done
+[ "$last" != "unreachable:/srv" ] || { echo "connection refused" >&2; exit 12; }
+`
+
+func Test_Publisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-rsync-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "rsync"), []byte(fakeRsync), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("RSYNC_LOG", path.Join(dir, "log"))
+
+	_, err = NewPublisher("--delete", 0)
+	assert.NotNil(t, err)
+
+	publisher, err := NewPublisher("timmy@files.example.com:/srv/www/hzn", 0)
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	assert.Nil(t, publisher.Publish(context.Background(), "/tmp/out", &out))
+	assert.Contains(t, out.String(), "Published /tmp/out to timmy@files.example.com:/srv/www/hzn")
+
+	log, err := ioutil.ReadFile(path.Join(dir, "log"))
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	assert.Equal(t, []string{
+		"--recursive --times --links --hard-links --chmod=D755,F644 --delay-updates --exclude=/build-hznpkg-* --exclude=*.json --exclude=*.json.sig -- /tmp/out/ timmy@files.example.com:/srv/www/hzn",
+		"--recursive --times --links --hard-links --chmod=D755,F644 --delay-updates --exclude=/build-hznpkg-* -- /tmp/out/ timmy@files.example.com:/srv/www/hzn",
+	}, lines)
+
+	publisher, err = NewPublisher("unreachable:/srv", 2<<20)
+	assert.Nil(t, err)
+	err = publisher.Publish(context.Background(), "/tmp/out", &out)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+}
@@ -0,0 +1,148 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sftpUploader puts files on a host over SSH by running the sftp client in
+// batch mode, authenticating with an identity (private key) file or the
+// user's ssh configuration and agent. Files are made world-readable so a
+// web server on the host can serve them.
+type sftpUploader struct {
+	sftpArgs []string
+	host     string
+	dir      string
+
+	// remote directories already created
+	lock    sync.Mutex
+	created map[string]bool
+}
+
+// newSFTPUploader returns an uploader for a destination URL of the form
+// sftp://[user@]host[:port]/path, authenticating with the given identity
+// file if it isn't empty
+func newSFTPUploader(u *url.URL, identity string) (*sftpUploader, error) {
+	if u.Hostname() == "" || u.Path == "" || u.Path == "/" {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 'sftp://[user@]host[:port]/path'", u)
+	}
+
+	if _, err := exec.LookPath("sftp"); err != nil {
+		return nil, fmt.Errorf("An sftp client is required for sftp upload destinations. Error: %v", err)
+	}
+
+	// batch mode fails rather than prompting for passwords or host key confirmation
+	args := []string{"-b", "-", "-o", "BatchMode=yes", "-o", "ConnectTimeout=30"}
+	if identity != "" {
+		args = append(args, "-i", identity)
+	}
+	if u.Port() != "" {
+		args = append(args, "-P", u.Port())
+	}
+
+	host := u.Hostname()
+	if u.User != nil {
+		host = fmt.Sprintf("%s@%s", u.User.Username(), host)
+	}
+
+	return &sftpUploader{
+		sftpArgs: args,
+		host:     host,
+		dir:      path.Clean(u.Path),
+		created:  map[string]bool{},
+	}, nil
+}
+
+func (s *sftpUploader) URL(name string) string {
+	return fmt.Sprintf("sftp://%s%s", s.host, path.Join(s.dir, name))
+}
+
+// Put creates the file's remote directory if necessary and copies it there
+func (s *sftpUploader) Put(ctx context.Context, name string, localPath string) error {
+	remotePath := path.Join(s.dir, name)
+
+	var batch bytes.Buffer
+
+	// mkdir fails for directories that exist, and chmod for those that aren't
+	// ours; a '-' prefix has sftp ignore that. Concurrent uploads may both
+	// create a directory, which is harmless.
+	s.lock.Lock()
+	dirs := []string{}
+	for dir := path.Dir(remotePath); dir != "/" && dir != "." && !s.created[dir]; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	s.lock.Unlock()
+
+	for _, dir := range dirs {
+		fmt.Fprintf(&batch, "-mkdir %s\n", quoteSFTP(dir))
+
+		// only directories within the destination are ours to make readable
+		if strings.HasPrefix(dir, s.dir+"/") {
+			fmt.Fprintf(&batch, "-chmod 755 %s\n", quoteSFTP(dir))
+		}
+	}
+
+	fmt.Fprintf(&batch, "put %s %s\n", quoteSFTP(localPath), quoteSFTP(remotePath))
+	fmt.Fprintf(&batch, "chmod 644 %s\n", quoteSFTP(remotePath))
+
+	cmd := exec.CommandContext(ctx, "sftp", append(append([]string{}, s.sftpArgs...), "--", s.host)...)
+	cmd.Stdin = &batch
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sftp failed: %v. Output: %s", err, bytes.TrimSpace(out))
+	}
+
+	// the directories are only known to exist once the batch succeeds
+	s.lock.Lock()
+	for _, dir := range dirs {
+		s.created[dir] = true
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+// Head lists the remote file with 'ls -l' for its size
+func (s *sftpUploader) Head(ctx context.Context, name string) (int64, bool, error) {
+	remotePath := path.Join(s.dir, name)
+
+	cmd := exec.CommandContext(ctx, "sftp", append(append([]string{}, s.sftpArgs...), "--", s.host)...)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("ls -l %s\n", quoteSFTP(remotePath)))
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil && strings.Contains(stderr.String(), "not found") {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("sftp failed: %v. Output: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	// the listing follows the echoed command, e.g. "-rw-r--r--  1 user group  1024 Jan  1 00:00 /path"
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "-") {
+			continue
+		}
+		if size, err := strconv.ParseInt(fields[4], 10, 64); err == nil {
+			return size, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("Unable to read the size of %v from sftp's listing: %s", remotePath, bytes.TrimSpace(out))
+}
+
+func (s *sftpUploader) Verify(ctx context.Context, name string, localPath string) error {
+	return verifySize(ctx, s, name, localPath)
+}
+
+// quoteSFTP quotes a path for an sftp batch file
+func quoteSFTP(p string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(p) + `"`
+}
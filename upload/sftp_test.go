@@ -0,0 +1,94 @@
+// +build unit
+
+package upload
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// a fake sftp that records its arguments and batch commands
+const fakeSFTP = `#!/bin/sh
+echo "$@" >> "$SFTP_LOG"
+cat >> "$SFTP_LOG"
+`
+
+// a fake sftp that lists one file, as sftp echoes batch commands and lists files
+const fakeSFTPListing = `#!/bin/sh
+batch=$(cat)
+case "$batch" in
+*missing*) echo "File \"/srv/www/hzn/missing.tgz\" not found." >&2; exit 1;;
+*) echo "sftp> $batch"; echo "-rw-r--r--    1 timmy    timmy           5 Jan  1 00:00 /srv/www/hzn/a.tgz";;
+esac
+`
+
+func Test_SFTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-sftp-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "sftp"), []byte(fakeSFTP), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("SFTP_LOG", path.Join(dir, "log"))
+
+	for _, destination := range []string{"sftp://files.example.com", "sftp://files.example.com/", "sftp:///srv/www"} {
+		u, _ := url.Parse(destination)
+		_, err := newSFTPUploader(u, "")
+		assert.NotNil(t, err, destination)
+	}
+
+	uploader, err := New("sftp://timmy@files.example.com:2222/srv/www/hzn/", Credentials{SSHIdentity: "/keys/id_ed25519"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "", BaseURL(uploader))
+	assert.Equal(t, "sftp://timmy@files.example.com/srv/www/hzn/pkg/a.tgz", uploader.URL("pkg/a.tgz"))
+
+	assert.Nil(t, uploader.Put(context.Background(), "5aecb701/a.tgz", "/tmp/build/a.tgz"))
+	assert.Nil(t, uploader.Put(context.Background(), "5aecb701/b \"x\".tgz", "/tmp/build/b.tgz"))
+
+	log, err := ioutil.ReadFile(path.Join(dir, "log"))
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	assert.Equal(t, []string{
+		"-b - -o BatchMode=yes -o ConnectTimeout=30 -i /keys/id_ed25519 -P 2222 -- timmy@files.example.com",
+		`-mkdir "/srv"`,
+		`-mkdir "/srv/www"`,
+		`-mkdir "/srv/www/hzn"`,
+		`-mkdir "/srv/www/hzn/5aecb701"`,
+		`-chmod 755 "/srv/www/hzn/5aecb701"`,
+		`put "/tmp/build/a.tgz" "/srv/www/hzn/5aecb701/a.tgz"`,
+		`chmod 644 "/srv/www/hzn/5aecb701/a.tgz"`,
+		"-b - -o BatchMode=yes -o ConnectTimeout=30 -i /keys/id_ed25519 -P 2222 -- timmy@files.example.com",
+		`put "/tmp/build/b.tgz" "/srv/www/hzn/5aecb701/b \"x\".tgz"`,
+		`chmod 644 "/srv/www/hzn/5aecb701/b \"x\".tgz"`,
+	}, lines)
+
+	// the directories of a failed upload are made again by the next
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "sftp"), []byte("#!/bin/sh\nexit 1\n"), 0755))
+	assert.NotNil(t, uploader.Put(context.Background(), "6bfdc812/a.tgz", "/tmp/build/a.tgz"))
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "sftp"), []byte(fakeSFTP), 0755))
+	assert.Nil(t, os.Remove(path.Join(dir, "log")))
+	assert.Nil(t, uploader.Put(context.Background(), "6bfdc812/a.tgz", "/tmp/build/a.tgz"))
+
+	log, err = ioutil.ReadFile(path.Join(dir, "log"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(log), `-mkdir "/srv/www/hzn/6bfdc812"`)
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "sftp"), []byte(fakeSFTPListing), 0755))
+
+	size, exists, err := uploader.Head(context.Background(), "a.tgz")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, int64(5), size)
+
+	_, exists, err = uploader.Head(context.Background(), "missing.tgz")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
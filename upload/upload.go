@@ -0,0 +1,299 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Uploader publishes files to a location edge nodes can download them from.
+// Backends other than those built in implement it and are added with
+// Register. Its requests are abandoned once the given context is done.
+type Uploader interface {
+	// Put writes the content of the local file to the destination under the given slash-separated name
+	Put(ctx context.Context, name string, localPath string) error
+
+	// Head returns the size of the file put under the given name, and false
+	// if the destination has no such file
+	Head(ctx context.Context, name string) (int64, bool, error)
+
+	// Verify checks that the file put under the given name has the content
+	// of the local file, as far as the destination can tell without
+	// downloading it (e.g. by its size)
+	Verify(ctx context.Context, name string, localPath string) error
+
+	// URL returns the URL a file put under the given name can be downloaded from
+	URL(name string) string
+}
+
+// Credentials holds the credentials for upload backends that don't read them from the environment
+type Credentials struct {
+	// SSHIdentity is the private key file to authenticate to SFTP hosts with, if not the user's default
+	SSHIdentity string
+
+	// Username and Password authenticate to WebDAV and HTTP servers, IPFS daemons' RPC APIs, OCI registries, and
+	// repository managers, where the username may instead be given in the destination URL; a Password alone is an
+	// Artifactory API key. They're the access key ID and secret for S3 and Google Cloud Storage.
+	Username string
+	Password string
+}
+
+// New returns an Uploader for the given destination URL. The scheme selects
+// the backend; those built in are:
+//
+//	s3://bucket[/prefix][?endpoint=url]      Amazon S3, or an S3-compatible store such as MinIO
+//	gs://bucket[/prefix]                     Google Cloud Storage, with an HMAC key
+//	azblob://account/container[/prefix]      Azure Blob Storage
+//	sftp://[user@]host[:port]/path           A host's filesystem over SSH
+//	davs://[user@]host[:port]/path           A WebDAV collection over HTTPS ('dav' for HTTP)
+//	https://[user@]host[:port]/path          An HTTPS server taking PUT requests ('http' for HTTP)
+//	ipfs://[host[:port]][?pin-service=name]  IPFS, with a running daemon's RPC API (experimental)
+//	oci://host[:port]/repository             An OCI registry repository, as ORAS artifacts ('oci+http' for HTTP)
+//	artifactory://host[:port]/repo[/path]    A JFrog Artifactory generic repository ('artifactory+http' for HTTP)
+//	nexus://host[:port]/repository/name      A Sonatype Nexus raw repository ('nexus+http' for HTTP)
+//
+// Others are added with Register. Credentials are taken from the given
+// Credentials or read from the environment as described by each backend. If
+// bwlimit is positive, files are sent at no more than that many bytes per
+// second in total.
+func New(destination string, credentials Credentials, bwlimit int64) (Uploader, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse upload destination %v. Error: %v", destination, err)
+	}
+
+	backend, err := backendFor(u)
+	if err != nil {
+		return nil, err
+	}
+
+	uploader, err := backend.New(u, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	limitBandwidth(uploader, newBandwidthLimiter(bwlimit))
+	return uploader, nil
+}
+
+// verifySize checks that the file put with the uploader under the given name
+// has the size of the local file, for Uploaders whose destinations tell no
+// more of the files put than their size
+func verifySize(ctx context.Context, uploader Uploader, name string, localPath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	size, exists, err := uploader.Head(ctx, name)
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("%v is missing from the upload destination", name)
+	} else if size != info.Size() {
+		return fmt.Errorf("%v has size %v at the upload destination, expected %v", name, size, info.Size())
+	}
+	return nil
+}
+
+// ContentAddressed returns true if the URLs of files put with the given
+// Uploader are derived from their content (e.g. IPFS content identifiers or
+// OCI registry blob digests), so they're known only once the files are put.
+// Such an Uploader must put parts as they're created for their URLs to be
+// recorded in the Pkg metadata.
+func ContentAddressed(uploader Uploader) bool {
+	c, ok := uploader.(interface {
+		contentAddressed() bool
+	})
+	return ok && c.contentAddressed()
+}
+
+// BaseURL returns the URL prefixing the URLs of files put with the given
+// Uploader, or "" if they aren't served over HTTP(S) (e.g. uploads to SFTP
+// hosts, whose web servers' URLs aren't known)
+func BaseURL(uploader Uploader) string {
+	base := strings.TrimRight(uploader.URL(""), "/")
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		return ""
+	}
+	return base
+}
+
+// pkgUploadFile is a file of a Pkg and the name it's uploaded under
+type pkgUploadFile struct {
+	name      string
+	localPath string
+}
+
+// pkgFiles lists the files of a Pkg as written by a create.Builder in the order
+// they're uploaded: the parts in pkgDir under the directory's name (the Pkg
+// ID), then the Pkg metadata and signature files, then any checksum files
+// (see create.WriteChecksums) covering them
+func pkgFiles(pkgDir string, pkgFile string, pkgSigFile string) ([]pkgUploadFile, error) {
+	files, err := ioutil.ReadDir(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgID := path.Base(pkgDir)
+	uploads, checksums := []pkgUploadFile{}, []pkgUploadFile{}
+	for _, f := range files {
+		// parts may be symbolic links to identical parts of other Pkgs, which are uploaded like any other
+		if info, err := os.Stat(path.Join(pkgDir, f.Name())); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		upload := pkgUploadFile{name: path.Join(pkgID, f.Name()), localPath: path.Join(pkgDir, f.Name())}
+		if cmdtools.IsChecksumFile(f.Name()) {
+			checksums = append(checksums, upload)
+		} else {
+			uploads = append(uploads, upload)
+		}
+	}
+
+	for _, file := range []string{pkgFile, pkgSigFile} {
+		uploads = append(uploads, pkgUploadFile{name: path.Base(file), localPath: file})
+
+		if _, err := os.Stat(file + cmdtools.ChecksumSidecarExt); err == nil {
+			checksums = append(checksums, pkgUploadFile{name: path.Base(file) + cmdtools.ChecksumSidecarExt, localPath: file + cmdtools.ChecksumSidecarExt})
+		}
+	}
+
+	return append(uploads, checksums...), nil
+}
+
+// Pkg uploads a Pkg as written by a create.Builder: the parts in pkgDir under
+// the directory's name (the Pkg ID), up to parallelism of them at once (at
+// least one), then the Pkg metadata and signature files, then any checksum
+// files. The metadata is put after the parts so it never refers to missing
+// parts. If a receipt is given, files it
+// records as uploaded to the same URL with the same content are skipped and
+// the files uploaded are recorded in it. The progress of large files sent
+// over HTTP is reported to out. It returns the number of bytes uploaded, not
+// counting skipped files. Once ctx is done, no more files are put and those
+// being put are abandoned.
+func Pkg(ctx context.Context, uploader Uploader, out io.Writer, pkgDir string, pkgFile string, pkgSigFile string, parallelism int, receipt *Receipt) (int64, error) {
+	return uploadPkg(ctx, uploader, out, pkgDir, pkgFile, pkgSigFile, parallelism, receipt, nil)
+}
+
+// uploadPkg uploads a Pkg as Pkg does, skipping the parts already uploaded,
+// whose names are in the given set
+func uploadPkg(ctx context.Context, uploader Uploader, out io.Writer, pkgDir string, pkgFile string, pkgSigFile string, parallelism int, receipt *Receipt, uploaded map[string]bool) (int64, error) {
+	files, err := pkgFiles(pkgDir, pkgFile, pkgSigFile)
+	if err != nil {
+		return 0, err
+	}
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	reportProgress(uploader, out)
+
+	// the metadata and signature files follow the parts
+	split := 0
+	for split < len(files) && files[split].localPath != pkgFile {
+		split++
+	}
+	parts, metadata := files[:split], files[split:]
+
+	var sent int64
+	slots := make(chan struct{}, parallelism)
+	errs := make(chan error, len(parts))
+	var group sync.WaitGroup
+	for _, f := range parts {
+		if uploaded[f.name] {
+			continue
+		}
+
+		group.Add(1)
+		go func(f pkgUploadFile) {
+			defer group.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			n, err := put(ctx, uploader, out, f.name, f.localPath, receipt)
+			atomic.AddInt64(&sent, n)
+			errs <- err
+		}(f)
+	}
+
+	group.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	for _, f := range metadata {
+		n, err := put(ctx, uploader, out, f.name, f.localPath, receipt)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
+// statusUploader is implemented by Uploaders contacting destinations over
+// HTTP(S) to report the status the destination responded to a put with
+type statusUploader interface {
+	putStatus(ctx context.Context, name string, localPath string) (int, error)
+}
+
+// put uploads a file, unless the receipt records it as uploaded or ctx is done, returning its size if uploaded
+func put(ctx context.Context, uploader Uploader, out io.Writer, name string, localPath string, receipt *Receipt) (int64, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	var size int64
+	var sum string
+	if receipt != nil {
+		var err error
+		size, sum, err = fileDigest(localPath)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to upload %v. Error: %v", localPath, err)
+		}
+
+		if receipt.uploaded(uploader.URL(name), size, sum) {
+			cmdtools.LoggerFor(out).WithContext(ctx).Subsystem(cmdtools.SubsystemUpload).Infof("Skipped uploading %v, already uploaded to %v", localPath, uploader.URL(name))
+			return 0, nil
+		}
+	} else {
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to upload %v. Error: %v", localPath, err)
+		}
+		size = info.Size()
+	}
+
+	cmdtools.LoggerFor(out).WithContext(ctx).Subsystem(cmdtools.SubsystemUpload).Debugf("Uploading %v to %v", localPath, uploader.URL(name))
+	var status int
+	var err error
+	if s, ok := uploader.(statusUploader); ok {
+		status, err = s.putStatus(ctx, name, localPath)
+	} else {
+		err = uploader.Put(ctx, name, localPath)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Unable to upload %v. Error: %v", localPath, err)
+	}
+
+	receipt.record(ReceiptObject{Name: name, URL: uploader.URL(name), Size: size, SHA256: sum, UploadedAt: time.Now().UTC(), Status: status})
+
+	cmdtools.LoggerFor(out).WithContext(ctx).Subsystem(cmdtools.SubsystemUpload).Infof("Uploaded %v to %v", localPath, uploader.URL(name))
+	return size, nil
+}
@@ -0,0 +1,324 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the size of the range of a part downloaded to spot-check its content
+const spotCheckBytes = 64 << 10
+
+// verifyFile is an uploaded file of a Pkg and the URL it should be downloadable from
+type verifyFile struct {
+	pkgUploadFile
+	url string
+}
+
+// Verify checks that an uploaded Pkg's files can be downloaded: each part
+// from the URL recorded in the Pkg metadata, with a HEAD request whose
+// Content-Length must match the part's size and, if spotCheck is set, a
+// ranged GET of a random part of it whose hash must match the local file's;
+// and the metadata and signature files, with a GET whose content must match
+// the local files, from beside the parts' directory. If fileURL is given, it
+// returns the URLs to check instead (e.g. pre-signed URLs). Files whose URLs
+// aren't HTTP(S) URLs are checked by the given Uploader (see Uploader.Verify)
+// if they're its URLs, and otherwise can't be checked and are skipped with a
+// warning, as are spot checks of servers that don't support range requests,
+// unless strict is set, in which case they fail the verification.
+// Requests are sent with the given Uploader's transport, if it has its own
+// (e.g. trusting a CA bundle), so the destination is reached as when uploading.
+// Once ctx is done, the verification is abandoned.
+func Verify(ctx context.Context, uploader Uploader, out io.Writer, pkgDir string, pkgFile string, pkgSigFile string, fileURL func(name string) string, spotCheck bool, strict bool) error {
+	files, err := verifyFiles(pkgDir, pkgFile, pkgSigFile, fileURL)
+	if err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{Timeout: 5 * time.Minute, Transport: transportOf(uploader)}
+	for _, f := range files {
+		var unverifiable string
+		if f.url == "" {
+			unverifiable = "its URL isn't known"
+		} else if !strings.HasPrefix(f.url, "http://") && !strings.HasPrefix(f.url, "https://") {
+			// the destination itself may tell whether the file was put, e.g. over SFTP
+			if uploader != nil && uploader.URL(f.name) == f.url {
+				if err := uploader.Verify(ctx, f.name, f.localPath); err != nil {
+					return fmt.Errorf("Unable to verify upload of %v. Error: %v", f.localPath, err)
+				}
+				cmdtools.LoggerFor(out).WithContext(ctx).Subsystem(cmdtools.SubsystemUpload).Infof("Verified upload of %v", f.localPath)
+				continue
+			}
+			unverifiable = fmt.Sprintf("its URL isn't an HTTP(S) URL: %v", f.url)
+		}
+		if unverifiable != "" && strict {
+			return fmt.Errorf("Unable to verify upload of %v, %v", f.localPath, unverifiable)
+		} else if unverifiable != "" {
+			cmdtools.LoggerFor(out).WithContext(ctx).Subsystem(cmdtools.SubsystemUpload).Warnf("Unable to verify upload of %v, %v", f.localPath, unverifiable)
+			continue
+		}
+
+		if strings.HasPrefix(f.name, path.Base(pkgDir)+"/") {
+			err = verifyPart(ctx, httpClient, out, f, spotCheck, strict)
+		} else {
+			err = verifyContent(ctx, httpClient, f)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to verify upload of %v. Error: %v", f.localPath, err)
+		}
+
+		cmdtools.LoggerFor(out).WithContext(ctx).Subsystem(cmdtools.SubsystemUpload).Infof("Verified upload of %v", f.localPath)
+	}
+
+	return nil
+}
+
+// transportOf returns the http.RoundTripper the uploader sends requests with
+// if it has its own, or nil for the default transport
+func transportOf(uploader Uploader) http.RoundTripper {
+	switch u := uploader.(type) {
+	case *objectStoreUploader:
+		return u.httpClient.Transport
+	default:
+		return nil
+	}
+}
+
+// verifyFiles pairs the Pkg's files with the URLs they should be downloadable from
+func verifyFiles(pkgDir string, pkgFile string, pkgSigFile string, fileURL func(name string) string) ([]verifyFile, error) {
+	uploads, err := pkgFiles(pkgDir, pkgFile, pkgSigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	recorded, err := recordedPartURLs(pkgDir, pkgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// the metadata is uploaded beside the parts' directory, so its URL shares their base
+	var base string
+	for name, u := range recorded {
+		if strings.HasSuffix(u, "/"+name) {
+			base = strings.TrimSuffix(u, "/"+name)
+			break
+		}
+	}
+
+	files := []verifyFile{}
+	for _, upload := range uploads {
+		f := verifyFile{pkgUploadFile: upload}
+
+		if fileURL != nil {
+			f.url = fileURL(upload.name)
+		} else if u, exists := recorded[upload.name]; exists {
+			f.url = u
+		} else if upload.localPath == pkgFile || upload.localPath == pkgSigFile || cmdtools.IsChecksumFile(upload.name) {
+			f.url = base + "/" + upload.name
+			if base == "" {
+				f.url = ""
+			}
+		} else {
+			return nil, fmt.Errorf("Part file %v isn't recorded in Pkg metadata %v", upload.localPath, pkgFile)
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// recordedPartURLs reads the Pkg metadata and returns the first source URL of
+// each part, keyed by the name the part's file is uploaded under
+func recordedPartURLs(pkgDir string, pkgFile string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(pkgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkg map[string]interface{}
+	if err := json.Unmarshal(content, &pkg); err != nil {
+		return nil, fmt.Errorf("Unable to parse Pkg metadata %v. Error: %v", pkgFile, err)
+	}
+
+	var parts []interface{}
+	switch p := pkg["parts"].(type) {
+	case []interface{}:
+		parts = p
+	case map[string]interface{}:
+		for _, part := range p {
+			parts = append(parts, part)
+		}
+	default:
+		return nil, fmt.Errorf("Unexpected parts content in Pkg metadata %v", pkgFile)
+	}
+
+	// parts are in the directory named for the Pkg ID, in files named for the part ID
+	pkgID := path.Base(pkgDir)
+	urls := map[string]string{}
+	for _, p := range parts {
+		part, _ := p.(map[string]interface{})
+		id, _ := part["id"].(string)
+		sources, _ := part["sources"].([]interface{})
+		if id == "" || len(sources) == 0 {
+			return nil, fmt.Errorf("Part without ID or sources in Pkg metadata %v", pkgFile)
+		}
+
+		source, _ := sources[0].(map[string]interface{})
+		u, _ := source["url"].(string)
+
+		// the URL may be content-addressed or pre-signed, so the file name is matched by part ID
+		matches, err := filepath.Glob(path.Join(pkgDir, id+".*"))
+		if err == nil {
+			matches = withoutChecksumFiles(matches)
+		}
+		if err != nil || len(matches) != 1 {
+			return nil, fmt.Errorf("Unable to find the file of part %v of Pkg metadata %v", id, pkgFile)
+		}
+
+		urls[path.Join(pkgID, path.Base(matches[0]))] = u
+	}
+
+	return urls, nil
+}
+
+func verifyPart(ctx context.Context, httpClient *http.Client, out io.Writer, f verifyFile, spotCheck bool, strict bool) error {
+	info, err := os.Stat(f.localPath)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, f.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v responded with status %v", redactURL(f.url), resp.StatusCode)
+	} else if resp.ContentLength != info.Size() {
+		return fmt.Errorf("%v has %v bytes, expected %v", redactURL(f.url), resp.ContentLength, info.Size())
+	}
+
+	if !spotCheck || info.Size() == 0 {
+		return nil
+	}
+
+	length := int64(spotCheckBytes)
+	if length > info.Size() {
+		length = info.Size()
+	}
+	offset := rand.Int63n(info.Size() - length + 1)
+
+	local, err := os.Open(f.localPath)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	expected := sha256.New()
+	if _, err := io.Copy(expected, io.NewSectionReader(local, offset, length)); err != nil {
+		return err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+length-1, 10))
+
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && strict {
+		return fmt.Errorf("%v doesn't support range requests, so its content can't be spot-checked", redactURL(f.url))
+	} else if resp.StatusCode == http.StatusOK {
+		cmdtools.LoggerFor(out).WithContext(ctx).Subsystem(cmdtools.SubsystemUpload).Warnf("Unable to spot-check content of %v, the server doesn't support range requests", f.localPath)
+		return nil
+	} else if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%v responded with status %v to range request", redactURL(f.url), resp.StatusCode)
+	}
+
+	actual := sha256.New()
+	if _, err := io.Copy(actual, io.LimitReader(resp.Body, length+1)); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(actual.Sum(nil), expected.Sum(nil)) {
+		return fmt.Errorf("Content of %v at bytes %v-%v doesn't match the local file", redactURL(f.url), offset, offset+length-1)
+	}
+	return nil
+}
+
+// verifyContent downloads the file and compares it with the local file
+func verifyContent(ctx context.Context, httpClient *http.Client, f verifyFile) error {
+	expected, err := ioutil.ReadFile(f.localPath)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v responded with status %v", redactURL(f.url), resp.StatusCode)
+	}
+
+	actual, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(len(expected))+1))
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(actual, expected) {
+		return fmt.Errorf("Content of %v doesn't match the local file", redactURL(f.url))
+	}
+	return nil
+}
+
+// redactURL drops the query of a URL, which may carry a pre-signed URL's signature, for error messages
+func redactURL(u string) string {
+	if i := strings.Index(u, "?"); i >= 0 {
+		return u[:i] + "?..."
+	}
+	return u
+}
+
+// withoutChecksumFiles returns the files that aren't checksum files
+func withoutChecksumFiles(files []string) []string {
+	content := []string{}
+	for _, file := range files {
+		if !cmdtools.IsChecksumFile(file) {
+			content = append(content, file)
+		}
+	}
+	return content
+}
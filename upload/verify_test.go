@@ -0,0 +1,93 @@
+// +build unit
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_Verify(t *testing.T) {
+	local, err := ioutil.TempDir("", "upload-verify-local-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(local)
+
+	served, err := ioutil.TempDir("", "upload-verify-served-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(served)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(served)))
+	defer server.Close()
+
+	partID := strings.Repeat("ab", 32)
+	part := bytes.Repeat([]byte("0123456789"), 20000)
+	metadata := []byte(fmt.Sprintf(`{"id":"pkgid","parts":{"%v":{"id":"%v","bytes":%v,"sources":[{"url":"%v/hzn/pkgid/%v.tar.gz"}]}}}`, partID, partID, len(part), server.URL, partID))
+
+	pkgDir := path.Join(local, "pkgid")
+	pkgFile := path.Join(local, "pkgid.json")
+	pkgSigFile := path.Join(local, "pkgid.json.sig")
+	assert.Nil(t, os.Mkdir(pkgDir, 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(pkgDir, partID+".tar.gz"), part, 0644))
+	assert.Nil(t, ioutil.WriteFile(pkgFile, metadata, 0644))
+	assert.Nil(t, ioutil.WriteFile(pkgSigFile, []byte("sig"), 0644))
+
+	// serve the Pkg as uploaded, under /hzn
+	assert.Nil(t, os.MkdirAll(path.Join(served, "hzn", "pkgid"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(served, "hzn", "pkgid", partID+".tar.gz"), part, 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(served, "hzn", "pkgid.json"), metadata, 0644))
+
+	var out bytes.Buffer
+
+	// the signature file is missing
+	err = Verify(context.Background(), nil, &out, pkgDir, pkgFile, pkgSigFile, nil, true, false)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "/hzn/pkgid.json.sig responded with status 404")
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(served, "hzn", "pkgid.json.sig"), []byte("sig"), 0644))
+	out.Reset()
+	assert.Nil(t, Verify(context.Background(), nil, &out, pkgDir, pkgFile, pkgSigFile, nil, true, false))
+	assert.Equal(t, 3, strings.Count(out.String(), "Verified upload of"))
+
+	// a truncated part
+	assert.Nil(t, ioutil.WriteFile(path.Join(served, "hzn", "pkgid", partID+".tar.gz"), part[:1000], 0644))
+	err = Verify(context.Background(), nil, &out, pkgDir, pkgFile, pkgSigFile, nil, false, false)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "has 1000 bytes, expected 200000")
+
+	// a corrupted part of the right size fails only the spot check
+	corrupted := bytes.Repeat([]byte("9876543210"), 20000)
+	assert.Nil(t, ioutil.WriteFile(path.Join(served, "hzn", "pkgid", partID+".tar.gz"), corrupted, 0644))
+	assert.Nil(t, Verify(context.Background(), nil, &out, pkgDir, pkgFile, pkgSigFile, nil, false, false))
+	err = Verify(context.Background(), nil, &out, pkgDir, pkgFile, pkgSigFile, nil, true, false)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "doesn't match the local file")
+
+	// URLs that can't be checked are skipped
+	out.Reset()
+	assert.Nil(t, Verify(context.Background(), nil, &out, pkgDir, pkgFile, pkgSigFile, func(name string) string { return "ipfs://bafk/" + name }, true, false))
+	assert.Equal(t, 3, strings.Count(out.String(), "[WARN] upload: Unable to verify upload"))
+
+	// unless strict
+	err = Verify(context.Background(), nil, &out, pkgDir, pkgFile, pkgSigFile, func(name string) string { return "ipfs://bafk/" + name }, true, true)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "its URL isn't an HTTP(S) URL")
+
+	// checksum files are verified beside the metadata and aren't taken for unrecorded parts
+	assert.Nil(t, ioutil.WriteFile(path.Join(served, "hzn", "pkgid", partID+".tar.gz"), part, 0644))
+	for _, file := range []string{path.Join("pkgid", "SHA256SUMS"), path.Join("pkgid", partID+".tar.gz.sha256"), "pkgid.json.sha256"} {
+		assert.Nil(t, ioutil.WriteFile(path.Join(local, file), []byte(file), 0644))
+		assert.Nil(t, ioutil.WriteFile(path.Join(served, "hzn", file), []byte(file), 0644))
+	}
+	out.Reset()
+	assert.Nil(t, Verify(context.Background(), nil, &out, pkgDir, pkgFile, pkgSigFile, nil, true, false))
+	assert.Equal(t, 6, strings.Count(out.String(), "Verified upload of"))
+}
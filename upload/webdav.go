@@ -0,0 +1,487 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webdavChunkSize is the size of the chunks larger files are put in
+const webdavChunkSize = 8 * 1024 * 1024
+
+// errRangesUnsupported is returned by putChunks if the server doesn't take
+// ranged PUT requests, so the file must be put whole
+var errRangesUnsupported = errors.New("WebDAV server doesn't support ranged PUT requests")
+
+// webdavUploader puts files in a WebDAV collection (e.g. a Nextcloud
+// folder), creating collections as needed, or, if plain, on an HTTP server
+// taking PUT requests, answering Basic or Digest authentication challenges.
+// Files larger than a chunk are put chunk by chunk with ranged PUT requests
+// (see putChunks), so an interrupted upload can be resumed, unless the
+// server turns out not to support them.
+type webdavUploader struct {
+	httpClient *http.Client
+	base       *url.URL
+	username   string
+	password   string
+	chunkSize  int64
+	resume     *resumeStore
+
+	// set for plain HTTP servers, which have no collections to create or files to move
+	plain bool
+
+	lock sync.Mutex
+
+	// collections already created
+	created map[string]bool
+
+	// set once the server refuses ranged PUT requests
+	noRanges bool
+
+	// the server's last authentication challenge, reused to authenticate requests up front
+	scheme string
+	params map[string]string
+	nc     int
+}
+
+// newWebDAVUploader returns an uploader for a destination URL of the form
+// dav[s]://[user@]host[:port]/path, contacted over HTTP(S)
+func newWebDAVUploader(u *url.URL, username string, password string) (*webdavUploader, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 'davs://[user@]host[:port]/path'", u)
+	}
+
+	base := *u
+	base.Scheme = "https"
+	if u.Scheme == "dav" {
+		base.Scheme = "http"
+	}
+	base.Path = strings.TrimRight(u.Path, "/")
+	base.RawPath = ""
+	base.User = nil
+
+	if username == "" && u.User != nil {
+		username = u.User.Username()
+	}
+
+	return &webdavUploader{
+		httpClient: &http.Client{Timeout: 10 * time.Minute},
+		base:       &base,
+		username:   username,
+		password:   password,
+		chunkSize:  webdavChunkSize,
+		resume:     newResumeStore(),
+		created:    map[string]bool{},
+	}, nil
+}
+
+// newHTTPUploader returns an uploader for a destination URL of the form
+// http[s]://[user@]host[:port]/path, whose server takes the files in PUT
+// requests to their URLs (e.g. nginx with its WebDAV module's PUT method
+// enabled, or a CDN's origin storage API)
+func newHTTPUploader(u *url.URL, username string, password string) (*webdavUploader, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("Unable to use upload destination %v, expected format 'https://[user@]host[:port]/path'", u)
+	}
+
+	dav := *u
+	dav.Scheme = "davs"
+	if u.Scheme == "http" {
+		dav.Scheme = "dav"
+	}
+
+	w, err := newWebDAVUploader(&dav, username, password)
+	if err != nil {
+		return nil, err
+	}
+	w.plain = true
+	return w, nil
+}
+
+func (w *webdavUploader) URL(name string) string {
+	u := *w.base
+	u.Path = path.Join(w.base.Path, name)
+	if name == "" {
+		u.Path = w.base.Path + "/"
+	}
+	return u.String()
+}
+
+// Put creates the collections within the destination the file goes in,
+// unless the server is plain, then puts the file, chunk by chunk if it's
+// larger than a chunk
+func (w *webdavUploader) Put(ctx context.Context, name string, localPath string) error {
+	_, err := w.putStatus(ctx, name, localPath)
+	return err
+}
+
+func (w *webdavUploader) putStatus(ctx context.Context, name string, localPath string) (int, error) {
+	collections := []string{}
+	for dir := path.Dir(path.Join("/", name)); dir != "/"; dir = path.Dir(dir) {
+		collections = append([]string{dir}, collections...)
+	}
+
+	// the destination itself may need creating too
+	if !w.plain {
+		for _, collection := range append([]string{""}, collections...) {
+			if err := w.mkcol(ctx, collection); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	w.lock.Lock()
+	chunked := info.Size() > w.chunkSize && !w.noRanges
+	w.lock.Unlock()
+
+	if chunked {
+		status, err := w.putChunks(ctx, f, info.Size(), name, w.resume.key(w.URL(name), info))
+		if err != errRangesUnsupported {
+			return status, err
+		}
+	}
+
+	resp, err := w.do(ctx, http.MethodPut, w.URL(name), nil, func() io.Reader { return io.NewSectionReader(f, 0, info.Size()) }, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return resp.StatusCode, nil
+	default:
+		return 0, w.statusError(resp, name)
+	}
+}
+
+// webdavUploadState is the persisted progress of a chunk-by-chunk upload
+type webdavUploadState struct {
+	// PartName is the name, relative to the destination, of the file the chunks are put in
+	PartName  string
+	ChunkSize int64
+
+	// Offset is the number of bytes put
+	Offset int64
+}
+
+// putChunks puts the file chunk by chunk in a hidden file beside the given
+// name, continuing an earlier upload whose state was saved under the given
+// key, if any, then moves it to the name, so the file never appears
+// incomplete. Plain servers can't move files, so the chunks are put under the
+// name itself; the Pkg metadata, put last, refers to the file only once it's
+// complete. The first chunk creates the file and later ones are put with a
+// Content-Range header, as Apache's mod_dav and others take them. Servers that
+// refuse those, or ignore them and replace the file with the chunk, which is
+// checked after each, get errRangesUnsupported.
+func (w *webdavUploader) putChunks(ctx context.Context, f *os.File, size int64, name string, key string) (int, error) {
+	var state webdavUploadState
+	resumed := w.resume.load(key, &state) && state.PartName != "" && state.ChunkSize == w.chunkSize
+	if resumed {
+		// an interrupted chunk may have been written in part; it's put again
+		partSize, exists, err := w.Head(ctx, state.PartName)
+		if err != nil {
+			return 0, err
+		}
+		resumed = exists && partSize >= state.Offset && partSize <= size
+	}
+	if !resumed {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return 0, err
+		}
+		state = webdavUploadState{PartName: path.Join(path.Dir(name), fmt.Sprintf(".%s.%x.part", path.Base(name), suffix)), ChunkSize: w.chunkSize}
+		if w.plain {
+			state.PartName = name
+		}
+	}
+
+	status := 0
+
+	for state.Offset < size {
+		offset, length := state.Offset, w.chunkSize
+		if remaining := size - offset; remaining < length {
+			length = remaining
+		}
+
+		header := http.Header{}
+		if offset > 0 {
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		}
+
+		resp, err := w.do(ctx, http.MethodPut, w.URL(state.PartName), header, func() io.Reader { return io.NewSectionReader(f, offset, length) }, length)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+
+		switch {
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusNoContent:
+		case offset > 0 && (resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable || resp.StatusCode == http.StatusNotImplemented):
+			return 0, w.refuseRanges(ctx, state.PartName, key)
+		default:
+			return 0, w.statusError(resp, state.PartName)
+		}
+
+		if offset > 0 {
+			partSize, _, err := w.Head(ctx, state.PartName)
+			if err != nil {
+				return 0, err
+			} else if partSize < offset+length {
+				return 0, w.refuseRanges(ctx, state.PartName, key)
+			}
+		}
+
+		state.Offset = offset + length
+		w.resume.save(key, state)
+	}
+
+	if w.plain {
+		w.resume.remove(key)
+		return status, nil
+	}
+
+	header := http.Header{}
+	header.Set("Destination", w.URL(name))
+	header.Set("Overwrite", "T")
+
+	resp, err := w.do(ctx, "MOVE", w.URL(state.PartName), header, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent:
+		w.resume.remove(key)
+		return resp.StatusCode, nil
+	default:
+		return 0, w.statusError(resp, state.PartName)
+	}
+}
+
+// refuseRanges records that the server doesn't support ranged PUT requests,
+// removing the file the chunks were put in, and returns errRangesUnsupported
+func (w *webdavUploader) refuseRanges(ctx context.Context, partName string, key string) error {
+	w.lock.Lock()
+	w.noRanges = true
+	w.lock.Unlock()
+
+	w.resume.remove(key)
+	if resp, err := w.do(ctx, http.MethodDelete, w.URL(partName), nil, nil, 0); err == nil {
+		resp.Body.Close()
+	}
+	return errRangesUnsupported
+}
+
+// Head looks the file up with a HEAD request
+func (w *webdavUploader) Head(ctx context.Context, name string) (int64, bool, error) {
+	resp, err := w.do(ctx, http.MethodHead, w.URL(name), nil, nil, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, true, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, w.statusError(resp, name)
+	}
+}
+
+func (w *webdavUploader) Verify(ctx context.Context, name string, localPath string) error {
+	return verifySize(ctx, w, name, localPath)
+}
+
+// mkcol creates the given collection relative to the destination unless it exists
+func (w *webdavUploader) mkcol(ctx context.Context, collection string) error {
+	w.lock.Lock()
+	created := w.created[collection]
+	w.lock.Unlock()
+
+	if created {
+		return nil
+	}
+
+	resp, err := w.do(ctx, "MKCOL", strings.TrimRight(w.URL(collection), "/")+"/", nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// servers answer 405 Method Not Allowed for collections that exist
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusMethodNotAllowed:
+	default:
+		return w.statusError(resp, collection+"/")
+	}
+
+	w.lock.Lock()
+	w.created[collection] = true
+	w.lock.Unlock()
+	return nil
+}
+
+func (w *webdavUploader) statusError(resp *http.Response, name string) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("WebDAV server responded with status %v to %v of %v: %s", resp.StatusCode, resp.Request.Method, w.URL(name), bytes.TrimSpace(body))
+}
+
+// do sends a request with the given headers, authenticating it with the
+// last challenge received if any, and resends it once if the server
+// challenges it. The body function returns a fresh body for each attempt.
+func (w *webdavUploader) do(ctx context.Context, method string, reqURL string, header http.Header, body func() io.Reader, length int64) (*http.Response, error) {
+	challenged := false
+
+	for {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = body()
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, reqURL, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = length
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		if err := w.authorize(req); err != nil {
+			return nil, err
+		}
+
+		resp, err := w.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized || challenged || w.username == "" {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		scheme, params := cmdtools.ParseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+		if scheme != "basic" && scheme != "digest" {
+			return nil, fmt.Errorf("Unsupported authentication challenge from WebDAV server: %v", resp.Header.Get("WWW-Authenticate"))
+		}
+
+		w.lock.Lock()
+		w.scheme, w.params, w.nc = scheme, params, 0
+		w.lock.Unlock()
+
+		challenged = true
+	}
+}
+
+// authorize adds credentials answering the last challenge to the request
+func (w *webdavUploader) authorize(req *http.Request) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	switch w.scheme {
+	case "basic":
+		req.SetBasicAuth(w.username, w.password)
+	case "digest":
+		w.nc++
+		authorization, err := digestAuthorization(w.params, w.username, w.password, req.Method, req.URL.RequestURI(), w.nc)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", authorization)
+	}
+	return nil
+}
+
+// digestAuthorization answers a Digest challenge as described in RFC 7616
+func digestAuthorization(params map[string]string, username string, password string, method string, uri string, nc int) (string, error) {
+	algorithm := params["algorithm"]
+
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("Unsupported digest authentication algorithm %v", algorithm)
+	}
+
+	h := func(s string) string {
+		hasher := newHash()
+		io.WriteString(hasher, s)
+		return fmt.Sprintf("%x", hasher.Sum(nil))
+	}
+
+	cnonceBytes := make([]byte, 8)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce := fmt.Sprintf("%x", cnonceBytes)
+	ncValue := fmt.Sprintf("%08x", nc)
+
+	ha1 := h(fmt.Sprintf("%s:%s:%s", username, params["realm"], password))
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(fmt.Sprintf("%s:%s:%s", ha1, params["nonce"], cnonce))
+	}
+	ha2 := h(fmt.Sprintf("%s:%s", method, uri))
+
+	fields := []string{
+		fmt.Sprintf(`username="%s"`, username),
+		fmt.Sprintf(`realm="%s"`, params["realm"]),
+		fmt.Sprintf(`nonce="%s"`, params["nonce"]),
+		fmt.Sprintf(`uri="%s"`, uri),
+	}
+
+	qopAuth := false
+	for _, qop := range strings.Split(params["qop"], ",") {
+		qopAuth = qopAuth || strings.TrimSpace(qop) == "auth"
+	}
+
+	if qopAuth {
+		response := h(fmt.Sprintf("%s:%s:%s:%s:auth:%s", ha1, params["nonce"], ncValue, cnonce, ha2))
+		fields = append(fields, "qop=auth", "nc="+ncValue, fmt.Sprintf(`cnonce="%s"`, cnonce), fmt.Sprintf(`response="%s"`, response))
+	} else {
+		fields = append(fields, fmt.Sprintf(`response="%s"`, h(fmt.Sprintf("%s:%s:%s", ha1, params["nonce"], ha2))))
+	}
+
+	if algorithm != "" {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+	if opaque, exists := params["opaque"]; exists {
+		fields = append(fields, fmt.Sprintf(`opaque="%s"`, opaque))
+	}
+
+	return "Digest " + strings.Join(fields, ", "), nil
+}
@@ -0,0 +1,256 @@
+// +build unit
+
+package upload
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-build/cmdtools"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a fake WebDAV server requiring digest authentication
+type fakeWebDAV struct {
+	lock        sync.Mutex
+	collections map[string]bool
+	files       map[string]string
+	challenges  int
+
+	// how PUT requests with a Content-Range header are handled: "" writes
+	// the range, "ignore" replaces the file, and "refuse" responds 400
+	ranges string
+
+	// the PUT request, counted from 1, responded to with an error, if any
+	failPut int
+	puts    int
+}
+
+func md5Hex(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+func (f *fakeWebDAV) authorized(r *http.Request) bool {
+	scheme, params := cmdtools.ParseAuthChallenge(r.Header.Get("Authorization"))
+	if scheme != "digest" || params["username"] != "timmy" || params["nonce"] != "n0nce" || params["uri"] != r.URL.RequestURI() {
+		return false
+	}
+
+	ha1 := md5Hex("timmy:files:s3cret")
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	return params["response"] == md5Hex(strings.Join([]string{ha1, "n0nce", params["nc"], params["cnonce"], "auth", ha2}, ":"))
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if !f.authorized(r) {
+		f.challenges++
+		w.Header().Set("WWW-Authenticate", `Digest realm="files", nonce="n0nce", qop="auth", algorithm=MD5, opaque="op"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	parent := r.URL.Path[:strings.LastIndex(strings.TrimRight(r.URL.Path, "/"), "/")+1]
+	if parent != "/" && !f.collections[parent] {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case "MKCOL":
+		if f.collections[r.URL.Path] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		f.collections[r.URL.Path] = true
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPut:
+		f.puts++
+		if f.puts == f.failPut {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var start, end, size int
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err == nil && f.ranges != "ignore" {
+			if f.ranges == "refuse" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			content := f.files[r.URL.Path]
+			if len(content) < start {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			f.files[r.URL.Path] = content[:start] + string(body)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		f.files[r.URL.Path] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case "MOVE":
+		destination, err := url.Parse(r.Header.Get("Destination"))
+		content, exists := f.files[r.URL.Path]
+		if err != nil || !exists || r.Header.Get("Overwrite") != "T" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(f.files, r.URL.Path)
+		f.files[destination.Path] = content
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(f.files, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodHead:
+		content, exists := f.files[r.URL.Path]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func Test_WebDAV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-webdav-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	service := &fakeWebDAV{collections: map[string]bool{"/dav/": true}, files: map[string]string{}}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	destination := strings.Replace(server.URL, "http://", "dav://timmy@", 1) + "/dav/hzn/"
+	uploader, err := New(destination, Credentials{Password: "s3cret"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, server.URL+"/dav/hzn", BaseURL(uploader))
+
+	assert.Nil(t, uploader.Put(context.Background(), "5aecb701/a.tgz", writeFile(t, dir, "a.tgz", "fffff")))
+	assert.Nil(t, uploader.Put(context.Background(), "5aecb701/b.tgz", writeFile(t, dir, "b.tgz", "ggggg")))
+	assert.Nil(t, uploader.Put(context.Background(), "5aecb701.json", writeFile(t, dir, "5aecb701.json", "{}")))
+
+	assert.Equal(t, map[string]string{"/dav/hzn/5aecb701/a.tgz": "fffff", "/dav/hzn/5aecb701/b.tgz": "ggggg", "/dav/hzn/5aecb701.json": "{}"}, service.files)
+	assert.True(t, service.collections["/dav/hzn/5aecb701/"])
+
+	// later requests are authenticated up front
+	assert.Equal(t, 1, service.challenges)
+
+	size, exists, err := uploader.Head(context.Background(), "5aecb701/b.tgz")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, int64(5), size)
+	_, exists, err = uploader.Head(context.Background(), "5aecb701/c.tgz")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, uploader.Verify(context.Background(), "5aecb701.json", path.Join(dir, "5aecb701.json")))
+	assert.NotNil(t, uploader.Verify(context.Background(), "5aecb701/b.tgz", writeFile(t, dir, "b.tgz", "gggggg")))
+
+	uploader, err = New(strings.Replace(server.URL, "http://", "dav://", 1)+"/dav/hzn", Credentials{}, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, uploader.Put(context.Background(), "c.tgz", writeFile(t, dir, "c.tgz", "hhhhh")))
+
+	uploader, err = New("davs://files.example.com/remote.php/dav/files/timmy/hzn", Credentials{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://files.example.com/remote.php/dav/files/timmy/hzn/a.tgz", uploader.URL("a.tgz"))
+}
+
+func Test_WebDAV_Chunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-webdav-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Setenv("XDG_CACHE_HOME", path.Join(dir, "cache"))
+
+	large := writeFile(t, dir, "large.tgz", "0123456789abcdef")
+
+	newServer := func(ranges string, failPut int) (*fakeWebDAV, *httptest.Server) {
+		service := &fakeWebDAV{collections: map[string]bool{"/dav/": true}, files: map[string]string{}, ranges: ranges, failPut: failPut}
+		return service, httptest.NewServer(service)
+	}
+	newUploader := func(server *httptest.Server) *webdavUploader {
+		uploader, err := New(strings.Replace(server.URL, "http://", "dav://timmy@", 1)+"/dav/hzn", Credentials{Password: "s3cret"}, 0)
+		assert.Nil(t, err)
+		w := uploader.(*webdavUploader)
+		w.chunkSize = 4
+		return w
+	}
+
+	// an interrupted upload continues with the failed chunk in a later run, and the file appears whole
+	service, server := newServer("", 3)
+	defer server.Close()
+
+	assert.NotNil(t, newUploader(server).Put(context.Background(), "pkg/large.tgz", large))
+	_, exists := service.files["/dav/hzn/pkg/large.tgz"]
+	assert.False(t, exists)
+
+	assert.Nil(t, newUploader(server).Put(context.Background(), "pkg/large.tgz", large))
+	assert.Equal(t, map[string]string{"/dav/hzn/pkg/large.tgz": "0123456789abcdef"}, service.files)
+	assert.Equal(t, 5, service.puts)
+
+	files, _ := ioutil.ReadDir(path.Join(dir, "cache", "horizon-pkg-build", "uploads"))
+	assert.Equal(t, 0, len(files))
+
+	// servers that refuse ranges, or ignore them, get the file whole
+	for _, ranges := range []string{"refuse", "ignore"} {
+		service, server := newServer(ranges, 0)
+		defer server.Close()
+
+		uploader := newUploader(server)
+		assert.Nil(t, uploader.Put(context.Background(), "pkg/large.tgz", large), ranges)
+		assert.Equal(t, map[string]string{"/dav/hzn/pkg/large.tgz": "0123456789abcdef"}, service.files, ranges)
+
+		puts := service.puts
+		assert.Nil(t, uploader.Put(context.Background(), "pkg/other.tgz", large), ranges)
+		assert.Equal(t, puts+1, service.puts, ranges)
+	}
+}
+
+func Test_HTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-http-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Setenv("XDG_CACHE_HOME", path.Join(dir, "cache"))
+
+	// the server creates directories itself
+	service := &fakeWebDAV{collections: map[string]bool{"/dav/": true, "/dav/hzn/": true, "/dav/hzn/pkg/": true}, files: map[string]string{}, failPut: 3}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	destination := strings.Replace(server.URL, "http://", "http://timmy@", 1) + "/dav/hzn"
+	uploader, err := New(destination, Credentials{Password: "s3cret"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, server.URL+"/dav/hzn/pkg/a.tgz", uploader.URL("pkg/a.tgz"))
+	uploader.(*webdavUploader).chunkSize = 4
+
+	assert.Nil(t, uploader.Put(context.Background(), "pkg.json", writeFile(t, dir, "pkg.json", "{}")))
+
+	// large files are put in chunks under their names and resumed
+	large := writeFile(t, dir, "large.tgz", "0123456789")
+	assert.NotNil(t, uploader.Put(context.Background(), "pkg/large.tgz", large))
+	assert.Nil(t, uploader.Put(context.Background(), "pkg/large.tgz", large))
+
+	assert.Equal(t, map[string]string{"/dav/hzn/pkg.json": "{}", "/dav/hzn/pkg/large.tgz": "0123456789"}, service.files)
+	assert.Equal(t, 3, len(service.collections))
+	assert.Nil(t, uploader.Verify(context.Background(), "pkg/large.tgz", large))
+
+	_, err = New("https:///hzn", Credentials{}, 0)
+	assert.NotNil(t, err)
+}